@@ -1,14 +1,17 @@
 package nebula
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"os"
 	"strings"
 	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/slackhq/nebula/cert"
+	"golang.org/x/term"
 )
 
 type CertState struct {
@@ -17,6 +20,13 @@ type CertState struct {
 	rawCertificateNoKey []byte
 	publicKey           []byte
 	privateKey          []byte
+
+	// rawChain holds the marshaled intermediate CAs that signed certificate, if it was not signed by a root
+	rawChain [][]byte
+
+	// encryptedKey is the pki.key pem privateKey was decrypted from, a reload with the same pem reuses privateKey
+	// instead of asking for the passphrase again
+	encryptedKey []byte
 }
 
 func NewCertState(certificate *cert.NebulaCertificate, privateKey []byte) (*CertState, error) {
@@ -46,6 +56,11 @@ func NewCertState(certificate *cert.NebulaCertificate, privateKey []byte) (*Cert
 }
 
 func NewCertStateFromConfig(c *Config) (*CertState, error) {
+	return newCertStateFromConfig(c, nil)
+}
+
+// newCertStateFromConfig loads our certificate and key, prev is the current state when reloading
+func newCertStateFromConfig(c *Config, prev *CertState) (*CertState, error) {
 	var pemPrivateKey []byte
 	var err error
 
@@ -70,9 +85,29 @@ func NewCertStateFromConfig(c *Config) (*CertState, error) {
 		}
 	}
 
-	rawKey, _, err := cert.UnmarshalX25519PrivateKey(pemPrivateKey)
-	if err != nil {
-		return nil, fmt.Errorf("error while unmarshaling pki.key %s: %s", privPathOrPEM, err)
+	var rawKey, encryptedKey []byte
+	if cert.IsEncryptedPrivateKey(pemPrivateKey) {
+		encryptedKey = pemPrivateKey
+		if prev != nil && bytes.Equal(prev.encryptedKey, encryptedKey) {
+			rawKey = prev.privateKey
+
+		} else {
+			passphrase, err := keyPassphrase(c, privPathOrPEM, prev == nil)
+			if err != nil {
+				return nil, err
+			}
+
+			rawKey, _, err = cert.DecryptAndUnmarshalX25519PrivateKey(passphrase, pemPrivateKey)
+			if err != nil {
+				return nil, fmt.Errorf("error while decrypting pki.key %s: %s", privPathOrPEM, err)
+			}
+		}
+
+	} else {
+		rawKey, _, err = cert.UnmarshalX25519PrivateKey(pemPrivateKey)
+		if err != nil {
+			return nil, fmt.Errorf("error while unmarshaling pki.key %s: %s", privPathOrPEM, err)
+		}
 	}
 
 	var rawCert []byte
@@ -98,11 +133,32 @@ func NewCertStateFromConfig(c *Config) (*CertState, error) {
 		}
 	}
 
-	nebulaCert, _, err := cert.UnmarshalNebulaCertificateFromPEM(rawCert)
+	nebulaCert, rawCert, err := cert.UnmarshalNebulaCertificateFromPEM(rawCert)
 	if err != nil {
 		return nil, fmt.Errorf("error while unmarshaling pki.cert %s: %s", pubPathOrPEM, err)
 	}
 
+	// Anything after our certificate is the chain of intermediate CAs that lead back to a root, peers need it to
+	// verify us
+	var rawChain [][]byte
+	for len(strings.TrimSpace(string(rawCert))) > 0 {
+		var ic *cert.NebulaCertificate
+		ic, rawCert, err = cert.UnmarshalNebulaCertificateFromPEM(rawCert)
+		if err != nil {
+			return nil, fmt.Errorf("error while unmarshaling intermediate certificate in pki.cert %s: %s", pubPathOrPEM, err)
+		}
+
+		if !ic.Details.IsCA {
+			return nil, fmt.Errorf("pki.cert %s; %s is not a CA, only intermediate CAs can follow the host certificate", pubPathOrPEM, ic.Details.Name)
+		}
+
+		b, err := ic.Marshal()
+		if err != nil {
+			return nil, fmt.Errorf("error while marshaling intermediate certificate in pki.cert %s: %s", pubPathOrPEM, err)
+		}
+		rawChain = append(rawChain, b)
+	}
+
 	if nebulaCert.Expired(time.Now()) {
 		return nil, fmt.Errorf("nebula certificate for this host is expired")
 	}
@@ -115,7 +171,45 @@ func NewCertStateFromConfig(c *Config) (*CertState, error) {
 		return nil, fmt.Errorf("private key is not a pair with public key in nebula cert")
 	}
 
-	return NewCertState(nebulaCert, rawKey)
+	cs, err := NewCertState(nebulaCert, rawKey)
+	if err != nil {
+		return nil, err
+	}
+
+	cs.rawChain = rawChain
+	cs.encryptedKey = encryptedKey
+	return cs, nil
+}
+
+// keyPassphrase finds the passphrase for an encrypted pki.key. pki.key_passphrase_file wins over the
+// NEBULA_KEY_PASSPHRASE environment variable, without either we can only ask if prompt is set and stdin is a terminal.
+// Reloads never prompt, nobody is watching the terminal by then and the reload would hang
+func keyPassphrase(c *Config, keyName string, prompt bool) ([]byte, error) {
+	if path := c.GetString("pki.key_passphrase_file", ""); path != "" {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read pki.key_passphrase_file %s: %s", path, err)
+		}
+		return bytes.TrimRight(b, "\r\n"), nil
+	}
+
+	if p, ok := os.LookupEnv("NEBULA_KEY_PASSPHRASE"); ok {
+		return []byte(p), nil
+	}
+
+	fd := int(os.Stdin.Fd())
+	if !prompt || !term.IsTerminal(fd) {
+		return nil, fmt.Errorf("pki.key %s is encrypted, provide the passphrase with pki.key_passphrase_file or NEBULA_KEY_PASSPHRASE", keyName)
+	}
+
+	fmt.Fprintf(os.Stderr, "Enter passphrase for pki.key %s: ", keyName)
+	p, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return nil, fmt.Errorf("error while reading passphrase for pki.key %s: %s", keyName, err)
+	}
+
+	return p, nil
 }
 
 func loadCAFromConfig(l *logrus.Logger, c *Config) (*cert.NebulaCAPool, error) {
@@ -160,5 +254,50 @@ func loadCAFromConfig(l *logrus.Logger, c *Config) (*cert.NebulaCAPool, error) {
 		CAs.BlocklistFingerprint(fp)
 	}
 
+	crls, err := loadCRLsFromConfig(c)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, crl := range crls {
+		err := CAs.ApplyCRL(crl, time.Now())
+		if err != nil {
+			l.WithError(err).WithField("issuer", crl.Details.Issuer).WithField("version", crl.Details.Version).
+				Warn("Ignoring certificate revocation list from pki.crl")
+		}
+	}
+
 	return CAs, nil
 }
+
+// loadCRLsFromConfig reads every revocation list in pki.crl, it is not an error for pki.crl to be unset
+func loadCRLsFromConfig(c *Config) ([]*cert.NebulaCRL, error) {
+	var rawCRL []byte
+	var err error
+
+	crlPathOrPEM := c.GetString("pki.crl", "")
+	if crlPathOrPEM == "" {
+		return nil, nil
+	}
+
+	if strings.Contains(crlPathOrPEM, "-----BEGIN") {
+		rawCRL = []byte(crlPathOrPEM)
+	} else {
+		rawCRL, err = ioutil.ReadFile(crlPathOrPEM)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read pki.crl file %s: %s", crlPathOrPEM, err)
+		}
+	}
+
+	var crls []*cert.NebulaCRL
+	for len(strings.TrimSpace(string(rawCRL))) > 0 {
+		var crl *cert.NebulaCRL
+		crl, rawCRL, err = cert.UnmarshalNebulaCRLFromPEM(rawCRL)
+		if err != nil {
+			return nil, fmt.Errorf("error while parsing pki.crl: %s", err)
+		}
+		crls = append(crls, crl)
+	}
+
+	return crls, nil
+}
@@ -1,14 +1,25 @@
 package cert
 
 import (
+	"errors"
 	"fmt"
 	"strings"
+	"sync"
 	"time"
 )
 
+var ErrCRLNotNewer = errors.New("crl is not newer than the current crl for the issuer")
+
 type NebulaCAPool struct {
 	CAs           map[string]*NebulaCertificate
 	certBlocklist map[string]struct{}
+
+	// crls are the current revocation lists by issuer fingerprint. They can be replaced while the pool is in use so
+	// they are guarded by crlLock. revoked holds what each list revoked by issuer fingerprint, a list only applies to
+	// certificates its issuer is above in the chain so one root can't revoke what another root issued
+	crlLock sync.RWMutex
+	crls    map[string]*NebulaCRL
+	revoked map[string]map[string]struct{}
 }
 
 // NewCAPool creates a CAPool
@@ -16,6 +27,8 @@ func NewCAPool() *NebulaCAPool {
 	ca := NebulaCAPool{
 		CAs:           make(map[string]*NebulaCertificate),
 		certBlocklist: make(map[string]struct{}),
+		crls:          make(map[string]*NebulaCRL),
+		revoked:       make(map[string]map[string]struct{}),
 	}
 
 	return &ca
@@ -77,7 +90,8 @@ func (ncp *NebulaCAPool) ResetCertBlocklist() {
 	ncp.certBlocklist = make(map[string]struct{})
 }
 
-// IsBlocklisted returns true if the fingerprint fails to generate or has been explicitly blocklisted
+// IsBlocklisted returns true if the fingerprint fails to generate, has been explicitly blocklisted, or was revoked by
+// a crl from the CA that issued it. Use IsRevoked to also consider crls from the CAs above the issuer
 func (ncp *NebulaCAPool) IsBlocklisted(c *NebulaCertificate) bool {
 	h, err := c.Sha256Sum()
 	if err != nil {
@@ -88,9 +102,159 @@ func (ncp *NebulaCAPool) IsBlocklisted(c *NebulaCertificate) bool {
 		return true
 	}
 
+	ncp.crlLock.RLock()
+	defer ncp.crlLock.RUnlock()
+
+	_, ok := ncp.revoked[c.Details.Issuer][h]
+	return ok
+}
+
+// IsRevoked returns true if c or any CA that signed it is blocklisted, or was revoked by a crl from a CA above it.
+// chain holds the verified signers of c starting with its issuer and ending with the root, as VerifyWithChain returns
+func (ncp *NebulaCAPool) IsRevoked(c *NebulaCertificate, chain []*NebulaCertificate) bool {
+	path := append([]*NebulaCertificate{c}, chain...)
+	fps := make([]string, len(path))
+	for i, pc := range path {
+		h, err := pc.Sha256Sum()
+		if err != nil {
+			return true
+		}
+
+		if _, ok := ncp.certBlocklist[h]; ok {
+			return true
+		}
+		fps[i] = h
+	}
+
+	ncp.crlLock.RLock()
+	defer ncp.crlLock.RUnlock()
+
+	// The chain is verified so each certificate names the fingerprint of the next as its issuer
+	for i := range path {
+		for _, above := range path[i:] {
+			if _, ok := ncp.revoked[above.Details.Issuer][fps[i]]; ok {
+				return true
+			}
+		}
+	}
+
 	return false
 }
 
+// ApplyCRL verifies a crl against the CA that issued it and replaces the current crl for that CA.
+// A crl from an intermediate CA must carry the chain back to a root in the pool and only revokes certificates the
+// intermediate issued.
+// ErrCRLNotNewer is returned if we already have a crl from the issuer with the same or a greater version.
+// An applied crl stays in effect after it expires, until a newer one replaces it
+func (ncp *NebulaCAPool) ApplyCRL(crl *NebulaCRL, t time.Time) error {
+	signer, err := ncp.crlSigner(crl, t)
+	if err != nil {
+		return err
+	}
+
+	if crl.Expired(t) {
+		return fmt.Errorf("crl is expired")
+	}
+
+	if !crl.CheckSignature(signer.Details.PublicKey) {
+		return fmt.Errorf("crl signature did not match")
+	}
+
+	ncp.crlLock.Lock()
+	defer ncp.crlLock.Unlock()
+
+	if current, ok := ncp.crls[crl.Details.Issuer]; ok && current.Details.Version >= crl.Details.Version {
+		return ErrCRLNotNewer
+	}
+
+	ncp.crls[crl.Details.Issuer] = crl
+	ncp.unlockedRebuildRevoked()
+	return nil
+}
+
+// AdoptCRLs carries the crls of a pool being replaced over to this one. Unlike ApplyCRL an expired list, or one from an
+// intermediate that has expired since, is kept since it stays in effect until a newer one replaces it. An intermediate
+// is verified as of when it issued the list. A list already in this pool with the same or a greater version wins.
+// Lists that no longer verify against this pool are left out and returned by issuer fingerprint with the reason
+func (ncp *NebulaCAPool) AdoptCRLs(crls []*NebulaCRL) map[string]error {
+	failed := make(map[string]error)
+	for _, crl := range crls {
+		signer, err := ncp.crlSigner(crl, crl.Details.IssuedAt)
+		if err == nil && !crl.CheckSignature(signer.Details.PublicKey) {
+			err = fmt.Errorf("crl signature did not match")
+		}
+		if err != nil {
+			failed[crl.Details.Issuer] = err
+			continue
+		}
+
+		ncp.crlLock.Lock()
+		if current, ok := ncp.crls[crl.Details.Issuer]; !ok || current.Details.Version < crl.Details.Version {
+			ncp.crls[crl.Details.Issuer] = crl
+			ncp.unlockedRebuildRevoked()
+		}
+		ncp.crlLock.Unlock()
+	}
+
+	return failed
+}
+
+// crlSigner returns the CA that issued crl, a root in the pool or an intermediate from the chain that is verified at t
+func (ncp *NebulaCAPool) crlSigner(crl *NebulaCRL, t time.Time) (*NebulaCertificate, error) {
+	if signer, ok := ncp.CAs[crl.Details.Issuer]; ok {
+		return signer, nil
+	}
+
+	return ncp.crlIntermediate(crl, t)
+}
+
+// crlIntermediate returns the intermediate CA that issued crl after verifying it back to a root in the pool
+func (ncp *NebulaCAPool) crlIntermediate(crl *NebulaCRL, t time.Time) (*NebulaCertificate, error) {
+	for _, ca := range crl.Chain {
+		fp, err := ca.Sha256Sum()
+		if err != nil || fp != crl.Details.Issuer {
+			continue
+		}
+
+		if !ca.Details.IsCA {
+			return nil, fmt.Errorf("crl issuer is not a CA")
+		}
+
+		if _, err := ca.VerifyWithChain(t, ncp, crl.Chain); err != nil {
+			return nil, fmt.Errorf("crl issuer could not be verified: %s", err)
+		}
+
+		return ca, nil
+	}
+
+	return nil, fmt.Errorf("could not find ca for the crl")
+}
+
+// GetCRLs returns the current crl for every issuer
+func (ncp *NebulaCAPool) GetCRLs() []*NebulaCRL {
+	ncp.crlLock.RLock()
+	defer ncp.crlLock.RUnlock()
+
+	crls := make([]*NebulaCRL, 0, len(ncp.crls))
+	for _, crl := range ncp.crls {
+		crls = append(crls, crl)
+	}
+	return crls
+}
+
+// unlockedRebuildRevoked assumes you have the crl write lock and rebuilds the revoked sets from every crl
+func (ncp *NebulaCAPool) unlockedRebuildRevoked() {
+	revoked := make(map[string]map[string]struct{}, len(ncp.crls))
+	for issuer, crl := range ncp.crls {
+		set := make(map[string]struct{}, len(crl.Details.Revoked))
+		for _, fp := range crl.Details.Revoked {
+			set[fp] = struct{}{}
+		}
+		revoked[issuer] = set
+	}
+	ncp.revoked = revoked
+}
+
 // GetCAForCert attempts to return the signing certificate for the provided certificate.
 // No signature validation is performed
 func (ncp *NebulaCAPool) GetCAForCert(c *NebulaCertificate) (*NebulaCertificate, error) {
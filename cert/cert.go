@@ -3,7 +3,6 @@ package cert
 import (
 	"bytes"
 	"crypto"
-	"crypto/rand"
 	"crypto/sha256"
 	"encoding/binary"
 	"encoding/hex"
@@ -11,6 +10,7 @@ import (
 	"encoding/pem"
 	"fmt"
 	"net"
+	"sort"
 	"time"
 
 	"github.com/golang/protobuf/proto"
@@ -21,11 +21,15 @@ import (
 const publicKeyLen = 32
 
 const (
-	CertBanner              = "NEBULA CERTIFICATE"
-	X25519PrivateKeyBanner  = "NEBULA X25519 PRIVATE KEY"
-	X25519PublicKeyBanner   = "NEBULA X25519 PUBLIC KEY"
-	Ed25519PrivateKeyBanner = "NEBULA ED25519 PRIVATE KEY"
-	Ed25519PublicKeyBanner  = "NEBULA ED25519 PUBLIC KEY"
+	CertBanner                       = "NEBULA CERTIFICATE"
+	CSRBanner                        = "NEBULA CERTIFICATE REQUEST"
+	X25519PrivateKeyBanner           = "NEBULA X25519 PRIVATE KEY"
+	X25519PublicKeyBanner            = "NEBULA X25519 PUBLIC KEY"
+	EncryptedX25519PrivateKeyBanner  = "NEBULA X25519 ENCRYPTED PRIVATE KEY"
+	Ed25519PrivateKeyBanner          = "NEBULA ED25519 PRIVATE KEY"
+	Ed25519PublicKeyBanner           = "NEBULA ED25519 PUBLIC KEY"
+	EncryptedEd25519PrivateKeyBanner = "NEBULA ED25519 ENCRYPTED PRIVATE KEY"
+	CRLBanner                        = "NEBULA CRL"
 )
 
 type NebulaCertificate struct {
@@ -44,6 +48,9 @@ type NebulaCertificateDetails struct {
 	IsCA      bool
 	Issuer    string
 
+	// Metadata holds arbitrary signed key/value pairs, it is nil if the certificate has none
+	Metadata map[string]string
+
 	// Map of groups for faster lookup
 	InvertedGroups map[string]struct{}
 }
@@ -73,12 +80,31 @@ func UnmarshalNebulaCertificate(b []byte) (*NebulaCertificate, error) {
 		return nil, fmt.Errorf("encoded Subnets should be in pairs, an odd number was found")
 	}
 
+	for _, rawIp := range rc.Details.Ip6S {
+		if len(rawIp) != net.IPv6len*2 {
+			return nil, fmt.Errorf("encoded IPv6 IPs should be 32 bytes, %v bytes were found", len(rawIp))
+		}
+	}
+
+	for _, rawIp := range rc.Details.Subnet6S {
+		if len(rawIp) != net.IPv6len*2 {
+			return nil, fmt.Errorf("encoded IPv6 Subnets should be 32 bytes, %v bytes were found", len(rawIp))
+		}
+	}
+
+	// Anything other than strictly increasing keys would mean more than one encoding for the same certificate
+	for i := 1; i < len(rc.Details.Metadata); i++ {
+		if rc.Details.Metadata[i-1].Key >= rc.Details.Metadata[i].Key {
+			return nil, fmt.Errorf("encoded Metadata keys must be sorted and unique")
+		}
+	}
+
 	nc := NebulaCertificate{
 		Details: NebulaCertificateDetails{
 			Name:           rc.Details.Name,
 			Groups:         make([]string, len(rc.Details.Groups)),
-			Ips:            make([]*net.IPNet, len(rc.Details.Ips)/2),
-			Subnets:        make([]*net.IPNet, len(rc.Details.Subnets)/2),
+			Ips:            make([]*net.IPNet, len(rc.Details.Ips)/2, len(rc.Details.Ips)/2+len(rc.Details.Ip6S)),
+			Subnets:        make([]*net.IPNet, len(rc.Details.Subnets)/2, len(rc.Details.Subnets)/2+len(rc.Details.Subnet6S)),
 			NotBefore:      time.Unix(rc.Details.NotBefore, 0),
 			NotAfter:       time.Unix(rc.Details.NotAfter, 0),
 			PublicKey:      make([]byte, len(rc.Details.PublicKey)),
@@ -113,10 +139,25 @@ func UnmarshalNebulaCertificate(b []byte) (*NebulaCertificate, error) {
 		}
 	}
 
+	for _, rawIp := range rc.Details.Ip6S {
+		nc.Details.Ips = append(nc.Details.Ips, unmarshalIp6(rawIp))
+	}
+
+	for _, rawIp := range rc.Details.Subnet6S {
+		nc.Details.Subnets = append(nc.Details.Subnets, unmarshalIp6(rawIp))
+	}
+
 	for _, g := range rc.Details.Groups {
 		nc.Details.InvertedGroups[g] = struct{}{}
 	}
 
+	if len(rc.Details.Metadata) > 0 {
+		nc.Details.Metadata = make(map[string]string, len(rc.Details.Metadata))
+		for _, md := range rc.Details.Metadata {
+			nc.Details.Metadata[md.Key] = md.Value
+		}
+	}
+
 	return &nc, nil
 }
 
@@ -178,6 +219,52 @@ func UnmarshalEd25519PrivateKey(b []byte) (ed25519.PrivateKey, []byte, error) {
 	return k.Bytes, r, nil
 }
 
+// EncryptAndMarshalX25519PrivateKey encrypts an X25519 private key with a key derived from passphrase and PEM
+// encodes it
+func EncryptAndMarshalX25519PrivateKey(b []byte, passphrase []byte, kdfParams *Argon2Parameters) ([]byte, error) {
+	return encryptAndMarshalPrivateKey(EncryptedX25519PrivateKeyBanner, b, passphrase, kdfParams)
+}
+
+// EncryptAndMarshalEd25519PrivateKey encrypts an Ed25519 private key with a key derived from passphrase and PEM
+// encodes it
+func EncryptAndMarshalEd25519PrivateKey(key ed25519.PrivateKey, passphrase []byte, kdfParams *Argon2Parameters) ([]byte, error) {
+	return encryptAndMarshalPrivateKey(EncryptedEd25519PrivateKeyBanner, key, passphrase, kdfParams)
+}
+
+// DecryptAndUnmarshalX25519PrivateKey will try to pem decode and decrypt an X25519 private key, returning any other
+// bytes b or an error on failure
+func DecryptAndUnmarshalX25519PrivateKey(passphrase, b []byte) ([]byte, []byte, error) {
+	k, r, err := unmarshalAndDecryptPrivateKey(EncryptedX25519PrivateKeyBanner, "X25519", passphrase, b)
+	if err != nil {
+		return nil, r, err
+	}
+	if len(k) != publicKeyLen {
+		return nil, r, fmt.Errorf("key was not 32 bytes, is invalid X25519 private key")
+	}
+
+	return k, r, nil
+}
+
+// DecryptAndUnmarshalEd25519PrivateKey will try to pem decode and decrypt an Ed25519 private key, returning any
+// other bytes b or an error on failure
+func DecryptAndUnmarshalEd25519PrivateKey(passphrase, b []byte) (ed25519.PrivateKey, []byte, error) {
+	k, r, err := unmarshalAndDecryptPrivateKey(EncryptedEd25519PrivateKeyBanner, "Ed25519", passphrase, b)
+	if err != nil {
+		return nil, r, err
+	}
+	if len(k) != ed25519.PrivateKeySize {
+		return nil, r, fmt.Errorf("key was not 64 bytes, is invalid ed25519 private key")
+	}
+
+	return k, r, nil
+}
+
+// IsEncryptedPrivateKey reports whether the first PEM block in b is an encrypted private key
+func IsEncryptedPrivateKey(b []byte) bool {
+	k, _ := pem.Decode(b)
+	return k != nil && (k.Type == EncryptedX25519PrivateKeyBanner || k.Type == EncryptedEd25519PrivateKeyBanner)
+}
+
 // MarshalX25519PublicKey is a simple helper to PEM encode an X25519 public key
 func MarshalX25519PublicKey(b []byte) []byte {
 	return pem.EncodeToMemory(&pem.Block{Type: X25519PublicKeyBanner, Bytes: b})
@@ -224,12 +311,17 @@ func UnmarshalEd25519PublicKey(b []byte) (ed25519.PublicKey, []byte, error) {
 
 // Sign signs a nebula cert with the provided private key
 func (nc *NebulaCertificate) Sign(key ed25519.PrivateKey) error {
+	return nc.SignWith(key)
+}
+
+// SignWith signs a nebula cert with a key that may live outside of this process, see PKCS11Signer and CommandSigner
+func (nc *NebulaCertificate) SignWith(signer crypto.Signer) error {
 	b, err := proto.Marshal(nc.getRawDetails())
 	if err != nil {
 		return err
 	}
 
-	sig, err := key.Sign(rand.Reader, b, crypto.Hash(0))
+	sig, err := signWith(signer, b)
 	if err != nil {
 		return err
 	}
@@ -253,35 +345,93 @@ func (nc *NebulaCertificate) Expired(t time.Time) bool {
 
 // Verify will ensure a certificate is good in all respects (expiry, group membership, signature, cert blocklist, etc)
 func (nc *NebulaCertificate) Verify(t time.Time, ncp *NebulaCAPool) (bool, error) {
-	if ncp.IsBlocklisted(nc) {
-		return false, fmt.Errorf("certificate has been blocked")
-	}
-
-	signer, err := ncp.GetCAForCert(nc)
-	if err != nil {
+	if _, err := nc.VerifyWithChain(t, ncp, nil); err != nil {
 		return false, err
 	}
 
-	if signer.Expired(t) {
-		return false, fmt.Errorf("root certificate is expired")
-	}
+	return true, nil
+}
 
-	if nc.Expired(t) {
-		return false, fmt.Errorf("certificate is expired")
+// VerifyWithChain is Verify for a certificate that may have been signed by an intermediate CA. intermediates are the
+// untrusted CA certificates that lead from nc to a root in the pool, in any order. The verified signers are returned
+// starting with the issuer of nc and ending with the root. Every certificate in the chain must fit within the
+// constraints of every CA above it.
+func (nc *NebulaCertificate) VerifyWithChain(t time.Time, ncp *NebulaCAPool, intermediates []*NebulaCertificate) ([]*NebulaCertificate, error) {
+	if ncp.IsBlocklisted(nc) {
+		return nil, fmt.Errorf("certificate has been blocked")
 	}
 
-	if !nc.CheckSignature(signer.Details.PublicKey) {
-		return false, fmt.Errorf("certificate signature did not match")
-	}
+	byFingerprint := make(map[string]*NebulaCertificate, len(intermediates))
+	for _, ic := range intermediates {
+		fp, err := ic.Sha256Sum()
+		if err != nil {
+			return nil, fmt.Errorf("could not calculate shasum for intermediate certificate: %s", err)
+		}
+		byFingerprint[fp] = ic
+	}
+
+	var signers []*NebulaCertificate
+	path := []*NebulaCertificate{nc}
+	c := nc
+	for {
+		signer, err := ncp.GetCAForCert(c)
+		root := err == nil
+		if !root {
+			var ok bool
+			// A fingerprint can't lead back to itself but a chain can't be longer than what we were given either
+			if signer, ok = byFingerprint[c.Details.Issuer]; !ok || len(signers) >= len(intermediates) {
+				return nil, err
+			}
 
-	if err := nc.CheckRootConstrains(signer); err != nil {
-		return false, err
-	}
+			if !signer.Details.IsCA {
+				return nil, fmt.Errorf("intermediate certificate was not a CA: %s", signer.Details.Name)
+			}
 
-	return true, nil
+			if ncp.IsBlocklisted(signer) {
+				return nil, fmt.Errorf("intermediate certificate has been blocked: %s", signer.Details.Name)
+			}
+
+			if signer.Expired(t) {
+				return nil, fmt.Errorf("intermediate certificate is expired: %s", signer.Details.Name)
+			}
+
+		} else if signer.Expired(t) {
+			return nil, fmt.Errorf("root certificate is expired")
+		}
+
+		if c == nc && nc.Expired(t) {
+			return nil, fmt.Errorf("certificate is expired")
+		}
+
+		if !c.CheckSignature(signer.Details.PublicKey) {
+			if c == nc {
+				return nil, fmt.Errorf("certificate signature did not match")
+			}
+			return nil, fmt.Errorf("intermediate certificate signature did not match: %s", c.Details.Name)
+		}
+
+		for _, pc := range path {
+			if err := pc.CheckRootConstrains(signer); err != nil {
+				return nil, err
+			}
+		}
+
+		signers = append(signers, signer)
+		if root {
+			// Each certificate was checked against the crl of its own issuer on the way up, a crl from a CA further
+			// up the chain can revoke it as well
+			if len(signers) > 1 && ncp.IsRevoked(nc, signers) {
+				return nil, fmt.Errorf("certificate has been blocked")
+			}
+			return signers, nil
+		}
+
+		path = append(path, signer)
+		c = signer
+	}
 }
 
-// CheckRootConstrains returns an error if the certificate violates constraints set on the root (groups, ips, subnets)
+// CheckRootConstrains returns an error if the certificate violates constraints set on the root (groups, ips, subnets, metadata)
 func (nc *NebulaCertificate) CheckRootConstrains(signer *NebulaCertificate) error {
 	// Make sure this cert wasn't valid before the root
 	if signer.Details.NotAfter.Before(nc.Details.NotAfter) {
@@ -320,6 +470,13 @@ func (nc *NebulaCertificate) CheckRootConstrains(signer *NebulaCertificate) erro
 		}
 	}
 
+	// Any metadata key the signer has pins the value for the certs it signs
+	for k, v := range signer.Details.Metadata {
+		if cv, ok := nc.Details.Metadata[k]; ok && cv != v {
+			return fmt.Errorf("certificate metadata %s does not match the signing ca: %s", k, cv)
+		}
+	}
+
 	return nil
 }
 
@@ -374,6 +531,14 @@ func (nc *NebulaCertificate) String() string {
 		s += "\t\tGroups: []\n"
 	}
 
+	if len(nc.Details.Metadata) > 0 {
+		s += "\t\tMetadata: [\n"
+		for _, k := range nc.metadataKeys() {
+			s += fmt.Sprintf("\t\t\t\"%v\": \"%v\"\n", k, nc.Details.Metadata[k])
+		}
+		s += "\t\t]\n"
+	}
+
 	s += fmt.Sprintf("\t\tNot before: %v\n", nc.Details.NotBefore)
 	s += fmt.Sprintf("\t\tNot After: %v\n", nc.Details.NotAfter)
 	s += fmt.Sprintf("\t\tIs CA: %v\n", nc.Details.IsCA)
@@ -401,12 +566,25 @@ func (nc *NebulaCertificate) getRawDetails() *RawNebulaCertificateDetails {
 		IsCA:      nc.Details.IsCA,
 	}
 
+	// IPv4 networks keep the original uint32 pair encoding so existing certificates remain byte for byte identical
 	for _, ipNet := range nc.Details.Ips {
-		rd.Ips = append(rd.Ips, ip2int(ipNet.IP), ip2int(ipNet.Mask))
+		if isIPv4Net(ipNet) {
+			rd.Ips = append(rd.Ips, ip2int(ipNet.IP), ip2int(ipNet.Mask))
+		} else {
+			rd.Ip6S = append(rd.Ip6S, marshalIp6(ipNet))
+		}
 	}
 
 	for _, ipNet := range nc.Details.Subnets {
-		rd.Subnets = append(rd.Subnets, ip2int(ipNet.IP), ip2int(ipNet.Mask))
+		if isIPv4Net(ipNet) {
+			rd.Subnets = append(rd.Subnets, ip2int(ipNet.IP), ip2int(ipNet.Mask))
+		} else {
+			rd.Subnet6S = append(rd.Subnet6S, marshalIp6(ipNet))
+		}
+	}
+
+	for _, k := range nc.metadataKeys() {
+		rd.Metadata = append(rd.Metadata, &RawNebulaCertificateMetadata{Key: k, Value: nc.Details.Metadata[k]})
 	}
 
 	copy(rd.PublicKey, nc.Details.PublicKey[:])
@@ -417,6 +595,16 @@ func (nc *NebulaCertificate) getRawDetails() *RawNebulaCertificateDetails {
 	return rd
 }
 
+// metadataKeys returns the metadata keys in the order they are encoded
+func (nc *NebulaCertificate) metadataKeys() []string {
+	keys := make([]string, 0, len(nc.Details.Metadata))
+	for k := range nc.Details.Metadata {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
 // Marshal will marshal a nebula cert into a protobuf byte array
 func (nc *NebulaCertificate) Marshal() ([]byte, error) {
 	rc := RawNebulaCertificate{
@@ -472,6 +660,11 @@ func (nc *NebulaCertificate) MarshalJSON() ([]byte, error) {
 		"fingerprint": fp,
 		"signature":   fmt.Sprintf("%x", nc.Signature),
 	}
+
+	if len(nc.Details.Metadata) > 0 {
+		jc["details"].(m)["metadata"] = nc.Details.Metadata
+	}
+
 	return json.Marshal(jc)
 }
 
@@ -529,6 +722,13 @@ func (nc *NebulaCertificate) Copy() *NebulaCertificate {
 		c.Details.InvertedGroups[g] = struct{}{}
 	}
 
+	if nc.Details.Metadata != nil {
+		c.Details.Metadata = make(map[string]string, len(nc.Details.Metadata))
+		for k, v := range nc.Details.Metadata {
+			c.Details.Metadata[k] = v
+		}
+	}
+
 	return c
 }
 
@@ -545,13 +745,16 @@ func netMatch(certIp *net.IPNet, rootIps []*net.IPNet) bool {
 func maskContains(caMask, certMask net.IPMask) bool {
 	caM := maskTo4(caMask)
 	cM := maskTo4(certMask)
-	// Make sure forcing to ipv4 didn't nuke us
 	if caM == nil || cM == nil {
-		return false
+		// At least one mask is not ipv4, they are only comparable if both are ipv6
+		if len(caMask) != net.IPv6len || len(certMask) != net.IPv6len {
+			return false
+		}
+		caM, cM = caMask, certMask
 	}
 
 	// Make sure the cert mask is not greater than the ca mask
-	for i := 0; i < len(caMask); i++ {
+	for i := 0; i < len(caM); i++ {
 		if caM[i] > cM[i] {
 			return false
 		}
@@ -581,6 +784,29 @@ func isZeros(b []byte) bool {
 	return true
 }
 
+// isIPv4Net returns true if the network is an ipv4 network, regardless of how the ip and mask are stored
+func isIPv4Net(ipNet *net.IPNet) bool {
+	return ipNet.IP.To4() != nil && maskTo4(ipNet.Mask) != nil
+}
+
+// marshalIp6 packs an ipv6 network into the 32 byte ip and mask form used by the raw certificate
+func marshalIp6(ipNet *net.IPNet) []byte {
+	b := make([]byte, net.IPv6len*2)
+	copy(b, ipNet.IP.To16())
+	copy(b[net.IPv6len:], ipNet.Mask)
+	return b
+}
+
+func unmarshalIp6(b []byte) *net.IPNet {
+	ipNet := &net.IPNet{
+		IP:   make(net.IP, net.IPv6len),
+		Mask: make(net.IPMask, net.IPv6len),
+	}
+	copy(ipNet.IP, b[:net.IPv6len])
+	copy(ipNet.Mask, b[net.IPv6len:])
+	return ipNet
+}
+
 func ip2int(ip []byte) uint32 {
 	if len(ip) == 16 {
 		return binary.BigEndian.Uint32(ip[12:16])
@@ -2,6 +2,7 @@ package cert
 
 import (
 	"crypto/rand"
+	"encoding/pem"
 	"fmt"
 	"io"
 	"net"
@@ -71,6 +72,118 @@ func TestMarshalingNebulaCertificate(t *testing.T) {
 	assert.EqualValues(t, nc.Details.Groups, nc2.Details.Groups)
 }
 
+func TestMarshalingNebulaCertificate_IPv6(t *testing.T) {
+	before := time.Now().Add(time.Second * -60).Round(time.Second)
+	after := time.Now().Add(time.Second * 60).Round(time.Second)
+	pubKey := []byte("1234567890abcedfghij1234567890ab")
+
+	nc := NebulaCertificate{
+		Details: NebulaCertificateDetails{
+			Name: "testing",
+			Ips: []*net.IPNet{
+				{IP: net.ParseIP("10.1.1.1"), Mask: net.IPMask(net.ParseIP("255.255.255.0"))},
+				{IP: net.ParseIP("fd00::1"), Mask: net.CIDRMask(64, 128)},
+			},
+			Subnets: []*net.IPNet{
+				{IP: net.ParseIP("9.1.1.0"), Mask: net.IPMask(net.ParseIP("255.255.255.0"))},
+				{IP: net.ParseIP("fd01:1::"), Mask: net.CIDRMask(48, 128)},
+			},
+			NotBefore: before,
+			NotAfter:  after,
+			PublicKey: pubKey,
+		},
+		Signature: []byte("1234567890abcedfghij1234567890ab"),
+	}
+
+	b, err := nc.Marshal()
+	assert.Nil(t, err)
+
+	nc2, err := UnmarshalNebulaCertificate(b)
+	assert.Nil(t, err)
+
+	assert.Len(t, nc2.Details.Ips, 2)
+	assert.Equal(t, "10.1.1.1/24", nc2.Details.Ips[0].String())
+	assert.Equal(t, "fd00::1/64", nc2.Details.Ips[1].String())
+	assert.Len(t, nc2.Details.Subnets, 2)
+	assert.Equal(t, "9.1.1.0/24", nc2.Details.Subnets[0].String())
+	assert.Equal(t, "fd01:1::/48", nc2.Details.Subnets[1].String())
+
+	// A v4 only cert must not use the ipv6 fields so that it stays compatible with older versions
+	nc.Details.Ips = nc.Details.Ips[:1]
+	nc.Details.Subnets = nc.Details.Subnets[:1]
+	rd := nc.getRawDetails()
+	assert.Empty(t, rd.Ip6S)
+	assert.Empty(t, rd.Subnet6S)
+	assert.Len(t, rd.Ips, 2)
+
+	// A malformed ipv6 entry should be rejected
+	rd.Ip6S = [][]byte{{1, 2, 3}}
+	b, err = proto.Marshal(&RawNebulaCertificate{Details: rd, Signature: nc.Signature})
+	assert.Nil(t, err)
+	_, err = UnmarshalNebulaCertificate(b)
+	assert.EqualError(t, err, "encoded IPv6 IPs should be 32 bytes, 3 bytes were found")
+}
+
+func TestMarshalingNebulaCertificate_Metadata(t *testing.T) {
+	nc := NebulaCertificate{
+		Details: NebulaCertificateDetails{
+			Name:      "testing",
+			NotBefore: time.Unix(1, 0),
+			NotAfter:  time.Unix(2, 0),
+			PublicKey: []byte("1234567890abcedfghij1234567890ab"),
+			Metadata:  map[string]string{"env": "prod", "app": "web", "empty": ""},
+		},
+		Signature: []byte("1234567890abcedfghij1234567890ab"),
+	}
+
+	// Keys are always encoded in order
+	rd := nc.getRawDetails()
+	assert.Len(t, rd.Metadata, 3)
+	assert.Equal(t, "app", rd.Metadata[0].Key)
+	assert.Equal(t, "empty", rd.Metadata[1].Key)
+	assert.Equal(t, "env", rd.Metadata[2].Key)
+	assert.Equal(t, "prod", rd.Metadata[2].Value)
+
+	b, err := nc.Marshal()
+	assert.Nil(t, err)
+
+	nc2, err := UnmarshalNebulaCertificate(b)
+	assert.Nil(t, err)
+	assert.Equal(t, nc.Details.Metadata, nc2.Details.Metadata)
+
+	b2, err := nc2.Marshal()
+	assert.Nil(t, err)
+	assert.Equal(t, b, b2)
+
+	assert.Contains(t, nc2.String(), "\t\tMetadata: [\n\t\t\t\"app\": \"web\"\n\t\t\t\"empty\": \"\"\n\t\t\t\"env\": \"prod\"\n\t\t]\n")
+
+	jb, err := nc2.MarshalJSON()
+	assert.Nil(t, err)
+	assert.Contains(t, string(jb), `"metadata":{"app":"web","empty":"","env":"prod"}`)
+
+	// Unsorted or duplicate keys should be rejected
+	rd.Metadata[0], rd.Metadata[1] = rd.Metadata[1], rd.Metadata[0]
+	b, err = proto.Marshal(&RawNebulaCertificate{Details: rd, Signature: nc.Signature})
+	assert.Nil(t, err)
+	_, err = UnmarshalNebulaCertificate(b)
+	assert.EqualError(t, err, "encoded Metadata keys must be sorted and unique")
+
+	rd.Metadata[0] = rd.Metadata[1]
+	b, err = proto.Marshal(&RawNebulaCertificate{Details: rd, Signature: nc.Signature})
+	assert.Nil(t, err)
+	_, err = UnmarshalNebulaCertificate(b)
+	assert.EqualError(t, err, "encoded Metadata keys must be sorted and unique")
+
+	// A certificate without metadata doesn't grow a field
+	nc.Details.Metadata = nil
+	b, err = nc.Marshal()
+	assert.Nil(t, err)
+	nc2, err = UnmarshalNebulaCertificate(b)
+	assert.Nil(t, err)
+	assert.Nil(t, nc2.Details.Metadata)
+	assert.NotContains(t, nc2.String(), "Metadata")
+}
+
 func TestNebulaCertificate_Sign(t *testing.T) {
 	before := time.Now().Add(time.Second * -60).Round(time.Second)
 	after := time.Now().Add(time.Second * 60).Round(time.Second)
@@ -296,6 +409,44 @@ func TestNebulaCertificate_Verify_IPs(t *testing.T) {
 	assert.Nil(t, err)
 }
 
+func TestNebulaCertificate_Verify_IPv6(t *testing.T) {
+	_, caIp1, _ := net.ParseCIDR("fd00::/48")
+	_, caIp2, _ := net.ParseCIDR("10.0.0.0/16")
+	ca, _, caKey, err := newTestCaCert(time.Now(), time.Now().Add(10*time.Minute), []*net.IPNet{caIp1, caIp2}, []*net.IPNet{}, []string{"test"})
+	assert.Nil(t, err)
+
+	caPem, err := ca.MarshalToPEM()
+	assert.Nil(t, err)
+
+	caPool := NewCAPool()
+	caPool.AddCACertificate(caPem)
+
+	// ip is outside the network
+	cIp1 := &net.IPNet{IP: net.ParseIP("fd01::1"), Mask: net.CIDRMask(64, 128)}
+	c, _, _, err := newTestCert(ca, caKey, time.Now(), time.Now().Add(5*time.Minute), []*net.IPNet{cIp1}, []*net.IPNet{}, []string{"test"})
+	assert.Nil(t, err)
+	v, err := c.Verify(time.Now(), caPool)
+	assert.False(t, v)
+	assert.EqualError(t, err, "certificate contained an ip assignment outside the limitations of the signing ca: fd01::1/64")
+
+	// ip is within the network but mask is outside
+	cIp1 = &net.IPNet{IP: net.ParseIP("fd00::1"), Mask: net.CIDRMask(32, 128)}
+	c, _, _, err = newTestCert(ca, caKey, time.Now(), time.Now().Add(5*time.Minute), []*net.IPNet{cIp1}, []*net.IPNet{}, []string{"test"})
+	assert.Nil(t, err)
+	v, err = c.Verify(time.Now(), caPool)
+	assert.False(t, v)
+	assert.EqualError(t, err, "certificate contained an ip assignment outside the limitations of the signing ca: fd00::1/32")
+
+	// dual stack ips within the networks
+	cIp1 = &net.IPNet{IP: net.ParseIP("fd00::1"), Mask: net.CIDRMask(64, 128)}
+	cIp2 := &net.IPNet{IP: net.ParseIP("10.0.1.1"), Mask: []byte{255, 255, 255, 0}}
+	c, _, _, err = newTestCert(ca, caKey, time.Now(), time.Now().Add(5*time.Minute), []*net.IPNet{cIp1, cIp2}, []*net.IPNet{}, []string{"test"})
+	assert.Nil(t, err)
+	v, err = c.Verify(time.Now(), caPool)
+	assert.True(t, v)
+	assert.Nil(t, err)
+}
+
 func TestNebulaCertificate_Verify_Subnets(t *testing.T) {
 	_, caIp1, _ := net.ParseCIDR("10.0.0.0/16")
 	_, caIp2, _ := net.ParseCIDR("192.168.0.0/24")
@@ -375,6 +526,120 @@ func TestNebulaCertificate_Verify_Subnets(t *testing.T) {
 	assert.Nil(t, err)
 }
 
+func TestNebulaCertificate_Verify_Metadata(t *testing.T) {
+	ca, _, caKey, err := newTestCaCert(time.Now(), time.Now().Add(10*time.Minute), []*net.IPNet{}, []*net.IPNet{}, []string{})
+	assert.Nil(t, err)
+	ca.Details.Metadata = map[string]string{"env": "prod"}
+	assert.Nil(t, ca.Sign(caKey))
+
+	caPem, err := ca.MarshalToPEM()
+	assert.Nil(t, err)
+
+	caPool := NewCAPool()
+	caPool.AddCACertificate(caPem)
+
+	c, _, _, err := newTestCert(ca, caKey, time.Now(), time.Now().Add(5*time.Minute), []*net.IPNet{}, []*net.IPNet{}, []string{})
+	assert.Nil(t, err)
+
+	// Keys the ca doesn't have are free, keys it does have must match
+	c.Details.Metadata = map[string]string{"app": "web"}
+	assert.Nil(t, c.Sign(caKey))
+	v, err := c.Verify(time.Now(), caPool)
+	assert.True(t, v)
+	assert.Nil(t, err)
+
+	c.Details.Metadata = map[string]string{"app": "web", "env": "prod"}
+	assert.Nil(t, c.Sign(caKey))
+	v, err = c.Verify(time.Now(), caPool)
+	assert.True(t, v)
+	assert.Nil(t, err)
+
+	c.Details.Metadata = map[string]string{"env": "dev"}
+	assert.Nil(t, c.Sign(caKey))
+	v, err = c.Verify(time.Now(), caPool)
+	assert.False(t, v)
+	assert.EqualError(t, err, "certificate metadata env does not match the signing ca: dev")
+}
+
+func TestNebulaCertificate_VerifyWithChain(t *testing.T) {
+	root, _, rootKey, err := newTestCaCert(time.Now(), time.Now().Add(10*time.Minute), []*net.IPNet{}, []*net.IPNet{}, []string{"test-group1", "test-group2", "test-group3", "other"})
+	assert.Nil(t, err)
+
+	rootPem, err := root.MarshalToPEM()
+	assert.Nil(t, err)
+
+	caPool := NewCAPool()
+	caPool.AddCACertificate(rootPem)
+
+	inter, interKey, err := newTestIntermediateCert(root, rootKey, "inter", []string{"test-group1", "test-group2", "test-group3"})
+	assert.Nil(t, err)
+	inter2, inter2Key, err := newTestIntermediateCert(inter, interKey, "inter2", nil)
+	assert.Nil(t, err)
+
+	c, _, _, err := newTestCert(inter2, inter2Key, time.Now(), time.Now().Add(5*time.Minute), []*net.IPNet{}, []*net.IPNet{}, []string{})
+	assert.Nil(t, err)
+
+	// The chain is needed to get to the root
+	v, err := c.Verify(time.Now(), caPool)
+	assert.False(t, v)
+	assert.EqualError(t, err, "could not find ca for the certificate")
+
+	_, err = c.VerifyWithChain(time.Now(), caPool, []*NebulaCertificate{inter2})
+	assert.EqualError(t, err, "could not find ca for the certificate")
+
+	// Order doesn't matter
+	signers, err := c.VerifyWithChain(time.Now(), caPool, []*NebulaCertificate{inter, inter2})
+	assert.Nil(t, err)
+	assert.Len(t, signers, 3)
+	assert.Equal(t, inter2, signers[0])
+	assert.Equal(t, inter, signers[1])
+	assert.Equal(t, root.Signature, signers[2].Signature)
+
+	// A root signed cert doesn't need a chain and ignores one
+	rc, _, _, err := newTestCert(root, rootKey, time.Now(), time.Now().Add(5*time.Minute), []*net.IPNet{}, []*net.IPNet{}, []string{})
+	assert.Nil(t, err)
+	signers, err = rc.VerifyWithChain(time.Now(), caPool, []*NebulaCertificate{inter})
+	assert.Nil(t, err)
+	assert.Len(t, signers, 1)
+	assert.Equal(t, root.Signature, signers[0].Signature)
+
+	// Blocking an intermediate blocks everything below it
+	fp, err := inter.Sha256Sum()
+	assert.Nil(t, err)
+	caPool.BlocklistFingerprint(fp)
+	_, err = c.VerifyWithChain(time.Now(), caPool, []*NebulaCertificate{inter, inter2})
+	assert.EqualError(t, err, "intermediate certificate has been blocked: inter")
+	caPool.ResetCertBlocklist()
+
+	// An expired intermediate
+	_, err = c.VerifyWithChain(time.Now().Add(9*time.Minute), caPool, []*NebulaCertificate{inter, inter2})
+	assert.EqualError(t, err, "intermediate certificate is expired: inter2")
+
+	// Only CAs can be intermediates
+	leaf, leafKey, err := newTestIntermediateCert(inter, interKey, "leaf", nil)
+	assert.Nil(t, err)
+	leaf.Details.IsCA = false
+	assert.Nil(t, leaf.Sign(interKey))
+	c2, _, _, err := newTestCert(leaf, leafKey, time.Now(), time.Now().Add(5*time.Minute), []*net.IPNet{}, []*net.IPNet{}, []string{})
+	assert.Nil(t, err)
+	_, err = c2.VerifyWithChain(time.Now(), caPool, []*NebulaCertificate{inter, leaf})
+	assert.EqualError(t, err, "intermediate certificate was not a CA: leaf")
+
+	// A tampered intermediate
+	bad := inter2.Copy()
+	bad.Details.Name = "evil"
+	c3, _, _, err := newTestCert(bad, inter2Key, time.Now(), time.Now().Add(5*time.Minute), []*net.IPNet{}, []*net.IPNet{}, []string{})
+	assert.Nil(t, err)
+	_, err = c3.VerifyWithChain(time.Now(), caPool, []*NebulaCertificate{inter, bad})
+	assert.EqualError(t, err, "intermediate certificate signature did not match: evil")
+
+	// Constraints are inherited from every level, inter2 has no groups of its own but inter does
+	c4, _, _, err := newTestCert(inter2, inter2Key, time.Now(), time.Now().Add(5*time.Minute), []*net.IPNet{}, []*net.IPNet{}, []string{"other"})
+	assert.Nil(t, err)
+	_, err = c4.VerifyWithChain(time.Now(), caPool, []*NebulaCertificate{inter, inter2})
+	assert.EqualError(t, err, "certificate contained a group not present on the signing ca: other")
+}
+
 func TestNebulaVerifyPrivateKey(t *testing.T) {
 	ca, _, caKey, err := newTestCaCert(time.Time{}, time.Time{}, []*net.IPNet{}, []*net.IPNet{}, []string{})
 	assert.Nil(t, err)
@@ -598,6 +863,86 @@ AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=
 	assert.EqualError(t, err, "input did not contain a valid PEM encoded block")
 }
 
+func TestEncryptedPrivateKeys(t *testing.T) {
+	// Cheap parameters so the test is quick, real keys use DefaultArgon2Parameters
+	kdfParams := NewArgon2Parameters(64, 1, 1)
+	passphrase := []byte("hunter2")
+
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	edPEM, err := EncryptAndMarshalEd25519PrivateKey(edKey, passphrase, kdfParams)
+	assert.Nil(t, err)
+	assert.True(t, IsEncryptedPrivateKey(edPEM))
+	assert.False(t, IsEncryptedPrivateKey(MarshalEd25519PrivateKey(edKey)))
+	assert.False(t, IsEncryptedPrivateKey([]byte("not a pem")))
+
+	_, xKey := x25519Keypair()
+	xPEM, err := EncryptAndMarshalX25519PrivateKey(xKey, passphrase, kdfParams)
+	assert.Nil(t, err)
+	assert.True(t, IsEncryptedPrivateKey(xPEM))
+
+	// Round trip, with anything after the key returned
+	k, rest, err := DecryptAndUnmarshalEd25519PrivateKey(passphrase, appendByteSlices(edPEM, xPEM))
+	assert.Nil(t, err)
+	assert.Equal(t, edKey, k)
+	assert.Equal(t, xPEM, rest)
+
+	xk, rest, err := DecryptAndUnmarshalX25519PrivateKey(passphrase, xPEM)
+	assert.Nil(t, err)
+	assert.Equal(t, xKey, xk)
+	assert.Empty(t, rest)
+
+	// Each key has its own salt even with shared parameters
+	edPEM2, err := EncryptAndMarshalEd25519PrivateKey(edKey, passphrase, kdfParams)
+	assert.Nil(t, err)
+	assert.NotEqual(t, edPEM, edPEM2)
+
+	// Wrong passphrase
+	k, _, err = DecryptAndUnmarshalEd25519PrivateKey([]byte("hunter3"), edPEM)
+	assert.Nil(t, k)
+	assert.EqualError(t, err, "invalid passphrase or corrupt private key")
+
+	// One kind of key can't be passed off as another, even with a swapped banner
+	_, _, err = DecryptAndUnmarshalX25519PrivateKey(passphrase, edPEM)
+	assert.EqualError(t, err, "bytes did not contain a proper nebula encrypted X25519 private key banner")
+
+	p, _ := pem.Decode(edPEM)
+	p.Type = EncryptedX25519PrivateKeyBanner
+	_, _, err = DecryptAndUnmarshalX25519PrivateKey(passphrase, pem.EncodeToMemory(p))
+	assert.EqualError(t, err, "invalid passphrase or corrupt private key")
+
+	// The plain unmarshalers don't accept encrypted keys
+	_, _, err = UnmarshalEd25519PrivateKey(edPEM)
+	assert.EqualError(t, err, "bytes did not contain a proper nebula Ed25519 private key banner")
+
+	// Tampered parameters
+	p, _ = pem.Decode(xPEM)
+	var rd RawNebulaEncryptedData
+	assert.Nil(t, proto.Unmarshal(p.Bytes, &rd))
+	rd.EncryptionMetadata.EncryptionAlgorithm = "ROT13"
+	p.Bytes, _ = proto.Marshal(&rd)
+	_, _, err = DecryptAndUnmarshalX25519PrivateKey(passphrase, pem.EncodeToMemory(p))
+	assert.EqualError(t, err, "unsupported encryption algorithm: ROT13")
+
+	rd.EncryptionMetadata.EncryptionAlgorithm = "AES-256-GCM"
+	rd.EncryptionMetadata.Argon2Parameters.Iterations = 0
+	p.Bytes, _ = proto.Marshal(&rd)
+	_, _, err = DecryptAndUnmarshalX25519PrivateKey(passphrase, pem.EncodeToMemory(p))
+	assert.EqualError(t, err, "invalid argon2 parameters")
+
+	// Parameters that would take too much memory or time are refused before deriving anything
+	rd.EncryptionMetadata.Argon2Parameters.Iterations = 1
+	rd.EncryptionMetadata.Argon2Parameters.Memory = 1<<32 - 1
+	p.Bytes, _ = proto.Marshal(&rd)
+	_, _, err = DecryptAndUnmarshalX25519PrivateKey(passphrase, pem.EncodeToMemory(p))
+	assert.EqualError(t, err, "argon2 parameters are too large, memory can be at most 4194304 KiB and iterations at most 64")
+
+	rd.EncryptionMetadata.Argon2Parameters.Memory = 64
+	rd.EncryptionMetadata.Argon2Parameters.Iterations = 1 << 20
+	p.Bytes, _ = proto.Marshal(&rd)
+	_, _, err = DecryptAndUnmarshalX25519PrivateKey(passphrase, pem.EncodeToMemory(p))
+	assert.EqualError(t, err, "argon2 parameters are too large, memory can be at most 4194304 KiB and iterations at most 64")
+}
+
 func TestUnmarshalEd25519PublicKey(t *testing.T) {
 	pubKey := []byte(`# A good key
 -----BEGIN NEBULA ED25519 PUBLIC KEY-----
@@ -794,6 +1139,42 @@ func newTestCaCert(before, after time.Time, ips, subnets []*net.IPNet, groups []
 	return nc, pub, priv, nil
 }
 
+// newTestIntermediateCert creates a CA signed by ca that is valid for as long as ca is
+func newTestIntermediateCert(ca *NebulaCertificate, key []byte, name string, groups []string) (*NebulaCertificate, []byte, error) {
+	issuer, err := ca.Sha256Sum()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	nc := &NebulaCertificate{
+		Details: NebulaCertificateDetails{
+			Name:           name,
+			Groups:         groups,
+			NotBefore:      ca.Details.NotBefore,
+			NotAfter:       ca.Details.NotAfter.Add(-time.Minute),
+			PublicKey:      pub,
+			IsCA:           true,
+			Issuer:         issuer,
+			InvertedGroups: make(map[string]struct{}),
+		},
+	}
+
+	for _, g := range groups {
+		nc.Details.InvertedGroups[g] = struct{}{}
+	}
+
+	if err := nc.Sign(key); err != nil {
+		return nil, nil, err
+	}
+
+	return nc, priv, nil
+}
+
 func newTestCert(ca *NebulaCertificate, key []byte, before, after time.Time, ips, subnets []*net.IPNet, groups []string) (*NebulaCertificate, []byte, []byte, error) {
 	issuer, err := ca.Sha256Sum()
 	if err != nil {
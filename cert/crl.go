@@ -0,0 +1,236 @@
+package cert
+
+import (
+	"crypto"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/crypto/ed25519"
+)
+
+// NebulaCRL is a list of revoked certificate fingerprints signed by a CA
+type NebulaCRL struct {
+	Details   NebulaCRLDetails
+	Signature []byte
+	// Chain holds the issuer and any intermediates above it when the list was signed by an intermediate CA, it is not
+	// covered by the signature since every certificate in it is signed on its own
+	Chain []*NebulaCertificate
+}
+
+type NebulaCRLDetails struct {
+	// Issuer is the fingerprint of the CA that signed the list
+	Issuer   string
+	Version  uint64
+	IssuedAt time.Time
+	NotAfter time.Time
+	Revoked  []string
+}
+
+// UnmarshalNebulaCRL will unmarshal a protobuf byte representation of a nebula crl
+func UnmarshalNebulaCRL(b []byte) (*NebulaCRL, error) {
+	if len(b) == 0 {
+		return nil, fmt.Errorf("nil byte array")
+	}
+	var rc RawNebulaCRL
+	err := proto.Unmarshal(b, &rc)
+	if err != nil {
+		return nil, err
+	}
+
+	if rc.Details == nil {
+		return nil, fmt.Errorf("encoded Details was nil")
+	}
+
+	nc := NebulaCRL{
+		Details: NebulaCRLDetails{
+			Issuer:   hex.EncodeToString(rc.Details.Issuer),
+			Version:  rc.Details.Version,
+			IssuedAt: time.Unix(rc.Details.IssuedAt, 0),
+			NotAfter: time.Unix(rc.Details.NotAfter, 0),
+			Revoked:  make([]string, len(rc.Details.Fingerprints)),
+		},
+		Signature: make([]byte, len(rc.Signature)),
+	}
+
+	copy(nc.Signature, rc.Signature)
+	for i, fp := range rc.Details.Fingerprints {
+		nc.Details.Revoked[i] = hex.EncodeToString(fp)
+	}
+
+	for _, rawCA := range rc.Chain {
+		ca, err := UnmarshalNebulaCertificate(rawCA)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unmarshal crl chain: %s", err)
+		}
+		nc.Chain = append(nc.Chain, ca)
+	}
+
+	return &nc, nil
+}
+
+// UnmarshalNebulaCRLFromPEM will unmarshal the first pem block in a byte array, returning any non consumed data
+// or an error on failure
+func UnmarshalNebulaCRLFromPEM(b []byte) (*NebulaCRL, []byte, error) {
+	p, r := pem.Decode(b)
+	if p == nil {
+		return nil, r, fmt.Errorf("input did not contain a valid PEM encoded block")
+	}
+	if p.Type != CRLBanner {
+		return nil, r, fmt.Errorf("bytes did not contain a proper nebula crl banner")
+	}
+	crl, err := UnmarshalNebulaCRL(p.Bytes)
+	return crl, r, err
+}
+
+// Sign signs a nebula crl with the provided private key
+func (crl *NebulaCRL) Sign(key ed25519.PrivateKey) error {
+	return crl.SignWith(key)
+}
+
+// SignWith signs a nebula crl with a key that may live outside of this process
+func (crl *NebulaCRL) SignWith(signer crypto.Signer) error {
+	rd, err := crl.getRawDetails()
+	if err != nil {
+		return err
+	}
+
+	b, err := proto.Marshal(rd)
+	if err != nil {
+		return err
+	}
+
+	sig, err := signWith(signer, b)
+	if err != nil {
+		return err
+	}
+	crl.Signature = sig
+	return nil
+}
+
+// CheckSignature verifies the signature against the provided public key
+func (crl *NebulaCRL) CheckSignature(key ed25519.PublicKey) bool {
+	rd, err := crl.getRawDetails()
+	if err != nil {
+		return false
+	}
+
+	b, err := proto.Marshal(rd)
+	if err != nil {
+		return false
+	}
+	return ed25519.Verify(key, b, crl.Signature)
+}
+
+// Expired will return true if the crl is past its NotAfter time
+func (crl *NebulaCRL) Expired(t time.Time) bool {
+	return crl.Details.NotAfter.Before(t)
+}
+
+// getRawDetails marshals the raw details into protobuf ready struct
+func (crl *NebulaCRL) getRawDetails() (*RawNebulaCRLDetails, error) {
+	rd := &RawNebulaCRLDetails{
+		Version:      crl.Details.Version,
+		IssuedAt:     crl.Details.IssuedAt.Unix(),
+		NotAfter:     crl.Details.NotAfter.Unix(),
+		Fingerprints: make([][]byte, len(crl.Details.Revoked)),
+	}
+
+	var err error
+	rd.Issuer, err = hex.DecodeString(crl.Details.Issuer)
+	if err != nil {
+		return nil, fmt.Errorf("invalid issuer fingerprint: %s", err)
+	}
+
+	for i, fp := range crl.Details.Revoked {
+		rd.Fingerprints[i], err = hex.DecodeString(fp)
+		if err != nil {
+			return nil, fmt.Errorf("invalid revoked fingerprint %s: %s", fp, err)
+		}
+	}
+
+	return rd, nil
+}
+
+// Marshal will marshal a nebula crl into a protobuf byte array
+func (crl *NebulaCRL) Marshal() ([]byte, error) {
+	rd, err := crl.getRawDetails()
+	if err != nil {
+		return nil, err
+	}
+
+	rc := RawNebulaCRL{
+		Details:   rd,
+		Signature: crl.Signature,
+	}
+
+	for _, ca := range crl.Chain {
+		b, err := ca.Marshal()
+		if err != nil {
+			return nil, err
+		}
+		rc.Chain = append(rc.Chain, b)
+	}
+
+	return proto.Marshal(&rc)
+}
+
+// MarshalToPEM will marshal a nebula crl into a protobuf byte array and pem encode the result
+func (crl *NebulaCRL) MarshalToPEM() ([]byte, error) {
+	b, err := crl.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: CRLBanner, Bytes: b}), nil
+}
+
+// String will return a pretty printed representation of a nebula crl
+func (crl *NebulaCRL) String() string {
+	if crl == nil {
+		return "NebulaCRL {}\n"
+	}
+
+	s := "NebulaCRL {\n"
+	s += "\tDetails {\n"
+	s += fmt.Sprintf("\t\tIssuer: %s\n", crl.Details.Issuer)
+	s += fmt.Sprintf("\t\tVersion: %v\n", crl.Details.Version)
+	s += fmt.Sprintf("\t\tIssued at: %v\n", crl.Details.IssuedAt)
+	s += fmt.Sprintf("\t\tNot After: %v\n", crl.Details.NotAfter)
+
+	if len(crl.Details.Revoked) > 0 {
+		s += "\t\tRevoked: [\n"
+		for _, fp := range crl.Details.Revoked {
+			s += fmt.Sprintf("\t\t\t%s\n", fp)
+		}
+		s += "\t\t]\n"
+	} else {
+		s += "\t\tRevoked: []\n"
+	}
+
+	s += "\t}\n"
+	s += fmt.Sprintf("\tSignature: %x\n", crl.Signature)
+	for _, ca := range crl.Chain {
+		fp, _ := ca.Sha256Sum()
+		s += fmt.Sprintf("\tChain: %s (%s)\n", ca.Details.Name, fp)
+	}
+	s += "}"
+
+	return s
+}
+
+func (crl *NebulaCRL) MarshalJSON() ([]byte, error) {
+	jc := m{
+		"details": m{
+			"issuer":   crl.Details.Issuer,
+			"version":  crl.Details.Version,
+			"issuedAt": crl.Details.IssuedAt,
+			"notAfter": crl.Details.NotAfter,
+			"revoked":  crl.Details.Revoked,
+		},
+		"signature": fmt.Sprintf("%x", crl.Signature),
+	}
+	return json.Marshal(jc)
+}
@@ -0,0 +1,296 @@
+package cert
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMarshalingNebulaCRL(t *testing.T) {
+	ca, _, caKey, _ := newTestCaCert(time.Time{}, time.Time{}, nil, nil, nil)
+	issuer, _ := ca.Sha256Sum()
+	c, _, _, _ := newTestCert(ca, caKey, time.Time{}, time.Time{}, nil, nil, nil)
+	fp, _ := c.Sha256Sum()
+
+	crl := NebulaCRL{
+		Details: NebulaCRLDetails{
+			Issuer:   issuer,
+			Version:  3,
+			IssuedAt: time.Unix(time.Now().Unix(), 0),
+			NotAfter: time.Unix(time.Now().Add(time.Hour).Unix(), 0),
+			Revoked:  []string{fp},
+		},
+	}
+	assert.Nil(t, crl.Sign(caKey))
+
+	b, err := crl.MarshalToPEM()
+	assert.Nil(t, err)
+
+	crl2, rest, err := UnmarshalNebulaCRLFromPEM(append(b, []byte("rest")...))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("rest"), rest)
+	assert.Equal(t, crl, *crl2)
+	assert.True(t, crl2.CheckSignature(ca.Details.PublicKey))
+
+	// Tampering with the list must break the signature
+	crl2.Details.Revoked = nil
+	assert.False(t, crl2.CheckSignature(ca.Details.PublicKey))
+
+	_, _, err = UnmarshalNebulaCRLFromPEM(pemCert(t, ca))
+	assert.EqualError(t, err, "bytes did not contain a proper nebula crl banner")
+
+	crl.Details.Issuer = "not hex"
+	assert.Error(t, crl.Sign(caKey))
+}
+
+func TestNebulaCAPool_ApplyCRL(t *testing.T) {
+	ca, _, caKey, _ := newTestCaCert(time.Time{}, time.Time{}, nil, nil, nil)
+	otherCa, _, otherKey, _ := newTestCaCert(time.Time{}, time.Time{}, nil, nil, nil)
+	issuer, _ := ca.Sha256Sum()
+	c, _, _, _ := newTestCert(ca, caKey, time.Time{}, time.Time{}, nil, nil, nil)
+	fp, _ := c.Sha256Sum()
+
+	pool := NewCAPool()
+	b, _ := ca.MarshalToPEM()
+	_, err := pool.AddCACertificate(b)
+	assert.Nil(t, err)
+
+	now := time.Now()
+	newCRL := func(version uint64, notAfter time.Time, key []byte, revoked ...string) *NebulaCRL {
+		crl := &NebulaCRL{
+			Details: NebulaCRLDetails{Issuer: issuer, Version: version, IssuedAt: now, NotAfter: notAfter, Revoked: revoked},
+		}
+		assert.Nil(t, crl.Sign(key))
+		return crl
+	}
+
+	assert.False(t, pool.IsBlocklisted(c))
+
+	// Signed by someone else
+	assert.EqualError(t, pool.ApplyCRL(newCRL(1, now.Add(time.Hour), otherKey, fp), now), "crl signature did not match")
+
+	// Unknown issuer
+	unknown := newCRL(1, now.Add(time.Hour), otherKey, fp)
+	unknown.Details.Issuer, _ = otherCa.Sha256Sum()
+	assert.EqualError(t, pool.ApplyCRL(unknown, now), "could not find ca for the crl")
+
+	// Expired
+	assert.EqualError(t, pool.ApplyCRL(newCRL(1, now.Add(-time.Second), caKey, fp), now), "crl is expired")
+	assert.False(t, pool.IsBlocklisted(c))
+
+	assert.Nil(t, pool.ApplyCRL(newCRL(2, now.Add(time.Hour), caKey, fp), now))
+	assert.True(t, pool.IsBlocklisted(c))
+	assert.Len(t, pool.GetCRLs(), 1)
+
+	// Replays of older or identical versions are refused
+	assert.Equal(t, ErrCRLNotNewer, pool.ApplyCRL(newCRL(2, now.Add(time.Hour), caKey), now))
+	assert.Equal(t, ErrCRLNotNewer, pool.ApplyCRL(newCRL(1, now.Add(time.Hour), caKey), now))
+	assert.True(t, pool.IsBlocklisted(c))
+
+	// A newer list replaces the old one entirely
+	assert.Nil(t, pool.ApplyCRL(newCRL(3, now.Add(time.Hour), caKey), now))
+	assert.False(t, pool.IsBlocklisted(c))
+}
+
+func TestNebulaCAPool_ApplyCRL_Intermediate(t *testing.T) {
+	// Intermediates end a minute before their CA so give the CAs some room
+	before, after := time.Now().Add(-time.Hour), time.Now().Add(time.Hour)
+	ca, _, caKey, _ := newTestCaCert(before, after, nil, nil, nil)
+	inter, interKey, err := newTestIntermediateCert(ca, caKey, "inter", nil)
+	assert.Nil(t, err)
+	otherInter, otherInterKey, err := newTestIntermediateCert(ca, caKey, "other-inter", nil)
+	assert.Nil(t, err)
+	interFp, _ := inter.Sha256Sum()
+
+	// A cert from the intermediate, and one from the root that the intermediate tries to revoke as well
+	c, _, _, _ := newTestCert(inter, interKey, time.Time{}, time.Time{}, nil, nil, nil)
+	fp, _ := c.Sha256Sum()
+	rootCert, _, _, _ := newTestCert(ca, caKey, time.Time{}, time.Time{}, nil, nil, nil)
+	rootFp, _ := rootCert.Sha256Sum()
+	otherCert, _, _, _ := newTestCert(otherInter, otherInterKey, time.Time{}, time.Time{}, nil, nil, nil)
+	otherFp, _ := otherCert.Sha256Sum()
+
+	pool := NewCAPool()
+	_, err = pool.AddCACertificate(pemCert(t, ca))
+	assert.Nil(t, err)
+
+	now := time.Now()
+	newCRL := func(version uint64, key []byte, chain ...*NebulaCertificate) *NebulaCRL {
+		crl := &NebulaCRL{
+			Details: NebulaCRLDetails{
+				Issuer: interFp, Version: version, IssuedAt: now, NotAfter: now.Add(time.Hour),
+				Revoked: []string{fp, rootFp, otherFp},
+			},
+			Chain: chain,
+		}
+		assert.Nil(t, crl.Sign(key))
+		return crl
+	}
+
+	// The intermediate has to come along with the list
+	assert.EqualError(t, pool.ApplyCRL(newCRL(1, interKey), now), "could not find ca for the crl")
+
+	// A chain that doesn't lead to a trusted root is refused
+	untrusted, _, untrustedKey, _ := newTestCaCert(before, after, nil, nil, nil)
+	forged, forgedKey, err := newTestIntermediateCert(untrusted, untrustedKey, "inter", nil)
+	assert.Nil(t, err)
+	forgedCRL := newCRL(1, forgedKey, forged)
+	forgedCRL.Details.Issuer, _ = forged.Sha256Sum()
+	assert.Nil(t, forgedCRL.Sign(forgedKey))
+	assert.EqualError(t, pool.ApplyCRL(forgedCRL, now), "crl issuer could not be verified: could not find ca for the certificate")
+
+	assert.EqualError(t, pool.ApplyCRL(newCRL(1, otherInterKey, inter), now), "crl signature did not match")
+
+	// The chain survives being passed around
+	b, err := newCRL(1, interKey, inter).Marshal()
+	assert.Nil(t, err)
+	crl, err := UnmarshalNebulaCRL(b)
+	assert.Nil(t, err)
+	assert.Nil(t, pool.ApplyCRL(crl, now))
+
+	// Only certs the intermediate issued are revoked
+	assert.True(t, pool.IsBlocklisted(c))
+	assert.False(t, pool.IsBlocklisted(rootCert))
+	assert.False(t, pool.IsBlocklisted(otherCert))
+	assert.Len(t, pool.GetCRLs(), 1)
+
+	// A root can still revoke the intermediate itself
+	caFp, _ := ca.Sha256Sum()
+	rootCRL := &NebulaCRL{Details: NebulaCRLDetails{Issuer: caFp, Version: 1, IssuedAt: now, NotAfter: now.Add(time.Hour), Revoked: []string{interFp}}}
+	assert.Nil(t, rootCRL.Sign(caKey))
+	assert.Nil(t, pool.ApplyCRL(rootCRL, now))
+	assert.True(t, pool.IsBlocklisted(inter))
+
+	// And a revoked intermediate can't publish lists anymore
+	assert.EqualError(t, pool.ApplyCRL(newCRL(2, interKey, inter), now), "crl issuer could not be verified: certificate has been blocked")
+}
+
+func TestNebulaCAPool_ApplyCRL_MultipleRoots(t *testing.T) {
+	before, after := time.Now().Add(-time.Hour), time.Now().Add(time.Hour)
+	ca, _, caKey, _ := newTestCaCert(before, after, nil, nil, nil)
+	otherCa, _, otherCaKey, _ := newTestCaCert(before, after, nil, nil, nil)
+	inter, interKey, err := newTestIntermediateCert(ca, caKey, "inter", nil)
+	assert.Nil(t, err)
+
+	c, _, _, _ := newTestCert(ca, caKey, time.Time{}, time.Time{}, nil, nil, nil)
+	fp, _ := c.Sha256Sum()
+	leaf, _, _, _ := newTestCert(inter, interKey, time.Time{}, time.Time{}, nil, nil, nil)
+	leafFp, _ := leaf.Sha256Sum()
+	otherCert, _, _, _ := newTestCert(otherCa, otherCaKey, time.Time{}, time.Time{}, nil, nil, nil)
+	otherFp, _ := otherCert.Sha256Sum()
+
+	pool := NewCAPool()
+	_, err = pool.AddCACertificate(pemCert(t, ca))
+	assert.Nil(t, err)
+	_, err = pool.AddCACertificate(pemCert(t, otherCa))
+	assert.Nil(t, err)
+
+	chain, err := leaf.VerifyWithChain(time.Now(), pool, []*NebulaCertificate{inter})
+	assert.Nil(t, err)
+
+	// The other root tries to revoke everything it knows about
+	now := time.Now()
+	otherIssuer, _ := otherCa.Sha256Sum()
+	crl := &NebulaCRL{Details: NebulaCRLDetails{
+		Issuer: otherIssuer, Version: 1, IssuedAt: now, NotAfter: now.Add(time.Hour),
+		Revoked: []string{fp, leafFp, otherFp},
+	}}
+	assert.Nil(t, crl.Sign(otherCaKey))
+	assert.Nil(t, pool.ApplyCRL(crl, now))
+
+	// Only its own cert is affected
+	assert.True(t, pool.IsBlocklisted(otherCert))
+	assert.False(t, pool.IsBlocklisted(c))
+	assert.False(t, pool.IsRevoked(leaf, chain))
+	_, err = c.VerifyWithChain(now, pool, nil)
+	assert.Nil(t, err)
+	_, err = leaf.VerifyWithChain(now, pool, []*NebulaCertificate{inter})
+	assert.Nil(t, err)
+
+	// The right root can revoke certs below its intermediates
+	issuer, _ := ca.Sha256Sum()
+	crl = &NebulaCRL{Details: NebulaCRLDetails{
+		Issuer: issuer, Version: 1, IssuedAt: now, NotAfter: now.Add(time.Hour), Revoked: []string{leafFp},
+	}}
+	assert.Nil(t, crl.Sign(caKey))
+	assert.Nil(t, pool.ApplyCRL(crl, now))
+
+	assert.False(t, pool.IsBlocklisted(leaf))
+	assert.True(t, pool.IsRevoked(leaf, chain))
+	_, err = leaf.VerifyWithChain(now, pool, []*NebulaCertificate{inter})
+	assert.EqualError(t, err, "certificate has been blocked")
+}
+
+func TestNebulaCAPool_AdoptCRLs(t *testing.T) {
+	before, after := time.Now().Add(-3*time.Hour), time.Now().Add(time.Hour)
+	ca, _, caKey, _ := newTestCaCert(before, after, nil, nil, nil)
+	otherCa, _, otherKey, _ := newTestCaCert(before, after, nil, nil, nil)
+	issuer, _ := ca.Sha256Sum()
+	otherIssuer, _ := otherCa.Sha256Sum()
+	c, _, _, _ := newTestCert(ca, caKey, time.Time{}, time.Time{}, nil, nil, nil)
+	fp, _ := c.Sha256Sum()
+
+	newPool := func(cas ...*NebulaCertificate) *NebulaCAPool {
+		pool := NewCAPool()
+		for _, ca := range cas {
+			_, err := pool.AddCACertificate(pemCert(t, ca))
+			assert.Nil(t, err)
+		}
+		return pool
+	}
+
+	// An intermediate that has expired since it published its list
+	inter, interKey, err := newTestIntermediateCert(ca, caKey, "inter", nil)
+	assert.Nil(t, err)
+	inter.Details.NotAfter = time.Now().Add(-30 * time.Minute)
+	assert.Nil(t, inter.Sign(caKey))
+	interIssuer, _ := inter.Sha256Sum()
+	interCert, _, _, _ := newTestCert(inter, interKey, before, inter.Details.NotAfter, nil, nil, nil)
+	interFp, _ := interCert.Sha256Sum()
+
+	// Every list was applied while it was current and has expired since
+	then := time.Now().Add(-2 * time.Hour)
+	crl := &NebulaCRL{Details: NebulaCRLDetails{Issuer: issuer, Version: 2, IssuedAt: then, NotAfter: then.Add(time.Hour), Revoked: []string{fp}}}
+	assert.Nil(t, crl.Sign(caKey))
+	otherCRL := &NebulaCRL{Details: NebulaCRLDetails{Issuer: otherIssuer, Version: 1, IssuedAt: then, NotAfter: then.Add(time.Hour)}}
+	assert.Nil(t, otherCRL.Sign(otherKey))
+	interCRL := &NebulaCRL{
+		Details: NebulaCRLDetails{Issuer: interIssuer, Version: 1, IssuedAt: then, NotAfter: then.Add(time.Hour), Revoked: []string{interFp}},
+		Chain:   []*NebulaCertificate{inter},
+	}
+	assert.Nil(t, interCRL.Sign(interKey))
+
+	old := newPool(ca, otherCa)
+	assert.Nil(t, old.ApplyCRL(crl, then))
+	assert.Nil(t, old.ApplyCRL(otherCRL, then))
+	assert.Nil(t, old.ApplyCRL(interCRL, then))
+
+	// The expired lists carry over, the one from a CA that is no longer trusted is reported
+	pool := newPool(ca)
+	failed := pool.AdoptCRLs(old.GetCRLs())
+	assert.Len(t, failed, 1)
+	assert.EqualError(t, failed[otherIssuer], "could not find ca for the crl")
+	assert.True(t, pool.IsBlocklisted(c))
+	assert.True(t, pool.IsBlocklisted(interCert))
+	assert.Len(t, pool.GetCRLs(), 2)
+
+	// A newer list that came from the config is kept
+	newer := &NebulaCRL{Details: NebulaCRLDetails{Issuer: issuer, Version: 3, IssuedAt: time.Now(), NotAfter: time.Now().Add(time.Hour)}}
+	assert.Nil(t, newer.Sign(caKey))
+	pool = newPool(ca)
+	assert.Nil(t, pool.ApplyCRL(newer, time.Now()))
+	assert.Len(t, pool.AdoptCRLs([]*NebulaCRL{crl}), 0)
+	assert.False(t, pool.IsBlocklisted(c))
+
+	// Tampering is still caught
+	crl.Details.Version = 4
+	failed = newPool(ca).AdoptCRLs([]*NebulaCRL{crl})
+	assert.EqualError(t, failed[issuer], "crl signature did not match")
+}
+
+func pemCert(t *testing.T, c *NebulaCertificate) []byte {
+	b, err := c.MarshalToPEM()
+	assert.Nil(t, err)
+	return b
+}
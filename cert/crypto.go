@@ -0,0 +1,177 @@
+package cert
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/pem"
+	"fmt"
+	"io"
+
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/crypto/argon2"
+)
+
+const aes256GCM = "AES-256-GCM"
+
+// The parameters are read from the key file, these keep a corrupt or hostile one from asking for terabytes of memory or
+// days of work
+const (
+	argon2MaxMemory     = 4 * 1024 * 1024 // KiB
+	argon2MaxIterations = 64
+)
+
+// Argon2Parameters control how a passphrase is stretched into an encryption key, they are stored next to the
+// ciphertext so a key can be decrypted with whatever parameters it was encrypted with
+type Argon2Parameters struct {
+	version     rune
+	Memory      uint32 // KiB
+	Parallelism uint8
+	Iterations  uint32
+	salt        []byte
+}
+
+// NewArgon2Parameters returns parameters for argon2id with a fresh salt
+func NewArgon2Parameters(memory uint32, parallelism uint8, iterations uint32) *Argon2Parameters {
+	return &Argon2Parameters{
+		version:     argon2.Version,
+		Memory:      memory,
+		Parallelism: parallelism,
+		Iterations:  iterations,
+	}
+}
+
+// DefaultArgon2Parameters are the second recommended option from RFC 9106, cheap enough to unlock a host key at boot
+func DefaultArgon2Parameters() *Argon2Parameters {
+	return NewArgon2Parameters(64*1024, 4, 3)
+}
+
+// aes256Encrypt seals data with a key derived from passphrase, ad is authenticated but not stored
+func aes256Encrypt(passphrase []byte, kdfParams *Argon2Parameters, data []byte, ad []byte) ([]byte, error) {
+	gcm, err := newAES256GCM(passphrase, kdfParams)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %s", err)
+	}
+
+	return gcm.Seal(nonce, nonce, data, ad), nil
+}
+
+// aes256Decrypt opens data sealed by aes256Encrypt, a wrong passphrase or tampered data is an error
+func aes256Decrypt(passphrase []byte, kdfParams *Argon2Parameters, data []byte, ad []byte) ([]byte, error) {
+	gcm, err := newAES256GCM(passphrase, kdfParams)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) < gcm.NonceSize() {
+		return nil, fmt.Errorf("ciphertext is too short")
+	}
+
+	nonce, ciphertext := data[:gcm.NonceSize()], data[gcm.NonceSize():]
+	plaintext, err := gcm.Open(nil, nonce, ciphertext, ad)
+	if err != nil {
+		return nil, fmt.Errorf("invalid passphrase or corrupt private key")
+	}
+
+	return plaintext, nil
+}
+
+func newAES256GCM(passphrase []byte, kdfParams *Argon2Parameters) (cipher.AEAD, error) {
+	if kdfParams.version != argon2.Version {
+		return nil, fmt.Errorf("unsupported argon2 version: %d", kdfParams.version)
+	}
+
+	if kdfParams.Memory == 0 || kdfParams.Parallelism == 0 || kdfParams.Iterations == 0 || len(kdfParams.salt) == 0 {
+		return nil, fmt.Errorf("invalid argon2 parameters")
+	}
+
+	key := argon2.IDKey(passphrase, kdfParams.salt, kdfParams.Iterations, kdfParams.Memory, kdfParams.Parallelism, 32)
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %s", err)
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// encryptAndMarshalPrivateKey seals key under banner, the banner is authenticated so one kind of key can not be passed
+// off as another
+func encryptAndMarshalPrivateKey(banner string, key []byte, passphrase []byte, kdfParams *Argon2Parameters) ([]byte, error) {
+	// Every key gets its own salt, even when the caller reuses the parameters
+	p := *kdfParams
+	kdfParams = &p
+	kdfParams.salt = make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, kdfParams.salt); err != nil {
+		return nil, fmt.Errorf("failed to generate salt: %s", err)
+	}
+
+	ciphertext, err := aes256Encrypt(passphrase, kdfParams, key, []byte(banner))
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := proto.Marshal(&RawNebulaEncryptedData{
+		EncryptionMetadata: &RawNebulaEncryptionMetadata{
+			EncryptionAlgorithm: aes256GCM,
+			Argon2Parameters: &RawNebulaArgon2Parameters{
+				Version:     kdfParams.version,
+				Memory:      kdfParams.Memory,
+				Parallelism: uint32(kdfParams.Parallelism),
+				Iterations:  kdfParams.Iterations,
+				Salt:        kdfParams.salt,
+			},
+		},
+		Ciphertext: ciphertext,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: banner, Bytes: b}), nil
+}
+
+func unmarshalAndDecryptPrivateKey(banner string, kind string, passphrase []byte, b []byte) ([]byte, []byte, error) {
+	k, r := pem.Decode(b)
+	if k == nil {
+		return nil, r, fmt.Errorf("input did not contain a valid PEM encoded block")
+	}
+	if k.Type != banner {
+		return nil, r, fmt.Errorf("bytes did not contain a proper nebula encrypted %s private key banner", kind)
+	}
+
+	var rd RawNebulaEncryptedData
+	if err := proto.Unmarshal(k.Bytes, &rd); err != nil {
+		return nil, r, fmt.Errorf("failed to unmarshal encrypted private key: %s", err)
+	}
+
+	md := rd.EncryptionMetadata
+	if md == nil || md.Argon2Parameters == nil {
+		return nil, r, fmt.Errorf("encrypted private key is missing its encryption metadata")
+	}
+	if md.EncryptionAlgorithm != aes256GCM {
+		return nil, r, fmt.Errorf("unsupported encryption algorithm: %s", md.EncryptionAlgorithm)
+	}
+	if md.Argon2Parameters.Parallelism > 255 {
+		return nil, r, fmt.Errorf("invalid argon2 parameters")
+	}
+	if md.Argon2Parameters.Memory > argon2MaxMemory || md.Argon2Parameters.Iterations > argon2MaxIterations {
+		return nil, r, fmt.Errorf("argon2 parameters are too large, memory can be at most %d KiB and iterations at most %d", argon2MaxMemory, argon2MaxIterations)
+	}
+
+	kdfParams := &Argon2Parameters{
+		version:     md.Argon2Parameters.Version,
+		Memory:      md.Argon2Parameters.Memory,
+		Parallelism: uint8(md.Argon2Parameters.Parallelism),
+		Iterations:  md.Argon2Parameters.Iterations,
+		salt:        md.Argon2Parameters.Salt,
+	}
+
+	key, err := aes256Decrypt(passphrase, kdfParams, rd.Ciphertext, []byte(banner))
+	return key, r, err
+}
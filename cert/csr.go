@@ -0,0 +1,116 @@
+package cert
+
+import (
+	"bytes"
+	"encoding/pem"
+	"fmt"
+
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/ed25519"
+)
+
+// NebulaCSR is a request for a certificate made by the host that holds the private key. It is encoded like a
+// certificate but is signed, using XEdDSA, by the X25519 key it asks to be certified. A CA can confirm the requester
+// holds that key without the key ever leaving the host. The validity period is chosen by the CA so NotBefore and
+// NotAfter are ignored
+type NebulaCSR struct {
+	Details   NebulaCertificateDetails
+	Signature []byte
+}
+
+// UnmarshalNebulaCSR will unmarshal a protobuf byte representation of a certificate request
+func UnmarshalNebulaCSR(b []byte) (*NebulaCSR, error) {
+	nc, err := UnmarshalNebulaCertificate(b)
+	if err != nil {
+		return nil, err
+	}
+
+	if nc.Details.IsCA || nc.Details.Issuer != "" {
+		return nil, fmt.Errorf("certificate requests can not be for a CA or name an issuer")
+	}
+
+	if len(nc.Details.PublicKey) != publicKeyLen {
+		return nil, fmt.Errorf("public key was not 32 bytes, is invalid X25519 public key")
+	}
+
+	if _, err := xeddsaPublicKey(nc.Details.PublicKey); err != nil {
+		return nil, err
+	}
+
+	return &NebulaCSR{Details: nc.Details, Signature: nc.Signature}, nil
+}
+
+// UnmarshalNebulaCSRFromPEM will unmarshal the first pem block in a byte array, returning any non consumed data
+// or an error on failure
+func UnmarshalNebulaCSRFromPEM(b []byte) (*NebulaCSR, []byte, error) {
+	p, r := pem.Decode(b)
+	if p == nil {
+		return nil, r, fmt.Errorf("input did not contain a valid PEM encoded block")
+	}
+	if p.Type != CSRBanner {
+		return nil, r, fmt.Errorf("bytes did not contain a proper nebula certificate request banner")
+	}
+	csr, err := UnmarshalNebulaCSR(p.Bytes)
+	return csr, r, err
+}
+
+// Sign signs the request with the X25519 private key for Details.PublicKey
+func (csr *NebulaCSR) Sign(privateKey []byte) error {
+	pub, err := curve25519.X25519(privateKey, curve25519.Basepoint)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(pub, csr.Details.PublicKey) {
+		return fmt.Errorf("private key is not a pair with the public key in the request")
+	}
+
+	b, err := proto.Marshal(csr.certificate().getRawDetails())
+	if err != nil {
+		return err
+	}
+
+	sig, err := xeddsaSign(privateKey, b)
+	if err != nil {
+		return err
+	}
+	csr.Signature = sig
+	return nil
+}
+
+// CheckSignature verifies the request was signed by the private key for Details.PublicKey
+func (csr *NebulaCSR) CheckSignature() bool {
+	pub, err := xeddsaPublicKey(csr.Details.PublicKey)
+	if err != nil {
+		return false
+	}
+
+	b, err := proto.Marshal(csr.certificate().getRawDetails())
+	if err != nil {
+		return false
+	}
+	return ed25519.Verify(pub, b, csr.Signature)
+}
+
+// Marshal will marshal a certificate request into a protobuf byte array
+func (csr *NebulaCSR) Marshal() ([]byte, error) {
+	return csr.certificate().Marshal()
+}
+
+// MarshalToPEM will marshal a certificate request into a protobuf byte array and pem encode the result
+func (csr *NebulaCSR) MarshalToPEM() ([]byte, error) {
+	b, err := csr.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: CSRBanner, Bytes: b}), nil
+}
+
+// String will return a pretty printed representation of a certificate request
+func (csr *NebulaCSR) String() string {
+	return csr.certificate().String()
+}
+
+func (csr *NebulaCSR) certificate() *NebulaCertificate {
+	return &NebulaCertificate{Details: csr.Details, Signature: csr.Signature}
+}
@@ -0,0 +1,133 @@
+package cert
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ed25519"
+)
+
+func TestNebulaCSR(t *testing.T) {
+	pub, priv := x25519Keypair()
+
+	csr := NebulaCSR{
+		Details: NebulaCertificateDetails{
+			Name:     "host1",
+			Ips:      []*net.IPNet{{IP: net.ParseIP("10.1.1.1").To4(), Mask: net.IPMask{255, 255, 255, 0}}},
+			Groups:   []string{"servers"},
+			Metadata: map[string]string{"env": "prod"},
+		},
+	}
+
+	_, otherPriv := x25519Keypair()
+	csr.Details.PublicKey = pub
+	assert.EqualError(t, csr.Sign(otherPriv), "private key is not a pair with the public key in the request")
+
+	assert.Nil(t, csr.Sign(priv))
+	assert.True(t, csr.CheckSignature())
+
+	b, err := csr.MarshalToPEM()
+	assert.Nil(t, err)
+
+	csr2, rest, err := UnmarshalNebulaCSRFromPEM(b)
+	assert.Nil(t, err)
+	assert.Empty(t, rest)
+	assert.True(t, csr2.CheckSignature())
+	assert.Equal(t, "host1", csr2.Details.Name)
+	assert.Equal(t, []string{"servers"}, csr2.Details.Groups)
+	assert.Equal(t, map[string]string{"env": "prod"}, csr2.Details.Metadata)
+	assert.Equal(t, pub, csr2.Details.PublicKey)
+
+	// Any change to the request invalidates it
+	csr2.Details.Groups = []string{"servers", "admins"}
+	assert.False(t, csr2.CheckSignature())
+
+	csr2.Details.Groups = csr.Details.Groups
+	csr2.Details.PublicKey, _ = x25519Keypair()
+	assert.False(t, csr2.CheckSignature())
+
+	// A certificate is not a request
+	nc := csr.certificate()
+	certPEM, err := nc.MarshalToPEM()
+	assert.Nil(t, err)
+	_, _, err = UnmarshalNebulaCSRFromPEM(certPEM)
+	assert.EqualError(t, err, "bytes did not contain a proper nebula certificate request banner")
+
+	nc.Details.IsCA = true
+	b, err = nc.Marshal()
+	assert.Nil(t, err)
+	_, err = UnmarshalNebulaCSR(b)
+	assert.EqualError(t, err, "certificate requests can not be for a CA or name an issuer")
+
+	// Nor is one for a low order public key, any signature would check out for it
+	nc.Details.IsCA = false
+	nc.Details.PublicKey = make([]byte, 32)
+	b, err = nc.Marshal()
+	assert.Nil(t, err)
+	_, err = UnmarshalNebulaCSR(b)
+	assert.EqualError(t, err, "X25519 public key has low order")
+
+	csr2.Details.PublicKey = nc.Details.PublicKey
+	assert.False(t, csr2.CheckSignature())
+}
+
+func TestXEdDSA(t *testing.T) {
+	msg := []byte("a message")
+
+	// Cover private keys whose edwards public key has either sign bit
+	for i := 0; i < 32; i++ {
+		pub, priv := x25519Keypair()
+
+		sig, err := xeddsaSign(priv, msg)
+		assert.Nil(t, err)
+
+		edPub, err := xeddsaPublicKey(pub)
+		assert.Nil(t, err)
+		assert.True(t, ed25519.Verify(edPub, msg, sig))
+		assert.False(t, ed25519.Verify(edPub, []byte("another message"), sig))
+	}
+
+	// u = -1 has no edwards equivalent
+	minusOne := []byte{
+		0xec, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff,
+		0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x7f,
+	}
+	_, err := xeddsaPublicKey(minusOne)
+	assert.EqualError(t, err, "invalid X25519 public key")
+
+	// The small subgroup, u = 0, 1 and the two points of order 8
+	lowOrder := [][]byte{
+		make([]byte, 32),
+		append([]byte{0x01}, make([]byte, 31)...),
+		{
+			0xe0, 0xeb, 0x7a, 0x7c, 0x3b, 0x41, 0xb8, 0xae, 0x16, 0x56, 0xe3, 0xfa, 0xf1, 0x9f, 0xc4, 0x6a,
+			0xda, 0x09, 0x8d, 0xeb, 0x9c, 0x32, 0xb1, 0xfd, 0x86, 0x62, 0x05, 0x16, 0x5f, 0x49, 0xb8, 0x00,
+		},
+		{
+			0x5f, 0x9c, 0x95, 0xbc, 0xa3, 0x50, 0x8c, 0x24, 0xb1, 0xd0, 0xb1, 0x55, 0x9c, 0x83, 0xef, 0x5b,
+			0x04, 0x44, 0x5c, 0xc4, 0x58, 0x1c, 0x8e, 0x86, 0xd8, 0x22, 0x4e, 0xdd, 0xd0, 0x9f, 0x11, 0x57,
+		},
+	}
+	for _, u := range lowOrder {
+		_, err = xeddsaPublicKey(u)
+		assert.EqualError(t, err, "X25519 public key has low order")
+	}
+
+	// u = p and p + 1 are 0 and 1 again, and a set top bit is ignored by SetBytes
+	p := []byte{
+		0xed, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff,
+		0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x7f,
+	}
+	_, err = xeddsaPublicKey(p)
+	assert.EqualError(t, err, "X25519 public key is not canonical")
+
+	p[0]++
+	_, err = xeddsaPublicKey(p)
+	assert.EqualError(t, err, "X25519 public key is not canonical")
+
+	pub, _ := x25519Keypair()
+	pub[31] |= 0x80
+	_, err = xeddsaPublicKey(pub)
+	assert.EqualError(t, err, "X25519 public key is not canonical")
+}
@@ -0,0 +1,132 @@
+package cert
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+// pkcs11URI is the subset of RFC 7512 needed to find an ed25519 key, ie
+// pkcs11:token=nebula;object=ca?module-path=/usr/lib/softhsm/libsofthsm2.so&pin-value=1234
+type pkcs11URI struct {
+	modulePath string
+	token      string
+	slotID     *uint
+	object     string
+	id         []byte
+	pin        string
+}
+
+func parsePKCS11URI(s string) (*pkcs11URI, error) {
+	if !strings.HasPrefix(s, "pkcs11:") {
+		return nil, fmt.Errorf("pkcs11 uri must start with pkcs11:")
+	}
+
+	u := &pkcs11URI{}
+	path := strings.TrimPrefix(s, "pkcs11:")
+	query := ""
+	if i := strings.IndexByte(path, '?'); i >= 0 {
+		path, query = path[:i], path[i+1:]
+	}
+
+	for _, attr := range strings.Split(path, ";") {
+		if attr == "" {
+			continue
+		}
+
+		k, v, err := splitPKCS11Attr(attr)
+		if err != nil {
+			return nil, err
+		}
+
+		switch k {
+		case "token":
+			u.token = v
+		case "object":
+			u.object = v
+		case "id":
+			u.id = []byte(v)
+		case "slot-id":
+			id, err := strconv.ParseUint(v, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("pkcs11 uri has an invalid slot-id: %s", v)
+			}
+			slot := uint(id)
+			u.slotID = &slot
+		case "type":
+			if v != "private" {
+				return nil, fmt.Errorf("pkcs11 uri must refer to a private key, got type=%s", v)
+			}
+		default:
+			return nil, fmt.Errorf("pkcs11 uri attribute is not supported: %s", k)
+		}
+	}
+
+	for _, attr := range strings.Split(query, "&") {
+		if attr == "" {
+			continue
+		}
+
+		k, v, err := splitPKCS11Attr(attr)
+		if err != nil {
+			return nil, err
+		}
+
+		switch k {
+		case "module-path":
+			u.modulePath = v
+		case "pin-value":
+			u.pin = v
+		case "pin-source":
+			b, err := ioutil.ReadFile(strings.TrimPrefix(v, "file:"))
+			if err != nil {
+				return nil, fmt.Errorf("failed to read pkcs11 pin-source: %s", err)
+			}
+			u.pin = strings.TrimRight(string(b), "\r\n")
+		default:
+			return nil, fmt.Errorf("pkcs11 uri query attribute is not supported: %s", k)
+		}
+	}
+
+	if u.modulePath == "" {
+		return nil, fmt.Errorf("pkcs11 uri must set module-path")
+	}
+
+	if u.object == "" && u.id == nil {
+		return nil, fmt.Errorf("pkcs11 uri must identify the key with object or id")
+	}
+
+	return u, nil
+}
+
+func splitPKCS11Attr(attr string) (string, string, error) {
+	i := strings.IndexByte(attr, '=')
+	if i < 0 {
+		return "", "", fmt.Errorf("pkcs11 uri attribute has no value: %s", attr)
+	}
+
+	v, err := url.PathUnescape(attr[i+1:])
+	if err != nil {
+		return "", "", fmt.Errorf("pkcs11 uri attribute %s is not properly escaped: %s", attr[:i], err)
+	}
+
+	return attr[:i], v, nil
+}
+
+// decodeEdwardsPoint returns the public key from a CKA_EC_POINT value. The standard says it is a DER octet string
+// but some modules return the bare point
+func decodeEdwardsPoint(b []byte) (ed25519.PublicKey, error) {
+	if len(b) == ed25519.PublicKeySize+2 && b[0] == 0x04 && b[1] == ed25519.PublicKeySize {
+		b = b[2:]
+	}
+
+	if len(b) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("pkcs11 public key is not an ed25519 key")
+	}
+
+	return ed25519.PublicKey(b), nil
+}
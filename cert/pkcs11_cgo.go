@@ -0,0 +1,207 @@
+// +build cgo,pkcs11
+
+package cert
+
+import (
+	"crypto"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/miekg/pkcs11"
+	"golang.org/x/crypto/ed25519"
+)
+
+// Not defined by the version of the pkcs11 headers vendored in github.com/miekg/pkcs11
+const (
+	ckkEcEdwards = 0x40
+	ckmEdDSA     = 0x1057
+)
+
+// PKCS11Signer signs with an ed25519 key held by a PKCS#11 module, the private key never leaves the token
+type PKCS11Signer struct {
+	sync.Mutex
+	ctx     *pkcs11.Ctx
+	session pkcs11.SessionHandle
+	key     pkcs11.ObjectHandle
+	pub     ed25519.PublicKey
+}
+
+// NewPKCS11Signer loads the module named in the RFC 7512 uri, logs in to the token and finds the key. Close must be
+// called when done to release the session
+func NewPKCS11Signer(uri string) (*PKCS11Signer, error) {
+	u, err := parsePKCS11URI(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx := pkcs11.New(u.modulePath)
+	if ctx == nil {
+		return nil, fmt.Errorf("failed to load pkcs11 module: %s", u.modulePath)
+	}
+
+	if err := ctx.Initialize(); err != nil {
+		ctx.Destroy()
+		return nil, fmt.Errorf("failed to initialize pkcs11 module: %s", err)
+	}
+
+	s := &PKCS11Signer{ctx: ctx}
+	if err := s.open(u); err != nil {
+		s.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *PKCS11Signer) open(u *pkcs11URI) error {
+	slot, err := findPKCS11Slot(s.ctx, u)
+	if err != nil {
+		return err
+	}
+
+	s.session, err = s.ctx.OpenSession(slot, pkcs11.CKF_SERIAL_SESSION)
+	if err != nil {
+		return fmt.Errorf("failed to open pkcs11 session: %s", err)
+	}
+
+	if u.pin != "" {
+		err = s.ctx.Login(s.session, pkcs11.CKU_USER, u.pin)
+		if err != nil && err != pkcs11.Error(pkcs11.CKR_USER_ALREADY_LOGGED_IN) {
+			return fmt.Errorf("failed to log in to pkcs11 token: %s", err)
+		}
+	}
+
+	s.key, err = s.findObject(u, pkcs11.CKO_PRIVATE_KEY)
+	if err != nil {
+		return err
+	}
+
+	pubKey, err := s.findObject(u, pkcs11.CKO_PUBLIC_KEY)
+	if err != nil {
+		return err
+	}
+
+	attrs, err := s.ctx.GetAttributeValue(s.session, pubKey, []*pkcs11.Attribute{pkcs11.NewAttribute(pkcs11.CKA_EC_POINT, nil)})
+	if err != nil {
+		return fmt.Errorf("failed to read pkcs11 public key: %s", err)
+	}
+
+	s.pub, err = decodeEdwardsPoint(attrs[0].Value)
+	return err
+}
+
+func findPKCS11Slot(ctx *pkcs11.Ctx, u *pkcs11URI) (uint, error) {
+	if u.slotID != nil {
+		return *u.slotID, nil
+	}
+
+	slots, err := ctx.GetSlotList(true)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list pkcs11 slots: %s", err)
+	}
+
+	if u.token == "" {
+		if len(slots) != 1 {
+			return 0, fmt.Errorf("pkcs11 uri must set token or slot-id when the module has %d tokens", len(slots))
+		}
+		return slots[0], nil
+	}
+
+	for _, slot := range slots {
+		ti, err := ctx.GetTokenInfo(slot)
+		if err != nil {
+			return 0, fmt.Errorf("failed to read pkcs11 token info: %s", err)
+		}
+
+		if strings.TrimRight(ti.Label, " ") == u.token {
+			return slot, nil
+		}
+	}
+
+	return 0, fmt.Errorf("pkcs11 token was not found: %s", u.token)
+}
+
+func (s *PKCS11Signer) findObject(u *pkcs11URI, class uint) (pkcs11.ObjectHandle, error) {
+	template := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, class),
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, ckkEcEdwards),
+	}
+	if u.object != "" {
+		template = append(template, pkcs11.NewAttribute(pkcs11.CKA_LABEL, u.object))
+	}
+	if u.id != nil {
+		template = append(template, pkcs11.NewAttribute(pkcs11.CKA_ID, u.id))
+	}
+
+	if err := s.ctx.FindObjectsInit(s.session, template); err != nil {
+		return 0, fmt.Errorf("failed to search the pkcs11 token: %s", err)
+	}
+
+	objs, _, err := s.ctx.FindObjects(s.session, 2)
+	s.ctx.FindObjectsFinal(s.session)
+	if err != nil {
+		return 0, fmt.Errorf("failed to search the pkcs11 token: %s", err)
+	}
+
+	kind := "private"
+	if class == pkcs11.CKO_PUBLIC_KEY {
+		kind = "public"
+	}
+
+	switch len(objs) {
+	case 0:
+		return 0, fmt.Errorf("no ed25519 %s key matched the pkcs11 uri", kind)
+	case 1:
+		return objs[0], nil
+	default:
+		return 0, fmt.Errorf("more than one ed25519 %s key matched the pkcs11 uri", kind)
+	}
+}
+
+// Public returns the ed25519 public key stored alongside the private key
+func (s *PKCS11Signer) Public() crypto.PublicKey {
+	return s.pub
+}
+
+// Sign has the token sign msg with EdDSA, opts must not request a hash since ed25519 signs the full message
+func (s *PKCS11Signer) Sign(_ io.Reader, msg []byte, opts crypto.SignerOpts) ([]byte, error) {
+	if opts.HashFunc() != crypto.Hash(0) {
+		return nil, fmt.Errorf("ed25519 cannot sign hashed messages")
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	err := s.ctx.SignInit(s.session, []*pkcs11.Mechanism{pkcs11.NewMechanism(ckmEdDSA, nil)}, s.key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start pkcs11 signing: %s", err)
+	}
+
+	sig, err := s.ctx.Sign(s.session, msg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign with pkcs11: %s", err)
+	}
+
+	return sig, nil
+}
+
+// Close ends the session with the token and unloads the module
+func (s *PKCS11Signer) Close() error {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.ctx == nil {
+		return nil
+	}
+
+	if s.session != 0 {
+		s.ctx.CloseSession(s.session)
+	}
+
+	err := s.ctx.Finalize()
+	s.ctx.Destroy()
+	s.ctx = nil
+	return err
+}
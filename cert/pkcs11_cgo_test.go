@@ -0,0 +1,46 @@
+// +build cgo,pkcs11
+
+package cert
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ed25519"
+)
+
+// TestPKCS11Signer needs a token holding an ed25519 key, with SoftHSM:
+//
+//	softhsm2-util --init-token --free --label nebula --pin 1234 --so-pin 1234
+//	pkcs11-tool --module /usr/lib/softhsm/libsofthsm2.so --token-label nebula --login --pin 1234 \
+//	    --keypairgen --key-type EC:edwards25519 --label ca
+//	NEBULA_TEST_PKCS11_URI='pkcs11:token=nebula;object=ca?module-path=/usr/lib/softhsm/libsofthsm2.so&pin-value=1234' \
+//	    go test -tags pkcs11 -run TestPKCS11Signer ./cert
+func TestPKCS11Signer(t *testing.T) {
+	uri := os.Getenv("NEBULA_TEST_PKCS11_URI")
+	if uri == "" {
+		t.Skip("NEBULA_TEST_PKCS11_URI is not set")
+	}
+
+	s, err := NewPKCS11Signer(uri)
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer s.Close()
+
+	pub := s.Public().(ed25519.PublicKey)
+	nc := NebulaCertificate{
+		Details: NebulaCertificateDetails{
+			Name:      "testing",
+			NotBefore: time.Now(),
+			NotAfter:  time.Now().Add(time.Minute),
+			PublicKey: pub,
+			IsCA:      true,
+		},
+	}
+	assert.Nil(t, nc.SignWith(s))
+	assert.True(t, nc.CheckSignature(pub))
+	assert.Nil(t, s.Close())
+}
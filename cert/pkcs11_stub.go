@@ -0,0 +1,34 @@
+// +build !cgo !pkcs11
+
+package cert
+
+import (
+	"crypto"
+	"fmt"
+	"io"
+)
+
+// PKCS11Signer signs with an ed25519 key held by a PKCS#11 module. This build does not include PKCS#11 support, it
+// requires cgo and the pkcs11 build tag
+type PKCS11Signer struct{}
+
+// NewPKCS11Signer always fails in this build
+func NewPKCS11Signer(uri string) (*PKCS11Signer, error) {
+	if _, err := parsePKCS11URI(uri); err != nil {
+		return nil, err
+	}
+
+	return nil, fmt.Errorf("pkcs11 support is not included in this build, rebuild with cgo enabled and -tags pkcs11")
+}
+
+func (s *PKCS11Signer) Public() crypto.PublicKey {
+	return nil
+}
+
+func (s *PKCS11Signer) Sign(_ io.Reader, _ []byte, _ crypto.SignerOpts) ([]byte, error) {
+	return nil, fmt.Errorf("pkcs11 support is not included in this build")
+}
+
+func (s *PKCS11Signer) Close() error {
+	return nil
+}
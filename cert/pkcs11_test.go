@@ -0,0 +1,68 @@
+package cert
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParsePKCS11URI(t *testing.T) {
+	u, err := parsePKCS11URI("pkcs11:token=nebula%20ca;object=root;type=private?module-path=/usr/lib/softhsm/libsofthsm2.so&pin-value=1234")
+	assert.Nil(t, err)
+	assert.Equal(t, &pkcs11URI{
+		modulePath: "/usr/lib/softhsm/libsofthsm2.so",
+		token:      "nebula ca",
+		object:     "root",
+		pin:        "1234",
+	}, u)
+
+	u, err = parsePKCS11URI("pkcs11:slot-id=3;id=%01%02?module-path=p11.so")
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{1, 2}, u.id)
+	if assert.NotNil(t, u.slotID) {
+		assert.Equal(t, uint(3), *u.slotID)
+	}
+
+	dir, err := ioutil.TempDir("", "pkcs11-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	pinFile := filepath.Join(dir, "pin")
+	assert.Nil(t, ioutil.WriteFile(pinFile, []byte("5678\n"), 0600))
+
+	u, err = parsePKCS11URI("pkcs11:object=root?module-path=p11.so&pin-source=file:" + pinFile)
+	assert.Nil(t, err)
+	assert.Equal(t, "5678", u.pin)
+
+	for uri, expected := range map[string]string{
+		"root.key":                                  "pkcs11 uri must start with pkcs11:",
+		"pkcs11:object=root":                        "pkcs11 uri must set module-path",
+		"pkcs11:token=nebula?module-path=p11.so":    "pkcs11 uri must identify the key with object or id",
+		"pkcs11:object=root;type=cert?module-path=": "pkcs11 uri must refer to a private key, got type=cert",
+		"pkcs11:object=root;serial=1?module-path=x": "pkcs11 uri attribute is not supported: serial",
+		"pkcs11:object=root?module-path=x&pin=1":    "pkcs11 uri query attribute is not supported: pin",
+		"pkcs11:object?module-path=x":               "pkcs11 uri attribute has no value: object",
+		"pkcs11:slot-id=a;object=b?module-path=x":   "pkcs11 uri has an invalid slot-id: a",
+		"pkcs11:object=%zz?module-path=x":           "pkcs11 uri attribute object is not properly escaped: invalid URL escape \"%zz\"",
+	} {
+		_, err := parsePKCS11URI(uri)
+		assert.EqualError(t, err, expected, uri)
+	}
+}
+
+func TestDecodeEdwardsPoint(t *testing.T) {
+	point := []byte("1234567890abcedfghij1234567890ab")
+
+	pub, err := decodeEdwardsPoint(point)
+	assert.Nil(t, err)
+	assert.Equal(t, point, []byte(pub))
+
+	pub, err = decodeEdwardsPoint(append([]byte{0x04, 0x20}, point...))
+	assert.Nil(t, err)
+	assert.Equal(t, point, []byte(pub))
+
+	_, err = decodeEdwardsPoint(append([]byte{0x04, 0x41}, point...))
+	assert.EqualError(t, err, "pkcs11 public key is not an ed25519 key")
+}
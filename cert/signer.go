@@ -0,0 +1,33 @@
+package cert
+
+import (
+	"crypto"
+	"crypto/rand"
+	"fmt"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+// signWith asks signer for an ed25519 signature over b. Signers that are not a local key are outside of our control
+// so the signature is checked before it is used
+func signWith(signer crypto.Signer, b []byte) ([]byte, error) {
+	if k, ok := signer.(ed25519.PrivateKey); ok {
+		return k.Sign(rand.Reader, b, crypto.Hash(0))
+	}
+
+	pub, ok := signer.Public().(ed25519.PublicKey)
+	if !ok || len(pub) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("signer does not hold an ed25519 key")
+	}
+
+	sig, err := signer.Sign(rand.Reader, b, crypto.Hash(0))
+	if err != nil {
+		return nil, err
+	}
+
+	if !ed25519.Verify(pub, b, sig) {
+		return nil, fmt.Errorf("signer produced a signature that does not match its public key")
+	}
+
+	return sig, nil
+}
@@ -0,0 +1,84 @@
+package cert
+
+import (
+	"bytes"
+	"crypto"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+// CommandSigner signs with a key held by an external program, such as a wrapper around a cloud KMS or a signing
+// service. The program is run with one more argument appended to the configured command:
+//
+//	public: print the ed25519 public key in the NEBULA ED25519 PUBLIC KEY pem format to stdout
+//	sign:   read the bytes to sign from stdin and write the raw 64 byte ed25519 signature to stdout
+//
+// A non zero exit status is an error, anything written to stderr is included in the error returned.
+type CommandSigner struct {
+	command []string
+	pub     ed25519.PublicKey
+}
+
+// NewCommandSigner runs command to get the public key of the signer
+func NewCommandSigner(command []string) (*CommandSigner, error) {
+	if len(command) == 0 || command[0] == "" {
+		return nil, fmt.Errorf("no signing command provided")
+	}
+
+	s := &CommandSigner{command: command}
+	out, err := s.run("public", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	s.pub, _, err = UnmarshalEd25519PublicKey(out)
+	if err != nil {
+		return nil, fmt.Errorf("signing command returned an invalid public key: %s", err)
+	}
+
+	return s, nil
+}
+
+// Public returns the ed25519 public key of the signer
+func (s *CommandSigner) Public() crypto.PublicKey {
+	return s.pub
+}
+
+// Sign has the signing command sign msg, opts must not request a hash since ed25519 signs the full message
+func (s *CommandSigner) Sign(_ io.Reader, msg []byte, opts crypto.SignerOpts) ([]byte, error) {
+	if opts.HashFunc() != crypto.Hash(0) {
+		return nil, fmt.Errorf("ed25519 cannot sign hashed messages")
+	}
+
+	sig, err := s.run("sign", msg)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(sig) != ed25519.SignatureSize {
+		return nil, fmt.Errorf("signing command returned a %d byte signature, expected %d", len(sig), ed25519.SignatureSize)
+	}
+
+	return sig, nil
+}
+
+func (s *CommandSigner) run(op string, stdin []byte) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(s.command[0], append(s.command[1:], op)...)
+	cmd.Stdin = bytes.NewReader(stdin)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("signing command failed to %s: %s: %s", op, err, msg)
+		}
+		return nil, fmt.Errorf("signing command failed to %s: %s", op, err)
+	}
+
+	return stdout.Bytes(), nil
+}
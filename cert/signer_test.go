@@ -0,0 +1,109 @@
+package cert
+
+import (
+	"crypto"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ed25519"
+)
+
+// TestCommandSignerHelper is not a real test, TestCommandSigner runs the test binary with it as the signing command
+func TestCommandSignerHelper(t *testing.T) {
+	rawKey := os.Getenv("NEBULA_TEST_SIGNER_KEY")
+	if rawKey == "" {
+		return
+	}
+
+	b, _ := hex.DecodeString(rawKey)
+	key := ed25519.PrivateKey(b)
+
+	switch os.Getenv("NEBULA_TEST_SIGNER_MODE") + os.Args[len(os.Args)-1] {
+	case "public", "badpublic":
+		os.Stdout.Write(MarshalEd25519PublicKey(key.Public().(ed25519.PublicKey)))
+	case "sign":
+		msg, _ := ioutil.ReadAll(os.Stdin)
+		os.Stdout.Write(ed25519.Sign(key, msg))
+	case "badsign":
+		os.Stdout.Write(ed25519.Sign(key, []byte("something else")))
+	default:
+		fmt.Fprint(os.Stderr, "no key for you")
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+func TestCommandSigner(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+	os.Setenv("NEBULA_TEST_SIGNER_KEY", hex.EncodeToString(priv))
+	defer os.Unsetenv("NEBULA_TEST_SIGNER_KEY")
+	defer os.Unsetenv("NEBULA_TEST_SIGNER_MODE")
+
+	cmd := []string{os.Args[0], "-test.run=^TestCommandSignerHelper$", "--"}
+
+	s, err := NewCommandSigner(cmd)
+	assert.Nil(t, err)
+	assert.Equal(t, pub, s.Public())
+
+	nc := NebulaCertificate{
+		Details: NebulaCertificateDetails{
+			Name:      "testing",
+			NotBefore: time.Now(),
+			NotAfter:  time.Now().Add(time.Minute),
+			PublicKey: pub,
+			IsCA:      true,
+		},
+	}
+	assert.Nil(t, nc.SignWith(s))
+	assert.True(t, nc.CheckSignature(pub))
+
+	crl := NebulaCRL{Details: NebulaCRLDetails{Version: 1, IssuedAt: time.Now(), NotAfter: time.Now().Add(time.Minute)}}
+	assert.Nil(t, crl.SignWith(s))
+	assert.True(t, crl.CheckSignature(pub))
+
+	// A signature that doesn't verify is never used
+	os.Setenv("NEBULA_TEST_SIGNER_MODE", "bad")
+	nc.Signature = nil
+	assert.EqualError(t, nc.SignWith(s), "signer produced a signature that does not match its public key")
+	assert.Nil(t, nc.Signature)
+
+	// Errors from the command are surfaced
+	os.Setenv("NEBULA_TEST_SIGNER_MODE", "fail")
+	_, err = NewCommandSigner(cmd)
+	assert.EqualError(t, err, "signing command failed to public: exit status 1: no key for you")
+
+	_, err = NewCommandSigner(nil)
+	assert.EqualError(t, err, "no signing command provided")
+
+	_, err = s.Sign(rand.Reader, []byte("hi"), crypto.SHA256)
+	assert.EqualError(t, err, "ed25519 cannot sign hashed messages")
+}
+
+type badSigner struct {
+	pub crypto.PublicKey
+}
+
+func (s badSigner) Public() crypto.PublicKey {
+	return s.pub
+}
+
+func (s badSigner) Sign(_ io.Reader, _ []byte, _ crypto.SignerOpts) ([]byte, error) {
+	return make([]byte, ed25519.SignatureSize), nil
+}
+
+func TestNebulaCertificate_SignWith(t *testing.T) {
+	nc := NebulaCertificate{Details: NebulaCertificateDetails{Name: "testing"}}
+
+	assert.EqualError(t, nc.SignWith(badSigner{pub: []byte("not a key")}), "signer does not hold an ed25519 key")
+
+	pub, _, _ := ed25519.GenerateKey(rand.Reader)
+	assert.EqualError(t, nc.SignWith(badSigner{pub: pub}), "signer produced a signature that does not match its public key")
+	assert.Nil(t, nc.Signature)
+}
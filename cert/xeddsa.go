@@ -0,0 +1,104 @@
+package cert
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha512"
+	"fmt"
+	"io"
+
+	"filippo.io/edwards25519"
+	"filippo.io/edwards25519/field"
+	"golang.org/x/crypto/ed25519"
+)
+
+// hash1Prefix domain separates the XEdDSA nonce hash from the ed25519 challenge hash, it is 2^256 - 2 little endian
+var hash1Prefix = append([]byte{0xfe}, []byte{
+	0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff,
+	0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff,
+}...)
+
+// xeddsaSign signs msg with an X25519 private key following the XEdDSA specification from Signal. The signature is a
+// plain ed25519 signature for the public key returned by xeddsaPublicKey
+func xeddsaSign(privateKey []byte, msg []byte) ([]byte, error) {
+	k, err := edwards25519.NewScalar().SetBytesWithClamping(privateKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid X25519 private key")
+	}
+
+	// The edwards public key always has a sign bit of 0, negate the private key if it would have been 1
+	A := new(edwards25519.Point).ScalarBaseMult(k).Bytes()
+	a := k
+	if A[31]&0x80 != 0 {
+		a = edwards25519.NewScalar().Negate(k)
+		A[31] &= 0x7f
+	}
+
+	Z := make([]byte, 64)
+	if _, err := io.ReadFull(rand.Reader, Z); err != nil {
+		return nil, err
+	}
+
+	h := sha512.New()
+	h.Write(hash1Prefix)
+	h.Write(a.Bytes())
+	h.Write(msg)
+	h.Write(Z)
+	r, err := edwards25519.NewScalar().SetUniformBytes(h.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+
+	R := new(edwards25519.Point).ScalarBaseMult(r).Bytes()
+
+	h.Reset()
+	h.Write(R)
+	h.Write(A)
+	h.Write(msg)
+	c, err := edwards25519.NewScalar().SetUniformBytes(h.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+
+	s := edwards25519.NewScalar().MultiplyAdd(c, a, r)
+	return append(R, s.Bytes()...), nil
+}
+
+// xeddsaPublicKey converts an X25519 public key to the ed25519 public key that checks its XEdDSA signatures. Keys that
+// are not canonical or that are in a small subgroup are refused, a signature from one of those proves nothing
+func xeddsaPublicKey(publicKey []byte) (ed25519.PublicKey, error) {
+	if len(publicKey) != publicKeyLen {
+		return nil, fmt.Errorf("invalid X25519 public key")
+	}
+
+	u, err := new(field.Element).SetBytes(publicKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid X25519 public key")
+	}
+
+	// SetBytes reduces u mod p and drops the top bit, so anything that doesn't round trip was not canonical
+	if !bytes.Equal(u.Bytes(), publicKey) {
+		return nil, fmt.Errorf("X25519 public key is not canonical")
+	}
+
+	// y = (u - 1) / (u + 1), which has no answer for u = -1
+	one := new(field.Element).One()
+	d := new(field.Element).Add(u, one)
+	if d.Equal(new(field.Element).Zero()) == 1 {
+		return nil, fmt.Errorf("invalid X25519 public key")
+	}
+
+	y := new(field.Element).Subtract(u, one)
+	y.Multiply(y, d.Invert(d))
+
+	// A u on the twist has no point with this y, and clearing the cofactor from a low order point leaves the identity
+	p, err := new(edwards25519.Point).SetBytes(y.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("invalid X25519 public key")
+	}
+	if p.MultByCofactor(p).Equal(edwards25519.NewIdentityPoint()) == 1 {
+		return nil, fmt.Errorf("X25519 public key has low order")
+	}
+
+	return y.Bytes(), nil
+}
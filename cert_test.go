@@ -0,0 +1,83 @@
+package nebula
+
+import (
+	"crypto/rand"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula/cert"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/ed25519"
+)
+
+func TestNewCertStateFromConfig_EncryptedKey(t *testing.T) {
+	l := NewTestLogger()
+	dir, err := ioutil.TempDir("", "cert-state")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	_, caKey, _ := ed25519.GenerateKey(rand.Reader)
+	var pub, priv [32]byte
+	_, _ = rand.Read(priv[:])
+	curve25519.ScalarBaseMult(&pub, &priv)
+
+	nc := cert.NebulaCertificate{
+		Details: cert.NebulaCertificateDetails{
+			Name:      "host",
+			Ips:       []*net.IPNet{{IP: net.IPv4(10, 1, 0, 1), Mask: net.IPv4Mask(255, 255, 255, 0)}},
+			NotBefore: time.Now(),
+			NotAfter:  time.Now().Add(time.Hour),
+			PublicKey: pub[:],
+			Issuer:    "ca",
+		},
+	}
+	assert.Nil(t, nc.Sign(caKey))
+	certPEM, err := nc.MarshalToPEM()
+	assert.Nil(t, err)
+
+	keyPEM, err := cert.EncryptAndMarshalX25519PrivateKey(priv[:], []byte("hunter2"), cert.NewArgon2Parameters(64, 1, 1))
+	assert.Nil(t, err)
+
+	passFile := filepath.Join(dir, "pass")
+	assert.Nil(t, ioutil.WriteFile(passFile, []byte("hunter2\n"), 0600))
+
+	c := NewConfig(l)
+	c.Settings["pki"] = map[interface{}]interface{}{
+		"cert":                string(certPEM),
+		"key":                 string(keyPEM),
+		"key_passphrase_file": passFile,
+	}
+
+	cs, err := NewCertStateFromConfig(c)
+	assert.Nil(t, err)
+	assert.Equal(t, priv[:], cs.privateKey)
+
+	// The environment is used when there is no passphrase file
+	delete(c.Settings["pki"].(map[interface{}]interface{}), "key_passphrase_file")
+	os.Setenv("NEBULA_KEY_PASSPHRASE", "wrong")
+	defer os.Unsetenv("NEBULA_KEY_PASSPHRASE")
+
+	_, err = NewCertStateFromConfig(c)
+	assert.EqualError(t, err, "error while decrypting pki.key <inline>: invalid passphrase or corrupt private key")
+
+	// A reload with the same key doesn't need the passphrase again
+	reloaded, err := newCertStateFromConfig(c, cs)
+	assert.Nil(t, err)
+	assert.Equal(t, priv[:], reloaded.privateKey)
+
+	os.Setenv("NEBULA_KEY_PASSPHRASE", "hunter2")
+	cs, err = NewCertStateFromConfig(c)
+	assert.Nil(t, err)
+	assert.Equal(t, priv[:], cs.privateKey)
+
+	// A reload with a new key and no passphrase configured fails instead of prompting
+	os.Unsetenv("NEBULA_KEY_PASSPHRASE")
+	cs.encryptedKey = []byte("an older key")
+	_, err = newCertStateFromConfig(c, cs)
+	assert.EqualError(t, err, "pki.key <inline> is encrypted, provide the passphrase with pki.key_passphrase_file or NEBULA_KEY_PASSPHRASE")
+}
@@ -23,9 +23,13 @@ func (tree *CIDR6Tree) AddCIDR(cidr *net.IPNet, val interface{}) {
 	var node, next *CIDRNode
 
 	cidrIP, ipv4 := isIPV4(cidr.IP)
+	mask := cidr.Mask
 	if ipv4 {
 		node = tree.root4
 		next = tree.root4
+		if len(mask) == net.IPv6len {
+			mask = mask[12:]
+		}
 
 	} else {
 		node = tree.root6
@@ -34,7 +38,7 @@ func (tree *CIDR6Tree) AddCIDR(cidr *net.IPNet, val interface{}) {
 
 	for i := 0; i < len(cidrIP); i += 4 {
 		ip := binary.BigEndian.Uint32(cidrIP[i : i+4])
-		mask := binary.BigEndian.Uint32(cidr.Mask[i : i+4])
+		mask := binary.BigEndian.Uint32(mask[i : i+4])
 		bit := startbit
 
 		// Find our last ancestor in the tree
@@ -162,6 +166,14 @@ func (tree *CIDR6Tree) MostSpecificContainsIpV6(hi, lo uint64) (value interface{
 	return value
 }
 
+// MostSpecificContainsVpnIp finds the most specific match for an overlay address of either family
+func (tree *CIDR6Tree) MostSpecificContainsVpnIp(ip VpnIp) (value interface{}) {
+	if ip.Is4() {
+		return tree.MostSpecificContainsIpV4(ip.To4())
+	}
+	return tree.MostSpecificContainsIpV6(ip.Hi, ip.Lo)
+}
+
 func isIPV4(ip net.IP) (net.IP, bool) {
 	if len(ip) == net.IPv4len {
 		return ip, true
@@ -75,3 +75,28 @@ func TestCIDR6Tree_MostSpecificContainsIpV6(t *testing.T) {
 		assert.Equal(t, tt.Result, tree.MostSpecificContainsIpV6(ip.Hi, ip.Lo))
 	}
 }
+
+func TestCIDR6Tree_MostSpecificContainsVpnIp(t *testing.T) {
+	tree := NewCIDR6Tree()
+	tree.AddCIDR(getCIDR("10.0.0.0/8"), "4a")
+	tree.AddCIDR(&net.IPNet{IP: net.ParseIP("10.1.1.1"), Mask: net.IPMask(net.ParseIP("255.255.255.255"))}, "4b")
+	tree.AddCIDR(getCIDR("fd00::/64"), "6a")
+	tree.AddCIDR(getCIDR("fd00::1/128"), "6b")
+
+	tests := []struct {
+		Result interface{}
+		IP     string
+	}{
+		{"4a", "10.0.0.1"},
+		{"4b", "10.1.1.1"},
+		{"6a", "fd00::2"},
+		{"6b", "fd00::1"},
+		{nil, "11.0.0.1"},
+		{nil, "fd01::1"},
+		{nil, "::ffff:0a00:0001:0:0"},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.Result, tree.MostSpecificContainsVpnIp(NewVpnIp(net.ParseIP(tt.IP))), tt.IP)
+	}
+}
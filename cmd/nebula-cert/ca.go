@@ -17,15 +17,21 @@ import (
 )
 
 type caFlags struct {
-	set         *flag.FlagSet
-	name        *string
-	duration    *time.Duration
-	outKeyPath  *string
-	outCertPath *string
-	outQRPath   *string
-	groups      *string
-	ips         *string
-	subnets     *string
+	set          *flag.FlagSet
+	name         *string
+	duration     *time.Duration
+	outKeyPath   *string
+	outCertPath  *string
+	outQRPath    *string
+	groups       *string
+	ips          *string
+	subnets      *string
+	meta         *string
+	intermediate *bool
+	caKeyPath    *string
+	caCertPath   *string
+	inKeyPath    *string
+	encryption   *bool
 }
 
 func newCaFlags() *caFlags {
@@ -34,11 +40,17 @@ func newCaFlags() *caFlags {
 	cf.name = cf.set.String("name", "", "Required: name of the certificate authority")
 	cf.duration = cf.set.Duration("duration", time.Duration(time.Hour*8760), "Optional: amount of time the certificate should be valid for. Valid time units are seconds: \"s\", minutes: \"m\", hours: \"h\"")
 	cf.outKeyPath = cf.set.String("out-key", "ca.key", "Optional: path to write the private key to")
+	cf.encryption = cf.set.Bool("encrypt", false, "Optional: encrypt out-key with a passphrase read from NEBULA_KEY_PASSPHRASE or the terminal")
+	cf.inKeyPath = cf.set.String("in-key", "", "Optional: use an existing key instead of generating one, a pkcs11: uri, exec: followed by a signing command, or a path. -out-key is not written")
 	cf.outCertPath = cf.set.String("out-crt", "ca.crt", "Optional: path to write the certificate to")
 	cf.outQRPath = cf.set.String("out-qr", "", "Optional: output a qr code image (png) of the certificate")
 	cf.groups = cf.set.String("groups", "", "Optional: comma separated list of groups. This will limit which groups subordinate certs can use")
 	cf.ips = cf.set.String("ips", "", "Optional: comma separated list of ip and network in CIDR notation. This will limit which ip addresses and networks subordinate certs can use")
 	cf.subnets = cf.set.String("subnets", "", "Optional: comma separated list of ip and network in CIDR notation. This will limit which subnet addresses and networks subordinate certs can use")
+	cf.meta = cf.set.String("meta", "", "Optional: comma separated list of key=value pairs. Subordinate certs that set one of these keys must use the same value")
+	cf.intermediate = cf.set.Bool("intermediate", false, "Optional: sign the certificate authority with -ca-key and -ca-crt instead of self signing it. It will not be valid past the signing certificate")
+	cf.caKeyPath = cf.set.String("ca-key", "", "Required with -intermediate: path to the signing CA key, a pkcs11: uri, or exec: followed by a signing command")
+	cf.caCertPath = cf.set.String("ca-crt", "", "Required with -intermediate: path to the signing CA cert, followed by its own intermediates if it has any")
 	return &cf
 }
 
@@ -63,6 +75,39 @@ func ca(args []string, out io.Writer, errOut io.Writer) error {
 		return &helpError{"-duration must be greater than 0"}
 	}
 
+	if *cf.encryption && *cf.inKeyPath != "" {
+		return newHelpErrorf("cannot set both -encrypt and -in-key")
+	}
+
+	var caKey keySigner
+	var caChain []*cert.NebulaCertificate
+	if *cf.intermediate {
+		if err := mustFlagString("ca-key", cf.caKeyPath); err != nil {
+			return err
+		}
+		if err := mustFlagString("ca-crt", cf.caCertPath); err != nil {
+			return err
+		}
+
+		caKey, err = openSigner("ca-key", *cf.caKeyPath, errOut)
+		if err != nil {
+			return err
+		}
+		defer caKey.Close()
+
+		caChain, err = readCAChain(*cf.caCertPath)
+		if err != nil {
+			return err
+		}
+
+		if caChain[0].Expired(time.Now()) {
+			return fmt.Errorf("ca certificate is expired")
+		}
+
+	} else if *cf.caKeyPath != "" || *cf.caCertPath != "" {
+		return newHelpErrorf("-ca-key and -ca-crt can only be used with -intermediate")
+	}
+
 	var groups []string
 	if *cf.groups != "" {
 		for _, rg := range strings.Split(*cf.groups, ",") {
@@ -103,9 +148,32 @@ func ca(args []string, out io.Writer, errOut io.Writer) error {
 		}
 	}
 
-	pub, rawPriv, err := ed25519.GenerateKey(rand.Reader)
+	metadata, err := parseMetadata(*cf.meta)
 	if err != nil {
-		return fmt.Errorf("error while generating ed25519 keys: %s", err)
+		return err
+	}
+
+	var key keySigner
+	var pub, rawPriv []byte
+	if *cf.inKeyPath != "" {
+		key, err = openSigner("in-key", *cf.inKeyPath, errOut)
+		if err != nil {
+			return err
+		}
+		defer key.Close()
+
+		var ok bool
+		pub, ok = key.Public().(ed25519.PublicKey)
+		if !ok {
+			return fmt.Errorf("in-key is not an ed25519 key")
+		}
+
+	} else {
+		pub, rawPriv, err = ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return fmt.Errorf("error while generating ed25519 keys: %s", err)
+		}
+		key = nopCloseSigner{ed25519.PrivateKey(rawPriv)}
 	}
 
 	nc := cert.NebulaCertificate{
@@ -118,25 +186,74 @@ func ca(args []string, out io.Writer, errOut io.Writer) error {
 			NotAfter:  time.Now().Add(*cf.duration),
 			PublicKey: pub,
 			IsCA:      true,
+			Metadata:  metadata,
 		},
 	}
 
-	if _, err := os.Stat(*cf.outKeyPath); err == nil {
-		return fmt.Errorf("refusing to overwrite existing CA key: %s", *cf.outKeyPath)
+	if len(caChain) > 0 {
+		nc.Details.Issuer, err = caChain[0].Sha256Sum()
+		if err != nil {
+			return fmt.Errorf("error while getting -ca-crt fingerprint: %s", err)
+		}
+
+		if nc.Details.NotAfter.After(caChain[0].Details.NotAfter) {
+			nc.Details.NotAfter = caChain[0].Details.NotAfter.Add(-time.Second)
+		}
+
+		for _, c := range caChain {
+			if err := nc.CheckRootConstrains(c); err != nil {
+				return fmt.Errorf("refusing to sign, root certificate constraints violated: %s", err)
+			}
+		}
+	}
+
+	var passphrase []byte
+	if rawPriv != nil {
+		if _, err := os.Stat(*cf.outKeyPath); err == nil {
+			return fmt.Errorf("refusing to overwrite existing CA key: %s", *cf.outKeyPath)
+		}
+
+		if *cf.encryption {
+			passphrase, err = readPassphrase(errOut, "out-key", true)
+			if err != nil {
+				return err
+			}
+
+			if len(passphrase) == 0 {
+				return fmt.Errorf("no passphrase specified, remove -encrypt to write out-key in plaintext")
+			}
+		}
 	}
 
 	if _, err := os.Stat(*cf.outCertPath); err == nil {
 		return fmt.Errorf("refusing to overwrite existing CA cert: %s", *cf.outCertPath)
 	}
 
-	err = nc.Sign(rawPriv)
+	if caKey != nil {
+		err = nc.SignWith(caKey)
+		if err == nil && !nc.CheckSignature(caChain[0].Details.PublicKey) {
+			err = fmt.Errorf("ca-key does not match ca-crt")
+		}
+	} else {
+		err = nc.SignWith(key)
+	}
 	if err != nil {
 		return fmt.Errorf("error while signing: %s", err)
 	}
 
-	err = ioutil.WriteFile(*cf.outKeyPath, cert.MarshalEd25519PrivateKey(rawPriv), 0600)
-	if err != nil {
-		return fmt.Errorf("error while writing out-key: %s", err)
+	if rawPriv != nil {
+		b := cert.MarshalEd25519PrivateKey(rawPriv)
+		if passphrase != nil {
+			b, err = cert.EncryptAndMarshalEd25519PrivateKey(rawPriv, passphrase, cert.DefaultArgon2Parameters())
+			if err != nil {
+				return fmt.Errorf("error while encrypting out-key: %s", err)
+			}
+		}
+
+		err = ioutil.WriteFile(*cf.outKeyPath, b, 0600)
+		if err != nil {
+			return fmt.Errorf("error while writing out-key: %s", err)
+		}
 	}
 
 	b, err := nc.MarshalToPEM()
@@ -144,6 +261,13 @@ func ca(args []string, out io.Writer, errOut io.Writer) error {
 		return fmt.Errorf("error while marshalling certificate: %s", err)
 	}
 
+	if len(caChain) > 0 {
+		b, err = appendCAChain(b, caChain)
+		if err != nil {
+			return err
+		}
+	}
+
 	err = ioutil.WriteFile(*cf.outCertPath, b, 0600)
 	if err != nil {
 		return fmt.Errorf("error while writing out-crt: %s", err)
@@ -164,6 +288,44 @@ func ca(args []string, out io.Writer, errOut io.Writer) error {
 	return nil
 }
 
+// readCAChain reads the signing CA certificate at path and any intermediate CAs that follow it, the signing CA is first
+func readCAChain(path string) ([]*cert.NebulaCertificate, error) {
+	rawCACert, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error while reading ca-crt: %s", err)
+	}
+
+	var chain []*cert.NebulaCertificate
+	for len(chain) == 0 || strings.TrimSpace(string(rawCACert)) != "" {
+		var c *cert.NebulaCertificate
+		c, rawCACert, err = cert.UnmarshalNebulaCertificateFromPEM(rawCACert)
+		if err != nil {
+			return nil, fmt.Errorf("error while parsing ca-crt: %s", err)
+		}
+		chain = append(chain, c)
+	}
+
+	return chain, nil
+}
+
+// appendCAChain adds the pem encoded chain to b when the signing CA is an intermediate, a cert is only useful along
+// with the intermediates that lead back to a root
+func appendCAChain(b []byte, chain []*cert.NebulaCertificate) ([]byte, error) {
+	if chain[0].Details.Issuer == "" {
+		return b, nil
+	}
+
+	for _, c := range chain {
+		pb, err := c.MarshalToPEM()
+		if err != nil {
+			return nil, fmt.Errorf("error while marshalling ca certificate: %s", err)
+		}
+		b = append(b, pb...)
+	}
+
+	return b, nil
+}
+
 func caSummary() string {
 	return "ca <flags>: create a self signed certificate authority"
 }
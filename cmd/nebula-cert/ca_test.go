@@ -4,13 +4,16 @@ package main
 
 import (
 	"bytes"
+	"crypto/rand"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
 	"github.com/slackhq/nebula/cert"
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ed25519"
 )
 
 //TODO: test file permissions
@@ -25,12 +28,24 @@ func Test_caHelp(t *testing.T) {
 	assert.Equal(
 		t,
 		"Usage of "+os.Args[0]+" ca <flags>: create a self signed certificate authority\n"+
+			"  -ca-crt string\n"+
+			"    \tRequired with -intermediate: path to the signing CA cert, followed by its own intermediates if it has any\n"+
+			"  -ca-key string\n"+
+			"    \tRequired with -intermediate: path to the signing CA key, a pkcs11: uri, or exec: followed by a signing command\n"+
 			"  -duration duration\n"+
 			"    \tOptional: amount of time the certificate should be valid for. Valid time units are seconds: \"s\", minutes: \"m\", hours: \"h\" (default 8760h0m0s)\n"+
+			"  -encrypt\n"+
+			"    \tOptional: encrypt out-key with a passphrase read from NEBULA_KEY_PASSPHRASE or the terminal\n"+
 			"  -groups string\n"+
 			"    \tOptional: comma separated list of groups. This will limit which groups subordinate certs can use\n"+
+			"  -in-key string\n"+
+			"    \tOptional: use an existing key instead of generating one, a pkcs11: uri, exec: followed by a signing command, or a path. -out-key is not written\n"+
+			"  -intermediate\n"+
+			"    \tOptional: sign the certificate authority with -ca-key and -ca-crt instead of self signing it. It will not be valid past the signing certificate\n"+
 			"  -ips string\n"+
 			"    \tOptional: comma separated list of ip and network in CIDR notation. This will limit which ip addresses and networks subordinate certs can use\n"+
+			"  -meta string\n"+
+			"    \tOptional: comma separated list of key=value pairs. Subordinate certs that set one of these keys must use the same value\n"+
 			"  -name string\n"+
 			"    \tRequired: name of the certificate authority\n"+
 			"  -out-crt string\n"+
@@ -138,3 +153,187 @@ func Test_ca(t *testing.T) {
 	os.Remove(keyF.Name())
 
 }
+
+func Test_caIntermediate(t *testing.T) {
+	ob := &bytes.Buffer{}
+	eb := &bytes.Buffer{}
+
+	dir, err := ioutil.TempDir("", "ca-intermediate")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	p := func(name string) string { return filepath.Join(dir, name) }
+
+	assert.Nil(t, ca([]string{"-name", "root", "-duration", "100m", "-groups", "a,b", "-out-crt", p("root.crt"), "-out-key", p("root.key")}, ob, eb))
+
+	// signing flags need -intermediate and -intermediate needs them
+	assertHelpError(t, ca([]string{"-name", "inter", "-ca-crt", p("root.crt"), "-out-crt", p("inter.crt"), "-out-key", p("inter.key")}, ob, eb), "-ca-key and -ca-crt can only be used with -intermediate")
+	assertHelpError(t, ca([]string{"-name", "inter", "-intermediate", "-ca-crt", p("root.crt"), "-out-crt", p("inter.crt"), "-out-key", p("inter.key")}, ob, eb), "-ca-key is required")
+
+	// root constraints apply
+	args := []string{"-name", "inter", "-intermediate", "-ca-crt", p("root.crt"), "-ca-key", p("root.key"), "-groups", "a,c", "-out-crt", p("inter.crt"), "-out-key", p("inter.key")}
+	assert.EqualError(t, ca(args, ob, eb), "refusing to sign, root certificate constraints violated: certificate contained a group not present on the signing ca: c")
+
+	// the default duration is longer than the root has left so it is cut short
+	args = []string{"-name", "inter", "-intermediate", "-ca-crt", p("root.crt"), "-ca-key", p("root.key"), "-groups", "a", "-out-crt", p("inter.crt"), "-out-key", p("inter.key")}
+	assert.Nil(t, ca(args, ob, eb))
+	assert.Equal(t, "", ob.String())
+	assert.Equal(t, "", eb.String())
+
+	rb, _ := ioutil.ReadFile(p("root.crt"))
+	caPool, err := cert.NewCAPoolFromBytes(rb)
+	assert.Nil(t, err)
+	root, _, err := cert.UnmarshalNebulaCertificateFromPEM(rb)
+	assert.Nil(t, err)
+
+	// the root never goes in the chain, an intermediate signed by it stands alone
+	rb, _ = ioutil.ReadFile(p("inter.crt"))
+	inter, rb, err := cert.UnmarshalNebulaCertificateFromPEM(rb)
+	assert.Nil(t, err)
+	assert.Len(t, rb, 0)
+	assert.True(t, inter.Details.IsCA)
+	assert.Equal(t, root.Details.NotAfter.Add(-time.Second), inter.Details.NotAfter)
+	signers, err := inter.VerifyWithChain(time.Now(), caPool, nil)
+	assert.Nil(t, err)
+	assert.Len(t, signers, 1)
+
+	// an intermediate signed by another intermediate carries its signer so it can be used to sign
+	args = []string{"-name", "inter2", "-intermediate", "-ca-crt", p("inter.crt"), "-ca-key", p("inter.key"), "-out-crt", p("inter2.crt"), "-out-key", p("inter2.key")}
+	assert.Nil(t, ca(args, ob, eb))
+
+	readChain := func(path string) (*cert.NebulaCertificate, []*cert.NebulaCertificate) {
+		rb, _ := ioutil.ReadFile(path)
+		c, rb, err := cert.UnmarshalNebulaCertificateFromPEM(rb)
+		assert.Nil(t, err)
+
+		var chain []*cert.NebulaCertificate
+		for len(rb) > 0 {
+			var ic *cert.NebulaCertificate
+			ic, rb, err = cert.UnmarshalNebulaCertificateFromPEM(rb)
+			assert.Nil(t, err)
+			chain = append(chain, ic)
+		}
+		return c, chain
+	}
+
+	inter2, chain := readChain(p("inter2.crt"))
+	assert.Equal(t, []*cert.NebulaCertificate{inter}, chain)
+	assert.True(t, inter2.Details.IsCA)
+
+	// hosts get the whole chain in their cert file
+	args = []string{"-ca-crt", p("inter2.crt"), "-ca-key", p("inter2.key"), "-name", "host", "-ip", "1.1.1.1/24", "-groups", "a", "-out-crt", p("host.crt"), "-out-key", p("host.key")}
+	assert.Nil(t, signCert(args, ob, eb))
+
+	host, chain := readChain(p("host.crt"))
+	assert.Len(t, chain, 2)
+	signers, err = host.VerifyWithChain(time.Now(), caPool, chain)
+	assert.Nil(t, err)
+	assert.Len(t, signers, 3)
+	assert.Equal(t, "inter2", signers[0].Details.Name)
+	assert.Equal(t, "inter", signers[1].Details.Name)
+	assert.Equal(t, "root", signers[2].Details.Name)
+	assert.Nil(t, verify([]string{"-ca", p("root.crt"), "-crt", p("host.crt")}, ob, eb))
+
+	// inter2 has no groups of its own but every level above it still constrains the host
+	args = []string{"-ca-crt", p("inter2.crt"), "-ca-key", p("inter2.key"), "-name", "host2", "-ip", "1.1.1.2/24", "-groups", "b", "-out-crt", p("host2.crt"), "-out-key", p("host2.key")}
+	assert.EqualError(t, signCert(args, ob, eb), "refusing to sign, root certificate constraints violated: certificate contained a group not present on the signing ca: b")
+}
+
+func Test_caExternalKey(t *testing.T) {
+	ob := &bytes.Buffer{}
+	eb := &bytes.Buffer{}
+
+	dir, err := ioutil.TempDir("", "ca-external")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	defer os.Unsetenv("NEBULA_TEST_SIGNER_KEY")
+	p := func(name string) string { return filepath.Join(dir, name) }
+
+	pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+	signer := signerHelperCommand(priv)
+
+	// the root is self signed by the command and no key is written
+	assert.Nil(t, ca([]string{"-name", "root", "-duration", "100m", "-in-key", signer, "-out-crt", p("root.crt"), "-out-key", p("root.key")}, ob, eb))
+	_, err = os.Stat(p("root.key"))
+	assert.True(t, os.IsNotExist(err))
+
+	rb, _ := ioutil.ReadFile(p("root.crt"))
+	root, _, err := cert.UnmarshalNebulaCertificateFromPEM(rb)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte(pub), root.Details.PublicKey)
+	assert.True(t, root.CheckSignature(pub))
+
+	// the command can sign intermediates and hosts
+	args := []string{"-name", "inter", "-intermediate", "-ca-crt", p("root.crt"), "-ca-key", signer, "-out-crt", p("inter.crt"), "-out-key", p("inter.key")}
+	assert.Nil(t, ca(args, ob, eb))
+
+	args = []string{"-ca-crt", p("root.crt"), "-ca-key", signer, "-name", "host", "-ip", "1.1.1.1/24", "-out-crt", p("host.crt"), "-out-key", p("host.key")}
+	assert.Nil(t, signCert(args, ob, eb))
+
+	caPool, err := cert.NewCAPoolFromBytes(rb)
+	assert.Nil(t, err)
+	for _, name := range []string{"inter.crt", "host.crt"} {
+		b, _ := ioutil.ReadFile(p(name))
+		c, _, err := cert.UnmarshalNebulaCertificateFromPEM(b)
+		assert.Nil(t, err)
+		ok, err := c.Verify(time.Now(), caPool)
+		assert.True(t, ok, name)
+		assert.Nil(t, err, name)
+	}
+
+	// a key that doesn't belong to the ca certificate is refused
+	args = []string{"-ca-crt", p("root.crt"), "-ca-key", p("inter.key"), "-name", "host2", "-ip", "1.1.1.2/24", "-out-crt", p("host2.crt"), "-out-key", p("host2.key")}
+	assert.EqualError(t, signCert(args, ob, eb), "refusing to sign, ca-key does not match ca-crt")
+
+	args = []string{"-name", "inter2", "-intermediate", "-ca-crt", p("root.crt"), "-ca-key", p("inter.key"), "-out-crt", p("inter2.crt"), "-out-key", p("inter2.key")}
+	assert.EqualError(t, ca(args, ob, eb), "error while signing: ca-key does not match ca-crt")
+
+	args = []string{"-name", "root2", "-in-key", "pkcs11:object=ca", "-out-crt", p("root2.crt")}
+	assert.EqualError(t, ca(args, ob, eb), "error while opening in-key: pkcs11 uri must set module-path")
+
+	args = []string{"-name", "root2", "-in-key", "exec:", "-out-crt", p("root2.crt")}
+	assert.EqualError(t, ca(args, ob, eb), "error while opening in-key: no signing command provided")
+	assert.Equal(t, "", ob.String())
+	assert.Equal(t, "", eb.String())
+}
+
+func Test_caEncrypted(t *testing.T) {
+	ob := &bytes.Buffer{}
+	eb := &bytes.Buffer{}
+
+	dir, err := ioutil.TempDir("", "ca-encrypted")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	defer os.Unsetenv("NEBULA_KEY_PASSPHRASE")
+	p := func(name string) string { return filepath.Join(dir, name) }
+
+	assertHelpError(t, ca([]string{"-name", "root", "-encrypt", "-in-key", p("nope")}, ob, eb), "cannot set both -encrypt and -in-key")
+
+	os.Setenv("NEBULA_KEY_PASSPHRASE", "")
+	args := []string{"-name", "root", "-encrypt", "-out-crt", p("ca.crt"), "-out-key", p("ca.key")}
+	assert.EqualError(t, ca(args, ob, eb), "no passphrase specified, remove -encrypt to write out-key in plaintext")
+
+	os.Setenv("NEBULA_KEY_PASSPHRASE", "hunter2")
+	assert.Nil(t, ca(args, ob, eb))
+	assert.Equal(t, "", ob.String())
+	assert.Equal(t, "", eb.String())
+
+	rb, _ := ioutil.ReadFile(p("ca.key"))
+	assert.True(t, cert.IsEncryptedPrivateKey(rb))
+	key, _, err := cert.DecryptAndUnmarshalEd25519PrivateKey([]byte("hunter2"), rb)
+	assert.Nil(t, err)
+
+	rb, _ = ioutil.ReadFile(p("ca.crt"))
+	root, _, err := cert.UnmarshalNebulaCertificateFromPEM(rb)
+	assert.Nil(t, err)
+	assert.Equal(t, key.Public(), ed25519.PublicKey(root.Details.PublicKey))
+
+	// the encrypted key signs once it is unlocked
+	args = []string{"-ca-crt", p("ca.crt"), "-ca-key", p("ca.key"), "-name", "host", "-ip", "1.1.1.1/24", "-out-crt", p("host.crt"), "-out-key", p("host.key")}
+	os.Setenv("NEBULA_KEY_PASSPHRASE", "hunter3")
+	assert.EqualError(t, signCert(args, ob, eb), "error while decrypting ca-key: invalid passphrase or corrupt private key")
+
+	os.Setenv("NEBULA_KEY_PASSPHRASE", "hunter2")
+	assert.Nil(t, signCert(args, ob, eb))
+	assert.Equal(t, "", ob.String())
+	assert.Equal(t, "", eb.String())
+}
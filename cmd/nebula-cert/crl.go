@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/slackhq/nebula/cert"
+)
+
+type crlFlags struct {
+	set          *flag.FlagSet
+	caKeyPath    *string
+	caCertPath   *string
+	outCRLPath   *string
+	fingerprints *string
+	version      *uint64
+	duration     *time.Duration
+}
+
+func newCRLFlags() *crlFlags {
+	cf := crlFlags{set: flag.NewFlagSet("crl", flag.ContinueOnError)}
+	cf.set.Usage = func() {}
+	cf.caKeyPath = cf.set.String("ca-key", "ca.key", "Optional: path to the signing CA key, a pkcs11: uri, or exec: followed by a signing command")
+	cf.caCertPath = cf.set.String("ca-crt", "ca.crt", "Optional: path to the signing CA cert, followed by its own intermediates if it has any")
+	cf.outCRLPath = cf.set.String("out-crl", "ca.crl", "Optional: path to write the crl to")
+	cf.fingerprints = cf.set.String("fingerprints", "", "Optional: comma separated list of certificate fingerprints to revoke")
+	cf.version = cf.set.Uint64("version", 0, "Required: version of the crl, must be greater than the version of any crl it replaces")
+	cf.duration = cf.set.Duration("duration", time.Hour*24*7, "Optional: how long the crl should be valid for, it must be reissued before it expires. Valid time units are seconds: \"s\", minutes: \"m\", hours: \"h\"")
+	return &cf
+}
+
+func crl(args []string, out io.Writer, errOut io.Writer) error {
+	cf := newCRLFlags()
+	err := cf.set.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	if err := mustFlagString("ca-key", cf.caKeyPath); err != nil {
+		return err
+	}
+	if err := mustFlagString("ca-crt", cf.caCertPath); err != nil {
+		return err
+	}
+	if err := mustFlagString("out-crl", cf.outCRLPath); err != nil {
+		return err
+	}
+	if *cf.version == 0 {
+		return newHelpErrorf("-version is required")
+	}
+	if *cf.duration <= 0 {
+		return newHelpErrorf("-duration must be greater than 0")
+	}
+
+	revoked := []string{}
+	seen := map[string]struct{}{}
+	if *cf.fingerprints != "" {
+		for _, rf := range strings.Split(*cf.fingerprints, ",") {
+			fp := strings.ToLower(strings.TrimSpace(rf))
+			if fp == "" {
+				continue
+			}
+
+			if b, err := hex.DecodeString(fp); err != nil || len(b) != 32 {
+				return newHelpErrorf("invalid fingerprint: %s", fp)
+			}
+			if _, ok := seen[fp]; ok {
+				continue
+			}
+			seen[fp] = struct{}{}
+			revoked = append(revoked, fp)
+		}
+	}
+
+	caKey, err := openSigner("ca-key", *cf.caKeyPath, errOut)
+	if err != nil {
+		return err
+	}
+	defer caKey.Close()
+
+	caChain, err := readCAChain(*cf.caCertPath)
+	if err != nil {
+		return err
+	}
+	caCert := caChain[0]
+
+	issuer, err := caCert.Sha256Sum()
+	if err != nil {
+		return fmt.Errorf("error while getting -ca-crt fingerprint: %s", err)
+	}
+
+	if caCert.Expired(time.Now()) {
+		return fmt.Errorf("ca certificate is expired")
+	}
+
+	now := time.Now()
+	notAfter := now.Add(*cf.duration)
+	// a crl is useless once the ca has expired, don't let it outlive the ca
+	if notAfter.After(caCert.Details.NotAfter) {
+		notAfter = caCert.Details.NotAfter
+	}
+
+	c := cert.NebulaCRL{
+		Details: cert.NebulaCRLDetails{
+			Issuer:   issuer,
+			Version:  *cf.version,
+			IssuedAt: now,
+			NotAfter: notAfter,
+			Revoked:  revoked,
+		},
+	}
+
+	// Hosts only know the roots, a list from an intermediate has to bring the way back to one along
+	if caCert.Details.Issuer != "" {
+		c.Chain = caChain
+	}
+
+	err = c.SignWith(caKey)
+	if err != nil {
+		return fmt.Errorf("error while signing: %s", err)
+	}
+
+	if !c.CheckSignature(caCert.Details.PublicKey) {
+		return fmt.Errorf("refusing to write crl, ca-key does not match ca-crt")
+	}
+
+	b, err := c.MarshalToPEM()
+	if err != nil {
+		return fmt.Errorf("error while marshalling crl: %s", err)
+	}
+
+	err = ioutil.WriteFile(*cf.outCRLPath, b, 0600)
+	if err != nil {
+		return fmt.Errorf("error while writing out-crl: %s", err)
+	}
+
+	return nil
+}
+
+func crlSummary() string {
+	return "crl <flags>: create and sign a certificate revocation list"
+}
+
+func crlHelp(out io.Writer) {
+	cf := newCRLFlags()
+	out.Write([]byte("Usage of " + os.Args[0] + " " + crlSummary() + "\n"))
+	cf.set.SetOutput(out)
+	cf.set.PrintDefaults()
+}
@@ -0,0 +1,155 @@
+// +build !windows
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/slackhq/nebula/cert"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ed25519"
+)
+
+func Test_crlSummary(t *testing.T) {
+	assert.Equal(t, "crl <flags>: create and sign a certificate revocation list", crlSummary())
+}
+
+func Test_crlHelp(t *testing.T) {
+	ob := &bytes.Buffer{}
+	crlHelp(ob)
+	assert.Equal(
+		t,
+		"Usage of "+os.Args[0]+" crl <flags>: create and sign a certificate revocation list\n"+
+			"  -ca-crt string\n"+
+			"    \tOptional: path to the signing CA cert, followed by its own intermediates if it has any (default \"ca.crt\")\n"+
+			"  -ca-key string\n"+
+			"    \tOptional: path to the signing CA key, a pkcs11: uri, or exec: followed by a signing command (default \"ca.key\")\n"+
+			"  -duration duration\n"+
+			"    \tOptional: how long the crl should be valid for, it must be reissued before it expires. Valid time units are seconds: \"s\", minutes: \"m\", hours: \"h\" (default 168h0m0s)\n"+
+			"  -fingerprints string\n"+
+			"    \tOptional: comma separated list of certificate fingerprints to revoke\n"+
+			"  -out-crl string\n"+
+			"    \tOptional: path to write the crl to (default \"ca.crl\")\n"+
+			"  -version uint\n"+
+			"    \tRequired: version of the crl, must be greater than the version of any crl it replaces\n",
+		ob.String(),
+	)
+}
+
+func Test_crl(t *testing.T) {
+	ob := &bytes.Buffer{}
+	eb := &bytes.Buffer{}
+
+	fp := "c99d4e650533b92061b09918e838a5a0a6aaee21eed1d12fd937682865936c72"
+
+	// required args
+	assertHelpError(t, crl([]string{"-ca-crt", "./nope", "-ca-key", "./nope"}, ob, eb), "-version is required")
+	assertHelpError(t, crl([]string{"-ca-crt", "./nope", "-ca-key", "./nope", "-version", "1", "-duration", "0"}, ob, eb), "-duration must be greater than 0")
+	assertHelpError(t, crl([]string{"-ca-crt", "./nope", "-ca-key", "./nope", "-version", "1", "-fingerprints", "abcd"}, ob, eb), "invalid fingerprint: abcd")
+	assert.Empty(t, ob.String())
+	assert.Empty(t, eb.String())
+
+	// failed to read key
+	args := []string{"-ca-crt", "./nope", "-ca-key", "./nope", "-version", "1", "-out-crl", "nope"}
+	assert.EqualError(t, crl(args, ob, eb), "error while reading ca-key: open ./nope: "+NoSuchFileError)
+
+	caKeyF, err := ioutil.TempFile("", "crl.key")
+	assert.Nil(t, err)
+	defer os.Remove(caKeyF.Name())
+	caPub, caPriv, _ := ed25519.GenerateKey(rand.Reader)
+	caKeyF.Write(cert.MarshalEd25519PrivateKey(caPriv))
+
+	// failed to read cert
+	args = []string{"-ca-crt", "./nope", "-ca-key", caKeyF.Name(), "-version", "1", "-out-crl", "nope"}
+	assert.EqualError(t, crl(args, ob, eb), "error while reading ca-crt: open ./nope: "+NoSuchFileError)
+
+	caCrtF, err := ioutil.TempFile("", "crl.crt")
+	assert.Nil(t, err)
+	defer os.Remove(caCrtF.Name())
+
+	// a ca that doesn't match the key
+	otherPub, _, _ := ed25519.GenerateKey(rand.Reader)
+	ca := cert.NebulaCertificate{
+		Details: cert.NebulaCertificateDetails{
+			Name:      "ca",
+			NotBefore: time.Now(),
+			NotAfter:  time.Now().Add(time.Hour),
+			PublicKey: otherPub,
+			IsCA:      true,
+		},
+	}
+	b, _ := ca.MarshalToPEM()
+	caCrtF.Write(b)
+
+	args = []string{"-ca-crt", caCrtF.Name(), "-ca-key", caKeyF.Name(), "-version", "1", "-out-crl", "nope"}
+	assert.EqualError(t, crl(args, ob, eb), "refusing to write crl, ca-key does not match ca-crt")
+
+	// a proper ca
+	ca.Details.PublicKey = caPub
+	b, _ = ca.MarshalToPEM()
+	caCrtF.Truncate(0)
+	caCrtF.WriteAt(b, 0)
+
+	// failed crl write
+	args = []string{"-ca-crt", caCrtF.Name(), "-ca-key", caKeyF.Name(), "-version", "1", "-out-crl", "/do/not/write/pleasecrl"}
+	assert.EqualError(t, crl(args, ob, eb), "error while writing out-crl: open /do/not/write/pleasecrl: "+NoSuchDirError)
+
+	crlF, err := ioutil.TempFile("", "test.crl")
+	assert.Nil(t, err)
+	defer os.Remove(crlF.Name())
+
+	// the duration is capped by the ca expiration
+	args = []string{"-ca-crt", caCrtF.Name(), "-ca-key", caKeyF.Name(), "-version", "7", "-out-crl", crlF.Name(), "-fingerprints", fp + ", , " + fp}
+	assert.Nil(t, crl(args, ob, eb))
+	assert.Empty(t, ob.String())
+	assert.Empty(t, eb.String())
+
+	rb, _ := ioutil.ReadFile(crlF.Name())
+	c, _, err := cert.UnmarshalNebulaCRLFromPEM(rb)
+	assert.Nil(t, err)
+	assert.True(t, c.CheckSignature(caPub))
+
+	issuer, _ := ca.Sha256Sum()
+	assert.Equal(t, issuer, c.Details.Issuer)
+	assert.Equal(t, uint64(7), c.Details.Version)
+	assert.Equal(t, []string{fp}, c.Details.Revoked)
+	assert.Equal(t, ca.Details.NotAfter.Unix(), c.Details.NotAfter.Unix())
+	assert.Empty(t, c.Chain)
+}
+
+func Test_crlIntermediate(t *testing.T) {
+	ob := &bytes.Buffer{}
+	eb := &bytes.Buffer{}
+
+	fp := "c99d4e650533b92061b09918e838a5a0a6aaee21eed1d12fd937682865936c72"
+
+	// a list from an intermediate carries the chain back to the root
+	dir, err := ioutil.TempDir("", "crl-intermediate")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	rootKey, rootCrt := filepath.Join(dir, "root.key"), filepath.Join(dir, "root.crt")
+	interKey, interCrt := filepath.Join(dir, "inter.key"), filepath.Join(dir, "inter.crt")
+	assert.Nil(t, ca([]string{"-name", "root", "-out-key", rootKey, "-out-crt", rootCrt}, ob, eb))
+	assert.Nil(t, ca([]string{"-name", "inter", "-intermediate", "-ca-key", rootKey, "-ca-crt", rootCrt, "-out-key", interKey, "-out-crt", interCrt, "-duration", "1h"}, ob, eb))
+
+	crlPath := filepath.Join(dir, "inter.crl")
+	args := []string{"-ca-crt", interCrt, "-ca-key", interKey, "-version", "1", "-out-crl", crlPath, "-fingerprints", fp}
+	assert.Nil(t, crl(args, ob, eb))
+
+	rb, _ := ioutil.ReadFile(crlPath)
+	c, _, err := cert.UnmarshalNebulaCRLFromPEM(rb)
+	assert.Nil(t, err)
+	assert.Len(t, c.Chain, 1)
+
+	rb, _ = ioutil.ReadFile(rootCrt)
+	pool, err := cert.NewCAPoolFromBytes(rb)
+	assert.Nil(t, err)
+	assert.Nil(t, pool.ApplyCRL(c, time.Now()))
+}
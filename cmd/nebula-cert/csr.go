@@ -0,0 +1,206 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/slackhq/nebula/cert"
+	"golang.org/x/crypto/curve25519"
+)
+
+type csrFlags struct {
+	set        *flag.FlagSet
+	name       *string
+	ip         *string
+	groups     *string
+	subnets    *string
+	meta       *string
+	inKeyPath  *string
+	outKeyPath *string
+	outCSRPath *string
+}
+
+func newCsrFlags() *csrFlags {
+	cf := csrFlags{set: flag.NewFlagSet("csr", flag.ContinueOnError)}
+	cf.set.Usage = func() {}
+	cf.name = cf.set.String("name", "", "Required: name of the cert, usually a hostname")
+	cf.ip = cf.set.String("ip", "", "Required: comma separated list of ip and network in CIDR notation to request, ipv4 addresses are preferred as the primary address")
+	cf.groups = cf.set.String("groups", "", "Optional: comma separated list of groups to request")
+	cf.subnets = cf.set.String("subnets", "", "Optional: comma separated list of subnets to request")
+	cf.meta = cf.set.String("meta", "", "Optional: comma separated list of key=value pairs to request")
+	cf.inKeyPath = cf.set.String("in-key", "", "Optional: path to a private key from nebula-cert keygen to use instead of generating one, it may be encrypted")
+	cf.outKeyPath = cf.set.String("out-key", "", "Optional (if in-key not set): path to write the private key to")
+	cf.outCSRPath = cf.set.String("out-csr", "", "Optional: path to write the certificate request to")
+	return &cf
+}
+
+func csr(args []string, out io.Writer, errOut io.Writer) error {
+	cf := newCsrFlags()
+	err := cf.set.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	if err := mustFlagString("name", cf.name); err != nil {
+		return err
+	}
+	if err := mustFlagString("ip", cf.ip); err != nil {
+		return err
+	}
+	if *cf.inKeyPath != "" && *cf.outKeyPath != "" {
+		return newHelpErrorf("cannot set both -in-key and -out-key")
+	}
+
+	ips := []*net.IPNet{}
+	for _, rs := range strings.Split(*cf.ip, ",") {
+		rs := strings.Trim(rs, " ")
+		if rs != "" {
+			ip, ipNet, err := net.ParseCIDR(rs)
+			if err != nil {
+				return newHelpErrorf("invalid ip definition: %s", err)
+			}
+			ipNet.IP = ip
+			ips = append(ips, ipNet)
+		}
+	}
+
+	if len(ips) == 0 {
+		return newHelpErrorf("invalid ip definition: no ips provided")
+	}
+
+	// ipv4 addresses are always encoded before ipv6 addresses, order them the same way up front
+	sort.SliceStable(ips, func(i, j int) bool {
+		return ips[i].IP.To4() != nil && ips[j].IP.To4() == nil
+	})
+
+	groups := []string{}
+	if *cf.groups != "" {
+		for _, rg := range strings.Split(*cf.groups, ",") {
+			g := strings.TrimSpace(rg)
+			if g != "" {
+				groups = append(groups, g)
+			}
+		}
+	}
+
+	subnets := []*net.IPNet{}
+	if *cf.subnets != "" {
+		for _, rs := range strings.Split(*cf.subnets, ",") {
+			rs := strings.Trim(rs, " ")
+			if rs != "" {
+				_, s, err := net.ParseCIDR(rs)
+				if err != nil {
+					return newHelpErrorf("invalid subnet definition: %s", err)
+				}
+				subnets = append(subnets, s)
+			}
+		}
+	}
+
+	metadata, err := parseMetadata(*cf.meta)
+	if err != nil {
+		return err
+	}
+
+	var pub, rawPriv []byte
+	if *cf.inKeyPath != "" {
+		rawKey, err := ioutil.ReadFile(*cf.inKeyPath)
+		if err != nil {
+			return fmt.Errorf("error while reading in-key: %s", err)
+		}
+
+		if cert.IsEncryptedPrivateKey(rawKey) {
+			passphrase, err := readPassphrase(errOut, "in-key", false)
+			if err != nil {
+				return err
+			}
+
+			rawPriv, _, err = cert.DecryptAndUnmarshalX25519PrivateKey(passphrase, rawKey)
+			if err != nil {
+				return fmt.Errorf("error while decrypting in-key: %s", err)
+			}
+
+		} else {
+			rawPriv, _, err = cert.UnmarshalX25519PrivateKey(rawKey)
+			if err != nil {
+				return fmt.Errorf("error while parsing in-key: %s", err)
+			}
+		}
+
+		pub, err = curve25519.X25519(rawPriv, curve25519.Basepoint)
+		if err != nil {
+			return fmt.Errorf("error while parsing in-key: %s", err)
+		}
+
+	} else {
+		pub, rawPriv = x25519Keypair()
+	}
+
+	req := cert.NebulaCSR{
+		Details: cert.NebulaCertificateDetails{
+			Name:      *cf.name,
+			Ips:       ips,
+			Groups:    groups,
+			Subnets:   subnets,
+			PublicKey: pub,
+			Metadata:  metadata,
+		},
+	}
+
+	if *cf.outKeyPath == "" && *cf.inKeyPath == "" {
+		*cf.outKeyPath = *cf.name + ".key"
+	}
+
+	if *cf.outCSRPath == "" {
+		*cf.outCSRPath = *cf.name + ".csr"
+	}
+
+	if _, err := os.Stat(*cf.outCSRPath); err == nil {
+		return fmt.Errorf("refusing to overwrite existing certificate request: %s", *cf.outCSRPath)
+	}
+
+	err = req.Sign(rawPriv)
+	if err != nil {
+		return fmt.Errorf("error while signing: %s", err)
+	}
+
+	if *cf.inKeyPath == "" {
+		if _, err := os.Stat(*cf.outKeyPath); err == nil {
+			return fmt.Errorf("refusing to overwrite existing key: %s", *cf.outKeyPath)
+		}
+
+		err = ioutil.WriteFile(*cf.outKeyPath, cert.MarshalX25519PrivateKey(rawPriv), 0600)
+		if err != nil {
+			return fmt.Errorf("error while writing out-key: %s", err)
+		}
+	}
+
+	b, err := req.MarshalToPEM()
+	if err != nil {
+		return fmt.Errorf("error while marshalling certificate request: %s", err)
+	}
+
+	err = ioutil.WriteFile(*cf.outCSRPath, b, 0600)
+	if err != nil {
+		return fmt.Errorf("error while writing out-csr: %s", err)
+	}
+
+	return nil
+}
+
+func csrSummary() string {
+	return "csr <flags>: create a certificate request, signed by the host key, to be passed to `nebula-cert sign -in-csr`"
+}
+
+func csrHelp(out io.Writer) {
+	cf := newCsrFlags()
+	out.Write([]byte("Usage of " + os.Args[0] + " " + csrSummary() + "\n"))
+	cf.set.SetOutput(out)
+	cf.set.PrintDefaults()
+}
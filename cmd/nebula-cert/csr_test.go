@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/slackhq/nebula/cert"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_csrSummary(t *testing.T) {
+	assert.Equal(t, "csr <flags>: create a certificate request, signed by the host key, to be passed to `nebula-cert sign -in-csr`", csrSummary())
+}
+
+func Test_csrHelp(t *testing.T) {
+	ob := &bytes.Buffer{}
+	csrHelp(ob)
+	assert.Equal(
+		t,
+		"Usage of "+os.Args[0]+" csr <flags>: create a certificate request, signed by the host key, to be passed to `nebula-cert sign -in-csr`\n"+
+			"  -groups string\n"+
+			"    \tOptional: comma separated list of groups to request\n"+
+			"  -in-key string\n"+
+			"    \tOptional: path to a private key from nebula-cert keygen to use instead of generating one, it may be encrypted\n"+
+			"  -ip string\n"+
+			"    \tRequired: comma separated list of ip and network in CIDR notation to request, ipv4 addresses are preferred as the primary address\n"+
+			"  -meta string\n"+
+			"    \tOptional: comma separated list of key=value pairs to request\n"+
+			"  -name string\n"+
+			"    \tRequired: name of the cert, usually a hostname\n"+
+			"  -out-csr string\n"+
+			"    \tOptional: path to write the certificate request to\n"+
+			"  -out-key string\n"+
+			"    \tOptional (if in-key not set): path to write the private key to\n"+
+			"  -subnets string\n"+
+			"    \tOptional: comma separated list of subnets to request\n",
+		ob.String(),
+	)
+}
+
+func Test_csr(t *testing.T) {
+	ob := &bytes.Buffer{}
+	eb := &bytes.Buffer{}
+
+	// required args
+	assertHelpError(t, csr([]string{"-ip", "1.1.1.1/24"}, ob, eb), "-name is required")
+	assertHelpError(t, csr([]string{"-name", "test"}, ob, eb), "-ip is required")
+	assertHelpError(t, csr([]string{"-name", "test", "-ip", "1.1.1.1/24", "-in-key", "nope", "-out-key", "nope"}, ob, eb), "cannot set both -in-key and -out-key")
+	assertHelpError(t, csr([]string{"-name", "test", "-ip", "a1.1.1.1/24"}, ob, eb), "invalid ip definition: invalid CIDR address: a1.1.1.1/24")
+	assert.Equal(t, "", ob.String())
+	assert.Equal(t, "", eb.String())
+
+	dir, err := ioutil.TempDir("", "csr")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	// failed key read
+	reqPath := filepath.Join(dir, "test.csr")
+	keyPath := filepath.Join(dir, "test.key")
+	args := []string{"-name", "test", "-ip", "1.1.1.1/24", "-in-key", "./nope", "-out-csr", reqPath}
+	assert.EqualError(t, csr(args, ob, eb), "error while reading in-key: open ./nope: "+NoSuchFileError)
+
+	// proper request with a new key
+	args = []string{"-name", "test", "-ip", "1.1.1.1/24", "-groups", "1, 2", "-out-csr", reqPath, "-out-key", keyPath}
+	assert.Nil(t, csr(args, ob, eb))
+	assert.Equal(t, "", ob.String())
+	assert.Equal(t, "", eb.String())
+
+	rb, _ := ioutil.ReadFile(reqPath)
+	req, b, err := cert.UnmarshalNebulaCSRFromPEM(rb)
+	assert.Len(t, b, 0)
+	assert.Nil(t, err)
+	assert.True(t, req.CheckSignature())
+	assert.Equal(t, "test", req.Details.Name)
+	assert.Equal(t, []string{"1", "2"}, req.Details.Groups)
+
+	rb, _ = ioutil.ReadFile(keyPath)
+	lKey, _, err := cert.UnmarshalX25519PrivateKey(rb)
+	assert.Nil(t, err)
+	assert.Nil(t, req.Sign(lKey))
+
+	// refuse to overwrite an existing request
+	assert.EqualError(t, csr(args, ob, eb), "refusing to overwrite existing certificate request: "+reqPath)
+
+	// proper request with an existing encrypted key
+	encKey, err := cert.EncryptAndMarshalX25519PrivateKey(lKey, []byte("hunter2"), cert.NewArgon2Parameters(64, 1, 1))
+	assert.Nil(t, err)
+	assert.Nil(t, ioutil.WriteFile(keyPath, encKey, 0600))
+
+	os.Setenv("NEBULA_KEY_PASSPHRASE", "hunter2")
+	defer os.Unsetenv("NEBULA_KEY_PASSPHRASE")
+	os.Remove(reqPath)
+	args = []string{"-name", "test", "-ip", "1.1.1.1/24", "-out-csr", reqPath, "-in-key", keyPath}
+	assert.Nil(t, csr(args, ob, eb))
+
+	rb, _ = ioutil.ReadFile(reqPath)
+	req2, _, err := cert.UnmarshalNebulaCSRFromPEM(rb)
+	assert.Nil(t, err)
+	assert.True(t, req2.CheckSignature())
+	assert.Equal(t, req.Details.PublicKey, req2.Details.PublicKey)
+}
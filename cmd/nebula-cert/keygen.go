@@ -14,6 +14,7 @@ type keygenFlags struct {
 	set        *flag.FlagSet
 	outKeyPath *string
 	outPubPath *string
+	encryption *bool
 }
 
 func newKeygenFlags() *keygenFlags {
@@ -21,6 +22,7 @@ func newKeygenFlags() *keygenFlags {
 	cf.set.Usage = func() {}
 	cf.outPubPath = cf.set.String("out-pub", "", "Required: path to write the public key to")
 	cf.outKeyPath = cf.set.String("out-key", "", "Required: path to write the private key to")
+	cf.encryption = cf.set.Bool("encrypt", false, "Optional: encrypt out-key with a passphrase read from NEBULA_KEY_PASSPHRASE or the terminal, nebula will need the same passphrase to start")
 	return &cf
 }
 
@@ -40,7 +42,24 @@ func keygen(args []string, out io.Writer, errOut io.Writer) error {
 
 	pub, rawPriv := x25519Keypair()
 
-	err = ioutil.WriteFile(*cf.outKeyPath, cert.MarshalX25519PrivateKey(rawPriv), 0600)
+	b := cert.MarshalX25519PrivateKey(rawPriv)
+	if *cf.encryption {
+		passphrase, err := readPassphrase(errOut, "out-key", true)
+		if err != nil {
+			return err
+		}
+
+		if len(passphrase) == 0 {
+			return fmt.Errorf("no passphrase specified, remove -encrypt to write out-key in plaintext")
+		}
+
+		b, err = cert.EncryptAndMarshalX25519PrivateKey(rawPriv, passphrase, cert.DefaultArgon2Parameters())
+		if err != nil {
+			return fmt.Errorf("error while encrypting out-key: %s", err)
+		}
+	}
+
+	err = ioutil.WriteFile(*cf.outKeyPath, b, 0600)
 	if err != nil {
 		return fmt.Errorf("error while writing out-key: %s", err)
 	}
@@ -22,6 +22,8 @@ func Test_keygenHelp(t *testing.T) {
 	assert.Equal(
 		t,
 		"Usage of "+os.Args[0]+" keygen <flags>: create a public/private key pair. the public key can be passed to `nebula-cert sign`\n"+
+			"  -encrypt\n"+
+			"    \tOptional: encrypt out-key with a passphrase read from NEBULA_KEY_PASSPHRASE or the terminal, nebula will need the same passphrase to start\n"+
 			"  -out-key string\n"+
 			"    \tRequired: path to write the private key to\n"+
 			"  -out-pub string\n"+
@@ -89,4 +91,23 @@ func Test_keygen(t *testing.T) {
 	assert.Len(t, b, 0)
 	assert.Nil(t, err)
 	assert.Len(t, lPub, 32)
+
+	// encrypted keygen
+	os.Setenv("NEBULA_KEY_PASSPHRASE", "")
+	defer os.Unsetenv("NEBULA_KEY_PASSPHRASE")
+	os.Remove(keyF.Name())
+	args = []string{"-out-pub", pubF.Name(), "-out-key", keyF.Name(), "-encrypt"}
+	assert.EqualError(t, keygen(args, ob, eb), "no passphrase specified, remove -encrypt to write out-key in plaintext")
+
+	os.Setenv("NEBULA_KEY_PASSPHRASE", "hunter2")
+	assert.Nil(t, keygen(args, ob, eb))
+	assert.Equal(t, "", ob.String())
+	assert.Equal(t, "", eb.String())
+
+	rb, _ = ioutil.ReadFile(keyF.Name())
+	assert.True(t, cert.IsEncryptedPrivateKey(rb))
+	lKey, b, err = cert.DecryptAndUnmarshalX25519PrivateKey([]byte("hunter2"), rb)
+	assert.Len(t, b, 0)
+	assert.Nil(t, err)
+	assert.Len(t, lKey, 32)
 }
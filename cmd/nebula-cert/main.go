@@ -1,10 +1,18 @@
 package main
 
 import (
+	"bytes"
+	"crypto"
 	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
+	"strings"
+
+	"github.com/anmitsu/go-shlex"
+	"github.com/slackhq/nebula/cert"
+	"golang.org/x/term"
 )
 
 var Build string
@@ -71,6 +79,10 @@ func main() {
 		err = printCert(args[1:], os.Stdout, os.Stderr)
 	case "verify":
 		err = verify(args[1:], os.Stdout, os.Stderr)
+	case "crl":
+		err = crl(args[1:], os.Stdout, os.Stderr)
+	case "csr":
+		err = csr(args[1:], os.Stdout, os.Stderr)
 	default:
 		err = fmt.Errorf("unknown mode: %s", args[0])
 	}
@@ -104,6 +116,10 @@ func handleError(mode string, e error, out io.Writer) int {
 			printHelp(out)
 		case "verify":
 			verifyHelp(out)
+		case "crl":
+			crlHelp(out)
+		case "csr":
+			csrHelp(out)
 		}
 	}
 
@@ -127,6 +143,8 @@ func help(err string, out io.Writer) {
 	fmt.Fprintln(out, "    "+signSummary())
 	fmt.Fprintln(out, "    "+printSummary())
 	fmt.Fprintln(out, "    "+verifySummary())
+	fmt.Fprintln(out, "    "+crlSummary())
+	fmt.Fprintln(out, "    "+csrSummary())
 }
 
 func mustFlagString(name string, val *string) error {
@@ -135,3 +153,130 @@ func mustFlagString(name string, val *string) error {
 	}
 	return nil
 }
+
+// parseMetadata turns a comma separated list of key=value pairs into a map, an empty string results in a nil map
+func parseMetadata(s string) (map[string]string, error) {
+	var md map[string]string
+	for _, rm := range strings.Split(s, ",") {
+		rm = strings.TrimSpace(rm)
+		if rm == "" {
+			continue
+		}
+
+		kv := strings.SplitN(rm, "=", 2)
+		k := strings.TrimSpace(kv[0])
+		if len(kv) != 2 || k == "" {
+			return nil, newHelpErrorf("invalid meta definition: %s should be key=value", rm)
+		}
+
+		if md == nil {
+			md = make(map[string]string)
+		}
+
+		if _, ok := md[k]; ok {
+			return nil, newHelpErrorf("invalid meta definition: %s was provided more than once", k)
+		}
+		md[k] = strings.TrimSpace(kv[1])
+	}
+
+	return md, nil
+}
+
+// keySigner is a signing key that may hold resources, like a PKCS#11 session, until closed
+type keySigner interface {
+	crypto.Signer
+	Close() error
+}
+
+type nopCloseSigner struct {
+	crypto.Signer
+}
+
+func (nopCloseSigner) Close() error {
+	return nil
+}
+
+// openSigner opens the ed25519 key given to the named flag. It is a pkcs11: uri, exec: followed by a signing
+// command, or the path to a key file which may be encrypted
+func openSigner(name string, spec string, errOut io.Writer) (keySigner, error) {
+	switch {
+	case strings.HasPrefix(spec, "pkcs11:"):
+		s, err := cert.NewPKCS11Signer(spec)
+		if err != nil {
+			return nil, fmt.Errorf("error while opening %s: %s", name, err)
+		}
+		return s, nil
+
+	case strings.HasPrefix(spec, "exec:"):
+		args, err := shlex.Split(strings.TrimPrefix(spec, "exec:"), true)
+		if err != nil {
+			return nil, fmt.Errorf("error while parsing %s command: %s", name, err)
+		}
+
+		s, err := cert.NewCommandSigner(args)
+		if err != nil {
+			return nil, fmt.Errorf("error while opening %s: %s", name, err)
+		}
+		return nopCloseSigner{s}, nil
+	}
+
+	rawKey, err := ioutil.ReadFile(spec)
+	if err != nil {
+		return nil, fmt.Errorf("error while reading %s: %s", name, err)
+	}
+
+	if cert.IsEncryptedPrivateKey(rawKey) {
+		passphrase, err := readPassphrase(errOut, name, false)
+		if err != nil {
+			return nil, err
+		}
+
+		key, _, err := cert.DecryptAndUnmarshalEd25519PrivateKey(passphrase, rawKey)
+		if err != nil {
+			return nil, fmt.Errorf("error while decrypting %s: %s", name, err)
+		}
+		return nopCloseSigner{key}, nil
+	}
+
+	key, _, err := cert.UnmarshalEd25519PrivateKey(rawKey)
+	if err != nil {
+		return nil, fmt.Errorf("error while parsing %s: %s", name, err)
+	}
+
+	return nopCloseSigner{key}, nil
+}
+
+// readPassphrase gets the passphrase for the key in the named flag from NEBULA_KEY_PASSPHRASE, or by asking on the
+// terminal. A new passphrase is asked for twice
+func readPassphrase(errOut io.Writer, name string, confirm bool) ([]byte, error) {
+	if p, ok := os.LookupEnv("NEBULA_KEY_PASSPHRASE"); ok {
+		return []byte(p), nil
+	}
+
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return nil, fmt.Errorf("no passphrase for %s, set NEBULA_KEY_PASSPHRASE or run from a terminal", name)
+	}
+
+	fmt.Fprintf(errOut, "Enter passphrase for %s: ", name)
+	p, err := term.ReadPassword(fd)
+	fmt.Fprintln(errOut)
+	if err != nil {
+		return nil, fmt.Errorf("error while reading passphrase: %s", err)
+	}
+
+	if confirm {
+		fmt.Fprintf(errOut, "Confirm passphrase for %s: ", name)
+		p2, err := term.ReadPassword(fd)
+		fmt.Fprintln(errOut)
+		if err != nil {
+			return nil, fmt.Errorf("error while reading passphrase: %s", err)
+		}
+
+		if !bytes.Equal(p, p2) {
+			return nil, fmt.Errorf("passphrases did not match")
+		}
+	}
+
+	return p, nil
+}
@@ -2,12 +2,17 @@ package main
 
 import (
 	"bytes"
+	"encoding/hex"
 	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"testing"
 
+	"github.com/slackhq/nebula/cert"
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ed25519"
 )
 
 //TODO: all flag parsing continueOnError will print to stderr on its own currently
@@ -22,7 +27,9 @@ func Test_help(t *testing.T) {
 		"    " + keygenSummary() + "\n" +
 		"    " + signSummary() + "\n" +
 		"    " + printSummary() + "\n" +
-		"    " + verifySummary() + "\n"
+		"    " + verifySummary() + "\n" +
+		"    " + crlSummary() + "\n" +
+		"    " + csrSummary() + "\n"
 
 	ob := &bytes.Buffer{}
 
@@ -57,7 +64,7 @@ func Test_handleError(t *testing.T) {
 	assert.Equal(t, "Error: test error\n", ob.String())
 
 	// test all modes with help error
-	modes := map[string]func(io.Writer){"ca": caHelp, "print": printHelp, "sign": signHelp, "verify": verifyHelp}
+	modes := map[string]func(io.Writer){"ca": caHelp, "print": printHelp, "sign": signHelp, "verify": verifyHelp, "crl": crlHelp, "csr": csrHelp}
 	eb := &bytes.Buffer{}
 	for mode, fn := range modes {
 		ob.Reset()
@@ -80,3 +87,32 @@ func assertHelpError(t *testing.T, err error, msg string) {
 
 	assert.EqualError(t, err, msg)
 }
+
+// Test_signerHelper is not a real test, it acts as an exec: signing command when NEBULA_TEST_SIGNER_KEY is set
+func Test_signerHelper(t *testing.T) {
+	rawKey := os.Getenv("NEBULA_TEST_SIGNER_KEY")
+	if rawKey == "" {
+		return
+	}
+
+	b, _ := hex.DecodeString(rawKey)
+	key := ed25519.PrivateKey(b)
+
+	switch os.Args[len(os.Args)-1] {
+	case "public":
+		os.Stdout.Write(cert.MarshalEd25519PublicKey(key.Public().(ed25519.PublicKey)))
+	case "sign":
+		msg, _ := ioutil.ReadAll(os.Stdin)
+		os.Stdout.Write(ed25519.Sign(key, msg))
+	default:
+		fmt.Fprint(os.Stderr, "unknown operation")
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+// signerHelperCommand returns an exec: key flag value that signs with key
+func signerHelperCommand(key ed25519.PrivateKey) string {
+	os.Setenv("NEBULA_TEST_SIGNER_KEY", hex.EncodeToString(key))
+	return "exec:" + os.Args[0] + " -test.run=^Test_signerHelper$ --"
+}
@@ -8,6 +8,7 @@ import (
 	"io/ioutil"
 	"net"
 	"os"
+	"sort"
 	"strings"
 	"time"
 
@@ -24,27 +25,31 @@ type signFlags struct {
 	ip          *string
 	duration    *time.Duration
 	inPubPath   *string
+	inCSRPath   *string
 	outKeyPath  *string
 	outCertPath *string
 	outQRPath   *string
 	groups      *string
 	subnets     *string
+	meta        *string
 }
 
 func newSignFlags() *signFlags {
 	sf := signFlags{set: flag.NewFlagSet("sign", flag.ContinueOnError)}
 	sf.set.Usage = func() {}
-	sf.caKeyPath = sf.set.String("ca-key", "ca.key", "Optional: path to the signing CA key")
+	sf.caKeyPath = sf.set.String("ca-key", "ca.key", "Optional: path to the signing CA key, a pkcs11: uri, or exec: followed by a signing command")
 	sf.caCertPath = sf.set.String("ca-crt", "ca.crt", "Optional: path to the signing CA cert")
-	sf.name = sf.set.String("name", "", "Required: name of the cert, usually a hostname")
-	sf.ip = sf.set.String("ip", "", "Required: ip and network in CIDR notation to assign the cert")
+	sf.name = sf.set.String("name", "", "Required (if in-csr not set): name of the cert, usually a hostname")
+	sf.ip = sf.set.String("ip", "", "Required (if in-csr not set): comma separated list of ip and network in CIDR notation to assign the cert, ipv4 addresses are preferred as the primary address")
 	sf.duration = sf.set.Duration("duration", 0, "Optional: how long the cert should be valid for. The default is 1 second before the signing cert expires. Valid time units are seconds: \"s\", minutes: \"m\", hours: \"h\"")
 	sf.inPubPath = sf.set.String("in-pub", "", "Optional (if out-key not set): path to read a previously generated public key")
+	sf.inCSRPath = sf.set.String("in-csr", "", "Optional: path to a certificate request from nebula-cert csr, -name, -ip, -groups, -subnets and -meta replace what it asks for when set")
 	sf.outKeyPath = sf.set.String("out-key", "", "Optional (if in-pub not set): path to write the private key to")
 	sf.outCertPath = sf.set.String("out-crt", "", "Optional: path to write the certificate to")
 	sf.outQRPath = sf.set.String("out-qr", "", "Optional: output a qr code image (png) of the certificate")
 	sf.groups = sf.set.String("groups", "", "Optional: comma separated list of groups")
 	sf.subnets = sf.set.String("subnets", "", "Optional: comma separated list of subnet this cert can serve for")
+	sf.meta = sf.set.String("meta", "", "Optional: comma separated list of key=value pairs to sign into the cert")
 	return &sf
 
 }
@@ -62,35 +67,53 @@ func signCert(args []string, out io.Writer, errOut io.Writer) error {
 	if err := mustFlagString("ca-crt", sf.caCertPath); err != nil {
 		return err
 	}
-	if err := mustFlagString("name", sf.name); err != nil {
-		return err
-	}
-	if err := mustFlagString("ip", sf.ip); err != nil {
-		return err
+	if *sf.inCSRPath == "" {
+		if err := mustFlagString("name", sf.name); err != nil {
+			return err
+		}
+		if err := mustFlagString("ip", sf.ip); err != nil {
+			return err
+		}
+	} else if *sf.inPubPath != "" || *sf.outKeyPath != "" {
+		return newHelpErrorf("cannot set -in-pub or -out-key with -in-csr")
 	}
 	if *sf.inPubPath != "" && *sf.outKeyPath != "" {
 		return newHelpErrorf("cannot set both -in-pub and -out-key")
 	}
 
-	rawCAKey, err := ioutil.ReadFile(*sf.caKeyPath)
-	if err != nil {
-		return fmt.Errorf("error while reading ca-key: %s", err)
-	}
+	var req *cert.NebulaCSR
+	if *sf.inCSRPath != "" {
+		rawCSR, err := ioutil.ReadFile(*sf.inCSRPath)
+		if err != nil {
+			return fmt.Errorf("error while reading in-csr: %s", err)
+		}
 
-	caKey, _, err := cert.UnmarshalEd25519PrivateKey(rawCAKey)
-	if err != nil {
-		return fmt.Errorf("error while parsing ca-key: %s", err)
+		req, _, err = cert.UnmarshalNebulaCSRFromPEM(rawCSR)
+		if err != nil {
+			return fmt.Errorf("error while parsing in-csr: %s", err)
+		}
+
+		// Only the holder of the private key could have signed the request
+		if !req.CheckSignature() {
+			return fmt.Errorf("refusing to sign, in-csr was not signed by the key it requests a certificate for")
+		}
+
+		if *sf.name == "" {
+			*sf.name = req.Details.Name
+		}
 	}
 
-	rawCACert, err := ioutil.ReadFile(*sf.caCertPath)
+	caKey, err := openSigner("ca-key", *sf.caKeyPath, errOut)
 	if err != nil {
-		return fmt.Errorf("error while reading ca-crt: %s", err)
+		return err
 	}
+	defer caKey.Close()
 
-	caCert, _, err := cert.UnmarshalNebulaCertificateFromPEM(rawCACert)
+	caChain, err := readCAChain(*sf.caCertPath)
 	if err != nil {
-		return fmt.Errorf("error while parsing ca-crt: %s", err)
+		return err
 	}
+	caCert := caChain[0]
 
 	issuer, err := caCert.Sha256Sum()
 	if err != nil {
@@ -106,13 +129,35 @@ func signCert(args []string, out io.Writer, errOut io.Writer) error {
 		*sf.duration = time.Until(caCert.Details.NotAfter) - time.Second*1
 	}
 
-	ip, ipNet, err := net.ParseCIDR(*sf.ip)
-	if err != nil {
-		return newHelpErrorf("invalid ip definition: %s", err)
+	ips := []*net.IPNet{}
+	if req != nil && *sf.ip == "" {
+		ips = req.Details.Ips
 	}
-	ipNet.IP = ip
+	for _, rs := range strings.Split(*sf.ip, ",") {
+		rs := strings.Trim(rs, " ")
+		if rs != "" {
+			ip, ipNet, err := net.ParseCIDR(rs)
+			if err != nil {
+				return newHelpErrorf("invalid ip definition: %s", err)
+			}
+			ipNet.IP = ip
+			ips = append(ips, ipNet)
+		}
+	}
+
+	if len(ips) == 0 {
+		return newHelpErrorf("invalid ip definition: no ips provided")
+	}
+
+	// ipv4 addresses are always encoded before ipv6 addresses, order them the same way up front
+	sort.SliceStable(ips, func(i, j int) bool {
+		return ips[i].IP.To4() != nil && ips[j].IP.To4() == nil
+	})
 
 	groups := []string{}
+	if req != nil && *sf.groups == "" {
+		groups = req.Details.Groups
+	}
 	if *sf.groups != "" {
 		for _, rg := range strings.Split(*sf.groups, ",") {
 			g := strings.TrimSpace(rg)
@@ -123,6 +168,9 @@ func signCert(args []string, out io.Writer, errOut io.Writer) error {
 	}
 
 	subnets := []*net.IPNet{}
+	if req != nil && *sf.subnets == "" {
+		subnets = req.Details.Subnets
+	}
 	if *sf.subnets != "" {
 		for _, rs := range strings.Split(*sf.subnets, ",") {
 			rs := strings.Trim(rs, " ")
@@ -136,8 +184,18 @@ func signCert(args []string, out io.Writer, errOut io.Writer) error {
 		}
 	}
 
+	metadata, err := parseMetadata(*sf.meta)
+	if err != nil {
+		return err
+	}
+	if req != nil && *sf.meta == "" {
+		metadata = req.Details.Metadata
+	}
+
 	var pub, rawPriv []byte
-	if *sf.inPubPath != "" {
+	if req != nil {
+		pub = req.Details.PublicKey
+	} else if *sf.inPubPath != "" {
 		rawPub, err := ioutil.ReadFile(*sf.inPubPath)
 		if err != nil {
 			return fmt.Errorf("error while reading in-pub: %s", err)
@@ -153,7 +211,7 @@ func signCert(args []string, out io.Writer, errOut io.Writer) error {
 	nc := cert.NebulaCertificate{
 		Details: cert.NebulaCertificateDetails{
 			Name:      *sf.name,
-			Ips:       []*net.IPNet{ipNet},
+			Ips:       ips,
 			Groups:    groups,
 			Subnets:   subnets,
 			NotBefore: time.Now(),
@@ -161,11 +219,14 @@ func signCert(args []string, out io.Writer, errOut io.Writer) error {
 			PublicKey: pub,
 			IsCA:      false,
 			Issuer:    issuer,
+			Metadata:  metadata,
 		},
 	}
 
-	if err := nc.CheckRootConstrains(caCert); err != nil {
-		return fmt.Errorf("refusing to sign, root certificate constraints violated: %s", err)
+	for _, c := range caChain {
+		if err := nc.CheckRootConstrains(c); err != nil {
+			return fmt.Errorf("refusing to sign, root certificate constraints violated: %s", err)
+		}
 	}
 
 	if *sf.outKeyPath == "" {
@@ -180,12 +241,16 @@ func signCert(args []string, out io.Writer, errOut io.Writer) error {
 		return fmt.Errorf("refusing to overwrite existing cert: %s", *sf.outCertPath)
 	}
 
-	err = nc.Sign(caKey)
+	err = nc.SignWith(caKey)
 	if err != nil {
 		return fmt.Errorf("error while signing: %s", err)
 	}
 
-	if *sf.inPubPath == "" {
+	if !nc.CheckSignature(caCert.Details.PublicKey) {
+		return fmt.Errorf("refusing to sign, ca-key does not match ca-crt")
+	}
+
+	if rawPriv != nil {
 		if _, err := os.Stat(*sf.outKeyPath); err == nil {
 			return fmt.Errorf("refusing to overwrite existing key: %s", *sf.outKeyPath)
 		}
@@ -201,6 +266,11 @@ func signCert(args []string, out io.Writer, errOut io.Writer) error {
 		return fmt.Errorf("error while marshalling certificate: %s", err)
 	}
 
+	b, err = appendCAChain(b, caChain)
+	if err != nil {
+		return err
+	}
+
 	err = ioutil.WriteFile(*sf.outCertPath, b, 0600)
 	if err != nil {
 		return fmt.Errorf("error while writing out-crt: %s", err)
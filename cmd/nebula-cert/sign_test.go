@@ -7,6 +7,7 @@ import (
 	"crypto/rand"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -30,17 +31,21 @@ func Test_signHelp(t *testing.T) {
 			"  -ca-crt string\n"+
 			"    \tOptional: path to the signing CA cert (default \"ca.crt\")\n"+
 			"  -ca-key string\n"+
-			"    \tOptional: path to the signing CA key (default \"ca.key\")\n"+
+			"    \tOptional: path to the signing CA key, a pkcs11: uri, or exec: followed by a signing command (default \"ca.key\")\n"+
 			"  -duration duration\n"+
 			"    \tOptional: how long the cert should be valid for. The default is 1 second before the signing cert expires. Valid time units are seconds: \"s\", minutes: \"m\", hours: \"h\"\n"+
 			"  -groups string\n"+
 			"    \tOptional: comma separated list of groups\n"+
+			"  -in-csr string\n"+
+			"    \tOptional: path to a certificate request from nebula-cert csr, -name, -ip, -groups, -subnets and -meta replace what it asks for when set\n"+
 			"  -in-pub string\n"+
 			"    \tOptional (if out-key not set): path to read a previously generated public key\n"+
 			"  -ip string\n"+
-			"    \tRequired: ip and network in CIDR notation to assign the cert\n"+
+			"    \tRequired (if in-csr not set): comma separated list of ip and network in CIDR notation to assign the cert, ipv4 addresses are preferred as the primary address\n"+
+			"  -meta string\n"+
+			"    \tOptional: comma separated list of key=value pairs to sign into the cert\n"+
 			"  -name string\n"+
-			"    \tRequired: name of the cert, usually a hostname\n"+
+			"    \tRequired (if in-csr not set): name of the cert, usually a hostname\n"+
 			"  -out-crt string\n"+
 			"    \tOptional: path to write the certificate to\n"+
 			"  -out-key string\n"+
@@ -167,6 +172,21 @@ func Test_signCert(t *testing.T) {
 	assert.Empty(t, ob.String())
 	assert.Empty(t, eb.String())
 
+	// bad meta
+	ob.Reset()
+	eb.Reset()
+	args = []string{"-ca-crt", caCrtF.Name(), "-ca-key", caKeyF.Name(), "-name", "test", "-ip", "1.1.1.1/24", "-out-crt", "nope", "-out-key", "nope", "-duration", "100m", "-meta", "env"}
+	assertHelpError(t, signCert(args, ob, eb), "invalid meta definition: env should be key=value")
+	assert.Empty(t, ob.String())
+	assert.Empty(t, eb.String())
+
+	ob.Reset()
+	eb.Reset()
+	args = []string{"-ca-crt", caCrtF.Name(), "-ca-key", caKeyF.Name(), "-name", "test", "-ip", "1.1.1.1/24", "-out-crt", "nope", "-out-key", "nope", "-duration", "100m", "-meta", "env=prod,env=dev"}
+	assertHelpError(t, signCert(args, ob, eb), "invalid meta definition: env was provided more than once")
+	assert.Empty(t, ob.String())
+	assert.Empty(t, eb.String())
+
 	// failed key write
 	ob.Reset()
 	eb.Reset()
@@ -234,6 +254,42 @@ func Test_signCert(t *testing.T) {
 
 	assert.True(t, lCrt.CheckSignature(caPub))
 
+	// test proper dual stack cert
+	os.Remove(keyF.Name())
+	os.Remove(crtF.Name())
+	ob.Reset()
+	eb.Reset()
+	args = []string{"-ca-crt", caCrtF.Name(), "-ca-key", caKeyF.Name(), "-name", "test", "-ip", "fd00::1/64, 1.1.1.1/24", "-out-crt", crtF.Name(), "-out-key", keyF.Name(), "-duration", "100m"}
+	assert.Nil(t, signCert(args, ob, eb))
+	assert.Empty(t, ob.String())
+	assert.Empty(t, eb.String())
+
+	rb, _ = ioutil.ReadFile(crtF.Name())
+	lCrt, b, err = cert.UnmarshalNebulaCertificateFromPEM(rb)
+	assert.Len(t, b, 0)
+	assert.Nil(t, err)
+	assert.Len(t, lCrt.Details.Ips, 2)
+	assert.Equal(t, "1.1.1.1/24", lCrt.Details.Ips[0].String())
+	assert.Equal(t, "fd00::1/64", lCrt.Details.Ips[1].String())
+	assert.True(t, lCrt.CheckSignature(caPub))
+
+	// test proper cert with metadata
+	os.Remove(keyF.Name())
+	os.Remove(crtF.Name())
+	ob.Reset()
+	eb.Reset()
+	args = []string{"-ca-crt", caCrtF.Name(), "-ca-key", caKeyF.Name(), "-name", "test", "-ip", "1.1.1.1/24", "-out-crt", crtF.Name(), "-out-key", keyF.Name(), "-duration", "100m", "-meta", "env=prod, ,  app = web=1 ,empty="}
+	assert.Nil(t, signCert(args, ob, eb))
+	assert.Empty(t, ob.String())
+	assert.Empty(t, eb.String())
+
+	rb, _ = ioutil.ReadFile(crtF.Name())
+	lCrt, b, err = cert.UnmarshalNebulaCertificateFromPEM(rb)
+	assert.Len(t, b, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"env": "prod", "app": "web=1", "empty": ""}, lCrt.Details.Metadata)
+	assert.True(t, lCrt.CheckSignature(caPub))
+
 	// test proper cert with in-pub
 	os.Remove(keyF.Name())
 	os.Remove(crtF.Name())
@@ -289,3 +345,81 @@ func Test_signCert(t *testing.T) {
 	assert.Empty(t, ob.String())
 	assert.Empty(t, eb.String())
 }
+
+func Test_signCertCSR(t *testing.T) {
+	ob := &bytes.Buffer{}
+	eb := &bytes.Buffer{}
+
+	dir, err := ioutil.TempDir("", "sign-csr")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	caKeyPath := filepath.Join(dir, "ca.key")
+	caCrtPath := filepath.Join(dir, "ca.crt")
+	assert.Nil(t, ca([]string{"-name", "ca", "-duration", "1h", "-out-key", caKeyPath, "-out-crt", caCrtPath}, ob, eb))
+
+	reqPath := filepath.Join(dir, "host.csr")
+	keyPath := filepath.Join(dir, "host.key")
+	args := []string{"-name", "host", "-ip", "10.1.0.1/16", "-groups", "servers", "-subnets", "10.2.0.0/16", "-meta", "env=prod", "-out-csr", reqPath, "-out-key", keyPath}
+	assert.Nil(t, csr(args, ob, eb))
+
+	// cannot set -in-csr with a key
+	crtPath := filepath.Join(dir, "host.crt")
+	assertHelpError(t, signCert([]string{"-ca-crt", caCrtPath, "-ca-key", caKeyPath, "-in-csr", reqPath, "-in-pub", "nope", "-out-crt", crtPath}, ob, eb), "cannot set -in-pub or -out-key with -in-csr")
+	assertHelpError(t, signCert([]string{"-ca-crt", caCrtPath, "-ca-key", caKeyPath, "-in-csr", reqPath, "-out-key", "nope", "-out-crt", crtPath}, ob, eb), "cannot set -in-pub or -out-key with -in-csr")
+
+	// failed to read or parse the request
+	args = []string{"-ca-crt", caCrtPath, "-ca-key", caKeyPath, "-in-csr", "./nope", "-out-crt", crtPath}
+	assert.EqualError(t, signCert(args, ob, eb), "error while reading in-csr: open ./nope: "+NoSuchFileError)
+
+	args = []string{"-ca-crt", caCrtPath, "-ca-key", caKeyPath, "-in-csr", caCrtPath, "-out-crt", crtPath}
+	assert.EqualError(t, signCert(args, ob, eb), "error while parsing in-csr: bytes did not contain a proper nebula certificate request banner")
+
+	// the request details are used when flags are not set
+	ob.Reset()
+	eb.Reset()
+	args = []string{"-ca-crt", caCrtPath, "-ca-key", caKeyPath, "-in-csr", reqPath, "-out-crt", crtPath}
+	assert.Nil(t, signCert(args, ob, eb))
+	assert.Empty(t, ob.String())
+	assert.Empty(t, eb.String())
+
+	rb, _ := ioutil.ReadFile(crtPath)
+	lCrt, _, err := cert.UnmarshalNebulaCertificateFromPEM(rb)
+	assert.Nil(t, err)
+	assert.Equal(t, "host", lCrt.Details.Name)
+	assert.Equal(t, "10.1.0.1/16", lCrt.Details.Ips[0].String())
+	assert.Equal(t, []string{"servers"}, lCrt.Details.Groups)
+	assert.Equal(t, "10.2.0.0/16", lCrt.Details.Subnets[0].String())
+	assert.Equal(t, map[string]string{"env": "prod"}, lCrt.Details.Metadata)
+
+	rb, _ = ioutil.ReadFile(keyPath)
+	lKey, _, err := cert.UnmarshalX25519PrivateKey(rb)
+	assert.Nil(t, err)
+	assert.Nil(t, lCrt.VerifyPrivateKey(lKey))
+
+	// flags replace what was requested
+	os.Remove(crtPath)
+	args = []string{"-ca-crt", caCrtPath, "-ca-key", caKeyPath, "-in-csr", reqPath, "-out-crt", crtPath, "-name", "other", "-ip", "10.1.0.2/16", "-groups", "admins"}
+	assert.Nil(t, signCert(args, ob, eb))
+
+	rb, _ = ioutil.ReadFile(crtPath)
+	lCrt, _, err = cert.UnmarshalNebulaCertificateFromPEM(rb)
+	assert.Nil(t, err)
+	assert.Equal(t, "other", lCrt.Details.Name)
+	assert.Equal(t, "10.1.0.2/16", lCrt.Details.Ips[0].String())
+	assert.Equal(t, []string{"admins"}, lCrt.Details.Groups)
+	assert.Equal(t, "10.2.0.0/16", lCrt.Details.Subnets[0].String())
+
+	// a request that was tampered with is refused
+	rb, _ = ioutil.ReadFile(reqPath)
+	req, _, err := cert.UnmarshalNebulaCSRFromPEM(rb)
+	assert.Nil(t, err)
+	req.Details.Groups = []string{"admins"}
+	b, err := req.MarshalToPEM()
+	assert.Nil(t, err)
+	assert.Nil(t, ioutil.WriteFile(reqPath, b, 0600))
+
+	os.Remove(crtPath)
+	args = []string{"-ca-crt", caCrtPath, "-ca-key", caKeyPath, "-in-csr", reqPath, "-out-crt", crtPath}
+	assert.EqualError(t, signCert(args, ob, eb), "refusing to sign, in-csr was not signed by the key it requests a certificate for")
+}
@@ -22,7 +22,7 @@ func newVerifyFlags() *verifyFlags {
 	vf := verifyFlags{set: flag.NewFlagSet("verify", flag.ContinueOnError)}
 	vf.set.Usage = func() {}
 	vf.caPath = vf.set.String("ca", "", "Required: path to a file containing one or more ca certificates")
-	vf.certPath = vf.set.String("crt", "", "Required: path to a file containing a single certificate")
+	vf.certPath = vf.set.String("crt", "", "Required: path to a file containing a certificate, followed by its intermediate CAs if it has any")
 	return &vf
 }
 
@@ -62,17 +62,24 @@ func verify(args []string, out io.Writer, errOut io.Writer) error {
 		return fmt.Errorf("unable to read crt; %s", err)
 	}
 
-	c, _, err := cert.UnmarshalNebulaCertificateFromPEM(rawCert)
+	c, rawCert, err := cert.UnmarshalNebulaCertificateFromPEM(rawCert)
 	if err != nil {
 		return fmt.Errorf("error while parsing crt: %s", err)
 	}
 
-	good, err := c.Verify(time.Now(), caPool)
-	if !good {
-		return err
+	// Any certificates after the first are the intermediate CAs it needs
+	var intermediates []*cert.NebulaCertificate
+	for strings.TrimSpace(string(rawCert)) != "" {
+		var ic *cert.NebulaCertificate
+		ic, rawCert, err = cert.UnmarshalNebulaCertificateFromPEM(rawCert)
+		if err != nil {
+			return fmt.Errorf("error while parsing crt: %s", err)
+		}
+		intermediates = append(intermediates, ic)
 	}
 
-	return nil
+	_, err = c.VerifyWithChain(time.Now(), caPool, intermediates)
+	return err
 }
 
 func verifySummary() string {
@@ -26,7 +26,7 @@ func Test_verifyHelp(t *testing.T) {
 			"  -ca string\n"+
 			"    \tRequired: path to a file containing one or more ca certificates\n"+
 			"  -crt string\n"+
-			"    \tRequired: path to a file containing a single certificate\n",
+			"    \tRequired: path to a file containing a certificate, followed by its intermediate CAs if it has any\n",
 		ob.String(),
 	)
 }
@@ -12,6 +12,7 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -26,6 +27,7 @@ type Config struct {
 	Settings    map[interface{}]interface{}
 	oldSettings map[interface{}]interface{}
 	callbacks   []func(*Config)
+	reloadLock  sync.Mutex
 	l           *logrus.Logger
 }
 
@@ -127,6 +129,18 @@ func (c *Config) CatchHUP() {
 }
 
 func (c *Config) ReloadConfig() {
+	err := c.reload()
+	if err != nil {
+		c.l.WithField("config_path", c.path).WithError(err).Error("Error occurred while reloading config")
+	}
+}
+
+// reload does the work for ReloadConfig but hands the error back, reloads can come from HUP and the management api
+// at the same time so they are serialized here
+func (c *Config) reload() error {
+	c.reloadLock.Lock()
+	defer c.reloadLock.Unlock()
+
 	c.oldSettings = make(map[interface{}]interface{})
 	for k, v := range c.Settings {
 		c.oldSettings[k] = v
@@ -134,13 +148,14 @@ func (c *Config) ReloadConfig() {
 
 	err := c.Load(c.path)
 	if err != nil {
-		c.l.WithField("config_path", c.path).WithError(err).Error("Error occurred while reloading config")
-		return
+		return err
 	}
 
 	for _, v := range c.callbacks {
 		v(c)
 	}
+
+	return nil
 }
 
 // GetString will get the string for k or return the default d if not found or invalid
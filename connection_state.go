@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/flynn/noise"
 	"github.com/sirupsen/logrus"
@@ -25,13 +26,28 @@ type ConnectionState struct {
 	queueLock            sync.Mutex
 	writeLock            sync.Mutex
 	ready                bool
+
+	// hsCipher is the cipher the handshake is done with and cipher is the one the tunnel uses once it is up, they
+	// differ when the peers negotiated something other than what the initiator does handshakes with
+	hsCipher string
+	cipher   string
+
+	// pqKey is the key an initiator offered for a hybrid handshake until the answer arrives, pqHybrid is set once the
+	// tunnel keys include the KEM secret
+	pqKey    *pqKey
+	pqHybrid bool
+
+	// peerChain holds the CAs that signed peerCert, starting with its issuer and ending with the root we trust
+	peerChain []*cert.NebulaCertificate
+
+	// established is when the handshake completed and atomicBytesSent counts the payload we sent since, they decide
+	// when the tunnel is re-keyed
+	established     time.Time
+	atomicBytesSent uint64
 }
 
-func (f *Interface) newConnectionState(l *logrus.Logger, initiator bool, pattern noise.HandshakePattern, psk []byte, pskStage int) *ConnectionState {
-	cs := noise.NewCipherSuite(noise.DH25519, noise.CipherAESGCM, noise.HashSHA256)
-	if f.cipher == "chachapoly" {
-		cs = noise.NewCipherSuite(noise.DH25519, noise.CipherChaChaPoly, noise.HashSHA256)
-	}
+func (f *Interface) newConnectionState(l *logrus.Logger, initiator bool, pattern noise.HandshakePattern, psk []byte, pskStage int, hsCipher string) *ConnectionState {
+	cs := noise.NewCipherSuite(noise.DH25519, nebulaCiphers[hsCipher].fn, noise.HashSHA256)
 
 	curCertState := f.certState
 	static := noise.DHKey{Private: curCertState.privateKey, Public: curCertState.publicKey}
@@ -61,6 +77,7 @@ func (f *Interface) newConnectionState(l *logrus.Logger, initiator bool, pattern
 		window:    b,
 		ready:     false,
 		certState: curCertState,
+		hsCipher:  hsCipher,
 	}
 
 	return ci
@@ -69,8 +86,10 @@ func (f *Interface) newConnectionState(l *logrus.Logger, initiator bool, pattern
 func (cs *ConnectionState) MarshalJSON() ([]byte, error) {
 	return json.Marshal(m{
 		"certificate":     cs.peerCert,
+		"cipher":          cs.cipher,
 		"initiator":       cs.initiator,
 		"message_counter": atomic.LoadUint64(&cs.atomicMessageCounter),
+		"pq_hybrid":       cs.pqHybrid,
 		"ready":           cs.ready,
 	})
 }
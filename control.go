@@ -1,9 +1,12 @@
 package nebula
 
 import (
+	"bytes"
+	"errors"
 	"net"
 	"os"
 	"os/signal"
+	"sort"
 	"sync/atomic"
 	"syscall"
 
@@ -14,12 +17,19 @@ import (
 // Every interaction here needs to take extra care to copy memory and not return or use arguments "as is" when touching
 // core. This means copying IP objects, slices, de-referencing pointers and taking the actual value, etc
 
+var ErrTunnelExists = errors.New("tunnel already exists")
+var ErrTunnelHandshaking = errors.New("tunnel is already handshaking")
+
 type Control struct {
-	f          *Interface
-	l          *logrus.Logger
-	sshStart   func()
-	statsStart func()
-	dnsStart   func()
+	f               *Interface
+	l               *logrus.Logger
+	config          *Config
+	sshStart        func()
+	statsStart      func()
+	dnsStart        func()
+	dnsStubStart    func()
+	management      *managementServer
+	managementStart func()
 }
 
 type ControlHostInfo struct {
@@ -31,6 +41,13 @@ type ControlHostInfo struct {
 	Cert           *cert.NebulaCertificate `json:"cert"`
 	MessageCounter uint64                  `json:"messageCounter"`
 	CurrentRemote  *udpAddr                `json:"currentRemote"`
+	Cipher         string                  `json:"cipher"`
+	PqHybrid       bool                    `json:"pqHybrid"`
+}
+
+type ControlLighthouseInfo struct {
+	VpnIP net.IP    `json:"vpnIp"`
+	Addrs *CacheMap `json:"addrs"`
 }
 
 // Start actually runs nebula, this is a nonblocking call. To block use Control.ShutdownBlock()
@@ -48,6 +65,12 @@ func (c *Control) Start() {
 	if c.dnsStart != nil {
 		go c.dnsStart()
 	}
+	if c.dnsStubStart != nil {
+		go c.dnsStubStart()
+	}
+	if c.managementStart != nil {
+		go c.managementStart()
+	}
 
 	// Start reading packets.
 	c.f.run()
@@ -57,6 +80,8 @@ func (c *Control) Start() {
 func (c *Control) Stop() {
 	//TODO: stop tun and udp routines, the lock on hostMap effectively does that though
 	c.CloseAllTunnels(false)
+	c.management.Stop()
+	c.f.tcp.Close()
 	c.l.Info("Goodbye")
 }
 
@@ -93,7 +118,7 @@ func (c *Control) ListHostmap(pendingMap bool) []ControlHostInfo {
 }
 
 // GetHostInfoByVpnIP returns a single tunnels hostInfo, or nil if not found
-func (c *Control) GetHostInfoByVpnIP(vpnIP uint32, pending bool) *ControlHostInfo {
+func (c *Control) GetHostInfoByVpnIP(vpnIP VpnIp, pending bool) *ControlHostInfo {
 	var hm *HostMap
 	if pending {
 		hm = c.f.handshakeManager.pendingHostMap
@@ -111,7 +136,7 @@ func (c *Control) GetHostInfoByVpnIP(vpnIP uint32, pending bool) *ControlHostInf
 }
 
 // SetRemoteForTunnel forces a tunnel to use a specific remote
-func (c *Control) SetRemoteForTunnel(vpnIP uint32, addr udpAddr) *ControlHostInfo {
+func (c *Control) SetRemoteForTunnel(vpnIP VpnIp, addr udpAddr) *ControlHostInfo {
 	hostInfo, err := c.f.hostMap.QueryVpnIP(vpnIP)
 	if err != nil {
 		return nil
@@ -123,7 +148,7 @@ func (c *Control) SetRemoteForTunnel(vpnIP uint32, addr udpAddr) *ControlHostInf
 }
 
 // CloseTunnel closes a fully established tunnel. If localOnly is false it will notify the remote end as well.
-func (c *Control) CloseTunnel(vpnIP uint32, localOnly bool) bool {
+func (c *Control) CloseTunnel(vpnIP VpnIp, localOnly bool) bool {
 	hostInfo, err := c.f.hostMap.QueryVpnIP(vpnIP)
 	if err != nil {
 		return false
@@ -146,11 +171,65 @@ func (c *Control) CloseTunnel(vpnIP uint32, localOnly bool) bool {
 	return true
 }
 
+// CreateTunnel starts a handshake with a host. If addr is not nil it will be tried instead of asking the lighthouse
+func (c *Control) CreateTunnel(vpnIP VpnIp, addr *udpAddr) error {
+	if _, err := c.f.hostMap.QueryVpnIP(vpnIP); err == nil {
+		return ErrTunnelExists
+	}
+
+	if _, err := c.f.handshakeManager.pendingHostMap.QueryVpnIP(vpnIP); err == nil {
+		return ErrTunnelHandshaking
+	}
+
+	hostInfo := c.f.handshakeManager.AddVpnIP(vpnIP)
+	if addr != nil {
+		hostInfo.SetRemote(addr.Copy())
+	}
+	c.f.getOrHandshake(vpnIP)
+	return nil
+}
+
+// ListLighthouseAddrMap returns the addresses this node has learned for every host, sorted by vpn ip
+func (c *Control) ListLighthouseAddrMap() []ControlLighthouseInfo {
+	lh := c.f.lightHouse
+	lh.RLock()
+	addrMap := make([]ControlLighthouseInfo, 0, len(lh.addrMap))
+	for k, v := range lh.addrMap {
+		addrMap = append(addrMap, ControlLighthouseInfo{VpnIP: k.ToIP(), Addrs: v.CopyCache()})
+	}
+	lh.RUnlock()
+
+	sort.Slice(addrMap, func(i, j int) bool {
+		return bytes.Compare(addrMap[i].VpnIP, addrMap[j].VpnIP) < 0
+	})
+	return addrMap
+}
+
+// QueryLighthouse returns the addresses known for a host, or nil if there are none yet.
+// A query is sent to the lighthouses either way so a later call may have an answer
+func (c *Control) QueryLighthouse(vpnIP VpnIp) *CacheMap {
+	rl := c.f.lightHouse.Query(vpnIP, c.f)
+	if rl == nil {
+		return nil
+	}
+	return rl.CopyCache()
+}
+
+// ReloadConfig reloads the config from disk, the same as sending nebula a HUP
+func (c *Control) ReloadConfig() error {
+	if c.config == nil {
+		return errors.New("no config to reload")
+	}
+	return c.config.reload()
+}
+
 // CloseAllTunnels is just like CloseTunnel except it goes through and shuts them all down, optionally you can avoid shutting down lighthouse tunnels
 // the int returned is a count of tunnels closed
 func (c *Control) CloseAllTunnels(excludeLighthouses bool) (closed int) {
 	//TODO: this is probably better as a function in ConnectionManager or HostMap directly
-	c.f.hostMap.Lock()
+	// Relayed tunnels are closed first so their relays are still around to carry the close message
+	var relayed, direct []*HostInfo
+	c.f.hostMap.RLock()
 	for _, h := range c.f.hostMap.Hosts {
 		if excludeLighthouses {
 			if _, ok := c.f.lightHouse.lighthouses[h.hostId]; ok {
@@ -158,22 +237,33 @@ func (c *Control) CloseAllTunnels(excludeLighthouses bool) (closed int) {
 			}
 		}
 
-		if h.ConnectionState.ready {
-			c.f.send(closeTunnel, 0, h.ConnectionState, h, h.remote, []byte{}, make([]byte, 12, 12), make([]byte, mtu))
-			c.f.closeTunnel(h, true)
+		if !h.ConnectionState.ready {
+			continue
+		}
 
-			c.l.WithField("vpnIp", IntIp(h.hostId)).WithField("udpAddr", h.remote).
-				Debug("Sending close tunnel message")
-			closed++
+		if h.remote == nil {
+			relayed = append(relayed, h)
+		} else {
+			direct = append(direct, h)
 		}
 	}
-	c.f.hostMap.Unlock()
+	c.f.hostMap.RUnlock()
+
+	// The hostmap lock can not be held while sending, relayed tunnels need it to find their relay
+	for _, h := range append(relayed, direct...) {
+		c.f.send(closeTunnel, 0, h.ConnectionState, h, h.remote, []byte{}, make([]byte, 12, 12), make([]byte, mtu))
+		c.f.closeTunnel(h, false)
+
+		c.l.WithField("vpnIp", h.hostId).WithField("udpAddr", h.remote).
+			Debug("Sending close tunnel message")
+		closed++
+	}
 	return
 }
 
 func copyHostInfo(h *HostInfo, preferredRanges []*net.IPNet) ControlHostInfo {
 	chi := ControlHostInfo{
-		VpnIP:         int2ip(h.hostId),
+		VpnIP:         h.hostId.ToIP(),
 		LocalIndex:    h.localIndexId,
 		RemoteIndex:   h.remoteIndexId,
 		RemoteAddrs:   h.remotes.CopyAddrs(preferredRanges),
@@ -182,6 +272,8 @@ func copyHostInfo(h *HostInfo, preferredRanges []*net.IPNet) ControlHostInfo {
 
 	if h.ConnectionState != nil {
 		chi.MessageCounter = atomic.LoadUint64(&h.ConnectionState.atomicMessageCounter)
+		chi.Cipher = h.ConnectionState.cipher
+		chi.PqHybrid = h.ConnectionState.pqHybrid
 	}
 
 	if c := h.GetCert(); c != nil {
@@ -16,7 +16,7 @@ func TestControl_GetHostInfoByVpnIP(t *testing.T) {
 	l := NewTestLogger()
 	// Special care must be taken to re-use all objects provided to the hostmap and certificate in the expectedInfo object
 	// To properly ensure we are not exposing core memory to the caller
-	hm := NewHostMap(l, "test", &net.IPNet{}, make([]*net.IPNet, 0))
+	hm := NewHostMap(l, "test", []*net.IPNet{}, make([]*net.IPNet, 0))
 	remote1 := NewUDPAddr(int2ip(100), 4444)
 	remote2 := NewUDPAddr(net.ParseIP("1:2:3:4:5:6:7:8"), 4444)
 	ipNet := net.IPNet{
@@ -46,20 +46,22 @@ func TestControl_GetHostInfoByVpnIP(t *testing.T) {
 	}
 
 	remotes := NewRemoteList()
-	remotes.unlockedPrependV4(0, NewIp4AndPort(remote1.IP, uint32(remote1.Port)))
-	remotes.unlockedPrependV6(0, NewIp6AndPort(remote2.IP, uint32(remote2.Port)))
-	hm.Add(ip2int(ipNet.IP), &HostInfo{
+	remotes.unlockedPrependV4(VpnIp{}, NewIp4AndPort(remote1.IP, uint32(remote1.Port)))
+	remotes.unlockedPrependV6(VpnIp{}, NewIp6AndPort(remote2.IP, uint32(remote2.Port)))
+	hm.Add(NewVpnIp(ipNet.IP), &HostInfo{
 		remote:  remote1,
 		remotes: remotes,
 		ConnectionState: &ConnectionState{
 			peerCert: crt,
+			cipher:   "chachapoly",
+			pqHybrid: true,
 		},
 		remoteIndexId: 200,
 		localIndexId:  201,
-		hostId:        ip2int(ipNet.IP),
+		hostId:        NewVpnIp(ipNet.IP),
 	})
 
-	hm.Add(ip2int(ipNet2.IP), &HostInfo{
+	hm.Add(NewVpnIp(ipNet2.IP), &HostInfo{
 		remote:  remote1,
 		remotes: remotes,
 		ConnectionState: &ConnectionState{
@@ -67,7 +69,7 @@ func TestControl_GetHostInfoByVpnIP(t *testing.T) {
 		},
 		remoteIndexId: 200,
 		localIndexId:  201,
-		hostId:        ip2int(ipNet2.IP),
+		hostId:        NewVpnIp(ipNet2.IP),
 	})
 
 	c := Control{
@@ -77,7 +79,7 @@ func TestControl_GetHostInfoByVpnIP(t *testing.T) {
 		l: logrus.New(),
 	}
 
-	thi := c.GetHostInfoByVpnIP(ip2int(ipNet.IP), false)
+	thi := c.GetHostInfoByVpnIP(NewVpnIp(ipNet.IP), false)
 
 	expectedInfo := ControlHostInfo{
 		VpnIP:          net.IPv4(1, 2, 3, 4).To4(),
@@ -88,15 +90,17 @@ func TestControl_GetHostInfoByVpnIP(t *testing.T) {
 		Cert:           crt.Copy(),
 		MessageCounter: 0,
 		CurrentRemote:  NewUDPAddr(int2ip(100), 4444),
+		Cipher:         "chachapoly",
+		PqHybrid:       true,
 	}
 
 	// Make sure we don't have any unexpected fields
-	assertFields(t, []string{"VpnIP", "LocalIndex", "RemoteIndex", "RemoteAddrs", "CachedPackets", "Cert", "MessageCounter", "CurrentRemote"}, thi)
+	assertFields(t, []string{"VpnIP", "LocalIndex", "RemoteIndex", "RemoteAddrs", "CachedPackets", "Cert", "MessageCounter", "CurrentRemote", "Cipher", "PqHybrid"}, thi)
 	util.AssertDeepCopyEqual(t, &expectedInfo, thi)
 
 	// Make sure we don't panic if the host info doesn't have a cert yet
 	assert.NotPanics(t, func() {
-		thi = c.GetHostInfoByVpnIP(ip2int(ipNet2.IP), false)
+		thi = c.GetHostInfoByVpnIP(NewVpnIp(ipNet2.IP), false)
 	})
 }
 
@@ -7,6 +7,7 @@ import (
 
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
+	"github.com/slackhq/nebula/cert"
 )
 
 // WaitForTypeByIndex will pipe all messages from this control device into the pipeTo control device
@@ -44,13 +45,13 @@ func (c *Control) WaitForTypeByIndex(toIndex uint32, msgType NebulaMessageType,
 // InjectLightHouseAddr will push toAddr into the local lighthouse cache for the vpnIp
 // This is necessary if you did not configure static hosts or are not running a lighthouse
 func (c *Control) InjectLightHouseAddr(vpnIp net.IP, toAddr *net.UDPAddr) {
+	iVpnIp := NewVpnIp(vpnIp)
 	c.f.lightHouse.Lock()
-	remoteList := c.f.lightHouse.unlockedGetRemoteList(ip2int(vpnIp))
+	remoteList := c.f.lightHouse.unlockedGetRemoteList(iVpnIp)
 	remoteList.Lock()
 	defer remoteList.Unlock()
 	c.f.lightHouse.Unlock()
 
-	iVpnIp := ip2int(vpnIp)
 	if v4 := toAddr.IP.To4(); v4 != nil {
 		remoteList.unlockedPrependV4(iVpnIp, NewIp4AndPort(v4, uint32(toAddr.Port)))
 	} else {
@@ -58,6 +59,42 @@ func (c *Control) InjectLightHouseAddr(vpnIp net.IP, toAddr *net.UDPAddr) {
 	}
 }
 
+// InjectRelays will push relays into the local lighthouse cache for the vpnIp
+// This is necessary if you want to reach a host through a relay and are not running a lighthouse
+func (c *Control) InjectRelays(vpnIp net.IP, relays []net.IP) {
+	iVpnIp := NewVpnIp(vpnIp)
+	c.f.lightHouse.Lock()
+	remoteList := c.f.lightHouse.unlockedGetRemoteList(iVpnIp)
+	remoteList.Lock()
+	defer remoteList.Unlock()
+	c.f.lightHouse.Unlock()
+
+	addrs := make([]*VpnAddr, len(relays))
+	for i, r := range relays {
+		addrs[i] = NewVpnAddr(NewVpnIp(r))
+	}
+	remoteList.unlockedSetRelay(iVpnIp, addrs)
+}
+
+// InjectCRL will handle the crl as if a lighthouse had sent it to us
+func (c *Control) InjectCRL(crl *cert.NebulaCRL) {
+	b, err := crl.Marshal()
+	if err != nil {
+		panic(err)
+	}
+	c.f.handleCRLs(c.f.lightHouse.myVpnIp, [][]byte{b})
+}
+
+// ReloadCertKey swaps in a new certificate and key as if they had been reloaded from the config
+func (c *Control) ReloadCertKey(certPEM, keyPEM []byte) {
+	conf := NewConfig(c.l)
+	conf.Settings["pki"] = map[interface{}]interface{}{
+		"cert": string(certPEM),
+		"key":  string(keyPEM),
+	}
+	c.f.reloadCertKey(conf)
+}
+
 // GetFromTun will pull a packet off the tun side of nebula
 func (c *Control) GetFromTun(block bool) []byte {
 	return c.f.inside.(*Tun).Get(block)
@@ -118,7 +155,7 @@ func (c *Control) GetUDPAddr() string {
 }
 
 func (c *Control) KillPendingTunnel(vpnIp net.IP) bool {
-	hostinfo, ok := c.f.handshakeManager.pendingHostMap.Hosts[ip2int(vpnIp)]
+	hostinfo, ok := c.f.handshakeManager.pendingHostMap.Hosts[NewVpnIp(vpnIp)]
 	if !ok {
 		return false
 	}
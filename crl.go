@@ -0,0 +1,89 @@
+package nebula
+
+import (
+	"time"
+
+	"github.com/slackhq/nebula/cert"
+)
+
+// handleCRLs applies the revocation lists a lighthouse sent us and tears down any tunnel they revoke
+func (f *Interface) handleCRLs(vpnIp VpnIp, rawCRLs [][]byte) {
+	applied := false
+	for _, b := range rawCRLs {
+		crl, err := cert.UnmarshalNebulaCRL(b)
+		if err != nil {
+			f.l.WithError(err).WithField("vpnIp", vpnIp).Info("Failed to unmarshal certificate revocation list")
+			continue
+		}
+
+		err = f.caPool.ApplyCRL(crl, time.Now())
+		if err == cert.ErrCRLNotNewer {
+			// We already have it, this is the usual case
+			continue
+		}
+
+		logMsg := f.l.WithField("vpnIp", vpnIp).WithField("issuer", crl.Details.Issuer).
+			WithField("version", crl.Details.Version)
+		if err != nil {
+			logMsg.WithError(err).Warn("Refusing certificate revocation list")
+			continue
+		}
+
+		logMsg.WithField("revoked", len(crl.Details.Revoked)).Info("Applied certificate revocation list")
+		applied = true
+	}
+
+	if applied {
+		f.publishCRLs()
+		f.closeRevokedTunnels()
+	}
+}
+
+// publishCRLs hands the revocation lists in our ca pool to the lighthouse so it can serve them
+func (f *Interface) publishCRLs() {
+	crls := f.caPool.GetCRLs()
+	rawCRLs := make([][]byte, 0, len(crls))
+	for _, crl := range crls {
+		b, err := crl.Marshal()
+		if err != nil {
+			f.l.WithError(err).WithField("issuer", crl.Details.Issuer).Error("Failed to marshal certificate revocation list")
+			continue
+		}
+		rawCRLs = append(rawCRLs, b)
+	}
+
+	f.lightHouse.SetCRLs(rawCRLs)
+}
+
+// closeRevokedTunnels closes every tunnel with a peer whose certificate is no longer trusted, the count closed is
+// returned
+func (f *Interface) closeRevokedTunnels() int {
+	// Relayed tunnels are closed first so their relays are still around to carry the close message
+	var relayed, direct []*HostInfo
+	f.hostMap.RLock()
+	for _, h := range f.hostMap.Hosts {
+		if h.ConnectionState == nil || h.ConnectionState.peerCert == nil {
+			continue
+		}
+
+		if !f.caPool.IsRevoked(h.ConnectionState.peerCert, h.ConnectionState.peerChain) {
+			continue
+		}
+
+		if h.remote == nil {
+			relayed = append(relayed, h)
+		} else {
+			direct = append(direct, h)
+		}
+	}
+	f.hostMap.RUnlock()
+
+	for _, h := range append(relayed, direct...) {
+		f.l.WithField("vpnIp", h.hostId).WithField("certName", h.ConnectionState.peerCert.Details.Name).
+			Info("Closing tunnel with revoked certificate")
+		f.sendCloseTunnel(h)
+		f.closeTunnel(h, false)
+	}
+
+	return len(relayed) + len(direct)
+}
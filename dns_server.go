@@ -1,153 +1,549 @@
 package nebula
 
 import (
+	"errors"
 	"fmt"
 	"net"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/miekg/dns"
 	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula/cert"
 )
 
-// This whole thing should be rewritten to use context
-
-var dnsR *dnsRecords
-var dnsServer *dns.Server
-var dnsAddr string
-
-type dnsRecords struct {
+// dnsServer answers queries for the hosts that have connected to this lighthouse. Within the zone it serves
+//
+//	<name>.<zone>               A and AAAA records for every ip in the certificate
+//	<group>.groups.<zone>       A and AAAA records for every host in the group
+//	<service>.<zone>            SRV records for the hosts in a group, from lighthouse.dns.services
+//	<ip>.in-addr.arpa, ip6.arpa PTR records for the vpn networks
+//	<vpn ip>.                   TXT record with the certificate, only for nebula hosts and localhost
+//
+// Names that do not exist get an NXDOMAIN and anything outside of the zone or the vpn networks is refused
+type dnsServer struct {
 	sync.RWMutex
-	dnsMap  map[string]string
+	l       *logrus.Logger
 	hostMap *HostMap
+
+	addr     string
+	zone     string
+	ttl      uint32
+	services map[string]dnsService
+	server   *dns.Server
+
+	// serial is bumped whenever a record changes so the SOA reflects it
+	serial uint32
+	hosts  map[string]*dnsHost
+	byIp   map[VpnIp]*dnsHost
+	groups map[string]map[string]*dnsHost
+}
+
+type dnsHost struct {
+	name   string
+	ips    []net.IP
+	groups []string
 }
 
-func newDnsRecords(hostMap *HostMap) *dnsRecords {
-	return &dnsRecords{
-		dnsMap:  make(map[string]string),
+type dnsService struct {
+	group    string
+	port     uint16
+	priority uint16
+	weight   uint16
+}
+
+func newDnsServer(l *logrus.Logger, hostMap *HostMap, c *Config) (*dnsServer, error) {
+	d := &dnsServer{
+		l:       l,
 		hostMap: hostMap,
+		serial:  uint32(time.Now().Unix()),
+		hosts:   map[string]*dnsHost{},
+		byIp:    map[VpnIp]*dnsHost{},
+		groups:  map[string]map[string]*dnsHost{},
+	}
+
+	err := d.configure(c)
+	if err != nil {
+		return nil, err
 	}
+
+	c.RegisterReloadCallback(func(c *Config) {
+		err := d.reload(c)
+		if err != nil {
+			l.WithError(err).Error("Failed to reload the dns server config")
+		}
+	})
+
+	return d, nil
 }
 
-func (d *dnsRecords) Query(data string) string {
-	d.RLock()
-	if r, ok := d.dnsMap[data]; ok {
-		d.RUnlock()
-		return r
+func getDnsServerAddr(c *Config) string {
+	return c.GetString("lighthouse.dns.host", "") + ":" + strconv.Itoa(c.GetInt("lighthouse.dns.port", 53))
+}
+
+// configure reads everything but the listen address, that requires a restart and is handled by reload
+func (d *dnsServer) configure(c *Config) error {
+	zone := dns.Fqdn(strings.ToLower(strings.Trim(c.GetString("lighthouse.dns.zone", ""), ".")))
+	if _, ok := dns.IsDomainName(zone); !ok {
+		return fmt.Errorf("lighthouse.dns.zone is not a valid domain name: %s", zone)
+	}
+
+	ttl := c.GetDuration("lighthouse.dns.ttl", time.Minute)
+	if ttl < 0 {
+		return fmt.Errorf("lighthouse.dns.ttl can not be negative")
 	}
-	d.RUnlock()
-	return ""
+
+	services, err := convertDnsServices(c.Get("lighthouse.dns.services"))
+	if err != nil {
+		return err
+	}
+
+	d.Lock()
+	defer d.Unlock()
+	if d.addr == "" {
+		d.addr = getDnsServerAddr(c)
+	}
+	d.zone = zone
+	d.ttl = uint32(ttl.Seconds())
+	d.services = services
+	d.serial++
+	return nil
 }
 
-func (d *dnsRecords) QueryCert(data string) string {
-	ip := net.ParseIP(data[:len(data)-1])
-	if ip == nil {
-		return ""
+func convertDnsServices(v interface{}) (map[string]dnsService, error) {
+	services := map[string]dnsService{}
+	if v == nil {
+		return services, nil
+	}
+
+	rs, ok := v.([]interface{})
+	if !ok {
+		return nil, errors.New("lighthouse.dns.services failed to parse, should be an array of services")
+	}
+
+	for i, r := range rs {
+		m, ok := r.(map[interface{}]interface{})
+		if !ok {
+			return nil, fmt.Errorf("lighthouse.dns.services #%v; could not parse service", i)
+		}
+
+		toUint16 := func(k string, d uint16) (uint16, error) {
+			v, ok := m[k]
+			if !ok {
+				return d, nil
+			}
+			n, err := strconv.ParseUint(fmt.Sprintf("%v", v), 10, 16)
+			if err != nil {
+				return 0, fmt.Errorf("lighthouse.dns.services #%v; %s must be a number between 0 and 65535", i, k)
+			}
+			return uint16(n), nil
+		}
+
+		name := strings.ToLower(strings.Trim(fmt.Sprintf("%v", m["name"]), "."))
+		if m["name"] == nil || name == "" {
+			return nil, fmt.Errorf("lighthouse.dns.services #%v; name must be provided", i)
+		}
+
+		s := dnsService{group: strings.ToLower(fmt.Sprintf("%v", m["group"]))}
+		if m["group"] == nil || s.group == "" {
+			return nil, fmt.Errorf("lighthouse.dns.services #%v; group must be provided", i)
+		}
+
+		var err error
+		if s.port, err = toUint16("port", 0); err != nil {
+			return nil, err
+		}
+		if s.port == 0 {
+			return nil, fmt.Errorf("lighthouse.dns.services #%v; port must be provided", i)
+		}
+		if s.priority, err = toUint16("priority", 10); err != nil {
+			return nil, err
+		}
+		if s.weight, err = toUint16("weight", 10); err != nil {
+			return nil, err
+		}
+
+		services[name] = s
 	}
-	iip := ip2int(ip)
-	hostinfo, err := d.hostMap.QueryVpnIP(iip)
+
+	return services, nil
+}
+
+func (d *dnsServer) reload(c *Config) error {
+	err := d.configure(c)
 	if err != nil {
-		return ""
+		return err
 	}
-	q := hostinfo.GetCert()
-	if q == nil {
-		return ""
+
+	addr := getDnsServerAddr(c)
+	d.Lock()
+	if d.addr == addr {
+		d.Unlock()
+		d.l.Debug("No DNS server listener change detected")
+		return nil
 	}
-	cert := q.Details
-	c := fmt.Sprintf("\"Name: %s\" \"Ips: %s\" \"Subnets %s\" \"Groups %s\" \"NotBefore %s\" \"NotAFter %s\" \"PublicKey %x\" \"IsCA %t\" \"Issuer %s\"", cert.Name, cert.Ips, cert.Subnets, cert.Groups, cert.NotBefore, cert.NotAfter, cert.PublicKey, cert.IsCA, cert.Issuer)
-	return c
+	d.addr = addr
+	server := d.server
+	d.Unlock()
+
+	d.l.Debug("Restarting DNS server")
+	if server != nil {
+		_ = server.Shutdown()
+	}
+	go d.Start()
+	return nil
 }
 
-func (d *dnsRecords) Add(host, data string) {
+// Start runs the dns listener, this is a blocking call
+func (d *dnsServer) Start() {
 	d.Lock()
-	d.dnsMap[host] = data
+	server := &dns.Server{Addr: d.addr, Net: "udp", Handler: d}
+	d.server = server
 	d.Unlock()
+
+	d.l.WithField("dnsListener", server.Addr).Info("Starting DNS responder")
+	err := server.ListenAndServe()
+	if err != nil {
+		d.l.WithError(err).WithField("dnsListener", server.Addr).Error("Failed to start server")
+	}
 }
 
-func parseQuery(l *logrus.Logger, m *dns.Msg, w dns.ResponseWriter) {
-	for _, q := range m.Question {
-		switch q.Qtype {
-		case dns.TypeA:
-			l.Debugf("Query for A %s", q.Name)
-			ip := dnsR.Query(q.Name)
-			if ip != "" {
-				rr, err := dns.NewRR(fmt.Sprintf("%s A %s", q.Name, ip))
-				if err == nil {
-					m.Answer = append(m.Answer, rr)
-				}
-			}
-		case dns.TypeTXT:
-			a, _, _ := net.SplitHostPort(w.RemoteAddr().String())
-			b := net.ParseIP(a)
-			// We don't answer these queries from non nebula nodes or localhost
-			//l.Debugf("Does %s contain %s", b, dnsR.hostMap.vpnCIDR)
-			if !dnsR.hostMap.vpnCIDR.Contains(b) && a != "127.0.0.1" {
-				return
-			}
-			l.Debugf("Query for TXT %s", q.Name)
-			ip := dnsR.QueryCert(q.Name)
-			if ip != "" {
-				rr, err := dns.NewRR(fmt.Sprintf("%s TXT %s", q.Name, ip))
-				if err == nil {
-					m.Answer = append(m.Answer, rr)
-				}
-			}
+// Add records the names and groups from a certificate, replacing whatever was known for its name or ips
+func (d *dnsServer) Add(c *cert.NebulaCertificate) {
+	if len(c.Details.Ips) == 0 {
+		return
+	}
+
+	h := &dnsHost{name: strings.ToLower(c.Details.Name)}
+	for _, ip := range c.Details.Ips {
+		h.ips = append(h.ips, ip.IP)
+	}
+	for _, g := range c.Details.Groups {
+		h.groups = append(h.groups, strings.ToLower(g))
+	}
+
+	d.Lock()
+	defer d.Unlock()
+	if old, ok := d.hosts[h.name]; ok && old.equal(h) {
+		return
+	}
+
+	d.unlockedRemove(d.hosts[h.name])
+	for _, ip := range h.ips {
+		d.unlockedRemove(d.byIp[NewVpnIp(ip)])
+	}
+
+	d.hosts[h.name] = h
+	for _, ip := range h.ips {
+		d.byIp[NewVpnIp(ip)] = h
+	}
+	for _, g := range h.groups {
+		if d.groups[g] == nil {
+			d.groups[g] = map[string]*dnsHost{}
 		}
+		d.groups[g][h.name] = h
 	}
+	d.serial++
 }
 
-func handleDnsRequest(l *logrus.Logger, w dns.ResponseWriter, r *dns.Msg) {
+func (d *dnsServer) unlockedRemove(h *dnsHost) {
+	if h == nil {
+		return
+	}
+
+	delete(d.hosts, h.name)
+	for _, ip := range h.ips {
+		delete(d.byIp, NewVpnIp(ip))
+	}
+	for _, g := range h.groups {
+		delete(d.groups[g], h.name)
+		if len(d.groups[g]) == 0 {
+			delete(d.groups, g)
+		}
+	}
+}
+
+func (h *dnsHost) equal(o *dnsHost) bool {
+	if h.name != o.name || !ipsEqual(h.ips, o.ips) || len(h.groups) != len(o.groups) {
+		return false
+	}
+	for i := range h.groups {
+		if h.groups[i] != o.groups[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (d *dnsServer) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	var from net.IP
+	if a, _, err := net.SplitHostPort(w.RemoteAddr().String()); err == nil {
+		from = net.ParseIP(a)
+	}
+
+	err := w.WriteMsg(d.answer(r, from))
+	if err != nil {
+		d.l.WithError(err).Debug("Failed to write dns response")
+	}
+}
+
+// answer builds the response to r, from is who asked and is only used to protect the certificate TXT records
+func (d *dnsServer) answer(r *dns.Msg, from net.IP) *dns.Msg {
 	m := new(dns.Msg)
 	m.SetReply(r)
 	m.Compress = false
 
-	switch r.Opcode {
-	case dns.OpcodeQuery:
-		parseQuery(l, m, w)
+	if r.Opcode != dns.OpcodeQuery {
+		m.Rcode = dns.RcodeNotImplemented
+		return m
 	}
 
-	w.WriteMsg(m)
-}
+	if len(r.Question) != 1 {
+		m.Rcode = dns.RcodeFormatError
+		return m
+	}
 
-func dnsMain(l *logrus.Logger, hostMap *HostMap, c *Config) func() {
-	dnsR = newDnsRecords(hostMap)
+	q := r.Question[0]
+	name := strings.ToLower(q.Name)
+	if d.l.Level >= logrus.DebugLevel {
+		d.l.Debugf("Query for %s %s", dns.TypeToString[q.Qtype], q.Name)
+	}
 
-	// attach request handler func
-	dns.HandleFunc(".", func(w dns.ResponseWriter, r *dns.Msg) {
-		handleDnsRequest(l, w, r)
-	})
+	if q.Qtype == dns.TypeTXT {
+		if ip := net.ParseIP(strings.TrimSuffix(name, ".")); ip != nil {
+			d.answerCert(m, q, ip, from)
+			return m
+		}
+	}
 
-	c.RegisterReloadCallback(func(c *Config) {
-		reloadDns(l, c)
-	})
+	d.RLock()
+	defer d.RUnlock()
 
-	return func() {
-		startDns(l, c)
+	if strings.HasSuffix(name, ".in-addr.arpa.") || strings.HasSuffix(name, ".ip6.arpa.") {
+		d.answerReverse(m, q, name)
+		return m
 	}
-}
 
-func getDnsServerAddr(c *Config) string {
-	return c.GetString("lighthouse.dns.host", "") + ":" + strconv.Itoa(c.GetInt("lighthouse.dns.port", 53))
+	var rel string
+	switch {
+	case d.zone == ".":
+		rel = strings.TrimSuffix(name, ".")
+	case name == d.zone:
+	case strings.HasSuffix(name, "."+d.zone):
+		rel = strings.TrimSuffix(name, "."+d.zone)
+	default:
+		m.Rcode = dns.RcodeRefused
+		return m
+	}
+
+	m.Authoritative = true
+	exists := false
+	if rel == "" {
+		exists = true
+		if q.Qtype == dns.TypeSOA {
+			m.Answer = append(m.Answer, d.soa(d.zone))
+		}
+
+	} else if s, ok := d.services[rel]; ok {
+		exists = true
+		if q.Qtype == dns.TypeSRV {
+			for _, h := range d.groups[s.group] {
+				target := dnsJoin(h.name, d.zone)
+				m.Answer = append(m.Answer, &dns.SRV{
+					Hdr:      d.header(q.Name, dns.TypeSRV),
+					Priority: s.priority,
+					Weight:   s.weight,
+					Port:     s.port,
+					Target:   target,
+				})
+				m.Extra = append(m.Extra, d.addrRecords(target, dns.TypeA, h)...)
+				m.Extra = append(m.Extra, d.addrRecords(target, dns.TypeAAAA, h)...)
+			}
+		}
+
+	} else if g := strings.TrimSuffix(rel, ".groups"); g != rel {
+		hosts := d.groups[g]
+		exists = len(hosts) > 0
+		for _, h := range hosts {
+			m.Answer = append(m.Answer, d.addrRecords(q.Name, q.Qtype, h)...)
+		}
+
+	} else if h, ok := d.hosts[rel]; ok {
+		exists = true
+		m.Answer = d.addrRecords(q.Name, q.Qtype, h)
+	}
+
+	if !exists {
+		m.Rcode = dns.RcodeNameError
+	}
+	if len(m.Answer) == 0 {
+		m.Ns = append(m.Ns, d.soa(d.zone))
+	}
+
+	return m
 }
 
-func startDns(l *logrus.Logger, c *Config) {
-	dnsAddr = getDnsServerAddr(c)
-	dnsServer = &dns.Server{Addr: dnsAddr, Net: "udp"}
-	l.WithField("dnsListener", dnsAddr).Infof("Starting DNS responder")
-	err := dnsServer.ListenAndServe()
-	defer dnsServer.Shutdown()
+// txtEscaper quotes the characters that are special inside a TXT character string
+var txtEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+
+func (d *dnsServer) answerCert(m *dns.Msg, q dns.Question, ip net.IP, from net.IP) {
+	// We don't answer these queries from non nebula nodes or localhost
+	if from == nil || (!d.hostMap.vpnCIDRContains(NewVpnIp(from)) && !from.IsLoopback()) {
+		return
+	}
+
+	hostinfo, err := d.hostMap.QueryVpnIP(NewVpnIp(ip))
 	if err != nil {
-		l.Errorf("Failed to start server: %s\n ", err.Error())
+		return
+	}
+	q2 := hostinfo.GetCert()
+	if q2 == nil {
+		return
+	}
+
+	c := q2.Details
+	txt := fmt.Sprintf("\"Name: %s\" \"Ips: %s\" \"Subnets %s\" \"Groups %s\" \"NotBefore %s\" \"NotAFter %s\" \"PublicKey %x\" \"IsCA %t\" \"Issuer %s\"", c.Name, c.Ips, c.Subnets, c.Groups, c.NotBefore, c.NotAfter, c.PublicKey, c.IsCA, c.Issuer)
+
+	// Metadata is free form so it needs escaping before it goes into the record text
+	keys := make([]string, 0, len(c.Metadata))
+	for k := range c.Metadata {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		txt += fmt.Sprintf(" \"Metadata %s=%s\"", txtEscaper.Replace(k), txtEscaper.Replace(c.Metadata[k]))
+	}
+
+	rr, err := dns.NewRR(fmt.Sprintf("%s TXT %s", q.Name, txt))
+	if err == nil {
+		m.Answer = append(m.Answer, rr)
 	}
 }
 
-func reloadDns(l *logrus.Logger, c *Config) {
-	if dnsAddr == getDnsServerAddr(c) {
-		l.Debug("No DNS server config change detected")
+func (d *dnsServer) answerReverse(m *dns.Msg, q dns.Question, name string) {
+	ip := reverseAddr(name)
+	if ip == nil {
+		m.Rcode = dns.RcodeRefused
 		return
 	}
 
-	l.Debug("Restarting DNS server")
-	dnsServer.Shutdown()
-	go startDns(l, c)
+	var zone string
+	for _, n := range d.hostMap.vpnCIDRs {
+		if n.Contains(ip) {
+			zone = reverseZone(n)
+			break
+		}
+	}
+	if zone == "" {
+		m.Rcode = dns.RcodeRefused
+		return
+	}
+
+	m.Authoritative = true
+	h, ok := d.byIp[NewVpnIp(ip)]
+	if !ok {
+		m.Rcode = dns.RcodeNameError
+	} else if q.Qtype == dns.TypePTR {
+		m.Answer = append(m.Answer, &dns.PTR{Hdr: d.header(q.Name, dns.TypePTR), Ptr: dnsJoin(h.name, d.zone)})
+	}
+
+	if len(m.Answer) == 0 {
+		m.Ns = append(m.Ns, d.soa(zone))
+	}
+}
+
+// addrRecords returns the records of type qtype for the addresses of h, anything other than A or AAAA returns nothing
+func (d *dnsServer) addrRecords(name string, qtype uint16, h *dnsHost) []dns.RR {
+	var rrs []dns.RR
+	for _, ip := range h.ips {
+		if ip4 := ip.To4(); ip4 != nil {
+			if qtype == dns.TypeA {
+				rrs = append(rrs, &dns.A{Hdr: d.header(name, dns.TypeA), A: ip4})
+			}
+		} else if qtype == dns.TypeAAAA {
+			rrs = append(rrs, &dns.AAAA{Hdr: d.header(name, dns.TypeAAAA), AAAA: ip})
+		}
+	}
+	return rrs
+}
+
+func (d *dnsServer) header(name string, rrtype uint16) dns.RR_Header {
+	return dns.RR_Header{Name: name, Rrtype: rrtype, Class: dns.ClassINET, Ttl: d.ttl}
+}
+
+func (d *dnsServer) soa(zone string) dns.RR {
+	return &dns.SOA{
+		Hdr:     d.header(zone, dns.TypeSOA),
+		Ns:      dnsJoin("ns", d.zone),
+		Mbox:    dnsJoin("hostmaster", d.zone),
+		Serial:  d.serial,
+		Refresh: 3600,
+		Retry:   600,
+		Expire:  86400,
+		Minttl:  d.ttl,
+	}
+}
+
+// dnsJoin puts label in front of zone, zone must be fully qualified
+func dnsJoin(label, zone string) string {
+	if zone == "." {
+		return label + "."
+	}
+	return label + "." + zone
+}
+
+// reverseAddr is the opposite of dns.ReverseAddr, it returns nil if name is not a complete reverse name
+func reverseAddr(name string) net.IP {
+	if s := strings.TrimSuffix(name, ".in-addr.arpa."); s != name {
+		labels := strings.Split(s, ".")
+		if len(labels) != net.IPv4len {
+			return nil
+		}
+		for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+			labels[i], labels[j] = labels[j], labels[i]
+		}
+		return net.ParseIP(strings.Join(labels, ".")).To4()
+	}
+
+	if s := strings.TrimSuffix(name, ".ip6.arpa."); s != name {
+		labels := strings.Split(s, ".")
+		if len(labels) != net.IPv6len*2 {
+			return nil
+		}
+
+		ip := make(net.IP, net.IPv6len)
+		for i, label := range labels {
+			n, err := strconv.ParseUint(label, 16, 8)
+			if err != nil || len(label) != 1 {
+				return nil
+			}
+			// The first label is the lowest nibble
+			pos := len(labels) - 1 - i
+			ip[pos/2] |= byte(n) << (4 * uint(1-pos%2))
+		}
+		return ip
+	}
+
+	return nil
+}
+
+// reverseZone returns the reverse zone that covers n, rounded out to the nearest label
+func reverseZone(n *net.IPNet) string {
+	name, err := dns.ReverseAddr(n.IP.String())
+	if err != nil {
+		return ""
+	}
+
+	ones, bits := n.Mask.Size()
+	keep := ones / 4
+	if bits == 32 {
+		keep = ones / 8
+	}
+
+	// Keep the 2 labels for in-addr.arpa or ip6.arpa
+	labels := dns.SplitDomainName(name)
+	return dns.Fqdn(strings.Join(labels[len(labels)-keep-2:], "."))
 }
@@ -1,19 +1,183 @@
 package nebula
 
 import (
+	"net"
 	"testing"
 
 	"github.com/miekg/dns"
+	"github.com/slackhq/nebula/cert"
+	"github.com/stretchr/testify/assert"
 )
 
-func TestParsequery(t *testing.T) {
-	//TODO: This test is basically pointless
-	hostMap := &HostMap{}
-	ds := newDnsRecords(hostMap)
-	ds.Add("test.com.com", "1.2.3.4")
+func TestDnsServer_answer(t *testing.T) {
+	l := NewTestLogger()
+	_, vpnNet, _ := net.ParseCIDR("10.128.0.0/16")
+	_, vpnNet6, _ := net.ParseCIDR("fd00::/64")
+	hostMap := NewHostMap(l, "test", []*net.IPNet{vpnNet, vpnNet6}, []*net.IPNet{})
 
-	m := new(dns.Msg)
-	m.SetQuestion("test.com.com", dns.TypeA)
+	c := NewConfig(l)
+	c.Settings["lighthouse"] = map[interface{}]interface{}{
+		"dns": map[interface{}]interface{}{
+			"zone": "Nebula.Internal.",
+			"ttl":  "30s",
+			"services": []interface{}{
+				map[interface{}]interface{}{"name": "_http._tcp", "group": "Web", "port": 80},
+			},
+		},
+	}
+	ds, err := newDnsServer(l, hostMap, c)
+	assert.NoError(t, err)
 
-	//parseQuery(m)
+	newCert := func(name string, groups []string, ips ...string) *cert.NebulaCertificate {
+		nc := &cert.NebulaCertificate{Details: cert.NebulaCertificateDetails{Name: name, Groups: groups}}
+		for _, ip := range ips {
+			nc.Details.Ips = append(nc.Details.Ips, &net.IPNet{IP: net.ParseIP(ip)})
+		}
+		return nc
+	}
+	ds.Add(newCert("Web1", []string{"web"}, "10.128.0.1", "fd00::1"))
+	ds.Add(newCert("web2", []string{"web", "db"}, "10.128.0.2"))
+
+	query := func(name string, qtype uint16) *dns.Msg {
+		m := new(dns.Msg)
+		m.SetQuestion(name, qtype)
+		return ds.answer(m, net.ParseIP("10.128.0.100"))
+	}
+
+	// Hosts
+	r := query("web1.nebula.internal.", dns.TypeA)
+	assert.Equal(t, dns.RcodeSuccess, r.Rcode)
+	assert.True(t, r.Authoritative)
+	assert.Len(t, r.Answer, 1)
+	assert.Equal(t, "10.128.0.1", r.Answer[0].(*dns.A).A.String())
+	assert.Equal(t, uint32(30), r.Answer[0].Header().Ttl)
+
+	r = query("WEB1.nebula.internal.", dns.TypeAAAA)
+	assert.Len(t, r.Answer, 1)
+	assert.Equal(t, "fd00::1", r.Answer[0].(*dns.AAAA).AAAA.String())
+	assert.Equal(t, "WEB1.nebula.internal.", r.Answer[0].Header().Name)
+
+	// A name that exists without the record type asked for
+	r = query("web2.nebula.internal.", dns.TypeAAAA)
+	assert.Equal(t, dns.RcodeSuccess, r.Rcode)
+	assert.Empty(t, r.Answer)
+	assert.Len(t, r.Ns, 1)
+	assert.Equal(t, "nebula.internal.", r.Ns[0].(*dns.SOA).Hdr.Name)
+
+	r = query("web3.nebula.internal.", dns.TypeA)
+	assert.Equal(t, dns.RcodeNameError, r.Rcode)
+	assert.Len(t, r.Ns, 1)
+
+	r = query("web1.example.com.", dns.TypeA)
+	assert.Equal(t, dns.RcodeRefused, r.Rcode)
+	assert.False(t, r.Authoritative)
+
+	r = query("nebula.internal.", dns.TypeSOA)
+	assert.Len(t, r.Answer, 1)
+	assert.Equal(t, "hostmaster.nebula.internal.", r.Answer[0].(*dns.SOA).Mbox)
+
+	// Groups
+	r = query("web.groups.nebula.internal.", dns.TypeA)
+	assert.Len(t, r.Answer, 2)
+	r = query("db.groups.nebula.internal.", dns.TypeA)
+	assert.Len(t, r.Answer, 1)
+	assert.Equal(t, "10.128.0.2", r.Answer[0].(*dns.A).A.String())
+	r = query("nope.groups.nebula.internal.", dns.TypeA)
+	assert.Equal(t, dns.RcodeNameError, r.Rcode)
+
+	// Services
+	r = query("_http._tcp.nebula.internal.", dns.TypeSRV)
+	assert.Len(t, r.Answer, 2)
+	assert.Len(t, r.Extra, 3)
+	targets := []string{}
+	for _, rr := range r.Answer {
+		assert.Equal(t, uint16(80), rr.(*dns.SRV).Port)
+		targets = append(targets, rr.(*dns.SRV).Target)
+	}
+	assert.ElementsMatch(t, []string{"web1.nebula.internal.", "web2.nebula.internal."}, targets)
+
+	// Reverse
+	r = query("1.0.128.10.in-addr.arpa.", dns.TypePTR)
+	assert.Len(t, r.Answer, 1)
+	assert.Equal(t, "web1.nebula.internal.", r.Answer[0].(*dns.PTR).Ptr)
+
+	rev6, _ := dns.ReverseAddr("fd00::1")
+	r = query(rev6, dns.TypePTR)
+	assert.Len(t, r.Answer, 1)
+	assert.Equal(t, "web1.nebula.internal.", r.Answer[0].(*dns.PTR).Ptr)
+
+	r = query("9.0.128.10.in-addr.arpa.", dns.TypePTR)
+	assert.Equal(t, dns.RcodeNameError, r.Rcode)
+	assert.Equal(t, "128.10.in-addr.arpa.", r.Ns[0].Header().Name)
+
+	r = query("1.0.0.192.in-addr.arpa.", dns.TypePTR)
+	assert.Equal(t, dns.RcodeRefused, r.Rcode)
+
+	// A host that got a new ip drops the old records
+	ds.Add(newCert("web2", []string{"db"}, "10.128.0.3"))
+	r = query("2.0.128.10.in-addr.arpa.", dns.TypePTR)
+	assert.Equal(t, dns.RcodeNameError, r.Rcode)
+	r = query("web.groups.nebula.internal.", dns.TypeA)
+	assert.Len(t, r.Answer, 1)
+
+	// Reloading moves the zone
+	c.Settings["lighthouse"] = map[interface{}]interface{}{"dns": map[interface{}]interface{}{"zone": "vpn"}}
+	assert.NoError(t, ds.reload(c))
+	r = query("web2.vpn.", dns.TypeA)
+	assert.Len(t, r.Answer, 1)
+	assert.Equal(t, "10.128.0.3", r.Answer[0].(*dns.A).A.String())
+	assert.Equal(t, uint32(60), r.Answer[0].Header().Ttl)
+	r = query("web2.nebula.internal.", dns.TypeA)
+	assert.Equal(t, dns.RcodeRefused, r.Rcode)
+
+	// Certificate TXT records carry the metadata
+	nc := newCert("web1", []string{"web"}, "10.128.0.1")
+	nc.Details.Metadata = map[string]string{"env": "prod", "note": `say "hi"`}
+	hostMap.Hosts[NewVpnIp(net.ParseIP("10.128.0.1"))] = &HostInfo{ConnectionState: &ConnectionState{peerCert: nc}}
+	r = query("10.128.0.1.", dns.TypeTXT)
+	assert.Len(t, r.Answer, 1)
+	txt := r.Answer[0].(*dns.TXT).Txt
+	assert.Equal(t, []string{"Metadata env=prod", `Metadata note=say \"hi\"`}, txt[len(txt)-2:])
+}
+
+func TestConvertDnsServices(t *testing.T) {
+	s, err := convertDnsServices(nil)
+	assert.NoError(t, err)
+	assert.Empty(t, s)
+
+	_, err = convertDnsServices("nope")
+	assert.EqualError(t, err, "lighthouse.dns.services failed to parse, should be an array of services")
+
+	_, err = convertDnsServices([]interface{}{map[interface{}]interface{}{"group": "web", "port": 80}})
+	assert.EqualError(t, err, "lighthouse.dns.services #0; name must be provided")
+
+	_, err = convertDnsServices([]interface{}{map[interface{}]interface{}{"name": "_http._tcp", "port": 80}})
+	assert.EqualError(t, err, "lighthouse.dns.services #0; group must be provided")
+
+	_, err = convertDnsServices([]interface{}{map[interface{}]interface{}{"name": "_http._tcp", "group": "web"}})
+	assert.EqualError(t, err, "lighthouse.dns.services #0; port must be provided")
+
+	_, err = convertDnsServices([]interface{}{map[interface{}]interface{}{"name": "_http._tcp", "group": "web", "port": 80, "weight": -1}})
+	assert.EqualError(t, err, "lighthouse.dns.services #0; weight must be a number between 0 and 65535")
+
+	s, err = convertDnsServices([]interface{}{map[interface{}]interface{}{"name": "_HTTP._tcp.", "group": "web", "port": 80, "priority": 5}})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]dnsService{"_http._tcp": {group: "web", port: 80, priority: 5, weight: 10}}, s)
+}
+
+func TestReverseAddr(t *testing.T) {
+	for _, ip := range []string{"10.1.2.3", "fd00::1", "2001:db8::abcd:1"} {
+		name, err := dns.ReverseAddr(ip)
+		assert.NoError(t, err)
+		assert.True(t, net.ParseIP(ip).Equal(reverseAddr(name)), ip)
+	}
+
+	assert.Nil(t, reverseAddr("2.3.in-addr.arpa."))
+	assert.Nil(t, reverseAddr("x.2.3.4.in-addr.arpa."))
+	assert.Nil(t, reverseAddr("example.com."))
+
+	_, n, _ := net.ParseCIDR("10.128.0.0/9")
+	assert.Equal(t, "10.in-addr.arpa.", reverseZone(n))
+	_, n, _ = net.ParseCIDR("fd00::/64")
+	assert.Equal(t, "0.0.0.0.0.0.0.0.0.0.0.0.0.0.d.f.ip6.arpa.", reverseZone(n))
 }
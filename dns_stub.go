@@ -0,0 +1,305 @@
+package nebula
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+var errNameQueryTimeout = errors.New("timed out waiting for the lighthouses to answer")
+
+// dnsStub is a dns server for this node that answers for hosts by their certificate name. It asks the lighthouses
+// over the tunnel, so it works without a lighthouse running serve_dns and the query never leaves the overlay. Answers,
+// including the names no lighthouse knows, are cached.
+type dnsStub struct {
+	sync.Mutex
+	l  *logrus.Logger
+	lh *LightHouse
+	f  EncWriter
+
+	addr        string
+	zone        string
+	cacheTTL    time.Duration
+	negativeTTL time.Duration
+	timeout     time.Duration
+	server      *dns.Server
+
+	cache   map[string]dnsStubEntry
+	pending map[string]*dnsStubQuery
+}
+
+type dnsStubEntry struct {
+	// vpnIp is the zero value if no lighthouse knew the name
+	vpnIp   VpnIp
+	expires time.Time
+}
+
+// dnsStubQuery is a name query that is waiting on the lighthouses, every request for the name waits on the same one
+type dnsStubQuery struct {
+	done  chan struct{}
+	vpnIp VpnIp
+	// unknown holds the lighthouses that did not know the name, the query fails once they all have answered
+	unknown map[VpnIp]struct{}
+}
+
+// newDnsStub returns nil if lighthouse.dns_stub is not enabled
+func newDnsStub(l *logrus.Logger, lh *LightHouse, c *Config) (*dnsStub, error) {
+	if !c.GetBool("lighthouse.dns_stub.enabled", false) {
+		return nil, nil
+	}
+
+	if !lh.amLighthouse && len(lh.lighthouses) == 0 {
+		return nil, errors.New("lighthouse.dns_stub requires lighthouse.hosts to be set")
+	}
+
+	s := &dnsStub{
+		l:       l,
+		lh:      lh,
+		cache:   map[string]dnsStubEntry{},
+		pending: map[string]*dnsStubQuery{},
+	}
+
+	err := s.configure(c)
+	if err != nil {
+		return nil, err
+	}
+
+	c.RegisterReloadCallback(func(c *Config) {
+		err := s.reload(c)
+		if err != nil {
+			l.WithError(err).Error("Failed to reload the dns stub config")
+		}
+	})
+
+	return s, nil
+}
+
+func getDnsStubAddr(c *Config) string {
+	return c.GetString("lighthouse.dns_stub.host", "127.0.0.1") + ":" + strconv.Itoa(c.GetInt("lighthouse.dns_stub.port", 5353))
+}
+
+func (s *dnsStub) configure(c *Config) error {
+	zone := dns.Fqdn(strings.ToLower(strings.Trim(c.GetString("lighthouse.dns_stub.zone", ""), ".")))
+	if _, ok := dns.IsDomainName(zone); !ok {
+		return fmt.Errorf("lighthouse.dns_stub.zone is not a valid domain name: %s", zone)
+	}
+
+	cacheTTL := c.GetDuration("lighthouse.dns_stub.cache_ttl", time.Minute*5)
+	negativeTTL := c.GetDuration("lighthouse.dns_stub.negative_ttl", time.Second*30)
+	timeout := c.GetDuration("lighthouse.dns_stub.timeout", time.Second*2)
+	if cacheTTL < 0 || negativeTTL < 0 {
+		return errors.New("lighthouse.dns_stub.cache_ttl and negative_ttl can not be negative")
+	}
+	if timeout <= 0 {
+		return errors.New("lighthouse.dns_stub.timeout must be greater than 0")
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	if s.addr == "" {
+		s.addr = getDnsStubAddr(c)
+	}
+	if s.cacheTTL != cacheTTL || s.negativeTTL != negativeTTL {
+		// Don't hold on to answers longer than we are now configured to
+		s.cache = map[string]dnsStubEntry{}
+	}
+	s.zone = zone
+	s.cacheTTL = cacheTTL
+	s.negativeTTL = negativeTTL
+	s.timeout = timeout
+	return nil
+}
+
+func (s *dnsStub) reload(c *Config) error {
+	err := s.configure(c)
+	if err != nil {
+		return err
+	}
+
+	addr := getDnsStubAddr(c)
+	s.Lock()
+	if s.addr == addr {
+		s.Unlock()
+		return nil
+	}
+	s.addr = addr
+	server := s.server
+	s.Unlock()
+
+	s.l.Debug("Restarting DNS stub")
+	if server != nil {
+		_ = server.Shutdown()
+	}
+	go s.Start()
+	return nil
+}
+
+// Start runs the dns listener, this is a blocking call
+func (s *dnsStub) Start() {
+	s.Lock()
+	server := &dns.Server{Addr: s.addr, Net: "udp", Handler: s}
+	s.server = server
+	s.Unlock()
+
+	s.l.WithField("dnsListener", server.Addr).Info("Starting DNS stub")
+	err := server.ListenAndServe()
+	if err != nil {
+		s.l.WithError(err).WithField("dnsListener", server.Addr).Error("Failed to start DNS stub")
+	}
+}
+
+// resolve returns the vpn ip for the certificate name, false is returned if the lighthouses do not know the name
+func (s *dnsStub) resolve(name string) (VpnIp, bool, error) {
+	name = strings.ToLower(name)
+	now := time.Now()
+
+	if s.lh.amLighthouse {
+		s.lh.RLock()
+		vpnIp, ok := s.lh.names[name]
+		s.lh.RUnlock()
+		return vpnIp, ok, nil
+	}
+
+	s.Lock()
+	if e, ok := s.cache[name]; ok && now.Before(e.expires) {
+		s.Unlock()
+		return e.vpnIp, e.vpnIp != VpnIp{}, nil
+	}
+
+	q, waiting := s.pending[name]
+	if !waiting {
+		q = &dnsStubQuery{done: make(chan struct{}), unknown: map[VpnIp]struct{}{}}
+		s.pending[name] = q
+		s.unlockedPurge(now)
+	}
+	timeout := s.timeout
+	s.Unlock()
+
+	if !waiting {
+		s.lh.SendNameQuery(name, s.f)
+	}
+
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case <-q.done:
+		return q.vpnIp, q.vpnIp != VpnIp{}, nil
+	case <-t.C:
+		s.Lock()
+		if s.pending[name] == q {
+			delete(s.pending, name)
+		}
+		s.Unlock()
+		return VpnIp{}, false, errNameQueryTimeout
+	}
+}
+
+// handleReply is the LightHouse nameHandler, answers nobody is waiting for are dropped
+func (s *dnsStub) handleReply(lighthouse VpnIp, name string, vpnIp VpnIp) {
+	name = strings.ToLower(name)
+
+	s.Lock()
+	defer s.Unlock()
+	q, ok := s.pending[name]
+	if !ok {
+		return
+	}
+
+	ttl := s.cacheTTL
+	if vpnIp == (VpnIp{}) {
+		q.unknown[lighthouse] = struct{}{}
+		if len(q.unknown) < len(s.lh.lighthouses) {
+			// Another lighthouse may still know it
+			return
+		}
+		ttl = s.negativeTTL
+	}
+
+	s.cache[name] = dnsStubEntry{vpnIp: vpnIp, expires: time.Now().Add(ttl)}
+	delete(s.pending, name)
+	q.vpnIp = vpnIp
+	close(q.done)
+}
+
+// unlockedPurge drops the expired cache entries, it assumes you have the lock
+func (s *dnsStub) unlockedPurge(now time.Time) {
+	for name, e := range s.cache {
+		if !now.Before(e.expires) {
+			delete(s.cache, name)
+		}
+	}
+}
+
+func (s *dnsStub) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	err := w.WriteMsg(s.answer(r))
+	if err != nil {
+		s.l.WithError(err).Debug("Failed to write dns stub response")
+	}
+}
+
+func (s *dnsStub) answer(r *dns.Msg) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.RecursionAvailable = true
+
+	if r.Opcode != dns.OpcodeQuery {
+		m.Rcode = dns.RcodeNotImplemented
+		return m
+	}
+
+	if len(r.Question) != 1 {
+		m.Rcode = dns.RcodeFormatError
+		return m
+	}
+
+	q := r.Question[0]
+	name := strings.ToLower(q.Name)
+
+	s.Lock()
+	zone, ttl := s.zone, s.cacheTTL
+	s.Unlock()
+
+	var rel string
+	switch {
+	case zone == ".":
+		rel = strings.TrimSuffix(name, ".")
+	case name == zone:
+	case strings.HasSuffix(name, "."+zone):
+		rel = strings.TrimSuffix(name, "."+zone)
+	default:
+		m.Rcode = dns.RcodeRefused
+		return m
+	}
+
+	if rel == "" {
+		return m
+	}
+
+	vpnIp, found, err := s.resolve(rel)
+	if err != nil {
+		s.l.WithError(err).WithField("name", rel).Debug("Failed to resolve name")
+		m.Rcode = dns.RcodeServerFailure
+		return m
+	}
+
+	if !found {
+		m.Rcode = dns.RcodeNameError
+		return m
+	}
+
+	hdr := dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET, Ttl: uint32(ttl.Seconds())}
+	switch {
+	case q.Qtype == dns.TypeA && vpnIp.Is4():
+		m.Answer = append(m.Answer, &dns.A{Hdr: hdr, A: vpnIp.ToIP()})
+	case q.Qtype == dns.TypeAAAA && !vpnIp.Is4():
+		m.Answer = append(m.Answer, &dns.AAAA{Hdr: hdr, AAAA: vpnIp.ToIP()})
+	}
+
+	return m
+}
@@ -0,0 +1,96 @@
+package nebula
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDnsStub(t *testing.T) {
+	l := NewTestLogger()
+	lhVpnIp := NewVpnIp(net.ParseIP("10.128.0.1"))
+	lhBVpnIp := NewVpnIp(net.ParseIP("10.128.0.2"))
+	hostVpnIp := NewVpnIp(net.ParseIP("10.128.0.3"))
+	udpServer, _ := NewListener(l, "0.0.0.0", 0, true)
+	lh := NewLightHouse(l, false, []*net.IPNet{{IP: net.IP{10, 128, 0, 4}, Mask: net.IPMask{255, 255, 255, 0}}}, []VpnIp{lhVpnIp, lhBVpnIp}, 10, 10003, udpServer, false, 1, false)
+
+	c := NewConfig(l)
+	s, err := newDnsStub(l, lh, c)
+	assert.NoError(t, err)
+	assert.Nil(t, s)
+
+	c.Settings["lighthouse"] = map[interface{}]interface{}{
+		"dns_stub": map[interface{}]interface{}{"enabled": true, "zone": "nebula.internal", "timeout": "100ms"},
+	}
+	s, err = newDnsStub(l, lh, c)
+	assert.NoError(t, err)
+	w := &testEncWriter{}
+	s.f = w
+
+	query := func(name string, qtype uint16) *dns.Msg {
+		m := new(dns.Msg)
+		m.SetQuestion(name, qtype)
+		return s.answer(m)
+	}
+
+	// reply answers the query as soon as it goes out, in the background like a real lighthouse would
+	reply := func(lighthouse VpnIp, vpnIp VpnIp) {
+		go func() {
+			assert.Eventually(t, func() bool {
+				s.Lock()
+				defer s.Unlock()
+				return len(s.pending) > 0
+			}, time.Second, time.Millisecond)
+			s.handleReply(lighthouse, "Host1", vpnIp)
+		}()
+	}
+
+	reply(lhVpnIp, hostVpnIp)
+	r := query("host1.nebula.internal.", dns.TypeA)
+	assert.Equal(t, dns.RcodeSuccess, r.Rcode)
+	assert.Len(t, r.Answer, 1)
+	assert.Equal(t, "10.128.0.3", r.Answer[0].(*dns.A).A.String())
+	assert.Equal(t, NebulaMeta_HostNameQuery, w.lastReply.msg.Type)
+	assert.Equal(t, "host1", w.lastReply.msg.Details.Name)
+
+	// The second lookup comes from the cache
+	w.lastReply = testLhReply{}
+	r = query("HOST1.nebula.internal.", dns.TypeAAAA)
+	assert.Equal(t, dns.RcodeSuccess, r.Rcode)
+	assert.Empty(t, r.Answer)
+	assert.Nil(t, w.lastReply.msg)
+
+	// A name is only unknown once every lighthouse says so
+	s.cache = map[string]dnsStubEntry{}
+	reply(lhVpnIp, VpnIp{})
+	r = query("host1.nebula.internal.", dns.TypeA)
+	assert.Equal(t, dns.RcodeServerFailure, r.Rcode)
+
+	reply(lhVpnIp, VpnIp{})
+	reply(lhBVpnIp, VpnIp{})
+	r = query("host1.nebula.internal.", dns.TypeA)
+	assert.Equal(t, dns.RcodeNameError, r.Rcode)
+	assert.Equal(t, VpnIp{}, s.cache["host1"].vpnIp)
+
+	// Answers that nobody asked for are ignored
+	s.handleReply(lhVpnIp, "host9", hostVpnIp)
+	assert.NotContains(t, s.cache, "host9")
+
+	r = query("host1.example.com.", dns.TypeA)
+	assert.Equal(t, dns.RcodeRefused, r.Rcode)
+
+	// Lighthouses answer from what they know
+	lh.amLighthouse = true
+	lh.SetName(hostVpnIp, "host1")
+	r = query("host1.nebula.internal.", dns.TypeA)
+	assert.Len(t, r.Answer, 1)
+	assert.Equal(t, "10.128.0.3", r.Answer[0].(*dns.A).A.String())
+
+	// Config errors
+	lh = NewLightHouse(l, false, []*net.IPNet{{IP: net.IP{10, 128, 0, 4}, Mask: net.IPMask{255, 255, 255, 0}}}, []VpnIp{}, 10, 10003, udpServer, false, 1, false)
+	_, err = newDnsStub(l, lh, c)
+	assert.EqualError(t, err, "lighthouse.dns_stub requires lighthouse.hosts to be set")
+}
@@ -3,19 +3,21 @@
 package e2e
 
 import (
+	"fmt"
 	"net"
 	"testing"
 	"time"
 
 	"github.com/slackhq/nebula"
+	"github.com/slackhq/nebula/cert"
 	"github.com/slackhq/nebula/e2e/router"
 	"github.com/stretchr/testify/assert"
 )
 
 func TestGoodHandshake(t *testing.T) {
 	ca, _, caKey, _ := newTestCaCert(time.Now(), time.Now().Add(10*time.Minute), []*net.IPNet{}, []*net.IPNet{}, []string{})
-	myControl, myVpnIp, myUdpAddr := newSimpleServer(ca, caKey, "me", net.IP{10, 0, 0, 1})
-	theirControl, theirVpnIp, theirUdpAddr := newSimpleServer(ca, caKey, "them", net.IP{10, 0, 0, 2})
+	myControl, myVpnIp, myUdpAddr := newSimpleServer(ca, caKey, "me", net.IP{10, 0, 0, 1}, nil)
+	theirControl, theirVpnIp, theirUdpAddr := newSimpleServer(ca, caKey, "them", net.IP{10, 0, 0, 2}, nil)
 
 	// Put their info in our lighthouse
 	myControl.InjectLightHouseAddr(theirVpnIp, theirUdpAddr)
@@ -60,15 +62,82 @@ func TestGoodHandshake(t *testing.T) {
 	//TODO: assert hostmaps
 }
 
+func TestCipherNegotiation(t *testing.T) {
+	ca, _, caKey, _ := newTestCaCert(time.Now(), time.Now().Add(10*time.Minute), []*net.IPNet{}, []*net.IPNet{}, []string{})
+	myControl, myVpnIp, myUdpAddr := newSimpleServer(ca, caKey, "me", net.IP{10, 0, 0, 1}, m{"cipher": "aes", "ciphers": []string{"chachapoly"}})
+	theirControl, theirVpnIp, theirUdpAddr := newSimpleServer(ca, caKey, "them", net.IP{10, 0, 0, 2}, m{"cipher": "chachapoly"})
+
+	myControl.InjectLightHouseAddr(theirVpnIp, theirUdpAddr)
+	r := router.NewR(myControl, theirControl)
+
+	myControl.Start()
+	theirControl.Start()
+
+	t.Log("Handshake with aes, they only take chachapoly for the tunnel")
+	myControl.InjectTunUDPPacket(theirVpnIp, 80, 80, []byte("Hi from me"))
+	p := r.RouteForAllUntilTxTun(theirControl)
+	assertUdpPacket(t, []byte("Hi from me"), p, myVpnIp, theirVpnIp, 80, 80)
+
+	assertHostInfoPair(t, myUdpAddr, theirUdpAddr, myVpnIp, theirVpnIp, myControl, theirControl)
+	assert.Equal(t, "chachapoly", myControl.GetHostInfoByVpnIP(nebula.NewVpnIp(theirVpnIp), false).Cipher)
+	assert.Equal(t, "chachapoly", theirControl.GetHostInfoByVpnIP(nebula.NewVpnIp(myVpnIp), false).Cipher)
+
+	t.Log("Do a bidirectional tunnel test")
+	assertTunnel(t, myVpnIp, theirVpnIp, myControl, theirControl, r)
+
+	myControl.Stop()
+	theirControl.Stop()
+}
+
+func TestPqHybridHandshake(t *testing.T) {
+	ca, _, caKey, _ := newTestCaCert(time.Now(), time.Now().Add(10*time.Minute), []*net.IPNet{}, []*net.IPNet{}, []string{})
+	myControl, myVpnIp, _ := newSimpleServer(ca, caKey, "me", net.IP{10, 0, 0, 1}, m{"handshakes": m{"pq_hybrid": "enabled"}})
+	theirControl, theirVpnIp, theirUdpAddr := newSimpleServer(ca, caKey, "them", net.IP{10, 0, 0, 2}, nil)
+	otherControl, otherVpnIp, otherUdpAddr := newSimpleServer(ca, caKey, "other", net.IP{10, 0, 0, 3}, m{"handshakes": m{"pq_hybrid": "required"}})
+
+	myControl.InjectLightHouseAddr(theirVpnIp, theirUdpAddr)
+	myControl.InjectLightHouseAddr(otherVpnIp, otherUdpAddr)
+	r := router.NewR(myControl, theirControl, otherControl)
+
+	myControl.Start()
+	theirControl.Start()
+	otherControl.Start()
+
+	t.Log("A node that does not start hybrid handshakes still answers them")
+	myControl.InjectTunUDPPacket(theirVpnIp, 80, 80, []byte("Hi from me"))
+	p := r.RouteForAllUntilTxTun(theirControl)
+	assertUdpPacket(t, []byte("Hi from me"), p, myVpnIp, theirVpnIp, 80, 80)
+	assert.True(t, myControl.GetHostInfoByVpnIP(nebula.NewVpnIp(theirVpnIp), false).PqHybrid)
+	assert.True(t, theirControl.GetHostInfoByVpnIP(nebula.NewVpnIp(myVpnIp), false).PqHybrid)
+
+	t.Log("A node that requires them accepts ours")
+	myControl.InjectTunUDPPacket(otherVpnIp, 80, 80, []byte("Hi from me"))
+	p = r.RouteForAllUntilTxTun(otherControl)
+	assertUdpPacket(t, []byte("Hi from me"), p, myVpnIp, otherVpnIp, 80, 80)
+	assert.True(t, otherControl.GetHostInfoByVpnIP(nebula.NewVpnIp(myVpnIp), false).PqHybrid)
+
+	t.Log("Do a bidirectional tunnel test")
+	assertTunnel(t, myVpnIp, otherVpnIp, myControl, otherControl, r)
+
+	// Everyone has more than one tunnel to close now, keep routing so the close messages do not block
+	go r.RouteForAllExitFunc(func(*nebula.UdpPacket, *nebula.Control) router.ExitType {
+		return router.KeepRouting
+	})
+
+	myControl.Stop()
+	theirControl.Stop()
+	otherControl.Stop()
+}
+
 func TestWrongResponderHandshake(t *testing.T) {
 	ca, _, caKey, _ := newTestCaCert(time.Now(), time.Now().Add(10*time.Minute), []*net.IPNet{}, []*net.IPNet{}, []string{})
 
 	// The IPs here are chosen on purpose:
 	// The current remote handling will sort by preference, public, and then lexically.
 	// So we need them to have a higher address than evil (we could apply a preference though)
-	myControl, myVpnIp, myUdpAddr := newSimpleServer(ca, caKey, "me", net.IP{10, 0, 0, 100})
-	theirControl, theirVpnIp, theirUdpAddr := newSimpleServer(ca, caKey, "them", net.IP{10, 0, 0, 99})
-	evilControl, evilVpnIp, evilUdpAddr := newSimpleServer(ca, caKey, "evil", net.IP{10, 0, 0, 2})
+	myControl, myVpnIp, myUdpAddr := newSimpleServer(ca, caKey, "me", net.IP{10, 0, 0, 100}, nil)
+	theirControl, theirVpnIp, theirUdpAddr := newSimpleServer(ca, caKey, "them", net.IP{10, 0, 0, 99}, nil)
+	evilControl, evilVpnIp, evilUdpAddr := newSimpleServer(ca, caKey, "evil", net.IP{10, 0, 0, 2}, nil)
 
 	// Add their real udp addr, which should be tried after evil.
 	myControl.InjectLightHouseAddr(theirVpnIp, theirUdpAddr)
@@ -114,8 +183,8 @@ func TestWrongResponderHandshake(t *testing.T) {
 	r.FlushAll()
 
 	t.Log("Ensure ensure I don't have any hostinfo artifacts from evil")
-	assert.Nil(t, myControl.GetHostInfoByVpnIP(ip2int(evilVpnIp), true), "My pending hostmap should not contain evil")
-	assert.Nil(t, myControl.GetHostInfoByVpnIP(ip2int(evilVpnIp), false), "My main hostmap should not contain evil")
+	assert.Nil(t, myControl.GetHostInfoByVpnIP(nebula.NewVpnIp(evilVpnIp), true), "My pending hostmap should not contain evil")
+	assert.Nil(t, myControl.GetHostInfoByVpnIP(nebula.NewVpnIp(evilVpnIp), false), "My main hostmap should not contain evil")
 	//NOTE: if evil lost the handshake race it may still have a tunnel since me would reject the handshake since the tunnel is complete
 
 	//TODO: assert hostmaps for everyone
@@ -126,8 +195,8 @@ func TestWrongResponderHandshake(t *testing.T) {
 
 func Test_Case1_Stage1Race(t *testing.T) {
 	ca, _, caKey, _ := newTestCaCert(time.Now(), time.Now().Add(10*time.Minute), []*net.IPNet{}, []*net.IPNet{}, []string{})
-	myControl, myVpnIp, myUdpAddr := newSimpleServer(ca, caKey, "me  ", net.IP{10, 0, 0, 1})
-	theirControl, theirVpnIp, theirUdpAddr := newSimpleServer(ca, caKey, "them", net.IP{10, 0, 0, 2})
+	myControl, myVpnIp, myUdpAddr := newSimpleServer(ca, caKey, "me  ", net.IP{10, 0, 0, 1}, nil)
+	theirControl, theirVpnIp, theirUdpAddr := newSimpleServer(ca, caKey, "them", net.IP{10, 0, 0, 2}, nil)
 
 	// Put their info in our lighthouse and vice versa
 	myControl.InjectLightHouseAddr(theirVpnIp, theirUdpAddr)
@@ -178,4 +247,339 @@ func Test_Case1_Stage1Race(t *testing.T) {
 	//TODO: assert hostmaps
 }
 
+func TestRelays(t *testing.T) {
+	ca, _, caKey, _ := newTestCaCert(time.Now(), time.Now().Add(10*time.Minute), []*net.IPNet{}, []*net.IPNet{}, []string{})
+	myControl, myVpnIp, _ := newSimpleServer(ca, caKey, "me     ", net.IP{10, 0, 0, 1}, m{"relay": m{"use_relays": true}})
+	relayControl, relayVpnIp, relayUdpAddr := newSimpleServer(ca, caKey, "relay  ", net.IP{10, 0, 0, 128}, m{"relay": m{"am_relay": true}})
+	theirControl, theirVpnIp, theirUdpAddr := newSimpleServer(ca, caKey, "them   ", net.IP{10, 0, 0, 2}, m{"relay": m{"relays": []string{"10.128.0.128"}}})
+
+	// Teach me how to get to the relay and that they can be reached via the relay, I never learn their address
+	myControl.InjectLightHouseAddr(relayVpnIp, relayUdpAddr)
+	myControl.InjectRelays(theirVpnIp, []net.IP{relayVpnIp})
+	relayControl.InjectLightHouseAddr(theirVpnIp, theirUdpAddr)
+
+	// Build a router so we don't have to reason who gets which packet
+	r := router.NewR(myControl, relayControl, theirControl)
+
+	// Start the servers
+	myControl.Start()
+	relayControl.Start()
+	theirControl.Start()
+
+	t.Log("Trigger a handshake from me to them via the relay")
+	myControl.InjectTunUDPPacket(theirVpnIp, 80, 80, []byte("Hi from me"))
+
+	p := r.RouteForAllUntilTxTun(theirControl)
+	assertUdpPacket(t, []byte("Hi from me"), p, myVpnIp, theirVpnIp, 80, 80)
+
+	t.Log("They should only know about me through the relay")
+	hi := theirControl.GetHostInfoByVpnIP(nebula.NewVpnIp(myVpnIp), false)
+	assert.NotNil(t, hi)
+	assert.Nil(t, hi.CurrentRemote)
+
+	t.Log("Reply from them back to me through the relay")
+	theirControl.InjectTunUDPPacket(myVpnIp, 80, 90, []byte("Hi from them"))
+	p = r.RouteForAllUntilTxTun(myControl)
+	assertUdpPacket(t, []byte("Hi from them"), p, theirVpnIp, myVpnIp, 90, 80)
+
+	// Everyone has more than one tunnel to close now, keep routing so the close messages do not block
+	go r.RouteForAllExitFunc(func(*nebula.UdpPacket, *nebula.Control) router.ExitType {
+		return router.KeepRouting
+	})
+
+	myControl.Stop()
+	relayControl.Stop()
+	theirControl.Stop()
+}
+
+func TestRevokedTunnel(t *testing.T) {
+	ca, _, caKey, _ := newTestCaCert(time.Now(), time.Now().Add(10*time.Minute), []*net.IPNet{}, []*net.IPNet{}, []string{})
+	myControl, myVpnIp, _ := newSimpleServer(ca, caKey, "me  ", net.IP{10, 0, 0, 1}, nil)
+	theirControl, theirVpnIp, theirUdpAddr := newSimpleServer(ca, caKey, "them", net.IP{10, 0, 0, 2}, nil)
+
+	myControl.InjectLightHouseAddr(theirVpnIp, theirUdpAddr)
+
+	r := router.NewR(myControl, theirControl)
+
+	myControl.Start()
+	theirControl.Start()
+
+	t.Log("Stand up a tunnel")
+	myControl.InjectTunUDPPacket(theirVpnIp, 80, 80, []byte("Hi from me"))
+	p := r.RouteForAllUntilTxTun(theirControl)
+	assertUdpPacket(t, []byte("Hi from me"), p, myVpnIp, theirVpnIp, 80, 80)
+	assertTunnel(t, myVpnIp, theirVpnIp, myControl, theirControl, r)
+
+	t.Log("Revoke their certificate")
+	hi := myControl.GetHostInfoByVpnIP(nebula.NewVpnIp(theirVpnIp), false)
+	fp, err := hi.Cert.Sha256Sum()
+	assert.Nil(t, err)
+	issuer, err := ca.Sha256Sum()
+	assert.Nil(t, err)
+
+	crl := &cert.NebulaCRL{
+		Details: cert.NebulaCRLDetails{
+			Issuer:   issuer,
+			Version:  1,
+			IssuedAt: time.Now(),
+			NotAfter: time.Now().Add(time.Hour),
+			Revoked:  []string{fp},
+		},
+	}
+	assert.Nil(t, crl.Sign(caKey))
+	myControl.InjectCRL(crl)
+
+	t.Log("I should have closed the tunnel and told them about it")
+	assert.Nil(t, myControl.GetHostInfoByVpnIP(nebula.NewVpnIp(theirVpnIp), false))
+	theirControl.InjectUDPPacket(myControl.GetFromUDP(true))
+	assert.Eventually(t, func() bool {
+		return theirControl.GetHostInfoByVpnIP(nebula.NewVpnIp(myVpnIp), false) == nil
+	}, time.Second, time.Millisecond*10)
+
+	myControl.Stop()
+	theirControl.Stop()
+}
+
+func TestCertRotation(t *testing.T) {
+	ca, _, caKey, _ := newTestCaCert(time.Now(), time.Now().Add(10*time.Minute), []*net.IPNet{}, []*net.IPNet{}, []string{})
+	myControl, myVpnIp, _ := newSimpleServer(ca, caKey, "me  ", net.IP{10, 0, 0, 1}, nil)
+	theirControl, theirVpnIp, theirUdpAddr := newSimpleServer(ca, caKey, "them", net.IP{10, 0, 0, 2}, nil)
+
+	myControl.InjectLightHouseAddr(theirVpnIp, theirUdpAddr)
+
+	r := router.NewR(myControl, theirControl)
+
+	myControl.Start()
+	theirControl.Start()
+
+	t.Log("Stand up a tunnel")
+	myControl.InjectTunUDPPacket(theirVpnIp, 80, 80, []byte("Hi from me"))
+	p := r.RouteForAllUntilTxTun(theirControl)
+	assertUdpPacket(t, []byte("Hi from me"), p, myVpnIp, theirVpnIp, 80, 80)
+
+	oldHi := myControl.GetHostInfoByVpnIP(nebula.NewVpnIp(theirVpnIp), false)
+	assert.Empty(t, theirControl.GetHostInfoByVpnIP(nebula.NewVpnIp(myVpnIp), false).Cert.Details.Groups)
+
+	t.Log("Give me a new certificate with a group")
+	_, _, myKey, myCert := newTestCert(ca, caKey, "me", time.Now(), time.Now().Add(5*time.Minute), &net.IPNet{IP: myVpnIp, Mask: net.IPMask{255, 255, 255, 0}}, nil, []string{"new"})
+	myControl.ReloadCertKey(myCert, myKey)
+
+	t.Log("Route until they have the new certificate")
+	r.RouteForAllExitFunc(func(*nebula.UdpPacket, *nebula.Control) router.ExitType {
+		hi := theirControl.GetHostInfoByVpnIP(nebula.NewVpnIp(myVpnIp), false)
+		if hi != nil && len(hi.Cert.Details.Groups) > 0 {
+			return router.RouteAndExit
+		}
+		return router.KeepRouting
+	})
+	assert.Equal(t, []string{"new"}, theirControl.GetHostInfoByVpnIP(nebula.NewVpnIp(myVpnIp), false).Cert.Details.Groups)
+
+	t.Log("My side of the tunnel should be replaced once their answer arrives")
+	assert.Eventually(t, func() bool {
+		hi := myControl.GetHostInfoByVpnIP(nebula.NewVpnIp(theirVpnIp), false)
+		return hi != nil && hi.LocalIndex != oldHi.LocalIndex
+	}, time.Second, time.Millisecond*10)
+
+	assertTunnel(t, myVpnIp, theirVpnIp, myControl, theirControl, r)
+
+	myControl.Stop()
+	theirControl.Stop()
+}
+
+func TestIntermediateHandshake(t *testing.T) {
+	ca, _, caKey, caPEM := newTestCaCert(time.Now(), time.Now().Add(10*time.Minute), []*net.IPNet{}, []*net.IPNet{}, []string{})
+	inter, _, interKey, _ := newTestIntermediateCaCert(ca, caKey, "test intermediate", time.Now(), time.Now().Add(9*time.Minute))
+
+	myControl, myVpnIp, _ := newSimpleServer(inter, interKey, "me  ", net.IP{10, 0, 0, 1}, m{"pki": m{"ca": string(caPEM)}})
+	theirControl, theirVpnIp, theirUdpAddr := newSimpleServer(ca, caKey, "them", net.IP{10, 0, 0, 2}, m{
+		"firewall": m{
+			"outbound": []m{{"proto": "any", "port": "any", "host": "any"}},
+			"inbound":  []m{{"proto": "any", "port": "any", "ca_name": "test ca"}},
+		},
+	})
+
+	myControl.InjectLightHouseAddr(theirVpnIp, theirUdpAddr)
+
+	r := router.NewR(myControl, theirControl)
+
+	myControl.Start()
+	theirControl.Start()
+
+	t.Log("They only trust the root, my intermediate should be accepted from the handshake")
+	myControl.InjectTunUDPPacket(theirVpnIp, 80, 80, []byte("Hi from me"))
+	p := r.RouteForAllUntilTxTun(theirControl)
+	assertUdpPacket(t, []byte("Hi from me"), p, myVpnIp, theirVpnIp, 80, 80)
+	assertTunnel(t, myVpnIp, theirVpnIp, myControl, theirControl, r)
+
+	hi := theirControl.GetHostInfoByVpnIP(nebula.NewVpnIp(myVpnIp), false)
+	interSum, err := inter.Sha256Sum()
+	assert.Nil(t, err)
+	assert.Equal(t, interSum, hi.Cert.Details.Issuer)
+
+	myControl.Stop()
+	theirControl.Stop()
+}
+
+func TestRekey(t *testing.T) {
+	ca, _, caKey, _ := newTestCaCert(time.Now(), time.Now().Add(10*time.Minute), []*net.IPNet{}, []*net.IPNet{}, []string{})
+	overrides := m{"rekey": m{"packets": 10}, "timers": m{"connection_alive_interval": 1}}
+	myControl, myVpnIp, _ := newSimpleServer(ca, caKey, "me  ", net.IP{10, 0, 0, 1}, overrides)
+	theirControl, theirVpnIp, theirUdpAddr := newSimpleServer(ca, caKey, "them", net.IP{10, 0, 0, 2}, nil)
+
+	myControl.InjectLightHouseAddr(theirVpnIp, theirUdpAddr)
+	r := router.NewR(myControl, theirControl)
+
+	myControl.Start()
+	theirControl.Start()
+
+	t.Log("Stand up a tunnel and use up the packets it is allowed")
+	for i := 0; i < 10; i++ {
+		myControl.InjectTunUDPPacket(theirVpnIp, 80, 80, []byte("Hi from me"))
+		p := r.RouteForAllUntilTxTun(theirControl)
+		assertUdpPacket(t, []byte("Hi from me"), p, myVpnIp, theirVpnIp, 80, 80)
+	}
+	oldHi := myControl.GetHostInfoByVpnIP(nebula.NewVpnIp(theirVpnIp), false)
+
+	t.Log("Route until they answer the new handshake")
+	h := &nebula.Header{}
+	r.RouteForAllExitFunc(func(p *nebula.UdpPacket, c *nebula.Control) router.ExitType {
+		if err := h.Parse(p.Data); err != nil {
+			panic(err)
+		}
+		if c == myControl && h.Type == nebula.NebulaMessageType(0) && h.MessageCounter == 2 {
+			return router.RouteAndExit
+		}
+		return router.KeepRouting
+	})
+
+	assert.Eventually(t, func() bool {
+		hi := myControl.GetHostInfoByVpnIP(nebula.NewVpnIp(theirVpnIp), false)
+		return hi != nil && hi.LocalIndex != oldHi.LocalIndex
+	}, time.Second, time.Millisecond*10)
+
+	assertTunnel(t, myVpnIp, theirVpnIp, myControl, theirControl, r)
+
+	myControl.Stop()
+	theirControl.Stop()
+}
+
+func TestMultipathSpread(t *testing.T) {
+	ca, _, caKey, _ := newTestCaCert(time.Now(), time.Now().Add(10*time.Minute), []*net.IPNet{}, []*net.IPNet{}, []string{})
+	overrides := m{"multipath": m{"mode": "spread", "check_interval": "100ms", "timeout": "1s"}}
+	myControl, myVpnIp, _ := newSimpleServer(ca, caKey, "me  ", net.IP{10, 0, 0, 1}, overrides)
+	theirControl, theirVpnIp, theirUdpAddr := newSimpleServer(ca, caKey, "them", net.IP{10, 0, 0, 2}, nil)
+
+	// They can also be reached on a second address
+	theirOtherUdpAddr := &net.UDPAddr{IP: net.IP{10, 1, 0, 2}, Port: 4243}
+	myControl.InjectLightHouseAddr(theirVpnIp, theirUdpAddr)
+	myControl.InjectLightHouseAddr(theirVpnIp, theirOtherUdpAddr)
+	r := router.NewR(myControl, theirControl)
+	r.AddRoute(theirOtherUdpAddr.IP, uint16(theirOtherUdpAddr.Port), theirControl)
+
+	myControl.Start()
+	theirControl.Start()
+
+	t.Log("Stand up a tunnel")
+	myControl.InjectTunUDPPacket(theirVpnIp, 80, 80, []byte("Hi from me"))
+	p := r.RouteForAllUntilTxTun(theirControl)
+	assertUdpPacket(t, []byte("Hi from me"), p, myVpnIp, theirVpnIp, 80, 80)
+
+	t.Log("Route until both paths have answered a path check")
+	h := &nebula.Header{}
+	replies := 0
+	r.RouteForAllExitFunc(func(p *nebula.UdpPacket, c *nebula.Control) router.ExitType {
+		if err := h.Parse(p.Data); err != nil {
+			panic(err)
+		}
+		if c == myControl && h.TypeName() == "pathCheck" && h.SubTypeName() == "pathCheckReply" {
+			replies++
+			if replies == 2 {
+				return router.RouteAndExit
+			}
+		}
+		return router.KeepRouting
+	})
+
+	t.Log("Send packets until both paths have been used, the replies may still be in flight so give it a moment")
+	used := map[string]int{}
+	for start := time.Now(); len(used) < 2 && time.Since(start) < time.Second; {
+		myControl.InjectTunUDPPacket(theirVpnIp, 80, 80, []byte("Hi from me"))
+		r.RouteForAllExitFunc(func(p *nebula.UdpPacket, c *nebula.Control) router.ExitType {
+			if err := h.Parse(p.Data); err != nil {
+				panic(err)
+			}
+			if c == theirControl && h.TypeName() == "message" {
+				used[net.JoinHostPort(p.ToIp.String(), fmt.Sprint(p.ToPort))]++
+				return router.RouteAndExit
+			}
+			return router.KeepRouting
+		})
+		assertUdpPacket(t, []byte("Hi from me"), theirControl.GetFromTun(true), myVpnIp, theirVpnIp, 80, 80)
+	}
+	assert.Contains(t, used, theirUdpAddr.String())
+	assert.Contains(t, used, theirOtherUdpAddr.String())
+
+	myControl.Stop()
+	theirControl.Stop()
+}
+
+func TestMultipathBest(t *testing.T) {
+	ca, _, caKey, _ := newTestCaCert(time.Now(), time.Now().Add(10*time.Minute), []*net.IPNet{}, []*net.IPNet{}, []string{})
+	overrides := m{"multipath": m{"mode": "best", "check_interval": "100ms", "timeout": "1s"}}
+	myControl, myVpnIp, _ := newSimpleServer(ca, caKey, "me  ", net.IP{10, 0, 0, 1}, overrides)
+	theirControl, theirVpnIp, theirUdpAddr := newSimpleServer(ca, caKey, "them", net.IP{10, 0, 0, 2}, nil)
+
+	theirOtherUdpAddr := &net.UDPAddr{IP: net.IP{10, 1, 0, 2}, Port: 4243}
+	myControl.InjectLightHouseAddr(theirVpnIp, theirUdpAddr)
+	myControl.InjectLightHouseAddr(theirVpnIp, theirOtherUdpAddr)
+	r := router.NewR(myControl, theirControl)
+	r.AddRoute(theirOtherUdpAddr.IP, uint16(theirOtherUdpAddr.Port), theirControl)
+
+	myControl.Start()
+	theirControl.Start()
+
+	t.Log("Stand up a tunnel, their answers come back from the second address")
+	myControl.InjectTunUDPPacket(theirVpnIp, 80, 80, []byte("Hi from me"))
+	p := r.RouteForAllUntilTxTun(theirControl)
+	assertUdpPacket(t, []byte("Hi from me"), p, myVpnIp, theirVpnIp, 80, 80)
+	hi := myControl.GetHostInfoByVpnIP(nebula.NewVpnIp(theirVpnIp), false)
+	assert.Equal(t, theirOtherUdpAddr.String(), hi.CurrentRemote.String())
+
+	t.Log("Drop everything sent to the second address until the tunnel moves off of it")
+	h := &nebula.Header{}
+	for start := time.Now(); hi.CurrentRemote.String() != theirUdpAddr.String() && time.Since(start) < time.Second*3; {
+		r.RouteForAllExitFunc(func(p *nebula.UdpPacket, c *nebula.Control) router.ExitType {
+			if c == theirControl && p.ToPort == uint16(theirOtherUdpAddr.Port) {
+				return router.ExitNow
+			}
+			if err := h.Parse(p.Data); err != nil {
+				panic(err)
+			}
+			if c == myControl && h.TypeName() == "pathCheck" {
+				return router.RouteAndExit
+			}
+			return router.KeepRouting
+		})
+		hi = myControl.GetHostInfoByVpnIP(nebula.NewVpnIp(theirVpnIp), false)
+	}
+	assert.Equal(t, theirUdpAddr.String(), hi.CurrentRemote.String())
+
+	t.Log("Make sure traffic follows")
+	myControl.InjectTunUDPPacket(theirVpnIp, 80, 80, []byte("Hi from me"))
+	r.RouteForAllExitFunc(func(p *nebula.UdpPacket, c *nebula.Control) router.ExitType {
+		if err := h.Parse(p.Data); err != nil {
+			panic(err)
+		}
+		if c == theirControl && h.TypeName() == "message" {
+			assert.Equal(t, uint16(theirUdpAddr.Port), p.ToPort)
+			return router.RouteAndExit
+		}
+		return router.KeepRouting
+	})
+	assertUdpPacket(t, []byte("Hi from me"), theirControl.GetFromTun(true), myVpnIp, theirVpnIp, 80, 80)
+
+	myControl.Stop()
+	theirControl.Stop()
+}
+
 //TODO: add a test with many lies
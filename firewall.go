@@ -1,6 +1,7 @@
 package nebula
 
 import (
+	"container/list"
 	"crypto/sha256"
 	"encoding/binary"
 	"encoding/hex"
@@ -26,8 +27,49 @@ const (
 	fwProtoUDP  = 17
 	fwProtoICMP = 1
 
+	// ICMPv6 is matched by `proto: icmp` rules, newPacket reports it as fwProtoICMP
+	fwProtoICMPv6 = 58
+
 	fwPortAny      = 0  // Special value for matching `port: any`
 	fwPortFragment = -1 // Special value for matching `port: fragment`
+
+	// The echo types of icmp and icmpv6, replies share the conntrack entry of their request
+	icmpEchoReply     = 0
+	icmpEchoRequest   = 8
+	icmpv6EchoRequest = 128
+	icmpv6EchoReply   = 129
+)
+
+// icmpPort returns the firewallPort key for an icmp type and code, a code of -1 matches any code. Keys are always
+// below fwPortFragment so they never collide with a real port
+func icmpPort(icmpType uint8, code int32) int32 {
+	return fwPortFragment - 1 - (int32(icmpType)<<9 | (code + 1))
+}
+
+// isICMPEcho returns true for the icmp and icmpv6 echo request and reply types
+func isICMPEcho(icmpType uint8) bool {
+	switch icmpType {
+	case icmpEchoReply, icmpEchoRequest, icmpv6EchoRequest, icmpv6EchoReply:
+		return true
+	}
+	return false
+}
+
+// isICMPError returns true for the icmp and icmpv6 types that carry the packet that caused the error. Type numbers
+// 1 through 4 are errors in icmpv6 and either unassigned or errors in icmp, 11 and 12 are unassigned in icmpv6
+func isICMPError(icmpType uint8) bool {
+	switch icmpType {
+	case 1, 2, 3, 4, 11, 12:
+		return true
+	}
+	return false
+}
+
+// Every packet a deny rule drops matches it again, a rule with logging on writes at most denyLogBurst lines per
+// denyLogInterval so a scan or flood can't fill the logs
+const (
+	denyLogBurst    = 10
+	denyLogInterval = time.Second
 )
 
 const tcpACK = 0x10
@@ -35,6 +77,19 @@ const tcpFIN = 0x01
 
 type FirewallInterface interface {
 	AddRule(incoming bool, proto uint8, startPort int32, endPort int32, groups []string, host string, ip *net.IPNet, caName string, caSha string) error
+	AddRuleWithOptions(incoming bool, proto uint8, startPort int32, endPort int32, groups []string, host string, ip *net.IPNet, caName string, caSha string, opts FirewallRuleOptions) error
+}
+
+// FirewallRuleOptions holds the settings of a rule that don't change what it matches
+type FirewallRuleOptions struct {
+	// Deny drops matching packets instead of allowing them
+	Deny bool
+	// Name identifies the rule in metrics, logs, and sshd output, the rule index is used if it is empty
+	Name string
+	// Log emits a log line each time the rule allows a new connection or denies a packet
+	Log bool
+	// Metadata limits the rule to peers whose certificate has all of these metadata values
+	Metadata map[string]string
 }
 
 type conn struct {
@@ -47,15 +102,25 @@ type conn struct {
 	// fields pack for free after the uint32 above
 	incoming     bool
 	rulesVersion uint16
+
+	// hostId and order let the conntrack table enforce its limits
+	hostId VpnIp
+	order  *list.Element
 }
 
-// TODO: need conntrack max tracked connections handling
 type Firewall struct {
 	Conntrack *FirewallConntrack
 
 	InRules  *FirewallTable
 	OutRules *FirewallTable
 
+	// Deny rules are checked before the allow rules above, a packet matching one is dropped even if it would be allowed
+	InDenyRules  *FirewallTable
+	OutDenyRules *FirewallTable
+
+	// ruleMeta holds every rule in the order they were added, for both directions
+	ruleMeta []*firewallRuleMeta
+
 	//TODO: we should have many more options for TCP, an option for ICMP, and mimic the kernel a bit better
 	// https://www.kernel.org/doc/Documentation/networking/nf_conntrack-sysctl.txt
 	TCPTimeout     time.Duration //linux: 5 days max
@@ -63,7 +128,14 @@ type Firewall struct {
 	DefaultTimeout time.Duration //linux: 600s
 
 	// Used to ensure we don't emit local packets for ips we don't own
-	localIps *CIDRTree
+	localIps *CIDR6Tree
+
+	// maxConnections caps the conntrack table, the oldest entry is evicted to make room. maxHostConnections caps the
+	// entries for a single host, new connections from a host at its cap are refused. 0 disables either limit
+	maxConnections     int
+	maxHostConnections int
+	metricEvicted      metrics.Counter
+	metricRefused      metrics.Counter
 
 	rules        string
 	rulesVersion uint16
@@ -80,6 +152,7 @@ type firewallMetrics struct {
 	droppedLocalIP  metrics.Counter
 	droppedRemoteIP metrics.Counter
 	droppedNoRule   metrics.Counter
+	droppedDenyRule metrics.Counter
 }
 
 type FirewallConntrack struct {
@@ -87,6 +160,57 @@ type FirewallConntrack struct {
 
 	Conns      map[FirewallPacket]*conn
 	TimerWheel *TimerWheel
+
+	// order holds the entries oldest first and hostConns counts the entries for each host
+	order     *list.List
+	hostConns map[VpnIp]int
+}
+
+func newFirewallConntrack(min, max time.Duration) *FirewallConntrack {
+	return &FirewallConntrack{
+		Conns:      make(map[FirewallPacket]*conn),
+		TimerWheel: NewTimerWheel(min, max),
+		order:      list.New(),
+		hostConns:  make(map[VpnIp]int),
+	}
+}
+
+// unlockedAdd tracks a new entry, replacing any existing one for fp. Caller must own the lock
+func (ct *FirewallConntrack) unlockedAdd(fp FirewallPacket, c *conn) {
+	ct.unlockedDelete(fp)
+	c.order = ct.order.PushBack(fp)
+	ct.hostConns[c.hostId]++
+	ct.Conns[fp] = c
+}
+
+// unlockedDelete stops tracking fp. Caller must own the lock
+func (ct *FirewallConntrack) unlockedDelete(fp FirewallPacket) {
+	c, ok := ct.Conns[fp]
+	if !ok {
+		return
+	}
+
+	delete(ct.Conns, fp)
+	ct.order.Remove(c.order)
+	if ct.hostConns[c.hostId] <= 1 {
+		delete(ct.hostConns, c.hostId)
+	} else {
+		ct.hostConns[c.hostId]--
+	}
+}
+
+// unlockedEvictOldest stops tracking the oldest entry. Caller must own the lock
+func (ct *FirewallConntrack) unlockedEvictOldest() {
+	if e := ct.order.Front(); e != nil {
+		ct.unlockedDelete(e.Value.(FirewallPacket))
+	}
+}
+
+// unlockedReset forgets every entry. Caller must own the lock
+func (ct *FirewallConntrack) unlockedReset() {
+	ct.Conns = make(map[FirewallPacket]*conn)
+	ct.order.Init()
+	ct.hostConns = make(map[VpnIp]int)
 }
 
 type FirewallTable struct {
@@ -114,18 +238,138 @@ type FirewallCA struct {
 type FirewallRule struct {
 	// Any makes Hosts, Groups, and CIDR irrelevant
 	Any    bool
-	Hosts  map[string]struct{}
+	Hosts  map[string][]*firewallRuleMeta
 	Groups [][]string
-	CIDR   *CIDRTree
+	CIDR   *CIDR6Tree
+	// Metadata holds rules that only apply to peers with certain certificate metadata, they are kept apart so an `any`
+	// in them doesn't shadow everyone else
+	Metadata []*firewallMetadataRule
+
+	// Rules that share a key are kept in the order they were added and the first one is credited with a match.
+	// anyMeta holds the rules that set Any, groupMeta lines up with Groups, and cidrMeta holds the lists that CIDR
+	// points to by network
+	anyMeta   []*firewallRuleMeta
+	groupMeta []*firewallRuleMeta
+	cidrMeta  map[string]*[]*firewallRuleMeta
+}
+
+type firewallMetadataRule struct {
+	metadata map[string]string
+	rule     *FirewallRule
+}
+
+// firewallRuleMeta identifies a rule as it was added. Every table entry the rule expands to points back to it so we
+// can tell which rule matched a packet
+type firewallRuleMeta struct {
+	index    int
+	incoming bool
+	rule     string
+	hash     string
+	opts     FirewallRuleOptions
+	hits     metrics.Counter
+	metric   string
+
+	// logLock guards the window that limits deny rule logging, suppressed counts the lines skipped since the last one
+	logLock    sync.Mutex
+	logWindow  time.Time
+	logged     int
+	suppressed int
+}
+
+// id returns the name of the rule, or a hash of the rule if it has no name. Unlike the index, the hash stays with the
+// rule when a reload adds, removes, or reorders the rules around it
+func (r *firewallRuleMeta) id() string {
+	if r.opts.Name != "" {
+		return r.opts.Name
+	}
+
+	return r.hash
+}
+
+func (r *firewallRuleMeta) direction() string {
+	if r.incoming {
+		return "incoming"
+	}
+	return "outgoing"
+}
+
+func (r *firewallRuleMeta) action() string {
+	if r.opts.Deny {
+		return "deny"
+	}
+	return "allow"
+}
+
+// hit records that the rule allowed a new connection or denied a packet
+func (r *firewallRuleMeta) hit(l *logrus.Logger, fp FirewallPacket, h *HostInfo) {
+	r.hits.Inc(1)
+
+	if !r.opts.Log {
+		return
+	}
+
+	suppressed, ok := r.allowLog(time.Now())
+	if !ok {
+		return
+	}
+
+	entry := h.logger(l).
+		WithField("fwPacket", fp).
+		WithField("firewallRule", m{"id": r.id(), "direction": r.direction(), "action": r.action()})
+	if suppressed > 0 {
+		entry = entry.WithField("suppressed", suppressed)
+	}
+	entry.Info("Firewall rule matched")
+}
+
+// allowLog returns true if a match can be logged at now and how many were skipped before it. Allow rules only match
+// new connections so they always log, deny rules are held to denyLogBurst lines per denyLogInterval
+func (r *firewallRuleMeta) allowLog(now time.Time) (int, bool) {
+	if !r.opts.Deny {
+		return 0, true
+	}
+
+	r.logLock.Lock()
+	defer r.logLock.Unlock()
+
+	if now.Sub(r.logWindow) >= denyLogInterval {
+		r.logWindow = now
+		r.logged = 0
+	}
+
+	if r.logged >= denyLogBurst {
+		r.suppressed++
+		return 0, false
+	}
+
+	r.logged++
+	suppressed := r.suppressed
+	r.suppressed = 0
+	return suppressed, true
+}
+
+func (r *firewallRuleMeta) MarshalJSON() ([]byte, error) {
+	return json.Marshal(m{
+		"id":        r.id(),
+		"index":     r.index,
+		"name":      r.opts.Name,
+		"direction": r.direction(),
+		"action":    r.action(),
+		"log":       r.opts.Log,
+		"hits":      r.hits.Count(),
+		"rule":      r.rule,
+	})
 }
 
 // Even though ports are uint16, int32 maps are faster for lookup
 // Plus we can use `-1` for fragment rules
 type firewallPort map[int32]*FirewallCA
 
+// FirewallPacket is the conntrack key and what rules match against. ICMP has no ports so RemotePort holds the type
+// and code, and LocalPort holds the identifier of echo messages so each ping is tracked on its own
 type FirewallPacket struct {
-	LocalIP    uint32
-	RemoteIP   uint32
+	LocalIP    VpnIp
+	RemoteIP   VpnIp
 	LocalPort  uint16
 	RemotePort uint16
 	Protocol   uint8
@@ -143,6 +387,19 @@ func (fp *FirewallPacket) Copy() *FirewallPacket {
 	}
 }
 
+// conntrackKey returns fp as it should be looked up in conntrack
+func (fp FirewallPacket) conntrackKey() FirewallPacket {
+	if fp.Protocol == fwProtoICMP && !fp.Fragment {
+		switch fp.RemotePort >> 8 {
+		case icmpEchoReply:
+			fp.RemotePort = icmpEchoRequest << 8
+		case icmpv6EchoReply:
+			fp.RemotePort = icmpv6EchoRequest << 8
+		}
+	}
+	return fp
+}
+
 func (fp FirewallPacket) MarshalJSON() ([]byte, error) {
 	var proto string
 	switch fp.Protocol {
@@ -156,8 +413,8 @@ func (fp FirewallPacket) MarshalJSON() ([]byte, error) {
 		proto = fmt.Sprintf("unknown %v", fp.Protocol)
 	}
 	return json.Marshal(m{
-		"LocalIP":    int2ip(fp.LocalIP).String(),
-		"RemoteIP":   int2ip(fp.RemoteIP).String(),
+		"LocalIP":    fp.LocalIP.String(),
+		"RemoteIP":   fp.RemoteIP.String(),
 		"LocalPort":  fp.LocalPort,
 		"RemotePort": fp.RemotePort,
 		"Protocol":   proto,
@@ -184,9 +441,9 @@ func NewFirewall(l *logrus.Logger, tcpTimeout, UDPTimeout, defaultTimeout time.D
 		max = defaultTimeout
 	}
 
-	localIps := NewCIDRTree()
+	localIps := NewCIDR6Tree()
 	for _, ip := range c.Details.Ips {
-		localIps.AddCIDR(&net.IPNet{IP: ip.IP, Mask: net.IPMask{255, 255, 255, 255}}, struct{}{})
+		localIps.AddCIDR(hostIPNet(ip.IP), struct{}{})
 	}
 
 	for _, n := range c.Details.Subnets {
@@ -194,28 +451,31 @@ func NewFirewall(l *logrus.Logger, tcpTimeout, UDPTimeout, defaultTimeout time.D
 	}
 
 	return &Firewall{
-		Conntrack: &FirewallConntrack{
-			Conns:      make(map[FirewallPacket]*conn),
-			TimerWheel: NewTimerWheel(min, max),
-		},
+		Conntrack:      newFirewallConntrack(min, max),
 		InRules:        newFirewallTable(),
 		OutRules:       newFirewallTable(),
+		InDenyRules:    newFirewallTable(),
+		OutDenyRules:   newFirewallTable(),
 		TCPTimeout:     tcpTimeout,
 		UDPTimeout:     UDPTimeout,
 		DefaultTimeout: defaultTimeout,
 		localIps:       localIps,
 		l:              l,
 
-		metricTCPRTT: metrics.GetOrRegisterHistogram("network.tcp.rtt", nil, metrics.NewExpDecaySample(1028, 0.015)),
+		metricTCPRTT:  metrics.GetOrRegisterHistogram("network.tcp.rtt", nil, metrics.NewExpDecaySample(1028, 0.015)),
+		metricEvicted: metrics.GetOrRegisterCounter("firewall.conntrack.evicted", nil),
+		metricRefused: metrics.GetOrRegisterCounter("firewall.conntrack.refused", nil),
 		incomingMetrics: firewallMetrics{
 			droppedLocalIP:  metrics.GetOrRegisterCounter("firewall.incoming.dropped.local_ip", nil),
 			droppedRemoteIP: metrics.GetOrRegisterCounter("firewall.incoming.dropped.remote_ip", nil),
 			droppedNoRule:   metrics.GetOrRegisterCounter("firewall.incoming.dropped.no_rule", nil),
+			droppedDenyRule: metrics.GetOrRegisterCounter("firewall.incoming.dropped.deny_rule", nil),
 		},
 		outgoingMetrics: firewallMetrics{
 			droppedLocalIP:  metrics.GetOrRegisterCounter("firewall.outgoing.dropped.local_ip", nil),
 			droppedRemoteIP: metrics.GetOrRegisterCounter("firewall.outgoing.dropped.remote_ip", nil),
 			droppedNoRule:   metrics.GetOrRegisterCounter("firewall.outgoing.dropped.no_rule", nil),
+			droppedDenyRule: metrics.GetOrRegisterCounter("firewall.outgoing.dropped.deny_rule", nil),
 		},
 	}
 }
@@ -227,9 +487,14 @@ func NewFirewallFromConfig(l *logrus.Logger, nc *cert.NebulaCertificate, c *Conf
 		c.GetDuration("firewall.conntrack.udp_timeout", time.Minute*3),
 		c.GetDuration("firewall.conntrack.default_timeout", time.Minute*10),
 		nc,
-		//TODO: max_connections
 	)
 
+	fw.maxConnections = c.GetInt("firewall.conntrack.max_connections", 100000)
+	fw.maxHostConnections = c.GetInt("firewall.conntrack.max_connections_per_host", 0)
+	if fw.maxConnections < 0 || fw.maxHostConnections < 0 {
+		return nil, fmt.Errorf("firewall.conntrack.max_connections and max_connections_per_host can not be negative")
+	}
+
 	err := AddFirewallRulesFromConfig(l, false, c, fw)
 	if err != nil {
 		return nil, err
@@ -245,6 +510,16 @@ func NewFirewallFromConfig(l *logrus.Logger, nc *cert.NebulaCertificate, c *Conf
 
 // AddRule properly creates the in memory rule structure for a firewall table.
 func (f *Firewall) AddRule(incoming bool, proto uint8, startPort int32, endPort int32, groups []string, host string, ip *net.IPNet, caName string, caSha string) error {
+	return f.AddRuleWithOptions(incoming, proto, startPort, endPort, groups, host, ip, caName, caSha, FirewallRuleOptions{})
+}
+
+// AddDenyRule is like AddRule but packets matching the rule are dropped, no matter which allow rules they match.
+func (f *Firewall) AddDenyRule(incoming bool, proto uint8, startPort int32, endPort int32, groups []string, host string, ip *net.IPNet, caName string, caSha string) error {
+	return f.AddRuleWithOptions(incoming, proto, startPort, endPort, groups, host, ip, caName, caSha, FirewallRuleOptions{Deny: true})
+}
+
+// AddRuleWithOptions is AddRule with control over the action, name, and logging of the rule.
+func (f *Firewall) AddRuleWithOptions(incoming bool, proto uint8, startPort int32, endPort int32, groups []string, host string, ip *net.IPNet, caName string, caSha string, opts FirewallRuleOptions) error {
 	// Under gomobile, stringing a nil pointer with fmt causes an abort in debug mode for iOS
 	// https://github.com/golang/go/issues/14131
 	sIp := ""
@@ -257,24 +532,57 @@ func (f *Firewall) AddRule(incoming bool, proto uint8, startPort int32, endPort
 		"incoming: %v, proto: %v, startPort: %v, endPort: %v, groups: %v, host: %v, ip: %v, caName: %v, caSha: %s",
 		incoming, proto, startPort, endPort, groups, host, sIp, caName, caSha,
 	)
-	f.rules += ruleString + "\n"
 
-	direction := "incoming"
-	if !incoming {
-		direction = "outgoing"
+	meta := &firewallRuleMeta{incoming: incoming, rule: ruleString, opts: opts}
+
+	// Options are only added when set so existing rule hashes don't change
+	if opts.Deny {
+		ruleString = "action: deny, " + ruleString
 	}
-	f.l.WithField("firewallRule", m{"direction": direction, "proto": proto, "startPort": startPort, "endPort": endPort, "groups": groups, "host": host, "ip": sIp, "caName": caName, "caSha": caSha}).
-		Info("Firewall rule added")
+	if opts.Name != "" {
+		ruleString += fmt.Sprintf(", name: %s", opts.Name)
+	}
+	if opts.Log {
+		ruleString += ", log: true"
+	}
+	if len(opts.Metadata) > 0 {
+		ruleString += fmt.Sprintf(", meta: %v", opts.Metadata)
+	}
+	sum := sha256.Sum256([]byte(ruleString))
+	meta.hash = hex.EncodeToString(sum[:6])
 
-	var (
-		ft *FirewallTable
-		fp firewallPort
-	)
+	dupes := 0
+	for _, r := range f.ruleMeta {
+		if r.incoming != incoming {
+			continue
+		}
 
-	if incoming {
-		ft = f.InRules
-	} else {
-		ft = f.OutRules
+		meta.index++
+		if opts.Name != "" && r.opts.Name == opts.Name {
+			return fmt.Errorf("rule name `%s` is already in use", opts.Name)
+		}
+		if r.opts.Name == "" && strings.HasPrefix(r.hash, meta.hash) {
+			dupes++
+		}
+	}
+
+	// Identical rules would otherwise share a counter
+	if dupes > 0 {
+		meta.hash += "-" + strconv.Itoa(dupes)
+	}
+	f.rules += ruleString + "\n"
+
+	// Counters are looked up by rule id so a rule keeps its count across a reload
+	meta.metric = fmt.Sprintf("firewall.%s.rules.%s.hits", meta.direction(), meta.id())
+	meta.hits = metrics.GetOrRegisterCounter(meta.metric, nil)
+
+	f.l.WithField("firewallRule", m{"id": meta.id(), "action": meta.action(), "direction": meta.direction(), "proto": proto, "startPort": startPort, "endPort": endPort, "groups": groups, "host": host, "ip": sIp, "caName": caName, "caSha": caSha, "meta": opts.Metadata, "log": opts.Log}).
+		Info("Firewall rule added")
+
+	var fp firewallPort
+	ft, denyFt := f.tables(incoming)
+	if opts.Deny {
+		ft = denyFt
 	}
 
 	switch proto {
@@ -290,7 +598,41 @@ func (f *Firewall) AddRule(incoming bool, proto uint8, startPort int32, endPort
 		return fmt.Errorf("unknown protocol %v", proto)
 	}
 
-	return fp.addRule(startPort, endPort, groups, host, ip, caName, caSha)
+	if err := fp.addRule(meta, startPort, endPort, groups, host, ip, caName, caSha); err != nil {
+		return err
+	}
+
+	f.ruleMeta = append(f.ruleMeta, meta)
+	return nil
+}
+
+// unregisterRuleMetrics drops the hit counters of rules that are not in next, so a reload doesn't leave counters for
+// removed rules behind
+func (f *Firewall) unregisterRuleMetrics(next *Firewall) {
+	keep := make(map[string]struct{}, len(next.ruleMeta))
+	for _, r := range next.ruleMeta {
+		keep[r.metric] = struct{}{}
+	}
+
+	for _, r := range f.ruleMeta {
+		if _, ok := keep[r.metric]; !ok {
+			metrics.Unregister(r.metric)
+		}
+	}
+}
+
+// GetRules returns every rule in the order they were added
+func (f *Firewall) GetRules() []*firewallRuleMeta {
+	return f.ruleMeta
+}
+
+// tables returns the allow and deny tables for packets flowing in the provided direction
+func (f *Firewall) tables(incoming bool) (*FirewallTable, *FirewallTable) {
+	if incoming {
+		return f.InRules, f.InDenyRules
+	}
+
+	return f.OutRules, f.OutDenyRules
 }
 
 // GetRuleHash returns a hash representation of all inbound and outbound rules
@@ -328,8 +670,8 @@ func AddFirewallRulesFromConfig(l *logrus.Logger, inbound bool, config *Config,
 			return fmt.Errorf("%s rule #%v; only one of port or code should be provided", table, i)
 		}
 
-		if r.Host == "" && len(r.Groups) == 0 && r.Group == "" && r.Cidr == "" && r.CAName == "" && r.CASha == "" {
-			return fmt.Errorf("%s rule #%v; at least one of host, group, cidr, ca_name, or ca_sha must be provided", table, i)
+		if r.Host == "" && len(r.Groups) == 0 && r.Group == "" && r.Cidr == "" && r.CAName == "" && r.CASha == "" && len(r.Meta) == 0 {
+			return fmt.Errorf("%s rule #%v; at least one of host, group, cidr, ca_name, ca_sha, or meta must be provided", table, i)
 		}
 
 		if len(r.Groups) > 0 {
@@ -345,18 +687,31 @@ func AddFirewallRulesFromConfig(l *logrus.Logger, inbound bool, config *Config,
 			groups = []string{r.Group}
 		}
 
-		var sPort, errPort string
-		if r.Code != "" {
-			errPort = "code"
-			sPort = r.Code
-		} else {
-			errPort = "port"
-			sPort = r.Port
+		// When a type is provided code is the icmp code, it is handled below once we know the protocol
+		var startPort, endPort int32
+		if r.Type == "" {
+			var sPort, errPort string
+			if r.Code != "" {
+				errPort = "code"
+				sPort = r.Code
+			} else {
+				errPort = "port"
+				sPort = r.Port
+			}
+
+			startPort, endPort, err = parsePort(sPort)
+			if err != nil {
+				return fmt.Errorf("%s rule #%v; %s %s", table, i, errPort, err)
+			}
 		}
 
-		startPort, endPort, err := parsePort(sPort)
-		if err != nil {
-			return fmt.Errorf("%s rule #%v; %s %s", table, i, errPort, err)
+		opts := FirewallRuleOptions{Name: r.Name, Log: r.Log, Metadata: r.Meta}
+		switch r.Action {
+		case "", "allow":
+		case "deny":
+			opts.Deny = true
+		default:
+			return fmt.Errorf("%s rule #%v; action was not understood; `%s`", table, i, r.Action)
 		}
 
 		var proto uint8
@@ -373,6 +728,25 @@ func AddFirewallRulesFromConfig(l *logrus.Logger, inbound bool, config *Config,
 			return fmt.Errorf("%s rule #%v; proto was not understood; `%s`", table, i, r.Proto)
 		}
 
+		if r.Type != "" {
+			if proto != fwProtoICMP {
+				return fmt.Errorf("%s rule #%v; type and code can only be used with proto icmp", table, i)
+			}
+
+			if r.Port != "" && r.Port != "any" {
+				return fmt.Errorf("%s rule #%v; port can not be used with type", table, i)
+			}
+
+			startPort, err = parseICMPType(r.Type, r.Code)
+			if err != nil {
+				return fmt.Errorf("%s rule #%v; %s", table, i, err)
+			}
+			endPort = startPort
+
+		} else if proto == fwProtoICMP && (startPort != fwPortAny || endPort != fwPortAny) && startPort != fwPortFragment {
+			l.Warnf("%s rule #%v; icmp rules match on type and code, this rule will never match a port", table, i)
+		}
+
 		var cidr *net.IPNet
 		if r.Cidr != "" {
 			_, cidr, err = net.ParseCIDR(r.Cidr)
@@ -381,7 +755,7 @@ func AddFirewallRulesFromConfig(l *logrus.Logger, inbound bool, config *Config,
 			}
 		}
 
-		err = fw.AddRule(inbound, proto, startPort, endPort, groups, r.Host, cidr, r.CAName, r.CASha)
+		err = fw.AddRuleWithOptions(inbound, proto, startPort, endPort, groups, r.Host, cidr, r.CAName, r.CASha, opts)
 		if err != nil {
 			return fmt.Errorf("%s rule #%v; `%s`", table, i, err)
 		}
@@ -393,18 +767,21 @@ func AddFirewallRulesFromConfig(l *logrus.Logger, inbound bool, config *Config,
 var ErrInvalidRemoteIP = errors.New("remote IP is not in remote certificate subnets")
 var ErrInvalidLocalIP = errors.New("local IP is not in list of handled local IPs")
 var ErrNoMatchingRule = errors.New("no matching rule in firewall table")
+var ErrDenyRule = errors.New("matched a deny rule in firewall table")
+var ErrConntrackHostFull = errors.New("too many conntrack entries for the remote host")
 
 // Drop returns an error if the packet should be dropped, explaining why. It
 // returns nil if the packet should not be dropped.
 func (f *Firewall) Drop(packet []byte, fp FirewallPacket, incoming bool, h *HostInfo, caPool *cert.NebulaCAPool, localCache ConntrackCache) error {
 	// Check if we spoke to this tuple, if we did then allow this packet
-	if f.inConns(packet, fp, incoming, h, caPool, localCache) {
+	key := fp.conntrackKey()
+	if f.inConns(packet, key, incoming, h, caPool, localCache) {
 		return nil
 	}
 
 	// Make sure remote address matches nebula certificate
 	if remoteCidr := h.remoteCidr; remoteCidr != nil {
-		if remoteCidr.Contains(fp.RemoteIP) == nil {
+		if remoteCidr.MostSpecificContainsVpnIp(fp.RemoteIP) == nil {
 			f.metrics(incoming).droppedRemoteIP.Inc(1)
 			return ErrInvalidRemoteIP
 		}
@@ -417,28 +794,86 @@ func (f *Firewall) Drop(packet []byte, fp FirewallPacket, incoming bool, h *Host
 	}
 
 	// Make sure we are supposed to be handling this local ip address
-	if f.localIps.Contains(fp.LocalIP) == nil {
+	if f.localIps.MostSpecificContainsVpnIp(fp.LocalIP) == nil {
 		f.metrics(incoming).droppedLocalIP.Inc(1)
 		return ErrInvalidLocalIP
 	}
 
-	table := f.OutRules
-	if incoming {
-		table = f.InRules
+	// We now know which firewall tables to check against, a deny rule wins over any allow rule
+	table, denyTable := f.tables(incoming)
+	if rule := denyTable.match(fp, incoming, h.ConnectionState.peerCert, h.ConnectionState.peerChain, caPool); rule != nil {
+		rule.hit(f.l, fp, h)
+		f.metrics(incoming).droppedDenyRule.Inc(1)
+		return ErrDenyRule
 	}
 
-	// We now know which firewall table to check against
-	if !table.match(fp, incoming, h.ConnectionState.peerCert, caPool) {
+	// ICMP errors about a connection we track are allowed without a rule or conntrack entry of their own
+	if f.isRelatedICMPError(packet, fp, incoming, h) {
+		return nil
+	}
+
+	rule := table.match(fp, incoming, h.ConnectionState.peerCert, h.ConnectionState.peerChain, caPool)
+	if rule == nil {
 		f.metrics(incoming).droppedNoRule.Inc(1)
 		return ErrNoMatchingRule
 	}
-
 	// We always want to conntrack since it is a faster operation
-	f.addConn(packet, fp, incoming)
+	if !f.addConn(packet, key, incoming, h.hostId) {
+		f.metricRefused.Inc(1)
+		return ErrConntrackHostFull
+	}
+	rule.hit(f.l, fp, h)
 
 	return nil
 }
 
+// RevalidateHostConntrack makes the conntrack entries of a single host pass the rules again on their next packet. This
+// is needed when a peer presents a different certificate on a tunnel that already has conntrack entries
+func (f *Firewall) RevalidateHostConntrack(hostId VpnIp) {
+	conntrack := f.Conntrack
+	conntrack.Lock()
+	defer conntrack.Unlock()
+
+	// Any version other than the current one triggers the check, the rules themselves did not change
+	remaining := conntrack.hostConns[hostId]
+	for _, c := range conntrack.Conns {
+		if remaining == 0 {
+			return
+		}
+
+		if c.hostId == hostId {
+			c.rulesVersion = f.rulesVersion - 1
+			remaining--
+		}
+	}
+}
+
+// isRelatedICMPError returns true if the packet is an icmp error about a connection h has in conntrack
+func (f *Firewall) isRelatedICMPError(packet []byte, fp FirewallPacket, incoming bool, h *HostInfo) bool {
+	if fp.Protocol != fwProtoICMP || fp.Fragment || !isICMPError(uint8(fp.RemotePort>>8)) {
+		return false
+	}
+
+	// The packet that caused the error follows the 8 byte icmp header
+	transport := ipHeaderLen(packet)
+	if transport < 0 || len(packet) < transport+8 {
+		return false
+	}
+
+	// That packet was flowing the other way
+	related := FirewallPacket{}
+	if err := newPacket(packet[transport+8:], !incoming, &related); err != nil {
+		return false
+	}
+
+	conntrack := f.Conntrack
+	conntrack.Lock()
+	c, ok := conntrack.Conns[related.conntrackKey()]
+	conntrack.Unlock()
+
+	return ok && c.hostId == h.hostId
+}
+
 func (f *Firewall) metrics(incoming bool) firewallMetrics {
 	if incoming {
 		return f.incomingMetrics
@@ -487,13 +922,11 @@ func (f *Firewall) inConns(packet []byte, fp FirewallPacket, incoming bool, h *H
 	if c.rulesVersion != f.rulesVersion {
 		// This conntrack entry was for an older rule set, validate
 		// it still passes with the current rule set
-		table := f.OutRules
-		if c.incoming {
-			table = f.InRules
-		}
+		table, denyTable := f.tables(c.incoming)
 
-		// We now know which firewall table to check against
-		if !table.match(fp, c.incoming, h.ConnectionState.peerCert, caPool) {
+		// We now know which firewall tables to check against
+		if denyTable.match(fp, c.incoming, h.ConnectionState.peerCert, h.ConnectionState.peerChain, caPool) != nil ||
+			table.match(fp, c.incoming, h.ConnectionState.peerCert, h.ConnectionState.peerChain, caPool) == nil {
 			if f.l.Level >= logrus.DebugLevel {
 				h.logger(f.l).
 					WithField("fwPacket", fp).
@@ -502,7 +935,7 @@ func (f *Firewall) inConns(packet []byte, fp FirewallPacket, incoming bool, h *H
 					WithField("oldRulesVersion", c.rulesVersion).
 					Debugln("dropping old conntrack entry, does not match new ruleset")
 			}
-			delete(conntrack.Conns, fp)
+			conntrack.unlockedDelete(fp)
 			conntrack.Unlock()
 			return false
 		}
@@ -523,7 +956,9 @@ func (f *Firewall) inConns(packet []byte, fp FirewallPacket, incoming bool, h *H
 	case fwProtoTCP:
 		c.Expires = time.Now().Add(f.TCPTimeout)
 		if incoming {
-			f.checkTCPRTT(c, packet)
+			if f.checkTCPRTT(c, packet) {
+				h.stats.setTCPRTT(time.Since(c.Sent))
+			}
 		} else {
 			setTCPRTTTracking(c, packet)
 		}
@@ -542,9 +977,11 @@ func (f *Firewall) inConns(packet []byte, fp FirewallPacket, incoming bool, h *H
 	return true
 }
 
-func (f *Firewall) addConn(packet []byte, fp FirewallPacket, incoming bool) {
+// addConn creates a conntrack entry for a new connection, it returns false if the remote host already has as many
+// entries as it is allowed. When the table is full the oldest entry is evicted to make room
+func (f *Firewall) addConn(packet []byte, fp FirewallPacket, incoming bool, hostId VpnIp) bool {
 	var timeout time.Duration
-	c := &conn{}
+	c := &conn{hostId: hostId}
 
 	switch fp.Protocol {
 	case fwProtoTCP:
@@ -560,7 +997,19 @@ func (f *Firewall) addConn(packet []byte, fp FirewallPacket, incoming bool) {
 
 	conntrack := f.Conntrack
 	conntrack.Lock()
-	if _, ok := conntrack.Conns[fp]; !ok {
+	defer conntrack.Unlock()
+
+	_, exists := conntrack.Conns[fp]
+	if !exists {
+		if f.maxHostConnections > 0 && conntrack.hostConns[hostId] >= f.maxHostConnections {
+			return false
+		}
+
+		for f.maxConnections > 0 && len(conntrack.Conns) >= f.maxConnections {
+			conntrack.unlockedEvictOldest()
+			f.metricEvicted.Inc(1)
+		}
+
 		conntrack.TimerWheel.Add(fp, timeout)
 	}
 
@@ -569,8 +1018,8 @@ func (f *Firewall) addConn(packet []byte, fp FirewallPacket, incoming bool) {
 	c.incoming = incoming
 	c.rulesVersion = f.rulesVersion
 	c.Expires = time.Now().Add(timeout)
-	conntrack.Conns[fp] = c
-	conntrack.Unlock()
+	conntrack.unlockedAdd(fp, c)
+	return true
 }
 
 // Evict checks if a conntrack entry has expired, if so it is removed, if not it is re-added to the wheel
@@ -593,33 +1042,29 @@ func (f *Firewall) evict(p FirewallPacket) {
 	}
 
 	// This conn is done
-	delete(conntrack.Conns, p)
+	conntrack.unlockedDelete(p)
 }
 
-func (ft *FirewallTable) match(p FirewallPacket, incoming bool, c *cert.NebulaCertificate, caPool *cert.NebulaCAPool) bool {
-	if ft.AnyProto.match(p, incoming, c, caPool) {
-		return true
+// match returns the rule that matched the packet, or nil if none did. chain is the verified signers of c, it is looked
+// up in caPool when empty
+func (ft *FirewallTable) match(p FirewallPacket, incoming bool, c *cert.NebulaCertificate, chain []*cert.NebulaCertificate, caPool *cert.NebulaCAPool) *firewallRuleMeta {
+	if r := ft.AnyProto.match(p, incoming, c, chain, caPool); r != nil {
+		return r
 	}
 
 	switch p.Protocol {
 	case fwProtoTCP:
-		if ft.TCP.match(p, incoming, c, caPool) {
-			return true
-		}
+		return ft.TCP.match(p, incoming, c, chain, caPool)
 	case fwProtoUDP:
-		if ft.UDP.match(p, incoming, c, caPool) {
-			return true
-		}
+		return ft.UDP.match(p, incoming, c, chain, caPool)
 	case fwProtoICMP:
-		if ft.ICMP.match(p, incoming, c, caPool) {
-			return true
-		}
+		return ft.ICMP.match(p, incoming, c, chain, caPool)
 	}
 
-	return false
+	return nil
 }
 
-func (fp firewallPort) addRule(startPort int32, endPort int32, groups []string, host string, ip *net.IPNet, caName string, caSha string) error {
+func (fp firewallPort) addRule(meta *firewallRuleMeta, startPort int32, endPort int32, groups []string, host string, ip *net.IPNet, caName string, caSha string) error {
 	if startPort > endPort {
 		return fmt.Errorf("start port was lower than end port")
 	}
@@ -632,7 +1077,7 @@ func (fp firewallPort) addRule(startPort int32, endPort int32, groups []string,
 			}
 		}
 
-		if err := fp[i].addRule(groups, host, ip, caName, caSha); err != nil {
+		if err := fp[i].addRule(meta, groups, host, ip, caName, caSha); err != nil {
 			return err
 		}
 	}
@@ -640,51 +1085,63 @@ func (fp firewallPort) addRule(startPort int32, endPort int32, groups []string,
 	return nil
 }
 
-func (fp firewallPort) match(p FirewallPacket, incoming bool, c *cert.NebulaCertificate, caPool *cert.NebulaCAPool) bool {
+func (fp firewallPort) match(p FirewallPacket, incoming bool, c *cert.NebulaCertificate, chain []*cert.NebulaCertificate, caPool *cert.NebulaCAPool) *firewallRuleMeta {
 	// We don't have any allowed ports, bail
 	if fp == nil {
-		return false
+		return nil
 	}
 
 	var port int32
 
 	if p.Fragment {
 		port = fwPortFragment
+	} else if p.Protocol == fwProtoICMP {
+		// Try the exact type and code, then any code for the type, then any type
+		icmpType := uint8(p.RemotePort >> 8)
+		if r := fp[icmpPort(icmpType, int32(p.RemotePort&0xff))].match(p, c, chain, caPool); r != nil {
+			return r
+		}
+		if r := fp[icmpPort(icmpType, -1)].match(p, c, chain, caPool); r != nil {
+			return r
+		}
+		return fp[fwPortAny].match(p, c, chain, caPool)
 	} else if incoming {
 		port = int32(p.LocalPort)
 	} else {
 		port = int32(p.RemotePort)
 	}
 
-	if fp[port].match(p, c, caPool) {
-		return true
+	if r := fp[port].match(p, c, chain, caPool); r != nil {
+		return r
 	}
 
-	return fp[fwPortAny].match(p, c, caPool)
+	return fp[fwPortAny].match(p, c, chain, caPool)
 }
 
-func (fc *FirewallCA) addRule(groups []string, host string, ip *net.IPNet, caName, caSha string) error {
-	fr := func() *FirewallRule {
-		return &FirewallRule{
-			Hosts:  make(map[string]struct{}),
-			Groups: make([][]string, 0),
-			CIDR:   NewCIDRTree(),
-		}
+func newFirewallRule() *FirewallRule {
+	return &FirewallRule{
+		Hosts:    make(map[string][]*firewallRuleMeta),
+		Groups:   make([][]string, 0),
+		CIDR:     NewCIDR6Tree(),
+		cidrMeta: make(map[string]*[]*firewallRuleMeta),
 	}
+}
 
+func (fc *FirewallCA) addRule(meta *firewallRuleMeta, groups []string, host string, ip *net.IPNet, caName, caSha string) error {
+	md := meta.opts.Metadata
 	if caSha == "" && caName == "" {
 		if fc.Any == nil {
-			fc.Any = fr()
+			fc.Any = newFirewallRule()
 		}
 
-		return fc.Any.addRule(groups, host, ip)
+		return fc.Any.withMetadata(md).addRule(meta, groups, host, ip)
 	}
 
 	if caSha != "" {
 		if _, ok := fc.CAShas[caSha]; !ok {
-			fc.CAShas[caSha] = fr()
+			fc.CAShas[caSha] = newFirewallRule()
 		}
-		err := fc.CAShas[caSha].addRule(groups, host, ip)
+		err := fc.CAShas[caSha].withMetadata(md).addRule(meta, groups, host, ip)
 		if err != nil {
 			return err
 		}
@@ -692,9 +1149,9 @@ func (fc *FirewallCA) addRule(groups []string, host string, ip *net.IPNet, caNam
 
 	if caName != "" {
 		if _, ok := fc.CANames[caName]; !ok {
-			fc.CANames[caName] = fr()
+			fc.CANames[caName] = newFirewallRule()
 		}
-		err := fc.CANames[caName].addRule(groups, host, ip)
+		err := fc.CANames[caName].withMetadata(md).addRule(meta, groups, host, ip)
 		if err != nil {
 			return err
 		}
@@ -703,51 +1160,94 @@ func (fc *FirewallCA) addRule(groups []string, host string, ip *net.IPNet, caNam
 	return nil
 }
 
-func (fc *FirewallCA) match(p FirewallPacket, c *cert.NebulaCertificate, caPool *cert.NebulaCAPool) bool {
+func (fc *FirewallCA) match(p FirewallPacket, c *cert.NebulaCertificate, chain []*cert.NebulaCertificate, caPool *cert.NebulaCAPool) *firewallRuleMeta {
 	if fc == nil {
-		return false
+		return nil
 	}
 
-	if fc.Any.match(p, c) {
-		return true
+	if r := fc.Any.match(p, c); r != nil {
+		return r
 	}
 
-	if t, ok := fc.CAShas[c.Details.Issuer]; ok {
-		if t.match(p, c) {
-			return true
+	if len(chain) == 0 {
+		if s, err := caPool.GetCAForCert(c); err == nil {
+			chain = []*cert.NebulaCertificate{s}
 		}
 	}
 
-	s, err := caPool.GetCAForCert(c)
-	if err != nil {
-		return false
+	// ca_sha and ca_name rules match any CA in the chain so rules for a root keep working for certs from its
+	// intermediates
+	issuer := c.Details.Issuer
+	for i := 0; issuer != ""; i++ {
+		if r := fc.CAShas[issuer].match(p, c); r != nil {
+			return r
+		}
+
+		if i == len(chain) {
+			break
+		}
+
+		if r := fc.CANames[chain[i].Details.Name].match(p, c); r != nil {
+			return r
+		}
+		issuer = chain[i].Details.Issuer
 	}
 
-	return fc.CANames[s.Details.Name].match(p, c)
+	return nil
 }
 
-func (fr *FirewallRule) addRule(groups []string, host string, ip *net.IPNet) error {
-	if fr.Any {
-		return nil
+// withMetadata returns the rule that holds entries limited to peers with the certificate metadata md, or fr itself when
+// md is empty or fr already matches everyone
+func (fr *FirewallRule) withMetadata(md map[string]string) *FirewallRule {
+	if len(md) == 0 || fr.Any {
+		return fr
+	}
+
+	for _, mr := range fr.Metadata {
+		if reflect.DeepEqual(mr.metadata, md) {
+			return mr.rule
+		}
 	}
 
+	r := newFirewallRule()
+	fr.Metadata = append(fr.Metadata, &firewallMetadataRule{metadata: md, rule: r})
+	return r
+}
+
+func (fr *FirewallRule) addRule(meta *firewallRuleMeta, groups []string, host string, ip *net.IPNet) error {
 	if fr.isAny(groups, host, ip) {
+		fr.anyMeta = append(fr.anyMeta, meta)
+		if fr.Any {
+			return nil
+		}
+
 		fr.Any = true
 		// If it's any we need to wipe out any pre-existing rules to save on memory
 		fr.Groups = make([][]string, 0)
-		fr.Hosts = make(map[string]struct{})
-		fr.CIDR = NewCIDRTree()
-	} else {
+		fr.groupMeta = nil
+		fr.Hosts = make(map[string][]*firewallRuleMeta)
+		fr.CIDR = NewCIDR6Tree()
+		fr.cidrMeta = make(map[string]*[]*firewallRuleMeta)
+		fr.Metadata = nil
+	} else if !fr.Any {
 		if len(groups) > 0 {
 			fr.Groups = append(fr.Groups, groups)
+			fr.groupMeta = append(fr.groupMeta, meta)
 		}
 
 		if host != "" {
-			fr.Hosts[host] = struct{}{}
+			fr.Hosts[host] = append(fr.Hosts[host], meta)
 		}
 
 		if ip != nil {
-			fr.CIDR.AddCIDR(ip, struct{}{})
+			// The tree holds a pointer to the list so later rules for the same network only need to be appended
+			if metas, ok := fr.cidrMeta[ip.String()]; ok {
+				*metas = append(*metas, meta)
+			} else {
+				metas = &[]*firewallRuleMeta{meta}
+				fr.cidrMeta[ip.String()] = metas
+				fr.CIDR.AddCIDR(ip, metas)
+			}
 		}
 	}
 
@@ -769,25 +1269,25 @@ func (fr *FirewallRule) isAny(groups []string, host string, ip *net.IPNet) bool
 		return true
 	}
 
-	if ip != nil && ip.Contains(net.IPv4(0, 0, 0, 0)) {
+	if ip != nil && (ip.Contains(net.IPv4zero) || ip.Contains(net.IPv6zero)) {
 		return true
 	}
 
 	return false
 }
 
-func (fr *FirewallRule) match(p FirewallPacket, c *cert.NebulaCertificate) bool {
+func (fr *FirewallRule) match(p FirewallPacket, c *cert.NebulaCertificate) *firewallRuleMeta {
 	if fr == nil {
-		return false
+		return nil
 	}
 
 	// Shortcut path for if groups, hosts, or cidr contained an `any`
 	if fr.Any {
-		return true
+		return fr.anyMeta[0]
 	}
 
 	// Need any of group, host, or cidr to match
-	for _, sg := range fr.Groups {
+	for i, sg := range fr.Groups {
 		found := false
 
 		for _, g := range sg {
@@ -800,25 +1300,52 @@ func (fr *FirewallRule) match(p FirewallPacket, c *cert.NebulaCertificate) bool
 		}
 
 		if found {
-			return true
+			return fr.groupMeta[i]
 		}
 	}
 
 	if fr.Hosts != nil {
-		if _, ok := fr.Hosts[c.Details.Name]; ok {
-			return true
+		if r, ok := fr.Hosts[c.Details.Name]; ok {
+			return r[0]
 		}
 	}
 
-	if fr.CIDR != nil && fr.CIDR.Contains(p.RemoteIP) != nil {
-		return true
+	if fr.CIDR != nil {
+		if r := fr.CIDR.MostSpecificContainsVpnIp(p.RemoteIP); r != nil {
+			return (*r.(*[]*firewallRuleMeta))[0]
+		}
+	}
+
+	for _, mr := range fr.Metadata {
+		if !hasMetadata(c, mr.metadata) {
+			continue
+		}
+
+		if r := mr.rule.match(p, c); r != nil {
+			return r
+		}
 	}
 
 	// No host, group, or cidr matched, bye bye
-	return false
+	return nil
+}
+
+// hasMetadata returns true if the certificate has every key in md with the same value
+func hasMetadata(c *cert.NebulaCertificate, md map[string]string) bool {
+	for k, v := range md {
+		if cv, ok := c.Details.Metadata[k]; !ok || cv != v {
+			return false
+		}
+	}
+
+	return true
 }
 
 type rule struct {
+	Type   string
+	Name   string
+	Log    bool
+	Action string
 	Port   string
 	Code   string
 	Proto  string
@@ -828,6 +1355,7 @@ type rule struct {
 	Cidr   string
 	CAName string
 	CASha  string
+	Meta   map[string]string
 }
 
 func convertRule(l *logrus.Logger, p interface{}, table string, i int) (rule, error) {
@@ -846,6 +1374,17 @@ func convertRule(l *logrus.Logger, p interface{}, table string, i int) (rule, er
 		return fmt.Sprintf("%v", v)
 	}
 
+	r.Type = toString("type", m)
+	r.Name = toString("name", m)
+	r.Action = toString("action", m)
+
+	if v, ok := m["log"]; ok {
+		var err error
+		r.Log, err = strconv.ParseBool(fmt.Sprintf("%v", v))
+		if err != nil {
+			return r, errors.New("log should be true or false")
+		}
+	}
 	r.Port = toString("port", m)
 	r.Code = toString("code", m)
 	r.Proto = toString("proto", m)
@@ -880,9 +1419,47 @@ func convertRule(l *logrus.Logger, p interface{}, table string, i int) (rule, er
 		}
 	}
 
+	if rm, ok := m["meta"]; ok {
+		mm, ok := rm.(map[interface{}]interface{})
+		if !ok {
+			return r, errors.New("meta should be a map of certificate metadata keys to values")
+		}
+
+		r.Meta = make(map[string]string, len(mm))
+		for k, v := range mm {
+			r.Meta[fmt.Sprintf("%v", k)] = fmt.Sprintf("%v", v)
+		}
+	}
+
 	return r, nil
 }
 
+// parseICMPType returns the firewall port that matches the icmp type and code, code can be empty to match any code
+func parseICMPType(t, c string) (int32, error) {
+	if t == "any" {
+		if c != "" && c != "any" {
+			return 0, fmt.Errorf("code can not be used with type `any`")
+		}
+		return fwPortAny, nil
+	}
+
+	icmpType, err := strconv.ParseUint(t, 10, 8)
+	if err != nil {
+		return 0, fmt.Errorf("type was not a number between 0 and 255; `%s`", t)
+	}
+
+	code := int32(-1)
+	if c != "" && c != "any" {
+		icmpCode, err := strconv.ParseUint(c, 10, 8)
+		if err != nil {
+			return 0, fmt.Errorf("code was not a number between 0 and 255; `%s`", c)
+		}
+		code = int32(icmpCode)
+	}
+
+	return icmpPort(uint8(icmpType), code), nil
+}
+
 func parsePort(s string) (startPort, endPort int32, err error) {
 	if s == "any" {
 		startPort = fwPortAny
@@ -936,7 +1513,10 @@ func setTCPRTTTracking(c *conn, p []byte) {
 		return
 	}
 
-	ihl := int(p[0]&0x0f) << 2
+	ihl := ipHeaderLen(p)
+	if ihl < 0 || len(p) < ihl+14 {
+		return
+	}
 
 	// Don't track FIN packets
 	if p[ihl+13]&tcpFIN != 0 {
@@ -952,7 +1532,11 @@ func (f *Firewall) checkTCPRTT(c *conn, p []byte) bool {
 		return false
 	}
 
-	ihl := int(p[0]&0x0f) << 2
+	ihl := ipHeaderLen(p)
+	if ihl < 0 || len(p) < ihl+14 {
+		return false
+	}
+
 	if p[ihl+13]&tcpACK == 0 {
 		return false
 	}
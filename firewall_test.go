@@ -4,14 +4,17 @@ import (
 	"bytes"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"math"
 	"net"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/rcrowley/go-metrics"
 	"github.com/slackhq/nebula/cert"
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/ipv4"
 )
 
 func TestNewFirewall(t *testing.T) {
@@ -70,34 +73,34 @@ func TestFirewall_AddRule(t *testing.T) {
 	assert.True(t, fw.InRules.TCP[1].Any.Any)
 	assert.Empty(t, fw.InRules.TCP[1].Any.Groups)
 	assert.Empty(t, fw.InRules.TCP[1].Any.Hosts)
-	assert.Nil(t, fw.InRules.TCP[1].Any.CIDR.root.left)
-	assert.Nil(t, fw.InRules.TCP[1].Any.CIDR.root.right)
-	assert.Nil(t, fw.InRules.TCP[1].Any.CIDR.root.value)
+	assert.Nil(t, fw.InRules.TCP[1].Any.CIDR.root4.left)
+	assert.Nil(t, fw.InRules.TCP[1].Any.CIDR.root4.right)
+	assert.Nil(t, fw.InRules.TCP[1].Any.CIDR.root4.value)
 
 	fw = NewFirewall(l, time.Second, time.Minute, time.Hour, c)
 	assert.Nil(t, fw.AddRule(true, fwProtoUDP, 1, 1, []string{"g1"}, "", nil, "", ""))
 	assert.False(t, fw.InRules.UDP[1].Any.Any)
 	assert.Contains(t, fw.InRules.UDP[1].Any.Groups[0], "g1")
 	assert.Empty(t, fw.InRules.UDP[1].Any.Hosts)
-	assert.Nil(t, fw.InRules.UDP[1].Any.CIDR.root.left)
-	assert.Nil(t, fw.InRules.UDP[1].Any.CIDR.root.right)
-	assert.Nil(t, fw.InRules.UDP[1].Any.CIDR.root.value)
+	assert.Nil(t, fw.InRules.UDP[1].Any.CIDR.root4.left)
+	assert.Nil(t, fw.InRules.UDP[1].Any.CIDR.root4.right)
+	assert.Nil(t, fw.InRules.UDP[1].Any.CIDR.root4.value)
 
 	fw = NewFirewall(l, time.Second, time.Minute, time.Hour, c)
 	assert.Nil(t, fw.AddRule(true, fwProtoICMP, 1, 1, []string{}, "h1", nil, "", ""))
 	assert.False(t, fw.InRules.ICMP[1].Any.Any)
 	assert.Empty(t, fw.InRules.ICMP[1].Any.Groups)
 	assert.Contains(t, fw.InRules.ICMP[1].Any.Hosts, "h1")
-	assert.Nil(t, fw.InRules.ICMP[1].Any.CIDR.root.left)
-	assert.Nil(t, fw.InRules.ICMP[1].Any.CIDR.root.right)
-	assert.Nil(t, fw.InRules.ICMP[1].Any.CIDR.root.value)
+	assert.Nil(t, fw.InRules.ICMP[1].Any.CIDR.root4.left)
+	assert.Nil(t, fw.InRules.ICMP[1].Any.CIDR.root4.right)
+	assert.Nil(t, fw.InRules.ICMP[1].Any.CIDR.root4.value)
 
 	fw = NewFirewall(l, time.Second, time.Minute, time.Hour, c)
 	assert.Nil(t, fw.AddRule(false, fwProtoAny, 1, 1, []string{}, "", ti, "", ""))
 	assert.False(t, fw.OutRules.AnyProto[1].Any.Any)
 	assert.Empty(t, fw.OutRules.AnyProto[1].Any.Groups)
 	assert.Empty(t, fw.OutRules.AnyProto[1].Any.Hosts)
-	assert.NotNil(t, fw.OutRules.AnyProto[1].Any.CIDR.Match(ip2int(ti.IP)))
+	assert.NotNil(t, fw.OutRules.AnyProto[1].Any.CIDR.MostSpecificContains(ti.IP))
 
 	fw = NewFirewall(l, time.Second, time.Minute, time.Hour, c)
 	assert.Nil(t, fw.AddRule(true, fwProtoUDP, 1, 1, []string{"g1"}, "", nil, "ca-name", ""))
@@ -112,7 +115,7 @@ func TestFirewall_AddRule(t *testing.T) {
 	assert.Nil(t, fw.AddRule(false, fwProtoAny, 0, 0, []string{"g1", "g2"}, "h1", ti, "", ""))
 	assert.Equal(t, []string{"g1", "g2"}, fw.OutRules.AnyProto[0].Any.Groups[0])
 	assert.Contains(t, fw.OutRules.AnyProto[0].Any.Hosts, "h1")
-	assert.NotNil(t, fw.OutRules.AnyProto[0].Any.CIDR.Match(ip2int(ti.IP)))
+	assert.NotNil(t, fw.OutRules.AnyProto[0].Any.CIDR.MostSpecificContains(ti.IP))
 
 	// run twice just to make sure
 	//TODO: these ANY rules should clear the CA firewall portion
@@ -121,9 +124,9 @@ func TestFirewall_AddRule(t *testing.T) {
 	assert.True(t, fw.OutRules.AnyProto[0].Any.Any)
 	assert.Empty(t, fw.OutRules.AnyProto[0].Any.Groups)
 	assert.Empty(t, fw.OutRules.AnyProto[0].Any.Hosts)
-	assert.Nil(t, fw.OutRules.AnyProto[0].Any.CIDR.root.left)
-	assert.Nil(t, fw.OutRules.AnyProto[0].Any.CIDR.root.right)
-	assert.Nil(t, fw.OutRules.AnyProto[0].Any.CIDR.root.value)
+	assert.Nil(t, fw.OutRules.AnyProto[0].Any.CIDR.root4.left)
+	assert.Nil(t, fw.OutRules.AnyProto[0].Any.CIDR.root4.right)
+	assert.Nil(t, fw.OutRules.AnyProto[0].Any.CIDR.root4.value)
 
 	fw = NewFirewall(l, time.Second, time.Minute, time.Hour, c)
 	assert.Nil(t, fw.AddRule(false, fwProtoAny, 0, 0, []string{}, "any", nil, "", ""))
@@ -146,8 +149,8 @@ func TestFirewall_Drop(t *testing.T) {
 	l.SetOutput(ob)
 
 	p := FirewallPacket{
-		ip2int(net.IPv4(1, 2, 3, 4)),
-		ip2int(net.IPv4(1, 2, 3, 4)),
+		NewVpnIp(net.IPv4(1, 2, 3, 4)),
+		NewVpnIp(net.IPv4(1, 2, 3, 4)),
 		10,
 		90,
 		fwProtoUDP,
@@ -172,7 +175,7 @@ func TestFirewall_Drop(t *testing.T) {
 		ConnectionState: &ConnectionState{
 			peerCert: &c,
 		},
-		hostId: ip2int(ipNet.IP),
+		hostId: NewVpnIp(ipNet.IP),
 	}
 	h.CreateRemoteCIDR(&c)
 
@@ -190,7 +193,7 @@ func TestFirewall_Drop(t *testing.T) {
 
 	// test remote mismatch
 	oldRemote := p.RemoteIP
-	p.RemoteIP = ip2int(net.IPv4(1, 2, 3, 10))
+	p.RemoteIP = NewVpnIp(net.IPv4(1, 2, 3, 10))
 	assert.Equal(t, fw.Drop([]byte{}, p, false, &h, cp, nil), ErrInvalidRemoteIP)
 	p.RemoteIP = oldRemote
 
@@ -221,30 +224,159 @@ func TestFirewall_Drop(t *testing.T) {
 	assert.NoError(t, fw.Drop([]byte{}, p, true, &h, cp, nil))
 }
 
+func TestFirewall_DropIntermediate(t *testing.T) {
+	l := NewTestLogger()
+	ob := &bytes.Buffer{}
+	l.SetOutput(ob)
+
+	p := FirewallPacket{
+		NewVpnIp(net.IPv4(1, 2, 3, 4)),
+		NewVpnIp(net.IPv4(1, 2, 3, 4)),
+		10,
+		90,
+		fwProtoUDP,
+		false,
+	}
+
+	ipNet := net.IPNet{
+		IP:   net.IPv4(1, 2, 3, 4),
+		Mask: net.IPMask{255, 255, 255, 0},
+	}
+
+	c := cert.NebulaCertificate{
+		Details: cert.NebulaCertificateDetails{
+			Name:           "host1",
+			Ips:            []*net.IPNet{&ipNet},
+			Groups:         []string{"default-group"},
+			InvertedGroups: map[string]struct{}{"default-group": {}},
+			Issuer:         "inter-shasum",
+		},
+	}
+	h := HostInfo{
+		ConnectionState: &ConnectionState{
+			peerCert: &c,
+			peerChain: []*cert.NebulaCertificate{
+				{Details: cert.NebulaCertificateDetails{Name: "ca-inter", Issuer: "root-shasum"}},
+				{Details: cert.NebulaCertificateDetails{Name: "ca-root"}},
+			},
+		},
+		hostId: NewVpnIp(ipNet.IP),
+	}
+	h.CreateRemoteCIDR(&c)
+	cp := cert.NewCAPool()
+
+	// Rules for any CA in the chain match
+	for _, ca := range [][2]string{{"", "inter-shasum"}, {"", "root-shasum"}, {"ca-inter", ""}, {"ca-root", ""}} {
+		fw := NewFirewall(l, time.Second, time.Minute, time.Hour, &c)
+		assert.Nil(t, fw.AddRule(true, fwProtoAny, 0, 0, []string{"default-group"}, "", nil, ca[0], ca[1]))
+		assert.NoError(t, fw.Drop([]byte{}, p, true, &h, cp, nil), ca)
+	}
+
+	fw := NewFirewall(l, time.Second, time.Minute, time.Hour, &c)
+	assert.Nil(t, fw.AddRule(true, fwProtoAny, 0, 0, []string{"default-group"}, "", nil, "ca-other", "other-shasum"))
+	assert.Equal(t, fw.Drop([]byte{}, p, true, &h, cp, nil), ErrNoMatchingRule)
+}
+
+func TestFirewall_DropMetadata(t *testing.T) {
+	l := NewTestLogger()
+	ob := &bytes.Buffer{}
+	l.SetOutput(ob)
+
+	p := FirewallPacket{
+		NewVpnIp(net.IPv4(1, 2, 3, 4)),
+		NewVpnIp(net.IPv4(1, 2, 3, 4)),
+		10,
+		90,
+		fwProtoUDP,
+		false,
+	}
+
+	ipNet := net.IPNet{
+		IP:   net.IPv4(1, 2, 3, 4),
+		Mask: net.IPMask{255, 255, 255, 0},
+	}
+
+	c := cert.NebulaCertificate{
+		Details: cert.NebulaCertificateDetails{
+			Name:           "host1",
+			Ips:            []*net.IPNet{&ipNet},
+			Groups:         []string{"default-group"},
+			InvertedGroups: map[string]struct{}{"default-group": {}},
+			Issuer:         "signer-shasum",
+			Metadata:       map[string]string{"env": "prod", "app": "web"},
+		},
+	}
+	h := HostInfo{
+		ConnectionState: &ConnectionState{
+			peerCert: &c,
+		},
+		hostId: NewVpnIp(ipNet.IP),
+	}
+	h.CreateRemoteCIDR(&c)
+	cp := cert.NewCAPool()
+
+	// Every metadata value has to match
+	fw := NewFirewall(l, time.Second, time.Minute, time.Hour, &c)
+	assert.Nil(t, fw.AddRuleWithOptions(true, fwProtoAny, 0, 0, nil, "", nil, "", "", FirewallRuleOptions{Metadata: map[string]string{"env": "dev"}}))
+	assert.Nil(t, fw.AddRuleWithOptions(true, fwProtoAny, 0, 0, nil, "", nil, "", "", FirewallRuleOptions{Metadata: map[string]string{"env": "prod", "app": "db"}}))
+	assert.Nil(t, fw.AddRuleWithOptions(true, fwProtoAny, 0, 0, nil, "", nil, "", "", FirewallRuleOptions{Metadata: map[string]string{"owner": "me"}}))
+	assert.Equal(t, fw.Drop([]byte{}, p, true, &h, cp, nil), ErrNoMatchingRule)
+
+	assert.Nil(t, fw.AddRuleWithOptions(true, fwProtoAny, 0, 0, nil, "", nil, "", "", FirewallRuleOptions{Metadata: map[string]string{"env": "prod", "app": "web"}}))
+	assert.NoError(t, fw.Drop([]byte{}, p, true, &h, cp, nil))
+
+	// Metadata narrows a group rule
+	fw = NewFirewall(l, time.Second, time.Minute, time.Hour, &c)
+	assert.Nil(t, fw.AddRuleWithOptions(true, fwProtoAny, 0, 0, []string{"default-group"}, "", nil, "", "", FirewallRuleOptions{Metadata: map[string]string{"env": "dev"}}))
+	assert.Equal(t, fw.Drop([]byte{}, p, true, &h, cp, nil), ErrNoMatchingRule)
+
+	assert.Nil(t, fw.AddRuleWithOptions(true, fwProtoAny, 0, 0, []string{"default-group"}, "", nil, "", "signer-shasum", FirewallRuleOptions{Metadata: map[string]string{"env": "prod"}}))
+	assert.NoError(t, fw.Drop([]byte{}, p, true, &h, cp, nil))
+
+	// An any rule limited by metadata must not open things up for everyone else
+	fw = NewFirewall(l, time.Second, time.Minute, time.Hour, &c)
+	assert.Nil(t, fw.AddRuleWithOptions(true, fwProtoAny, 0, 0, []string{"any"}, "", nil, "", "", FirewallRuleOptions{Metadata: map[string]string{"env": "dev"}}))
+	assert.Nil(t, fw.AddRule(true, fwProtoAny, 0, 0, []string{"nope"}, "", nil, "", ""))
+	assert.Equal(t, fw.Drop([]byte{}, p, true, &h, cp, nil), ErrNoMatchingRule)
+
+	// A deny rule can single out metadata too
+	fw = NewFirewall(l, time.Second, time.Minute, time.Hour, &c)
+	assert.Nil(t, fw.AddRule(true, fwProtoAny, 0, 0, []string{"any"}, "", nil, "", ""))
+	assert.Nil(t, fw.AddRuleWithOptions(true, fwProtoAny, 0, 0, nil, "", nil, "", "", FirewallRuleOptions{Deny: true, Metadata: map[string]string{"env": "prod"}}))
+	assert.Equal(t, fw.Drop([]byte{}, p, true, &h, cp, nil), ErrDenyRule)
+
+	// A cert without metadata never matches
+	c.Details.Metadata = nil
+	fw = NewFirewall(l, time.Second, time.Minute, time.Hour, &c)
+	assert.Nil(t, fw.AddRuleWithOptions(true, fwProtoAny, 0, 0, nil, "", nil, "", "", FirewallRuleOptions{Metadata: map[string]string{"env": "prod"}}))
+	assert.Equal(t, fw.Drop([]byte{}, p, true, &h, cp, nil), ErrNoMatchingRule)
+}
+
 func BenchmarkFirewallTable_match(b *testing.B) {
 	ft := FirewallTable{
 		TCP: firewallPort{},
 	}
 
 	_, n, _ := net.ParseCIDR("172.1.1.1/32")
-	_ = ft.TCP.addRule(10, 10, []string{"good-group"}, "good-host", n, "", "")
-	_ = ft.TCP.addRule(10, 10, []string{"good-group2"}, "good-host", n, "", "")
-	_ = ft.TCP.addRule(10, 10, []string{"good-group3"}, "good-host", n, "", "")
-	_ = ft.TCP.addRule(10, 10, []string{"good-group4"}, "good-host", n, "", "")
-	_ = ft.TCP.addRule(10, 10, []string{"good-group, good-group1"}, "good-host", n, "", "")
+	rule := &firewallRuleMeta{}
+	_ = ft.TCP.addRule(rule, 10, 10, []string{"good-group"}, "good-host", n, "", "")
+	_ = ft.TCP.addRule(rule, 10, 10, []string{"good-group2"}, "good-host", n, "", "")
+	_ = ft.TCP.addRule(rule, 10, 10, []string{"good-group3"}, "good-host", n, "", "")
+	_ = ft.TCP.addRule(rule, 10, 10, []string{"good-group4"}, "good-host", n, "", "")
+	_ = ft.TCP.addRule(rule, 10, 10, []string{"good-group, good-group1"}, "good-host", n, "", "")
 	cp := cert.NewCAPool()
 
 	b.Run("fail on proto", func(b *testing.B) {
 		c := &cert.NebulaCertificate{}
 		for n := 0; n < b.N; n++ {
-			ft.match(FirewallPacket{Protocol: fwProtoUDP}, true, c, cp)
+			ft.match(FirewallPacket{Protocol: fwProtoUDP}, true, c, nil, cp)
 		}
 	})
 
 	b.Run("fail on port", func(b *testing.B) {
 		c := &cert.NebulaCertificate{}
 		for n := 0; n < b.N; n++ {
-			ft.match(FirewallPacket{Protocol: fwProtoTCP, LocalPort: 1}, true, c, cp)
+			ft.match(FirewallPacket{Protocol: fwProtoTCP, LocalPort: 1}, true, c, nil, cp)
 		}
 	})
 
@@ -258,7 +390,7 @@ func BenchmarkFirewallTable_match(b *testing.B) {
 			},
 		}
 		for n := 0; n < b.N; n++ {
-			ft.match(FirewallPacket{Protocol: fwProtoTCP, LocalPort: 10}, true, c, cp)
+			ft.match(FirewallPacket{Protocol: fwProtoTCP, LocalPort: 10}, true, c, nil, cp)
 		}
 	})
 
@@ -270,7 +402,7 @@ func BenchmarkFirewallTable_match(b *testing.B) {
 			},
 		}
 		for n := 0; n < b.N; n++ {
-			ft.match(FirewallPacket{Protocol: fwProtoTCP, LocalPort: 10}, true, c, cp)
+			ft.match(FirewallPacket{Protocol: fwProtoTCP, LocalPort: 10}, true, c, nil, cp)
 		}
 	})
 
@@ -282,12 +414,12 @@ func BenchmarkFirewallTable_match(b *testing.B) {
 			},
 		}
 		for n := 0; n < b.N; n++ {
-			ft.match(FirewallPacket{Protocol: fwProtoTCP, LocalPort: 10}, true, c, cp)
+			ft.match(FirewallPacket{Protocol: fwProtoTCP, LocalPort: 10}, true, c, nil, cp)
 		}
 	})
 
 	b.Run("pass on ip", func(b *testing.B) {
-		ip := ip2int(net.IPv4(172, 1, 1, 1))
+		ip := NewVpnIp(net.IPv4(172, 1, 1, 1))
 		c := &cert.NebulaCertificate{
 			Details: cert.NebulaCertificateDetails{
 				InvertedGroups: map[string]struct{}{"nope": {}},
@@ -295,14 +427,14 @@ func BenchmarkFirewallTable_match(b *testing.B) {
 			},
 		}
 		for n := 0; n < b.N; n++ {
-			ft.match(FirewallPacket{Protocol: fwProtoTCP, LocalPort: 10, RemoteIP: ip}, true, c, cp)
+			ft.match(FirewallPacket{Protocol: fwProtoTCP, LocalPort: 10, RemoteIP: ip}, true, c, nil, cp)
 		}
 	})
 
-	_ = ft.TCP.addRule(0, 0, []string{"good-group"}, "good-host", n, "", "")
+	_ = ft.TCP.addRule(rule, 0, 0, []string{"good-group"}, "good-host", n, "", "")
 
 	b.Run("pass on ip with any port", func(b *testing.B) {
-		ip := ip2int(net.IPv4(172, 1, 1, 1))
+		ip := NewVpnIp(net.IPv4(172, 1, 1, 1))
 		c := &cert.NebulaCertificate{
 			Details: cert.NebulaCertificateDetails{
 				InvertedGroups: map[string]struct{}{"nope": {}},
@@ -310,7 +442,7 @@ func BenchmarkFirewallTable_match(b *testing.B) {
 			},
 		}
 		for n := 0; n < b.N; n++ {
-			ft.match(FirewallPacket{Protocol: fwProtoTCP, LocalPort: 100, RemoteIP: ip}, true, c, cp)
+			ft.match(FirewallPacket{Protocol: fwProtoTCP, LocalPort: 100, RemoteIP: ip}, true, c, nil, cp)
 		}
 	})
 }
@@ -321,8 +453,8 @@ func TestFirewall_Drop2(t *testing.T) {
 	l.SetOutput(ob)
 
 	p := FirewallPacket{
-		ip2int(net.IPv4(1, 2, 3, 4)),
-		ip2int(net.IPv4(1, 2, 3, 4)),
+		NewVpnIp(net.IPv4(1, 2, 3, 4)),
+		NewVpnIp(net.IPv4(1, 2, 3, 4)),
 		10,
 		90,
 		fwProtoUDP,
@@ -345,7 +477,7 @@ func TestFirewall_Drop2(t *testing.T) {
 		ConnectionState: &ConnectionState{
 			peerCert: &c,
 		},
-		hostId: ip2int(ipNet.IP),
+		hostId: NewVpnIp(ipNet.IP),
 	}
 	h.CreateRemoteCIDR(&c)
 
@@ -380,8 +512,8 @@ func TestFirewall_Drop3(t *testing.T) {
 	l.SetOutput(ob)
 
 	p := FirewallPacket{
-		ip2int(net.IPv4(1, 2, 3, 4)),
-		ip2int(net.IPv4(1, 2, 3, 4)),
+		NewVpnIp(net.IPv4(1, 2, 3, 4)),
+		NewVpnIp(net.IPv4(1, 2, 3, 4)),
 		1,
 		1,
 		fwProtoUDP,
@@ -411,7 +543,7 @@ func TestFirewall_Drop3(t *testing.T) {
 		ConnectionState: &ConnectionState{
 			peerCert: &c1,
 		},
-		hostId: ip2int(ipNet.IP),
+		hostId: NewVpnIp(ipNet.IP),
 	}
 	h1.CreateRemoteCIDR(&c1)
 
@@ -426,7 +558,7 @@ func TestFirewall_Drop3(t *testing.T) {
 		ConnectionState: &ConnectionState{
 			peerCert: &c2,
 		},
-		hostId: ip2int(ipNet.IP),
+		hostId: NewVpnIp(ipNet.IP),
 	}
 	h2.CreateRemoteCIDR(&c2)
 
@@ -441,7 +573,7 @@ func TestFirewall_Drop3(t *testing.T) {
 		ConnectionState: &ConnectionState{
 			peerCert: &c3,
 		},
-		hostId: ip2int(ipNet.IP),
+		hostId: NewVpnIp(ipNet.IP),
 	}
 	h3.CreateRemoteCIDR(&c3)
 
@@ -466,8 +598,8 @@ func TestFirewall_DropConntrackReload(t *testing.T) {
 	l.SetOutput(ob)
 
 	p := FirewallPacket{
-		ip2int(net.IPv4(1, 2, 3, 4)),
-		ip2int(net.IPv4(1, 2, 3, 4)),
+		NewVpnIp(net.IPv4(1, 2, 3, 4)),
+		NewVpnIp(net.IPv4(1, 2, 3, 4)),
 		10,
 		90,
 		fwProtoUDP,
@@ -492,7 +624,7 @@ func TestFirewall_DropConntrackReload(t *testing.T) {
 		ConnectionState: &ConnectionState{
 			peerCert: &c,
 		},
-		hostId: ip2int(ipNet.IP),
+		hostId: NewVpnIp(ipNet.IP),
 	}
 	h.CreateRemoteCIDR(&c)
 
@@ -527,6 +659,393 @@ func TestFirewall_DropConntrackReload(t *testing.T) {
 	assert.Equal(t, fw.Drop([]byte{}, p, false, &h, cp, nil), ErrNoMatchingRule)
 }
 
+func TestFirewall_DropDeny(t *testing.T) {
+	l := NewTestLogger()
+	ob := &bytes.Buffer{}
+	l.SetOutput(ob)
+
+	p := FirewallPacket{
+		NewVpnIp(net.IPv4(1, 2, 3, 4)),
+		NewVpnIp(net.IPv4(1, 2, 3, 4)),
+		22,
+		90,
+		fwProtoTCP,
+		false,
+	}
+
+	ipNet := net.IPNet{
+		IP:   net.IPv4(1, 2, 3, 4),
+		Mask: net.IPMask{255, 255, 255, 0},
+	}
+
+	c := cert.NebulaCertificate{
+		Details: cert.NebulaCertificateDetails{
+			Name:           "host1",
+			Ips:            []*net.IPNet{&ipNet},
+			Groups:         []string{"default-group"},
+			InvertedGroups: map[string]struct{}{"default-group": {}},
+			Issuer:         "signer-shasum",
+		},
+	}
+	h := HostInfo{
+		ConnectionState: &ConnectionState{
+			peerCert: &c,
+		},
+		hostId: NewVpnIp(ipNet.IP),
+	}
+	h.CreateRemoteCIDR(&c)
+
+	// Everyone in default-group except host1 on port 22
+	fw := NewFirewall(l, time.Second, time.Minute, time.Hour, &c)
+	assert.Nil(t, fw.AddRule(true, fwProtoAny, 0, 0, []string{"default-group"}, "", nil, "", ""))
+	assert.Nil(t, fw.AddDenyRule(true, fwProtoTCP, 22, 22, nil, "host1", nil, "", ""))
+	cp := cert.NewCAPool()
+
+	assert.Equal(t, fw.Drop([]byte{}, p, true, &h, cp, nil), ErrDenyRule)
+
+	// Other ports are still allowed
+	p.LocalPort = 23
+	assert.NoError(t, fw.Drop([]byte{}, p, true, &h, cp, nil))
+
+	// Deny rules only apply to their own direction
+	p.LocalPort = 22
+	fw = NewFirewall(l, time.Second, time.Minute, time.Hour, &c)
+	assert.Nil(t, fw.AddRule(true, fwProtoAny, 0, 0, []string{"any"}, "", nil, "", ""))
+	assert.Nil(t, fw.AddDenyRule(false, fwProtoAny, 0, 0, []string{"any"}, "", nil, "", ""))
+	assert.NoError(t, fw.Drop([]byte{}, p, true, &h, cp, nil))
+
+	// A deny rule added by a reload drops existing conntrack entries
+	oldFw := fw
+	fw = NewFirewall(l, time.Second, time.Minute, time.Hour, &c)
+	assert.Nil(t, fw.AddRule(true, fwProtoAny, 0, 0, []string{"any"}, "", nil, "", ""))
+	assert.Nil(t, fw.AddDenyRule(true, fwProtoTCP, 22, 22, []string{"default-group"}, "", nil, "", ""))
+	fw.Conntrack = oldFw.Conntrack
+	fw.rulesVersion = oldFw.rulesVersion + 1
+
+	// Drop outbound because the conntrack entry is gone and there are no outbound rules
+	assert.Equal(t, fw.Drop([]byte{}, p, false, &h, cp, nil), ErrNoMatchingRule)
+}
+
+func TestFirewall_RuleHits(t *testing.T) {
+	l := NewTestLogger()
+	ob := &bytes.Buffer{}
+	l.SetOutput(ob)
+
+	p := FirewallPacket{
+		NewVpnIp(net.IPv4(1, 2, 3, 4)),
+		NewVpnIp(net.IPv4(1, 2, 3, 4)),
+		80,
+		90,
+		fwProtoTCP,
+		false,
+	}
+
+	ipNet := net.IPNet{
+		IP:   net.IPv4(1, 2, 3, 4),
+		Mask: net.IPMask{255, 255, 255, 0},
+	}
+
+	c := cert.NebulaCertificate{
+		Details: cert.NebulaCertificateDetails{
+			Name:           "host1",
+			Ips:            []*net.IPNet{&ipNet},
+			Groups:         []string{"default-group"},
+			InvertedGroups: map[string]struct{}{"default-group": {}},
+			Issuer:         "signer-shasum",
+		},
+	}
+	h := HostInfo{
+		ConnectionState: &ConnectionState{
+			peerCert: &c,
+		},
+		hostId: NewVpnIp(ipNet.IP),
+	}
+	h.CreateRemoteCIDR(&c)
+
+	fw := NewFirewall(l, time.Second, time.Minute, time.Hour, &c)
+	assert.Nil(t, fw.AddRuleWithOptions(true, fwProtoTCP, 80, 80, []string{"default-group"}, "", nil, "", "", FirewallRuleOptions{Name: "test-rule-hits-web"}))
+	assert.Nil(t, fw.AddRuleWithOptions(true, fwProtoTCP, 443, 443, nil, "host1", nil, "", "", FirewallRuleOptions{Log: true}))
+	assert.Nil(t, fw.AddRuleWithOptions(true, fwProtoTCP, 22, 22, nil, "", &ipNet, "", "", FirewallRuleOptions{Name: "test-rule-hits-ssh", Deny: true}))
+	assert.EqualError(
+		t,
+		fw.AddRuleWithOptions(true, fwProtoAny, 0, 0, []string{"any"}, "", nil, "", "", FirewallRuleOptions{Name: "test-rule-hits-web"}),
+		"rule name `test-rule-hits-web` is already in use",
+	)
+	cp := cert.NewCAPool()
+
+	rules := fw.GetRules()
+	assert.Len(t, rules, 3)
+	assert.Equal(t, "test-rule-hits-web", rules[0].id())
+	assert.Equal(t, rules[1].hash, rules[1].id())
+	assert.Len(t, rules[1].id(), 12)
+	web, hostRule, ssh := rules[0].hits.Count(), rules[1].hits.Count(), rules[2].hits.Count()
+
+	// New connections count against the rule that allowed them, conntrack hits do not
+	assert.NoError(t, fw.Drop([]byte{}, p, true, &h, cp, nil))
+	assert.NoError(t, fw.Drop([]byte{}, p, true, &h, cp, nil))
+	assert.Equal(t, web+1, rules[0].hits.Count())
+
+	p.LocalPort = 443
+	assert.NoError(t, fw.Drop([]byte{}, p, true, &h, cp, nil))
+	assert.Equal(t, hostRule+1, rules[1].hits.Count())
+	assert.Contains(t, ob.String(), "Firewall rule matched")
+
+	p.LocalPort = 22
+	assert.Equal(t, fw.Drop([]byte{}, p, true, &h, cp, nil), ErrDenyRule)
+	assert.Equal(t, ssh+1, rules[2].hits.Count())
+}
+
+func TestFirewall_RuleHitsDenyLogLimit(t *testing.T) {
+	l := NewTestLogger()
+	ob := &bytes.Buffer{}
+	l.SetOutput(ob)
+
+	ipNet := net.IPNet{
+		IP:   net.IPv4(1, 2, 3, 4),
+		Mask: net.IPMask{255, 255, 255, 0},
+	}
+
+	c := cert.NebulaCertificate{
+		Details: cert.NebulaCertificateDetails{
+			Name:           "host1",
+			Ips:            []*net.IPNet{&ipNet},
+			Groups:         []string{"default-group"},
+			InvertedGroups: map[string]struct{}{"default-group": {}},
+			Issuer:         "signer-shasum",
+		},
+	}
+	h := HostInfo{
+		ConnectionState: &ConnectionState{
+			peerCert: &c,
+		},
+		hostId: NewVpnIp(ipNet.IP),
+	}
+	h.CreateRemoteCIDR(&c)
+
+	fw := NewFirewall(l, time.Second, time.Minute, time.Hour, &c)
+	assert.Nil(t, fw.AddRuleWithOptions(true, fwProtoTCP, 22, 22, nil, "host1", nil, "", "", FirewallRuleOptions{Name: "test-rule-deny-log", Deny: true, Log: true}))
+	cp := cert.NewCAPool()
+	rule := fw.GetRules()[0]
+
+	p := FirewallPacket{h.hostId, h.hostId, 22, 90, fwProtoTCP, false}
+	for i := 0; i < denyLogBurst*3; i++ {
+		assert.Equal(t, ErrDenyRule, fw.Drop([]byte{}, p, true, &h, cp, nil))
+	}
+
+	// Every packet is counted but only the burst is logged
+	assert.Equal(t, int64(denyLogBurst*3), rule.hits.Count())
+	assert.Equal(t, denyLogBurst, strings.Count(ob.String(), "Firewall rule matched"))
+	assert.NotContains(t, ob.String(), "suppressed")
+
+	// The next window reports what was skipped
+	rule.logWindow = rule.logWindow.Add(-denyLogInterval)
+	ob.Reset()
+	assert.Equal(t, ErrDenyRule, fw.Drop([]byte{}, p, true, &h, cp, nil))
+	assert.Contains(t, ob.String(), fmt.Sprintf("suppressed=%d", denyLogBurst*2))
+}
+
+func TestFirewall_RuleHitsOverlap(t *testing.T) {
+	l := NewTestLogger()
+	ob := &bytes.Buffer{}
+	l.SetOutput(ob)
+
+	ipNet := net.IPNet{IP: net.IPv4(1, 2, 3, 4), Mask: net.IPMask{255, 255, 255, 0}}
+	c := cert.NebulaCertificate{
+		Details: cert.NebulaCertificateDetails{
+			Name:           "host1",
+			Ips:            []*net.IPNet{&ipNet},
+			InvertedGroups: map[string]struct{}{},
+		},
+	}
+	h := HostInfo{ConnectionState: &ConnectionState{peerCert: &c}, hostId: NewVpnIp(ipNet.IP)}
+	h.CreateRemoteCIDR(&c)
+	p := FirewallPacket{LocalIP: NewVpnIp(net.IPv4(1, 2, 3, 4)), RemoteIP: NewVpnIp(ipNet.IP), LocalPort: 10, RemotePort: 90, Protocol: fwProtoUDP}
+	cp := cert.NewCAPool()
+
+	// The first rule in config order is credited when rules share a key, no matter which one logs
+	_, cidr, _ := net.ParseCIDR("1.2.3.0/24")
+	for _, tc := range []struct {
+		host string
+		cidr *net.IPNet
+	}{{host: "host1"}, {cidr: cidr}, {host: "any"}} {
+		ob.Reset()
+		fw := NewFirewall(l, time.Second, time.Minute, time.Hour, &c)
+		assert.Nil(t, fw.AddRule(true, fwProtoUDP, 10, 10, nil, tc.host, tc.cidr, "", ""))
+		assert.Nil(t, fw.AddRuleWithOptions(true, fwProtoUDP, 10, 10, nil, tc.host, tc.cidr, "", "", FirewallRuleOptions{Log: true}))
+
+		rules := fw.GetRules()
+		first, second := rules[0].hits.Count(), rules[1].hits.Count()
+		assert.NoError(t, fw.Drop([]byte{}, p, true, &h, cp, nil))
+		assert.Equal(t, first+1, rules[0].hits.Count())
+		assert.Equal(t, second, rules[1].hits.Count())
+		assert.NotContains(t, ob.String(), "Firewall rule matched")
+	}
+}
+
+func TestFirewall_RuleMetricsReload(t *testing.T) {
+	l := NewTestLogger()
+	c := &cert.NebulaCertificate{}
+
+	fw := NewFirewall(l, time.Second, time.Minute, time.Hour, c)
+	assert.Nil(t, fw.AddRule(true, fwProtoTCP, 22, 22, nil, "reload-removed", nil, "", ""))
+	assert.Nil(t, fw.AddRule(true, fwProtoTCP, 80, 80, nil, "reload-kept", nil, "", ""))
+	assert.Nil(t, fw.AddRule(true, fwProtoTCP, 80, 80, nil, "reload-kept", nil, "", ""))
+	removed, kept, dupe := fw.GetRules()[0], fw.GetRules()[1], fw.GetRules()[2]
+	assert.NotEqual(t, kept.id(), dupe.id())
+	kept.hits.Inc(5)
+
+	// The kept rule moved but it keeps its counter
+	fw2 := NewFirewall(l, time.Second, time.Minute, time.Hour, c)
+	assert.Nil(t, fw2.AddRule(true, fwProtoTCP, 80, 80, nil, "reload-kept", nil, "", ""))
+	assert.Equal(t, kept.id(), fw2.GetRules()[0].id())
+	assert.Equal(t, kept.hits.Count(), fw2.GetRules()[0].hits.Count())
+
+	fw.unregisterRuleMetrics(fw2)
+	assert.Nil(t, metrics.Get(removed.metric))
+	assert.Nil(t, metrics.Get(dupe.metric))
+	assert.NotNil(t, metrics.Get(kept.metric))
+	metrics.Unregister(kept.metric)
+}
+
+func TestFirewall_DropICMP(t *testing.T) {
+	l := NewTestLogger()
+	ob := &bytes.Buffer{}
+	l.SetOutput(ob)
+
+	myIp := net.IPv4(1, 2, 3, 4)
+	newHost := func(name string, ip net.IP) *HostInfo {
+		c := &cert.NebulaCertificate{
+			Details: cert.NebulaCertificateDetails{
+				Name:           name,
+				Ips:            []*net.IPNet{{IP: ip, Mask: net.IPMask{255, 255, 255, 0}}},
+				InvertedGroups: map[string]struct{}{},
+			},
+		}
+		h := &HostInfo{ConnectionState: &ConnectionState{peerCert: c}, hostId: NewVpnIp(ip)}
+		h.CreateRemoteCIDR(c)
+		return h
+	}
+	them := newHost("them", net.IPv4(1, 2, 3, 5))
+	other := newHost("other", net.IPv4(1, 2, 3, 6))
+
+	build := func(src, dst net.IP, proto int, payload ...byte) []byte {
+		h := ipv4.Header{Len: ipv4.HeaderLen, TotalLen: ipv4.HeaderLen + len(payload), Protocol: proto, Src: src, Dst: dst}
+		b, _ := h.Marshal()
+		return append(b, payload...)
+	}
+	drop := func(fw *Firewall, packet []byte, incoming bool, h *HostInfo) error {
+		fp := FirewallPacket{}
+		assert.NoError(t, newPacket(packet, incoming, &fp))
+		return fw.Drop(packet, fp, incoming, h, cert.NewCAPool(), nil)
+	}
+
+	fw := NewFirewall(l, time.Second, time.Minute, time.Hour, them.ConnectionState.peerCert)
+	fw.localIps.AddCIDR(&net.IPNet{IP: myIp, Mask: net.IPMask{255, 255, 255, 255}}, struct{}{})
+	assert.Nil(t, fw.AddRule(false, fwProtoUDP, 0, 0, []string{"any"}, "", nil, "", ""))
+	assert.Nil(t, fw.AddRule(false, fwProtoICMP, icmpPort(icmpEchoRequest, -1), icmpPort(icmpEchoRequest, -1), []string{"any"}, "", nil, "", ""))
+	assert.Nil(t, fw.AddRule(true, fwProtoICMP, icmpPort(3, 1), icmpPort(3, 1), []string{"any"}, "", nil, "", ""))
+
+	// Only the type and code in the rules are allowed
+	assert.NoError(t, drop(fw, build(myIp, them.hostId.ToIP(), fwProtoICMP, icmpEchoRequest, 0, 0, 0, 0, 7, 0, 1), false, them))
+	assert.Equal(t, ErrNoMatchingRule, drop(fw, build(myIp, them.hostId.ToIP(), fwProtoICMP, 13, 0, 0, 0), false, them))
+	assert.NoError(t, drop(fw, build(them.hostId.ToIP(), myIp, fwProtoICMP, 3, 1, 0, 0), true, them))
+	assert.Equal(t, ErrNoMatchingRule, drop(fw, build(them.hostId.ToIP(), myIp, fwProtoICMP, 3, 2, 0, 0), true, them))
+
+	// Echo replies are tracked by identifier
+	assert.NoError(t, drop(fw, build(them.hostId.ToIP(), myIp, fwProtoICMP, icmpEchoReply, 0, 0, 0, 0, 7, 0, 1), true, them))
+	assert.Equal(t, ErrNoMatchingRule, drop(fw, build(them.hostId.ToIP(), myIp, fwProtoICMP, icmpEchoReply, 0, 0, 0, 0, 8, 0, 1), true, them))
+
+	// Errors about a tracked flow are allowed
+	udp := build(myIp, them.hostId.ToIP(), fwProtoUDP, 0x03, 0xe8, 0, 53, 0, 8, 0, 0)
+	assert.NoError(t, drop(fw, udp, false, them))
+	unreachable := append([]byte{3, 3, 0, 0, 0, 0, 0, 0}, udp...)
+	assert.NoError(t, drop(fw, build(them.hostId.ToIP(), myIp, fwProtoICMP, unreachable...), true, them))
+
+	// But not about a flow we aren't tracking
+	untracked := build(myIp, them.hostId.ToIP(), fwProtoUDP, 0x03, 0xe8, 0, 54, 0, 8, 0, 0)
+	unreachable = append([]byte{3, 3, 0, 0, 0, 0, 0, 0}, untracked...)
+	assert.Equal(t, ErrNoMatchingRule, drop(fw, build(them.hostId.ToIP(), myIp, fwProtoICMP, unreachable...), true, them))
+
+	// Or from a different host
+	unreachable = append([]byte{3, 3, 0, 0, 0, 0, 0, 0}, udp...)
+	assert.Equal(t, ErrNoMatchingRule, drop(fw, build(other.hostId.ToIP(), myIp, fwProtoICMP, unreachable...), true, other))
+}
+
+func TestFirewall_RevalidateHostConntrack(t *testing.T) {
+	l := NewTestLogger()
+	ob := &bytes.Buffer{}
+	l.SetOutput(ob)
+
+	p := FirewallPacket{
+		NewVpnIp(net.IPv4(1, 2, 3, 4)),
+		NewVpnIp(net.IPv4(1, 2, 3, 4)),
+		10,
+		90,
+		fwProtoUDP,
+		false,
+	}
+
+	ipNet := net.IPNet{
+		IP:   net.IPv4(1, 2, 3, 4),
+		Mask: net.IPMask{255, 255, 255, 0},
+	}
+
+	c := cert.NebulaCertificate{
+		Details: cert.NebulaCertificateDetails{
+			Name:           "host1",
+			Ips:            []*net.IPNet{&ipNet},
+			Groups:         []string{"default-group"},
+			InvertedGroups: map[string]struct{}{"default-group": {}},
+			Issuer:         "signer-shasum",
+		},
+	}
+	h := HostInfo{
+		ConnectionState: &ConnectionState{
+			peerCert: &c,
+		},
+		hostId: NewVpnIp(ipNet.IP),
+	}
+	h.CreateRemoteCIDR(&c)
+
+	fw := NewFirewall(l, time.Second, time.Minute, time.Hour, &c)
+	assert.Nil(t, fw.AddRule(true, fwProtoAny, 0, 0, []string{"default-group"}, "", nil, "", ""))
+	cp := cert.NewCAPool()
+
+	// Allow inbound
+	resetConntrack(fw)
+	assert.NoError(t, fw.Drop([]byte{}, p, true, &h, cp, nil))
+
+	// Another host with its own entry
+	other := HostInfo{ConnectionState: &ConnectionState{peerCert: &c}, hostId: NewVpnIp(net.IPv4(1, 2, 3, 5))}
+	op := p
+	op.RemoteIP = other.hostId
+	assert.NoError(t, fw.Drop([]byte{}, op, true, &other, cp, nil))
+
+	// Allow outbound because the conntrack entry still passes the inbound rules
+	fw.RevalidateHostConntrack(h.hostId)
+	assert.NoError(t, fw.Drop([]byte{}, p, false, &h, cp, nil))
+
+	// The peer comes back with a certificate that is no longer in the group
+	nc := c.Copy()
+	nc.Details.Groups = []string{"other-group"}
+	nc.Details.InvertedGroups = map[string]struct{}{"other-group": {}}
+	h.ConnectionState.peerCert = nc
+
+	// Allow outbound because conntrack has not been revalidated
+	assert.NoError(t, fw.Drop([]byte{}, p, false, &h, cp, nil))
+
+	// Only the entries of the host are touched, the rules version stays the same for everyone else
+	version := fw.rulesVersion
+	fw.RevalidateHostConntrack(h.hostId)
+	assert.Equal(t, version, fw.rulesVersion)
+	assert.NotEqual(t, version, fw.Conntrack.Conns[p].rulesVersion)
+	assert.Equal(t, version, fw.Conntrack.Conns[op].rulesVersion)
+
+	// Drop outbound because the new certificate doesn't match the rules
+	assert.Equal(t, fw.Drop([]byte{}, p, false, &h, cp, nil), ErrNoMatchingRule)
+	assert.NoError(t, fw.Drop([]byte{}, op, false, &other, cp, nil))
+}
+
 func BenchmarkLookup(b *testing.B) {
 	ml := func(m map[string]struct{}, a [][]string) {
 		for n := 0; n < b.N; n++ {
@@ -661,7 +1180,7 @@ func TestNewFirewallFromConfig(t *testing.T) {
 	conf = NewConfig(l)
 	conf.Settings["firewall"] = map[interface{}]interface{}{"outbound": []interface{}{map[interface{}]interface{}{}}}
 	_, err = NewFirewallFromConfig(l, c, conf)
-	assert.EqualError(t, err, "firewall.outbound rule #0; at least one of host, group, cidr, ca_name, or ca_sha must be provided")
+	assert.EqualError(t, err, "firewall.outbound rule #0; at least one of host, group, cidr, ca_name, ca_sha, or meta must be provided")
 
 	// Test code/port error
 	conf = NewConfig(l)
@@ -690,6 +1209,63 @@ func TestNewFirewallFromConfig(t *testing.T) {
 	conf.Settings["firewall"] = map[interface{}]interface{}{"inbound": []interface{}{map[interface{}]interface{}{"port": "1", "proto": "any", "group": "a", "groups": []string{"b", "c"}}}}
 	_, err = NewFirewallFromConfig(l, c, conf)
 	assert.EqualError(t, err, "firewall.inbound rule #0; only one of group or groups should be defined, both provided")
+
+	// Test negative conntrack limits
+	conf = NewConfig(l)
+	conf.Settings["firewall"] = map[interface{}]interface{}{"conntrack": map[interface{}]interface{}{"max_connections_per_host": -1}}
+	_, err = NewFirewallFromConfig(l, c, conf)
+	assert.EqualError(t, err, "firewall.conntrack.max_connections and max_connections_per_host can not be negative")
+
+	// Test conntrack limits
+	conf = NewConfig(l)
+	conf.Settings["firewall"] = map[interface{}]interface{}{"conntrack": map[interface{}]interface{}{"max_connections": 10, "max_connections_per_host": 2}}
+	fw, err := NewFirewallFromConfig(l, c, conf)
+	assert.NoError(t, err)
+	assert.Equal(t, 10, fw.maxConnections)
+	assert.Equal(t, 2, fw.maxHostConnections)
+}
+
+func TestFirewall_ConntrackLimits(t *testing.T) {
+	l := NewTestLogger()
+	fw := NewFirewall(l, time.Second, time.Minute, time.Hour, &cert.NebulaCertificate{})
+	fw.maxConnections = 3
+	fw.maxHostConnections = 2
+
+	host1 := NewVpnIp(net.IPv4(1, 2, 3, 4))
+	host2 := NewVpnIp(net.IPv4(1, 2, 3, 5))
+	fp := func(host VpnIp, port uint16) FirewallPacket {
+		return FirewallPacket{RemoteIP: host, LocalPort: port, Protocol: fwProtoUDP}
+	}
+
+	assert.True(t, fw.addConn([]byte{}, fp(host1, 1), true, host1))
+	assert.True(t, fw.addConn([]byte{}, fp(host1, 2), true, host1))
+
+	// host1 is at its limit
+	assert.False(t, fw.addConn([]byte{}, fp(host1, 3), true, host1))
+	assert.NotContains(t, fw.Conntrack.Conns, fp(host1, 3))
+
+	// Existing entries can always be refreshed
+	assert.True(t, fw.addConn([]byte{}, fp(host1, 1), true, host1))
+	assert.Equal(t, 2, fw.Conntrack.hostConns[host1])
+
+	// The table is full after this one
+	assert.True(t, fw.addConn([]byte{}, fp(host2, 1), true, host2))
+	assert.Len(t, fw.Conntrack.Conns, 3)
+
+	// The oldest entry, host1 port 2 since port 1 was refreshed, makes room for the next
+	assert.True(t, fw.addConn([]byte{}, fp(host2, 2), true, host2))
+	assert.Len(t, fw.Conntrack.Conns, 3)
+	assert.NotContains(t, fw.Conntrack.Conns, fp(host1, 2))
+	assert.Contains(t, fw.Conntrack.Conns, fp(host1, 1))
+	assert.Equal(t, 1, fw.Conntrack.hostConns[host1])
+	assert.Equal(t, 2, fw.Conntrack.hostConns[host2])
+
+	// host1 is under its limit again, its own oldest entry makes room this time
+	assert.True(t, fw.addConn([]byte{}, fp(host1, 3), true, host1))
+	assert.NotContains(t, fw.Conntrack.Conns, fp(host1, 1))
+	assert.Equal(t, 1, fw.Conntrack.hostConns[host1])
+	assert.Equal(t, 2, fw.Conntrack.hostConns[host2])
+	assert.Equal(t, 3, fw.Conntrack.order.Len())
 }
 
 func TestAddFirewallRulesFromConfig(t *testing.T) {
@@ -757,6 +1333,87 @@ func TestAddFirewallRulesFromConfig(t *testing.T) {
 	assert.Nil(t, AddFirewallRulesFromConfig(l, true, conf, mf))
 	assert.Equal(t, addRuleCall{incoming: true, proto: fwProtoAny, startPort: 1, endPort: 1, groups: []string{"a", "b"}, ip: nil}, mf.lastCall)
 
+	// Test deny rule
+	conf = NewConfig(l)
+	mf = &mockFirewall{}
+	conf.Settings["firewall"] = map[interface{}]interface{}{"inbound": []interface{}{map[interface{}]interface{}{"action": "deny", "port": "22", "proto": "tcp", "host": "a"}}}
+	assert.Nil(t, AddFirewallRulesFromConfig(l, true, conf, mf))
+	assert.Equal(t, addRuleCall{incoming: true, proto: fwProtoTCP, startPort: 22, endPort: 22, host: "a", opts: FirewallRuleOptions{Deny: true}}, mf.lastCall)
+
+	// Test explicit allow rule
+	conf = NewConfig(l)
+	mf = &mockFirewall{}
+	conf.Settings["firewall"] = map[interface{}]interface{}{"inbound": []interface{}{map[interface{}]interface{}{"action": "allow", "port": "22", "proto": "tcp", "host": "a"}}}
+	assert.Nil(t, AddFirewallRulesFromConfig(l, true, conf, mf))
+	assert.Equal(t, addRuleCall{incoming: true, proto: fwProtoTCP, startPort: 22, endPort: 22, host: "a"}, mf.lastCall)
+
+	// Test rule name and logging
+	conf = NewConfig(l)
+	mf = &mockFirewall{}
+	conf.Settings["firewall"] = map[interface{}]interface{}{"inbound": []interface{}{map[interface{}]interface{}{"name": "ssh", "log": true, "port": "22", "proto": "tcp", "host": "a"}}}
+	assert.Nil(t, AddFirewallRulesFromConfig(l, true, conf, mf))
+	assert.Equal(t, addRuleCall{incoming: true, proto: fwProtoTCP, startPort: 22, endPort: 22, host: "a", opts: FirewallRuleOptions{Name: "ssh", Log: true}}, mf.lastCall)
+
+	// Test certificate metadata
+	conf = NewConfig(l)
+	mf = &mockFirewall{}
+	conf.Settings["firewall"] = map[interface{}]interface{}{"inbound": []interface{}{map[interface{}]interface{}{"port": "22", "proto": "tcp", "meta": map[interface{}]interface{}{"env": "prod", "tier": 1}}}}
+	assert.Nil(t, AddFirewallRulesFromConfig(l, true, conf, mf))
+	assert.Equal(t, addRuleCall{incoming: true, proto: fwProtoTCP, startPort: 22, endPort: 22, opts: FirewallRuleOptions{Metadata: map[string]string{"env": "prod", "tier": "1"}}}, mf.lastCall)
+
+	conf.Settings["firewall"] = map[interface{}]interface{}{"inbound": []interface{}{map[interface{}]interface{}{"port": "22", "proto": "tcp", "meta": "env=prod"}}}
+	assert.EqualError(t, AddFirewallRulesFromConfig(l, true, conf, mf), "firewall.inbound rule #0; meta should be a map of certificate metadata keys to values")
+
+	// Test bad log value
+	conf = NewConfig(l)
+	mf = &mockFirewall{}
+	conf.Settings["firewall"] = map[interface{}]interface{}{"inbound": []interface{}{map[interface{}]interface{}{"log": "sometimes", "port": "22", "proto": "tcp", "host": "a"}}}
+	assert.EqualError(t, AddFirewallRulesFromConfig(l, true, conf, mf), "firewall.inbound rule #0; log should be true or false")
+
+	// Test icmp type and code
+	conf = NewConfig(l)
+	mf = &mockFirewall{}
+	conf.Settings["firewall"] = map[interface{}]interface{}{"inbound": []interface{}{map[interface{}]interface{}{"type": "3", "code": "4", "proto": "icmp", "host": "a"}}}
+	assert.Nil(t, AddFirewallRulesFromConfig(l, true, conf, mf))
+	assert.Equal(t, addRuleCall{incoming: true, proto: fwProtoICMP, startPort: icmpPort(3, 4), endPort: icmpPort(3, 4), host: "a"}, mf.lastCall)
+
+	// Test icmp type with any code
+	conf = NewConfig(l)
+	mf = &mockFirewall{}
+	conf.Settings["firewall"] = map[interface{}]interface{}{"inbound": []interface{}{map[interface{}]interface{}{"type": 8, "port": "any", "proto": "icmp", "host": "a"}}}
+	assert.Nil(t, AddFirewallRulesFromConfig(l, true, conf, mf))
+	assert.Equal(t, addRuleCall{incoming: true, proto: fwProtoICMP, startPort: icmpPort(8, -1), endPort: icmpPort(8, -1), host: "a"}, mf.lastCall)
+
+	// Test icmp any type
+	conf = NewConfig(l)
+	mf = &mockFirewall{}
+	conf.Settings["firewall"] = map[interface{}]interface{}{"inbound": []interface{}{map[interface{}]interface{}{"type": "any", "proto": "icmp", "host": "a"}}}
+	assert.Nil(t, AddFirewallRulesFromConfig(l, true, conf, mf))
+	assert.Equal(t, addRuleCall{incoming: true, proto: fwProtoICMP, startPort: fwPortAny, endPort: fwPortAny, host: "a"}, mf.lastCall)
+
+	// Test type errors
+	conf = NewConfig(l)
+	conf.Settings["firewall"] = map[interface{}]interface{}{"inbound": []interface{}{map[interface{}]interface{}{"type": "8", "proto": "tcp", "host": "a"}}}
+	assert.EqualError(t, AddFirewallRulesFromConfig(l, true, conf, mf), "firewall.inbound rule #0; type and code can only be used with proto icmp")
+
+	conf.Settings["firewall"] = map[interface{}]interface{}{"inbound": []interface{}{map[interface{}]interface{}{"type": "8", "port": "1", "proto": "icmp", "host": "a"}}}
+	assert.EqualError(t, AddFirewallRulesFromConfig(l, true, conf, mf), "firewall.inbound rule #0; port can not be used with type")
+
+	conf.Settings["firewall"] = map[interface{}]interface{}{"inbound": []interface{}{map[interface{}]interface{}{"type": "256", "proto": "icmp", "host": "a"}}}
+	assert.EqualError(t, AddFirewallRulesFromConfig(l, true, conf, mf), "firewall.inbound rule #0; type was not a number between 0 and 255; `256`")
+
+	conf.Settings["firewall"] = map[interface{}]interface{}{"inbound": []interface{}{map[interface{}]interface{}{"type": "3", "code": "x", "proto": "icmp", "host": "a"}}}
+	assert.EqualError(t, AddFirewallRulesFromConfig(l, true, conf, mf), "firewall.inbound rule #0; code was not a number between 0 and 255; `x`")
+
+	conf.Settings["firewall"] = map[interface{}]interface{}{"inbound": []interface{}{map[interface{}]interface{}{"type": "any", "code": "1", "proto": "icmp", "host": "a"}}}
+	assert.EqualError(t, AddFirewallRulesFromConfig(l, true, conf, mf), "firewall.inbound rule #0; code can not be used with type `any`")
+
+	// Test bad action
+	conf = NewConfig(l)
+	mf = &mockFirewall{}
+	conf.Settings["firewall"] = map[interface{}]interface{}{"inbound": []interface{}{map[interface{}]interface{}{"action": "reject", "port": "22", "proto": "tcp", "host": "a"}}}
+	assert.EqualError(t, AddFirewallRulesFromConfig(l, true, conf, mf), "firewall.inbound rule #0; action was not understood; `reject`")
+
 	// Test Add error
 	conf = NewConfig(l)
 	mf = &mockFirewall{}
@@ -902,6 +1559,7 @@ type addRuleCall struct {
 	ip        *net.IPNet
 	caName    string
 	caSha     string
+	opts      FirewallRuleOptions
 }
 
 type mockFirewall struct {
@@ -910,6 +1568,10 @@ type mockFirewall struct {
 }
 
 func (mf *mockFirewall) AddRule(incoming bool, proto uint8, startPort int32, endPort int32, groups []string, host string, ip *net.IPNet, caName string, caSha string) error {
+	return mf.AddRuleWithOptions(incoming, proto, startPort, endPort, groups, host, ip, caName, caSha, FirewallRuleOptions{})
+}
+
+func (mf *mockFirewall) AddRuleWithOptions(incoming bool, proto uint8, startPort int32, endPort int32, groups []string, host string, ip *net.IPNet, caName string, caSha string, opts FirewallRuleOptions) error {
 	mf.lastCall = addRuleCall{
 		incoming:  incoming,
 		proto:     proto,
@@ -920,6 +1582,7 @@ func (mf *mockFirewall) AddRule(incoming bool, proto uint8, startPort int32, end
 		ip:        ip,
 		caName:    caName,
 		caSha:     caSha,
+		opts:      opts,
 	}
 
 	err := mf.nextCallReturn
@@ -929,6 +1592,6 @@ func (mf *mockFirewall) AddRule(incoming bool, proto uint8, startPort int32, end
 
 func resetConntrack(fw *Firewall) {
 	fw.Conntrack.Lock()
-	fw.Conntrack.Conns = map[FirewallPacket]*conn{}
+	fw.Conntrack.unlockedReset()
 	fw.Conntrack.Unlock()
 }
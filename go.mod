@@ -3,6 +3,7 @@ module github.com/slackhq/nebula
 go 1.16
 
 require (
+	filippo.io/edwards25519 v1.0.0
 	github.com/anmitsu/go-shlex v0.0.0-20161002113705-648efa622239
 	github.com/armon/go-radix v1.0.0
 	github.com/cespare/xxhash/v2 v2.1.1 // indirect
@@ -16,6 +17,7 @@ require (
 	github.com/kardianos/service v1.1.0
 	github.com/konsorten/go-windows-terminal-sequences v1.0.2 // indirect
 	github.com/miekg/dns v1.1.25
+	github.com/miekg/pkcs11 v1.1.1
 	github.com/nbrownus/go-metrics-prometheus v0.0.0-20180622211546-6e6d5173d99c
 	github.com/prometheus/client_golang v1.2.1
 	github.com/prometheus/client_model v0.0.0-20191202183732-d1d2010b5bee // indirect
@@ -30,6 +32,7 @@ require (
 	golang.org/x/crypto v0.0.0-20210322153248-0c34fe9e7dc2
 	golang.org/x/net v0.0.0-20210226172049-e18ecbb05110
 	golang.org/x/sys v0.0.0-20201119102817-f84b799fce68
+	golang.org/x/term v0.0.0-20201126162022-7de9c90e9dd1
 	google.golang.org/protobuf v1.26.0
 	gopkg.in/yaml.v2 v2.2.7
 )
@@ -3,22 +3,25 @@ package nebula
 const (
 	handshakeIXPSK0 = 0
 	handshakeXXPSK0 = 1
+	// handshakeIXPQ is IX with an ML-KEM key exchange carried in the handshake details
+	handshakeIXPQ = 2
 )
 
-func HandleIncomingHandshake(f *Interface, addr *udpAddr, packet []byte, h *Header, hostinfo *HostInfo) {
-	if !f.lightHouse.remoteAllowList.Allow(addr.IP) {
+func HandleIncomingHandshake(f *Interface, addr *udpAddr, via *ViaSender, packet []byte, h *Header, hostinfo *HostInfo) {
+	// Relayed handshakes have no address to check, the relay already allowed the sender
+	if addr != nil && !f.lightHouse.remoteAllowList.Allow(addr.IP) {
 		f.l.WithField("udpAddr", addr).Debug("lighthouse.remote_allow_list denied incoming handshake")
 		return
 	}
 
 	switch h.Subtype {
-	case handshakeIXPSK0:
+	case handshakeIXPSK0, handshakeIXPQ:
 		switch h.MessageCounter {
 		case 1:
-			ixHandshakeStage1(f, addr, packet, h)
+			ixHandshakeStage1(f, addr, via, packet, h)
 		case 2:
 			newHostinfo, _ := f.handshakeManager.QueryIndex(h.RemoteIndex)
-			tearDown := ixHandshakeStage2(f, addr, newHostinfo, packet, h)
+			tearDown := ixHandshakeStage2(f, addr, via, newHostinfo, packet, h)
 			if tearDown && newHostinfo != nil {
 				f.handshakeManager.DeleteHostInfo(newHostinfo)
 			}
@@ -16,6 +16,10 @@ const (
 	DefaultHandshakeTryInterval   = time.Millisecond * 100
 	DefaultHandshakeRetries       = 10
 	DefaultHandshakeTriggerBuffer = 64
+	DefaultUseRelays              = true
+
+	// handshakeRelayAfter is the number of direct handshake attempts made before relays are tried as well
+	handshakeRelayAfter = 2
 )
 
 var (
@@ -23,6 +27,8 @@ var (
 		tryInterval:   DefaultHandshakeTryInterval,
 		retries:       DefaultHandshakeRetries,
 		triggerBuffer: DefaultHandshakeTriggerBuffer,
+		useRelays:     DefaultUseRelays,
+		rekeyGrace:    DefaultRekeyGrace,
 	}
 )
 
@@ -30,8 +36,12 @@ type HandshakeConfig struct {
 	tryInterval   time.Duration
 	retries       int
 	triggerBuffer int
+	useRelays     bool
+	// rekeyGrace is how long a tunnel that was replaced by a new handshake still accepts packets
+	rekeyGrace time.Duration
 
 	messageMetrics *MessageMetrics
+	tcp            *tcpTransport
 }
 
 type HandshakeManager struct {
@@ -47,17 +57,17 @@ type HandshakeManager struct {
 	l                      *logrus.Logger
 
 	// can be used to trigger outbound handshake for the given vpnIP
-	trigger chan uint32
+	trigger chan VpnIp
 }
 
-func NewHandshakeManager(l *logrus.Logger, tunCidr *net.IPNet, preferredRanges []*net.IPNet, mainHostMap *HostMap, lightHouse *LightHouse, outside *udpConn, config HandshakeConfig) *HandshakeManager {
+func NewHandshakeManager(l *logrus.Logger, tunCidrs []*net.IPNet, preferredRanges []*net.IPNet, mainHostMap *HostMap, lightHouse *LightHouse, outside *udpConn, config HandshakeConfig) *HandshakeManager {
 	return &HandshakeManager{
-		pendingHostMap:         NewHostMap(l, "pending", tunCidr, preferredRanges),
+		pendingHostMap:         NewHostMap(l, "pending", tunCidrs, preferredRanges),
 		mainHostMap:            mainHostMap,
 		lightHouse:             lightHouse,
 		outside:                outside,
 		config:                 config,
-		trigger:                make(chan uint32, config.triggerBuffer),
+		trigger:                make(chan VpnIp, config.triggerBuffer),
 		OutboundHandshakeTimer: NewSystemTimerWheel(config.tryInterval, hsTimeout(config.retries, config.tryInterval)),
 		messageMetrics:         config.messageMetrics,
 		metricInitiated:        metrics.GetOrRegisterCounter("handshake_manager.initiated", nil),
@@ -71,7 +81,7 @@ func (c *HandshakeManager) Run(f EncWriter) {
 	for {
 		select {
 		case vpnIP := <-c.trigger:
-			c.l.WithField("vpnIp", IntIp(vpnIP)).Debug("HandshakeManager: triggered")
+			c.l.WithField("vpnIp", vpnIP).Debug("HandshakeManager: triggered")
 			c.handleOutbound(vpnIP, f, true)
 		case now := <-clockSource:
 			c.NextOutboundHandshakeTimerTick(now, f)
@@ -86,12 +96,12 @@ func (c *HandshakeManager) NextOutboundHandshakeTimerTick(now time.Time, f EncWr
 		if ep == nil {
 			break
 		}
-		vpnIP := ep.(uint32)
+		vpnIP := ep.(VpnIp)
 		c.handleOutbound(vpnIP, f, false)
 	}
 }
 
-func (c *HandshakeManager) handleOutbound(vpnIP uint32, f EncWriter, lighthouseTriggered bool) {
+func (c *HandshakeManager) handleOutbound(vpnIP VpnIp, f EncWriter, lighthouseTriggered bool) {
 	hostinfo, err := c.pendingHostMap.QueryVpnIP(vpnIP)
 	if err != nil {
 		return
@@ -153,7 +163,7 @@ func (c *HandshakeManager) handleOutbound(vpnIP uint32, f EncWriter, lighthouseT
 	var sentTo []*udpAddr
 	hostinfo.remotes.ForEach(c.pendingHostMap.preferredRanges, func(addr *udpAddr, _ bool) {
 		c.messageMetrics.Tx(handshake, NebulaMessageSubType(hostinfo.HandshakePacket[0][1]), 1)
-		err = c.outside.WriteTo(hostinfo.HandshakePacket[0], addr)
+		err = c.sendHandshake(hostinfo, addr)
 		if err != nil {
 			hostinfo.logger(c.l).WithField("udpAddr", addr).
 				WithField("initiatorIndex", hostinfo.localIndexId).
@@ -173,6 +183,11 @@ func (c *HandshakeManager) handleOutbound(vpnIP uint32, f EncWriter, lighthouseT
 			Info("Handshake message sent")
 	}
 
+	// Fall back to relays if we have no way to reach the host directly or direct attempts have not been answered
+	if c.config.useRelays && (len(sentTo) == 0 || hostinfo.HandshakeCounter >= handshakeRelayAfter) {
+		c.handleOutboundRelays(vpnIP, hostinfo, f)
+	}
+
 	// Increment the counter to increase our delay, linear backoff
 	hostinfo.HandshakeCounter++
 
@@ -183,7 +198,82 @@ func (c *HandshakeManager) handleOutbound(vpnIP uint32, f EncWriter, lighthouseT
 	}
 }
 
-func (c *HandshakeManager) AddVpnIP(vpnIP uint32) *HostInfo {
+// sendHandshake sends the first handshake packet to addr. It goes over tcp if we are connected to addr, tcp only
+// remotes are connected to with the packet in hand, and once udp has gone unanswered long enough tcp is tried as well.
+// It assumes the hostinfo lock is held
+func (c *HandshakeManager) sendHandshake(hostinfo *HostInfo, addr *udpAddr) error {
+	tcp := c.config.tcp
+	if ok, err := tcp.writeTo(hostinfo.HandshakePacket[0], addr); ok {
+		return err
+	}
+
+	if tcp != nil && hostinfo.remotes.IsTCP(addr) {
+		tcp.connect(addr, hostinfo.HandshakePacket[0])
+		return nil
+	}
+
+	if tcp.fallback(hostinfo.HandshakeCounter) {
+		tcp.connect(addr, hostinfo.HandshakePacket[0])
+	}
+
+	return c.outside.WriteTo(hostinfo.HandshakePacket[0], addr)
+}
+
+// handleOutboundRelays sends the handshake through every established relay for vpnIP and asks the others to set up a
+// relay for us. It assumes the hostinfo lock is held
+func (c *HandshakeManager) handleOutboundRelays(vpnIP VpnIp, hostinfo *HostInfo, f EncWriter) {
+	for _, relayIp := range hostinfo.remotes.CopyRelays() {
+		if relayIp == vpnIP || relayIp == c.lightHouse.myVpnIp {
+			continue
+		}
+
+		relayHostInfo, err := c.mainHostMap.QueryVpnIP(relayIp)
+		if err != nil || relayHostInfo.remote == nil {
+			// We need a direct tunnel with the relay before it can help us
+			hostinfo.logger(c.l).WithField("relay", relayIp).Debug("Establishing a tunnel with the relay")
+			f.Handshake(relayIp)
+			continue
+		}
+
+		relay, ok := relayHostInfo.relayState.QueryRelayForByIp(vpnIP)
+		if !ok {
+			relay, err = c.mainHostMap.AddRelay(relayHostInfo, vpnIP, 0, relayTerminal, relayRequested)
+			if err != nil {
+				hostinfo.logger(c.l).WithField("relay", relayIp).WithError(err).Error("Failed to allocate a relay index")
+				continue
+			}
+		}
+
+		if relay.State == relayEstablished {
+			c.messageMetrics.Tx(handshake, NebulaMessageSubType(hostinfo.HandshakePacket[0][1]), 1)
+			f.SendVia(relayHostInfo, relay, hostinfo.HandshakePacket[0], make([]byte, 12, 12), make([]byte, mtu))
+			hostinfo.logger(c.l).WithField("relay", relayIp).
+				WithField("initiatorIndex", hostinfo.localIndexId).
+				WithField("handshake", m{"stage": 1, "style": "ix_psk0"}).
+				Info("Handshake message sent")
+			continue
+		}
+
+		// Keep asking until the relay answers, requests are idempotent on the relay
+		req := NebulaControl{
+			Type:                NebulaControl_CreateRelayRequest,
+			InitiatorRelayIndex: relay.LocalIndex,
+			RelayFromIp:         NewVpnAddr(c.lightHouse.myVpnIp),
+			RelayToIp:           NewVpnAddr(vpnIP),
+		}
+		b, err := req.Marshal()
+		if err != nil {
+			hostinfo.logger(c.l).WithField("relay", relayIp).WithError(err).Error("Failed to marshal relay request")
+			continue
+		}
+
+		f.SendMessageToVpnIp(control, 0, relayIp, b, make([]byte, 12, 12), make([]byte, mtu))
+		hostinfo.logger(c.l).WithField("relay", relayIp).WithField("relayIndex", relay.LocalIndex).
+			Info("Sent relay request")
+	}
+}
+
+func (c *HandshakeManager) AddVpnIP(vpnIP VpnIp) *HostInfo {
 	hostinfo := c.pendingHostMap.AddVpnIP(vpnIP)
 	// We lock here and use an array to insert items to prevent locking the
 	// main receive thread for very long by waiting to add items to the pending map
@@ -251,7 +341,7 @@ func (c *HandshakeManager) CheckAndComplete(hostinfo *HostInfo, handshakePacket
 		// We have a collision, but this can happen since we can't control
 		// the remote ID. Just log about the situation as a note.
 		hostinfo.logger(c.l).
-			WithField("remoteIndex", hostinfo.remoteIndexId).WithField("collision", IntIp(existingRemoteIndex.hostId)).
+			WithField("remoteIndex", hostinfo.remoteIndexId).WithField("collision", existingRemoteIndex.hostId).
 			Info("New host shadows existing host remoteIndex")
 	}
 
@@ -272,10 +362,7 @@ func (c *HandshakeManager) CheckAndComplete(hostinfo *HostInfo, handshakePacket
 	}
 
 	if existingHostInfo != nil {
-		// We are going to overwrite this entry, so remove the old references
-		delete(c.mainHostMap.Hosts, existingHostInfo.hostId)
-		delete(c.mainHostMap.Indexes, existingHostInfo.localIndexId)
-		delete(c.mainHostMap.RemoteIndexes, existingHostInfo.remoteIndexId)
+		c.unlockedReplaceHostInfo(existingHostInfo, hostinfo, f)
 	}
 
 	c.mainHostMap.addHostInfo(hostinfo, f)
@@ -293,10 +380,7 @@ func (c *HandshakeManager) Complete(hostinfo *HostInfo, f *Interface) {
 
 	existingHostInfo, found := c.mainHostMap.Hosts[hostinfo.hostId]
 	if found && existingHostInfo != nil {
-		// We are going to overwrite this entry, so remove the old references
-		delete(c.mainHostMap.Hosts, existingHostInfo.hostId)
-		delete(c.mainHostMap.Indexes, existingHostInfo.localIndexId)
-		delete(c.mainHostMap.RemoteIndexes, existingHostInfo.remoteIndexId)
+		c.unlockedReplaceHostInfo(existingHostInfo, hostinfo, f)
 	}
 
 	existingRemoteIndex, found := c.mainHostMap.RemoteIndexes[hostinfo.remoteIndexId]
@@ -304,7 +388,7 @@ func (c *HandshakeManager) Complete(hostinfo *HostInfo, f *Interface) {
 		// We have a collision, but this can happen since we can't control
 		// the remote ID. Just log about the situation as a note.
 		hostinfo.logger(c.l).
-			WithField("remoteIndex", hostinfo.remoteIndexId).WithField("collision", IntIp(existingRemoteIndex.hostId)).
+			WithField("remoteIndex", hostinfo.remoteIndexId).WithField("collision", existingRemoteIndex.hostId).
 			Info("New host shadows existing host remoteIndex")
 	}
 
@@ -312,6 +396,27 @@ func (c *HandshakeManager) Complete(hostinfo *HostInfo, f *Interface) {
 	c.pendingHostMap.unlockedDeleteHostInfo(hostinfo)
 }
 
+// unlockedReplaceHostInfo removes the references to an existing tunnel that hostinfo is about to replace. Relays
+// running over the old tunnel move to the new one and, if the peer changed certificates, the firewall re-checks the
+// conntrack entries of that peer against the new one. The old local index is retired rather than deleted so packets still in flight
+// with the old keys are not lost. It assumes you have the main hostmap write lock
+func (c *HandshakeManager) unlockedReplaceHostInfo(existing, hostinfo *HostInfo, f *Interface) {
+	delete(c.mainHostMap.Hosts, existing.hostId)
+	c.mainHostMap.unlockedRetireIndex(existing, c.config.rekeyGrace)
+	delete(c.mainHostMap.RemoteIndexes, existing.remoteIndexId)
+	c.mainHostMap.unlockedMoveRelays(existing, hostinfo)
+
+	if f == nil || f.firewall == nil || existing.ConnectionState == nil || hostinfo.ConnectionState == nil {
+		return
+	}
+
+	oldCert, newCert := existing.ConnectionState.peerCert, hostinfo.ConnectionState.peerCert
+	if oldCert != nil && newCert != nil && !bytes.Equal(oldCert.Signature, newCert.Signature) {
+		hostinfo.logger(c.l).WithField("certName", newCert.Details.Name).Info("Peer presented a new certificate")
+		f.firewall.RevalidateHostConntrack(hostinfo.hostId)
+	}
+}
+
 // AddIndexHostInfo generates a unique localIndexId for this HostInfo
 // and adds it to the pendingHostMap. Will error if we are unable to generate
 // a unique localIndexId
@@ -13,12 +13,12 @@ func Test_NewHandshakeManagerVpnIP(t *testing.T) {
 	_, tuncidr, _ := net.ParseCIDR("172.1.1.1/24")
 	_, vpncidr, _ := net.ParseCIDR("172.1.1.1/24")
 	_, localrange, _ := net.ParseCIDR("10.1.1.1/24")
-	ip := ip2int(net.ParseIP("172.1.1.2"))
+	ip := NewVpnIp(net.ParseIP("172.1.1.2"))
 	preferredRanges := []*net.IPNet{localrange}
 	mw := &mockEncWriter{}
-	mainHM := NewHostMap(l, "test", vpncidr, preferredRanges)
+	mainHM := NewHostMap(l, "test", []*net.IPNet{vpncidr}, preferredRanges)
 
-	blah := NewHandshakeManager(l, tuncidr, preferredRanges, mainHM, &LightHouse{}, &udpConn{}, defaultHandshakeConfig)
+	blah := NewHandshakeManager(l, []*net.IPNet{tuncidr}, preferredRanges, mainHM, &LightHouse{}, &udpConn{}, defaultHandshakeConfig)
 
 	now := time.Now()
 	blah.NextOutboundHandshakeTimerTick(now, mw)
@@ -54,13 +54,13 @@ func Test_NewHandshakeManagerTrigger(t *testing.T) {
 	_, tuncidr, _ := net.ParseCIDR("172.1.1.1/24")
 	_, vpncidr, _ := net.ParseCIDR("172.1.1.1/24")
 	_, localrange, _ := net.ParseCIDR("10.1.1.1/24")
-	ip := ip2int(net.ParseIP("172.1.1.2"))
+	ip := NewVpnIp(net.ParseIP("172.1.1.2"))
 	preferredRanges := []*net.IPNet{localrange}
 	mw := &mockEncWriter{}
-	mainHM := NewHostMap(l, "test", vpncidr, preferredRanges)
-	lh := &LightHouse{addrMap: make(map[uint32]*RemoteList), l: l}
+	mainHM := NewHostMap(l, "test", []*net.IPNet{vpncidr}, preferredRanges)
+	lh := &LightHouse{addrMap: make(map[VpnIp]*RemoteList), l: l}
 
-	blah := NewHandshakeManager(l, tuncidr, preferredRanges, mainHM, lh, &udpConn{}, defaultHandshakeConfig)
+	blah := NewHandshakeManager(l, []*net.IPNet{tuncidr}, preferredRanges, mainHM, lh, &udpConn{}, defaultHandshakeConfig)
 
 	now := time.Now()
 	blah.NextOutboundHandshakeTimerTick(now, mw)
@@ -103,6 +103,50 @@ func testCountTimerWheelEntries(tw *SystemTimerWheel) (c int) {
 type mockEncWriter struct {
 }
 
-func (mw *mockEncWriter) SendMessageToVpnIp(t NebulaMessageType, st NebulaMessageSubType, vpnIp uint32, p, nb, out []byte) {
+func (mw *mockEncWriter) SendMessageToVpnIp(t NebulaMessageType, st NebulaMessageSubType, vpnIp VpnIp, p, nb, out []byte) {
 	return
 }
+
+func (mw *mockEncWriter) SendVia(via *HostInfo, relay Relay, ad, nb, out []byte) {
+	return
+}
+
+func (mw *mockEncWriter) Handshake(vpnIp VpnIp) {}
+
+func Test_HandshakeManagerRetiresReplacedIndex(t *testing.T) {
+	l := NewTestLogger()
+	_, vpncidr, _ := net.ParseCIDR("172.1.1.1/24")
+	ip := NewVpnIp(net.ParseIP("172.1.1.2"))
+	mainHM := NewHostMap(l, "test", []*net.IPNet{vpncidr}, []*net.IPNet{})
+
+	config := defaultHandshakeConfig
+	config.rekeyGrace = time.Millisecond * 50
+	hm := NewHandshakeManager(l, []*net.IPNet{vpncidr}, []*net.IPNet{}, mainHM, &LightHouse{}, &udpConn{}, config)
+	f := &Interface{}
+
+	old := &HostInfo{hostId: ip, localIndexId: 1, remoteIndexId: 2, ConnectionState: &ConnectionState{}}
+	mainHM.Lock()
+	mainHM.addHostInfo(old, f)
+	mainHM.Unlock()
+
+	hostinfo := &HostInfo{hostId: ip, localIndexId: 3, remoteIndexId: 4, ConnectionState: &ConnectionState{}}
+	hm.Complete(hostinfo, f)
+
+	// Packets sent with the old keys still find their tunnel for a little while
+	h, err := mainHM.QueryVpnIP(ip)
+	assert.NoError(t, err)
+	assert.Equal(t, hostinfo, h)
+	h, err = mainHM.QueryIndex(1)
+	assert.NoError(t, err)
+	assert.Equal(t, old, h)
+	assert.NotContains(t, mainHM.RemoteIndexes, uint32(2))
+
+	assert.Eventually(t, func() bool {
+		_, err := mainHM.QueryIndex(1)
+		return err != nil
+	}, time.Second, time.Millisecond*10)
+
+	h, err = mainHM.QueryIndex(3)
+	assert.NoError(t, err)
+	assert.Equal(t, hostinfo, h)
+}
@@ -38,6 +38,9 @@ const (
 	//TODO These are deprecated as of 06/12/2018 - NB
 	testRemote      NebulaMessageType = 6
 	testRemoteReply NebulaMessageType = 7
+
+	control   NebulaMessageType = 8
+	pathCheck NebulaMessageType = 9
 )
 
 var typeMap = map[NebulaMessageType]string{
@@ -51,6 +54,9 @@ var typeMap = map[NebulaMessageType]string{
 	//TODO These are deprecated as of 06/12/2018 - NB
 	testRemote:      "testRemote",
 	testRemoteReply: "testRemoteReply",
+
+	control:   "control",
+	pathCheck: "pathCheck",
 }
 
 const (
@@ -58,6 +64,16 @@ const (
 	testReply   NebulaMessageSubType = 1
 )
 
+const (
+	pathCheckRequest NebulaMessageSubType = 0
+	pathCheckReply   NebulaMessageSubType = 1
+)
+
+const (
+	messageNone  NebulaMessageSubType = 0
+	messageRelay NebulaMessageSubType = 1
+)
+
 var eHeaderTooShort = errors.New("header is too short")
 
 var subTypeTestMap = map[NebulaMessageSubType]string{
@@ -65,20 +81,34 @@ var subTypeTestMap = map[NebulaMessageSubType]string{
 	testReply:   "testReply",
 }
 
+var subTypePathCheckMap = map[NebulaMessageSubType]string{
+	pathCheckRequest: "pathCheckRequest",
+	pathCheckReply:   "pathCheckReply",
+}
+
+var subTypeMessageMap = map[NebulaMessageSubType]string{
+	messageNone:  "none",
+	messageRelay: "relay",
+}
+
 var subTypeNoneMap = map[NebulaMessageSubType]string{0: "none"}
 
 var subTypeMap = map[NebulaMessageType]*map[NebulaMessageSubType]string{
-	message:     &subTypeNoneMap,
+	message:     &subTypeMessageMap,
 	recvError:   &subTypeNoneMap,
 	lightHouse:  &subTypeNoneMap,
 	test:        &subTypeTestMap,
 	closeTunnel: &subTypeNoneMap,
 	handshake: {
 		handshakeIXPSK0: "ix_psk0",
+		handshakeIXPQ:   "ix_pq",
 	},
 	//TODO: these are deprecated
 	testRemote:      &subTypeNoneMap,
 	testRemoteReply: &subTypeNoneMap,
+
+	control:   &subTypeNoneMap,
+	pathCheck: &subTypePathCheckMap,
 }
 
 type Header struct {
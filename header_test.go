@@ -71,6 +71,8 @@ func TestSubTypeName(t *testing.T) {
 
 	assert.Equal(t, "none", SubTypeName(message, 0))
 	assert.Equal(t, "none", (&Header{Type: message, Subtype: 0}).SubTypeName())
+
+	assert.Equal(t, "relay", SubTypeName(message, messageRelay))
 }
 
 func TestTypeMap(t *testing.T) {
@@ -84,19 +86,24 @@ func TestTypeMap(t *testing.T) {
 		closeTunnel:     "closeTunnel",
 		testRemote:      "testRemote",
 		testRemoteReply: "testRemoteReply",
+		control:         "control",
+		pathCheck:       "pathCheck",
 	}, typeMap)
 
 	assert.Equal(t, map[NebulaMessageType]*map[NebulaMessageSubType]string{
-		message:     &subTypeNoneMap,
+		message:     &subTypeMessageMap,
 		recvError:   &subTypeNoneMap,
 		lightHouse:  &subTypeNoneMap,
 		test:        &subTypeTestMap,
 		closeTunnel: &subTypeNoneMap,
 		handshake: {
 			handshakeIXPSK0: "ix_psk0",
+			handshakeIXPQ:   "ix_pq",
 		},
 		testRemote:      &subTypeNoneMap,
 		testRemoteReply: &subTypeNoneMap,
+		control:         &subTypeNoneMap,
+		pathCheck:       &subTypePathCheckMap,
 	}, subTypeMap)
 }
 
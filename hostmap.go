@@ -27,12 +27,19 @@ type HostMap struct {
 	name            string
 	Indexes         map[uint32]*HostInfo
 	RemoteIndexes   map[uint32]*HostInfo
-	Hosts           map[uint32]*HostInfo
+	Hosts           map[VpnIp]*HostInfo
+	Relays          map[uint32]*HostInfo // Maps a relay index to the tunnel the relay runs over
 	preferredRanges []*net.IPNet
-	vpnCIDR         *net.IPNet
-	unsafeRoutes    *CIDRTree
+	vpnCIDRs        []*net.IPNet
+	unsafeRoutes    *CIDR6Tree
 	metricsEnabled  bool
 	l               *logrus.Logger
+
+	// aliases maps the secondary vpn ips of a peer certificate to the tunnel established under its primary vpn ip
+	aliases map[VpnIp]*HostInfo
+
+	// tunnelMetrics is only set on the main hostmap and only when per tunnel metrics are enabled
+	tunnelMetrics *tunnelMetrics
 }
 
 type HostInfo struct {
@@ -50,9 +57,9 @@ type HostInfo struct {
 	packetStore       []*cachedPacket  //todo: this is other handshake manager entry
 	remoteIndexId     uint32
 	localIndexId      uint32
-	hostId            uint32
+	hostId            VpnIp
 	recvError         int
-	remoteCidr        *CIDRTree
+	remoteCidr        *CIDR6Tree
 
 	// lastRebindCount is the other side of Interface.rebindCount, if these values don't match then we need to ask LH
 	// for a punch from the remote end of this tunnel. The goal being to prime their conntrack for our traffic just like
@@ -66,6 +73,152 @@ type HostInfo struct {
 
 	lastRoam       time.Time
 	lastRoamRemote *udpAddr
+
+	// relayState tracks the relays that run over this tunnel as well as the relays that can be used to reach this host
+	relayState RelayState
+
+	// stats is nil unless per tunnel metrics are enabled and this tunnel is being tracked
+	stats *tunnelStats
+
+	// paths is nil unless multipath is enabled
+	paths *hostPaths
+}
+
+// Relay types
+const (
+	relayTerminal   = 0 // We are one of the two ends of the relay
+	relayForwarding = 1 // We are forwarding packets between the two ends
+)
+
+// Relay states
+const (
+	relayRequested   = 0
+	relayEstablished = 1
+)
+
+// Relay is one leg of a relayed connection, it is stored on the HostInfo of the tunnel the leg runs over
+type Relay struct {
+	Type        int
+	State       int
+	LocalIndex  uint32
+	RemoteIndex uint32
+	// PeerIp is the vpn ip on the other side of the relay
+	PeerIp VpnIp
+}
+
+type RelayState struct {
+	sync.RWMutex
+
+	// relays are the vpn ips of the hosts we can use to relay packets to this host
+	relays map[VpnIp]struct{}
+
+	// relayForByIp and relayForByIdx hold the relays that run over this tunnel, by the peer vpn ip and our local index
+	relayForByIp  map[VpnIp]*Relay
+	relayForByIdx map[uint32]*Relay
+}
+
+// InsertRelayTo records that this host can be reached through the relay at relayIp
+func (rs *RelayState) InsertRelayTo(relayIp VpnIp) {
+	rs.Lock()
+	defer rs.Unlock()
+	if rs.relays == nil {
+		rs.relays = map[VpnIp]struct{}{}
+	}
+	rs.relays[relayIp] = struct{}{}
+}
+
+// CopyRelayIps returns the vpn ips of the relays this host can be reached through
+func (rs *RelayState) CopyRelayIps() []VpnIp {
+	rs.RLock()
+	defer rs.RUnlock()
+	ret := make([]VpnIp, 0, len(rs.relays))
+	for ip := range rs.relays {
+		ret = append(ret, ip)
+	}
+	return ret
+}
+
+// CopyRelayFor returns a copy of every relay running over this tunnel
+func (rs *RelayState) CopyRelayFor() []Relay {
+	rs.RLock()
+	defer rs.RUnlock()
+	ret := make([]Relay, 0, len(rs.relayForByIdx))
+	for _, r := range rs.relayForByIdx {
+		ret = append(ret, *r)
+	}
+	return ret
+}
+
+func (rs *RelayState) QueryRelayForByIp(vpnIp VpnIp) (Relay, bool) {
+	rs.RLock()
+	defer rs.RUnlock()
+	r, ok := rs.relayForByIp[vpnIp]
+	if !ok {
+		return Relay{}, false
+	}
+	return *r, true
+}
+
+func (rs *RelayState) QueryRelayForByIdx(idx uint32) (Relay, bool) {
+	rs.RLock()
+	defer rs.RUnlock()
+	r, ok := rs.relayForByIdx[idx]
+	if !ok {
+		return Relay{}, false
+	}
+	return *r, true
+}
+
+// insertRelay adds a relay that runs over this tunnel
+func (rs *RelayState) insertRelay(r *Relay) {
+	rs.Lock()
+	defer rs.Unlock()
+	if rs.relayForByIp == nil {
+		rs.relayForByIp = map[VpnIp]*Relay{}
+		rs.relayForByIdx = map[uint32]*Relay{}
+	}
+	rs.relayForByIp[r.PeerIp] = r
+	rs.relayForByIdx[r.LocalIndex] = r
+}
+
+// EstablishRelay marks the relay with our local index as established and records the index the other side chose
+func (rs *RelayState) EstablishRelay(localIdx, remoteIdx uint32) (Relay, bool) {
+	return rs.UpdateRelayForByIdx(localIdx, remoteIdx, relayEstablished)
+}
+
+// UpdateRelayForByIdx records the index the other side chose and the state for the relay with our local index
+func (rs *RelayState) UpdateRelayForByIdx(localIdx, remoteIdx uint32, state int) (Relay, bool) {
+	rs.Lock()
+	defer rs.Unlock()
+	r, ok := rs.relayForByIdx[localIdx]
+	if !ok {
+		return Relay{}, false
+	}
+	r.RemoteIndex = remoteIdx
+	r.State = state
+	return *r, true
+}
+
+// UpdateRelayForByIpState changes the state of the relay to vpnIp, if we have one
+func (rs *RelayState) UpdateRelayForByIpState(vpnIp VpnIp, state int) {
+	rs.Lock()
+	defer rs.Unlock()
+	if r, ok := rs.relayForByIp[vpnIp]; ok {
+		r.State = state
+	}
+}
+
+// DeleteRelay removes the relay to vpnIp that runs over this tunnel, returning it if it existed
+func (rs *RelayState) DeleteRelay(vpnIp VpnIp) (Relay, bool) {
+	rs.Lock()
+	defer rs.Unlock()
+	r, ok := rs.relayForByIp[vpnIp]
+	if !ok {
+		return Relay{}, false
+	}
+	delete(rs.relayForByIp, vpnIp)
+	delete(rs.relayForByIdx, r.LocalIndex)
+	return *r, true
 }
 
 type cachedPacket struct {
@@ -82,18 +235,21 @@ type cachedPacketMetrics struct {
 	dropped metrics.Counter
 }
 
-func NewHostMap(l *logrus.Logger, name string, vpnCIDR *net.IPNet, preferredRanges []*net.IPNet) *HostMap {
-	h := map[uint32]*HostInfo{}
+func NewHostMap(l *logrus.Logger, name string, vpnCIDRs []*net.IPNet, preferredRanges []*net.IPNet) *HostMap {
+	h := map[VpnIp]*HostInfo{}
 	i := map[uint32]*HostInfo{}
 	r := map[uint32]*HostInfo{}
+	relays := map[uint32]*HostInfo{}
 	m := HostMap{
 		name:            name,
 		Indexes:         i,
 		RemoteIndexes:   r,
 		Hosts:           h,
+		Relays:          relays,
 		preferredRanges: preferredRanges,
-		vpnCIDR:         vpnCIDR,
-		unsafeRoutes:    NewCIDRTree(),
+		vpnCIDRs:        vpnCIDRs,
+		unsafeRoutes:    NewCIDR6Tree(),
+		aliases:         map[VpnIp]*HostInfo{},
 		l:               l,
 	}
 	return &m
@@ -105,14 +261,16 @@ func (hm *HostMap) EmitStats(name string) {
 	hostLen := len(hm.Hosts)
 	indexLen := len(hm.Indexes)
 	remoteIndexLen := len(hm.RemoteIndexes)
+	relaysLen := len(hm.Relays)
 	hm.RUnlock()
 
 	metrics.GetOrRegisterGauge("hostmap."+name+".hosts", nil).Update(int64(hostLen))
 	metrics.GetOrRegisterGauge("hostmap."+name+".indexes", nil).Update(int64(indexLen))
 	metrics.GetOrRegisterGauge("hostmap."+name+".remoteIndexes", nil).Update(int64(remoteIndexLen))
+	metrics.GetOrRegisterGauge("hostmap."+name+".relayIndexes", nil).Update(int64(relaysLen))
 }
 
-func (hm *HostMap) GetIndexByVpnIP(vpnIP uint32) (uint32, error) {
+func (hm *HostMap) GetIndexByVpnIP(vpnIP VpnIp) (uint32, error) {
 	hm.RLock()
 	if i, ok := hm.Hosts[vpnIP]; ok {
 		index := i.localIndexId
@@ -123,13 +281,13 @@ func (hm *HostMap) GetIndexByVpnIP(vpnIP uint32) (uint32, error) {
 	return 0, errors.New("vpn IP not found")
 }
 
-func (hm *HostMap) Add(ip uint32, hostinfo *HostInfo) {
+func (hm *HostMap) Add(ip VpnIp, hostinfo *HostInfo) {
 	hm.Lock()
 	hm.Hosts[ip] = hostinfo
 	hm.Unlock()
 }
 
-func (hm *HostMap) AddVpnIP(vpnIP uint32) *HostInfo {
+func (hm *HostMap) AddVpnIP(vpnIP VpnIp) *HostInfo {
 	h := &HostInfo{}
 	hm.RLock()
 	if _, ok := hm.Hosts[vpnIP]; !ok {
@@ -150,16 +308,16 @@ func (hm *HostMap) AddVpnIP(vpnIP uint32) *HostInfo {
 	}
 }
 
-func (hm *HostMap) DeleteVpnIP(vpnIP uint32) {
+func (hm *HostMap) DeleteVpnIP(vpnIP VpnIp) {
 	hm.Lock()
 	delete(hm.Hosts, vpnIP)
 	if len(hm.Hosts) == 0 {
-		hm.Hosts = map[uint32]*HostInfo{}
+		hm.Hosts = map[VpnIp]*HostInfo{}
 	}
 	hm.Unlock()
 
 	if hm.l.Level >= logrus.DebugLevel {
-		hm.l.WithField("hostMap", m{"mapName": hm.name, "vpnIp": IntIp(vpnIP), "mapTotalSize": len(hm.Hosts)}).
+		hm.l.WithField("hostMap", m{"mapName": hm.name, "vpnIp": vpnIP, "mapTotalSize": len(hm.Hosts)}).
 			Debug("Hostmap vpnIp deleted")
 	}
 }
@@ -173,12 +331,12 @@ func (hm *HostMap) addRemoteIndexHostInfo(index uint32, h *HostInfo) {
 
 	if hm.l.Level > logrus.DebugLevel {
 		hm.l.WithField("hostMap", m{"mapName": hm.name, "indexNumber": index, "mapTotalSize": len(hm.Indexes),
-			"hostinfo": m{"existing": true, "localIndexId": h.localIndexId, "hostId": IntIp(h.hostId)}}).
+			"hostinfo": m{"existing": true, "localIndexId": h.localIndexId, "hostId": h.hostId}}).
 			Debug("Hostmap remoteIndex added")
 	}
 }
 
-func (hm *HostMap) AddVpnIPHostInfo(vpnIP uint32, h *HostInfo) {
+func (hm *HostMap) AddVpnIPHostInfo(vpnIP VpnIp, h *HostInfo) {
 	hm.Lock()
 	h.hostId = vpnIP
 	hm.Hosts[vpnIP] = h
@@ -187,8 +345,8 @@ func (hm *HostMap) AddVpnIPHostInfo(vpnIP uint32, h *HostInfo) {
 	hm.Unlock()
 
 	if hm.l.Level > logrus.DebugLevel {
-		hm.l.WithField("hostMap", m{"mapName": hm.name, "vpnIp": IntIp(vpnIP), "mapTotalSize": len(hm.Hosts),
-			"hostinfo": m{"existing": true, "localIndexId": h.localIndexId, "hostId": IntIp(h.hostId)}}).
+		hm.l.WithField("hostMap", m{"mapName": hm.name, "vpnIp": vpnIP, "mapTotalSize": len(hm.Hosts),
+			"hostinfo": m{"existing": true, "localIndexId": h.localIndexId, "hostId": h.hostId}}).
 			Debug("Hostmap vpnIp added")
 	}
 }
@@ -253,13 +411,18 @@ func (hm *HostMap) unlockedDeleteHostInfo(hostinfo *HostInfo) {
 	hostinfo2, ok := hm.Hosts[hostinfo.hostId]
 	if ok && hostinfo2 != hostinfo {
 		delete(hm.Hosts, hostinfo2.hostId)
+		hm.unlockedDeleteAliases(hostinfo2)
+		hm.unlockedDeleteRelays(hostinfo2)
 		delete(hm.Indexes, hostinfo2.localIndexId)
 		delete(hm.RemoteIndexes, hostinfo2.remoteIndexId)
 	}
 
 	delete(hm.Hosts, hostinfo.hostId)
+	hm.unlockedDeleteAliases(hostinfo)
+	hm.unlockedDeleteRelays(hostinfo)
+	hm.tunnelMetrics.remove(hostinfo.hostId)
 	if len(hm.Hosts) == 0 {
-		hm.Hosts = map[uint32]*HostInfo{}
+		hm.Hosts = map[VpnIp]*HostInfo{}
 	}
 	delete(hm.Indexes, hostinfo.localIndexId)
 	if len(hm.Indexes) == 0 {
@@ -272,7 +435,7 @@ func (hm *HostMap) unlockedDeleteHostInfo(hostinfo *HostInfo) {
 
 	if hm.l.Level >= logrus.DebugLevel {
 		hm.l.WithField("hostMap", m{"mapName": hm.name, "mapTotalSize": len(hm.Hosts),
-			"vpnIp": IntIp(hostinfo.hostId), "indexNumber": hostinfo.localIndexId, "remoteIndexNumber": hostinfo.remoteIndexId}).
+			"vpnIp": hostinfo.hostId, "indexNumber": hostinfo.localIndexId, "remoteIndexNumber": hostinfo.remoteIndexId}).
 			Debug("Hostmap hostInfo deleted")
 	}
 }
@@ -289,6 +452,43 @@ func (hm *HostMap) QueryIndex(index uint32) (*HostInfo, error) {
 	}
 }
 
+func (hm *HostMap) QueryRelayIndex(index uint32) (*HostInfo, error) {
+	hm.RLock()
+	defer hm.RUnlock()
+	if h, ok := hm.Relays[index]; ok {
+		return h, nil
+	}
+	return nil, errors.New("unable to find relay index")
+}
+
+// AddRelay generates a unique relay index and records a relay to peerIp over the tunnel in relayHostInfo
+func (hm *HostMap) AddRelay(relayHostInfo *HostInfo, peerIp VpnIp, remoteIdx uint32, relayType, state int) (Relay, error) {
+	hm.Lock()
+	defer hm.Unlock()
+
+	for i := 0; i < 32; i++ {
+		index, err := generateIndex(hm.l)
+		if err != nil {
+			return Relay{}, err
+		}
+
+		if _, inRelays := hm.Relays[index]; !inRelays {
+			r := &Relay{
+				Type:        relayType,
+				State:       state,
+				LocalIndex:  index,
+				RemoteIndex: remoteIdx,
+				PeerIp:      peerIp,
+			}
+			hm.Relays[index] = relayHostInfo
+			relayHostInfo.relayState.insertRelay(r)
+			return *r, nil
+		}
+	}
+
+	return Relay{}, errors.New("failed to generate unique relay index")
+}
+
 func (hm *HostMap) QueryReverseIndex(index uint32) (*HostInfo, error) {
 	hm.RLock()
 	if h, ok := hm.RemoteIndexes[index]; ok {
@@ -300,19 +500,24 @@ func (hm *HostMap) QueryReverseIndex(index uint32) (*HostInfo, error) {
 	}
 }
 
-func (hm *HostMap) QueryVpnIP(vpnIp uint32) (*HostInfo, error) {
+func (hm *HostMap) QueryVpnIP(vpnIp VpnIp) (*HostInfo, error) {
 	return hm.queryVpnIP(vpnIp, nil)
 }
 
 // PromoteBestQueryVpnIP will attempt to lazily switch to the best remote every
 // `PromoteEvery` calls to this function for a given host.
-func (hm *HostMap) PromoteBestQueryVpnIP(vpnIp uint32, ifce *Interface) (*HostInfo, error) {
+func (hm *HostMap) PromoteBestQueryVpnIP(vpnIp VpnIp, ifce *Interface) (*HostInfo, error) {
 	return hm.queryVpnIP(vpnIp, ifce)
 }
 
-func (hm *HostMap) queryVpnIP(vpnIp uint32, promoteIfce *Interface) (*HostInfo, error) {
+func (hm *HostMap) queryVpnIP(vpnIp VpnIp, promoteIfce *Interface) (*HostInfo, error) {
 	hm.RLock()
-	if h, ok := hm.Hosts[vpnIp]; ok {
+	h, ok := hm.Hosts[vpnIp]
+	if !ok {
+		h, ok = hm.aliases[vpnIp]
+	}
+
+	if ok {
 		hm.RUnlock()
 		// Do not attempt promotion if you are a lighthouse
 		if promoteIfce != nil && !promoteIfce.lightHouse.amLighthouse {
@@ -326,34 +531,109 @@ func (hm *HostMap) queryVpnIP(vpnIp uint32, promoteIfce *Interface) (*HostInfo,
 	return nil, errors.New("unable to find host")
 }
 
-func (hm *HostMap) queryUnsafeRoute(ip uint32) uint32 {
-	r := hm.unsafeRoutes.MostSpecificContains(ip)
+func (hm *HostMap) queryUnsafeRoute(ip VpnIp) (VpnIp, bool) {
+	r := hm.unsafeRoutes.MostSpecificContainsVpnIp(ip)
 	if r != nil {
-		return r.(uint32)
+		return r.(VpnIp), true
 	} else {
-		return 0
+		return VpnIp{}, false
 	}
 }
 
+// unlockedRetireIndex keeps the local index of a tunnel that was replaced for grace so the packets the peer sent before
+// it switched to the new tunnel can still be decrypted. It assumes you have the hm write lock
+func (hm *HostMap) unlockedRetireIndex(hostinfo *HostInfo, grace time.Duration) {
+	if grace <= 0 {
+		delete(hm.Indexes, hostinfo.localIndexId)
+		return
+	}
+
+	time.AfterFunc(grace, func() {
+		hm.Lock()
+		defer hm.Unlock()
+		if hm.Indexes[hostinfo.localIndexId] == hostinfo {
+			delete(hm.Indexes, hostinfo.localIndexId)
+		}
+	})
+}
+
+// vpnCIDRContains returns true if the ip is within any of our vpn networks
+func (hm *HostMap) vpnCIDRContains(ip VpnIp) bool {
+	return vpnNetContains(hm.vpnCIDRs, ip)
+}
+
 // We already have the hm Lock when this is called, so make sure to not call
 // any other methods that might try to grab it again
 func (hm *HostMap) addHostInfo(hostinfo *HostInfo, f *Interface) {
-	if f.serveDns {
-		remoteCert := hostinfo.ConnectionState.peerCert
-		dnsR.Add(remoteCert.Details.Name+".", remoteCert.Details.Ips[0].IP.String())
+	if f.dnsServer != nil {
+		f.dnsServer.Add(hostinfo.ConnectionState.peerCert)
 	}
 
 	hm.Hosts[hostinfo.hostId] = hostinfo
 	hm.Indexes[hostinfo.localIndexId] = hostinfo
 	hm.RemoteIndexes[hostinfo.remoteIndexId] = hostinfo
+	hostinfo.stats = hm.tunnelMetrics.handshake(hostinfo.hostId)
+	if f.multipath.mode != pathModeOff {
+		hostinfo.paths = newHostPaths(f.multipath.mode)
+	}
+
+	for _, ip := range hostinfo.vpnAliases() {
+		hm.aliases[ip] = hostinfo
+	}
 
 	if hm.l.Level >= logrus.DebugLevel {
-		hm.l.WithField("hostMap", m{"mapName": hm.name, "vpnIp": IntIp(hostinfo.hostId), "mapTotalSize": len(hm.Hosts),
-			"hostinfo": m{"existing": true, "localIndexId": hostinfo.localIndexId, "hostId": IntIp(hostinfo.hostId)}}).
+		hm.l.WithField("hostMap", m{"mapName": hm.name, "vpnIp": hostinfo.hostId, "mapTotalSize": len(hm.Hosts),
+			"hostinfo": m{"existing": true, "localIndexId": hostinfo.localIndexId, "hostId": hostinfo.hostId}}).
 			Debug("Hostmap vpnIp added")
 	}
 }
 
+// unlockedDeleteAliases assumes you have the hm lock and removes any secondary vpn ips that point to this hostinfo
+// The peer certificate may already be gone so we can't rely on it to find them
+func (hm *HostMap) unlockedDeleteAliases(hostinfo *HostInfo) {
+	for ip, h := range hm.aliases {
+		if h == hostinfo {
+			delete(hm.aliases, ip)
+		}
+	}
+}
+
+// unlockedDeleteRelays assumes you have the hm lock and removes the relay indexes that run over this hostinfo.
+// The other leg of a relay we are forwarding is useless on its own so it is removed as well
+func (hm *HostMap) unlockedDeleteRelays(hostinfo *HostInfo) {
+	for _, r := range hostinfo.relayState.CopyRelayFor() {
+		if hm.Relays[r.LocalIndex] == hostinfo {
+			delete(hm.Relays, r.LocalIndex)
+		}
+
+		if r.Type != relayForwarding {
+			continue
+		}
+
+		peer, ok := hm.Hosts[r.PeerIp]
+		if !ok {
+			continue
+		}
+
+		if pr, ok := peer.relayState.DeleteRelay(hostinfo.hostId); ok {
+			delete(hm.Relays, pr.LocalIndex)
+		}
+	}
+}
+
+// unlockedMoveRelays hands the relays running over from to the tunnel that is replacing it, the relay indexes stay the
+// same so the other ends of the relays are not disturbed. It assumes you have the write lock
+func (hm *HostMap) unlockedMoveRelays(from, to *HostInfo) {
+	for _, r := range from.relayState.CopyRelayFor() {
+		if hm.Relays[r.LocalIndex] == from {
+			hm.Relays[r.LocalIndex] = to
+		}
+
+		r := r
+		to.relayState.insertRelay(&r)
+	}
+}
+
 // punchList assembles a list of all non nil RemoteList pointer entries in this hostmap
 // The caller can then do the its work outside of the read lock
 func (hm *HostMap) punchList(rl []*RemoteList) []*RemoteList {
@@ -395,7 +675,7 @@ func (hm *HostMap) Punchy(conn *udpConn) {
 func (hm *HostMap) addUnsafeRoutes(routes *[]route) {
 	for _, r := range *routes {
 		hm.l.WithField("route", r.route).WithField("via", r.via).Warn("Adding UNSAFE Route")
-		hm.unsafeRoutes.AddCIDR(r.route, ip2int(*r.via))
+		hm.unsafeRoutes.AddCIDR(r.route, NewVpnIp(*r.via))
 	}
 }
 
@@ -407,16 +687,19 @@ func (i *HostInfo) BindConnectionState(cs *ConnectionState) {
 // NOTE: It is an error to call this if you are a lighthouse since they should not roam clients!
 func (i *HostInfo) TryPromoteBest(preferredRanges []*net.IPNet, ifce *Interface) {
 	c := atomic.AddUint32(&i.promoteCounter, 1)
-	if c%PromoteEvery == 0 {
+	// The path manager measures every remote when picking the best one, there is nothing to probe for here
+	if c%PromoteEvery == 0 && ifce.multipath.mode != pathModeBest {
 		// The lock here is currently protecting i.remote access
 		i.RLock()
 		defer i.RUnlock()
 
-		// return early if we are already on a preferred remote
-		rIP := i.remote.IP
-		for _, l := range preferredRanges {
-			if l.Contains(rIP) {
-				return
+		// return early if we are already on a preferred remote, relayed tunnels have no remote and always probe
+		if i.remote != nil {
+			rIP := i.remote.IP
+			for _, l := range preferredRanges {
+				if l.Contains(rIP) {
+					return
+				}
 			}
 		}
 
@@ -471,6 +754,7 @@ func (i *HostInfo) handshakeComplete(l *logrus.Logger, m *cachedPacketMetrics) {
 	//TODO: this should be managed by the handshake state machine to set it based on how many handshake were seen.
 	// Clamping it to 2 gets us out of the woods for now
 	atomic.StoreUint64(&i.ConnectionState.atomicMessageCounter, 2)
+	i.ConnectionState.established = time.Now()
 
 	if l.Level >= logrus.DebugLevel {
 		i.logger(l).Debugf("Sending %d stored packets", len(i.packetStore))
@@ -507,6 +791,14 @@ func (i *HostInfo) SetRemote(remote *udpAddr) {
 	}
 }
 
+// pathRemote returns the address the next packet for this host should be sent to
+func (i *HostInfo) pathRemote() *udpAddr {
+	if i.paths == nil || i.remote == nil {
+		return i.remote
+	}
+	return i.paths.pick(i.remote)
+}
+
 func (i *HostInfo) ClearConnectionState() {
 	i.ConnectionState = nil
 }
@@ -525,9 +817,9 @@ func (i *HostInfo) CreateRemoteCIDR(c *cert.NebulaCertificate) {
 		return
 	}
 
-	remoteCidr := NewCIDRTree()
+	remoteCidr := NewCIDR6Tree()
 	for _, ip := range c.Details.Ips {
-		remoteCidr.AddCIDR(&net.IPNet{IP: ip.IP, Mask: net.IPMask{255, 255, 255, 255}}, struct{}{})
+		remoteCidr.AddCIDR(hostIPNet(ip.IP), struct{}{})
 	}
 
 	for _, n := range c.Details.Subnets {
@@ -536,12 +828,28 @@ func (i *HostInfo) CreateRemoteCIDR(c *cert.NebulaCertificate) {
 	i.remoteCidr = remoteCidr
 }
 
+// vpnAliases returns the vpn ips in the peer certificate other than the one this tunnel is keyed on
+func (i *HostInfo) vpnAliases() []VpnIp {
+	c := i.GetCert()
+	if c == nil || len(c.Details.Ips) < 2 {
+		return nil
+	}
+
+	var ips []VpnIp
+	for _, ipNet := range c.Details.Ips {
+		if ip := NewVpnIp(ipNet.IP); ip != i.hostId {
+			ips = append(ips, ip)
+		}
+	}
+	return ips
+}
+
 func (i *HostInfo) logger(l *logrus.Logger) *logrus.Entry {
 	if i == nil {
 		return logrus.NewEntry(l)
 	}
 
-	li := l.WithField("vpnIp", IntIp(i.hostId))
+	li := l.WithField("vpnIp", i.hostId)
 
 	if connState := i.ConnectionState; connState != nil {
 		if peerCert := connState.peerCert; peerCert != nil {
@@ -556,7 +864,7 @@ func (i *HostInfo) logger(l *logrus.Logger) *logrus.Entry {
 
 /*
 
-func (hm *HostMap) DebugRemotes(vpnIp uint32) string {
+func (hm *HostMap) DebugRemotes(vpnIp VpnIp) string {
 	s := "\n"
 	for _, h := range hm.Hosts {
 		for _, r := range h.Remotes {
@@ -586,6 +894,14 @@ func (i *HostInfo) Probes() []*Probe {
 
 // Utility functions
 
+// hostIPNet returns a network that contains exactly the provided ip
+func hostIPNet(ip net.IP) *net.IPNet {
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}
+}
+
 func localIps(l *logrus.Logger, allowList *AllowList) *[]net.IP {
 	//FIXME: This function is pretty garbage
 	var ips []net.IP
@@ -1 +1,90 @@
 package nebula
+
+import (
+	"net"
+	"testing"
+
+	"github.com/slackhq/nebula/cert"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHostMap_aliases(t *testing.T) {
+	l := NewTestLogger()
+	hm := NewHostMap(l, "test", []*net.IPNet{}, []*net.IPNet{})
+	f := &Interface{}
+
+	ip4 := &net.IPNet{IP: net.ParseIP("10.0.0.2").To4(), Mask: net.CIDRMask(24, 32)}
+	ip6 := &net.IPNet{IP: net.ParseIP("fd00::2"), Mask: net.CIDRMask(64, 128)}
+
+	hostinfo := &HostInfo{
+		hostId:        NewVpnIp(ip4.IP),
+		localIndexId:  1,
+		remoteIndexId: 2,
+		ConnectionState: &ConnectionState{
+			peerCert: &cert.NebulaCertificate{
+				Details: cert.NebulaCertificateDetails{Ips: []*net.IPNet{ip4, ip6}},
+			},
+		},
+	}
+
+	hm.Lock()
+	hm.addHostInfo(hostinfo, f)
+	hm.Unlock()
+
+	// The secondary vpn ip should resolve to the same tunnel
+	h, err := hm.QueryVpnIP(NewVpnIp(ip6.IP))
+	assert.NoError(t, err)
+	assert.Equal(t, hostinfo, h)
+	assert.Len(t, hm.Hosts, 1)
+
+	// Removing the tunnel removes the alias even if the certificate is gone
+	hostinfo.ConnectionState = nil
+	hm.DeleteHostInfo(hostinfo)
+	_, err = hm.QueryVpnIP(NewVpnIp(ip6.IP))
+	assert.Error(t, err)
+	assert.Empty(t, hm.aliases)
+}
+
+func TestHostMap_relays(t *testing.T) {
+	l := NewTestLogger()
+	hm := NewHostMap(l, "test", []*net.IPNet{}, []*net.IPNet{})
+	f := &Interface{}
+
+	a := &HostInfo{hostId: NewVpnIp(net.ParseIP("10.0.0.1")), localIndexId: 1}
+	b := &HostInfo{hostId: NewVpnIp(net.ParseIP("10.0.0.2")), localIndexId: 2}
+
+	hm.Lock()
+	hm.addHostInfo(a, f)
+	hm.addHostInfo(b, f)
+	hm.Unlock()
+
+	// Forward between a and b
+	ra, err := hm.AddRelay(a, b.hostId, 100, relayForwarding, relayRequested)
+	assert.NoError(t, err)
+	rb, err := hm.AddRelay(b, a.hostId, 0, relayForwarding, relayRequested)
+	assert.NoError(t, err)
+	assert.NotEqual(t, ra.LocalIndex, rb.LocalIndex)
+
+	h, err := hm.QueryRelayIndex(ra.LocalIndex)
+	assert.NoError(t, err)
+	assert.Equal(t, a, h)
+
+	r, ok := b.relayState.EstablishRelay(rb.LocalIndex, 200)
+	assert.True(t, ok)
+	assert.Equal(t, relayEstablished, r.State)
+	assert.Equal(t, uint32(200), r.RemoteIndex)
+
+	r, ok = b.relayState.QueryRelayForByIp(a.hostId)
+	assert.True(t, ok)
+	assert.Equal(t, relayEstablished, r.State)
+
+	// Removing one side of a forwarded relay removes the other side as well
+	hm.DeleteHostInfo(a)
+	_, err = hm.QueryRelayIndex(ra.LocalIndex)
+	assert.Error(t, err)
+	_, err = hm.QueryRelayIndex(rb.LocalIndex)
+	assert.Error(t, err)
+	_, ok = b.relayState.QueryRelayForByIp(a.hostId)
+	assert.False(t, ok)
+	assert.Empty(t, hm.Relays)
+}
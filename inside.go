@@ -25,14 +25,14 @@ func (f *Interface) consumeInsidePacket(packet []byte, fwPacket *FirewallPacket,
 	}
 
 	// Ignore broadcast packets
-	if f.dropMulticast && isMulticast(fwPacket.RemoteIP) {
+	if f.dropMulticast && fwPacket.RemoteIP.IsMulticast() {
 		return
 	}
 
 	hostinfo := f.getOrHandshake(fwPacket.RemoteIP)
 	if hostinfo == nil {
 		if f.l.Level >= logrus.DebugLevel {
-			f.l.WithField("vpnIp", IntIp(fwPacket.RemoteIP)).
+			f.l.WithField("vpnIp", fwPacket.RemoteIP).
 				WithField("fwPacket", fwPacket).
 				Debugln("dropping outbound packet, vpnIp not in our CIDR or in unsafe routes")
 		}
@@ -54,7 +54,7 @@ func (f *Interface) consumeInsidePacket(packet []byte, fwPacket *FirewallPacket,
 
 	dropReason := f.firewall.Drop(packet, *fwPacket, false, hostinfo, f.caPool, localCache)
 	if dropReason == nil {
-		f.sendNoMetrics(message, 0, ci, hostinfo, hostinfo.remote, packet, nb, out, q)
+		f.sendNoMetrics(message, 0, ci, hostinfo, hostinfo.pathRemote(), packet, nb, out, q)
 
 	} else if f.l.Level >= logrus.DebugLevel {
 		hostinfo.logger(f.l).
@@ -65,10 +65,11 @@ func (f *Interface) consumeInsidePacket(packet []byte, fwPacket *FirewallPacket,
 }
 
 // getOrHandshake returns nil if the vpnIp is not routable
-func (f *Interface) getOrHandshake(vpnIp uint32) *HostInfo {
-	if f.hostMap.vpnCIDR.Contains(int2ip(vpnIp)) == false {
-		vpnIp = f.hostMap.queryUnsafeRoute(vpnIp)
-		if vpnIp == 0 {
+func (f *Interface) getOrHandshake(vpnIp VpnIp) *HostInfo {
+	if !f.hostMap.vpnCIDRContains(vpnIp) {
+		var ok bool
+		vpnIp, ok = f.hostMap.queryUnsafeRoute(vpnIp)
+		if !ok {
 			return nil
 		}
 	}
@@ -99,7 +100,7 @@ func (f *Interface) getOrHandshake(vpnIp uint32) *HostInfo {
 
 	if ci == nil {
 		// if we don't have a connection state, then send a handshake initiation
-		ci = f.newConnectionState(f.l, true, noise.HandshakeIX, []byte{}, 0)
+		ci = f.newConnectionState(f.l, true, noise.HandshakeIX, []byte{}, 0, f.cipher)
 		// FIXME: Maybe make XX selectable, but probably not since psk makes it nearly pointless for us.
 		//ci = f.newConnectionState(true, noise.HandshakeXX, []byte{}, 0)
 		hostinfo.ConnectionState = ci
@@ -126,6 +127,44 @@ func (f *Interface) getOrHandshake(vpnIp uint32) *HostInfo {
 	return hostinfo
 }
 
+// Handshake will attempt to initiate a tunnel with the provided vpn ip if one does not already exist
+func (f *Interface) Handshake(vpnIp VpnIp) {
+	f.getOrHandshake(vpnIp)
+}
+
+// rehandshake starts a new handshake with a host we already have a tunnel with. The existing tunnel keeps carrying
+// traffic until the new one completes and replaces it
+func (f *Interface) rehandshake(vpnIp VpnIp) {
+	existing, err := f.hostMap.QueryVpnIP(vpnIp)
+	if err != nil {
+		return
+	}
+
+	if _, err := f.handshakeManager.pendingHostMap.QueryVpnIP(vpnIp); err == nil {
+		// A handshake is already underway, it will pick up our current certificate
+		return
+	}
+
+	hostinfo := f.handshakeManager.AddVpnIP(vpnIp)
+	hostinfo.Lock()
+	defer hostinfo.Unlock()
+
+	if hostinfo.ConnectionState != nil {
+		// We raced with another handshake for this host
+		return
+	}
+
+	// Try the addresses and relays the current tunnel is using
+	hostinfo.remotes = existing.remotes
+	hostinfo.ConnectionState = f.newConnectionState(f.l, true, noise.HandshakeIX, []byte{}, 0, f.cipher)
+	ixHandshakeStage0(f, vpnIp, hostinfo)
+
+	select {
+	case f.handshakeManager.trigger <- vpnIp:
+	default:
+	}
+}
+
 func (f *Interface) sendMessageNow(t NebulaMessageType, st NebulaMessageSubType, hostInfo *HostInfo, p, nb, out []byte) {
 	fp := &FirewallPacket{}
 	err := newPacket(p, false, fp)
@@ -145,15 +184,15 @@ func (f *Interface) sendMessageNow(t NebulaMessageType, st NebulaMessageSubType,
 		return
 	}
 
-	f.sendNoMetrics(message, st, hostInfo.ConnectionState, hostInfo, hostInfo.remote, p, nb, out, 0)
+	f.sendNoMetrics(message, st, hostInfo.ConnectionState, hostInfo, hostInfo.pathRemote(), p, nb, out, 0)
 }
 
 // SendMessageToVpnIp handles real ip:port lookup and sends to the current best known address for vpnIp
-func (f *Interface) SendMessageToVpnIp(t NebulaMessageType, st NebulaMessageSubType, vpnIp uint32, p, nb, out []byte) {
+func (f *Interface) SendMessageToVpnIp(t NebulaMessageType, st NebulaMessageSubType, vpnIp VpnIp, p, nb, out []byte) {
 	hostInfo := f.getOrHandshake(vpnIp)
 	if hostInfo == nil {
 		if f.l.Level >= logrus.DebugLevel {
-			f.l.WithField("vpnIp", IntIp(vpnIp)).
+			f.l.WithField("vpnIp", vpnIp).
 				Debugln("dropping SendMessageToVpnIp, vpnIp not in our CIDR or in unsafe routes")
 		}
 		return
@@ -176,7 +215,7 @@ func (f *Interface) SendMessageToVpnIp(t NebulaMessageType, st NebulaMessageSubT
 }
 
 func (f *Interface) sendMessageToVpnIp(t NebulaMessageType, st NebulaMessageSubType, hostInfo *HostInfo, p, nb, out []byte) {
-	f.send(t, st, hostInfo.ConnectionState, hostInfo, hostInfo.remote, p, nb, out)
+	f.send(t, st, hostInfo.ConnectionState, hostInfo, hostInfo.pathRemote(), p, nb, out)
 }
 
 func (f *Interface) send(t NebulaMessageType, st NebulaMessageSubType, ci *ConnectionState, hostinfo *HostInfo, remote *udpAddr, p, nb, out []byte) {
@@ -191,9 +230,17 @@ func (f *Interface) sendNoMetrics(t NebulaMessageType, st NebulaMessageSubType,
 	}
 
 	var err error
+	var fullOut []byte
+	if remote == nil {
+		// There is no direct path to this host, leave room at the front of out to wrap the packet for a relay
+		fullOut = out
+		out = out[HeaderLen:]
+	}
+
 	//TODO: enable if we do more than 1 tun queue
 	//ci.writeLock.Lock()
 	c := atomic.AddUint64(&ci.atomicMessageCounter, 1)
+	atomic.AddUint64(&ci.atomicBytesSent, uint64(len(p)))
 
 	//l.WithField("trace", string(debug.Stack())).Error("out Header ", &Header{Version, t, st, 0, hostinfo.remoteIndexId, c}, p)
 	out = HeaderEncode(out, Version, uint8(t), uint8(st), hostinfo.remoteIndexId, c)
@@ -222,7 +269,13 @@ func (f *Interface) sendNoMetrics(t NebulaMessageType, st NebulaMessageSubType,
 		return
 	}
 
-	err = f.writers[q].WriteTo(out, remote)
+	hostinfo.stats.tx(len(out))
+	if remote == nil {
+		f.sendToRelay(hostinfo, out, nb, fullOut)
+		return
+	}
+
+	err = f.writeTo(f.writers[q], out, remote)
 	if err != nil {
 		hostinfo.logger(f.l).WithError(err).
 			WithField("udpAddr", remote).Error("Failed to write outgoing packet")
@@ -230,11 +283,52 @@ func (f *Interface) sendNoMetrics(t NebulaMessageType, st NebulaMessageSubType,
 	return
 }
 
-func isMulticast(ip uint32) bool {
-	// Class D multicast
-	if (((ip >> 24) & 0xff) & 0xf0) == 0xe0 {
-		return true
+// sendToRelay sends an already encrypted packet for hostinfo through the first established relay that can reach it
+func (f *Interface) sendToRelay(hostinfo *HostInfo, p, nb, out []byte) {
+	for _, relayIp := range hostinfo.relayState.CopyRelayIps() {
+		relayHostInfo, err := f.hostMap.QueryVpnIP(relayIp)
+		if err != nil {
+			continue
+		}
+
+		relay, ok := relayHostInfo.relayState.QueryRelayForByIp(hostinfo.hostId)
+		if !ok || relay.State != relayEstablished {
+			continue
+		}
+
+		f.SendVia(relayHostInfo, relay, p, nb, out)
+		return
+	}
+
+	if f.l.Level >= logrus.DebugLevel {
+		hostinfo.logger(f.l).Debug("Dropping outgoing packet, no remote or relay available")
+	}
+}
+
+// SendVia wraps a complete nebula packet so that the relay on the other side of via can forward it. The header and the
+// wrapped packet are authenticated with the keys of the via tunnel but are not encrypted a second time
+func (f *Interface) SendVia(via *HostInfo, relay Relay, ad, nb, out []byte) {
+	if via.remote == nil {
+		// Relays must be reachable directly, we do not chain them
+		via.logger(f.l).WithField("relayTo", relay.PeerIp).Error("Refusing to send through a relay that has no remote")
+		return
 	}
 
-	return false
+	ci := via.ConnectionState
+	c := atomic.AddUint64(&ci.atomicMessageCounter, 1)
+	out = HeaderEncode(out, Version, uint8(message), uint8(messageRelay), relay.RemoteIndex, c)
+	f.connectionManager.Out(via.hostId)
+
+	// ad may already be sitting right after the header in out, append copes with the overlap
+	out = append(out, ad...)
+	out, err := ci.eKey.EncryptDanger(out, out, nil, c, nb)
+	if err != nil {
+		via.logger(f.l).WithError(err).WithField("counter", c).Error("Failed to sign relay packet")
+		return
+	}
+
+	err = f.writeTo(f.writers[0], out, via.remote)
+	if err != nil {
+		via.logger(f.l).WithError(err).WithField("udpAddr", via.remote).Error("Failed to write outgoing relay packet")
+	}
 }
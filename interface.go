@@ -1,11 +1,13 @@
 package nebula
 
 import (
+	"bytes"
 	"errors"
 	"io"
 	"net"
 	"os"
 	"runtime"
+	"sync/atomic"
 	"time"
 
 	"github.com/rcrowley/go-metrics"
@@ -30,10 +32,16 @@ type InterfaceConfig struct {
 	Inside                  Inside
 	certState               *CertState
 	Cipher                  string
+	Ciphers                 []string
+	pqMode                  pqMode
+	rekey                   rekeyConfig
+	multipath               multipathConfig
+	tcp                     *tcpTransport
 	Firewall                *Firewall
-	ServeDns                bool
+	dnsServer               *dnsServer
 	HandshakeManager        *HandshakeManager
 	lightHouse              *LightHouse
+	relayManager            *relayManager
 	checkInterval           int
 	pendingDeletionInterval int
 	DropLocalBroadcast      bool
@@ -54,14 +62,21 @@ type Interface struct {
 	inside             Inside
 	certState          *CertState
 	cipher             string
+	ciphers            []string
+	pqMode             pqMode
+	rekey              rekeyConfig
+	multipath          multipathConfig
+	pathManager        *pathManager
+	tcp                *tcpTransport
 	firewall           *Firewall
 	connectionManager  *connectionManager
 	handshakeManager   *HandshakeManager
-	serveDns           bool
+	dnsServer          *dnsServer
 	createTime         time.Time
 	lightHouse         *LightHouse
-	localBroadcast     uint32
-	myVpnIp            uint32
+	relayManager       *relayManager
+	localBroadcast     VpnIp
+	myVpnIp            VpnIp
 	dropLocalBroadcast bool
 	dropMulticast      bool
 	udpBatchSize       int
@@ -70,7 +85,10 @@ type Interface struct {
 
 	// rebindCount is used to decide if an active tunnel should trigger a punch notification through a lighthouse
 	rebindCount int8
-	version     string
+
+	// atomicRehandshakeGen is bumped each time our certificate changes so an older round of re-handshakes can stop
+	atomicRehandshakeGen uint32
+	version              string
 
 	conntrackCacheTimeout time.Duration
 
@@ -104,12 +122,18 @@ func NewInterface(c *InterfaceConfig) (*Interface, error) {
 		inside:             c.Inside,
 		certState:          c.certState,
 		cipher:             c.Cipher,
+		ciphers:            c.Ciphers,
+		pqMode:             c.pqMode,
+		rekey:              c.rekey,
+		multipath:          c.multipath,
+		tcp:                c.tcp,
 		firewall:           c.Firewall,
-		serveDns:           c.ServeDns,
+		dnsServer:          c.dnsServer,
 		handshakeManager:   c.HandshakeManager,
 		createTime:         time.Now(),
 		lightHouse:         c.lightHouse,
-		localBroadcast:     ip2int(c.certState.certificate.Details.Ips[0].IP) | ^ip2int(c.certState.certificate.Details.Ips[0].Mask),
+		relayManager:       c.relayManager,
+		localBroadcast:     localBroadcast(c.certState.certificate.Details.Ips),
 		dropLocalBroadcast: c.DropLocalBroadcast,
 		dropMulticast:      c.DropMulticast,
 		udpBatchSize:       c.UDPBatchSize,
@@ -118,7 +142,7 @@ func NewInterface(c *InterfaceConfig) (*Interface, error) {
 		writers:            make([]*udpConn, c.routines),
 		readers:            make([]io.ReadWriteCloser, c.routines),
 		caPool:             c.caPool,
-		myVpnIp:            ip2int(c.certState.certificate.Details.Ips[0].IP),
+		myVpnIp:            NewVpnIp(c.certState.certificate.Details.Ips[0].IP),
 
 		conntrackCacheTimeout: c.ConntrackCacheTimeout,
 
@@ -133,6 +157,7 @@ func NewInterface(c *InterfaceConfig) (*Interface, error) {
 	}
 
 	ifce.connectionManager = newConnectionManager(c.l, ifce, c.checkInterval, c.pendingDeletionInterval)
+	ifce.pathManager = newPathManager(c.l, ifce, c.multipath)
 
 	return ifce, nil
 }
@@ -172,6 +197,9 @@ func (f *Interface) activate() {
 }
 
 func (f *Interface) run() {
+	f.pathManager.Start()
+	f.tcp.Start(f.newTcpReader)
+
 	// Launch n queues to read packets from udp
 	for i := 0; i < f.routines; i++ {
 		go f.listenOut(i)
@@ -236,13 +264,23 @@ func (f *Interface) reloadCA(c *Config) {
 		return
 	}
 
+	// Revocation lists learned from the lighthouses are not in the config, carry them over. Expired lists are kept too,
+	// there is usually no newer list to replace them with
+	for issuer, err := range newCAs.AdoptCRLs(f.caPool.GetCRLs()) {
+		f.l.WithError(err).WithField("issuer", issuer).
+			Warn("Dropping certificate revocation list that no longer verifies against the trusted CA certificates")
+	}
+
 	f.caPool = newCAs
 	f.l.WithField("fingerprints", f.caPool.GetFingerprints()).Info("Trusted CA certificates refreshed")
+
+	f.publishCRLs()
+	f.closeRevokedTunnels()
 }
 
 func (f *Interface) reloadCertKey(c *Config) {
 	// reload and check in all cases
-	cs, err := NewCertStateFromConfig(c)
+	cs, err := newCertStateFromConfig(c, f.certState)
 	if err != nil {
 		f.l.WithError(err).Error("Could not refresh client cert")
 		return
@@ -256,8 +294,45 @@ func (f *Interface) reloadCertKey(c *Config) {
 		return
 	}
 
+	changed := !bytes.Equal(f.certState.rawCertificate, cs.rawCertificate) || len(f.certState.rawChain) != len(cs.rawChain)
+	for i := 0; !changed && i < len(cs.rawChain); i++ {
+		changed = !bytes.Equal(f.certState.rawChain[i], cs.rawChain[i])
+	}
 	f.certState = cs
 	f.l.WithField("cert", cs.certificate).Info("Client cert refreshed from disk")
+
+	if changed {
+		// Our peers only learn about the new certificate through a handshake
+		f.rehandshakeTunnels(c.GetDuration("pki.rehandshake_delay", time.Millisecond*100))
+	}
+}
+
+// rehandshakeTunnels re-handshakes every established tunnel, waiting delay between each so we don't flood the network
+// with handshakes. A newer call stops any older round still in progress
+func (f *Interface) rehandshakeTunnels(delay time.Duration) {
+	gen := atomic.AddUint32(&f.atomicRehandshakeGen, 1)
+
+	var vpnIps []VpnIp
+	f.hostMap.RLock()
+	for vpnIp, h := range f.hostMap.Hosts {
+		if h.ConnectionState != nil && h.ConnectionState.ready {
+			vpnIps = append(vpnIps, vpnIp)
+		}
+	}
+	f.hostMap.RUnlock()
+
+	f.l.WithField("tunnels", len(vpnIps)).WithField("delay", delay).Info("Re-handshaking tunnels with the new certificate")
+
+	go func() {
+		for _, vpnIp := range vpnIps {
+			if atomic.LoadUint32(&f.atomicRehandshakeGen) != gen {
+				return
+			}
+
+			f.rehandshake(vpnIp)
+			time.Sleep(delay)
+		}
+	}()
 }
 
 func (f *Interface) reloadFirewall(c *Config) {
@@ -292,6 +367,7 @@ func (f *Interface) reloadFirewall(c *Config) {
 
 	f.firewall = fw
 
+	oldFw.unregisterRuleMetrics(fw)
 	oldFw.Destroy()
 	f.l.WithField("firewallHash", fw.GetRuleHash()).
 		WithField("oldFirewallHash", oldFw.GetRuleHash()).
@@ -311,3 +387,18 @@ func (f *Interface) emitStats(i time.Duration) {
 		udpStats()
 	}
 }
+
+// localBroadcast returns the broadcast address of the first ipv4 network in ips, ipv6 has no broadcast address so
+// the zero value is returned if there are no ipv4 networks
+func localBroadcast(ips []*net.IPNet) VpnIp {
+	for _, ipNet := range ips {
+		if ip4 := ipNet.IP.To4(); ip4 != nil {
+			mask := ipNet.Mask
+			if len(mask) == net.IPv6len {
+				mask = mask[12:]
+			}
+			return NewVpnIp4(ip2int(ip4) | ^ip2int(mask))
+		}
+	}
+	return VpnIp{}
+}
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"strings"
 	"sync"
 	"time"
 
@@ -18,17 +19,24 @@ import (
 
 var ErrHostNotKnown = errors.New("host not known")
 
+// hostSyncBatchBytes caps how many hosts go into a single HostSyncNotification, it keeps the message within what a
+// typical path carries without fragmenting
+const hostSyncBatchBytes = 1200
+
 type LightHouse struct {
 	//TODO: We need a timer wheel to kick out vpnIps that haven't reported in a long time
 	sync.RWMutex //Because we concurrently read and write to our maps
 	amLighthouse bool
-	myVpnIp      uint32
-	myVpnZeros   uint32
+	myVpnIp      VpnIp
+	myVpnNets    []*net.IPNet
 	punchConn    *udpConn
 
 	// Local cache of answers from light houses
 	// map of vpn Ip to answers
-	addrMap map[uint32]*RemoteList
+	addrMap map[VpnIp]*RemoteList
+
+	// aliases maps the secondary vpn ips of a host to its primary vpn ip, only populated when we are a lighthouse
+	aliases map[VpnIp]VpnIp
 
 	// filters remote addresses allowed for each host
 	// - When we are a lighthouse, this filters what addresses we store and
@@ -40,13 +48,40 @@ type LightHouse struct {
 	// filters local addresses that we advertise to lighthouses
 	localAllowList *AllowList
 
+	// relaysForMe are the hosts we advertise to lighthouses as being able to relay packets to us
+	relaysForMe []VpnIp
+
 	// used to trigger the HandshakeManager when we receive HostQueryReply
-	handshakeTrigger chan<- uint32
+	handshakeTrigger chan<- VpnIp
+
+	// crls are the marshaled revocation lists we answer HostCRLQuery with, only used when we are a lighthouse
+	crls [][]byte
+	// crlInterval is how often we ask the lighthouses for revocation lists, 0 disables it
+	crlInterval time.Duration
+	// crlHandler is called with the revocation lists a lighthouse sent us
+	crlHandler func(vpnIp VpnIp, crls [][]byte)
+
+	// syncPeers are the other lighthouses we share our address cache with, only used when we are a lighthouse
+	syncPeers map[VpnIp]struct{}
+	// syncInterval is how often we ask the sync peers for a full copy of their cache
+	syncInterval time.Duration
+
+	// names maps certificate names to the primary vpn ip of the host and hostNames is the reverse, only populated when
+	// we are a lighthouse
+	names     map[string]VpnIp
+	hostNames map[VpnIp]string
+	// nameHandler is called with the answer to a HostNameQuery, vpnIp is the zero value if the lighthouse did not know
+	// the name
+	nameHandler func(lighthouse VpnIp, name string, vpnIp VpnIp)
+
+	// staticHostMap is the static_host_map as configured, dns names in it are periodically looked up again
+	staticHostMap *staticHostMap
+	resolver      staticResolver
 
 	// staticList exists to avoid having a bool in each addrMap entry
 	// since static should be rare
-	staticList  map[uint32]struct{}
-	lighthouses map[uint32]struct{}
+	staticList  map[VpnIp]struct{}
+	lighthouses map[VpnIp]struct{}
 	interval    int
 	nebulaPort  uint32 // 32 bits because protobuf does not have a uint16
 	punchBack   bool
@@ -58,19 +93,26 @@ type LightHouse struct {
 }
 
 type EncWriter interface {
-	SendMessageToVpnIp(t NebulaMessageType, st NebulaMessageSubType, vpnIp uint32, p, nb, out []byte)
+	SendVia(via *HostInfo, relay Relay, ad, nb, out []byte)
+	SendMessageToVpnIp(t NebulaMessageType, st NebulaMessageSubType, vpnIp VpnIp, p, nb, out []byte)
+	Handshake(vpnIp VpnIp)
 }
 
-func NewLightHouse(l *logrus.Logger, amLighthouse bool, myVpnIpNet *net.IPNet, ips []uint32, interval int, nebulaPort uint32, pc *udpConn, punchBack bool, punchDelay time.Duration, metricsEnabled bool) *LightHouse {
-	ones, _ := myVpnIpNet.Mask.Size()
+// NewLightHouse creates a new lighthouse, myVpnNets are the networks from our certificate with the first being our
+// primary vpn ip
+func NewLightHouse(l *logrus.Logger, amLighthouse bool, myVpnNets []*net.IPNet, ips []VpnIp, interval int, nebulaPort uint32, pc *udpConn, punchBack bool, punchDelay time.Duration, metricsEnabled bool) *LightHouse {
 	h := LightHouse{
 		amLighthouse: amLighthouse,
-		myVpnIp:      ip2int(myVpnIpNet.IP),
-		myVpnZeros:   uint32(32 - ones),
-		addrMap:      make(map[uint32]*RemoteList),
+		myVpnIp:      NewVpnIp(myVpnNets[0].IP),
+		myVpnNets:    myVpnNets,
+		addrMap:      make(map[VpnIp]*RemoteList),
+		aliases:      make(map[VpnIp]VpnIp),
 		nebulaPort:   nebulaPort,
-		lighthouses:  make(map[uint32]struct{}),
-		staticList:   make(map[uint32]struct{}),
+		lighthouses:  make(map[VpnIp]struct{}),
+		syncPeers:    make(map[VpnIp]struct{}),
+		names:        make(map[string]VpnIp),
+		hostNames:    make(map[VpnIp]string),
+		staticList:   make(map[VpnIp]struct{}),
 		interval:     interval,
 		punchConn:    pc,
 		punchBack:    punchBack,
@@ -107,16 +149,53 @@ func (lh *LightHouse) SetLocalAllowList(allowList *AllowList) {
 	lh.localAllowList = allowList
 }
 
+// SetRelaysForMe replaces the list of relays we advertise to lighthouses
+func (lh *LightHouse) SetRelaysForMe(relays []VpnIp) {
+	lh.Lock()
+	defer lh.Unlock()
+
+	lh.relaysForMe = relays
+}
+
+// GetRelaysForMe returns the list of relays we advertise to lighthouses
+func (lh *LightHouse) GetRelaysForMe() []VpnIp {
+	lh.RLock()
+	defer lh.RUnlock()
+
+	return lh.relaysForMe
+}
+
+// SetCRLs replaces the marshaled revocation lists we serve to other hosts
+func (lh *LightHouse) SetCRLs(crls [][]byte) {
+	lh.Lock()
+	defer lh.Unlock()
+
+	lh.crls = crls
+}
+
+// GetCRLs returns the marshaled revocation lists we serve to other hosts
+func (lh *LightHouse) GetCRLs() [][]byte {
+	lh.RLock()
+	defer lh.RUnlock()
+
+	return lh.crls
+}
+
 func (lh *LightHouse) ValidateLHStaticEntries() error {
 	for lhIP, _ := range lh.lighthouses {
 		if _, ok := lh.staticList[lhIP]; !ok {
-			return fmt.Errorf("Lighthouse %s does not have a static_host_map entry", IntIp(lhIP))
+			return fmt.Errorf("Lighthouse %s does not have a static_host_map entry", lhIP)
+		}
+	}
+	for peerIP := range lh.syncPeers {
+		if _, ok := lh.staticList[peerIP]; !ok {
+			return fmt.Errorf("Lighthouse sync peer %s does not have a static_host_map entry", peerIP)
 		}
 	}
 	return nil
 }
 
-func (lh *LightHouse) Query(ip uint32, f EncWriter) *RemoteList {
+func (lh *LightHouse) Query(ip VpnIp, f EncWriter) *RemoteList {
 	if !lh.IsLighthouseIP(ip) {
 		lh.QueryServer(ip, f)
 	}
@@ -130,7 +209,7 @@ func (lh *LightHouse) Query(ip uint32, f EncWriter) *RemoteList {
 }
 
 // This is asynchronous so no reply should be expected
-func (lh *LightHouse) QueryServer(ip uint32, f EncWriter) {
+func (lh *LightHouse) QueryServer(ip VpnIp, f EncWriter) {
 	if lh.amLighthouse {
 		return
 	}
@@ -142,7 +221,7 @@ func (lh *LightHouse) QueryServer(ip uint32, f EncWriter) {
 	// Send a query to the lighthouses and hope for the best next time
 	query, err := proto.Marshal(NewLhQueryByInt(ip))
 	if err != nil {
-		lh.l.WithError(err).WithField("vpnIp", IntIp(ip)).Error("Failed to marshal lighthouse query payload")
+		lh.l.WithError(err).WithField("vpnIp", ip).Error("Failed to marshal lighthouse query payload")
 		return
 	}
 
@@ -154,7 +233,7 @@ func (lh *LightHouse) QueryServer(ip uint32, f EncWriter) {
 	}
 }
 
-func (lh *LightHouse) QueryCache(ip uint32) *RemoteList {
+func (lh *LightHouse) QueryCache(ip VpnIp) *RemoteList {
 	lh.RLock()
 	if v, ok := lh.addrMap[ip]; ok {
 		lh.RUnlock()
@@ -171,8 +250,12 @@ func (lh *LightHouse) QueryCache(ip uint32) *RemoteList {
 // queryAndPrepMessage is a lock helper on RemoteList, assisting the caller to build a lighthouse message containing
 // details from the remote list. It looks for a hit in the addrMap and a hit in the RemoteList under the owner vpnIp
 // If one is found then f() is called with proper locking, f() must return result of n.MarshalTo()
-func (lh *LightHouse) queryAndPrepMessage(vpnIp uint32, f func(*cache) (int, error)) (bool, int, error) {
+func (lh *LightHouse) queryAndPrepMessage(vpnIp VpnIp, f func(*cache) (int, error)) (bool, int, error) {
 	lh.RLock()
+	if primary, ok := lh.aliases[vpnIp]; ok {
+		vpnIp = primary
+	}
+
 	// Do we have an entry in the main cache?
 	if v, ok := lh.addrMap[vpnIp]; ok {
 		// Swap lh lock for remote list lock
@@ -194,7 +277,7 @@ func (lh *LightHouse) queryAndPrepMessage(vpnIp uint32, f func(*cache) (int, err
 	return false, 0, nil
 }
 
-func (lh *LightHouse) DeleteVpnIP(vpnIP uint32) {
+func (lh *LightHouse) DeleteVpnIP(vpnIP VpnIp) {
 	// First we check the static mapping
 	// and do nothing if it is there
 	if _, ok := lh.staticList[vpnIP]; ok {
@@ -203,18 +286,70 @@ func (lh *LightHouse) DeleteVpnIP(vpnIP uint32) {
 	lh.Lock()
 	//l.Debugln(lh.addrMap)
 	delete(lh.addrMap, vpnIP)
+	lh.unlockedDeleteName(vpnIP)
+	for alias, primary := range lh.aliases {
+		if primary == vpnIP {
+			delete(lh.aliases, alias)
+		}
+	}
 
 	if lh.l.Level >= logrus.DebugLevel {
-		lh.l.Debugf("deleting %s from lighthouse.", IntIp(vpnIP))
+		lh.l.Debugf("deleting %s from lighthouse.", vpnIP)
+	}
+
+	lh.Unlock()
+}
+
+// AddAliases records the secondary vpn ips of a host so that queries for them are answered with the host's primary
+// vpn ip entry. Only lighthouses answer queries so this is a no-op otherwise.
+func (lh *LightHouse) AddAliases(vpnIp VpnIp, aliases []VpnIp) {
+	if !lh.amLighthouse || len(aliases) == 0 {
+		return
+	}
+
+	lh.Lock()
+	for _, alias := range aliases {
+		lh.aliases[alias] = vpnIp
+	}
+	lh.Unlock()
+}
+
+// SetName records the certificate name of a host so name queries for it can be answered. Only lighthouses answer name
+// queries so this is a no-op otherwise.
+func (lh *LightHouse) SetName(vpnIp VpnIp, name string) {
+	if !lh.amLighthouse || name == "" {
+		return
 	}
 
+	lh.Lock()
+	lh.unlockedSetName(vpnIp, strings.ToLower(name))
 	lh.Unlock()
 }
 
+// unlockedSetName assumes you have the lh lock, a name or vpn ip that moved drops its old mapping
+func (lh *LightHouse) unlockedSetName(vpnIp VpnIp, name string) {
+	if old, ok := lh.hostNames[vpnIp]; ok && old != name {
+		delete(lh.names, old)
+	}
+	if old, ok := lh.names[name]; ok && old != vpnIp {
+		delete(lh.hostNames, old)
+	}
+
+	lh.names[name] = vpnIp
+	lh.hostNames[vpnIp] = name
+}
+
+func (lh *LightHouse) unlockedDeleteName(vpnIp VpnIp) {
+	if name, ok := lh.hostNames[vpnIp]; ok {
+		delete(lh.names, name)
+		delete(lh.hostNames, vpnIp)
+	}
+}
+
 // AddStaticRemote adds a static host entry for vpnIp as ourselves as the owner
 // We are the owner because we don't want a lighthouse server to advertise for static hosts it was configured with
 // And we don't want a lighthouse query reply to interfere with our learned cache if we are a client
-func (lh *LightHouse) AddStaticRemote(vpnIp uint32, toAddr *udpAddr) {
+func (lh *LightHouse) AddStaticRemote(vpnIp VpnIp, toAddr *udpAddr) {
 	lh.Lock()
 	am := lh.unlockedGetRemoteList(vpnIp)
 	am.Lock()
@@ -241,7 +376,7 @@ func (lh *LightHouse) AddStaticRemote(vpnIp uint32, toAddr *udpAddr) {
 }
 
 // unlockedGetRemoteList assumes you have the lh lock
-func (lh *LightHouse) unlockedGetRemoteList(vpnIP uint32) *RemoteList {
+func (lh *LightHouse) unlockedGetRemoteList(vpnIP VpnIp) *RemoteList {
 	am, ok := lh.addrMap[vpnIP]
 	if !ok {
 		am = NewRemoteList()
@@ -254,10 +389,10 @@ func (lh *LightHouse) unlockedGetRemoteList(vpnIP uint32) *RemoteList {
 func (lh *LightHouse) unlockedShouldAddV4(to *Ip4AndPort) bool {
 	allow := lh.remoteAllowList.AllowIpV4(to.Ip)
 	if lh.l.Level >= logrus.TraceLevel {
-		lh.l.WithField("remoteIp", IntIp(to.Ip)).WithField("allow", allow).Trace("remoteAllowList.Allow")
+		lh.l.WithField("remoteIp", NewVpnIp4(to.Ip)).WithField("allow", allow).Trace("remoteAllowList.Allow")
 	}
 
-	if !allow || ipMaskContains(lh.myVpnIp, lh.myVpnZeros, to.Ip) {
+	if !allow || vpnNetContains(lh.myVpnNets, NewVpnIp4(to.Ip)) {
 		return false
 	}
 
@@ -271,8 +406,7 @@ func (lh *LightHouse) unlockedShouldAddV6(to *Ip6AndPort) bool {
 		lh.l.WithField("remoteIp", lhIp6ToIp(to)).WithField("allow", allow).Trace("remoteAllowList.Allow")
 	}
 
-	// We don't check our vpn network here because nebula does not support ipv6 on the inside
-	if !allow {
+	if !allow || vpnNetContains(lh.myVpnNets, VpnIp{Hi: to.Hi, Lo: to.Lo}) {
 		return false
 	}
 
@@ -286,20 +420,20 @@ func lhIp6ToIp(v *Ip6AndPort) net.IP {
 	return ip
 }
 
-func (lh *LightHouse) IsLighthouseIP(vpnIP uint32) bool {
+func (lh *LightHouse) IsLighthouseIP(vpnIP VpnIp) bool {
 	if _, ok := lh.lighthouses[vpnIP]; ok {
 		return true
 	}
 	return false
 }
 
-func NewLhQueryByInt(VpnIp uint32) *NebulaMeta {
-	return &NebulaMeta{
-		Type: NebulaMeta_HostQuery,
-		Details: &NebulaMetaDetails{
-			VpnIp: VpnIp,
-		},
+func NewLhQueryByInt(vpnIp VpnIp) *NebulaMeta {
+	n := &NebulaMeta{
+		Type:    NebulaMeta_HostQuery,
+		Details: &NebulaMetaDetails{},
 	}
+	n.Details.setVpnIp(vpnIp)
+	return n
 }
 
 func NewIp4AndPort(ip net.IP, port uint32) *Ip4AndPort {
@@ -344,25 +478,33 @@ func (lh *LightHouse) SendUpdate(f EncWriter) {
 	var v6 []*Ip6AndPort
 
 	for _, e := range *localIps(lh.l, lh.localAllowList) {
-		if ip4 := e.To4(); ip4 != nil && ipMaskContains(lh.myVpnIp, lh.myVpnZeros, ip2int(ip4)) {
+		// Only add IPs that aren't my VPN/tun IP
+		if vpnNetContains(lh.myVpnNets, NewVpnIp(e)) {
 			continue
 		}
 
-		// Only add IPs that aren't my VPN/tun IP
 		if ip := e.To4(); ip != nil {
 			v4 = append(v4, NewIp4AndPort(e, lh.nebulaPort))
 		} else {
 			v6 = append(v6, NewIp6AndPort(e, lh.nebulaPort))
 		}
 	}
+
+	relays := lh.GetRelaysForMe()
+	var relayAddrs []*VpnAddr
+	for _, r := range relays {
+		relayAddrs = append(relayAddrs, NewVpnAddr(r))
+	}
+
 	m := &NebulaMeta{
 		Type: NebulaMeta_HostUpdateNotification,
 		Details: &NebulaMetaDetails{
-			VpnIp:       lh.myVpnIp,
 			Ip4AndPorts: v4,
 			Ip6AndPorts: v6,
+			RelayVpnIps: relayAddrs,
 		},
 	}
+	m.Details.setVpnIp(lh.myVpnIp)
 
 	lh.metricTx(NebulaMeta_HostUpdateNotification, int64(len(lh.lighthouses)))
 	nb := make([]byte, 12, 12)
@@ -377,6 +519,131 @@ func (lh *LightHouse) SendUpdate(f EncWriter) {
 	for vpnIp := range lh.lighthouses {
 		f.SendMessageToVpnIp(lightHouse, 0, vpnIp, mm, nb, out)
 	}
+
+	// Peers can only reach us through a relay if we already have a tunnel with it
+	for _, r := range relays {
+		f.Handshake(r)
+	}
+}
+
+// LhCRLWorker periodically asks every lighthouse for the current revocation lists
+func (lh *LightHouse) LhCRLWorker(f EncWriter) {
+	if lh.amLighthouse || lh.crlInterval <= 0 || len(lh.lighthouses) == 0 {
+		return
+	}
+
+	for {
+		lh.SendCRLQuery(f)
+		time.Sleep(lh.crlInterval)
+	}
+}
+
+func (lh *LightHouse) SendCRLQuery(f EncWriter) {
+	m := &NebulaMeta{
+		Type:    NebulaMeta_HostCRLQuery,
+		Details: &NebulaMetaDetails{},
+	}
+	m.Details.setVpnIp(lh.myVpnIp)
+
+	mm, err := proto.Marshal(m)
+	if err != nil {
+		lh.l.WithError(err).Error("Error while marshaling for lighthouse crl query")
+		return
+	}
+
+	lh.metricTx(NebulaMeta_HostCRLQuery, int64(len(lh.lighthouses)))
+	nb := make([]byte, 12, 12)
+	out := make([]byte, mtu)
+	for vpnIp := range lh.lighthouses {
+		f.SendMessageToVpnIp(lightHouse, 0, vpnIp, mm, nb, out)
+	}
+}
+
+// SendNameQuery asks every lighthouse for the vpn ip of the host with the certificate name, the answers are passed to
+// nameHandler
+func (lh *LightHouse) SendNameQuery(name string, f EncWriter) {
+	m := &NebulaMeta{
+		Type:    NebulaMeta_HostNameQuery,
+		Details: &NebulaMetaDetails{Name: name},
+	}
+
+	mm, err := proto.Marshal(m)
+	if err != nil {
+		lh.l.WithError(err).Error("Error while marshaling for lighthouse name query")
+		return
+	}
+
+	lh.metricTx(NebulaMeta_HostNameQuery, int64(len(lh.lighthouses)))
+	nb := make([]byte, 12, 12)
+	out := make([]byte, mtu)
+	for vpnIp := range lh.lighthouses {
+		f.SendMessageToVpnIp(lightHouse, 0, vpnIp, mm, nb, out)
+	}
+}
+
+// LhSyncWorker asks the sync peers for everything they know on startup and every syncInterval after, replicated
+// entries that were not refreshed in 3 intervals are forgotten
+func (lh *LightHouse) LhSyncWorker(f EncWriter) {
+	if !lh.amLighthouse || lh.syncInterval <= 0 || len(lh.syncPeers) == 0 {
+		return
+	}
+
+	for {
+		lh.SendSyncQuery(f)
+		time.Sleep(lh.syncInterval)
+		lh.purgeSynced(time.Now().Add(-3 * lh.syncInterval))
+	}
+}
+
+func (lh *LightHouse) SendSyncQuery(f EncWriter) {
+	m := &NebulaMeta{
+		Type:    NebulaMeta_HostSyncQuery,
+		Details: &NebulaMetaDetails{},
+	}
+	m.Details.setVpnIp(lh.myVpnIp)
+
+	mm, err := proto.Marshal(m)
+	if err != nil {
+		lh.l.WithError(err).Error("Error while marshaling for lighthouse sync query")
+		return
+	}
+
+	lh.metricTx(NebulaMeta_HostSyncQuery, int64(len(lh.syncPeers)))
+	nb := make([]byte, 12, 12)
+	out := make([]byte, mtu)
+	for vpnIp := range lh.syncPeers {
+		f.SendMessageToVpnIp(lightHouse, 0, vpnIp, mm, nb, out)
+	}
+}
+
+// purgeSynced forgets entries from sync peers that have not been refreshed since before. Entries hosts reported to us
+// directly are left alone, those go away when the tunnel does
+func (lh *LightHouse) purgeSynced(before time.Time) {
+	lh.Lock()
+	defer lh.Unlock()
+
+	for vpnIp, am := range lh.addrMap {
+		am.Lock()
+		c := am.cache[vpnIp]
+		if c != nil && !c.syncedAt.IsZero() && c.syncedAt.Before(before) {
+			delete(am.cache, vpnIp)
+			am.shouldRebuild = true
+			if len(am.cache) == 0 {
+				delete(lh.addrMap, vpnIp)
+				lh.unlockedDeleteName(vpnIp)
+			}
+
+			if lh.l.Level >= logrus.DebugLevel {
+				lh.l.WithField("vpnIp", vpnIp).Debug("Forgetting stale entry from a lighthouse sync peer")
+			}
+		}
+		am.Unlock()
+	}
+}
+
+func (lh *LightHouse) isSyncPeer(vpnIp VpnIp) bool {
+	_, ok := lh.syncPeers[vpnIp]
+	return ok
 }
 
 type LightHouseHandler struct {
@@ -418,26 +685,31 @@ func (lhh *LightHouseHandler) resetMeta() *NebulaMeta {
 	details := lhh.meta.Details
 	lhh.meta.Reset()
 
-	// Keep the array memory around
-	details.Ip4AndPorts = details.Ip4AndPorts[:0]
-	details.Ip6AndPorts = details.Ip6AndPorts[:0]
+	// Keep the array memory around, everything else is cleared since unmarshal leaves fields missing from the wire alone
+	*details = NebulaMetaDetails{
+		Ip4AndPorts: details.Ip4AndPorts[:0],
+		Ip6AndPorts: details.Ip6AndPorts[:0],
+		RelayVpnIps: details.RelayVpnIps[:0],
+		CRLs:        details.CRLs[:0],
+		Hosts:       details.Hosts[:0],
+	}
 	lhh.meta.Details = details
 
 	return lhh.meta
 }
 
-func (lhh *LightHouseHandler) HandleRequest(rAddr *udpAddr, vpnIp uint32, p []byte, w EncWriter) {
+func (lhh *LightHouseHandler) HandleRequest(rAddr *udpAddr, vpnIp VpnIp, p []byte, w EncWriter) {
 	n := lhh.resetMeta()
 	err := n.Unmarshal(p)
 	if err != nil {
-		lhh.l.WithError(err).WithField("vpnIp", IntIp(vpnIp)).WithField("udpAddr", rAddr).
+		lhh.l.WithError(err).WithField("vpnIp", vpnIp).WithField("udpAddr", rAddr).
 			Error("Failed to unmarshal lighthouse packet")
 		//TODO: send recv_error?
 		return
 	}
 
 	if n.Details == nil {
-		lhh.l.WithField("vpnIp", IntIp(vpnIp)).WithField("udpAddr", rAddr).
+		lhh.l.WithField("vpnIp", vpnIp).WithField("udpAddr", rAddr).
 			Error("Invalid lighthouse update")
 		//TODO: send recv_error?
 		return
@@ -453,15 +725,33 @@ func (lhh *LightHouseHandler) HandleRequest(rAddr *udpAddr, vpnIp uint32, p []by
 		lhh.handleHostQueryReply(n, vpnIp)
 
 	case NebulaMeta_HostUpdateNotification:
-		lhh.handleHostUpdateNotification(n, vpnIp)
+		lhh.handleHostUpdateNotification(n, vpnIp, w)
 
 	case NebulaMeta_HostMovedNotification:
 	case NebulaMeta_HostPunchNotification:
 		lhh.handleHostPunchNotification(n, vpnIp, w)
+
+	case NebulaMeta_HostCRLQuery:
+		lhh.handleHostCRLQuery(vpnIp, w)
+
+	case NebulaMeta_HostCRLReply:
+		lhh.handleHostCRLReply(n, vpnIp)
+
+	case NebulaMeta_HostSyncNotification:
+		lhh.handleHostSyncNotification(n, vpnIp)
+
+	case NebulaMeta_HostSyncQuery:
+		lhh.handleHostSyncQuery(vpnIp, w)
+
+	case NebulaMeta_HostNameQuery:
+		lhh.handleHostNameQuery(n, vpnIp, w)
+
+	case NebulaMeta_HostNameQueryReply:
+		lhh.handleHostNameQueryReply(n, vpnIp)
 	}
 }
 
-func (lhh *LightHouseHandler) handleHostQuery(n *NebulaMeta, vpnIp uint32, addr *udpAddr, w EncWriter) {
+func (lhh *LightHouseHandler) handleHostQuery(n *NebulaMeta, vpnIp VpnIp, addr *udpAddr, w EncWriter) {
 	// Exit if we don't answer queries
 	if !lhh.lh.amLighthouse {
 		if lhh.l.Level >= logrus.DebugLevel {
@@ -471,12 +761,12 @@ func (lhh *LightHouseHandler) handleHostQuery(n *NebulaMeta, vpnIp uint32, addr
 	}
 
 	//TODO: we can DRY this further
-	reqVpnIP := n.Details.VpnIp
+	reqVpnIP := n.Details.vpnIp()
 	//TODO: Maybe instead of marshalling into n we marshal into a new `r` to not nuke our current request data
-	found, ln, err := lhh.lh.queryAndPrepMessage(n.Details.VpnIp, func(c *cache) (int, error) {
+	found, ln, err := lhh.lh.queryAndPrepMessage(reqVpnIP, func(c *cache) (int, error) {
 		n = lhh.resetMeta()
 		n.Type = NebulaMeta_HostQueryReply
-		n.Details.VpnIp = reqVpnIP
+		n.Details.setVpnIp(reqVpnIP)
 
 		lhh.coalesceAnswers(c, n)
 
@@ -488,7 +778,7 @@ func (lhh *LightHouseHandler) handleHostQuery(n *NebulaMeta, vpnIp uint32, addr
 	}
 
 	if err != nil {
-		lhh.l.WithError(err).WithField("vpnIp", IntIp(vpnIp)).Error("Failed to marshal lighthouse host query reply")
+		lhh.l.WithError(err).WithField("vpnIp", vpnIp).Error("Failed to marshal lighthouse host query reply")
 		return
 	}
 
@@ -499,7 +789,7 @@ func (lhh *LightHouseHandler) handleHostQuery(n *NebulaMeta, vpnIp uint32, addr
 	found, ln, err = lhh.lh.queryAndPrepMessage(vpnIp, func(c *cache) (int, error) {
 		n = lhh.resetMeta()
 		n.Type = NebulaMeta_HostPunchNotification
-		n.Details.VpnIp = vpnIp
+		n.Details.setVpnIp(vpnIp)
 
 		lhh.coalesceAnswers(c, n)
 
@@ -511,7 +801,7 @@ func (lhh *LightHouseHandler) handleHostQuery(n *NebulaMeta, vpnIp uint32, addr
 	}
 
 	if err != nil {
-		lhh.l.WithError(err).WithField("vpnIp", IntIp(vpnIp)).Error("Failed to marshal lighthouse host was queried for")
+		lhh.l.WithError(err).WithField("vpnIp", vpnIp).Error("Failed to marshal lighthouse host was queried for")
 		return
 	}
 
@@ -537,30 +827,38 @@ func (lhh *LightHouseHandler) coalesceAnswers(c *cache, n *NebulaMeta) {
 			n.Details.Ip6AndPorts = append(n.Details.Ip6AndPorts, c.v6.reported...)
 		}
 	}
+
+	if c.relay != nil {
+		for _, r := range c.relay.relay {
+			n.Details.RelayVpnIps = append(n.Details.RelayVpnIps, NewVpnAddr(r))
+		}
+	}
 }
 
-func (lhh *LightHouseHandler) handleHostQueryReply(n *NebulaMeta, vpnIp uint32) {
+func (lhh *LightHouseHandler) handleHostQueryReply(n *NebulaMeta, vpnIp VpnIp) {
 	if !lhh.lh.IsLighthouseIP(vpnIp) {
 		return
 	}
 
+	reqVpnIP := n.Details.vpnIp()
 	lhh.lh.Lock()
-	am := lhh.lh.unlockedGetRemoteList(n.Details.VpnIp)
+	am := lhh.lh.unlockedGetRemoteList(reqVpnIP)
 	am.Lock()
 	lhh.lh.Unlock()
 
 	am.unlockedSetV4(vpnIp, n.Details.Ip4AndPorts, lhh.lh.unlockedShouldAddV4)
 	am.unlockedSetV6(vpnIp, n.Details.Ip6AndPorts, lhh.lh.unlockedShouldAddV6)
+	am.unlockedSetRelay(vpnIp, n.Details.RelayVpnIps)
 	am.Unlock()
 
 	// Non-blocking attempt to trigger, skip if it would block
 	select {
-	case lhh.lh.handshakeTrigger <- n.Details.VpnIp:
+	case lhh.lh.handshakeTrigger <- reqVpnIP:
 	default:
 	}
 }
 
-func (lhh *LightHouseHandler) handleHostUpdateNotification(n *NebulaMeta, vpnIp uint32) {
+func (lhh *LightHouseHandler) handleHostUpdateNotification(n *NebulaMeta, vpnIp VpnIp, w EncWriter) {
 	if !lhh.lh.amLighthouse {
 		if lhh.l.Level >= logrus.DebugLevel {
 			lhh.l.Debugln("I am not a lighthouse, do not take host updates: ", vpnIp)
@@ -569,9 +867,9 @@ func (lhh *LightHouseHandler) handleHostUpdateNotification(n *NebulaMeta, vpnIp
 	}
 
 	//Simple check that the host sent this not someone else
-	if n.Details.VpnIp != vpnIp {
+	if n.Details.vpnIp() != vpnIp {
 		if lhh.l.Level >= logrus.DebugLevel {
-			lhh.l.WithField("vpnIp", IntIp(vpnIp)).WithField("answer", IntIp(n.Details.VpnIp)).Debugln("Host sent invalid update")
+			lhh.l.WithField("vpnIp", vpnIp).WithField("answer", n.Details.vpnIp()).Debugln("Host sent invalid update")
 		}
 		return
 	}
@@ -583,14 +881,164 @@ func (lhh *LightHouseHandler) handleHostUpdateNotification(n *NebulaMeta, vpnIp
 
 	am.unlockedSetV4(vpnIp, n.Details.Ip4AndPorts, lhh.lh.unlockedShouldAddV4)
 	am.unlockedSetV6(vpnIp, n.Details.Ip6AndPorts, lhh.lh.unlockedShouldAddV6)
+	am.unlockedSetRelay(vpnIp, n.Details.RelayVpnIps)
+	c := am.cache[vpnIp]
+	c.reportedAt = time.Now()
+	c.syncedAt = time.Time{}
 	am.Unlock()
+
+	if len(lhh.lh.syncPeers) > 0 {
+		lhh.sendHostSync([]VpnIp{vpnIp}, lhh.lh.syncPeers, w)
+	}
+}
+
+// handleHostSyncNotification takes the entries another lighthouse heard from hosts directly, each replaces ours only if
+// the host reported to them more recently
+func (lhh *LightHouseHandler) handleHostSyncNotification(n *NebulaMeta, vpnIp VpnIp) {
+	if !lhh.lh.amLighthouse || !lhh.lh.isSyncPeer(vpnIp) {
+		if lhh.l.Level >= logrus.DebugLevel {
+			lhh.l.WithField("vpnIp", vpnIp).Debugln("Ignoring sync from a host that is not a lighthouse sync peer")
+		}
+		return
+	}
+
+	now := time.Now()
+	for _, d := range n.Details.Hosts {
+		lhh.applyHostSync(d, now)
+	}
+}
+
+// applyHostSync takes a single entry from a HostSyncNotification. The age is placed on our own clock, the time the
+// message spent in flight only makes the entry look a little older than it is
+func (lhh *LightHouseHandler) applyHostSync(d *NebulaMetaDetails, now time.Time) {
+	age := time.Duration(d.Age)
+	if age < 0 {
+		// Too large to be a real age
+		return
+	}
+
+	hostVpnIp := d.vpnIp()
+	reportedAt := now.Add(-age)
+
+	lhh.lh.Lock()
+	if d.Name != "" {
+		lhh.lh.unlockedSetName(hostVpnIp, strings.ToLower(d.Name))
+	}
+	am := lhh.lh.unlockedGetRemoteList(hostVpnIp)
+	am.Lock()
+	lhh.lh.Unlock()
+	defer am.Unlock()
+
+	if c := am.cache[hostVpnIp]; c != nil && c.reportedAt.After(reportedAt) {
+		return
+	}
+
+	am.unlockedSetV4(hostVpnIp, d.Ip4AndPorts, lhh.lh.unlockedShouldAddV4)
+	am.unlockedSetV6(hostVpnIp, d.Ip6AndPorts, lhh.lh.unlockedShouldAddV6)
+	am.unlockedSetRelay(hostVpnIp, d.RelayVpnIps)
+	c := am.cache[hostVpnIp]
+	c.reportedAt = reportedAt
+	c.syncedAt = now
+}
+
+// handleHostSyncQuery sends a sync peer every entry that was reported to us directly
+func (lhh *LightHouseHandler) handleHostSyncQuery(vpnIp VpnIp, w EncWriter) {
+	if !lhh.lh.amLighthouse || !lhh.lh.isSyncPeer(vpnIp) {
+		if lhh.l.Level >= logrus.DebugLevel {
+			lhh.l.WithField("vpnIp", vpnIp).Debugln("Ignoring sync query from a host that is not a lighthouse sync peer")
+		}
+		return
+	}
+
+	lhh.lh.RLock()
+	hosts := make([]VpnIp, 0, len(lhh.lh.addrMap))
+	for hostVpnIp := range lhh.lh.addrMap {
+		hosts = append(hosts, hostVpnIp)
+	}
+	lhh.lh.RUnlock()
+
+	lhh.sendHostSync(hosts, map[VpnIp]struct{}{vpnIp: {}}, w)
+}
+
+// sendHostSync sends the addresses the hosts reported to us to the provided sync peers, as many hosts to a message as
+// fit in hostSyncBatchBytes. Entries we got from another peer are not passed along, every peer hears from the source
+func (lhh *LightHouseHandler) sendHostSync(hostVpnIps []VpnIp, peers map[VpnIp]struct{}, w EncWriter) {
+	now := time.Now()
+	n := lhh.resetMeta()
+	n.Type = NebulaMeta_HostSyncNotification
+	size := 0
+
+	for _, hostVpnIp := range hostVpnIps {
+		d := lhh.hostSyncDetails(hostVpnIp, now)
+		if d == nil {
+			continue
+		}
+
+		// Each host also costs a field tag and a length
+		dSize := d.Size() + 4
+		if size+dSize > hostSyncBatchBytes && len(n.Details.Hosts) > 0 {
+			lhh.flushHostSync(n, peers, w)
+			n.Details.Hosts = n.Details.Hosts[:0]
+			size = 0
+		}
+
+		n.Details.Hosts = append(n.Details.Hosts, d)
+		size += dSize
+	}
+
+	if len(n.Details.Hosts) > 0 {
+		lhh.flushHostSync(n, peers, w)
+	}
 }
 
-func (lhh *LightHouseHandler) handleHostPunchNotification(n *NebulaMeta, vpnIp uint32, w EncWriter) {
+// hostSyncDetails returns the entry for a host that reported to us directly, nil if it did not
+func (lhh *LightHouseHandler) hostSyncDetails(hostVpnIp VpnIp, now time.Time) *NebulaMetaDetails {
+	lhh.lh.RLock()
+	name := lhh.lh.hostNames[hostVpnIp]
+	lhh.lh.RUnlock()
+
+	var d *NebulaMetaDetails
+	lhh.lh.queryAndPrepMessage(hostVpnIp, func(c *cache) (int, error) {
+		if !c.syncedAt.IsZero() || c.reportedAt.IsZero() {
+			return 0, nil
+		}
+
+		age := now.Sub(c.reportedAt)
+		if age < 0 {
+			age = 0
+		}
+
+		// Cached addresses are never modified, only replaced, so they are safe to hold on to after the lock is gone
+		d = &NebulaMetaDetails{Age: uint64(age), Name: name}
+		d.setVpnIp(hostVpnIp)
+		lhh.coalesceAnswers(c, &NebulaMeta{Details: d})
+		return 0, nil
+	})
+
+	return d
+}
+
+// flushHostSync sends a HostSyncNotification that has been filled with hosts to the sync peers
+func (lhh *LightHouseHandler) flushHostSync(n *NebulaMeta, peers map[VpnIp]struct{}, w EncWriter) {
+	ln, err := n.MarshalTo(lhh.pb)
+	if err != nil {
+		lhh.l.WithError(err).WithField("hosts", len(n.Details.Hosts)).Error("Failed to marshal lighthouse sync notification")
+		return
+	}
+
+	lhh.lh.metricTx(NebulaMeta_HostSyncNotification, int64(len(peers)))
+	for peer := range peers {
+		w.SendMessageToVpnIp(lightHouse, 0, peer, lhh.pb[:ln], lhh.nb, lhh.out[:0])
+	}
+}
+
+func (lhh *LightHouseHandler) handleHostPunchNotification(n *NebulaMeta, vpnIp VpnIp, w EncWriter) {
 	if !lhh.lh.IsLighthouseIP(vpnIp) {
 		return
 	}
 
+	queryVpnIp := n.Details.vpnIp()
+
 	empty := []byte{0}
 	punch := func(vpnPeer *udpAddr) {
 		if vpnPeer == nil {
@@ -605,7 +1053,7 @@ func (lhh *LightHouseHandler) handleHostPunchNotification(n *NebulaMeta, vpnIp u
 
 		if lhh.l.Level >= logrus.DebugLevel {
 			//TODO: lacking the ip we are actually punching on, old: l.Debugf("Punching %s on %d for %s", IntIp(a.Ip), a.Port, IntIp(n.Details.VpnIp))
-			lhh.l.Debugf("Punching on %d for %s", vpnPeer.Port, IntIp(n.Details.VpnIp))
+			lhh.l.Debugf("Punching on %d for %s", vpnPeer.Port, queryVpnIp)
 		}
 	}
 
@@ -624,18 +1072,119 @@ func (lhh *LightHouseHandler) handleHostPunchNotification(n *NebulaMeta, vpnIp u
 		go func() {
 			time.Sleep(time.Second * 5)
 			if lhh.l.Level >= logrus.DebugLevel {
-				lhh.l.Debugf("Sending a nebula test packet to vpn ip %s", IntIp(n.Details.VpnIp))
+				lhh.l.Debugf("Sending a nebula test packet to vpn ip %s", queryVpnIp)
 			}
 			//NOTE: we have to allocate a new output buffer here since we are spawning a new goroutine
 			// for each punchBack packet. We should move this into a timerwheel or a single goroutine
 			// managed by a channel.
-			w.SendMessageToVpnIp(test, testRequest, n.Details.VpnIp, []byte(""), make([]byte, 12, 12), make([]byte, mtu))
+			w.SendMessageToVpnIp(test, testRequest, queryVpnIp, []byte(""), make([]byte, 12, 12), make([]byte, mtu))
 		}()
 	}
 }
 
-// ipMaskContains checks if testIp is contained by ip after applying a cidr
-// zeros is 32 - bits from net.IPMask.Size()
-func ipMaskContains(ip uint32, zeros uint32, testIp uint32) bool {
-	return (testIp^ip)>>zeros == 0
+func (lhh *LightHouseHandler) handleHostCRLQuery(vpnIp VpnIp, w EncWriter) {
+	if !lhh.lh.amLighthouse {
+		if lhh.l.Level >= logrus.DebugLevel {
+			lhh.l.WithField("vpnIp", vpnIp).Debugln("I don't answer crl queries")
+		}
+		return
+	}
+
+	// Each list goes in its own reply to keep the packets small
+	for _, crl := range lhh.lh.GetCRLs() {
+		n := lhh.resetMeta()
+		n.Type = NebulaMeta_HostCRLReply
+		n.Details.CRLs = append(n.Details.CRLs, crl)
+
+		if n.Size() > len(lhh.pb) {
+			lhh.l.WithField("vpnIp", vpnIp).WithField("size", n.Size()).Error("Crl is too large to send in a lighthouse reply")
+			continue
+		}
+
+		ln, err := n.MarshalTo(lhh.pb)
+		if err != nil {
+			lhh.l.WithError(err).WithField("vpnIp", vpnIp).Error("Failed to marshal lighthouse crl reply")
+			return
+		}
+
+		lhh.lh.metricTx(NebulaMeta_HostCRLReply, 1)
+		w.SendMessageToVpnIp(lightHouse, 0, vpnIp, lhh.pb[:ln], lhh.nb, lhh.out[:0])
+	}
+}
+
+func (lhh *LightHouseHandler) handleHostCRLReply(n *NebulaMeta, vpnIp VpnIp) {
+	if !lhh.lh.IsLighthouseIP(vpnIp) {
+		return
+	}
+
+	if lhh.lh.crlHandler != nil && len(n.Details.CRLs) > 0 {
+		lhh.lh.crlHandler(vpnIp, n.Details.CRLs)
+	}
+}
+
+// handleHostNameQuery answers with the vpn ip of the host that has the certificate name that was asked for
+func (lhh *LightHouseHandler) handleHostNameQuery(n *NebulaMeta, vpnIp VpnIp, w EncWriter) {
+	if !lhh.lh.amLighthouse {
+		if lhh.l.Level >= logrus.DebugLevel {
+			lhh.l.WithField("vpnIp", vpnIp).Debugln("I don't answer name queries")
+		}
+		return
+	}
+
+	name := n.Details.Name
+	lhh.lh.RLock()
+	// An unknown name gets the zero value, which the node takes as not found
+	found := lhh.lh.names[strings.ToLower(name)]
+	lhh.lh.RUnlock()
+
+	n = lhh.resetMeta()
+	n.Type = NebulaMeta_HostNameQueryReply
+	n.Details.Name = name
+	n.Details.setVpnIp(found)
+
+	if n.Size() > len(lhh.pb) {
+		lhh.l.WithField("vpnIp", vpnIp).WithField("size", n.Size()).Error("Name query is too large to answer")
+		return
+	}
+
+	ln, err := n.MarshalTo(lhh.pb)
+	if err != nil {
+		lhh.l.WithError(err).WithField("vpnIp", vpnIp).Error("Failed to marshal lighthouse name query reply")
+		return
+	}
+
+	lhh.lh.metricTx(NebulaMeta_HostNameQueryReply, 1)
+	w.SendMessageToVpnIp(lightHouse, 0, vpnIp, lhh.pb[:ln], lhh.nb, lhh.out[:0])
+}
+
+func (lhh *LightHouseHandler) handleHostNameQueryReply(n *NebulaMeta, vpnIp VpnIp) {
+	if !lhh.lh.IsLighthouseIP(vpnIp) || lhh.lh.nameHandler == nil {
+		return
+	}
+
+	var found VpnIp
+	if n.Details.VpnIp != 0 || n.Details.VpnIp6Hi != 0 || n.Details.VpnIp6Lo != 0 {
+		found = n.Details.vpnIp()
+	}
+	lhh.lh.nameHandler(vpnIp, n.Details.Name, found)
+}
+
+// vpnIp returns the vpn ip carried in the details, preferring the ipv6 fields when they are set
+func (d *NebulaMetaDetails) vpnIp() VpnIp {
+	if d.VpnIp6Hi != 0 || d.VpnIp6Lo != 0 {
+		return VpnIp{Hi: d.VpnIp6Hi, Lo: d.VpnIp6Lo}
+	}
+	return NewVpnIp4(d.VpnIp)
+}
+
+// setVpnIp stores ipv4 addresses in VpnIp so older nodes can still understand us, ipv6 addresses use VpnIp6Hi/VpnIp6Lo
+func (d *NebulaMetaDetails) setVpnIp(ip VpnIp) {
+	if ip.Is4() {
+		d.VpnIp = ip.To4()
+		d.VpnIp6Hi, d.VpnIp6Lo = 0, 0
+		return
+	}
+
+	d.VpnIp = 0
+	d.VpnIp6Hi, d.VpnIp6Lo = ip.Hi, ip.Lo
 }
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"net"
 	"testing"
+	"time"
 
 	"github.com/golang/protobuf/proto"
 	"github.com/stretchr/testify/assert"
@@ -22,7 +23,7 @@ func TestOldIPv4Only(t *testing.T) {
 
 func TestNewLhQuery(t *testing.T) {
 	myIp := net.ParseIP("192.1.1.1")
-	myIpint := ip2int(myIp)
+	myIpint := NewVpnIp(myIp)
 
 	// Generating a new lh query should work
 	a := NewLhQueryByInt(myIpint)
@@ -38,7 +39,18 @@ func TestNewLhQuery(t *testing.T) {
 	n := &NebulaMeta{}
 	err = proto.Unmarshal(b, n)
 	assert.Nil(t, err)
+	assert.Equal(t, myIpint, n.Details.vpnIp())
 
+	// ipv6 vpn ips should round trip as well
+	myIp6 := NewVpnIp(net.ParseIP("fd00::1"))
+	b, err = proto.Marshal(NewLhQueryByInt(myIp6))
+	assert.Nil(t, err)
+
+	n = &NebulaMeta{}
+	err = proto.Unmarshal(b, n)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(0), n.Details.VpnIp)
+	assert.Equal(t, myIp6, n.Details.vpnIp())
 }
 
 func Test_lhStaticMapping(t *testing.T) {
@@ -48,16 +60,16 @@ func Test_lhStaticMapping(t *testing.T) {
 
 	udpServer, _ := NewListener(l, "0.0.0.0", 0, true)
 
-	meh := NewLightHouse(l, true, &net.IPNet{IP: net.IP{0, 0, 0, 1}, Mask: net.IPMask{255, 255, 255, 255}}, []uint32{ip2int(lh1IP)}, 10, 10003, udpServer, false, 1, false)
-	meh.AddStaticRemote(ip2int(lh1IP), NewUDPAddr(lh1IP, uint16(4242)))
+	meh := NewLightHouse(l, true, []*net.IPNet{{IP: net.IP{0, 0, 0, 1}, Mask: net.IPMask{255, 255, 255, 255}}}, []VpnIp{NewVpnIp(lh1IP)}, 10, 10003, udpServer, false, 1, false)
+	meh.AddStaticRemote(NewVpnIp(lh1IP), NewUDPAddr(lh1IP, uint16(4242)))
 	err := meh.ValidateLHStaticEntries()
 	assert.Nil(t, err)
 
 	lh2 := "10.128.0.3"
 	lh2IP := net.ParseIP(lh2)
 
-	meh = NewLightHouse(l, true, &net.IPNet{IP: net.IP{0, 0, 0, 1}, Mask: net.IPMask{255, 255, 255, 255}}, []uint32{ip2int(lh1IP), ip2int(lh2IP)}, 10, 10003, udpServer, false, 1, false)
-	meh.AddStaticRemote(ip2int(lh1IP), NewUDPAddr(lh1IP, uint16(4242)))
+	meh = NewLightHouse(l, true, []*net.IPNet{{IP: net.IP{0, 0, 0, 1}, Mask: net.IPMask{255, 255, 255, 255}}}, []VpnIp{NewVpnIp(lh1IP), NewVpnIp(lh2IP)}, 10, 10003, udpServer, false, 1, false)
+	meh.AddStaticRemote(NewVpnIp(lh1IP), NewUDPAddr(lh1IP, uint16(4242)))
 	err = meh.ValidateLHStaticEntries()
 	assert.EqualError(t, err, "Lighthouse 10.128.0.3 does not have a static_host_map entry")
 }
@@ -69,13 +81,13 @@ func BenchmarkLighthouseHandleRequest(b *testing.B) {
 
 	udpServer, _ := NewListener(l, "0.0.0.0", 0, true)
 
-	lh := NewLightHouse(l, true, &net.IPNet{IP: net.IP{0, 0, 0, 1}, Mask: net.IPMask{0, 0, 0, 0}}, []uint32{ip2int(lh1IP)}, 10, 10003, udpServer, false, 1, false)
+	lh := NewLightHouse(l, true, []*net.IPNet{{IP: net.IP{0, 0, 0, 1}, Mask: net.IPMask{0, 0, 0, 0}}}, []VpnIp{NewVpnIp(lh1IP)}, 10, 10003, udpServer, false, 1, false)
 
 	hAddr := NewUDPAddrFromString("4.5.6.7:12345")
 	hAddr2 := NewUDPAddrFromString("4.5.6.7:12346")
-	lh.addrMap[3] = NewRemoteList()
-	lh.addrMap[3].unlockedSetV4(
-		3,
+	lh.addrMap[NewVpnIp4(3)] = NewRemoteList()
+	lh.addrMap[NewVpnIp4(3)].unlockedSetV4(
+		NewVpnIp4(3),
 		[]*Ip4AndPort{
 			NewIp4AndPort(hAddr.IP, uint32(hAddr.Port)),
 			NewIp4AndPort(hAddr2.IP, uint32(hAddr2.Port)),
@@ -85,9 +97,9 @@ func BenchmarkLighthouseHandleRequest(b *testing.B) {
 
 	rAddr := NewUDPAddrFromString("1.2.2.3:12345")
 	rAddr2 := NewUDPAddrFromString("1.2.2.3:12346")
-	lh.addrMap[2] = NewRemoteList()
-	lh.addrMap[2].unlockedSetV4(
-		3,
+	lh.addrMap[NewVpnIp4(2)] = NewRemoteList()
+	lh.addrMap[NewVpnIp4(2)].unlockedSetV4(
+		NewVpnIp4(3),
 		[]*Ip4AndPort{
 			NewIp4AndPort(rAddr.IP, uint32(rAddr.Port)),
 			NewIp4AndPort(rAddr2.IP, uint32(rAddr2.Port)),
@@ -109,7 +121,7 @@ func BenchmarkLighthouseHandleRequest(b *testing.B) {
 		p, err := proto.Marshal(req)
 		assert.NoError(b, err)
 		for n := 0; n < b.N; n++ {
-			lhh.HandleRequest(rAddr, 2, p, mw)
+			lhh.HandleRequest(rAddr, NewVpnIp4(2), p, mw)
 		}
 	})
 	b.Run("found", func(b *testing.B) {
@@ -125,7 +137,7 @@ func BenchmarkLighthouseHandleRequest(b *testing.B) {
 		assert.NoError(b, err)
 
 		for n := 0; n < b.N; n++ {
-			lhh.HandleRequest(rAddr, 2, p, mw)
+			lhh.HandleRequest(rAddr, NewVpnIp4(2), p, mw)
 		}
 	})
 }
@@ -145,17 +157,17 @@ func TestLighthouse_Memory(t *testing.T) {
 	myUdpAddr9 := &udpAddr{IP: net.ParseIP("192.168.0.2"), Port: 4247}
 	myUdpAddr10 := &udpAddr{IP: net.ParseIP("192.168.0.2"), Port: 4248}
 	myUdpAddr11 := &udpAddr{IP: net.ParseIP("192.168.0.2"), Port: 4249}
-	myVpnIp := ip2int(net.ParseIP("10.128.0.2"))
+	myVpnIp := NewVpnIp(net.ParseIP("10.128.0.2"))
 
 	theirUdpAddr0 := &udpAddr{IP: net.ParseIP("10.0.0.3"), Port: 4242}
 	theirUdpAddr1 := &udpAddr{IP: net.ParseIP("192.168.0.3"), Port: 4242}
 	theirUdpAddr2 := &udpAddr{IP: net.ParseIP("172.16.0.3"), Port: 4242}
 	theirUdpAddr3 := &udpAddr{IP: net.ParseIP("100.152.0.3"), Port: 4242}
 	theirUdpAddr4 := &udpAddr{IP: net.ParseIP("24.15.0.3"), Port: 4242}
-	theirVpnIp := ip2int(net.ParseIP("10.128.0.3"))
+	theirVpnIp := NewVpnIp(net.ParseIP("10.128.0.3"))
 
 	udpServer, _ := NewListener(l, "0.0.0.0", 0, true)
-	lh := NewLightHouse(l, true, &net.IPNet{IP: net.IP{10, 128, 0, 1}, Mask: net.IPMask{255, 255, 255, 0}}, []uint32{}, 10, 10003, udpServer, false, 1, false)
+	lh := NewLightHouse(l, true, []*net.IPNet{{IP: net.IP{10, 128, 0, 1}, Mask: net.IPMask{255, 255, 255, 0}}}, []VpnIp{}, 10, 10003, udpServer, false, 1, false)
 	lhh := lh.NewRequestHandler()
 
 	// Test that my first update responds with just that
@@ -218,13 +230,8 @@ func TestLighthouse_Memory(t *testing.T) {
 	assertIp4InArray(t, r.msg.Details.Ip4AndPorts, good)
 }
 
-func newLHHostRequest(fromAddr *udpAddr, myVpnIp, queryVpnIp uint32, lhh *LightHouseHandler) testLhReply {
-	req := &NebulaMeta{
-		Type: NebulaMeta_HostQuery,
-		Details: &NebulaMetaDetails{
-			VpnIp: queryVpnIp,
-		},
-	}
+func newLHHostRequest(fromAddr *udpAddr, myVpnIp, queryVpnIp VpnIp, lhh *LightHouseHandler) testLhReply {
+	req := NewLhQueryByInt(queryVpnIp)
 
 	b, err := req.Marshal()
 	if err != nil {
@@ -236,14 +243,14 @@ func newLHHostRequest(fromAddr *udpAddr, myVpnIp, queryVpnIp uint32, lhh *LightH
 	return w.lastReply
 }
 
-func newLHHostUpdate(fromAddr *udpAddr, vpnIp uint32, addrs []*udpAddr, lhh *LightHouseHandler) {
+func newLHHostUpdate(fromAddr *udpAddr, vpnIp VpnIp, addrs []*udpAddr, lhh *LightHouseHandler) {
 	req := &NebulaMeta{
 		Type: NebulaMeta_HostUpdateNotification,
 		Details: &NebulaMetaDetails{
-			VpnIp:       vpnIp,
 			Ip4AndPorts: make([]*Ip4AndPort, len(addrs)),
 		},
 	}
+	req.Details.setVpnIp(vpnIp)
 
 	for k, v := range addrs {
 		req.Details.Ip4AndPorts[k] = &Ip4AndPort{Ip: ip2int(v.IP), Port: uint32(v.Port)}
@@ -324,24 +331,264 @@ func newLHHostUpdate(fromAddr *udpAddr, vpnIp uint32, addrs []*udpAddr, lhh *Lig
 //	)
 //}
 
-func Test_ipMaskContains(t *testing.T) {
-	assert.True(t, ipMaskContains(ip2int(net.ParseIP("10.0.0.1")), 32-24, ip2int(net.ParseIP("10.0.0.255"))))
-	assert.False(t, ipMaskContains(ip2int(net.ParseIP("10.0.0.1")), 32-24, ip2int(net.ParseIP("10.0.1.1"))))
-	assert.True(t, ipMaskContains(ip2int(net.ParseIP("10.0.0.1")), 32, ip2int(net.ParseIP("10.0.1.1"))))
+func TestLighthouse_aliases(t *testing.T) {
+	l := NewTestLogger()
+	theirUdpAddr0 := &udpAddr{IP: net.ParseIP("10.0.0.3"), Port: 4242}
+	theirUdpAddr1 := &udpAddr{IP: net.ParseIP("24.15.0.3"), Port: 4242}
+	theirVpnIp := NewVpnIp(net.ParseIP("10.128.0.3"))
+	theirVpnIp6 := NewVpnIp(net.ParseIP("fd00::3"))
+
+	udpServer, _ := NewListener(l, "0.0.0.0", 0, true)
+	lh := NewLightHouse(l, true, []*net.IPNet{{IP: net.IP{10, 128, 0, 1}, Mask: net.IPMask{255, 255, 255, 0}}}, []VpnIp{}, 10, 10003, udpServer, false, 1, false)
+	lhh := lh.NewRequestHandler()
+
+	newLHHostUpdate(theirUdpAddr0, theirVpnIp, []*udpAddr{theirUdpAddr1}, lhh)
+
+	// Without an alias we have no answer for their secondary vpn ip
+	r := newLHHostRequest(theirUdpAddr0, theirVpnIp, theirVpnIp6, lhh)
+	assert.Nil(t, r.msg)
+
+	// Once learned the alias is answered with their primary entry, the last reply is the punch notification
+	lh.AddAliases(theirVpnIp, []VpnIp{theirVpnIp6})
+	r = newLHHostRequest(theirUdpAddr0, theirVpnIp, theirVpnIp6, lhh)
+	assert.Equal(t, theirVpnIp6, r.vpnIp)
+	assertIp4InArray(t, r.msg.Details.Ip4AndPorts, theirUdpAddr1)
+
+	// Deleting the host removes its aliases
+	lh.DeleteVpnIP(theirVpnIp)
+	assert.Empty(t, lh.aliases)
+}
+
+func TestLighthouse_crls(t *testing.T) {
+	l := NewTestLogger()
+	udpAddr := &udpAddr{IP: net.ParseIP("10.0.0.3"), Port: 4242}
+	theirVpnIp := NewVpnIp(net.ParseIP("10.128.0.3"))
+	lhVpnIp := NewVpnIp(net.ParseIP("10.128.0.1"))
+
+	query := &NebulaMeta{Type: NebulaMeta_HostCRLQuery, Details: &NebulaMetaDetails{}}
+	qb, _ := query.Marshal()
+
+	// A lighthouse with nothing to serve stays quiet
+	udpServer, _ := NewListener(l, "0.0.0.0", 0, true)
+	lh := NewLightHouse(l, true, []*net.IPNet{{IP: net.IP{10, 128, 0, 1}, Mask: net.IPMask{255, 255, 255, 0}}}, []VpnIp{}, 10, 10003, udpServer, false, 1, false)
+	lhh := lh.NewRequestHandler()
+	w := &testEncWriter{}
+	lhh.HandleRequest(udpAddr, theirVpnIp, qb, w)
+	assert.Nil(t, w.lastReply.msg)
+
+	lh.SetCRLs([][]byte{[]byte("crl")})
+	lhh.HandleRequest(udpAddr, theirVpnIp, qb, w)
+	assert.Equal(t, theirVpnIp, w.lastReply.vpnIp)
+	assert.Equal(t, NebulaMeta_HostCRLReply, w.lastReply.msg.Type)
+	assert.Equal(t, [][]byte{[]byte("crl")}, w.lastReply.msg.Details.CRLs)
+
+	// A node only takes revocation lists from its lighthouses
+	var got [][]byte
+	node := NewLightHouse(l, false, []*net.IPNet{{IP: net.IP{10, 128, 0, 2}, Mask: net.IPMask{255, 255, 255, 0}}}, []VpnIp{lhVpnIp}, 10, 10003, udpServer, false, 1, false)
+	node.crlHandler = func(vpnIp VpnIp, crls [][]byte) {
+		got = crls
+	}
+	nodeh := node.NewRequestHandler()
+	rb, _ := w.lastReply.msg.Marshal()
+
+	nodeh.HandleRequest(udpAddr, theirVpnIp, rb, w)
+	assert.Nil(t, got)
+
+	nodeh.HandleRequest(udpAddr, lhVpnIp, rb, w)
+	assert.Equal(t, [][]byte{[]byte("crl")}, got)
+
+	// Nodes don't answer queries
+	w = &testEncWriter{}
+	nodeh.HandleRequest(udpAddr, theirVpnIp, qb, w)
+	assert.Nil(t, w.lastReply.msg)
+}
+
+func TestLighthouse_sync(t *testing.T) {
+	l := NewTestLogger()
+	theirUdpAddr0 := &udpAddr{IP: net.ParseIP("10.0.0.3"), Port: 4242}
+	theirUdpAddr1 := &udpAddr{IP: net.ParseIP("24.15.0.3"), Port: 4242}
+	theirUdpAddr2 := &udpAddr{IP: net.ParseIP("24.15.0.4"), Port: 4242}
+	theirVpnIp := NewVpnIp(net.ParseIP("10.128.0.3"))
+	otherVpnIp := NewVpnIp(net.ParseIP("10.128.0.9"))
+	lhAVpnIp := NewVpnIp(net.ParseIP("10.128.0.1"))
+	lhBVpnIp := NewVpnIp(net.ParseIP("10.128.0.2"))
+
+	udpServer, _ := NewListener(l, "0.0.0.0", 0, true)
+	lhA := NewLightHouse(l, true, []*net.IPNet{{IP: net.IP{10, 128, 0, 1}, Mask: net.IPMask{255, 255, 255, 0}}}, []VpnIp{}, 10, 10003, udpServer, false, 1, false)
+	lhA.syncPeers[lhBVpnIp] = struct{}{}
+	lhhA := lhA.NewRequestHandler()
+	lhB := NewLightHouse(l, true, []*net.IPNet{{IP: net.IP{10, 128, 0, 2}, Mask: net.IPMask{255, 255, 255, 0}}}, []VpnIp{}, 10, 10003, udpServer, false, 1, false)
+	lhB.syncPeers[lhAVpnIp] = struct{}{}
+	lhhB := lhB.NewRequestHandler()
+
+	// They report to A, A passes it along to B
+	update := &NebulaMeta{
+		Type:    NebulaMeta_HostUpdateNotification,
+		Details: &NebulaMetaDetails{Ip4AndPorts: []*Ip4AndPort{NewIp4AndPort(theirUdpAddr1.IP, uint32(theirUdpAddr1.Port))}},
+	}
+	update.Details.setVpnIp(theirVpnIp)
+	ub, _ := update.Marshal()
+	wA := &testEncWriter{}
+	lhhA.HandleRequest(theirUdpAddr0, theirVpnIp, ub, wA)
+
+	syncMsg := wA.lastReply.msg
+	assert.Equal(t, lhBVpnIp, wA.lastReply.vpnIp)
+	assert.Equal(t, NebulaMeta_HostSyncNotification, syncMsg.Type)
+	assert.Len(t, syncMsg.Details.Hosts, 1)
+	assert.Equal(t, theirVpnIp, syncMsg.Details.Hosts[0].vpnIp())
+	assert.Less(t, syncMsg.Details.Hosts[0].Age, uint64(time.Minute))
+	sb, _ := syncMsg.Marshal()
+
+	wB := &testEncWriter{}
+	lhhB.HandleRequest(theirUdpAddr0, lhAVpnIp, sb, wB)
+	r := newLHHostRequest(theirUdpAddr0, otherVpnIp, theirVpnIp, lhhB)
+	assertIp4InArray(t, r.msg.Details.Ip4AndPorts, theirUdpAddr1)
+
+	// An older entry does not replace a newer one, age is relative so the clocks of the lighthouses don't matter
+	syncMsg.Details.Hosts[0].Age += uint64(time.Minute)
+	syncMsg.Details.Hosts[0].Ip4AndPorts = []*Ip4AndPort{NewIp4AndPort(theirUdpAddr2.IP, uint32(theirUdpAddr2.Port))}
+	sb, _ = syncMsg.Marshal()
+	lhhB.HandleRequest(theirUdpAddr0, lhAVpnIp, sb, wB)
+	r = newLHHostRequest(theirUdpAddr0, otherVpnIp, theirVpnIp, lhhB)
+	assertIp4InArray(t, r.msg.Details.Ip4AndPorts, theirUdpAddr1)
+
+	// Only sync peers are listened to
+	syncMsg.Details.Hosts[0].Age = 0
+	sb, _ = syncMsg.Marshal()
+	lhhB.HandleRequest(theirUdpAddr0, otherVpnIp, sb, wB)
+	r = newLHHostRequest(theirUdpAddr0, otherVpnIp, theirVpnIp, lhhB)
+	assertIp4InArray(t, r.msg.Details.Ip4AndPorts, theirUdpAddr1)
+
+	lhhB.HandleRequest(theirUdpAddr0, lhAVpnIp, sb, wB)
+	r = newLHHostRequest(theirUdpAddr0, otherVpnIp, theirVpnIp, lhhB)
+	assertIp4InArray(t, r.msg.Details.Ip4AndPorts, theirUdpAddr2)
+
+	// A full syncMsg only includes what was reported directly, and only to syncMsg peers
+	query := &NebulaMeta{Type: NebulaMeta_HostSyncQuery, Details: &NebulaMetaDetails{}}
+	qb, _ := query.Marshal()
+
+	wB = &testEncWriter{}
+	lhhB.HandleRequest(theirUdpAddr0, lhAVpnIp, qb, wB)
+	assert.Nil(t, wB.lastReply.msg)
+
+	wA = &testEncWriter{}
+	lhhA.HandleRequest(theirUdpAddr0, otherVpnIp, qb, wA)
+	assert.Nil(t, wA.lastReply.msg)
+
+	lhhA.HandleRequest(theirUdpAddr0, lhBVpnIp, qb, wA)
+	assert.Equal(t, lhBVpnIp, wA.lastReply.vpnIp)
+	assert.Equal(t, NebulaMeta_HostSyncNotification, wA.lastReply.msg.Type)
+	assert.Len(t, wA.lastReply.msg.Details.Hosts, 1)
+	assert.Equal(t, theirVpnIp, wA.lastReply.msg.Details.Hosts[0].vpnIp())
+	assertIp4InArray(t, wA.lastReply.msg.Details.Hosts[0].Ip4AndPorts, theirUdpAddr1)
+
+	// A large address cache is sent a batch of hosts at a time
+	for i := 0; i < 200; i++ {
+		update.Details.setVpnIp(NewVpnIp4(ip2int(net.IP{10, 128, 1, byte(i)})))
+		ub, _ = update.Marshal()
+		lhhA.HandleRequest(theirUdpAddr0, update.Details.vpnIp(), ub, &testEncWriter{})
+	}
+
+	wA = &testEncWriter{}
+	lhhA.HandleRequest(theirUdpAddr0, lhBVpnIp, qb, wA)
+	assert.True(t, len(wA.replies) > 1 && len(wA.replies) < 201)
+	hosts := 0
+	for _, reply := range wA.replies {
+		b, _ := reply.msg.Marshal()
+		assert.LessOrEqual(t, len(b), hostSyncBatchBytes)
+		hosts += len(reply.msg.Details.Hosts)
+	}
+	assert.Equal(t, 201, hosts)
+
+	// Entries that stop being synced are forgotten, entries reported directly are not
+	lhA.purgeSynced(time.Now().Add(time.Minute))
+	lhB.purgeSynced(time.Now().Add(time.Minute))
+	assert.Contains(t, lhA.addrMap, theirVpnIp)
+	assert.NotContains(t, lhB.addrMap, theirVpnIp)
+}
+
+func TestLighthouse_names(t *testing.T) {
+	l := NewTestLogger()
+	udpAddr := &udpAddr{IP: net.ParseIP("10.0.0.3"), Port: 4242}
+	theirVpnIp := NewVpnIp(net.ParseIP("10.128.0.3"))
+	otherVpnIp := NewVpnIp(net.ParseIP("10.128.0.9"))
+	lhVpnIp := NewVpnIp(net.ParseIP("10.128.0.1"))
+	lhBVpnIp := NewVpnIp(net.ParseIP("10.128.0.2"))
+
+	udpServer, _ := NewListener(l, "0.0.0.0", 0, true)
+	lh := NewLightHouse(l, true, []*net.IPNet{{IP: net.IP{10, 128, 0, 1}, Mask: net.IPMask{255, 255, 255, 0}}}, []VpnIp{}, 10, 10003, udpServer, false, 1, false)
+	lh.syncPeers[lhBVpnIp] = struct{}{}
+	lhh := lh.NewRequestHandler()
+	lh.SetName(theirVpnIp, "Host1")
+
+	query := &NebulaMeta{Type: NebulaMeta_HostNameQuery, Details: &NebulaMetaDetails{Name: "host1"}}
+	qb, _ := query.Marshal()
+	w := &testEncWriter{}
+	lhh.HandleRequest(udpAddr, otherVpnIp, qb, w)
+	assert.Equal(t, otherVpnIp, w.lastReply.vpnIp)
+	assert.Equal(t, NebulaMeta_HostNameQueryReply, w.lastReply.msg.Type)
+	assert.Equal(t, "host1", w.lastReply.msg.Details.Name)
+	assert.Equal(t, theirVpnIp, w.lastReply.msg.Details.vpnIp())
+	found, _ := w.lastReply.msg.Marshal()
+
+	// A node only takes answers from its lighthouses
+	var gotName string
+	var gotVpnIp VpnIp
+	node := NewLightHouse(l, false, []*net.IPNet{{IP: net.IP{10, 128, 0, 4}, Mask: net.IPMask{255, 255, 255, 0}}}, []VpnIp{lhVpnIp}, 10, 10003, udpServer, false, 1, false)
+	node.nameHandler = func(lighthouse VpnIp, name string, vpnIp VpnIp) {
+		assert.Equal(t, lhVpnIp, lighthouse)
+		gotName, gotVpnIp = name, vpnIp
+	}
+	nodeh := node.NewRequestHandler()
+	nodeh.HandleRequest(udpAddr, otherVpnIp, found, w)
+	assert.Empty(t, gotName)
+
+	nodeh.HandleRequest(udpAddr, lhVpnIp, found, w)
+	assert.Equal(t, "host1", gotName)
+	assert.Equal(t, theirVpnIp, gotVpnIp)
+
+	// Unknown names are answered with no vpn ip
+	query.Details.Name = "host2"
+	qb, _ = query.Marshal()
+	lhh.HandleRequest(udpAddr, otherVpnIp, qb, w)
+	assert.Equal(t, "host2", w.lastReply.msg.Details.Name)
+	rb, _ := w.lastReply.msg.Marshal()
+	nodeh.HandleRequest(udpAddr, lhVpnIp, rb, w)
+	assert.Equal(t, "host2", gotName)
+	assert.Equal(t, VpnIp{}, gotVpnIp)
+
+	// Names go along with the sync to other lighthouses
+	update := &NebulaMeta{Type: NebulaMeta_HostUpdateNotification, Details: &NebulaMetaDetails{}}
+	update.Details.setVpnIp(theirVpnIp)
+	ub, _ := update.Marshal()
+	lhh.HandleRequest(udpAddr, theirVpnIp, ub, w)
+	assert.Equal(t, lhBVpnIp, w.lastReply.vpnIp)
+	assert.Equal(t, "host1", w.lastReply.msg.Details.Hosts[0].Name)
+
+	// The name is forgotten along with the host, and nodes don't answer
+	lh.DeleteVpnIP(theirVpnIp)
+	assert.Empty(t, lh.names)
+	assert.Empty(t, lh.hostNames)
+
+	node.SetName(theirVpnIp, "host1")
+	w = &testEncWriter{}
+	nodeh.HandleRequest(udpAddr, otherVpnIp, qb, w)
+	assert.Nil(t, w.lastReply.msg)
 }
 
 type testLhReply struct {
 	nebType    NebulaMessageType
 	nebSubType NebulaMessageSubType
-	vpnIp      uint32
+	vpnIp      VpnIp
 	msg        *NebulaMeta
 }
 
 type testEncWriter struct {
 	lastReply testLhReply
+	replies   []testLhReply
 }
 
-func (tw *testEncWriter) SendMessageToVpnIp(t NebulaMessageType, st NebulaMessageSubType, vpnIp uint32, p, _, _ []byte) {
+func (tw *testEncWriter) SendMessageToVpnIp(t NebulaMessageType, st NebulaMessageSubType, vpnIp VpnIp, p, _, _ []byte) {
 	tw.lastReply = testLhReply{
 		nebType:    t,
 		nebSubType: st,
@@ -353,8 +600,15 @@ func (tw *testEncWriter) SendMessageToVpnIp(t NebulaMessageType, st NebulaMessag
 	if err != nil {
 		panic(err)
 	}
+	tw.replies = append(tw.replies, tw.lastReply)
 }
 
+func (tw *testEncWriter) SendVia(via *HostInfo, relay Relay, ad, nb, out []byte) {
+	return
+}
+
+func (tw *testEncWriter) Handshake(vpnIp VpnIp) {}
+
 // assertIp4InArray asserts every address in want is at the same position in have and that the lengths match
 func assertIp4InArray(t *testing.T, have []*Ip4AndPort, want ...*udpAddr) {
 	assert.Len(t, have, len(want))
@@ -1,7 +1,6 @@
 package nebula
 
 import (
-	"encoding/binary"
 	"fmt"
 	"net"
 	"time"
@@ -62,13 +61,13 @@ func Main(config *Config, configTest bool, buildVersion string, logger *logrus.L
 	}
 	l.WithField("firewallHash", fw.GetRuleHash()).Info("Firewall started")
 
-	// TODO: make sure mask is 4 bytes
-	tunCidr := cs.certificate.Details.Ips[0]
-	routes, err := parseRoutes(config, tunCidr)
+	// The first ip in the certificate is our primary vpn ip, any others are also assigned to the tun device
+	tunCidrs := cs.certificate.Details.Ips
+	routes, err := parseRoutes(config, tunCidrs)
 	if err != nil {
 		return nil, NewContextualError("Could not parse tun.routes", nil, err)
 	}
-	unsafeRoutes, err := parseUnsafeRoutes(config, tunCidr)
+	unsafeRoutes, err := parseUnsafeRoutes(config, tunCidrs)
 	if err != nil {
 		return nil, NewContextualError("Could not parse tun.unsafe_routes", nil, err)
 	}
@@ -83,6 +82,16 @@ func Main(config *Config, configTest bool, buildVersion string, logger *logrus.L
 		}
 	}
 
+	management := newManagementServer(l.WithField("subsystem", "management"))
+	wireManagementReload(l, management, config)
+	var managementStart func()
+	if config.GetBool("management.enabled", false) {
+		managementStart, err = configManagement(management, config)
+		if err != nil {
+			return nil, NewContextualError("Error while configuring the management api", nil, err)
+		}
+	}
+
 	////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
 	// All non system modifying configuration consumption should live above this line
 	// tun config, listeners, anything modifying the computer should be below
@@ -130,12 +139,12 @@ func Main(config *Config, configTest bool, buildVersion string, logger *logrus.L
 
 		switch {
 		case config.GetBool("tun.disabled", false):
-			tun = newDisabledTun(tunCidr, config.GetInt("tun.tx_queue", 500), config.GetBool("stats.message_metrics", false), l)
+			tun = newDisabledTun(tunCidrs, config.GetInt("tun.tx_queue", 500), config.GetBool("stats.message_metrics", false), l)
 		case tunFd != nil:
 			tun, err = newTunFromFd(
 				l,
 				*tunFd,
-				tunCidr,
+				tunCidrs,
 				config.GetInt("tun.mtu", DEFAULT_MTU),
 				routes,
 				unsafeRoutes,
@@ -145,7 +154,7 @@ func Main(config *Config, configTest bool, buildVersion string, logger *logrus.L
 			tun, err = newTun(
 				l,
 				config.GetString("tun.dev", ""),
-				tunCidr,
+				tunCidrs,
 				config.GetInt("tun.mtu", DEFAULT_MTU),
 				routes,
 				unsafeRoutes,
@@ -183,6 +192,17 @@ func Main(config *Config, configTest bool, buildVersion string, logger *logrus.L
 		}
 	}
 
+	tcp, err := newTcpTransport(l, config, port)
+	if err != nil {
+		return nil, NewContextualError("Failed to configure tcp", nil, err)
+	}
+
+	if !configTest {
+		if err = tcp.Listen(); err != nil {
+			return nil, NewContextualError("Failed to open tcp listener", nil, err)
+		}
+	}
+
 	// Set up my internal host map
 	var preferredRanges []*net.IPNet
 	rawPreferredRanges := config.GetStringSlice("preferred_ranges", []string{})
@@ -221,12 +241,16 @@ func Main(config *Config, configTest bool, buildVersion string, logger *logrus.L
 		}
 	}
 
-	hostMap := NewHostMap(l, "main", tunCidr, preferredRanges)
+	hostMap := NewHostMap(l, "main", tunCidrs, preferredRanges)
 
 	hostMap.addUnsafeRoutes(&unsafeRoutes)
 	hostMap.metricsEnabled = config.GetBool("stats.message_metrics", false)
+	hostMap.tunnelMetrics, err = newTunnelMetricsFromConfig(l, config, hostMap)
+	if err != nil {
+		return nil, NewContextualError("Failed to configure per tunnel metrics", nil, err)
+	}
 
-	l.WithField("network", hostMap.vpnCIDR).WithField("preferredRanges", hostMap.preferredRanges).Info("Main HostMap created")
+	l.WithField("network", ipNetsString(hostMap.vpnCIDRs)).WithField("preferredRanges", hostMap.preferredRanges).Info("Main HostMap created")
 
 	/*
 		config.SetDefault("promoter.interval", 10)
@@ -252,22 +276,22 @@ func Main(config *Config, configTest bool, buildVersion string, logger *logrus.L
 		l.Warn("lighthouse.am_lighthouse enabled on node but upstream lighthouses exist in config")
 	}
 
-	lighthouseHosts := make([]uint32, len(rawLighthouseHosts))
+	lighthouseHosts := make([]VpnIp, len(rawLighthouseHosts))
 	for i, host := range rawLighthouseHosts {
 		ip := net.ParseIP(host)
 		if ip == nil {
 			return nil, NewContextualError("Unable to parse lighthouse host entry", m{"host": host, "entry": i + 1}, nil)
 		}
-		if !tunCidr.Contains(ip) {
-			return nil, NewContextualError("lighthouse host is not in our subnet, invalid", m{"vpnIp": ip, "network": tunCidr.String()}, nil)
+		lighthouseHosts[i] = NewVpnIp(ip)
+		if !vpnNetContains(tunCidrs, lighthouseHosts[i]) {
+			return nil, NewContextualError("lighthouse host is not in our subnet, invalid", m{"vpnIp": ip, "network": ipNetsString(tunCidrs)}, nil)
 		}
-		lighthouseHosts[i] = ip2int(ip)
 	}
 
 	lightHouse := NewLightHouse(
 		l,
 		amLighthouse,
-		tunCidr,
+		tunCidrs,
 		lighthouseHosts,
 		//TODO: change to a duration
 		config.GetInt("lighthouse.interval", 10),
@@ -289,29 +313,34 @@ func Main(config *Config, configTest bool, buildVersion string, logger *logrus.L
 		return nil, NewContextualError("Invalid lighthouse.local_allow_list", nil, err)
 	}
 	lightHouse.SetLocalAllowList(localAllowList)
+	lightHouse.crlInterval = config.GetDuration("lighthouse.crl_interval", time.Minute*5)
 
-	//TODO: Move all of this inside functions in lighthouse.go
-	for k, v := range config.GetMap("static_host_map", map[interface{}]interface{}{}) {
-		vpnIp := net.ParseIP(fmt.Sprintf("%v", k))
-		if !tunCidr.Contains(vpnIp) {
-			return nil, NewContextualError("static_host_map key is not in our subnet, invalid", m{"vpnIp": vpnIp, "network": tunCidr.String()}, nil)
-		}
-		vals, ok := v.([]interface{})
-		if ok {
-			for _, v := range vals {
-				ip, port, err := parseIPAndPort(fmt.Sprintf("%v", v))
-				if err != nil {
-					return nil, NewContextualError("Static host address could not be parsed", m{"vpnIp": vpnIp}, err)
-				}
-				lightHouse.AddStaticRemote(ip2int(vpnIp), NewUDPAddr(ip, port))
+	rawSyncPeers := config.GetStringSlice("lighthouse.sync.peers", []string{})
+	if !amLighthouse && len(rawSyncPeers) != 0 {
+		l.Warn("lighthouse.sync.peers is only used when lighthouse.am_lighthouse is enabled")
+	}
+
+	if amLighthouse {
+		for i, peer := range rawSyncPeers {
+			ip := net.ParseIP(peer)
+			if ip == nil {
+				return nil, NewContextualError("Unable to parse lighthouse sync peer entry", m{"peer": peer, "entry": i + 1}, nil)
 			}
-		} else {
-			ip, port, err := parseIPAndPort(fmt.Sprintf("%v", v))
-			if err != nil {
-				return nil, NewContextualError("Static host address could not be parsed", m{"vpnIp": vpnIp}, err)
+			vpnIp := NewVpnIp(ip)
+			if !vpnNetContains(tunCidrs, vpnIp) {
+				return nil, NewContextualError("lighthouse sync peer is not in our subnet, invalid", m{"vpnIp": ip, "network": ipNetsString(tunCidrs)}, nil)
+			}
+			if vpnIp == lightHouse.myVpnIp {
+				continue
 			}
-			lightHouse.AddStaticRemote(ip2int(vpnIp), NewUDPAddr(ip, port))
+			lightHouse.syncPeers[vpnIp] = struct{}{}
 		}
+		lightHouse.syncInterval = config.GetDuration("lighthouse.sync.interval", time.Minute)
+	}
+
+	err = lightHouse.LoadStaticHostMap(config)
+	if err != nil {
+		return nil, err
 	}
 
 	err = lightHouse.ValidateLHStaticEntries()
@@ -319,6 +348,11 @@ func Main(config *Config, configTest bool, buildVersion string, logger *logrus.L
 		l.WithError(err).Error("Lighthouse unreachable")
 	}
 
+	relayManager, err := newRelayManagerFromConfig(l, hostMap, lightHouse, tunCidrs, config)
+	if err != nil {
+		return nil, err
+	}
+
 	var messageMetrics *MessageMetrics
 	if config.GetBool("stats.message_metrics", false) {
 		messageMetrics = newMessageMetrics()
@@ -330,26 +364,59 @@ func Main(config *Config, configTest bool, buildVersion string, logger *logrus.L
 		tryInterval:   config.GetDuration("handshakes.try_interval", DefaultHandshakeTryInterval),
 		retries:       config.GetInt("handshakes.retries", DefaultHandshakeRetries),
 		triggerBuffer: config.GetInt("handshakes.trigger_buffer", DefaultHandshakeTriggerBuffer),
+		// Relays do not use other relays to reach their peers
+		useRelays:  config.GetBool("relay.use_relays", DefaultUseRelays) && !relayManager.GetAmRelay(),
+		rekeyGrace: config.GetDuration("rekey.grace", DefaultRekeyGrace),
 
 		messageMetrics: messageMetrics,
+		tcp:            tcp,
 	}
 
-	handshakeManager := NewHandshakeManager(l, tunCidr, preferredRanges, hostMap, lightHouse, udpConns[0], handshakeConfig)
+	handshakeManager := NewHandshakeManager(l, tunCidrs, preferredRanges, hostMap, lightHouse, udpConns[0], handshakeConfig)
 	lightHouse.handshakeTrigger = handshakeManager.trigger
 
 	//TODO: These will be reused for psk
 	//handshakeMACKey := config.GetString("handshake_mac.key", "")
 	//handshakeAcceptedMACKeys := config.GetStringSlice("handshake_mac.accepted_keys", []string{})
 
-	serveDns := false
+	var ds *dnsServer
 	if config.GetBool("lighthouse.serve_dns", false) {
 		if config.GetBool("lighthouse.am_lighthouse", false) {
-			serveDns = true
+			ds, err = newDnsServer(l, hostMap, config)
+			if err != nil {
+				return nil, NewContextualError("Failed to configure the dns server", nil, err)
+			}
 		} else {
 			l.Warn("DNS server refusing to run because this host is not a lighthouse.")
 		}
 	}
 
+	dnsStub, err := newDnsStub(l, lightHouse, config)
+	if err != nil {
+		return nil, NewContextualError("Failed to configure the dns stub", nil, err)
+	}
+
+	cipher := config.GetString("cipher", "aes")
+	ciphers, err := configCiphers(cipher, config.GetStringSlice("ciphers", []string{}))
+	if err != nil {
+		return nil, err
+	}
+
+	pq, err := configPqMode(config.GetString("handshakes.pq_hybrid", "disabled"))
+	if err != nil {
+		return nil, NewContextualError("Failed to configure handshakes.pq_hybrid", nil, err)
+	}
+
+	rekey, err := newRekeyConfig(config)
+	if err != nil {
+		return nil, NewContextualError("Failed to configure rekey", nil, err)
+	}
+
+	multipath, err := newMultipathConfig(config)
+	if err != nil {
+		return nil, NewContextualError("Failed to configure multipath", nil, err)
+	}
+
 	checkInterval := config.GetInt("timers.connection_alive_interval", 5)
 	pendingDeletionInterval := config.GetInt("timers.pending_deletion_interval", 10)
 	ifConfig := &InterfaceConfig{
@@ -357,11 +424,17 @@ func Main(config *Config, configTest bool, buildVersion string, logger *logrus.L
 		Inside:                  tun,
 		Outside:                 udpConns[0],
 		certState:               cs,
-		Cipher:                  config.GetString("cipher", "aes"),
+		Cipher:                  cipher,
+		Ciphers:                 ciphers,
+		pqMode:                  pq,
+		rekey:                   rekey,
+		multipath:               multipath,
+		tcp:                     tcp,
 		Firewall:                fw,
-		ServeDns:                serveDns,
+		dnsServer:               ds,
 		HandshakeManager:        handshakeManager,
 		lightHouse:              lightHouse,
+		relayManager:            relayManager,
 		checkInterval:           checkInterval,
 		pendingDeletionInterval: pendingDeletionInterval,
 		DropLocalBroadcast:      config.GetBool("tun.drop_local_broadcast", false),
@@ -376,15 +449,6 @@ func Main(config *Config, configTest bool, buildVersion string, logger *logrus.L
 		l:                     l,
 	}
 
-	switch ifConfig.Cipher {
-	case "aes":
-		noiseEndianness = binary.BigEndian
-	case "chachapoly":
-		noiseEndianness = binary.LittleEndian
-	default:
-		return nil, fmt.Errorf("unknown cipher: %v", ifConfig.Cipher)
-	}
-
 	var ifce *Interface
 	if !configTest {
 		ifce, err = NewInterface(ifConfig)
@@ -400,9 +464,20 @@ func Main(config *Config, configTest bool, buildVersion string, logger *logrus.L
 
 		go handshakeManager.Run(ifce)
 		go lightHouse.LhUpdateWorker(ifce)
+
+		lightHouse.crlHandler = ifce.handleCRLs
+		ifce.publishCRLs()
+		go lightHouse.LhCRLWorker(ifce)
+		go lightHouse.LhSyncWorker(ifce)
+		go lightHouse.LhResolveWorker()
+
+		if dnsStub != nil {
+			dnsStub.f = ifce
+			lightHouse.nameHandler = dnsStub.handleReply
+		}
 	}
 
-	statsStart, err := startStats(l, config, buildVersion, configTest)
+	statsStart, err := startStats(l, config, hostMap, buildVersion, configTest)
 	if err != nil {
 		return nil, NewContextualError("Failed to start stats emitter", nil, err)
 	}
@@ -418,10 +493,28 @@ func Main(config *Config, configTest bool, buildVersion string, logger *logrus.L
 
 	// Start DNS server last to allow using the nebula IP as lighthouse.dns.host
 	var dnsStart func()
-	if amLighthouse && serveDns {
+	if ds != nil {
 		l.Debugln("Starting dns server")
-		dnsStart = dnsMain(l, hostMap, config)
+		dnsStart = ds.Start
+	}
+
+	var dnsStubStart func()
+	if dnsStub != nil {
+		dnsStubStart = dnsStub.Start
+	}
+
+	ctrl := &Control{
+		f:               ifce,
+		l:               l,
+		config:          config,
+		sshStart:        sshStart,
+		statsStart:      statsStart,
+		dnsStart:        dnsStart,
+		dnsStubStart:    dnsStubStart,
+		management:      management,
+		managementStart: managementStart,
 	}
+	management.control = ctrl
 
-	return &Control{ifce, l, sshStart, statsStart, dnsStart}, nil
+	return ctrl, nil
 }
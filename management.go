@@ -0,0 +1,407 @@
+package nebula
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// managementServer serves a HTTP+JSON api on a unix socket for local automation. There is no authentication beyond the
+// permissions on the socket file, anyone that can connect has full control over nebula.
+//
+//	GET    /v1/hostmap              list tunnels, ?pending=true for the pending (handshaking) hostmap
+//	GET    /v1/hostmap/<vpn ip>     a single tunnel, ?pending=true to look in the pending hostmap
+//	POST   /v1/hostmap/<vpn ip>     start a handshake, ?address=<ip:port> to try that address instead of the lighthouse
+//	DELETE /v1/hostmap/<vpn ip>     close a tunnel, ?local_only=true to skip notifying the remote end
+//	GET    /v1/lighthouse           the lighthouse address map
+//	GET    /v1/lighthouse/<vpn ip>  the addresses known for a host, a query is sent to the lighthouses as well
+//	POST   /v1/reload               reload the config, same as a HUP
+//	GET    /v1/log-level            the current log level as {"level": "info"}
+//	PUT    /v1/log-level            change the log level, the body is the same as what GET returns
+type managementServer struct {
+	sync.Mutex
+	l        *logrus.Entry
+	control  *Control
+	server   *http.Server
+	listener net.Listener
+	listen   string
+}
+
+type managementLogLevel struct {
+	Level string `json:"level"`
+}
+
+type managementError struct {
+	Error string `json:"error"`
+}
+
+func newManagementServer(l *logrus.Entry) *managementServer {
+	return &managementServer{l: l}
+}
+
+func wireManagementReload(l *logrus.Logger, s *managementServer, c *Config) {
+	c.RegisterReloadCallback(func(c *Config) {
+		if !c.HasChanged("management") {
+			return
+		}
+
+		if c.GetBool("management.enabled", false) {
+			run, err := configManagement(s, c)
+			if err != nil {
+				l.WithError(err).Error("Failed to reconfigure the management api")
+				s.Stop()
+			}
+			if run != nil {
+				go run()
+			}
+		} else {
+			s.Stop()
+		}
+	})
+}
+
+// configManagement reads the management config and stops any running server. On success it returns a function that
+// will run the server with the new config.
+func configManagement(s *managementServer, c *Config) (func(), error) {
+	listen := c.GetString("management.listen", "")
+	if listen == "" {
+		return nil, fmt.Errorf("management.listen must be provided")
+	}
+
+	mode := os.FileMode(0600)
+	switch v := c.Get("management.mode").(type) {
+	case nil:
+	case int:
+		// yaml reads an unquoted 0660 as an octal number
+		mode = os.FileMode(v)
+	case string:
+		m, err := strconv.ParseUint(v, 8, 32)
+		if err != nil {
+			return nil, fmt.Errorf("management.mode could not be parsed as an octal file mode: %s", v)
+		}
+		mode = os.FileMode(m)
+	default:
+		return nil, fmt.Errorf("management.mode could not be parsed as an octal file mode: %v", v)
+	}
+
+	if mode&^os.ModePerm != 0 {
+		return nil, fmt.Errorf("management.mode can only contain permission bits: %o", mode)
+	}
+
+	gid := -1
+	if group := c.GetString("management.group", ""); group != "" {
+		g, err := user.LookupGroup(group)
+		if err != nil {
+			return nil, fmt.Errorf("management.group could not be found: %s", err)
+		}
+
+		gid, err = strconv.Atoi(g.Gid)
+		if err != nil {
+			return nil, fmt.Errorf("management.group is not supported on this platform")
+		}
+	}
+
+	s.Stop()
+	return func() {
+		if err := s.run(listen, mode, gid); err != nil {
+			s.l.WithError(err).WithField("listen", listen).Warn("Failed to run the management api")
+		}
+	}, nil
+}
+
+func (s *managementServer) run(listen string, mode os.FileMode, gid int) error {
+	// Clean up a socket left behind by a previous run, but never one that is still being served
+	if fi, err := os.Lstat(listen); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if conn, err := net.Dial("unix", listen); err == nil {
+			conn.Close()
+			return fmt.Errorf("another process is already listening on %s", listen)
+		}
+		_ = os.Remove(listen)
+	}
+
+	// The socket is created with whatever the umask allows, bind it in a private directory next to listen and only
+	// move it into place once the permissions are set so nobody can connect in between
+	tmpDir, err := ioutil.TempDir(filepath.Dir(listen), ".nebula-mgmt")
+	if err != nil {
+		return fmt.Errorf("failed to create a private directory for the socket: %s", err)
+	}
+
+	tmpListen := filepath.Join(tmpDir, "sock")
+	ln, err := net.Listen("unix", tmpListen)
+	if err == nil {
+		err = placeManagementSocket(ln, tmpListen, listen, mode, gid)
+		if err != nil {
+			ln.Close()
+		}
+	}
+	_ = os.RemoveAll(tmpDir)
+	if err != nil {
+		return err
+	}
+
+	srv := &http.Server{Handler: newManagementHandler(s.l, s.control)}
+
+	s.Lock()
+	s.server = srv
+	s.listener = ln
+	s.listen = listen
+	s.Unlock()
+
+	s.l.WithField("listen", listen).WithField("mode", fmt.Sprintf("%04o", mode)).Info("Management api listening")
+	err = srv.Serve(ln)
+	if errors.Is(err, net.ErrClosed) {
+		return nil
+	}
+	return err
+}
+
+// placeManagementSocket sets the permissions on a freshly bound socket at tmpListen and moves it to listen
+func placeManagementSocket(ln net.Listener, tmpListen, listen string, mode os.FileMode, gid int) error {
+	// Stop removes the socket from where it ends up
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
+
+	err := os.Chmod(tmpListen, mode)
+	if err == nil && gid >= 0 {
+		err = os.Chown(tmpListen, -1, gid)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to set permissions on the socket: %s", err)
+	}
+
+	if err := os.Rename(tmpListen, listen); err != nil {
+		return fmt.Errorf("failed to move the socket into place: %s", err)
+	}
+	return nil
+}
+
+// Stop closes the socket. Requests that are in flight, such as the reload that stopped us, are allowed to finish
+func (s *managementServer) Stop() {
+	if s == nil {
+		return
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	if s.listener == nil {
+		return
+	}
+
+	s.server.SetKeepAlivesEnabled(false)
+	if err := s.listener.Close(); err != nil {
+		s.l.WithError(err).Warn("Failed to close the management api socket")
+	}
+	if err := os.Remove(s.listen); err != nil && !os.IsNotExist(err) {
+		s.l.WithError(err).Warn("Failed to remove the management api socket")
+	}
+
+	s.server = nil
+	s.listener = nil
+	s.l.Info("Management api stopped")
+}
+
+type managementHandler struct {
+	l *logrus.Entry
+	c *Control
+}
+
+func newManagementHandler(l *logrus.Entry, c *Control) http.Handler {
+	h := &managementHandler{l: l, c: c}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/hostmap", h.hostMap)
+	mux.HandleFunc("/v1/hostmap/", h.tunnel)
+	mux.HandleFunc("/v1/lighthouse", h.lighthouse)
+	mux.HandleFunc("/v1/lighthouse/", h.lighthouseQuery)
+	mux.HandleFunc("/v1/reload", h.reload)
+	mux.HandleFunc("/v1/log-level", h.logLevel)
+	return mux
+}
+
+func (h *managementHandler) hostMap(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+
+	pending, ok := queryBool(w, r, "pending")
+	if !ok {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, h.c.ListHostmap(pending))
+}
+
+func (h *managementHandler) tunnel(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet, http.MethodPost, http.MethodDelete) {
+		return
+	}
+
+	vpnIp, ok := pathVpnIp(w, r, "/v1/hostmap/")
+	if !ok {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		pending, ok := queryBool(w, r, "pending")
+		if !ok {
+			return
+		}
+
+		hi := h.c.GetHostInfoByVpnIP(vpnIp, pending)
+		if hi == nil {
+			writeError(w, http.StatusNotFound, "could not find tunnel for vpn ip: %s", vpnIp)
+			return
+		}
+		writeJSON(w, http.StatusOK, hi)
+
+	case http.MethodPost:
+		var addr *udpAddr
+		if a := r.URL.Query().Get("address"); a != "" {
+			ip, port, err := parseIPAndPort(a)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, "address could not be parsed: %s", err)
+				return
+			}
+			addr = NewUDPAddr(ip, port)
+		}
+
+		h.l.WithField("vpnIp", vpnIp).WithField("udpAddr", addr).Info("Creating tunnel from the management api")
+		err := h.c.CreateTunnel(vpnIp, addr)
+		if err != nil {
+			writeError(w, http.StatusConflict, "%s", err)
+			return
+		}
+		writeJSON(w, http.StatusCreated, h.c.GetHostInfoByVpnIP(vpnIp, true))
+
+	case http.MethodDelete:
+		localOnly, ok := queryBool(w, r, "local_only")
+		if !ok {
+			return
+		}
+
+		h.l.WithField("vpnIp", vpnIp).WithField("localOnly", localOnly).Info("Closing tunnel from the management api")
+		if !h.c.CloseTunnel(vpnIp, localOnly) {
+			writeError(w, http.StatusNotFound, "could not find tunnel for vpn ip: %s", vpnIp)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (h *managementHandler) lighthouse(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, h.c.ListLighthouseAddrMap())
+}
+
+func (h *managementHandler) lighthouseQuery(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+
+	vpnIp, ok := pathVpnIp(w, r, "/v1/lighthouse/")
+	if !ok {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, h.c.QueryLighthouse(vpnIp))
+}
+
+func (h *managementHandler) reload(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodPost) {
+		return
+	}
+
+	h.l.Info("Reloading config from the management api")
+	if err := h.c.ReloadConfig(); err != nil {
+		h.l.WithError(err).Error("Error occurred while reloading config")
+		writeError(w, http.StatusInternalServerError, "%s", err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *managementHandler) logLevel(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet, http.MethodPut) {
+		return
+	}
+
+	if r.Method == http.MethodPut {
+		var req managementLogLevel
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "could not parse the request body: %s", err)
+			return
+		}
+
+		level, err := logrus.ParseLevel(req.Level)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "unknown log level %s. possible log levels: %s", req.Level, logrus.AllLevels)
+			return
+		}
+
+		h.l.WithField("level", level).Info("Changing log level from the management api")
+		h.c.l.SetLevel(level)
+	}
+
+	writeJSON(w, http.StatusOK, managementLogLevel{Level: h.c.l.GetLevel().String()})
+}
+
+// allowMethods writes a 405 and returns false if the request method is not one of methods
+func allowMethods(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	for _, m := range methods {
+		if r.Method == m {
+			return true
+		}
+	}
+
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	writeError(w, http.StatusMethodNotAllowed, "method %s is not allowed", r.Method)
+	return false
+}
+
+func pathVpnIp(w http.ResponseWriter, r *http.Request, prefix string) (VpnIp, bool) {
+	s := strings.TrimPrefix(r.URL.Path, prefix)
+	ip := net.ParseIP(s)
+	if ip == nil {
+		writeError(w, http.StatusBadRequest, "the provided vpn ip could not be parsed: %s", s)
+		return VpnIp{}, false
+	}
+
+	return NewVpnIp(ip), true
+}
+
+func queryBool(w http.ResponseWriter, r *http.Request, name string) (bool, bool) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return false, true
+	}
+
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "%s should be true or false", name)
+		return false, false
+	}
+	return b, true
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, format string, a ...interface{}) {
+	writeJSON(w, status, managementError{Error: fmt.Sprintf(format, a...)})
+}
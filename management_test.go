@@ -0,0 +1,198 @@
+package nebula
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestManagementHandler(t *testing.T) {
+	l := NewTestLogger()
+	hm := NewHostMap(l, "test", []*net.IPNet{}, []*net.IPNet{})
+	vpnIp := NewVpnIp(net.IPv4(10, 1, 1, 1))
+	hm.Add(vpnIp, &HostInfo{
+		remote:          NewUDPAddr(net.IPv4(192, 168, 0, 1), 4242),
+		remotes:         NewRemoteList(),
+		ConnectionState: &ConnectionState{},
+		localIndexId:    201,
+		hostId:          vpnIp,
+	})
+
+	lhIp := NewVpnIp(net.IPv4(10, 1, 1, 2))
+	rl := NewRemoteList()
+	rl.unlockedPrependV4(lhIp, NewIp4AndPort(net.IPv4(192, 168, 0, 2), 4242))
+
+	c := &Control{
+		f: &Interface{
+			hostMap:          hm,
+			handshakeManager: &HandshakeManager{pendingHostMap: NewHostMap(l, "pending", []*net.IPNet{}, []*net.IPNet{})},
+			lightHouse:       &LightHouse{amLighthouse: true, addrMap: map[VpnIp]*RemoteList{lhIp: rl}},
+		},
+		l: logrus.New(),
+	}
+	h := newManagementHandler(l.WithField("subsystem", "management"), c)
+
+	do := func(method, target, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(method, target, strings.NewReader(body)))
+		return w
+	}
+
+	// Hostmap
+	w := do(http.MethodGet, "/v1/hostmap", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var hosts []ControlHostInfo
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &hosts))
+	assert.Len(t, hosts, 1)
+	assert.Equal(t, uint32(201), hosts[0].LocalIndex)
+
+	w = do(http.MethodGet, "/v1/hostmap?pending=true", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "[]\n", w.Body.String())
+
+	w = do(http.MethodGet, "/v1/hostmap?pending=sure", "")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, "{\"error\":\"pending should be true or false\"}\n", w.Body.String())
+
+	w = do(http.MethodPost, "/v1/hostmap", "")
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+	assert.Equal(t, "GET", w.Header().Get("Allow"))
+
+	// Single tunnels
+	w = do(http.MethodGet, "/v1/hostmap/10.1.1.1", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var hi ControlHostInfo
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &hi))
+	assert.Equal(t, "10.1.1.1", hi.VpnIP.String())
+
+	w = do(http.MethodGet, "/v1/hostmap/10.1.1.9", "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = do(http.MethodGet, "/v1/hostmap/nope", "")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = do(http.MethodDelete, "/v1/hostmap/10.1.1.9", "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = do(http.MethodPost, "/v1/hostmap/10.1.1.1", "")
+	assert.Equal(t, http.StatusConflict, w.Code)
+	assert.Equal(t, "{\"error\":\"tunnel already exists\"}\n", w.Body.String())
+
+	w = do(http.MethodPost, "/v1/hostmap/10.1.1.9?address=nope", "")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	// Lighthouse
+	w = do(http.MethodGet, "/v1/lighthouse", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var addrMap []ControlLighthouseInfo
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &addrMap))
+	assert.Len(t, addrMap, 1)
+	assert.Equal(t, "10.1.1.2", addrMap[0].VpnIP.String())
+
+	w = do(http.MethodGet, "/v1/lighthouse/10.1.1.2", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `{"ip":"192.168.0.2","port":4242}`)
+
+	w = do(http.MethodGet, "/v1/lighthouse/10.1.1.9", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "null\n", w.Body.String())
+
+	// Log level
+	w = do(http.MethodGet, "/v1/log-level", "")
+	assert.Equal(t, "{\"level\":\"info\"}\n", w.Body.String())
+
+	w = do(http.MethodPut, "/v1/log-level", `{"level": "debug"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "{\"level\":\"debug\"}\n", w.Body.String())
+	assert.Equal(t, logrus.DebugLevel, c.l.GetLevel())
+
+	w = do(http.MethodPut, "/v1/log-level", `{"level": "loud"}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, logrus.DebugLevel, c.l.GetLevel())
+
+	// Reload without a config to reload
+	w = do(http.MethodPost, "/v1/reload", "")
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+}
+
+func TestConfigManagement(t *testing.T) {
+	l := NewTestLogger()
+	dir, err := ioutil.TempDir("", "management-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	listen := filepath.Join(dir, "nebula.sock")
+
+	s := newManagementServer(l.WithField("subsystem", "management"))
+	s.control = &Control{l: logrus.New()}
+
+	c := NewConfig(l)
+	_, err = configManagement(s, c)
+	assert.EqualError(t, err, "management.listen must be provided")
+
+	c.Settings["management"] = map[interface{}]interface{}{"listen": listen, "mode": "0999"}
+	_, err = configManagement(s, c)
+	assert.EqualError(t, err, "management.mode could not be parsed as an octal file mode: 0999")
+
+	c.Settings["management"] = map[interface{}]interface{}{"listen": listen, "mode": 01777}
+	_, err = configManagement(s, c)
+	assert.EqualError(t, err, "management.mode can only contain permission bits: 1777")
+
+	// A socket left behind by a crash is replaced
+	stale, err := net.Listen("unix", listen)
+	assert.NoError(t, err)
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	c.Settings["management"] = map[interface{}]interface{}{"listen": listen, "mode": "0660"}
+	run, err := configManagement(s, c)
+	assert.NoError(t, err)
+	done := make(chan struct{})
+	go func() {
+		run()
+		close(done)
+	}()
+
+	client := http.Client{Transport: &http.Transport{
+		DialContext: func(_ context.Context, _, _ string) (net.Conn, error) {
+			return net.Dial("unix", listen)
+		},
+	}}
+
+	assert.Eventually(t, func() bool {
+		resp, err := client.Get("http://nebula/v1/log-level")
+		if err != nil {
+			return false
+		}
+		resp.Body.Close()
+		return resp.StatusCode == http.StatusOK
+	}, time.Second, 10*time.Millisecond)
+
+	fi, err := os.Stat(listen)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0660), fi.Mode().Perm())
+
+	// The private directory the socket was bound in is gone
+	entries, err := ioutil.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1)
+	assert.Equal(t, "nebula.sock", entries[0].Name())
+
+	// A second server must not take the socket away from a running one
+	assert.EqualError(t, newManagementServer(s.l).run(listen, 0600, -1), "another process is already listening on "+listen)
+
+	s.Stop()
+	<-done
+	_, err = os.Stat(listen)
+	assert.True(t, os.IsNotExist(err))
+}
@@ -38,6 +38,8 @@ func newMessageMetrics() *MessageMetrics {
 		return [][]metrics.Counter{
 			{
 				metrics.GetOrRegisterCounter(fmt.Sprintf("messages.%s.handshake_ixpsk0", t), nil),
+				metrics.NilCounter{},
+				metrics.GetOrRegisterCounter(fmt.Sprintf("messages.%s.handshake_ixpq", t), nil),
 			},
 			nil,
 			{metrics.GetOrRegisterCounter(fmt.Sprintf("messages.%s.recv_error", t), nil)},
@@ -47,6 +49,13 @@ func newMessageMetrics() *MessageMetrics {
 				metrics.GetOrRegisterCounter(fmt.Sprintf("messages.%s.test_response", t), nil),
 			},
 			{metrics.GetOrRegisterCounter(fmt.Sprintf("messages.%s.close_tunnel", t), nil)},
+			nil,
+			nil,
+			{metrics.GetOrRegisterCounter(fmt.Sprintf("messages.%s.control", t), nil)},
+			{
+				metrics.GetOrRegisterCounter(fmt.Sprintf("messages.%s.path_check_request", t), nil),
+				metrics.GetOrRegisterCounter(fmt.Sprintf("messages.%s.path_check_reply", t), nil),
+			},
 		}
 	}
 	return &MessageMetrics{
@@ -81,6 +90,12 @@ func newLighthouseMetrics() *MessageMetrics {
 			NebulaMeta_HostQueryReply,
 			NebulaMeta_HostUpdateNotification,
 			NebulaMeta_HostPunchNotification,
+			NebulaMeta_HostCRLQuery,
+			NebulaMeta_HostCRLReply,
+			NebulaMeta_HostSyncNotification,
+			NebulaMeta_HostSyncQuery,
+			NebulaMeta_HostNameQuery,
+			NebulaMeta_HostNameQueryReply,
 		}
 		for _, i := range used {
 			h[i] = []metrics.Counter{metrics.GetOrRegisterCounter(fmt.Sprintf("lighthouse.%s.%s", t, i.String()), nil)}
@@ -0,0 +1,457 @@
+package nebula
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/bits"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// pathMode is how multipath.mode is configured
+type pathMode int
+
+const (
+	// pathModeOff sends everything to the single remote chosen by the handshake and roaming
+	pathModeOff pathMode = iota
+	// pathModeFailover sticks to the current remote while it answers path checks and moves to another path when not
+	pathModeFailover
+	// pathModeSpread sends packets round robin across every path that answers path checks
+	pathModeSpread
+	// pathModeBest moves the tunnel to the path with the lowest latency and loss
+	pathModeBest
+)
+
+// pathHistory is how many of the most recent path checks count towards a path's loss
+const pathHistory = 16
+
+func (p pathMode) String() string {
+	switch p {
+	case pathModeOff:
+		return "off"
+	case pathModeFailover:
+		return "failover"
+	case pathModeSpread:
+		return "spread"
+	case pathModeBest:
+		return "best"
+	}
+	return fmt.Sprintf("unknown(%d)", int(p))
+}
+
+type multipathConfig struct {
+	mode          pathMode
+	checkInterval time.Duration
+	timeout       time.Duration
+	maxPaths      int
+	// hysteresis is how much cheaper another path has to be before the best mode moves a tunnel to it
+	hysteresis time.Duration
+}
+
+func newMultipathConfig(c *Config) (multipathConfig, error) {
+	mc := multipathConfig{
+		checkInterval: c.GetDuration("multipath.check_interval", time.Second),
+		timeout:       c.GetDuration("multipath.timeout", time.Second*3),
+		maxPaths:      c.GetInt("multipath.max_paths", 4),
+		hysteresis:    c.GetDuration("multipath.hysteresis", time.Millisecond*10),
+	}
+
+	switch c.GetString("multipath.mode", "off") {
+	case "off", "false":
+		mc.mode = pathModeOff
+	case "failover":
+		mc.mode = pathModeFailover
+	case "spread":
+		mc.mode = pathModeSpread
+	case "best":
+		mc.mode = pathModeBest
+	default:
+		return mc, fmt.Errorf("unknown multipath.mode: %v", c.GetString("multipath.mode", "off"))
+	}
+
+	if mc.checkInterval <= 0 {
+		return mc, fmt.Errorf("multipath.check_interval must be greater than 0")
+	}
+	if mc.timeout < mc.checkInterval {
+		return mc, fmt.Errorf("multipath.timeout must not be shorter than multipath.check_interval")
+	}
+	if mc.maxPaths < 1 {
+		return mc, fmt.Errorf("multipath.max_paths must be at least 1")
+	}
+	if mc.hysteresis < 0 {
+		return mc, fmt.Errorf("multipath.hysteresis can not be negative")
+	}
+
+	return mc, nil
+}
+
+// path is one underlay address a host can be reached on
+type path struct {
+	addr *udpAddr
+
+	// checkId identifies the last path check sent on this path, a reply only counts if it echoes it
+	checkId  uint64
+	lastSent time.Time
+	lastSeen time.Time
+	answered bool
+
+	rtt time.Duration
+	// srtt is the smoothed round trip time, weighted the same way tcp does
+	srtt time.Duration
+	// history has a bit set for each of the last checks that was answered, the newest is the lowest bit
+	history uint32
+	checks  int
+}
+
+func (p *path) alive(now time.Time, timeout time.Duration) bool {
+	return !p.lastSeen.IsZero() && now.Sub(p.lastSeen) < timeout
+}
+
+// loss is the fraction of the recent path checks that went unanswered
+func (p *path) loss() float64 {
+	if p.checks == 0 {
+		return 0
+	}
+
+	answered := bits.OnesCount32(p.history & (1<<uint(p.checks) - 1))
+	return float64(p.checks-answered) / float64(p.checks)
+}
+
+// cost is how long it takes on average to get a packet across, counting the retries loss would need
+func (p *path) cost() time.Duration {
+	loss := p.loss()
+	if loss >= 1 {
+		return time.Duration(1<<63 - 1)
+	}
+	return time.Duration(float64(p.srtt) / (1 - loss))
+}
+
+// hostPaths tracks the paths to a single host. It has its own lock so choosing a path for each packet does not
+// contend with the hostinfo lock
+type hostPaths struct {
+	sync.RWMutex
+	mode  pathMode
+	paths []*path
+	// alive is rebuilt whenever a path changes state, it is what packets are sent over
+	alive []*udpAddr
+	next  uint32
+}
+
+func newHostPaths(mode pathMode) *hostPaths {
+	return &hostPaths{mode: mode}
+}
+
+// pick returns the address the next packet should go to. current is the remote the tunnel would use without multipath
+// and is returned until some path has answered a check, which is also what happens with peers that can't answer them
+func (hp *hostPaths) pick(current *udpAddr) *udpAddr {
+	hp.RLock()
+	defer hp.RUnlock()
+
+	if len(hp.alive) == 0 || hp.mode == pathModeBest {
+		// The best mode changes the remote itself, see pathManager.checkHost
+		return current
+	}
+
+	if hp.mode == pathModeSpread {
+		n := atomic.AddUint32(&hp.next, 1)
+		return hp.alive[n%uint32(len(hp.alive))]
+	}
+
+	for _, addr := range hp.alive {
+		if addr.Equals(current) {
+			return current
+		}
+	}
+	return hp.alive[0]
+}
+
+// update replaces the paths with addrs, keeping the state of the ones we already had. It returns the paths and the
+// addresses that came up or went down
+func (hp *hostPaths) update(addrs []*udpAddr, now time.Time, timeout time.Duration) (paths []*path, up, down []*udpAddr) {
+	hp.Lock()
+	defer hp.Unlock()
+
+	paths = make([]*path, 0, len(addrs))
+	for _, addr := range addrs {
+		var p *path
+		for _, old := range hp.paths {
+			if old.addr.Equals(addr) {
+				p = old
+				break
+			}
+		}
+
+		if p == nil {
+			p = &path{addr: addr.Copy()}
+		}
+		paths = append(paths, p)
+	}
+
+	up, down = hp.unlockedSetPaths(paths, now, timeout)
+	return paths, up, down
+}
+
+// handleReply records the answer to a path check, it returns the path if it just came up. The reply is matched on the
+// check id alone, a host with several addresses may answer from a different one than we sent to
+func (hp *hostPaths) handleReply(checkId uint64, now time.Time, timeout time.Duration) *udpAddr {
+	hp.Lock()
+	defer hp.Unlock()
+
+	for _, p := range hp.paths {
+		if p.checkId != checkId || p.answered {
+			continue
+		}
+
+		p.answered = true
+		p.rtt = now.Sub(p.lastSent)
+		if p.srtt == 0 {
+			p.srtt = p.rtt
+		} else {
+			p.srtt = (p.srtt*7 + p.rtt) / 8
+		}
+		p.lastSeen = now
+		up, _ := hp.unlockedSetPaths(hp.paths, now, timeout)
+		if len(up) > 0 {
+			return up[0]
+		}
+		return nil
+	}
+
+	return nil
+}
+
+// startCheck records whether the last check on p was answered and starts a new one with id
+func (hp *hostPaths) startCheck(p *path, id uint64, now time.Time) {
+	hp.Lock()
+	defer hp.Unlock()
+
+	if !p.lastSent.IsZero() {
+		p.history <<= 1
+		if p.answered {
+			p.history |= 1
+		}
+		if p.checks < pathHistory {
+			p.checks++
+		}
+	}
+
+	p.checkId = id
+	p.lastSent = now
+	p.answered = false
+}
+
+// best returns a copy of the path the tunnel should move to, if there is one. A path has to be cheaper than the current
+// remote by more than hysteresis unless the current remote stopped answering
+func (hp *hostPaths) best(current *udpAddr, now time.Time, timeout, hysteresis time.Duration) (path, bool) {
+	hp.RLock()
+	defer hp.RUnlock()
+
+	var best, cur *path
+	for _, p := range hp.paths {
+		if p.addr.Equals(current) {
+			cur = p
+		}
+		if !p.alive(now, timeout) {
+			continue
+		}
+		if best == nil || p.cost() < best.cost() {
+			best = p
+		}
+	}
+
+	if best == nil || best == cur {
+		return path{}, false
+	}
+
+	if cur != nil && cur.alive(now, timeout) && best.cost()+hysteresis >= cur.cost() {
+		return path{}, false
+	}
+
+	return *best, true
+}
+
+// selects reports if the best mode is choosing between paths and addr is one of them, roaming to it would undo that
+// choice
+func (hp *hostPaths) selects(addr *udpAddr) bool {
+	if hp.mode != pathModeBest {
+		return false
+	}
+
+	hp.RLock()
+	defer hp.RUnlock()
+	for _, p := range hp.paths {
+		if p.addr.Equals(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// unlockedSetPaths stores paths and rebuilds the list of alive addresses, returning the addresses that came up or went
+// down since the last time. It assumes you have the lock
+func (hp *hostPaths) unlockedSetPaths(paths []*path, now time.Time, timeout time.Duration) (up, down []*udpAddr) {
+	alive := make([]*udpAddr, 0, len(paths))
+	for _, p := range paths {
+		if p.alive(now, timeout) {
+			alive = append(alive, p.addr)
+		}
+	}
+
+	for _, addr := range alive {
+		if !udpAddrsContain(hp.alive, addr) {
+			up = append(up, addr)
+		}
+	}
+	for _, addr := range hp.alive {
+		if !udpAddrsContain(alive, addr) {
+			down = append(down, addr)
+		}
+	}
+
+	hp.paths = paths
+	hp.alive = alive
+	return up, down
+}
+
+func udpAddrsContain(addrs []*udpAddr, addr *udpAddr) bool {
+	for _, a := range addrs {
+		if a.Equals(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// pathManager sends path checks over every direct path of every tunnel so packets only go over the ones that work, and
+// in the best mode over the one that works best
+type pathManager struct {
+	l      *logrus.Logger
+	f      *Interface
+	config multipathConfig
+
+	atomicCheckId uint64
+}
+
+func newPathManager(l *logrus.Logger, f *Interface, config multipathConfig) *pathManager {
+	return &pathManager{l: l, f: f, config: config}
+}
+
+func (pm *pathManager) Start() {
+	if pm.config.mode == pathModeOff {
+		return
+	}
+	go pm.Run()
+}
+
+func (pm *pathManager) Run() {
+	nb := make([]byte, 12, 12)
+	out := make([]byte, mtu)
+	for now := range time.Tick(pm.config.checkInterval) {
+		pm.check(now, nb, out)
+	}
+}
+
+// check sends a path check on each path of every tunnel
+func (pm *pathManager) check(now time.Time, nb, out []byte) {
+	pm.f.hostMap.RLock()
+	hosts := make([]*HostInfo, 0, len(pm.f.hostMap.Hosts))
+	for _, h := range pm.f.hostMap.Hosts {
+		hosts = append(hosts, h)
+	}
+	pm.f.hostMap.RUnlock()
+
+	for _, h := range hosts {
+		pm.checkHost(h, now, nb, out)
+	}
+}
+
+func (pm *pathManager) checkHost(h *HostInfo, now time.Time, nb, out []byte) {
+	h.RLock()
+	ci, remote, remotes, paths := h.ConnectionState, h.remote, h.remotes, h.paths
+	h.RUnlock()
+
+	if ci == nil || !ci.ready || paths == nil || remote == nil {
+		// Relayed tunnels have no direct paths to check
+		return
+	}
+
+	// The remote the tunnel is on is always a path, it may not be in the remote list yet if the host just roamed
+	addrs := []*udpAddr{remote}
+	for _, addr := range remotes.CopyAddrs(pm.f.hostMap.preferredRanges) {
+		if len(addrs) >= pm.config.maxPaths {
+			break
+		}
+		if !udpAddrsContain(addrs, addr) {
+			addrs = append(addrs, addr)
+		}
+	}
+
+	checks, up, down := paths.update(addrs, now, pm.config.timeout)
+	for _, addr := range down {
+		h.logger(pm.l).WithField("udpAddr", addr).Info("Path is down")
+	}
+	for _, addr := range up {
+		h.logger(pm.l).WithField("udpAddr", addr).Info("Path is up")
+	}
+
+	if pm.config.mode == pathModeBest {
+		pm.selectPath(h, remote, paths, now)
+	}
+
+	b := make([]byte, 8)
+	for _, p := range checks {
+		id := atomic.AddUint64(&pm.atomicCheckId, 1)
+		paths.startCheck(p, id, now)
+
+		binary.BigEndian.PutUint64(b, id)
+		pm.f.send(pathCheck, pathCheckRequest, ci, h, p.addr, b, nb, out)
+	}
+}
+
+// selectPath moves the tunnel to a better path if there is one
+func (pm *pathManager) selectPath(h *HostInfo, remote *udpAddr, paths *hostPaths, now time.Time) {
+	best, ok := paths.best(remote, now, pm.config.timeout, pm.config.hysteresis)
+	if !ok {
+		return
+	}
+
+	h.Lock()
+	defer h.Unlock()
+	if !h.remote.Equals(remote) {
+		// The host roamed while we were looking, the next check will have another look
+		return
+	}
+
+	h.logger(pm.l).WithField("udpAddr", remote).WithField("newAddr", best.addr).
+		WithField("rtt", best.srtt).WithField("loss", best.loss()).
+		Info("Switching to a better path")
+	h.SetRemote(best.addr)
+}
+
+// handlePathCheck answers a path check request on the path it came in on or records the reply to one of ours
+func (f *Interface) handlePathCheck(hostinfo *HostInfo, addr *udpAddr, h *Header, d []byte, nb, out []byte) {
+	if addr == nil {
+		// Paths only make sense for direct traffic
+		return
+	}
+
+	switch h.Subtype {
+	case pathCheckRequest:
+		// d lives in out which send is about to encrypt into, echo a copy of the check id
+		id := make([]byte, len(d))
+		copy(id, d)
+		f.send(pathCheck, pathCheckReply, hostinfo.ConnectionState, hostinfo, addr, id, nb, out)
+
+	case pathCheckReply:
+		if hostinfo.paths == nil || len(d) != 8 {
+			return
+		}
+
+		if up := hostinfo.paths.handleReply(binary.BigEndian.Uint64(d), time.Now(), f.multipath.timeout); up != nil {
+			hostinfo.logger(f.l).WithField("udpAddr", up).Info("Path is up")
+		}
+	}
+}
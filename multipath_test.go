@@ -0,0 +1,199 @@
+package nebula
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewMultipathConfig(t *testing.T) {
+	l := NewTestLogger()
+	c := NewConfig(l)
+
+	mc, err := newMultipathConfig(c)
+	assert.NoError(t, err)
+	assert.Equal(t, multipathConfig{mode: pathModeOff, checkInterval: time.Second, timeout: time.Second * 3, maxPaths: 4, hysteresis: time.Millisecond * 10}, mc)
+
+	c.Settings["multipath"] = map[interface{}]interface{}{"mode": "spread", "check_interval": "500ms", "timeout": "2s", "max_paths": 2}
+	mc, err = newMultipathConfig(c)
+	assert.NoError(t, err)
+	assert.Equal(t, multipathConfig{mode: pathModeSpread, checkInterval: time.Millisecond * 500, timeout: time.Second * 2, maxPaths: 2, hysteresis: time.Millisecond * 10}, mc)
+
+	c.Settings["multipath"] = map[interface{}]interface{}{"mode": "best", "hysteresis": "25ms"}
+	mc, err = newMultipathConfig(c)
+	assert.NoError(t, err)
+	assert.Equal(t, pathModeBest, mc.mode)
+	assert.Equal(t, time.Millisecond*25, mc.hysteresis)
+
+	c.Settings["multipath"] = map[interface{}]interface{}{"mode": "everywhere"}
+	_, err = newMultipathConfig(c)
+	assert.EqualError(t, err, "unknown multipath.mode: everywhere")
+
+	c.Settings["multipath"] = map[interface{}]interface{}{"mode": "failover", "check_interval": "0s"}
+	_, err = newMultipathConfig(c)
+	assert.EqualError(t, err, "multipath.check_interval must be greater than 0")
+
+	c.Settings["multipath"] = map[interface{}]interface{}{"mode": "failover", "check_interval": "5s", "timeout": "1s"}
+	_, err = newMultipathConfig(c)
+	assert.EqualError(t, err, "multipath.timeout must not be shorter than multipath.check_interval")
+
+	c.Settings["multipath"] = map[interface{}]interface{}{"mode": "failover", "max_paths": 0}
+	_, err = newMultipathConfig(c)
+	assert.EqualError(t, err, "multipath.max_paths must be at least 1")
+
+	c.Settings["multipath"] = map[interface{}]interface{}{"mode": "best", "hysteresis": "-1s"}
+	_, err = newMultipathConfig(c)
+	assert.EqualError(t, err, "multipath.hysteresis can not be negative")
+}
+
+func TestHostPaths(t *testing.T) {
+	now := time.Now()
+	timeout := time.Second * 3
+	a := NewUDPAddr(net.ParseIP("1.0.0.1"), 4242)
+	b := NewUDPAddr(net.ParseIP("1.0.0.2"), 4242)
+
+	hp := newHostPaths(pathModeFailover)
+	paths, up, down := hp.update([]*udpAddr{a, b}, now, timeout)
+	assert.Len(t, paths, 2)
+	assert.Empty(t, up)
+	assert.Empty(t, down)
+
+	// Nothing has answered yet, stay on the current remote
+	assert.Equal(t, a, hp.pick(a))
+
+	paths[0].checkId = 1
+	paths[1].checkId = 2
+	assert.Nil(t, hp.handleReply(3, now, timeout))
+	assert.True(t, hp.handleReply(2, now, timeout).Equals(b))
+	assert.Nil(t, hp.handleReply(2, now, timeout), "a path only comes up once")
+
+	// Failover moves off of a remote that is not answering but stays on one that is
+	assert.True(t, hp.pick(a).Equals(b))
+	assert.True(t, hp.handleReply(1, now, timeout).Equals(a))
+	assert.Equal(t, a, hp.pick(a))
+
+	// The paths we already had keep their state
+	paths2, up, down := hp.update([]*udpAddr{b, a}, now.Add(time.Second), timeout)
+	assert.Equal(t, paths[1], paths2[0])
+	assert.Equal(t, paths[0], paths2[1])
+	assert.Empty(t, up)
+	assert.Empty(t, down)
+
+	// Both go down once they stop answering
+	_, up, down = hp.update([]*udpAddr{a, b}, now.Add(timeout), timeout)
+	assert.Empty(t, up)
+	assert.Len(t, down, 2)
+	assert.Equal(t, a, hp.pick(a))
+}
+
+func TestHostPaths_spread(t *testing.T) {
+	now := time.Now()
+	timeout := time.Second * 3
+	a := NewUDPAddr(net.ParseIP("1.0.0.1"), 4242)
+	b := NewUDPAddr(net.ParseIP("1.0.0.2"), 4242)
+
+	hp := newHostPaths(pathModeSpread)
+	paths, _, _ := hp.update([]*udpAddr{a, b}, now, timeout)
+	paths[0].checkId = 1
+	paths[1].checkId = 2
+	hp.handleReply(1, now, timeout)
+	hp.handleReply(2, now, timeout)
+
+	seen := map[string]int{}
+	for i := 0; i < 10; i++ {
+		seen[hp.pick(a).String()]++
+	}
+	assert.Equal(t, map[string]int{a.String(): 5, b.String(): 5}, seen)
+}
+
+func TestPath_quality(t *testing.T) {
+	now := time.Now()
+	hp := newHostPaths(pathModeBest)
+	paths, _, _ := hp.update([]*udpAddr{NewUDPAddr(net.ParseIP("1.0.0.1"), 4242)}, now, time.Second)
+	p := paths[0]
+
+	// Answer 3 out of 4 checks
+	for i := uint64(1); i <= 4; i++ {
+		hp.startCheck(p, i, now)
+		now = now.Add(time.Millisecond * 10)
+		if i != 2 {
+			hp.handleReply(i, now, time.Second)
+		}
+	}
+	// Start one more so the last one is counted
+	hp.startCheck(p, 5, now)
+
+	assert.Equal(t, time.Millisecond*10, p.rtt)
+	assert.Equal(t, time.Millisecond*10, p.srtt)
+	assert.Equal(t, 0.25, p.loss())
+	assert.Equal(t, time.Duration(13333333), p.cost())
+
+	// srtt moves slowly towards a new rtt
+	now = now.Add(time.Millisecond * 100)
+	hp.handleReply(5, now, time.Second)
+	assert.Equal(t, time.Millisecond*100, p.rtt)
+	assert.Equal(t, (time.Millisecond*70+time.Millisecond*100)/8, p.srtt)
+
+	// Only the last pathHistory checks count
+	for i := uint64(6); i < 6+pathHistory; i++ {
+		hp.startCheck(p, i, now)
+		hp.handleReply(i, now, time.Second)
+	}
+	hp.startCheck(p, 100, now)
+	assert.Equal(t, pathHistory, p.checks)
+	assert.Equal(t, float64(0), p.loss())
+}
+
+func TestHostPaths_best(t *testing.T) {
+	now := time.Now()
+	timeout := time.Second * 3
+	hysteresis := time.Millisecond * 10
+	a := NewUDPAddr(net.ParseIP("1.0.0.1"), 4242)
+	b := NewUDPAddr(net.ParseIP("1.0.0.2"), 4242)
+
+	hp := newHostPaths(pathModeBest)
+	paths, _, _ := hp.update([]*udpAddr{a, b}, now, timeout)
+
+	reply := func(p *path, id uint64, rtt time.Duration) {
+		hp.startCheck(p, id, now)
+		hp.handleReply(id, now.Add(rtt), timeout)
+	}
+
+	// Nothing measured yet
+	_, ok := hp.best(a, now, timeout, hysteresis)
+	assert.False(t, ok)
+
+	// b is faster but not by enough
+	reply(paths[0], 1, time.Millisecond*50)
+	reply(paths[1], 2, time.Millisecond*45)
+	_, ok = hp.best(a, now, timeout, hysteresis)
+	assert.False(t, ok)
+
+	// The best mode leaves picking to the path manager
+	assert.Equal(t, a, hp.pick(a))
+
+	// b is now faster by enough
+	paths[1].srtt = time.Millisecond * 30
+	best, ok := hp.best(a, now, timeout, hysteresis)
+	assert.True(t, ok)
+	assert.True(t, best.addr.Equals(b))
+
+	// And never suggests the current path
+	_, ok = hp.best(b, now, timeout, hysteresis)
+	assert.False(t, ok)
+
+	// A current remote that stopped answering is left for any working path
+	paths[0].srtt = time.Millisecond * 30
+	paths[1].srtt = time.Millisecond * 40
+	paths[1].lastSeen = now.Add(time.Second * 2)
+	best, ok = hp.best(a, now.Add(timeout+time.Second), timeout, hysteresis)
+	assert.True(t, ok)
+	assert.True(t, best.addr.Equals(b))
+
+	// Known paths are never roamed to in the best mode
+	assert.True(t, hp.selects(b))
+	assert.False(t, hp.selects(NewUDPAddr(net.ParseIP("1.0.0.3"), 4242)))
+	assert.False(t, newHostPaths(pathModeFailover).selects(a))
+}
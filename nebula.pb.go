@@ -35,19 +35,31 @@ const (
 	NebulaMeta_HostWhoamiReply        NebulaMeta_MessageType = 7
 	NebulaMeta_PathCheck              NebulaMeta_MessageType = 8
 	NebulaMeta_PathCheckReply         NebulaMeta_MessageType = 9
+	NebulaMeta_HostCRLQuery           NebulaMeta_MessageType = 10
+	NebulaMeta_HostCRLReply           NebulaMeta_MessageType = 11
+	NebulaMeta_HostSyncNotification   NebulaMeta_MessageType = 12
+	NebulaMeta_HostSyncQuery          NebulaMeta_MessageType = 13
+	NebulaMeta_HostNameQuery          NebulaMeta_MessageType = 14
+	NebulaMeta_HostNameQueryReply     NebulaMeta_MessageType = 15
 )
 
 var NebulaMeta_MessageType_name = map[int32]string{
-	0: "None",
-	1: "HostQuery",
-	2: "HostQueryReply",
-	3: "HostUpdateNotification",
-	4: "HostMovedNotification",
-	5: "HostPunchNotification",
-	6: "HostWhoami",
-	7: "HostWhoamiReply",
-	8: "PathCheck",
-	9: "PathCheckReply",
+	0:  "None",
+	1:  "HostQuery",
+	2:  "HostQueryReply",
+	3:  "HostUpdateNotification",
+	4:  "HostMovedNotification",
+	5:  "HostPunchNotification",
+	6:  "HostWhoami",
+	7:  "HostWhoamiReply",
+	8:  "PathCheck",
+	9:  "PathCheckReply",
+	10: "HostCRLQuery",
+	11: "HostCRLReply",
+	12: "HostSyncNotification",
+	13: "HostSyncQuery",
+	14: "HostNameQuery",
+	15: "HostNameQueryReply",
 }
 
 var NebulaMeta_MessageType_value = map[string]int32{
@@ -61,6 +73,12 @@ var NebulaMeta_MessageType_value = map[string]int32{
 	"HostWhoamiReply":        7,
 	"PathCheck":              8,
 	"PathCheckReply":         9,
+	"HostCRLQuery":           10,
+	"HostCRLReply":           11,
+	"HostSyncNotification":   12,
+	"HostSyncQuery":          13,
+	"HostNameQuery":          14,
+	"HostNameQueryReply":     15,
 }
 
 func (x NebulaMeta_MessageType) String() string {
@@ -93,7 +111,35 @@ func (x NebulaPing_MessageType) String() string {
 }
 
 func (NebulaPing_MessageType) EnumDescriptor() ([]byte, []int) {
-	return fileDescriptor_2d65afa7693df5ef, []int{4, 0}
+	return fileDescriptor_2d65afa7693df5ef, []int{5, 0}
+}
+
+type NebulaControl_MessageType int32
+
+const (
+	NebulaControl_None                NebulaControl_MessageType = 0
+	NebulaControl_CreateRelayRequest  NebulaControl_MessageType = 1
+	NebulaControl_CreateRelayResponse NebulaControl_MessageType = 2
+)
+
+var NebulaControl_MessageType_name = map[int32]string{
+	0: "None",
+	1: "CreateRelayRequest",
+	2: "CreateRelayResponse",
+}
+
+var NebulaControl_MessageType_value = map[string]int32{
+	"None":                0,
+	"CreateRelayRequest":  1,
+	"CreateRelayResponse": 2,
+}
+
+func (x NebulaControl_MessageType) String() string {
+	return proto.EnumName(NebulaControl_MessageType_name, int32(x))
+}
+
+func (NebulaControl_MessageType) EnumDescriptor() ([]byte, []int) {
+	return fileDescriptor_2d65afa7693df5ef, []int{8, 0}
 }
 
 type NebulaMeta struct {
@@ -153,6 +199,21 @@ type NebulaMetaDetails struct {
 	Ip4AndPorts []*Ip4AndPort `protobuf:"bytes,2,rep,name=Ip4AndPorts,proto3" json:"Ip4AndPorts,omitempty"`
 	Ip6AndPorts []*Ip6AndPort `protobuf:"bytes,4,rep,name=Ip6AndPorts,proto3" json:"Ip6AndPorts,omitempty"`
 	Counter     uint32        `protobuf:"varint,3,opt,name=counter,proto3" json:"counter,omitempty"`
+	// VpnIp6Hi and VpnIp6Lo replace VpnIp when the vpn ip is ipv6
+	VpnIp6Hi uint64 `protobuf:"varint,5,opt,name=VpnIp6Hi,proto3" json:"VpnIp6Hi,omitempty"`
+	VpnIp6Lo uint64 `protobuf:"varint,6,opt,name=VpnIp6Lo,proto3" json:"VpnIp6Lo,omitempty"`
+	// RelayVpnIps are the relays the host can be reached through
+	RelayVpnIps []*VpnAddr `protobuf:"bytes,7,rep,name=RelayVpnIps,proto3" json:"RelayVpnIps,omitempty"`
+	// CRLs are marshaled cert.RawNebulaCRL messages, one per issuing CA
+	CRLs [][]byte `protobuf:"bytes,8,rep,name=CRLs,proto3" json:"CRLs,omitempty"`
+	// Age is how long ago the host last reported itself to the lighthouse sending a HostSyncNotification, in
+	// nanoseconds. It is relative so the clocks of the lighthouses don't have to agree
+	Age uint64 `protobuf:"varint,9,opt,name=Age,proto3" json:"Age,omitempty"`
+	// Name is the certificate name asked about in a HostNameQuery and answered with VpnIp in a HostNameQueryReply, an
+	// unknown name is answered with no VpnIp. Lighthouses also pass it along in a HostSyncNotification
+	Name string `protobuf:"bytes,10,opt,name=Name,proto3" json:"Name,omitempty"`
+	// Hosts are the entries of a HostSyncNotification, each one holds the VpnIp, addresses, relays, Age, and Name of a host
+	Hosts []*NebulaMetaDetails `protobuf:"bytes,11,rep,name=Hosts,proto3" json:"Hosts,omitempty"`
 }
 
 func (m *NebulaMetaDetails) Reset()         { *m = NebulaMetaDetails{} }
@@ -216,6 +277,107 @@ func (m *NebulaMetaDetails) GetCounter() uint32 {
 	return 0
 }
 
+func (m *NebulaMetaDetails) GetVpnIp6Hi() uint64 {
+	if m != nil {
+		return m.VpnIp6Hi
+	}
+	return 0
+}
+
+func (m *NebulaMetaDetails) GetVpnIp6Lo() uint64 {
+	if m != nil {
+		return m.VpnIp6Lo
+	}
+	return 0
+}
+
+func (m *NebulaMetaDetails) GetRelayVpnIps() []*VpnAddr {
+	if m != nil {
+		return m.RelayVpnIps
+	}
+	return nil
+}
+
+func (m *NebulaMetaDetails) GetCRLs() [][]byte {
+	if m != nil {
+		return m.CRLs
+	}
+	return nil
+}
+
+func (m *NebulaMetaDetails) GetAge() uint64 {
+	if m != nil {
+		return m.Age
+	}
+	return 0
+}
+
+func (m *NebulaMetaDetails) GetName() string {
+	if m != nil {
+		return m.Name
+	}
+	return ""
+}
+
+func (m *NebulaMetaDetails) GetHosts() []*NebulaMetaDetails {
+	if m != nil {
+		return m.Hosts
+	}
+	return nil
+}
+
+type VpnAddr struct {
+	Hi uint64 `protobuf:"varint,1,opt,name=Hi,proto3" json:"Hi,omitempty"`
+	Lo uint64 `protobuf:"varint,2,opt,name=Lo,proto3" json:"Lo,omitempty"`
+}
+
+func (m *VpnAddr) Reset()         { *m = VpnAddr{} }
+func (m *VpnAddr) String() string { return proto.CompactTextString(m) }
+func (*VpnAddr) ProtoMessage()    {}
+func (*VpnAddr) Descriptor() ([]byte, []int) {
+	return fileDescriptor_2d65afa7693df5ef, []int{2}
+}
+func (m *VpnAddr) XXX_Unmarshal(b []byte) error {
+	return m.Unmarshal(b)
+}
+func (m *VpnAddr) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	if deterministic {
+		return xxx_messageInfo_VpnAddr.Marshal(b, m, deterministic)
+	} else {
+		b = b[:cap(b)]
+		n, err := m.MarshalToSizedBuffer(b)
+		if err != nil {
+			return nil, err
+		}
+		return b[:n], nil
+	}
+}
+func (m *VpnAddr) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_VpnAddr.Merge(m, src)
+}
+func (m *VpnAddr) XXX_Size() int {
+	return m.Size()
+}
+func (m *VpnAddr) XXX_DiscardUnknown() {
+	xxx_messageInfo_VpnAddr.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_VpnAddr proto.InternalMessageInfo
+
+func (m *VpnAddr) GetHi() uint64 {
+	if m != nil {
+		return m.Hi
+	}
+	return 0
+}
+
+func (m *VpnAddr) GetLo() uint64 {
+	if m != nil {
+		return m.Lo
+	}
+	return 0
+}
+
 type Ip4AndPort struct {
 	Ip   uint32 `protobuf:"varint,1,opt,name=Ip,proto3" json:"Ip,omitempty"`
 	Port uint32 `protobuf:"varint,2,opt,name=Port,proto3" json:"Port,omitempty"`
@@ -225,7 +387,7 @@ func (m *Ip4AndPort) Reset()         { *m = Ip4AndPort{} }
 func (m *Ip4AndPort) String() string { return proto.CompactTextString(m) }
 func (*Ip4AndPort) ProtoMessage()    {}
 func (*Ip4AndPort) Descriptor() ([]byte, []int) {
-	return fileDescriptor_2d65afa7693df5ef, []int{2}
+	return fileDescriptor_2d65afa7693df5ef, []int{3}
 }
 func (m *Ip4AndPort) XXX_Unmarshal(b []byte) error {
 	return m.Unmarshal(b)
@@ -278,7 +440,7 @@ func (m *Ip6AndPort) Reset()         { *m = Ip6AndPort{} }
 func (m *Ip6AndPort) String() string { return proto.CompactTextString(m) }
 func (*Ip6AndPort) ProtoMessage()    {}
 func (*Ip6AndPort) Descriptor() ([]byte, []int) {
-	return fileDescriptor_2d65afa7693df5ef, []int{3}
+	return fileDescriptor_2d65afa7693df5ef, []int{4}
 }
 func (m *Ip6AndPort) XXX_Unmarshal(b []byte) error {
 	return m.Unmarshal(b)
@@ -337,7 +499,7 @@ func (m *NebulaPing) Reset()         { *m = NebulaPing{} }
 func (m *NebulaPing) String() string { return proto.CompactTextString(m) }
 func (*NebulaPing) ProtoMessage()    {}
 func (*NebulaPing) Descriptor() ([]byte, []int) {
-	return fileDescriptor_2d65afa7693df5ef, []int{4}
+	return fileDescriptor_2d65afa7693df5ef, []int{5}
 }
 func (m *NebulaPing) XXX_Unmarshal(b []byte) error {
 	return m.Unmarshal(b)
@@ -389,7 +551,7 @@ func (m *NebulaHandshake) Reset()         { *m = NebulaHandshake{} }
 func (m *NebulaHandshake) String() string { return proto.CompactTextString(m) }
 func (*NebulaHandshake) ProtoMessage()    {}
 func (*NebulaHandshake) Descriptor() ([]byte, []int) {
-	return fileDescriptor_2d65afa7693df5ef, []int{5}
+	return fileDescriptor_2d65afa7693df5ef, []int{6}
 }
 func (m *NebulaHandshake) XXX_Unmarshal(b []byte) error {
 	return m.Unmarshal(b)
@@ -438,13 +600,22 @@ type NebulaHandshakeDetails struct {
 	ResponderIndex uint32 `protobuf:"varint,3,opt,name=ResponderIndex,proto3" json:"ResponderIndex,omitempty"`
 	Cookie         uint64 `protobuf:"varint,4,opt,name=Cookie,proto3" json:"Cookie,omitempty"`
 	Time           uint64 `protobuf:"varint,5,opt,name=Time,proto3" json:"Time,omitempty"`
+	// Ciphers are the ciphers the initiator can use for the tunnel in order of preference, the first is the one the
+	// handshake is done with. The responder answers with only the one it picked
+	Ciphers []string `protobuf:"bytes,6,rep,name=Ciphers,proto3" json:"Ciphers,omitempty"`
+	// PqKey is the ML-KEM encapsulation key the initiator offers in a hybrid handshake, PqCiphertext is the responder's
+	// answer to it. The secret they share is mixed into the tunnel keys
+	PqKey        []byte `protobuf:"bytes,7,opt,name=PqKey,proto3" json:"PqKey,omitempty"`
+	PqCiphertext []byte `protobuf:"bytes,8,opt,name=PqCiphertext,proto3" json:"PqCiphertext,omitempty"`
+	// CertChain holds the intermediate CA certificates that lead from Cert to a root, when Cert was not signed by a root
+	CertChain [][]byte `protobuf:"bytes,9,rep,name=CertChain,proto3" json:"CertChain,omitempty"`
 }
 
 func (m *NebulaHandshakeDetails) Reset()         { *m = NebulaHandshakeDetails{} }
 func (m *NebulaHandshakeDetails) String() string { return proto.CompactTextString(m) }
 func (*NebulaHandshakeDetails) ProtoMessage()    {}
 func (*NebulaHandshakeDetails) Descriptor() ([]byte, []int) {
-	return fileDescriptor_2d65afa7693df5ef, []int{6}
+	return fileDescriptor_2d65afa7693df5ef, []int{7}
 }
 func (m *NebulaHandshakeDetails) XXX_Unmarshal(b []byte) error {
 	return m.Unmarshal(b)
@@ -508,58 +679,184 @@ func (m *NebulaHandshakeDetails) GetTime() uint64 {
 	return 0
 }
 
+func (m *NebulaHandshakeDetails) GetCiphers() []string {
+	if m != nil {
+		return m.Ciphers
+	}
+	return nil
+}
+
+func (m *NebulaHandshakeDetails) GetPqKey() []byte {
+	if m != nil {
+		return m.PqKey
+	}
+	return nil
+}
+
+func (m *NebulaHandshakeDetails) GetPqCiphertext() []byte {
+	if m != nil {
+		return m.PqCiphertext
+	}
+	return nil
+}
+
+func (m *NebulaHandshakeDetails) GetCertChain() [][]byte {
+	if m != nil {
+		return m.CertChain
+	}
+	return nil
+}
+
+type NebulaControl struct {
+	Type                NebulaControl_MessageType `protobuf:"varint,1,opt,name=Type,proto3,enum=nebula.NebulaControl_MessageType" json:"Type,omitempty"`
+	InitiatorRelayIndex uint32                    `protobuf:"varint,2,opt,name=InitiatorRelayIndex,proto3" json:"InitiatorRelayIndex,omitempty"`
+	ResponderRelayIndex uint32                    `protobuf:"varint,3,opt,name=ResponderRelayIndex,proto3" json:"ResponderRelayIndex,omitempty"`
+	RelayToIp           *VpnAddr                  `protobuf:"bytes,4,opt,name=RelayToIp,proto3" json:"RelayToIp,omitempty"`
+	RelayFromIp         *VpnAddr                  `protobuf:"bytes,5,opt,name=RelayFromIp,proto3" json:"RelayFromIp,omitempty"`
+}
+
+func (m *NebulaControl) Reset()         { *m = NebulaControl{} }
+func (m *NebulaControl) String() string { return proto.CompactTextString(m) }
+func (*NebulaControl) ProtoMessage()    {}
+func (*NebulaControl) Descriptor() ([]byte, []int) {
+	return fileDescriptor_2d65afa7693df5ef, []int{8}
+}
+func (m *NebulaControl) XXX_Unmarshal(b []byte) error {
+	return m.Unmarshal(b)
+}
+func (m *NebulaControl) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	if deterministic {
+		return xxx_messageInfo_NebulaControl.Marshal(b, m, deterministic)
+	} else {
+		b = b[:cap(b)]
+		n, err := m.MarshalToSizedBuffer(b)
+		if err != nil {
+			return nil, err
+		}
+		return b[:n], nil
+	}
+}
+func (m *NebulaControl) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_NebulaControl.Merge(m, src)
+}
+func (m *NebulaControl) XXX_Size() int {
+	return m.Size()
+}
+func (m *NebulaControl) XXX_DiscardUnknown() {
+	xxx_messageInfo_NebulaControl.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_NebulaControl proto.InternalMessageInfo
+
+func (m *NebulaControl) GetType() NebulaControl_MessageType {
+	if m != nil {
+		return m.Type
+	}
+	return NebulaControl_None
+}
+
+func (m *NebulaControl) GetInitiatorRelayIndex() uint32 {
+	if m != nil {
+		return m.InitiatorRelayIndex
+	}
+	return 0
+}
+
+func (m *NebulaControl) GetResponderRelayIndex() uint32 {
+	if m != nil {
+		return m.ResponderRelayIndex
+	}
+	return 0
+}
+
+func (m *NebulaControl) GetRelayToIp() *VpnAddr {
+	if m != nil {
+		return m.RelayToIp
+	}
+	return nil
+}
+
+func (m *NebulaControl) GetRelayFromIp() *VpnAddr {
+	if m != nil {
+		return m.RelayFromIp
+	}
+	return nil
+}
+
 func init() {
 	proto.RegisterEnum("nebula.NebulaMeta_MessageType", NebulaMeta_MessageType_name, NebulaMeta_MessageType_value)
 	proto.RegisterEnum("nebula.NebulaPing_MessageType", NebulaPing_MessageType_name, NebulaPing_MessageType_value)
+	proto.RegisterEnum("nebula.NebulaControl_MessageType", NebulaControl_MessageType_name, NebulaControl_MessageType_value)
 	proto.RegisterType((*NebulaMeta)(nil), "nebula.NebulaMeta")
 	proto.RegisterType((*NebulaMetaDetails)(nil), "nebula.NebulaMetaDetails")
+	proto.RegisterType((*VpnAddr)(nil), "nebula.VpnAddr")
 	proto.RegisterType((*Ip4AndPort)(nil), "nebula.Ip4AndPort")
 	proto.RegisterType((*Ip6AndPort)(nil), "nebula.Ip6AndPort")
 	proto.RegisterType((*NebulaPing)(nil), "nebula.NebulaPing")
 	proto.RegisterType((*NebulaHandshake)(nil), "nebula.NebulaHandshake")
 	proto.RegisterType((*NebulaHandshakeDetails)(nil), "nebula.NebulaHandshakeDetails")
+	proto.RegisterType((*NebulaControl)(nil), "nebula.NebulaControl")
 }
 
 func init() { proto.RegisterFile("nebula.proto", fileDescriptor_2d65afa7693df5ef) }
 
 var fileDescriptor_2d65afa7693df5ef = []byte{
-	// 570 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x7c, 0x54, 0x41, 0x6f, 0xda, 0x4c,
-	0x10, 0x65, 0x8d, 0x21, 0xc9, 0x90, 0x10, 0x7f, 0xfb, 0xb5, 0x08, 0x7a, 0xb0, 0x22, 0x1f, 0x2a,
-	0x4e, 0xa4, 0x82, 0x08, 0xf5, 0xd8, 0x96, 0x1e, 0x40, 0x0a, 0x88, 0x5a, 0x69, 0x2b, 0xf5, 0x52,
-	0x2d, 0xf6, 0x16, 0xaf, 0x80, 0x5d, 0xd7, 0x5e, 0xaa, 0xf0, 0x2f, 0xfa, 0x33, 0x7a, 0xeb, 0xdf,
-	0xe8, 0xa1, 0x87, 0x1c, 0x7a, 0xe8, 0xb1, 0x82, 0x3f, 0x52, 0xed, 0xda, 0xd8, 0x04, 0xa2, 0xde,
-	0xe6, 0xcd, 0xbc, 0x37, 0x3b, 0x3c, 0x3f, 0x01, 0xa7, 0x9c, 0x4e, 0x96, 0x73, 0xd2, 0x0a, 0x23,
-	0x21, 0x05, 0x2e, 0x27, 0xc8, 0xf9, 0x69, 0x00, 0x8c, 0x74, 0x39, 0xa4, 0x92, 0xe0, 0x36, 0x98,
-	0x37, 0xab, 0x90, 0xd6, 0xd1, 0x05, 0x6a, 0x56, 0xdb, 0x76, 0x2b, 0xd5, 0xe4, 0x8c, 0xd6, 0x90,
-	0xc6, 0x31, 0x99, 0x52, 0xc5, 0x72, 0x35, 0x17, 0x77, 0xe0, 0xe8, 0x35, 0x95, 0x84, 0xcd, 0xe3,
-	0xba, 0x71, 0x81, 0x9a, 0x95, 0x76, 0xe3, 0x50, 0x96, 0x12, 0xdc, 0x2d, 0xd3, 0xf9, 0x85, 0xa0,
-	0xb2, 0xb3, 0x0a, 0x1f, 0x83, 0x39, 0x12, 0x9c, 0x5a, 0x05, 0x7c, 0x06, 0x27, 0x7d, 0x11, 0xcb,
-	0x37, 0x4b, 0x1a, 0xad, 0x2c, 0x84, 0x31, 0x54, 0x33, 0xe8, 0xd2, 0x70, 0xbe, 0xb2, 0x0c, 0xfc,
-	0x04, 0x6a, 0xaa, 0xf7, 0x36, 0xf4, 0x89, 0xa4, 0x23, 0x21, 0xd9, 0x27, 0xe6, 0x11, 0xc9, 0x04,
-	0xb7, 0x8a, 0xb8, 0x01, 0x8f, 0xd5, 0x6c, 0x28, 0xbe, 0x50, 0xff, 0xde, 0xc8, 0xdc, 0x8e, 0xc6,
-	0x4b, 0xee, 0x05, 0xf7, 0x46, 0x25, 0x5c, 0x05, 0x50, 0xa3, 0xf7, 0x81, 0x20, 0x0b, 0x66, 0x95,
-	0xf1, 0xff, 0x70, 0x9e, 0xe3, 0xe4, 0xd9, 0x23, 0x75, 0xd9, 0x98, 0xc8, 0xa0, 0x17, 0x50, 0x6f,
-	0x66, 0x1d, 0xab, 0xcb, 0x32, 0x98, 0x50, 0x4e, 0x9c, 0xef, 0x08, 0xfe, 0x3b, 0xf8, 0xd5, 0xf8,
-	0x11, 0x94, 0xde, 0x85, 0x7c, 0x10, 0x6a, 0x5b, 0xcf, 0xdc, 0x04, 0xe0, 0x2b, 0xa8, 0x0c, 0xc2,
-	0xab, 0x97, 0xdc, 0x1f, 0x8b, 0x48, 0x2a, 0xef, 0x8a, 0xcd, 0x4a, 0x1b, 0x6f, 0xbd, 0xcb, 0x47,
-	0xee, 0x2e, 0x2d, 0x51, 0x75, 0x33, 0x95, 0xb9, 0xaf, 0xea, 0xee, 0xa8, 0x32, 0x1a, 0xae, 0xc3,
-	0x91, 0x27, 0x96, 0x5c, 0xd2, 0xa8, 0x5e, 0xd4, 0x37, 0x6c, 0xa1, 0xf3, 0x0c, 0x20, 0x5f, 0x8f,
-	0xab, 0x60, 0x64, 0x67, 0x1a, 0x83, 0x10, 0x63, 0x30, 0x55, 0x5f, 0x7f, 0xd8, 0x33, 0x57, 0xd7,
-	0xce, 0x0b, 0xa5, 0xe8, 0xee, 0x28, 0xfa, 0x4c, 0x2b, 0x4c, 0xd7, 0xe8, 0x33, 0x85, 0xaf, 0x85,
-	0xe6, 0x9b, 0xae, 0x71, 0x2d, 0xb2, 0x0d, 0xc5, 0x9d, 0x0d, 0xb7, 0xdb, 0xcc, 0x8d, 0x19, 0x9f,
-	0xfe, 0x3b, 0x73, 0x8a, 0xf1, 0x40, 0xe6, 0x30, 0x98, 0x37, 0x6c, 0x41, 0xd3, 0x77, 0x74, 0xed,
-	0x38, 0x07, 0x89, 0x52, 0x62, 0xab, 0x80, 0x4f, 0xa0, 0x94, 0x7c, 0x1f, 0xe4, 0x7c, 0x84, 0xf3,
-	0x64, 0x6f, 0x9f, 0x70, 0x3f, 0x0e, 0xc8, 0x8c, 0xe2, 0xe7, 0x79, 0x7c, 0x91, 0x8e, 0xef, 0xde,
-	0x05, 0x19, 0x73, 0x3f, 0xc3, 0xea, 0x88, 0xfe, 0x82, 0x78, 0xfa, 0x88, 0x53, 0x57, 0xd7, 0xce,
-	0x37, 0x04, 0xb5, 0x87, 0x75, 0x8a, 0xde, 0xa3, 0x91, 0xd4, 0xaf, 0x9c, 0xba, 0xba, 0xc6, 0x4f,
-	0xa1, 0x3a, 0xe0, 0x4c, 0x32, 0x22, 0x45, 0x34, 0xe0, 0x3e, 0xbd, 0x4d, 0x9d, 0xde, 0xeb, 0x2a,
-	0x9e, 0x4b, 0xe3, 0x50, 0x70, 0x9f, 0xa6, 0xbc, 0xc4, 0xcf, 0xbd, 0x2e, 0xae, 0x41, 0xb9, 0x27,
-	0xc4, 0x8c, 0xd1, 0xba, 0xa9, 0x9d, 0x49, 0x51, 0xe6, 0x57, 0x29, 0xf7, 0xeb, 0x55, 0xe7, 0xc7,
-	0xda, 0x46, 0x77, 0x6b, 0x1b, 0xfd, 0x59, 0xdb, 0xe8, 0xeb, 0xc6, 0x2e, 0xdc, 0x6d, 0xec, 0xc2,
-	0xef, 0x8d, 0x5d, 0xf8, 0xd0, 0x98, 0x32, 0x19, 0x2c, 0x27, 0x2d, 0x4f, 0x2c, 0x2e, 0xe3, 0x39,
-	0xf1, 0x66, 0xc1, 0xe7, 0xcb, 0xc4, 0x93, 0x49, 0x59, 0xff, 0x7d, 0x74, 0xfe, 0x06, 0x00, 0x00,
-	0xff, 0xff, 0x20, 0x00, 0x2b, 0x46, 0x4e, 0x04, 0x00, 0x00,
+	// 873 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x84, 0x55, 0x4b, 0x6f, 0xe3, 0x54,
+	0x14, 0xae, 0x1f, 0x79, 0xf8, 0xe4, 0x51, 0xcf, 0xe9, 0x10, 0x6e, 0x47, 0x28, 0x0a, 0x5e, 0xa0,
+	0xb0, 0xa0, 0x1d, 0xda, 0xa1, 0x62, 0x49, 0x09, 0x42, 0x89, 0x48, 0xab, 0x70, 0x29, 0x83, 0xc4,
+	0x06, 0xb9, 0xc9, 0xa5, 0xb6, 0x9a, 0xf8, 0xba, 0xf6, 0x0d, 0x6a, 0x7e, 0x00, 0x7b, 0xd6, 0xfc,
+	0xa2, 0x59, 0x76, 0x85, 0x58, 0xa2, 0xf6, 0x8f, 0xa0, 0x7b, 0x6f, 0xfc, 0x48, 0x1a, 0x86, 0xdd,
+	0x79, 0x7c, 0xdf, 0xf1, 0x97, 0xef, 0xf8, 0x38, 0xd0, 0x8c, 0xd8, 0xf5, 0x72, 0xee, 0x1f, 0xc5,
+	0x09, 0x17, 0x1c, 0xab, 0x3a, 0xf3, 0xde, 0x59, 0x00, 0x97, 0x2a, 0xbc, 0x60, 0xc2, 0xc7, 0x13,
+	0xb0, 0xaf, 0x56, 0x31, 0x23, 0x46, 0xcf, 0xe8, 0xb7, 0x4f, 0xba, 0x47, 0x6b, 0x4e, 0x81, 0x38,
+	0xba, 0x60, 0x69, 0xea, 0xdf, 0x30, 0x89, 0xa2, 0x0a, 0x8b, 0xa7, 0x50, 0xfb, 0x86, 0x09, 0x3f,
+	0x9c, 0xa7, 0xc4, 0xec, 0x19, 0xfd, 0xc6, 0xc9, 0xe1, 0x73, 0xda, 0x1a, 0x40, 0x33, 0xa4, 0xf7,
+	0x60, 0x42, 0xa3, 0x34, 0x0a, 0xeb, 0x60, 0x5f, 0xf2, 0x88, 0xb9, 0x7b, 0xd8, 0x02, 0x67, 0xc8,
+	0x53, 0xf1, 0xfd, 0x92, 0x25, 0x2b, 0xd7, 0x40, 0x84, 0x76, 0x9e, 0x52, 0x16, 0xcf, 0x57, 0xae,
+	0x89, 0xaf, 0xa0, 0x23, 0x6b, 0x3f, 0xc6, 0x33, 0x5f, 0xb0, 0x4b, 0x2e, 0xc2, 0x5f, 0xc3, 0xa9,
+	0x2f, 0x42, 0x1e, 0xb9, 0x16, 0x1e, 0xc2, 0x07, 0xb2, 0x77, 0xc1, 0x7f, 0x63, 0xb3, 0x8d, 0x96,
+	0x9d, 0xb5, 0x26, 0xcb, 0x68, 0x1a, 0x6c, 0xb4, 0x2a, 0xd8, 0x06, 0x90, 0xad, 0x9f, 0x02, 0xee,
+	0x2f, 0x42, 0xb7, 0x8a, 0x07, 0xb0, 0x5f, 0xe4, 0xfa, 0xb1, 0x35, 0xa9, 0x6c, 0xe2, 0x8b, 0x60,
+	0x10, 0xb0, 0xe9, 0xad, 0x5b, 0x97, 0xca, 0xf2, 0x54, 0x43, 0x1c, 0x74, 0xa1, 0x29, 0x79, 0x03,
+	0x3a, 0xd6, 0xfa, 0xa1, 0x54, 0xd1, 0x98, 0x06, 0x12, 0x78, 0x29, 0x2b, 0x3f, 0xac, 0xa2, 0xe9,
+	0x86, 0x8a, 0x26, 0xbe, 0x80, 0x56, 0xd6, 0xd1, 0xf4, 0x56, 0x56, 0xba, 0xf4, 0x17, 0x4c, 0x97,
+	0xda, 0xd8, 0x01, 0xdc, 0x28, 0xe9, 0xb9, 0xfb, 0xde, 0xef, 0x16, 0xbc, 0x78, 0xe6, 0x38, 0xbe,
+	0x84, 0xca, 0xdb, 0x38, 0x1a, 0xc5, 0x6a, 0xa5, 0x2d, 0xaa, 0x13, 0x7c, 0x03, 0x8d, 0x51, 0xfc,
+	0xe6, 0x3c, 0x9a, 0x4d, 0x78, 0x22, 0xe4, 0xde, 0xac, 0x7e, 0xe3, 0x04, 0xb3, 0xbd, 0x15, 0x2d,
+	0x5a, 0x86, 0x69, 0xd6, 0x59, 0xce, 0xb2, 0xb7, 0x59, 0x67, 0x25, 0x56, 0x0e, 0x43, 0x02, 0xb5,
+	0x29, 0x5f, 0x46, 0x82, 0x25, 0xc4, 0x52, 0x1a, 0xb2, 0x14, 0x5f, 0x41, 0x5d, 0xc9, 0x39, 0x1b,
+	0x86, 0xa4, 0xd2, 0x33, 0xfa, 0x36, 0xcd, 0xf3, 0xa2, 0x37, 0xe6, 0xa4, 0x5a, 0xee, 0x8d, 0x39,
+	0x7e, 0x0e, 0x0d, 0xca, 0xe6, 0xfe, 0x4a, 0x15, 0x52, 0x52, 0x53, 0x3a, 0xf6, 0x33, 0x1d, 0x6f,
+	0xe3, 0xe8, 0x7c, 0x36, 0x4b, 0x68, 0x19, 0x83, 0x08, 0xf6, 0x80, 0x8e, 0x53, 0x52, 0xef, 0x59,
+	0xfd, 0x26, 0x55, 0x31, 0xba, 0x60, 0x9d, 0xdf, 0x30, 0xe2, 0xa8, 0xe9, 0x32, 0x94, 0x28, 0x69,
+	0x2b, 0x81, 0x9e, 0xd1, 0x77, 0xa8, 0x8a, 0xf1, 0x18, 0x2a, 0xd2, 0xee, 0x94, 0x34, 0x7a, 0xd6,
+	0xfb, 0x5f, 0x6e, 0x8d, 0xf3, 0x3e, 0x85, 0xda, 0x5a, 0x02, 0xb6, 0xc1, 0x1c, 0x86, 0xca, 0x79,
+	0x9b, 0x9a, 0xc3, 0x50, 0xe6, 0x63, 0xae, 0xae, 0xc4, 0xa6, 0xe6, 0x98, 0x7b, 0xaf, 0x01, 0x0a,
+	0x7f, 0x65, 0x37, 0xdf, 0x93, 0x39, 0x8a, 0xa5, 0x1a, 0x59, 0x57, 0xf8, 0x16, 0x55, 0xb1, 0xf7,
+	0x15, 0x40, 0xe1, 0xed, 0xff, 0xcd, 0xcf, 0x27, 0x58, 0xa5, 0x09, 0xf7, 0xd9, 0xc1, 0x4f, 0xc2,
+	0xe8, 0xe6, 0xfd, 0x07, 0x2f, 0x11, 0x3b, 0x0e, 0x1e, 0xc1, 0xbe, 0x0a, 0x17, 0x6c, 0xfd, 0x1c,
+	0x15, 0x7b, 0xde, 0xb3, 0x73, 0x96, 0x64, 0x77, 0x0f, 0x1d, 0xa8, 0xe8, 0x17, 0xd4, 0xf0, 0x7e,
+	0x81, 0x7d, 0x3d, 0x77, 0xe8, 0x47, 0xb3, 0x34, 0xf0, 0x6f, 0x19, 0x7e, 0x59, 0x7c, 0x3b, 0x0c,
+	0xf5, 0xed, 0xd8, 0x52, 0x90, 0x23, 0xb7, 0x3f, 0x20, 0x52, 0xc4, 0x70, 0xe1, 0x4f, 0x95, 0x88,
+	0x26, 0x55, 0xb1, 0xf7, 0xa7, 0x09, 0x9d, 0xdd, 0x3c, 0xb5, 0x7f, 0x96, 0x08, 0xf5, 0x14, 0xb9,
+	0x7f, 0x96, 0x08, 0xfc, 0x04, 0xda, 0xa3, 0x28, 0x14, 0xa1, 0x2f, 0x78, 0x32, 0x8a, 0x66, 0xec,
+	0x7e, 0xed, 0xf4, 0x56, 0x55, 0xe2, 0x28, 0x4b, 0x63, 0x1e, 0xcd, 0xd8, 0x1a, 0xa7, 0xfd, 0xdc,
+	0xaa, 0x62, 0x07, 0xaa, 0x03, 0xce, 0x6f, 0x43, 0x46, 0x6c, 0xe5, 0xcc, 0x3a, 0xcb, 0xfd, 0xaa,
+	0x14, 0x7e, 0xc9, 0xa3, 0x18, 0x84, 0x71, 0xc0, 0x92, 0x94, 0x54, 0x7b, 0x56, 0xdf, 0xa1, 0x59,
+	0x2a, 0x0f, 0x76, 0x72, 0xf7, 0x1d, 0x5b, 0x91, 0x9a, 0x92, 0xaa, 0x13, 0xf4, 0xa0, 0x39, 0xb9,
+	0xd3, 0x10, 0xc1, 0xee, 0x05, 0xa9, 0xab, 0xe6, 0x46, 0x0d, 0x3f, 0x02, 0x47, 0xfe, 0xae, 0x41,
+	0xe0, 0x87, 0x11, 0x71, 0xd4, 0x8b, 0x5e, 0x14, 0xbc, 0xbf, 0x4c, 0x68, 0x69, 0x73, 0x06, 0x3c,
+	0x12, 0x09, 0x9f, 0xe3, 0x17, 0x1b, 0xbb, 0xff, 0x78, 0xd3, 0xf9, 0x35, 0x68, 0xc7, 0xfa, 0x5f,
+	0xc3, 0x41, 0x6e, 0x90, 0x3a, 0xb1, 0xb2, 0x77, 0xbb, 0x5a, 0x92, 0x91, 0x5b, 0x55, 0x62, 0x68,
+	0x17, 0x77, 0xb5, 0xf0, 0x33, 0x70, 0x54, 0x76, 0xc5, 0x47, 0xb1, 0x72, 0x73, 0xc7, 0x7d, 0x17,
+	0x88, 0xfc, 0x83, 0xf0, 0x6d, 0xc2, 0x17, 0xa3, 0x98, 0x54, 0x76, 0x13, 0xca, 0x18, 0x6f, 0xf8,
+	0x5f, 0xff, 0x3f, 0x1d, 0xc0, 0x41, 0xc2, 0x7c, 0xc1, 0x14, 0x9a, 0xb2, 0xbb, 0x25, 0x4b, 0x85,
+	0x6b, 0xe0, 0x87, 0x70, 0xb0, 0x51, 0x97, 0xa2, 0x53, 0xe6, 0x9a, 0x5f, 0x9f, 0xbe, 0x7b, 0xec,
+	0x1a, 0x0f, 0x8f, 0x5d, 0xe3, 0x9f, 0xc7, 0xae, 0xf1, 0xc7, 0x53, 0x77, 0xef, 0xe1, 0xa9, 0xbb,
+	0xf7, 0xf7, 0x53, 0x77, 0xef, 0xe7, 0xc3, 0x9b, 0x50, 0x04, 0xcb, 0xeb, 0xa3, 0x29, 0x5f, 0x1c,
+	0xa7, 0x73, 0x7f, 0x7a, 0x1b, 0xdc, 0x1d, 0x6b, 0x4d, 0xd7, 0x55, 0xf5, 0x37, 0x7c, 0xfa, 0xef,
+	0x00, 0x0e, 0x2f, 0x80, 0x67, 0x96, 0x07, 0x00, 0x00,
 }
 
 func (m *NebulaMeta) Marshal() (dAtA []byte, err error) {
@@ -622,6 +919,65 @@ func (m *NebulaMetaDetails) MarshalToSizedBuffer(dAtA []byte) (int, error) {
 	_ = i
 	var l int
 	_ = l
+	if len(m.Hosts) > 0 {
+		for iNdEx := len(m.Hosts) - 1; iNdEx >= 0; iNdEx-- {
+			{
+				size, err := m.Hosts[iNdEx].MarshalToSizedBuffer(dAtA[:i])
+				if err != nil {
+					return 0, err
+				}
+				i -= size
+				i = encodeVarintNebula(dAtA, i, uint64(size))
+			}
+			i--
+			dAtA[i] = 0x5a
+		}
+	}
+	if len(m.Name) > 0 {
+		i -= len(m.Name)
+		copy(dAtA[i:], m.Name)
+		i = encodeVarintNebula(dAtA, i, uint64(len(m.Name)))
+		i--
+		dAtA[i] = 0x52
+	}
+	if m.Age != 0 {
+		i = encodeVarintNebula(dAtA, i, uint64(m.Age))
+		i--
+		dAtA[i] = 0x48
+	}
+	if len(m.CRLs) > 0 {
+		for iNdEx := len(m.CRLs) - 1; iNdEx >= 0; iNdEx-- {
+			i -= len(m.CRLs[iNdEx])
+			copy(dAtA[i:], m.CRLs[iNdEx])
+			i = encodeVarintNebula(dAtA, i, uint64(len(m.CRLs[iNdEx])))
+			i--
+			dAtA[i] = 0x42
+		}
+	}
+	if len(m.RelayVpnIps) > 0 {
+		for iNdEx := len(m.RelayVpnIps) - 1; iNdEx >= 0; iNdEx-- {
+			{
+				size, err := m.RelayVpnIps[iNdEx].MarshalToSizedBuffer(dAtA[:i])
+				if err != nil {
+					return 0, err
+				}
+				i -= size
+				i = encodeVarintNebula(dAtA, i, uint64(size))
+			}
+			i--
+			dAtA[i] = 0x3a
+		}
+	}
+	if m.VpnIp6Lo != 0 {
+		i = encodeVarintNebula(dAtA, i, uint64(m.VpnIp6Lo))
+		i--
+		dAtA[i] = 0x30
+	}
+	if m.VpnIp6Hi != 0 {
+		i = encodeVarintNebula(dAtA, i, uint64(m.VpnIp6Hi))
+		i--
+		dAtA[i] = 0x28
+	}
 	if len(m.Ip6AndPorts) > 0 {
 		for iNdEx := len(m.Ip6AndPorts) - 1; iNdEx >= 0; iNdEx-- {
 			{
@@ -663,6 +1019,39 @@ func (m *NebulaMetaDetails) MarshalToSizedBuffer(dAtA []byte) (int, error) {
 	return len(dAtA) - i, nil
 }
 
+func (m *VpnAddr) Marshal() (dAtA []byte, err error) {
+	size := m.Size()
+	dAtA = make([]byte, size)
+	n, err := m.MarshalToSizedBuffer(dAtA[:size])
+	if err != nil {
+		return nil, err
+	}
+	return dAtA[:n], nil
+}
+
+func (m *VpnAddr) MarshalTo(dAtA []byte) (int, error) {
+	size := m.Size()
+	return m.MarshalToSizedBuffer(dAtA[:size])
+}
+
+func (m *VpnAddr) MarshalToSizedBuffer(dAtA []byte) (int, error) {
+	i := len(dAtA)
+	_ = i
+	var l int
+	_ = l
+	if m.Lo != 0 {
+		i = encodeVarintNebula(dAtA, i, uint64(m.Lo))
+		i--
+		dAtA[i] = 0x10
+	}
+	if m.Hi != 0 {
+		i = encodeVarintNebula(dAtA, i, uint64(m.Hi))
+		i--
+		dAtA[i] = 0x8
+	}
+	return len(dAtA) - i, nil
+}
+
 func (m *Ip4AndPort) Marshal() (dAtA []byte, err error) {
 	size := m.Size()
 	dAtA = make([]byte, size)
@@ -829,6 +1218,38 @@ func (m *NebulaHandshakeDetails) MarshalToSizedBuffer(dAtA []byte) (int, error)
 	_ = i
 	var l int
 	_ = l
+	if len(m.CertChain) > 0 {
+		for iNdEx := len(m.CertChain) - 1; iNdEx >= 0; iNdEx-- {
+			i -= len(m.CertChain[iNdEx])
+			copy(dAtA[i:], m.CertChain[iNdEx])
+			i = encodeVarintNebula(dAtA, i, uint64(len(m.CertChain[iNdEx])))
+			i--
+			dAtA[i] = 0x4a
+		}
+	}
+	if len(m.PqCiphertext) > 0 {
+		i -= len(m.PqCiphertext)
+		copy(dAtA[i:], m.PqCiphertext)
+		i = encodeVarintNebula(dAtA, i, uint64(len(m.PqCiphertext)))
+		i--
+		dAtA[i] = 0x42
+	}
+	if len(m.PqKey) > 0 {
+		i -= len(m.PqKey)
+		copy(dAtA[i:], m.PqKey)
+		i = encodeVarintNebula(dAtA, i, uint64(len(m.PqKey)))
+		i--
+		dAtA[i] = 0x3a
+	}
+	if len(m.Ciphers) > 0 {
+		for iNdEx := len(m.Ciphers) - 1; iNdEx >= 0; iNdEx-- {
+			i -= len(m.Ciphers[iNdEx])
+			copy(dAtA[i:], m.Ciphers[iNdEx])
+			i = encodeVarintNebula(dAtA, i, uint64(len(m.Ciphers[iNdEx])))
+			i--
+			dAtA[i] = 0x32
+		}
+	}
 	if m.Time != 0 {
 		i = encodeVarintNebula(dAtA, i, uint64(m.Time))
 		i--
@@ -859,24 +1280,86 @@ func (m *NebulaHandshakeDetails) MarshalToSizedBuffer(dAtA []byte) (int, error)
 	return len(dAtA) - i, nil
 }
 
-func encodeVarintNebula(dAtA []byte, offset int, v uint64) int {
-	offset -= sovNebula(v)
-	base := offset
-	for v >= 1<<7 {
-		dAtA[offset] = uint8(v&0x7f | 0x80)
-		v >>= 7
-		offset++
+func (m *NebulaControl) Marshal() (dAtA []byte, err error) {
+	size := m.Size()
+	dAtA = make([]byte, size)
+	n, err := m.MarshalToSizedBuffer(dAtA[:size])
+	if err != nil {
+		return nil, err
 	}
-	dAtA[offset] = uint8(v)
-	return base
+	return dAtA[:n], nil
 }
-func (m *NebulaMeta) Size() (n int) {
-	if m == nil {
-		return 0
-	}
+
+func (m *NebulaControl) MarshalTo(dAtA []byte) (int, error) {
+	size := m.Size()
+	return m.MarshalToSizedBuffer(dAtA[:size])
+}
+
+func (m *NebulaControl) MarshalToSizedBuffer(dAtA []byte) (int, error) {
+	i := len(dAtA)
+	_ = i
 	var l int
 	_ = l
-	if m.Type != 0 {
+	if m.RelayFromIp != nil {
+		{
+			size, err := m.RelayFromIp.MarshalToSizedBuffer(dAtA[:i])
+			if err != nil {
+				return 0, err
+			}
+			i -= size
+			i = encodeVarintNebula(dAtA, i, uint64(size))
+		}
+		i--
+		dAtA[i] = 0x2a
+	}
+	if m.RelayToIp != nil {
+		{
+			size, err := m.RelayToIp.MarshalToSizedBuffer(dAtA[:i])
+			if err != nil {
+				return 0, err
+			}
+			i -= size
+			i = encodeVarintNebula(dAtA, i, uint64(size))
+		}
+		i--
+		dAtA[i] = 0x22
+	}
+	if m.ResponderRelayIndex != 0 {
+		i = encodeVarintNebula(dAtA, i, uint64(m.ResponderRelayIndex))
+		i--
+		dAtA[i] = 0x18
+	}
+	if m.InitiatorRelayIndex != 0 {
+		i = encodeVarintNebula(dAtA, i, uint64(m.InitiatorRelayIndex))
+		i--
+		dAtA[i] = 0x10
+	}
+	if m.Type != 0 {
+		i = encodeVarintNebula(dAtA, i, uint64(m.Type))
+		i--
+		dAtA[i] = 0x8
+	}
+	return len(dAtA) - i, nil
+}
+
+func encodeVarintNebula(dAtA []byte, offset int, v uint64) int {
+	offset -= sovNebula(v)
+	base := offset
+	for v >= 1<<7 {
+		dAtA[offset] = uint8(v&0x7f | 0x80)
+		v >>= 7
+		offset++
+	}
+	dAtA[offset] = uint8(v)
+	return base
+}
+func (m *NebulaMeta) Size() (n int) {
+	if m == nil {
+		return 0
+	}
+	var l int
+	_ = l
+	if m.Type != 0 {
 		n += 1 + sovNebula(uint64(m.Type))
 	}
 	if m.Details != nil {
@@ -910,6 +1393,52 @@ func (m *NebulaMetaDetails) Size() (n int) {
 			n += 1 + l + sovNebula(uint64(l))
 		}
 	}
+	if m.VpnIp6Hi != 0 {
+		n += 1 + sovNebula(uint64(m.VpnIp6Hi))
+	}
+	if m.VpnIp6Lo != 0 {
+		n += 1 + sovNebula(uint64(m.VpnIp6Lo))
+	}
+	if len(m.RelayVpnIps) > 0 {
+		for _, e := range m.RelayVpnIps {
+			l = e.Size()
+			n += 1 + l + sovNebula(uint64(l))
+		}
+	}
+	if len(m.CRLs) > 0 {
+		for _, b := range m.CRLs {
+			l = len(b)
+			n += 1 + l + sovNebula(uint64(l))
+		}
+	}
+	if m.Age != 0 {
+		n += 1 + sovNebula(uint64(m.Age))
+	}
+	l = len(m.Name)
+	if l > 0 {
+		n += 1 + l + sovNebula(uint64(l))
+	}
+	if len(m.Hosts) > 0 {
+		for _, e := range m.Hosts {
+			l = e.Size()
+			n += 1 + l + sovNebula(uint64(l))
+		}
+	}
+	return n
+}
+
+func (m *VpnAddr) Size() (n int) {
+	if m == nil {
+		return 0
+	}
+	var l int
+	_ = l
+	if m.Hi != 0 {
+		n += 1 + sovNebula(uint64(m.Hi))
+	}
+	if m.Lo != 0 {
+		n += 1 + sovNebula(uint64(m.Lo))
+	}
 	return n
 }
 
@@ -1000,6 +1529,52 @@ func (m *NebulaHandshakeDetails) Size() (n int) {
 	if m.Time != 0 {
 		n += 1 + sovNebula(uint64(m.Time))
 	}
+	if len(m.Ciphers) > 0 {
+		for _, s := range m.Ciphers {
+			l = len(s)
+			n += 1 + l + sovNebula(uint64(l))
+		}
+	}
+	l = len(m.PqKey)
+	if l > 0 {
+		n += 1 + l + sovNebula(uint64(l))
+	}
+	l = len(m.PqCiphertext)
+	if l > 0 {
+		n += 1 + l + sovNebula(uint64(l))
+	}
+	if len(m.CertChain) > 0 {
+		for _, b := range m.CertChain {
+			l = len(b)
+			n += 1 + l + sovNebula(uint64(l))
+		}
+	}
+	return n
+}
+
+func (m *NebulaControl) Size() (n int) {
+	if m == nil {
+		return 0
+	}
+	var l int
+	_ = l
+	if m.Type != 0 {
+		n += 1 + sovNebula(uint64(m.Type))
+	}
+	if m.InitiatorRelayIndex != 0 {
+		n += 1 + sovNebula(uint64(m.InitiatorRelayIndex))
+	}
+	if m.ResponderRelayIndex != 0 {
+		n += 1 + sovNebula(uint64(m.ResponderRelayIndex))
+	}
+	if m.RelayToIp != nil {
+		l = m.RelayToIp.Size()
+		n += 1 + l + sovNebula(uint64(l))
+	}
+	if m.RelayFromIp != nil {
+		l = m.RelayFromIp.Size()
+		n += 1 + l + sovNebula(uint64(l))
+	}
 	return n
 }
 
@@ -1249,61 +1824,11 @@ func (m *NebulaMetaDetails) Unmarshal(dAtA []byte) error {
 				return err
 			}
 			iNdEx = postIndex
-		default:
-			iNdEx = preIndex
-			skippy, err := skipNebula(dAtA[iNdEx:])
-			if err != nil {
-				return err
-			}
-			if (skippy < 0) || (iNdEx+skippy) < 0 {
-				return ErrInvalidLengthNebula
-			}
-			if (iNdEx + skippy) > l {
-				return io.ErrUnexpectedEOF
-			}
-			iNdEx += skippy
-		}
-	}
-
-	if iNdEx > l {
-		return io.ErrUnexpectedEOF
-	}
-	return nil
-}
-func (m *Ip4AndPort) Unmarshal(dAtA []byte) error {
-	l := len(dAtA)
-	iNdEx := 0
-	for iNdEx < l {
-		preIndex := iNdEx
-		var wire uint64
-		for shift := uint(0); ; shift += 7 {
-			if shift >= 64 {
-				return ErrIntOverflowNebula
-			}
-			if iNdEx >= l {
-				return io.ErrUnexpectedEOF
-			}
-			b := dAtA[iNdEx]
-			iNdEx++
-			wire |= uint64(b&0x7F) << shift
-			if b < 0x80 {
-				break
-			}
-		}
-		fieldNum := int32(wire >> 3)
-		wireType := int(wire & 0x7)
-		if wireType == 4 {
-			return fmt.Errorf("proto: Ip4AndPort: wiretype end group for non-group")
-		}
-		if fieldNum <= 0 {
-			return fmt.Errorf("proto: Ip4AndPort: illegal tag %d (wire type %d)", fieldNum, wire)
-		}
-		switch fieldNum {
-		case 1:
+		case 5:
 			if wireType != 0 {
-				return fmt.Errorf("proto: wrong wireType = %d for field Ip", wireType)
+				return fmt.Errorf("proto: wrong wireType = %d for field VpnIp6Hi", wireType)
 			}
-			m.Ip = 0
+			m.VpnIp6Hi = 0
 			for shift := uint(0); ; shift += 7 {
 				if shift >= 64 {
 					return ErrIntOverflowNebula
@@ -1313,16 +1838,16 @@ func (m *Ip4AndPort) Unmarshal(dAtA []byte) error {
 				}
 				b := dAtA[iNdEx]
 				iNdEx++
-				m.Ip |= uint32(b&0x7F) << shift
+				m.VpnIp6Hi |= uint64(b&0x7F) << shift
 				if b < 0x80 {
 					break
 				}
 			}
-		case 2:
+		case 6:
 			if wireType != 0 {
-				return fmt.Errorf("proto: wrong wireType = %d for field Port", wireType)
+				return fmt.Errorf("proto: wrong wireType = %d for field VpnIp6Lo", wireType)
 			}
-			m.Port = 0
+			m.VpnIp6Lo = 0
 			for shift := uint(0); ; shift += 7 {
 				if shift >= 64 {
 					return ErrIntOverflowNebula
@@ -1332,66 +1857,16 @@ func (m *Ip4AndPort) Unmarshal(dAtA []byte) error {
 				}
 				b := dAtA[iNdEx]
 				iNdEx++
-				m.Port |= uint32(b&0x7F) << shift
+				m.VpnIp6Lo |= uint64(b&0x7F) << shift
 				if b < 0x80 {
 					break
 				}
 			}
-		default:
-			iNdEx = preIndex
-			skippy, err := skipNebula(dAtA[iNdEx:])
-			if err != nil {
-				return err
-			}
-			if (skippy < 0) || (iNdEx+skippy) < 0 {
-				return ErrInvalidLengthNebula
-			}
-			if (iNdEx + skippy) > l {
-				return io.ErrUnexpectedEOF
-			}
-			iNdEx += skippy
-		}
-	}
-
-	if iNdEx > l {
-		return io.ErrUnexpectedEOF
-	}
-	return nil
-}
-func (m *Ip6AndPort) Unmarshal(dAtA []byte) error {
-	l := len(dAtA)
-	iNdEx := 0
-	for iNdEx < l {
-		preIndex := iNdEx
-		var wire uint64
-		for shift := uint(0); ; shift += 7 {
-			if shift >= 64 {
-				return ErrIntOverflowNebula
-			}
-			if iNdEx >= l {
-				return io.ErrUnexpectedEOF
-			}
-			b := dAtA[iNdEx]
-			iNdEx++
-			wire |= uint64(b&0x7F) << shift
-			if b < 0x80 {
-				break
-			}
-		}
-		fieldNum := int32(wire >> 3)
-		wireType := int(wire & 0x7)
-		if wireType == 4 {
-			return fmt.Errorf("proto: Ip6AndPort: wiretype end group for non-group")
-		}
-		if fieldNum <= 0 {
-			return fmt.Errorf("proto: Ip6AndPort: illegal tag %d (wire type %d)", fieldNum, wire)
-		}
-		switch fieldNum {
-		case 1:
-			if wireType != 0 {
-				return fmt.Errorf("proto: wrong wireType = %d for field Hi", wireType)
+		case 7:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field RelayVpnIps", wireType)
 			}
-			m.Hi = 0
+			var msglen int
 			for shift := uint(0); ; shift += 7 {
 				if shift >= 64 {
 					return ErrIntOverflowNebula
@@ -1401,16 +1876,31 @@ func (m *Ip6AndPort) Unmarshal(dAtA []byte) error {
 				}
 				b := dAtA[iNdEx]
 				iNdEx++
-				m.Hi |= uint64(b&0x7F) << shift
+				msglen |= int(b&0x7F) << shift
 				if b < 0x80 {
 					break
 				}
 			}
-		case 2:
-			if wireType != 0 {
-				return fmt.Errorf("proto: wrong wireType = %d for field Lo", wireType)
+			if msglen < 0 {
+				return ErrInvalidLengthNebula
 			}
-			m.Lo = 0
+			postIndex := iNdEx + msglen
+			if postIndex < 0 {
+				return ErrInvalidLengthNebula
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.RelayVpnIps = append(m.RelayVpnIps, &VpnAddr{})
+			if err := m.RelayVpnIps[len(m.RelayVpnIps)-1].Unmarshal(dAtA[iNdEx:postIndex]); err != nil {
+				return err
+			}
+			iNdEx = postIndex
+		case 8:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field CRLs", wireType)
+			}
+			var byteLen int
 			for shift := uint(0); ; shift += 7 {
 				if shift >= 64 {
 					return ErrIntOverflowNebula
@@ -1420,18 +1910,31 @@ func (m *Ip6AndPort) Unmarshal(dAtA []byte) error {
 				}
 				b := dAtA[iNdEx]
 				iNdEx++
-				m.Lo |= uint64(b&0x7F) << shift
+				byteLen |= int(b&0x7F) << shift
 				if b < 0x80 {
 					break
 				}
 			}
-		case 3:
-			if wireType != 0 {
-				return fmt.Errorf("proto: wrong wireType = %d for field Port", wireType)
+			if byteLen < 0 {
+				return ErrInvalidLengthNebula
 			}
-			m.Port = 0
-			for shift := uint(0); ; shift += 7 {
-				if shift >= 64 {
+			postIndex := iNdEx + byteLen
+			if postIndex < 0 {
+				return ErrInvalidLengthNebula
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.CRLs = append(m.CRLs, make([]byte, postIndex-iNdEx))
+			copy(m.CRLs[len(m.CRLs)-1], dAtA[iNdEx:postIndex])
+			iNdEx = postIndex
+		case 9:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Age", wireType)
+			}
+			m.Age = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
 					return ErrIntOverflowNebula
 				}
 				if iNdEx >= l {
@@ -1439,11 +1942,77 @@ func (m *Ip6AndPort) Unmarshal(dAtA []byte) error {
 				}
 				b := dAtA[iNdEx]
 				iNdEx++
-				m.Port |= uint32(b&0x7F) << shift
+				m.Age |= uint64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 10:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Name", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowNebula
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				stringLen |= uint64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			intStringLen := int(stringLen)
+			if intStringLen < 0 {
+				return ErrInvalidLengthNebula
+			}
+			postIndex := iNdEx + intStringLen
+			if postIndex < 0 {
+				return ErrInvalidLengthNebula
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Name = string(dAtA[iNdEx:postIndex])
+			iNdEx = postIndex
+		case 11:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Hosts", wireType)
+			}
+			var msglen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowNebula
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				msglen |= int(b&0x7F) << shift
 				if b < 0x80 {
 					break
 				}
 			}
+			if msglen < 0 {
+				return ErrInvalidLengthNebula
+			}
+			postIndex := iNdEx + msglen
+			if postIndex < 0 {
+				return ErrInvalidLengthNebula
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Hosts = append(m.Hosts, &NebulaMetaDetails{})
+			if err := m.Hosts[len(m.Hosts)-1].Unmarshal(dAtA[iNdEx:postIndex]); err != nil {
+				return err
+			}
+			iNdEx = postIndex
 		default:
 			iNdEx = preIndex
 			skippy, err := skipNebula(dAtA[iNdEx:])
@@ -1465,7 +2034,7 @@ func (m *Ip6AndPort) Unmarshal(dAtA []byte) error {
 	}
 	return nil
 }
-func (m *NebulaPing) Unmarshal(dAtA []byte) error {
+func (m *VpnAddr) Unmarshal(dAtA []byte) error {
 	l := len(dAtA)
 	iNdEx := 0
 	for iNdEx < l {
@@ -1488,17 +2057,17 @@ func (m *NebulaPing) Unmarshal(dAtA []byte) error {
 		fieldNum := int32(wire >> 3)
 		wireType := int(wire & 0x7)
 		if wireType == 4 {
-			return fmt.Errorf("proto: NebulaPing: wiretype end group for non-group")
+			return fmt.Errorf("proto: VpnAddr: wiretype end group for non-group")
 		}
 		if fieldNum <= 0 {
-			return fmt.Errorf("proto: NebulaPing: illegal tag %d (wire type %d)", fieldNum, wire)
+			return fmt.Errorf("proto: VpnAddr: illegal tag %d (wire type %d)", fieldNum, wire)
 		}
 		switch fieldNum {
 		case 1:
 			if wireType != 0 {
-				return fmt.Errorf("proto: wrong wireType = %d for field Type", wireType)
+				return fmt.Errorf("proto: wrong wireType = %d for field Hi", wireType)
 			}
-			m.Type = 0
+			m.Hi = 0
 			for shift := uint(0); ; shift += 7 {
 				if shift >= 64 {
 					return ErrIntOverflowNebula
@@ -1508,16 +2077,16 @@ func (m *NebulaPing) Unmarshal(dAtA []byte) error {
 				}
 				b := dAtA[iNdEx]
 				iNdEx++
-				m.Type |= NebulaPing_MessageType(b&0x7F) << shift
+				m.Hi |= uint64(b&0x7F) << shift
 				if b < 0x80 {
 					break
 				}
 			}
 		case 2:
 			if wireType != 0 {
-				return fmt.Errorf("proto: wrong wireType = %d for field Time", wireType)
+				return fmt.Errorf("proto: wrong wireType = %d for field Lo", wireType)
 			}
-			m.Time = 0
+			m.Lo = 0
 			for shift := uint(0); ; shift += 7 {
 				if shift >= 64 {
 					return ErrIntOverflowNebula
@@ -1527,7 +2096,7 @@ func (m *NebulaPing) Unmarshal(dAtA []byte) error {
 				}
 				b := dAtA[iNdEx]
 				iNdEx++
-				m.Time |= uint64(b&0x7F) << shift
+				m.Lo |= uint64(b&0x7F) << shift
 				if b < 0x80 {
 					break
 				}
@@ -1553,7 +2122,7 @@ func (m *NebulaPing) Unmarshal(dAtA []byte) error {
 	}
 	return nil
 }
-func (m *NebulaHandshake) Unmarshal(dAtA []byte) error {
+func (m *Ip4AndPort) Unmarshal(dAtA []byte) error {
 	l := len(dAtA)
 	iNdEx := 0
 	for iNdEx < l {
@@ -1576,17 +2145,17 @@ func (m *NebulaHandshake) Unmarshal(dAtA []byte) error {
 		fieldNum := int32(wire >> 3)
 		wireType := int(wire & 0x7)
 		if wireType == 4 {
-			return fmt.Errorf("proto: NebulaHandshake: wiretype end group for non-group")
+			return fmt.Errorf("proto: Ip4AndPort: wiretype end group for non-group")
 		}
 		if fieldNum <= 0 {
-			return fmt.Errorf("proto: NebulaHandshake: illegal tag %d (wire type %d)", fieldNum, wire)
+			return fmt.Errorf("proto: Ip4AndPort: illegal tag %d (wire type %d)", fieldNum, wire)
 		}
 		switch fieldNum {
 		case 1:
-			if wireType != 2 {
-				return fmt.Errorf("proto: wrong wireType = %d for field Details", wireType)
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Ip", wireType)
 			}
-			var msglen int
+			m.Ip = 0
 			for shift := uint(0); ; shift += 7 {
 				if shift >= 64 {
 					return ErrIntOverflowNebula
@@ -1596,33 +2165,16 @@ func (m *NebulaHandshake) Unmarshal(dAtA []byte) error {
 				}
 				b := dAtA[iNdEx]
 				iNdEx++
-				msglen |= int(b&0x7F) << shift
+				m.Ip |= uint32(b&0x7F) << shift
 				if b < 0x80 {
 					break
 				}
 			}
-			if msglen < 0 {
-				return ErrInvalidLengthNebula
-			}
-			postIndex := iNdEx + msglen
-			if postIndex < 0 {
-				return ErrInvalidLengthNebula
-			}
-			if postIndex > l {
-				return io.ErrUnexpectedEOF
-			}
-			if m.Details == nil {
-				m.Details = &NebulaHandshakeDetails{}
-			}
-			if err := m.Details.Unmarshal(dAtA[iNdEx:postIndex]); err != nil {
-				return err
-			}
-			iNdEx = postIndex
 		case 2:
-			if wireType != 2 {
-				return fmt.Errorf("proto: wrong wireType = %d for field Hmac", wireType)
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Port", wireType)
 			}
-			var byteLen int
+			m.Port = 0
 			for shift := uint(0); ; shift += 7 {
 				if shift >= 64 {
 					return ErrIntOverflowNebula
@@ -1632,26 +2184,11 @@ func (m *NebulaHandshake) Unmarshal(dAtA []byte) error {
 				}
 				b := dAtA[iNdEx]
 				iNdEx++
-				byteLen |= int(b&0x7F) << shift
+				m.Port |= uint32(b&0x7F) << shift
 				if b < 0x80 {
 					break
 				}
 			}
-			if byteLen < 0 {
-				return ErrInvalidLengthNebula
-			}
-			postIndex := iNdEx + byteLen
-			if postIndex < 0 {
-				return ErrInvalidLengthNebula
-			}
-			if postIndex > l {
-				return io.ErrUnexpectedEOF
-			}
-			m.Hmac = append(m.Hmac[:0], dAtA[iNdEx:postIndex]...)
-			if m.Hmac == nil {
-				m.Hmac = []byte{}
-			}
-			iNdEx = postIndex
 		default:
 			iNdEx = preIndex
 			skippy, err := skipNebula(dAtA[iNdEx:])
@@ -1673,7 +2210,7 @@ func (m *NebulaHandshake) Unmarshal(dAtA []byte) error {
 	}
 	return nil
 }
-func (m *NebulaHandshakeDetails) Unmarshal(dAtA []byte) error {
+func (m *Ip6AndPort) Unmarshal(dAtA []byte) error {
 	l := len(dAtA)
 	iNdEx := 0
 	for iNdEx < l {
@@ -1696,17 +2233,17 @@ func (m *NebulaHandshakeDetails) Unmarshal(dAtA []byte) error {
 		fieldNum := int32(wire >> 3)
 		wireType := int(wire & 0x7)
 		if wireType == 4 {
-			return fmt.Errorf("proto: NebulaHandshakeDetails: wiretype end group for non-group")
+			return fmt.Errorf("proto: Ip6AndPort: wiretype end group for non-group")
 		}
 		if fieldNum <= 0 {
-			return fmt.Errorf("proto: NebulaHandshakeDetails: illegal tag %d (wire type %d)", fieldNum, wire)
+			return fmt.Errorf("proto: Ip6AndPort: illegal tag %d (wire type %d)", fieldNum, wire)
 		}
 		switch fieldNum {
 		case 1:
-			if wireType != 2 {
-				return fmt.Errorf("proto: wrong wireType = %d for field Cert", wireType)
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Hi", wireType)
 			}
-			var byteLen int
+			m.Hi = 0
 			for shift := uint(0); ; shift += 7 {
 				if shift >= 64 {
 					return ErrIntOverflowNebula
@@ -1716,31 +2253,16 @@ func (m *NebulaHandshakeDetails) Unmarshal(dAtA []byte) error {
 				}
 				b := dAtA[iNdEx]
 				iNdEx++
-				byteLen |= int(b&0x7F) << shift
+				m.Hi |= uint64(b&0x7F) << shift
 				if b < 0x80 {
 					break
 				}
 			}
-			if byteLen < 0 {
-				return ErrInvalidLengthNebula
-			}
-			postIndex := iNdEx + byteLen
-			if postIndex < 0 {
-				return ErrInvalidLengthNebula
-			}
-			if postIndex > l {
-				return io.ErrUnexpectedEOF
-			}
-			m.Cert = append(m.Cert[:0], dAtA[iNdEx:postIndex]...)
-			if m.Cert == nil {
-				m.Cert = []byte{}
-			}
-			iNdEx = postIndex
 		case 2:
 			if wireType != 0 {
-				return fmt.Errorf("proto: wrong wireType = %d for field InitiatorIndex", wireType)
+				return fmt.Errorf("proto: wrong wireType = %d for field Lo", wireType)
 			}
-			m.InitiatorIndex = 0
+			m.Lo = 0
 			for shift := uint(0); ; shift += 7 {
 				if shift >= 64 {
 					return ErrIntOverflowNebula
@@ -1750,16 +2272,16 @@ func (m *NebulaHandshakeDetails) Unmarshal(dAtA []byte) error {
 				}
 				b := dAtA[iNdEx]
 				iNdEx++
-				m.InitiatorIndex |= uint32(b&0x7F) << shift
+				m.Lo |= uint64(b&0x7F) << shift
 				if b < 0x80 {
 					break
 				}
 			}
 		case 3:
 			if wireType != 0 {
-				return fmt.Errorf("proto: wrong wireType = %d for field ResponderIndex", wireType)
+				return fmt.Errorf("proto: wrong wireType = %d for field Port", wireType)
 			}
-			m.ResponderIndex = 0
+			m.Port = 0
 			for shift := uint(0); ; shift += 7 {
 				if shift >= 64 {
 					return ErrIntOverflowNebula
@@ -1769,16 +2291,66 @@ func (m *NebulaHandshakeDetails) Unmarshal(dAtA []byte) error {
 				}
 				b := dAtA[iNdEx]
 				iNdEx++
-				m.ResponderIndex |= uint32(b&0x7F) << shift
+				m.Port |= uint32(b&0x7F) << shift
 				if b < 0x80 {
 					break
 				}
 			}
-		case 4:
+		default:
+			iNdEx = preIndex
+			skippy, err := skipNebula(dAtA[iNdEx:])
+			if err != nil {
+				return err
+			}
+			if (skippy < 0) || (iNdEx+skippy) < 0 {
+				return ErrInvalidLengthNebula
+			}
+			if (iNdEx + skippy) > l {
+				return io.ErrUnexpectedEOF
+			}
+			iNdEx += skippy
+		}
+	}
+
+	if iNdEx > l {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+func (m *NebulaPing) Unmarshal(dAtA []byte) error {
+	l := len(dAtA)
+	iNdEx := 0
+	for iNdEx < l {
+		preIndex := iNdEx
+		var wire uint64
+		for shift := uint(0); ; shift += 7 {
+			if shift >= 64 {
+				return ErrIntOverflowNebula
+			}
+			if iNdEx >= l {
+				return io.ErrUnexpectedEOF
+			}
+			b := dAtA[iNdEx]
+			iNdEx++
+			wire |= uint64(b&0x7F) << shift
+			if b < 0x80 {
+				break
+			}
+		}
+		fieldNum := int32(wire >> 3)
+		wireType := int(wire & 0x7)
+		if wireType == 4 {
+			return fmt.Errorf("proto: NebulaPing: wiretype end group for non-group")
+		}
+		if fieldNum <= 0 {
+			return fmt.Errorf("proto: NebulaPing: illegal tag %d (wire type %d)", fieldNum, wire)
+		}
+		switch fieldNum {
+		case 1:
 			if wireType != 0 {
-				return fmt.Errorf("proto: wrong wireType = %d for field Cookie", wireType)
+				return fmt.Errorf("proto: wrong wireType = %d for field Type", wireType)
 			}
-			m.Cookie = 0
+			m.Type = 0
 			for shift := uint(0); ; shift += 7 {
 				if shift >= 64 {
 					return ErrIntOverflowNebula
@@ -1788,12 +2360,12 @@ func (m *NebulaHandshakeDetails) Unmarshal(dAtA []byte) error {
 				}
 				b := dAtA[iNdEx]
 				iNdEx++
-				m.Cookie |= uint64(b&0x7F) << shift
+				m.Type |= NebulaPing_MessageType(b&0x7F) << shift
 				if b < 0x80 {
 					break
 				}
 			}
-		case 5:
+		case 2:
 			if wireType != 0 {
 				return fmt.Errorf("proto: wrong wireType = %d for field Time", wireType)
 			}
@@ -1833,6 +2405,597 @@ func (m *NebulaHandshakeDetails) Unmarshal(dAtA []byte) error {
 	}
 	return nil
 }
+func (m *NebulaHandshake) Unmarshal(dAtA []byte) error {
+	l := len(dAtA)
+	iNdEx := 0
+	for iNdEx < l {
+		preIndex := iNdEx
+		var wire uint64
+		for shift := uint(0); ; shift += 7 {
+			if shift >= 64 {
+				return ErrIntOverflowNebula
+			}
+			if iNdEx >= l {
+				return io.ErrUnexpectedEOF
+			}
+			b := dAtA[iNdEx]
+			iNdEx++
+			wire |= uint64(b&0x7F) << shift
+			if b < 0x80 {
+				break
+			}
+		}
+		fieldNum := int32(wire >> 3)
+		wireType := int(wire & 0x7)
+		if wireType == 4 {
+			return fmt.Errorf("proto: NebulaHandshake: wiretype end group for non-group")
+		}
+		if fieldNum <= 0 {
+			return fmt.Errorf("proto: NebulaHandshake: illegal tag %d (wire type %d)", fieldNum, wire)
+		}
+		switch fieldNum {
+		case 1:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Details", wireType)
+			}
+			var msglen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowNebula
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				msglen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if msglen < 0 {
+				return ErrInvalidLengthNebula
+			}
+			postIndex := iNdEx + msglen
+			if postIndex < 0 {
+				return ErrInvalidLengthNebula
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			if m.Details == nil {
+				m.Details = &NebulaHandshakeDetails{}
+			}
+			if err := m.Details.Unmarshal(dAtA[iNdEx:postIndex]); err != nil {
+				return err
+			}
+			iNdEx = postIndex
+		case 2:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Hmac", wireType)
+			}
+			var byteLen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowNebula
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				byteLen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if byteLen < 0 {
+				return ErrInvalidLengthNebula
+			}
+			postIndex := iNdEx + byteLen
+			if postIndex < 0 {
+				return ErrInvalidLengthNebula
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Hmac = append(m.Hmac[:0], dAtA[iNdEx:postIndex]...)
+			if m.Hmac == nil {
+				m.Hmac = []byte{}
+			}
+			iNdEx = postIndex
+		default:
+			iNdEx = preIndex
+			skippy, err := skipNebula(dAtA[iNdEx:])
+			if err != nil {
+				return err
+			}
+			if (skippy < 0) || (iNdEx+skippy) < 0 {
+				return ErrInvalidLengthNebula
+			}
+			if (iNdEx + skippy) > l {
+				return io.ErrUnexpectedEOF
+			}
+			iNdEx += skippy
+		}
+	}
+
+	if iNdEx > l {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+func (m *NebulaHandshakeDetails) Unmarshal(dAtA []byte) error {
+	l := len(dAtA)
+	iNdEx := 0
+	for iNdEx < l {
+		preIndex := iNdEx
+		var wire uint64
+		for shift := uint(0); ; shift += 7 {
+			if shift >= 64 {
+				return ErrIntOverflowNebula
+			}
+			if iNdEx >= l {
+				return io.ErrUnexpectedEOF
+			}
+			b := dAtA[iNdEx]
+			iNdEx++
+			wire |= uint64(b&0x7F) << shift
+			if b < 0x80 {
+				break
+			}
+		}
+		fieldNum := int32(wire >> 3)
+		wireType := int(wire & 0x7)
+		if wireType == 4 {
+			return fmt.Errorf("proto: NebulaHandshakeDetails: wiretype end group for non-group")
+		}
+		if fieldNum <= 0 {
+			return fmt.Errorf("proto: NebulaHandshakeDetails: illegal tag %d (wire type %d)", fieldNum, wire)
+		}
+		switch fieldNum {
+		case 1:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Cert", wireType)
+			}
+			var byteLen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowNebula
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				byteLen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if byteLen < 0 {
+				return ErrInvalidLengthNebula
+			}
+			postIndex := iNdEx + byteLen
+			if postIndex < 0 {
+				return ErrInvalidLengthNebula
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Cert = append(m.Cert[:0], dAtA[iNdEx:postIndex]...)
+			if m.Cert == nil {
+				m.Cert = []byte{}
+			}
+			iNdEx = postIndex
+		case 2:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field InitiatorIndex", wireType)
+			}
+			m.InitiatorIndex = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowNebula
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.InitiatorIndex |= uint32(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 3:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field ResponderIndex", wireType)
+			}
+			m.ResponderIndex = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowNebula
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.ResponderIndex |= uint32(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 4:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Cookie", wireType)
+			}
+			m.Cookie = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowNebula
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.Cookie |= uint64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 5:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Time", wireType)
+			}
+			m.Time = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowNebula
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.Time |= uint64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 6:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Ciphers", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowNebula
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				stringLen |= uint64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			intStringLen := int(stringLen)
+			if intStringLen < 0 {
+				return ErrInvalidLengthNebula
+			}
+			postIndex := iNdEx + intStringLen
+			if postIndex < 0 {
+				return ErrInvalidLengthNebula
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Ciphers = append(m.Ciphers, string(dAtA[iNdEx:postIndex]))
+			iNdEx = postIndex
+		case 7:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field PqKey", wireType)
+			}
+			var byteLen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowNebula
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				byteLen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if byteLen < 0 {
+				return ErrInvalidLengthNebula
+			}
+			postIndex := iNdEx + byteLen
+			if postIndex < 0 {
+				return ErrInvalidLengthNebula
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.PqKey = append(m.PqKey[:0], dAtA[iNdEx:postIndex]...)
+			if m.PqKey == nil {
+				m.PqKey = []byte{}
+			}
+			iNdEx = postIndex
+		case 8:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field PqCiphertext", wireType)
+			}
+			var byteLen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowNebula
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				byteLen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if byteLen < 0 {
+				return ErrInvalidLengthNebula
+			}
+			postIndex := iNdEx + byteLen
+			if postIndex < 0 {
+				return ErrInvalidLengthNebula
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.PqCiphertext = append(m.PqCiphertext[:0], dAtA[iNdEx:postIndex]...)
+			if m.PqCiphertext == nil {
+				m.PqCiphertext = []byte{}
+			}
+			iNdEx = postIndex
+		case 9:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field CertChain", wireType)
+			}
+			var byteLen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowNebula
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				byteLen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if byteLen < 0 {
+				return ErrInvalidLengthNebula
+			}
+			postIndex := iNdEx + byteLen
+			if postIndex < 0 {
+				return ErrInvalidLengthNebula
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.CertChain = append(m.CertChain, make([]byte, postIndex-iNdEx))
+			copy(m.CertChain[len(m.CertChain)-1], dAtA[iNdEx:postIndex])
+			iNdEx = postIndex
+		default:
+			iNdEx = preIndex
+			skippy, err := skipNebula(dAtA[iNdEx:])
+			if err != nil {
+				return err
+			}
+			if (skippy < 0) || (iNdEx+skippy) < 0 {
+				return ErrInvalidLengthNebula
+			}
+			if (iNdEx + skippy) > l {
+				return io.ErrUnexpectedEOF
+			}
+			iNdEx += skippy
+		}
+	}
+
+	if iNdEx > l {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+func (m *NebulaControl) Unmarshal(dAtA []byte) error {
+	l := len(dAtA)
+	iNdEx := 0
+	for iNdEx < l {
+		preIndex := iNdEx
+		var wire uint64
+		for shift := uint(0); ; shift += 7 {
+			if shift >= 64 {
+				return ErrIntOverflowNebula
+			}
+			if iNdEx >= l {
+				return io.ErrUnexpectedEOF
+			}
+			b := dAtA[iNdEx]
+			iNdEx++
+			wire |= uint64(b&0x7F) << shift
+			if b < 0x80 {
+				break
+			}
+		}
+		fieldNum := int32(wire >> 3)
+		wireType := int(wire & 0x7)
+		if wireType == 4 {
+			return fmt.Errorf("proto: NebulaControl: wiretype end group for non-group")
+		}
+		if fieldNum <= 0 {
+			return fmt.Errorf("proto: NebulaControl: illegal tag %d (wire type %d)", fieldNum, wire)
+		}
+		switch fieldNum {
+		case 1:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Type", wireType)
+			}
+			m.Type = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowNebula
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.Type |= NebulaControl_MessageType(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 2:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field InitiatorRelayIndex", wireType)
+			}
+			m.InitiatorRelayIndex = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowNebula
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.InitiatorRelayIndex |= uint32(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 3:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field ResponderRelayIndex", wireType)
+			}
+			m.ResponderRelayIndex = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowNebula
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.ResponderRelayIndex |= uint32(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 4:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field RelayToIp", wireType)
+			}
+			var msglen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowNebula
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				msglen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if msglen < 0 {
+				return ErrInvalidLengthNebula
+			}
+			postIndex := iNdEx + msglen
+			if postIndex < 0 {
+				return ErrInvalidLengthNebula
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			if m.RelayToIp == nil {
+				m.RelayToIp = &VpnAddr{}
+			}
+			if err := m.RelayToIp.Unmarshal(dAtA[iNdEx:postIndex]); err != nil {
+				return err
+			}
+			iNdEx = postIndex
+		case 5:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field RelayFromIp", wireType)
+			}
+			var msglen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowNebula
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				msglen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if msglen < 0 {
+				return ErrInvalidLengthNebula
+			}
+			postIndex := iNdEx + msglen
+			if postIndex < 0 {
+				return ErrInvalidLengthNebula
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			if m.RelayFromIp == nil {
+				m.RelayFromIp = &VpnAddr{}
+			}
+			if err := m.RelayFromIp.Unmarshal(dAtA[iNdEx:postIndex]); err != nil {
+				return err
+			}
+			iNdEx = postIndex
+		default:
+			iNdEx = preIndex
+			skippy, err := skipNebula(dAtA[iNdEx:])
+			if err != nil {
+				return err
+			}
+			if (skippy < 0) || (iNdEx+skippy) < 0 {
+				return ErrInvalidLengthNebula
+			}
+			if (iNdEx + skippy) > l {
+				return io.ErrUnexpectedEOF
+			}
+			iNdEx += skippy
+		}
+	}
+
+	if iNdEx > l {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
 func skipNebula(dAtA []byte) (n int, err error) {
 	l := len(dAtA)
 	iNdEx := 0
@@ -4,6 +4,8 @@ import (
 	"crypto/cipher"
 	"encoding/binary"
 	"errors"
+	"fmt"
+	"math"
 
 	"github.com/flynn/noise"
 )
@@ -12,17 +14,94 @@ type endianness interface {
 	PutUint64(b []byte, v uint64)
 }
 
-var noiseEndianness endianness = binary.BigEndian
+type nebulaCipher struct {
+	fn noise.CipherFunc
+	// endianness is how noise lays out the nonce for this cipher
+	endianness endianness
+}
+
+// nebulaCiphers are the ciphers a tunnel can use, by the name used in the config and the handshake
+var nebulaCiphers = map[string]nebulaCipher{
+	"aes":        {fn: noise.CipherAESGCM, endianness: binary.BigEndian},
+	"chachapoly": {fn: noise.CipherChaChaPoly, endianness: binary.LittleEndian},
+}
 
 type NebulaCipherState struct {
-	c noise.Cipher
+	c          noise.Cipher
+	endianness endianness
 	//k [32]byte
 	//n uint64
 }
 
-func NewNebulaCipherState(s *noise.CipherState) *NebulaCipherState {
-	return &NebulaCipherState{c: s.Cipher()}
+// NewNebulaCipherState takes the keys from a handshake done with hsCipher for use with cipher. When they differ the
+// key is run through the noise rekey function and used with cipher instead, the handshake key is never used with two
+// different ciphers. A hybrid handshake also mixes in pqSecret, it is nil otherwise.
+func NewNebulaCipherState(s *noise.CipherState, hsCipher, cipher string, pqSecret []byte) *NebulaCipherState {
+	c := s.Cipher()
+	if hsCipher != cipher || pqSecret != nil {
+		var k [32]byte
+		copy(k[:], c.Encrypt(nil, math.MaxUint64, []byte{}, k[:]))
+		if pqSecret != nil {
+			k = pqMixKey(k[:], pqSecret)
+		}
+		c = nebulaCiphers[cipher].fn.Cipher(k)
+	}
+
+	return &NebulaCipherState{c: c, endianness: nebulaCiphers[cipher].endianness}
+}
+
+// configCiphers returns the ciphers we accept for a tunnel in order of preference. The cipher we do handshakes with is
+// always first, ciphers can list the others we are willing to use.
+func configCiphers(hsCipher string, ciphers []string) ([]string, error) {
+	if _, ok := nebulaCiphers[hsCipher]; !ok {
+		return nil, fmt.Errorf("unknown cipher: %v", hsCipher)
+	}
+
+	out := []string{hsCipher}
+	for _, c := range ciphers {
+		if _, ok := nebulaCiphers[c]; !ok {
+			return nil, fmt.Errorf("unknown cipher in ciphers: %v", c)
+		}
+
+		if !stringsContain(out, c) {
+			out = append(out, c)
+		}
+	}
+
+	return out, nil
+}
+
+// negotiateCipher picks the cipher for a tunnel as the responder, our first preference that the initiator supports.
+// An initiator that did not list its ciphers can only use the one it did the handshake with.
+func negotiateCipher(ours, theirs []string, hsCipher string) (string, bool) {
+	if len(theirs) == 0 {
+		theirs = []string{hsCipher}
+	}
+
+	for _, c := range ours {
+		if stringsContain(theirs, c) {
+			return c, true
+		}
+	}
+
+	return "", false
+}
+
+func stringsContain(s []string, v string) bool {
+	for _, x := range s {
+		if x == v {
+			return true
+		}
+	}
+	return false
+}
 
+// Overhead returns the number of bytes the cipher adds to a sealed message
+func (s *NebulaCipherState) Overhead() int {
+	if s != nil {
+		return s.c.(cipher.AEAD).Overhead()
+	}
+	return 0
 }
 
 func (s *NebulaCipherState) EncryptDanger(out, ad, plaintext []byte, n uint64, nb []byte) ([]byte, error) {
@@ -37,7 +116,7 @@ func (s *NebulaCipherState) EncryptDanger(out, ad, plaintext []byte, n uint64, n
 		nb[1] = 0
 		nb[2] = 0
 		nb[3] = 0
-		noiseEndianness.PutUint64(nb[4:], n)
+		s.endianness.PutUint64(nb[4:], n)
 		out = s.c.(cipher.AEAD).Seal(out, nb, plaintext, ad)
 		//l.Debugf("Encryption: outlen: %d, nonce: %d, ad: %s, plainlen %d", len(out), n, ad, len(plaintext))
 		return out, nil
@@ -52,7 +131,7 @@ func (s *NebulaCipherState) DecryptDanger(out, ad, ciphertext []byte, n uint64,
 		nb[1] = 0
 		nb[2] = 0
 		nb[3] = 0
-		noiseEndianness.PutUint64(nb[4:], n)
+		s.endianness.PutUint64(nb[4:], n)
 		return s.c.(cipher.AEAD).Open(out, nb, ciphertext, ad)
 	} else {
 		return []byte{}, nil
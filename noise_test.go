@@ -0,0 +1,81 @@
+package nebula
+
+import (
+	"crypto/rand"
+	"testing"
+
+	"github.com/flynn/noise"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfigCiphers(t *testing.T) {
+	c, err := configCiphers("aes", []string{})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"aes"}, c)
+
+	c, err = configCiphers("chachapoly", []string{"aes", "chachapoly"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"chachapoly", "aes"}, c)
+
+	_, err = configCiphers("des", []string{})
+	assert.EqualError(t, err, "unknown cipher: des")
+
+	_, err = configCiphers("aes", []string{"des"})
+	assert.EqualError(t, err, "unknown cipher in ciphers: des")
+}
+
+func TestNegotiateCipher(t *testing.T) {
+	// Our preference wins
+	c, ok := negotiateCipher([]string{"aes", "chachapoly"}, []string{"chachapoly", "aes"}, "chachapoly")
+	assert.True(t, ok)
+	assert.Equal(t, "aes", c)
+
+	c, ok = negotiateCipher([]string{"aes", "chachapoly"}, []string{"chachapoly"}, "chachapoly")
+	assert.True(t, ok)
+	assert.Equal(t, "chachapoly", c)
+
+	// Older nodes don't list anything, they can only use the handshake cipher
+	c, ok = negotiateCipher([]string{"aes", "chachapoly"}, nil, "chachapoly")
+	assert.True(t, ok)
+	assert.Equal(t, "chachapoly", c)
+
+	_, ok = negotiateCipher([]string{"aes"}, nil, "chachapoly")
+	assert.False(t, ok)
+}
+
+// noiseHandshake returns the cipher states both sides of a chachapoly handshake arrive at
+func noiseHandshake() ([2]*noise.CipherState, [2]*noise.CipherState) {
+	cs := noise.NewCipherSuite(noise.DH25519, noise.CipherChaChaPoly, noise.HashSHA256)
+	i, _ := noise.NewHandshakeState(noise.Config{CipherSuite: cs, Random: rand.Reader, Pattern: noise.HandshakeNN, Initiator: true})
+	r, _ := noise.NewHandshakeState(noise.Config{CipherSuite: cs, Random: rand.Reader, Pattern: noise.HandshakeNN})
+	msg, _, _, _ := i.WriteMessage(nil, nil)
+	_, _, _, _ = r.ReadMessage(nil, msg)
+	msg, r0, r1, _ := r.WriteMessage(nil, nil)
+	_, i0, i1, _ := i.ReadMessage(nil, msg)
+	return [2]*noise.CipherState{i0, i1}, [2]*noise.CipherState{r0, r1}
+}
+
+func TestNewNebulaCipherState(t *testing.T) {
+	nb := make([]byte, 12)
+	for _, cipher := range []string{"chachapoly", "aes"} {
+		i, r := noiseHandshake()
+		iState := NewNebulaCipherState(i[0], "chachapoly", cipher, nil)
+		rState := NewNebulaCipherState(r[0], "chachapoly", cipher, nil)
+
+		out, err := iState.EncryptDanger(nil, []byte("ad"), []byte("hello"), 2, nb)
+		assert.NoError(t, err)
+		plain, err := rState.DecryptDanger(nil, []byte("ad"), out, 2, nb)
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("hello"), plain, cipher)
+
+		_, err = rState.DecryptDanger(nil, []byte("ad"), out, 3, nb)
+		assert.Error(t, err, cipher)
+	}
+
+	// A switched cipher must not reuse the handshake key
+	i, r := noiseHandshake()
+	plainState := NewNebulaCipherState(i[0], "chachapoly", "chachapoly", nil)
+	out, _ := plainState.EncryptDanger(nil, nil, []byte("hello"), 2, nb)
+	_, err := NewNebulaCipherState(r[0], "chachapoly", "aes", nil).DecryptDanger(nil, nil, out, 2, nb)
+	assert.Error(t, err)
+}
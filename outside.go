@@ -11,13 +11,29 @@ import (
 	"github.com/sirupsen/logrus"
 	"github.com/slackhq/nebula/cert"
 	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
 )
 
 const (
 	minFwPacketLen = 4
 )
 
-func (f *Interface) readOutsidePackets(addr *udpAddr, out []byte, packet []byte, header *Header, fwPacket *FirewallPacket, lhh *LightHouseHandler, nb []byte, q int, localCache ConntrackCache) {
+// ipv6 extension headers that newPacket knows how to skip over
+const (
+	ipv6HopByHop   = 0
+	ipv6Routing    = 43
+	ipv6Fragment   = 44
+	ipv6AuthHeader = 51
+	ipv6DestOpts   = 60
+)
+
+// ViaSender describes the relay a packet arrived through when it did not come directly from the sender
+type ViaSender struct {
+	relayHI *HostInfo // The tunnel to the relay the packet came through
+	relay   Relay     // Our end of the relay, PeerIp is the host the packet is from
+}
+
+func (f *Interface) readOutsidePackets(addr *udpAddr, via *ViaSender, out []byte, packet []byte, header *Header, fwPacket *FirewallPacket, lhh *LightHouseHandler, nb []byte, q int, localCache ConntrackCache) {
 	err := header.Parse(packet)
 	if err != nil {
 		// TODO: best if we return this and let caller log
@@ -32,7 +48,12 @@ func (f *Interface) readOutsidePackets(addr *udpAddr, out []byte, packet []byte,
 	//l.Error("in packet ", header, packet[HeaderLen:])
 
 	// verify if we've seen this index before, otherwise respond to the handshake initiation
-	hostinfo, err := f.hostMap.QueryIndex(header.RemoteIndex)
+	var hostinfo *HostInfo
+	if header.Type == message && header.Subtype == messageRelay {
+		hostinfo, err = f.hostMap.QueryRelayIndex(header.RemoteIndex)
+	} else {
+		hostinfo, err = f.hostMap.QueryIndex(header.RemoteIndex)
+	}
 
 	var ci *ConnectionState
 	if err == nil {
@@ -41,6 +62,11 @@ func (f *Interface) readOutsidePackets(addr *udpAddr, out []byte, packet []byte,
 
 	switch header.Type {
 	case message:
+		if header.Subtype == messageRelay {
+			f.handleRelayPacket(hostinfo, addr, via, out, packet, header, fwPacket, lhh, nb, q, localCache)
+			return
+		}
+
 		if !f.handleEncrypted(ci, addr, header) {
 			return
 		}
@@ -90,7 +116,9 @@ func (f *Interface) readOutsidePackets(addr *udpAddr, out []byte, packet []byte,
 		if header.Subtype == testRequest {
 			// This testRequest might be from TryPromoteBest, so we should roam
 			// to the new IP address before responding
-			f.handleHostRoaming(hostinfo, addr)
+			if via == nil {
+				f.handleHostRoaming(hostinfo, addr)
+			}
 			f.send(test, testReply, ci, hostinfo, hostinfo.remote, d, nb, out)
 		}
 
@@ -101,11 +129,15 @@ func (f *Interface) readOutsidePackets(addr *udpAddr, out []byte, packet []byte,
 
 	case handshake:
 		f.messageMetrics.Rx(header.Type, header.Subtype, 1)
-		HandleIncomingHandshake(f, addr, packet, header, hostinfo)
+		HandleIncomingHandshake(f, addr, via, packet, header, hostinfo)
 		return
 
 	case recvError:
 		f.messageMetrics.Rx(header.Type, header.Subtype, 1)
+		if via != nil {
+			// The relay can vouch for who sent this but not for the remote index it claims to be about
+			return
+		}
 		f.handleRecvError(addr, header)
 		return
 
@@ -115,21 +147,127 @@ func (f *Interface) readOutsidePackets(addr *udpAddr, out []byte, packet []byte,
 			return
 		}
 
+		if current, err := f.hostMap.QueryVpnIP(hostinfo.hostId); err == nil && current != hostinfo {
+			// The tunnel was already replaced by a newer handshake, only its retired index is left to clean up
+			f.hostMap.DeleteIndex(hostinfo.localIndexId)
+			return
+		}
+
 		hostinfo.logger(f.l).WithField("udpAddr", addr).
 			Info("Close tunnel received, tearing down.")
 
 		f.closeTunnel(hostinfo, false)
 		return
 
+	case pathCheck:
+		f.messageMetrics.Rx(header.Type, header.Subtype, 1)
+		if !f.handleEncrypted(ci, addr, header) {
+			return
+		}
+
+		d, err := f.decrypt(hostinfo, header.MessageCounter, out, packet, header, nb)
+		if err != nil {
+			hostinfo.logger(f.l).WithError(err).WithField("udpAddr", addr).
+				WithField("packet", packet).
+				Error("Failed to decrypt path check packet")
+			return
+		}
+
+		f.handlePathCheck(hostinfo, addr, header, d, nb, out)
+
+		// Path checks arrive on every path on purpose, they must not make us roam
+		f.connectionManager.In(hostinfo.hostId)
+		return
+
+	case control:
+		f.messageMetrics.Rx(header.Type, header.Subtype, 1)
+		if !f.handleEncrypted(ci, addr, header) {
+			return
+		}
+
+		d, err := f.decrypt(hostinfo, header.MessageCounter, out, packet, header, nb)
+		if err != nil {
+			hostinfo.logger(f.l).WithError(err).WithField("udpAddr", addr).
+				WithField("packet", packet).
+				Error("Failed to decrypt control packet")
+			return
+		}
+
+		m := &NebulaControl{}
+		err = m.Unmarshal(d)
+		if err != nil {
+			hostinfo.logger(f.l).WithError(err).Error("Failed to unmarshal control message")
+			return
+		}
+
+		f.relayManager.HandleControlMsg(hostinfo, m, f)
+
+		// Fallthrough to the bottom to record incoming traffic
+
 	default:
 		f.messageMetrics.Rx(header.Type, header.Subtype, 1)
 		hostinfo.logger(f.l).Debugf("Unexpected packet received from %s", addr)
 		return
 	}
 
-	f.handleHostRoaming(hostinfo, addr)
+	if via == nil {
+		f.handleHostRoaming(hostinfo, addr)
+	}
+
+	f.connectionManager.In(hostinfo.hostId)
+	hostinfo.stats.rx(len(packet))
+}
+
+// handleRelayPacket verifies a packet that was wrapped for a relay, it is either handed back to readOutsidePackets if
+// we are the end of the relay or forwarded on to the other end if we are the relay
+func (f *Interface) handleRelayPacket(hostinfo *HostInfo, addr *udpAddr, via *ViaSender, out []byte, packet []byte, header *Header, fwPacket *FirewallPacket, lhh *LightHouseHandler, nb []byte, q int, localCache ConntrackCache) {
+	if via != nil {
+		// Relays are only one hop, a relay packet inside of a relay packet is garbage
+		return
+	}
+
+	// Relay indexes are not tunnel indexes so there is no point in sending a recv_error for an unknown one
+	if hostinfo == nil || hostinfo.ConnectionState == nil || !hostinfo.ConnectionState.window.Check(f.l, header.MessageCounter) {
+		return
+	}
+
+	inner, err := f.decryptRelay(hostinfo, header.MessageCounter, out, packet, nb)
+	if err != nil {
+		hostinfo.logger(f.l).WithError(err).WithField("udpAddr", addr).Error("Failed to authenticate relay packet")
+		return
+	}
 
+	// The relay packet is authentic, record traffic for the tunnel it came in on
+	f.handleHostRoaming(hostinfo, addr)
 	f.connectionManager.In(hostinfo.hostId)
+	hostinfo.stats.rx(len(packet))
+
+	relay, ok := hostinfo.relayState.QueryRelayForByIdx(header.RemoteIndex)
+	if !ok {
+		hostinfo.logger(f.l).WithField("relayIndex", header.RemoteIndex).Debug("Relay packet received for an unknown relay")
+		return
+	}
+
+	switch relay.Type {
+	case relayTerminal:
+		// We are the end of the relay, process the wrapped packet as if it came to us directly
+		f.readOutsidePackets(nil, &ViaSender{relayHI: hostinfo, relay: relay}, out[:0], inner, header, fwPacket, lhh, nb, q, localCache)
+
+	case relayForwarding:
+		targetHI, err := f.hostMap.QueryVpnIP(relay.PeerIp)
+		if err != nil {
+			hostinfo.logger(f.l).WithField("relayTo", relay.PeerIp).Debug("Dropping relay packet, no tunnel to the relay target")
+			return
+		}
+
+		targetRelay, ok := targetHI.relayState.QueryRelayForByIp(hostinfo.hostId)
+		if !ok || targetRelay.State != relayEstablished {
+			hostinfo.logger(f.l).WithField("relayTo", relay.PeerIp).Debug("Dropping relay packet, the relay to the target is not established")
+			return
+		}
+
+		f.SendVia(targetHI, targetRelay, inner, nb, out)
+	}
 }
 
 // closeTunnel closes a tunnel locally, it does not send a closeTunnel packet to the remote
@@ -153,6 +291,10 @@ func (f *Interface) sendCloseTunnel(h *HostInfo) {
 
 func (f *Interface) handleHostRoaming(hostinfo *HostInfo, addr *udpAddr) {
 	if hostDidRoam(hostinfo.remote, addr) {
+		if hostinfo.paths != nil && hostinfo.paths.selects(addr) {
+			// The path manager picked the remote, a multi-homed host may just be answering from another address
+			return
+		}
 		if !f.lightHouse.remoteAllowList.Allow(addr.IP) {
 			hostinfo.logger(f.l).WithField("newAddr", addr).Debug("lighthouse.remote_allow_list denied roaming")
 			return
@@ -168,8 +310,7 @@ func (f *Interface) handleHostRoaming(hostinfo *HostInfo, addr *udpAddr) {
 		hostinfo.logger(f.l).WithField("udpAddr", hostinfo.remote).WithField("newAddr", addr).
 			Info("Host roamed to new udp ip/port.")
 		hostinfo.lastRoam = time.Now()
-		remoteCopy := *hostinfo.remote
-		hostinfo.lastRoamRemote = &remoteCopy
+		hostinfo.lastRoamRemote = hostinfo.remote.Copy()
 		hostinfo.SetRemote(addr)
 	}
 
@@ -179,7 +320,10 @@ func (f *Interface) handleEncrypted(ci *ConnectionState, addr *udpAddr, header *
 	// If connectionstate exists and the replay protector allows, process packet
 	// Else, send recv errors for 300 seconds after a restart to allow fast reconnection.
 	if ci == nil || !ci.window.Check(f.l, header.MessageCounter) {
-		f.sendRecvError(addr, header.RemoteIndex)
+		// We can't tell the sender anything useful when the packet came through a relay
+		if addr != nil {
+			f.sendRecvError(addr, header.RemoteIndex)
+		}
 		return false
 	}
 
@@ -193,11 +337,17 @@ func newPacket(data []byte, incoming bool, fp *FirewallPacket) error {
 		return fmt.Errorf("packet is less than %v bytes", ipv4.HeaderLen)
 	}
 
-	// Is it an ipv4 packet?
-	if int((data[0]>>4)&0x0f) != 4 {
-		return fmt.Errorf("packet is not ipv4, type: %v", int((data[0]>>4)&0x0f))
+	switch int((data[0] >> 4) & 0x0f) {
+	case 4:
+		return newPacket4(data, incoming, fp)
+	case 6:
+		return newPacket6(data, incoming, fp)
 	}
 
+	return fmt.Errorf("packet is not ipv4 or ipv6, type: %v", int((data[0]>>4)&0x0f))
+}
+
+func newPacket4(data []byte, incoming bool, fp *FirewallPacket) error {
 	// Adjust our start position based on the advertised ip header length
 	ihl := int(data[0]&0x0f) << 2
 
@@ -215,37 +365,141 @@ func newPacket(data []byte, incoming bool, fp *FirewallPacket) error {
 
 	// Accounting for a variable header length, do we have enough data for our src/dst tuples?
 	minLen := ihl
-	if !fp.Fragment && fp.Protocol != fwProtoICMP {
-		minLen += minFwPacketLen
+	if !fp.Fragment {
+		minLen += transportMinLen(fp.Protocol)
 	}
 	if len(data) < minLen {
 		return fmt.Errorf("packet is less than %v bytes, ip header len: %v", minLen, ihl)
 	}
 
+	src := NewVpnIp4(binary.BigEndian.Uint32(data[12:16]))
+	dst := NewVpnIp4(binary.BigEndian.Uint32(data[16:20]))
+	setPacketTuple(data, ihl, incoming, fp, src, dst)
+	return nil
+}
+
+func newPacket6(data []byte, incoming bool, fp *FirewallPacket) error {
+	if len(data) < ipv6.HeaderLen {
+		return fmt.Errorf("ipv6 packet is less than %v bytes", ipv6.HeaderLen)
+	}
+
+	proto, offset, fragment, err := ipv6TransportHeader(data)
+	if err != nil {
+		return err
+	}
+
+	fp.Fragment = fragment
+	fp.Protocol = proto
+	if proto == fwProtoICMPv6 {
+		fp.Protocol = fwProtoICMP
+	}
+
+	minLen := offset
+	if !fp.Fragment {
+		minLen += transportMinLen(fp.Protocol)
+	}
+	if len(data) < minLen {
+		return fmt.Errorf("packet is less than %v bytes, ip header len: %v", minLen, offset)
+	}
+
+	src := VpnIp{Hi: binary.BigEndian.Uint64(data[8:16]), Lo: binary.BigEndian.Uint64(data[16:24])}
+	dst := VpnIp{Hi: binary.BigEndian.Uint64(data[24:32]), Lo: binary.BigEndian.Uint64(data[32:40])}
+	setPacketTuple(data, offset, incoming, fp, src, dst)
+	return nil
+}
+
+// setPacketTuple fills in the locally oriented addresses and ports, transport is the offset of the transport header
+func setPacketTuple(data []byte, transport int, incoming bool, fp *FirewallPacket, src, dst VpnIp) {
+	var srcPort, dstPort uint16
+	if !fp.Fragment && fp.Protocol != fwProtoICMP {
+		srcPort = binary.BigEndian.Uint16(data[transport : transport+2])
+		dstPort = binary.BigEndian.Uint16(data[transport+2 : transport+4])
+	}
+
 	// Firewall packets are locally oriented
 	if incoming {
-		fp.RemoteIP = binary.BigEndian.Uint32(data[12:16])
-		fp.LocalIP = binary.BigEndian.Uint32(data[16:20])
-		if fp.Fragment || fp.Protocol == fwProtoICMP {
-			fp.RemotePort = 0
-			fp.LocalPort = 0
-		} else {
-			fp.RemotePort = binary.BigEndian.Uint16(data[ihl : ihl+2])
-			fp.LocalPort = binary.BigEndian.Uint16(data[ihl+2 : ihl+4])
-		}
+		fp.RemoteIP, fp.LocalIP = src, dst
+		fp.RemotePort, fp.LocalPort = srcPort, dstPort
 	} else {
-		fp.LocalIP = binary.BigEndian.Uint32(data[12:16])
-		fp.RemoteIP = binary.BigEndian.Uint32(data[16:20])
-		if fp.Fragment || fp.Protocol == fwProtoICMP {
-			fp.RemotePort = 0
-			fp.LocalPort = 0
-		} else {
-			fp.LocalPort = binary.BigEndian.Uint16(data[ihl : ihl+2])
-			fp.RemotePort = binary.BigEndian.Uint16(data[ihl+2 : ihl+4])
+		fp.LocalIP, fp.RemoteIP = src, dst
+		fp.LocalPort, fp.RemotePort = srcPort, dstPort
+	}
+
+	if !fp.Fragment && fp.Protocol == fwProtoICMP {
+		// The type and code stand in for ports, see FirewallPacket
+		fp.RemotePort = binary.BigEndian.Uint16(data[transport : transport+2])
+		if isICMPEcho(data[transport]) && len(data) >= transport+6 {
+			fp.LocalPort = binary.BigEndian.Uint16(data[transport+4 : transport+6])
 		}
 	}
+}
 
-	return nil
+// transportMinLen is how much of the transport header we need to build a FirewallPacket
+func transportMinLen(proto uint8) int {
+	if proto == fwProtoICMP {
+		// The type and code
+		return 2
+	}
+	return minFwPacketLen
+}
+
+// ipv6TransportHeader walks the ipv6 extension header chain to find the upper layer protocol and its offset.
+// fragment is true if this is the second or further fragment of a fragmented packet.
+func ipv6TransportHeader(data []byte) (proto uint8, offset int, fragment bool, err error) {
+	proto = data[6]
+	offset = ipv6.HeaderLen
+
+	for {
+		switch proto {
+		case ipv6HopByHop, ipv6Routing, ipv6DestOpts:
+			if len(data) < offset+8 {
+				return 0, 0, false, fmt.Errorf("ipv6 packet had a truncated extension header: %v", proto)
+			}
+			proto = data[offset]
+			offset += (int(data[offset+1]) + 1) << 3
+
+		case ipv6AuthHeader:
+			if len(data) < offset+8 {
+				return 0, 0, false, fmt.Errorf("ipv6 packet had a truncated extension header: %v", proto)
+			}
+			proto = data[offset]
+			offset += (int(data[offset+1]) + 2) << 2
+
+		case ipv6Fragment:
+			if len(data) < offset+8 {
+				return 0, 0, false, fmt.Errorf("ipv6 packet had a truncated extension header: %v", proto)
+			}
+			// The low 3 bits are reserved and the M flag, the rest is the fragment offset
+			if binary.BigEndian.Uint16(data[offset+2:offset+4])&^0x7 != 0 {
+				fragment = true
+			}
+			proto = data[offset]
+			offset += 8
+
+		default:
+			return proto, offset, fragment, nil
+		}
+	}
+}
+
+// ipHeaderLen returns the offset of the transport header in an ip packet or -1 if it can not be determined
+func ipHeaderLen(p []byte) int {
+	if len(p) < ipv4.HeaderLen {
+		return -1
+	}
+
+	if p[0]>>4 == 6 {
+		if len(p) < ipv6.HeaderLen {
+			return -1
+		}
+		_, offset, _, err := ipv6TransportHeader(p)
+		if err != nil {
+			return -1
+		}
+		return offset
+	}
+
+	return int(p[0]&0x0f) << 2
 }
 
 func (f *Interface) decrypt(hostinfo *HostInfo, mc uint64, out []byte, packet []byte, header *Header, nb []byte) ([]byte, error) {
@@ -264,6 +518,32 @@ func (f *Interface) decrypt(hostinfo *HostInfo, mc uint64, out []byte, packet []
 	return out, nil
 }
 
+// decryptRelay authenticates a relay packet, which carries no plaintext, and returns the wrapped nebula packet
+func (f *Interface) decryptRelay(hostinfo *HostInfo, mc uint64, out []byte, packet []byte, nb []byte) ([]byte, error) {
+	dKey := hostinfo.ConnectionState.dKey
+	if dKey == nil {
+		return nil, errors.New("no cipher state available to authenticate")
+	}
+
+	overhead := dKey.Overhead()
+	if len(packet) < HeaderLen+overhead {
+		return nil, errors.New("relay packet is too short")
+	}
+
+	// Everything but the trailing tag is authenticated data
+	signedPayload := packet[:len(packet)-overhead]
+	_, err := dKey.DecryptDanger(out, signedPayload, packet[len(packet)-overhead:], mc, nb)
+	if err != nil {
+		return nil, err
+	}
+
+	if !hostinfo.ConnectionState.window.Update(f.l, mc) {
+		return nil, errors.New("out of window packet")
+	}
+
+	return signedPayload[HeaderLen:], nil
+}
+
 func (f *Interface) decryptToTun(hostinfo *HostInfo, messageCounter uint64, out []byte, packet []byte, fwPacket *FirewallPacket, nb []byte, q int, localCache ConntrackCache) {
 	var err error
 
@@ -310,7 +590,7 @@ func (f *Interface) sendRecvError(endpoint *udpAddr, index uint32) {
 
 	//TODO: this should be a signed message so we can trust that we should drop the index
 	b := HeaderEncode(make([]byte, HeaderLen), Version, uint8(recvError), 0, index, 0)
-	f.outside.WriteTo(b, endpoint)
+	f.writeTo(f.outside, b, endpoint)
 	if f.l.Level >= logrus.DebugLevel {
 		f.l.WithField("index", index).
 			WithField("udpAddr", endpoint).
@@ -376,42 +656,53 @@ func (f *Interface) sendMeta(ci *ConnectionState, endpoint *net.UDPAddr, meta *N
 }
 */
 
-func RecombineCertAndValidate(h *noise.HandshakeState, rawCertBytes []byte, caPool *cert.NebulaCAPool) (*cert.NebulaCertificate, error) {
+// RecombineCertAndValidate puts the peer's static key back into the certificate they sent and verifies it, along with
+// any intermediate CAs in rawChain. The verified signers of the certificate are returned, ending with the root
+func RecombineCertAndValidate(h *noise.HandshakeState, rawCertBytes []byte, rawChain [][]byte, caPool *cert.NebulaCAPool) (*cert.NebulaCertificate, []*cert.NebulaCertificate, error) {
 	pk := h.PeerStatic()
 
 	if pk == nil {
-		return nil, errors.New("no peer static key was present")
+		return nil, nil, errors.New("no peer static key was present")
 	}
 
 	if rawCertBytes == nil {
-		return nil, errors.New("provided payload was empty")
+		return nil, nil, errors.New("provided payload was empty")
 	}
 
 	r := &cert.RawNebulaCertificate{}
 	err := proto.Unmarshal(rawCertBytes, r)
 	if err != nil {
-		return nil, fmt.Errorf("error unmarshaling cert: %s", err)
+		return nil, nil, fmt.Errorf("error unmarshaling cert: %s", err)
 	}
 
 	// If the Details are nil, just exit to avoid crashing
 	if r.Details == nil {
-		return nil, fmt.Errorf("certificate did not contain any details")
+		return nil, nil, fmt.Errorf("certificate did not contain any details")
 	}
 
 	r.Details.PublicKey = pk
 	recombined, err := proto.Marshal(r)
 	if err != nil {
-		return nil, fmt.Errorf("error while recombining certificate: %s", err)
+		return nil, nil, fmt.Errorf("error while recombining certificate: %s", err)
+	}
+
+	intermediates := make([]*cert.NebulaCertificate, len(rawChain))
+	for i, b := range rawChain {
+		intermediates[i], err = cert.UnmarshalNebulaCertificate(b)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error unmarshaling intermediate cert: %s", err)
+		}
+	}
+
+	c, err := cert.UnmarshalNebulaCertificate(recombined)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error while unmarshaling recombined certificate: %s", err)
 	}
 
-	c, _ := cert.UnmarshalNebulaCertificate(recombined)
-	isValid, err := c.Verify(time.Now(), caPool)
+	signers, err := c.VerifyWithChain(time.Now(), caPool, intermediates)
 	if err != nil {
-		return c, fmt.Errorf("certificate validation failed: %s", err)
-	} else if !isValid {
-		// This case should never happen but here's to defensive programming!
-		return c, errors.New("certificate validation failed but did not return an error")
+		return c, nil, fmt.Errorf("certificate validation failed: %s", err)
 	}
 
-	return c, nil
+	return c, signers, nil
 }
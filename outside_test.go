@@ -1,11 +1,13 @@
 package nebula
 
 import (
+	"encoding/binary"
 	"net"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
 )
 
 func Test_newPacket(t *testing.T) {
@@ -29,9 +31,9 @@ func Test_newPacket(t *testing.T) {
 
 	assert.EqualError(t, err, "packet is less than 28 bytes, ip header len: 24")
 
-	// not an ipv4 packet
+	// not an ipv4 or ipv6 packet
 	err = newPacket([]byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}, true, p)
-	assert.EqualError(t, err, "packet is not ipv4, type: 0")
+	assert.EqualError(t, err, "packet is not ipv4 or ipv6, type: 0")
 
 	// invalid ihl
 	err = newPacket([]byte{4<<4 | (8 >> 2 & 0x0f), 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}, true, p)
@@ -53,8 +55,8 @@ func Test_newPacket(t *testing.T) {
 
 	assert.Nil(t, err)
 	assert.Equal(t, p.Protocol, uint8(fwProtoTCP))
-	assert.Equal(t, p.LocalIP, ip2int(net.IPv4(10, 0, 0, 2)))
-	assert.Equal(t, p.RemoteIP, ip2int(net.IPv4(10, 0, 0, 1)))
+	assert.Equal(t, p.LocalIP, NewVpnIp(net.IPv4(10, 0, 0, 2)))
+	assert.Equal(t, p.RemoteIP, NewVpnIp(net.IPv4(10, 0, 0, 1)))
 	assert.Equal(t, p.RemotePort, uint16(3))
 	assert.Equal(t, p.LocalPort, uint16(4))
 
@@ -74,8 +76,105 @@ func Test_newPacket(t *testing.T) {
 
 	assert.Nil(t, err)
 	assert.Equal(t, p.Protocol, uint8(2))
-	assert.Equal(t, p.LocalIP, ip2int(net.IPv4(10, 0, 0, 1)))
-	assert.Equal(t, p.RemoteIP, ip2int(net.IPv4(10, 0, 0, 2)))
+	assert.Equal(t, p.LocalIP, NewVpnIp(net.IPv4(10, 0, 0, 1)))
+	assert.Equal(t, p.RemoteIP, NewVpnIp(net.IPv4(10, 0, 0, 2)))
 	assert.Equal(t, p.RemotePort, uint16(6))
 	assert.Equal(t, p.LocalPort, uint16(5))
+
+	// icmp has its type and code in RemotePort and the echo identifier in LocalPort
+	h = ipv4.Header{
+		Version:  1,
+		Protocol: fwProtoICMP,
+		Len:      100,
+		Src:      net.IPv4(10, 0, 0, 1),
+		Dst:      net.IPv4(10, 0, 0, 2),
+	}
+
+	b, _ = h.Marshal()
+	err = newPacket(append(b, icmpEchoRequest, 0, 0, 0, 0, 7, 0, 1), false, p)
+	assert.Nil(t, err)
+	assert.Equal(t, uint16(icmpEchoRequest<<8), p.RemotePort)
+	assert.Equal(t, uint16(7), p.LocalPort)
+
+	// icmp errors have no identifier
+	err = newPacket(append(b, 3, 4, 0, 0, 0, 7, 0, 1), true, p)
+	assert.Nil(t, err)
+	assert.Equal(t, uint16(3<<8|4), p.RemotePort)
+	assert.Equal(t, uint16(0), p.LocalPort)
+}
+
+func Test_newPacket6(t *testing.T) {
+	p := &FirewallPacket{}
+	src := net.ParseIP("fd00::1")
+	dst := net.ParseIP("fd00::2")
+
+	build := func(next uint8, payload ...byte) []byte {
+		return newIpv6Packet(next, src, dst, payload)
+	}
+
+	// too short
+	err := newPacket(build(fwProtoUDP)[:30], true, p)
+	assert.EqualError(t, err, "ipv6 packet is less than 40 bytes")
+
+	// missing the transport ports
+	err = newPacket(build(fwProtoUDP, 0, 3), true, p)
+	assert.EqualError(t, err, "packet is less than 44 bytes, ip header len: 40")
+
+	// incoming udp
+	err = newPacket(build(fwProtoUDP, 0, 3, 0, 4), true, p)
+	assert.Nil(t, err)
+	assert.Equal(t, uint8(fwProtoUDP), p.Protocol)
+	assert.Equal(t, NewVpnIp(dst), p.LocalIP)
+	assert.Equal(t, NewVpnIp(src), p.RemoteIP)
+	assert.Equal(t, uint16(3), p.RemotePort)
+	assert.Equal(t, uint16(4), p.LocalPort)
+	assert.False(t, p.Fragment)
+
+	// outgoing tcp behind a hop-by-hop options header
+	err = newPacket(build(ipv6HopByHop, fwProtoTCP, 0, 0, 0, 0, 0, 0, 0, 0, 5, 0, 6), false, p)
+	assert.Nil(t, err)
+	assert.Equal(t, uint8(fwProtoTCP), p.Protocol)
+	assert.Equal(t, NewVpnIp(src), p.LocalIP)
+	assert.Equal(t, NewVpnIp(dst), p.RemoteIP)
+	assert.Equal(t, uint16(6), p.RemotePort)
+	assert.Equal(t, uint16(5), p.LocalPort)
+
+	// icmpv6 is treated as icmp, the type and code are in RemotePort and a truncated echo has no identifier
+	err = newPacket(build(fwProtoICMPv6, 128, 0), true, p)
+	assert.Nil(t, err)
+	assert.Equal(t, uint8(fwProtoICMP), p.Protocol)
+	assert.Equal(t, uint16(128<<8), p.RemotePort)
+	assert.Equal(t, uint16(0), p.LocalPort)
+
+	// icmpv6 echo identifier
+	err = newPacket(build(fwProtoICMPv6, 129, 0, 0, 0, 0x12, 0x34, 0, 1), true, p)
+	assert.Nil(t, err)
+	assert.Equal(t, uint16(129<<8), p.RemotePort)
+	assert.Equal(t, uint16(0x1234), p.LocalPort)
+
+	// icmpv6 without a type
+	err = newPacket(build(fwProtoICMPv6), true, p)
+	assert.EqualError(t, err, "packet is less than 42 bytes, ip header len: 40")
+
+	// a non first fragment has no transport header
+	err = newPacket(build(ipv6Fragment, fwProtoUDP, 0, 0, 8, 0, 0, 0, 1), true, p)
+	assert.Nil(t, err)
+	assert.Equal(t, uint8(fwProtoUDP), p.Protocol)
+	assert.True(t, p.Fragment)
+
+	// truncated extension header
+	err = newPacket(build(ipv6Routing, fwProtoUDP, 0), true, p)
+	assert.EqualError(t, err, "ipv6 packet had a truncated extension header: 43")
+}
+
+// newIpv6Packet builds a minimal ipv6 packet, golang.org/x/net/ipv6 does not provide a header marshaller
+func newIpv6Packet(next uint8, src, dst net.IP, payload []byte) []byte {
+	b := make([]byte, ipv6.HeaderLen, ipv6.HeaderLen+len(payload))
+	b[0] = 6 << 4
+	binary.BigEndian.PutUint16(b[4:6], uint16(len(payload)))
+	b[6] = next
+	b[7] = 64
+	copy(b[8:24], src.To16())
+	copy(b[24:40], dst.To16())
+	return append(b, payload...)
 }
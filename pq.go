@@ -0,0 +1,65 @@
+package nebula
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// pqMode is how handshakes.pq_hybrid is configured
+type pqMode int
+
+const (
+	// pqDisabled starts classic handshakes, hybrid handshakes from others are still answered
+	pqDisabled pqMode = iota
+	// pqEnabled starts hybrid handshakes and answers both kinds
+	pqEnabled
+	// pqRequired starts hybrid handshakes and refuses classic ones
+	pqRequired
+)
+
+var errPqUnsupported = errors.New("this build of nebula does not support post-quantum handshakes")
+
+func (p pqMode) String() string {
+	switch p {
+	case pqDisabled:
+		return "disabled"
+	case pqEnabled:
+		return "enabled"
+	case pqRequired:
+		return "required"
+	}
+	return fmt.Sprintf("unknown(%d)", int(p))
+}
+
+func configPqMode(s string) (pqMode, error) {
+	var p pqMode
+	switch s {
+	case "disabled", "false":
+		return pqDisabled, nil
+	case "enabled", "true":
+		p = pqEnabled
+	case "required":
+		p = pqRequired
+	default:
+		return pqDisabled, fmt.Errorf("unknown handshakes.pq_hybrid mode: %v", s)
+	}
+
+	if !pqSupported {
+		return pqDisabled, errPqUnsupported
+	}
+	return p, nil
+}
+
+// pqMixKey derives the tunnel key for one direction from the key noise arrived at and the secret both sides got from
+// the KEM. An attacker has to break both X25519 and the KEM to learn it
+func pqMixKey(noiseKey, pqSecret []byte) [32]byte {
+	var k [32]byte
+	r := hkdf.New(sha256.New, append(append([]byte{}, noiseKey...), pqSecret...), nil, []byte("nebula pq hybrid"))
+	// Reading 32 bytes from hkdf can not fail
+	_, _ = io.ReadFull(r, k[:])
+	return k
+}
@@ -0,0 +1,36 @@
+// +build go1.24
+
+package nebula
+
+import "crypto/mlkem"
+
+const pqSupported = true
+
+// pqKey is the ephemeral ML-KEM-768 key an initiator offers in a hybrid handshake, it is thrown away once the
+// handshake completes
+type pqKey struct {
+	dk *mlkem.DecapsulationKey768
+}
+
+// newPqKey returns a new key and the encapsulation key to send to the responder
+func newPqKey() (*pqKey, []byte, error) {
+	dk, err := mlkem.GenerateKey768()
+	if err != nil {
+		return nil, nil, err
+	}
+	return &pqKey{dk: dk}, dk.EncapsulationKey().Bytes(), nil
+}
+
+func (k *pqKey) decapsulate(ciphertext []byte) ([]byte, error) {
+	return k.dk.Decapsulate(ciphertext)
+}
+
+// pqEncapsulate returns a shared secret and the ciphertext the initiator needs to recover it
+func pqEncapsulate(encapsulationKey []byte) ([]byte, []byte, error) {
+	ek, err := mlkem.NewEncapsulationKey768(encapsulationKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	secret, ciphertext := ek.Encapsulate()
+	return secret, ciphertext, nil
+}
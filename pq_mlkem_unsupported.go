@@ -0,0 +1,20 @@
+// +build !go1.24
+
+package nebula
+
+// ML-KEM is only in the standard library from go 1.24 on, older builds can not do hybrid handshakes
+const pqSupported = false
+
+type pqKey struct{}
+
+func newPqKey() (*pqKey, []byte, error) {
+	return nil, nil, errPqUnsupported
+}
+
+func (k *pqKey) decapsulate(ciphertext []byte) ([]byte, error) {
+	return nil, errPqUnsupported
+}
+
+func pqEncapsulate(encapsulationKey []byte) ([]byte, []byte, error) {
+	return nil, nil, errPqUnsupported
+}
@@ -0,0 +1,62 @@
+package nebula
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfigPqMode(t *testing.T) {
+	p, err := configPqMode("disabled")
+	assert.NoError(t, err)
+	assert.Equal(t, pqDisabled, p)
+
+	_, err = configPqMode("sometimes")
+	assert.EqualError(t, err, "unknown handshakes.pq_hybrid mode: sometimes")
+
+	if !pqSupported {
+		_, err = configPqMode("required")
+		assert.Equal(t, errPqUnsupported, err)
+		return
+	}
+
+	p, err = configPqMode("true")
+	assert.NoError(t, err)
+	assert.Equal(t, pqEnabled, p)
+
+	p, err = configPqMode("required")
+	assert.NoError(t, err)
+	assert.Equal(t, pqRequired, p)
+}
+
+func TestPqHybridKeys(t *testing.T) {
+	if !pqSupported {
+		t.Skip(errPqUnsupported)
+	}
+
+	k, ek, err := newPqKey()
+	assert.NoError(t, err)
+
+	rSecret, ct, err := pqEncapsulate(ek)
+	assert.NoError(t, err)
+	iSecret, err := k.decapsulate(ct)
+	assert.NoError(t, err)
+	assert.Equal(t, rSecret, iSecret)
+
+	_, _, err = pqEncapsulate(ek[1:])
+	assert.Error(t, err)
+
+	// Both sides end up with the same tunnel key, and it is not the classic one
+	i, r := noiseHandshake()
+	nb := make([]byte, 12)
+	out, err := NewNebulaCipherState(i[0], "chachapoly", "aes", iSecret).EncryptDanger(nil, nil, []byte("hello"), 2, nb)
+	assert.NoError(t, err)
+	plain, err := NewNebulaCipherState(r[0], "chachapoly", "aes", rSecret).DecryptDanger(nil, nil, out, 2, nb)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("hello"), plain)
+
+	i, r = noiseHandshake()
+	out, _ = NewNebulaCipherState(i[0], "chachapoly", "chachapoly", iSecret).EncryptDanger(nil, nil, []byte("hello"), 2, nb)
+	_, err = NewNebulaCipherState(r[0], "chachapoly", "chachapoly", nil).DecryptDanger(nil, nil, out, 2, nb)
+	assert.Error(t, err)
+}
@@ -0,0 +1,90 @@
+package nebula
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultRekeyGrace is how long the keys of a tunnel that was replaced by a new handshake are still accepted
+const DefaultRekeyGrace = time.Second * 10
+
+// rekeyConfig holds the limits that get a tunnel fresh keys through a new handshake, a limit of 0 is never reached
+type rekeyConfig struct {
+	interval time.Duration
+	packets  uint64
+	bytes    uint64
+}
+
+func newRekeyConfig(c *Config) (rekeyConfig, error) {
+	interval := c.GetDuration("rekey.interval", 0)
+	packets := c.GetInt("rekey.packets", 0)
+	bytes := c.GetInt("rekey.bytes", 0)
+	if interval < 0 || packets < 0 || bytes < 0 {
+		return rekeyConfig{}, errors.New("rekey.interval, packets, and bytes can not be negative")
+	}
+
+	return rekeyConfig{interval: interval, packets: uint64(packets), bytes: uint64(bytes)}, nil
+}
+
+func (r rekeyConfig) enabled() bool {
+	return r.interval > 0 || r.packets > 0 || r.bytes > 0
+}
+
+// due returns why the tunnel needs new keys or an empty string if it does not yet. Only the side that started the
+// tunnel re-keys it on time so both sides don't race each other, the responder waits a little longer in case the
+// initiator does not re-key at all
+func (r rekeyConfig) due(ci *ConnectionState, now time.Time) string {
+	if r.interval > 0 {
+		interval := r.interval
+		if !ci.initiator {
+			interval += interval / 10
+		}
+
+		if now.Sub(ci.established) >= interval {
+			return "interval"
+		}
+	}
+
+	if r.packets > 0 && atomic.LoadUint64(&ci.atomicMessageCounter) >= r.packets {
+		return "packets"
+	}
+
+	if r.bytes > 0 && atomic.LoadUint64(&ci.atomicBytesSent) >= r.bytes {
+		return "bytes"
+	}
+
+	return ""
+}
+
+// checkRekey starts a new handshake with vpnIP if the tunnel reached one of its rekey limits. The current tunnel keeps
+// carrying traffic until the new one replaces it
+func (n *connectionManager) checkRekey(vpnIP VpnIp, now time.Time) {
+	if !n.intf.rekey.enabled() {
+		return
+	}
+
+	hostinfo, err := n.hostMap.QueryVpnIP(vpnIP)
+	if err != nil {
+		return
+	}
+
+	if _, err := n.intf.handshakeManager.pendingHostMap.QueryVpnIP(vpnIP); err == nil {
+		// Already handshaking
+		return
+	}
+
+	reason := ""
+	hostinfo.RLock()
+	if ci := hostinfo.ConnectionState; ci != nil && ci.ready {
+		reason = n.intf.rekey.due(ci, now)
+	}
+	hostinfo.RUnlock()
+
+	if reason == "" {
+		return
+	}
+
+	hostinfo.logger(n.l).WithField("reason", reason).Info("Re-keying tunnel")
+	n.intf.rehandshake(vpnIP)
+}
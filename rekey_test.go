@@ -0,0 +1,48 @@
+package nebula
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewRekeyConfig(t *testing.T) {
+	l := NewTestLogger()
+	c := NewConfig(l)
+
+	r, err := newRekeyConfig(c)
+	assert.NoError(t, err)
+	assert.False(t, r.enabled())
+
+	c.Settings["rekey"] = map[interface{}]interface{}{"interval": "24h", "packets": 1000, "bytes": 1 << 40}
+	r, err = newRekeyConfig(c)
+	assert.NoError(t, err)
+	assert.True(t, r.enabled())
+	assert.Equal(t, rekeyConfig{interval: time.Hour * 24, packets: 1000, bytes: 1 << 40}, r)
+
+	c.Settings["rekey"] = map[interface{}]interface{}{"packets": -1}
+	_, err = newRekeyConfig(c)
+	assert.EqualError(t, err, "rekey.interval, packets, and bytes can not be negative")
+}
+
+func TestRekeyConfig_due(t *testing.T) {
+	now := time.Now()
+	ci := &ConnectionState{initiator: true, established: now, atomicMessageCounter: 10, atomicBytesSent: 100}
+
+	assert.Equal(t, "", rekeyConfig{}.due(ci, now.Add(time.Hour*24*365)))
+
+	r := rekeyConfig{interval: time.Hour}
+	assert.Equal(t, "", r.due(ci, now.Add(time.Minute*59)))
+	assert.Equal(t, "interval", r.due(ci, now.Add(time.Hour)))
+
+	// The responder gives the initiator a chance to go first
+	ci.initiator = false
+	assert.Equal(t, "", r.due(ci, now.Add(time.Hour)))
+	assert.Equal(t, "interval", r.due(ci, now.Add(time.Minute*66)))
+
+	assert.Equal(t, "", rekeyConfig{packets: 11}.due(ci, now))
+	assert.Equal(t, "packets", rekeyConfig{packets: 10}.due(ci, now))
+	assert.Equal(t, "", rekeyConfig{bytes: 101}.due(ci, now))
+	assert.Equal(t, "bytes", rekeyConfig{bytes: 100}.due(ci, now))
+}
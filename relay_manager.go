@@ -0,0 +1,296 @@
+package nebula
+
+import (
+	"net"
+	"sync/atomic"
+
+	"github.com/sirupsen/logrus"
+)
+
+type relayManager struct {
+	l          *logrus.Logger
+	hostmap    *HostMap
+	lightHouse *LightHouse
+	vpnNets    []*net.IPNet
+
+	// atomicAmRelay is 1 when we are willing to forward packets between other hosts
+	atomicAmRelay int32
+}
+
+func newRelayManagerFromConfig(l *logrus.Logger, hostmap *HostMap, lightHouse *LightHouse, vpnNets []*net.IPNet, c *Config) (*relayManager, error) {
+	rm := &relayManager{
+		l:          l,
+		hostmap:    hostmap,
+		lightHouse: lightHouse,
+		vpnNets:    vpnNets,
+	}
+
+	err := rm.reload(c, true)
+	if err != nil {
+		return nil, err
+	}
+
+	c.RegisterReloadCallback(func(c *Config) {
+		err := rm.reload(c, false)
+		if err != nil {
+			l.WithError(err).Error("Failed to reload relay config")
+		}
+	})
+
+	return rm, nil
+}
+
+func (rm *relayManager) reload(c *Config, initial bool) error {
+	if initial || c.HasChanged("relay.am_relay") {
+		rm.setAmRelay(c.GetBool("relay.am_relay", false))
+	}
+
+	if initial || c.HasChanged("relay.relays") || c.HasChanged("relay.am_relay") {
+		relays, err := rm.parseRelays(c)
+		if err != nil {
+			return err
+		}
+		rm.lightHouse.SetRelaysForMe(relays)
+	}
+
+	return nil
+}
+
+// parseRelays reads relay.relays, the hosts that peers may use to reach us
+func (rm *relayManager) parseRelays(c *Config) ([]VpnIp, error) {
+	rawRelays := c.GetStringSlice("relay.relays", []string{})
+	if rm.GetAmRelay() {
+		// A relay reaching another relay through a relay is a loop we don't want to deal with
+		if len(rawRelays) > 0 {
+			rm.l.Info("Ignoring relay.relays because relay.am_relay is true")
+		}
+		return nil, nil
+	}
+
+	relays := make([]VpnIp, 0, len(rawRelays))
+	for i, v := range rawRelays {
+		ip := net.ParseIP(v)
+		if ip == nil {
+			return nil, NewContextualError("Unable to parse relay entry", m{"relay": v, "entry": i + 1}, nil)
+		}
+
+		vpnIp := NewVpnIp(ip)
+		if !vpnNetContains(rm.vpnNets, vpnIp) {
+			return nil, NewContextualError("relay is not in our subnet, invalid", m{"vpnIp": ip, "network": ipNetsString(rm.vpnNets)}, nil)
+		}
+
+		if vpnIp == rm.lightHouse.myVpnIp {
+			return nil, NewContextualError("relay can not be our own vpn ip", m{"vpnIp": ip}, nil)
+		}
+
+		relays = append(relays, vpnIp)
+	}
+
+	return relays, nil
+}
+
+func (rm *relayManager) GetAmRelay() bool {
+	return atomic.LoadInt32(&rm.atomicAmRelay) == 1
+}
+
+func (rm *relayManager) setAmRelay(v bool) {
+	var val int32
+	if v {
+		val = 1
+	}
+	atomic.StoreInt32(&rm.atomicAmRelay, val)
+}
+
+// isRelayForMe checks if vpnIp is one of the relays we advertise
+func (rm *relayManager) isRelayForMe(vpnIp VpnIp) bool {
+	for _, r := range rm.lightHouse.GetRelaysForMe() {
+		if r == vpnIp {
+			return true
+		}
+	}
+	return false
+}
+
+// HandleControlMsg processes a control message that arrived over the tunnel with h
+func (rm *relayManager) HandleControlMsg(h *HostInfo, m *NebulaControl, f EncWriter) {
+	switch m.Type {
+	case NebulaControl_CreateRelayRequest:
+		rm.handleCreateRelayRequest(h, f, m)
+	case NebulaControl_CreateRelayResponse:
+		rm.handleCreateRelayResponse(h, f, m)
+	}
+}
+
+func (rm *relayManager) handleCreateRelayRequest(h *HostInfo, f EncWriter, m *NebulaControl) {
+	from := m.RelayFromIp.vpnIp()
+	target := m.RelayToIp.vpnIp()
+
+	logMsg := rm.l.WithField("relayFrom", from).WithField("relayTo", target).
+		WithField("initiatorIdx", m.InitiatorRelayIndex).WithField("vpnIp", h.hostId)
+
+	if target == from {
+		logMsg.Info("Ignoring relay request to the requesting host")
+		return
+	}
+
+	if target == rm.lightHouse.myVpnIp {
+		rm.handleCreateRelayRequestForMe(h, f, m, logMsg)
+		return
+	}
+
+	// Only the host on the other end of the tunnel may ask us to relay on its own behalf
+	if from != h.hostId {
+		logMsg.Info("Ignoring relay request that was not sent by the requesting host")
+		return
+	}
+
+	if !rm.GetAmRelay() {
+		logMsg.Debug("Ignoring relay request, relay.am_relay is not enabled")
+		return
+	}
+
+	peer, err := rm.hostmap.QueryVpnIP(target)
+	if err != nil {
+		// We can't forward anything until we have a tunnel with the target, the requester will try again
+		f.Handshake(target)
+		return
+	}
+
+	if peer.remote == nil {
+		logMsg.Info("Ignoring relay request, the target is only reachable through a relay")
+		return
+	}
+
+	targetRelay, ok := peer.relayState.QueryRelayForByIp(from)
+	if !ok {
+		targetRelay, err = rm.hostmap.AddRelay(peer, from, 0, relayForwarding, relayRequested)
+		if err != nil {
+			logMsg.WithError(err).Error("Failed to allocate a relay index")
+			return
+		}
+	}
+
+	if targetRelay.State == relayRequested {
+		// Keep asking the target until it answers, the requester retries as long as it is handshaking
+		req := NebulaControl{
+			Type:                NebulaControl_CreateRelayRequest,
+			InitiatorRelayIndex: targetRelay.LocalIndex,
+			RelayFromIp:         NewVpnAddr(from),
+			RelayToIp:           NewVpnAddr(target),
+		}
+		rm.sendControl(f, target, &req, logMsg)
+	}
+
+	state := relayRequested
+	if targetRelay.State == relayEstablished {
+		state = relayEstablished
+	}
+
+	relay, ok := h.relayState.QueryRelayForByIp(target)
+	if !ok {
+		relay, err = rm.hostmap.AddRelay(h, target, m.InitiatorRelayIndex, relayForwarding, state)
+		if err != nil {
+			logMsg.WithError(err).Error("Failed to allocate a relay index")
+			return
+		}
+	} else {
+		relay, _ = h.relayState.UpdateRelayForByIdx(relay.LocalIndex, m.InitiatorRelayIndex, state)
+	}
+
+	if relay.State != relayEstablished {
+		return
+	}
+
+	resp := NebulaControl{
+		Type:                NebulaControl_CreateRelayResponse,
+		InitiatorRelayIndex: m.InitiatorRelayIndex,
+		ResponderRelayIndex: relay.LocalIndex,
+		RelayFromIp:         m.RelayFromIp,
+		RelayToIp:           m.RelayToIp,
+	}
+	rm.sendControl(f, from, &resp, logMsg)
+}
+
+// handleCreateRelayRequestForMe handles a relay request where we are the target, h is the relay
+func (rm *relayManager) handleCreateRelayRequestForMe(h *HostInfo, f EncWriter, m *NebulaControl, logMsg *logrus.Entry) {
+	if !rm.isRelayForMe(h.hostId) {
+		logMsg.Info("Ignoring relay request from a host that is not in relay.relays")
+		return
+	}
+
+	relay, ok := h.relayState.QueryRelayForByIp(m.RelayFromIp.vpnIp())
+	if ok {
+		// The relay may have restarted and chosen a new index, always take the latest
+		relay, _ = h.relayState.EstablishRelay(relay.LocalIndex, m.InitiatorRelayIndex)
+	} else {
+		var err error
+		relay, err = rm.hostmap.AddRelay(h, m.RelayFromIp.vpnIp(), m.InitiatorRelayIndex, relayTerminal, relayEstablished)
+		if err != nil {
+			logMsg.WithError(err).Error("Failed to allocate a relay index")
+			return
+		}
+	}
+
+	resp := NebulaControl{
+		Type:                NebulaControl_CreateRelayResponse,
+		InitiatorRelayIndex: m.InitiatorRelayIndex,
+		ResponderRelayIndex: relay.LocalIndex,
+		RelayFromIp:         m.RelayFromIp,
+		RelayToIp:           m.RelayToIp,
+	}
+	rm.sendControl(f, h.hostId, &resp, logMsg)
+}
+
+func (rm *relayManager) handleCreateRelayResponse(h *HostInfo, f EncWriter, m *NebulaControl) {
+	logMsg := rm.l.WithField("relayFrom", m.RelayFromIp.vpnIp()).WithField("relayTo", m.RelayToIp.vpnIp()).
+		WithField("initiatorIdx", m.InitiatorRelayIndex).WithField("responderIdx", m.ResponderRelayIndex).
+		WithField("vpnIp", h.hostId)
+
+	relay, ok := h.relayState.QueryRelayForByIdx(m.InitiatorRelayIndex)
+	if !ok {
+		logMsg.Debug("Ignoring relay response for an unknown relay")
+		return
+	}
+
+	relay, _ = h.relayState.EstablishRelay(relay.LocalIndex, m.ResponderRelayIndex)
+
+	if relay.Type == relayTerminal {
+		// The handshake manager will use the relay on its next attempt
+		logMsg.Info("Relay established")
+		return
+	}
+
+	// We are forwarding, let the requester know the relay is ready
+	peer, err := rm.hostmap.QueryVpnIP(relay.PeerIp)
+	if err != nil {
+		logMsg.WithError(err).Debug("Relay requester is gone")
+		return
+	}
+
+	peerRelay, ok := peer.relayState.QueryRelayForByIp(h.hostId)
+	if !ok {
+		logMsg.Debug("Relay requester no longer has a relay to the target")
+		return
+	}
+
+	peerRelay, _ = peer.relayState.EstablishRelay(peerRelay.LocalIndex, peerRelay.RemoteIndex)
+
+	resp := NebulaControl{
+		Type:                NebulaControl_CreateRelayResponse,
+		InitiatorRelayIndex: peerRelay.RemoteIndex,
+		ResponderRelayIndex: peerRelay.LocalIndex,
+		RelayFromIp:         NewVpnAddr(peer.hostId),
+		RelayToIp:           NewVpnAddr(h.hostId),
+	}
+	rm.sendControl(f, peer.hostId, &resp, logMsg)
+}
+
+func (rm *relayManager) sendControl(f EncWriter, vpnIp VpnIp, msg *NebulaControl, logMsg *logrus.Entry) {
+	b, err := msg.Marshal()
+	if err != nil {
+		logMsg.WithError(err).Error("Failed to marshal control message")
+		return
+	}
+
+	f.SendMessageToVpnIp(control, 0, vpnIp, b, make([]byte, 12, 12), make([]byte, mtu))
+}
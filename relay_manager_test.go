@@ -0,0 +1,139 @@
+package nebula
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testControlWriter struct {
+	sent []testControlMsg
+}
+
+type testControlMsg struct {
+	vpnIp VpnIp
+	msg   *NebulaControl
+}
+
+func (tw *testControlWriter) SendMessageToVpnIp(t NebulaMessageType, st NebulaMessageSubType, vpnIp VpnIp, p, _, _ []byte) {
+	m := &NebulaControl{}
+	if err := m.Unmarshal(p); err != nil {
+		panic(err)
+	}
+	tw.sent = append(tw.sent, testControlMsg{vpnIp: vpnIp, msg: m})
+}
+
+func (tw *testControlWriter) SendVia(via *HostInfo, relay Relay, ad, nb, out []byte) {}
+
+func (tw *testControlWriter) Handshake(vpnIp VpnIp) {}
+
+func TestRelayManager_forwarding(t *testing.T) {
+	l := NewTestLogger()
+	hm := NewHostMap(l, "test", []*net.IPNet{}, []*net.IPNet{})
+	f := &Interface{}
+
+	me := NewVpnIp(net.ParseIP("10.0.0.1"))
+	a := &HostInfo{hostId: NewVpnIp(net.ParseIP("10.0.0.2")), localIndexId: 1, remote: NewUDPAddrFromString("1.1.1.1:4242")}
+	b := &HostInfo{hostId: NewVpnIp(net.ParseIP("10.0.0.3")), localIndexId: 2, remote: NewUDPAddrFromString("1.1.1.2:4242")}
+	hm.Lock()
+	hm.addHostInfo(a, f)
+	hm.addHostInfo(b, f)
+	hm.Unlock()
+
+	rm := &relayManager{l: l, hostmap: hm, lightHouse: &LightHouse{myVpnIp: me}}
+	w := &testControlWriter{}
+
+	req := &NebulaControl{
+		Type:                NebulaControl_CreateRelayRequest,
+		InitiatorRelayIndex: 10,
+		RelayFromIp:         NewVpnAddr(a.hostId),
+		RelayToIp:           NewVpnAddr(b.hostId),
+	}
+
+	// We are not a relay, nothing happens
+	rm.HandleControlMsg(a, req, w)
+	assert.Empty(t, w.sent)
+	assert.Empty(t, hm.Relays)
+
+	// Someone other than the requester can not ask for a relay on their behalf
+	rm.setAmRelay(true)
+	rm.HandleControlMsg(b, req, w)
+	assert.Empty(t, w.sent)
+
+	// The request is passed on to the target
+	rm.HandleControlMsg(a, req, w)
+	assert.Len(t, w.sent, 1)
+	assert.Equal(t, b.hostId, w.sent[0].vpnIp)
+	assert.Equal(t, NebulaControl_CreateRelayRequest, w.sent[0].msg.Type)
+	assert.Len(t, hm.Relays, 2)
+
+	toB, ok := b.relayState.QueryRelayForByIp(a.hostId)
+	assert.True(t, ok)
+	assert.Equal(t, toB.LocalIndex, w.sent[0].msg.InitiatorRelayIndex)
+	assert.Equal(t, relayRequested, toB.State)
+
+	toA, ok := a.relayState.QueryRelayForByIp(b.hostId)
+	assert.True(t, ok)
+	assert.Equal(t, uint32(10), toA.RemoteIndex)
+	assert.Equal(t, relayRequested, toA.State)
+
+	// The target answers and the requester is told the relay is ready
+	rm.HandleControlMsg(b, &NebulaControl{
+		Type:                NebulaControl_CreateRelayResponse,
+		InitiatorRelayIndex: toB.LocalIndex,
+		ResponderRelayIndex: 20,
+		RelayFromIp:         NewVpnAddr(a.hostId),
+		RelayToIp:           NewVpnAddr(b.hostId),
+	}, w)
+	assert.Len(t, w.sent, 2)
+	assert.Equal(t, a.hostId, w.sent[1].vpnIp)
+	assert.Equal(t, NebulaControl_CreateRelayResponse, w.sent[1].msg.Type)
+	assert.Equal(t, uint32(10), w.sent[1].msg.InitiatorRelayIndex)
+	assert.Equal(t, toA.LocalIndex, w.sent[1].msg.ResponderRelayIndex)
+
+	toB, _ = b.relayState.QueryRelayForByIp(a.hostId)
+	assert.Equal(t, relayEstablished, toB.State)
+	assert.Equal(t, uint32(20), toB.RemoteIndex)
+
+	toA, _ = a.relayState.QueryRelayForByIp(b.hostId)
+	assert.Equal(t, relayEstablished, toA.State)
+}
+
+func TestRelayManager_terminal(t *testing.T) {
+	l := NewTestLogger()
+	hm := NewHostMap(l, "test", []*net.IPNet{}, []*net.IPNet{})
+	f := &Interface{}
+
+	me := NewVpnIp(net.ParseIP("10.0.0.1"))
+	relay := &HostInfo{hostId: NewVpnIp(net.ParseIP("10.0.0.2")), localIndexId: 1, remote: NewUDPAddrFromString("1.1.1.1:4242")}
+	hm.Lock()
+	hm.addHostInfo(relay, f)
+	hm.Unlock()
+
+	rm := &relayManager{l: l, hostmap: hm, lightHouse: &LightHouse{myVpnIp: me}}
+	w := &testControlWriter{}
+
+	req := &NebulaControl{
+		Type:                NebulaControl_CreateRelayRequest,
+		InitiatorRelayIndex: 10,
+		RelayFromIp:         NewVpnAddr(NewVpnIp(net.ParseIP("10.0.0.3"))),
+		RelayToIp:           NewVpnAddr(me),
+	}
+
+	// Only relays we advertise may set up relays to us
+	rm.HandleControlMsg(relay, req, w)
+	assert.Empty(t, w.sent)
+
+	rm.lightHouse.SetRelaysForMe([]VpnIp{relay.hostId})
+	rm.HandleControlMsg(relay, req, w)
+	assert.Len(t, w.sent, 1)
+	assert.Equal(t, relay.hostId, w.sent[0].vpnIp)
+	assert.Equal(t, NebulaControl_CreateRelayResponse, w.sent[0].msg.Type)
+	assert.Equal(t, uint32(10), w.sent[0].msg.InitiatorRelayIndex)
+
+	r, ok := relay.relayState.QueryRelayForByIdx(w.sent[0].msg.ResponderRelayIndex)
+	assert.True(t, ok)
+	assert.Equal(t, relayTerminal, r.Type)
+	assert.Equal(t, relayEstablished, r.State)
+}
@@ -5,6 +5,7 @@ import (
 	"net"
 	"sort"
 	"sync"
+	"time"
 )
 
 // forEachFunc is used to benefit folks that want to do work inside the lock
@@ -23,6 +24,7 @@ type CacheMap map[string]*Cache
 type Cache struct {
 	Learned  []*udpAddr `json:"learned,omitempty"`
 	Reported []*udpAddr `json:"reported,omitempty"`
+	Relay    []VpnIp    `json:"relay,omitempty"`
 }
 
 //TODO: Seems like we should plop static host entries in here too since the are protected by the lighthouse from deletion
@@ -30,8 +32,19 @@ type Cache struct {
 
 // cache is an internal struct that splits v4 and v6 addresses inside the cache map
 type cache struct {
-	v4 *cacheV4
-	v6 *cacheV6
+	v4    *cacheV4
+	v6    *cacheV6
+	relay *cacheRelay
+
+	// reportedAt is when the owner last reported itself to a lighthouse, it decides which copy wins when lighthouses sync
+	reportedAt time.Time
+	// syncedAt is when another lighthouse last sent us this entry, it is zero if the owner reported to us directly
+	syncedAt time.Time
+}
+
+// cacheRelay stores the vpn ips of the relays that were reported for the host under cache
+type cacheRelay struct {
+	relay []VpnIp
 }
 
 // cacheV4 stores learned and reported ipv4 records under cache
@@ -58,12 +71,15 @@ type RemoteList struct {
 	// These are maps to store v4 and v6 addresses per lighthouse
 	// Map key is the vpnIp of the person that told us about this the cached entries underneath.
 	// For learned addresses, this is the vpnIp that sent the packet
-	cache map[uint32]*cache
+	cache map[VpnIp]*cache
 
 	// This is a list of remotes that we have tried to handshake with and have returned from the wrong vpn ip.
 	// They should not be tried again during a handshake
 	badRemotes []*udpAddr
 
+	// These remotes only take nebula over tcp, they come from tcp:// entries in the static_host_map
+	tcpRemotes []*udpAddr
+
 	// A flag that the cache may have changed and addrs needs to be rebuilt
 	shouldRebuild bool
 }
@@ -72,7 +88,7 @@ type RemoteList struct {
 func NewRemoteList() *RemoteList {
 	return &RemoteList{
 		addrs: make([]*udpAddr, 0),
-		cache: make(map[uint32]*cache),
+		cache: make(map[VpnIp]*cache),
 	}
 }
 
@@ -118,7 +134,7 @@ func (r *RemoteList) CopyAddrs(preferredRanges []*net.IPNet) []*udpAddr {
 // Currently this is only needed when HostInfo.SetRemote is called as that should cover both handshaking and roaming.
 // It will mark the deduplicated address list as dirty, so do not call it unless new information is available
 //TODO: this needs to support the allow list list
-func (r *RemoteList) LearnRemote(ownerVpnIp uint32, addr *udpAddr) {
+func (r *RemoteList) LearnRemote(ownerVpnIp VpnIp, addr *udpAddr) {
 	r.Lock()
 	defer r.Unlock()
 	if v4 := addr.IP.To4(); v4 != nil {
@@ -148,7 +164,7 @@ func (r *RemoteList) CopyCache() *CacheMap {
 	}
 
 	for owner, mc := range r.cache {
-		c := getOrMake(IntIp(owner).String())
+		c := getOrMake(owner.String())
 
 		if mc.v4 != nil {
 			if mc.v4.learned != nil {
@@ -169,11 +185,47 @@ func (r *RemoteList) CopyCache() *CacheMap {
 				c.Reported = append(c.Reported, NewUDPAddrFromLH6(a))
 			}
 		}
+
+		if mc.relay != nil {
+			c.Relay = append(c.Relay, mc.relay.relay...)
+		}
 	}
 
 	return &cm
 }
 
+// CopyRelays locks and returns a deduplicated list of the relays that were reported for this host
+func (r *RemoteList) CopyRelays() []VpnIp {
+	if r == nil {
+		return nil
+	}
+
+	r.RLock()
+	defer r.RUnlock()
+
+	var relays []VpnIp
+	seen := map[VpnIp]struct{}{}
+	for _, c := range r.cache {
+		if c.relay == nil {
+			continue
+		}
+
+		for _, v := range c.relay.relay {
+			if _, ok := seen[v]; ok {
+				continue
+			}
+			seen[v] = struct{}{}
+			relays = append(relays, v)
+		}
+	}
+
+	// Map iteration order is random, keep the result stable for callers
+	sort.Slice(relays, func(i, j int) bool {
+		return relays[i].Less(relays[j])
+	})
+	return relays
+}
+
 // BlockRemote locks and records the address as bad, it will be excluded from the deduplicated address list
 func (r *RemoteList) BlockRemote(bad *udpAddr) {
 	r.Lock()
@@ -210,6 +262,27 @@ func (r *RemoteList) ResetBlockedRemotes() {
 	r.Unlock()
 }
 
+// IsTCP locks and reports if addr should only be reached over tcp
+func (r *RemoteList) IsTCP(addr *udpAddr) bool {
+	if r == nil {
+		return false
+	}
+
+	r.RLock()
+	defer r.RUnlock()
+	for _, v := range r.tcpRemotes {
+		if v.Equals(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// unlockedSetTCP assumes you have the write lock and replaces the list of tcp only remotes
+func (r *RemoteList) unlockedSetTCP(addrs []*udpAddr) {
+	r.tcpRemotes = addrs
+}
+
 // Rebuild locks and generates the deduplicated address list only if there is work to be done
 // There is generally no reason to call this directly but it is safe to do so
 func (r *RemoteList) Rebuild(preferredRanges []*net.IPNet) {
@@ -239,14 +312,14 @@ func (r *RemoteList) unlockedIsBad(remote *udpAddr) bool {
 
 // unlockedSetLearnedV4 assumes you have the write lock and sets the current learned address for this owner and marks the
 // deduplicated address list as dirty
-func (r *RemoteList) unlockedSetLearnedV4(ownerVpnIp uint32, to *Ip4AndPort) {
+func (r *RemoteList) unlockedSetLearnedV4(ownerVpnIp VpnIp, to *Ip4AndPort) {
 	r.shouldRebuild = true
 	r.unlockedGetOrMakeV4(ownerVpnIp).learned = to
 }
 
 // unlockedSetV4 assumes you have the write lock and resets the reported list of ips for this owner to the list provided
 // and marks the deduplicated address list as dirty
-func (r *RemoteList) unlockedSetV4(ownerVpnIp uint32, to []*Ip4AndPort, check checkFuncV4) {
+func (r *RemoteList) unlockedSetV4(ownerVpnIp VpnIp, to []*Ip4AndPort, check checkFuncV4) {
 	r.shouldRebuild = true
 	c := r.unlockedGetOrMakeV4(ownerVpnIp)
 
@@ -263,7 +336,7 @@ func (r *RemoteList) unlockedSetV4(ownerVpnIp uint32, to []*Ip4AndPort, check ch
 
 // unlockedPrependV4 assumes you have the write lock and prepends the address in the reported list for this owner
 // This is only useful for establishing static hosts
-func (r *RemoteList) unlockedPrependV4(ownerVpnIp uint32, to *Ip4AndPort) {
+func (r *RemoteList) unlockedPrependV4(ownerVpnIp VpnIp, to *Ip4AndPort) {
 	r.shouldRebuild = true
 	c := r.unlockedGetOrMakeV4(ownerVpnIp)
 
@@ -276,14 +349,14 @@ func (r *RemoteList) unlockedPrependV4(ownerVpnIp uint32, to *Ip4AndPort) {
 
 // unlockedSetLearnedV6 assumes you have the write lock and sets the current learned address for this owner and marks the
 // deduplicated address list as dirty
-func (r *RemoteList) unlockedSetLearnedV6(ownerVpnIp uint32, to *Ip6AndPort) {
+func (r *RemoteList) unlockedSetLearnedV6(ownerVpnIp VpnIp, to *Ip6AndPort) {
 	r.shouldRebuild = true
 	r.unlockedGetOrMakeV6(ownerVpnIp).learned = to
 }
 
 // unlockedSetV6 assumes you have the write lock and resets the reported list of ips for this owner to the list provided
 // and marks the deduplicated address list as dirty
-func (r *RemoteList) unlockedSetV6(ownerVpnIp uint32, to []*Ip6AndPort, check checkFuncV6) {
+func (r *RemoteList) unlockedSetV6(ownerVpnIp VpnIp, to []*Ip6AndPort, check checkFuncV6) {
 	r.shouldRebuild = true
 	c := r.unlockedGetOrMakeV6(ownerVpnIp)
 
@@ -300,7 +373,7 @@ func (r *RemoteList) unlockedSetV6(ownerVpnIp uint32, to []*Ip6AndPort, check ch
 
 // unlockedPrependV6 assumes you have the write lock and prepends the address in the reported list for this owner
 // This is only useful for establishing static hosts
-func (r *RemoteList) unlockedPrependV6(ownerVpnIp uint32, to *Ip6AndPort) {
+func (r *RemoteList) unlockedPrependV6(ownerVpnIp VpnIp, to *Ip6AndPort) {
 	r.shouldRebuild = true
 	c := r.unlockedGetOrMakeV6(ownerVpnIp)
 
@@ -311,9 +384,36 @@ func (r *RemoteList) unlockedPrependV6(ownerVpnIp uint32, to *Ip6AndPort) {
 	}
 }
 
+// unlockedSetRelay assumes you have the write lock and resets the reported list of relays for this owner to the list
+// provided. Relays do not participate in the deduplicated address list so it is not marked as dirty
+func (r *RemoteList) unlockedSetRelay(ownerVpnIp VpnIp, to []*VpnAddr) {
+	c := r.unlockedGetOrMakeRelay(ownerVpnIp)
+
+	// Reset the slice
+	c.relay = c.relay[:0]
+
+	for _, v := range to[:minInt(len(to), MaxRemotes)] {
+		c.relay = append(c.relay, v.vpnIp())
+	}
+}
+
+// unlockedGetOrMakeRelay assumes you have the write lock and builds the cache and owner entry. Only the relay pointer
+// is established
+func (r *RemoteList) unlockedGetOrMakeRelay(ownerVpnIp VpnIp) *cacheRelay {
+	am := r.cache[ownerVpnIp]
+	if am == nil {
+		am = &cache{}
+		r.cache[ownerVpnIp] = am
+	}
+	if am.relay == nil {
+		am.relay = &cacheRelay{}
+	}
+	return am.relay
+}
+
 // unlockedGetOrMakeV4 assumes you have the write lock and builds the cache and owner entry. Only the v4 pointer is established.
 // The caller must dirty the learned address cache if required
-func (r *RemoteList) unlockedGetOrMakeV4(ownerVpnIp uint32) *cacheV4 {
+func (r *RemoteList) unlockedGetOrMakeV4(ownerVpnIp VpnIp) *cacheV4 {
 	am := r.cache[ownerVpnIp]
 	if am == nil {
 		am = &cache{}
@@ -328,7 +428,7 @@ func (r *RemoteList) unlockedGetOrMakeV4(ownerVpnIp uint32) *cacheV4 {
 
 // unlockedGetOrMakeV6 assumes you have the write lock and builds the cache and owner entry. Only the v6 pointer is established.
 // The caller must dirty the learned address cache if required
-func (r *RemoteList) unlockedGetOrMakeV6(ownerVpnIp uint32) *cacheV6 {
+func (r *RemoteList) unlockedGetOrMakeV6(ownerVpnIp VpnIp) *cacheV6 {
 	am := r.cache[ownerVpnIp]
 	if am == nil {
 		am = &cache{}
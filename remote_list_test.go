@@ -10,7 +10,7 @@ import (
 func TestRemoteList_Rebuild(t *testing.T) {
 	rl := NewRemoteList()
 	rl.unlockedSetV4(
-		0,
+		NewVpnIp4(0),
 		[]*Ip4AndPort{
 			{Ip: ip2int(net.ParseIP("70.199.182.92")), Port: 1475}, // this is duped
 			{Ip: ip2int(net.ParseIP("172.17.0.182")), Port: 10101},
@@ -27,7 +27,7 @@ func TestRemoteList_Rebuild(t *testing.T) {
 	)
 
 	rl.unlockedSetV6(
-		1,
+		NewVpnIp4(1),
 		[]*Ip6AndPort{
 			NewIp6AndPort(net.ParseIP("1::1"), 1), // this is duped
 			NewIp6AndPort(net.ParseIP("1::1"), 2), // almost dupe of 0 with a diff port, also gets duped
@@ -98,10 +98,36 @@ func TestRemoteList_Rebuild(t *testing.T) {
 	assert.Equal(t, "172.31.0.1:10101", rl.addrs[9].String())
 }
 
+func TestRemoteList_CopyRelays(t *testing.T) {
+	rl := NewRemoteList()
+	assert.Empty(t, rl.CopyRelays())
+
+	lh1 := NewVpnIp(net.ParseIP("10.0.0.1"))
+	lh2 := NewVpnIp(net.ParseIP("10.0.0.2"))
+	r1 := NewVpnIp(net.ParseIP("10.0.0.10"))
+	r2 := NewVpnIp(net.ParseIP("10.0.0.9"))
+
+	rl.unlockedSetRelay(lh1, []*VpnAddr{NewVpnAddr(r1), NewVpnAddr(r2)})
+	rl.unlockedSetRelay(lh2, []*VpnAddr{NewVpnAddr(r1)})
+
+	// Duplicates across owners are removed and the result is sorted
+	assert.Equal(t, []VpnIp{r2, r1}, rl.CopyRelays())
+
+	// Relays do not end up in the address list
+	assert.Equal(t, 0, rl.Len([]*net.IPNet{}))
+
+	// Replacing an owners list drops the old entries
+	rl.unlockedSetRelay(lh1, nil)
+	assert.Equal(t, []VpnIp{r1}, rl.CopyRelays())
+
+	cm := *rl.CopyCache()
+	assert.Equal(t, []VpnIp{r1}, cm[lh2.String()].Relay)
+}
+
 func BenchmarkFullRebuild(b *testing.B) {
 	rl := NewRemoteList()
 	rl.unlockedSetV4(
-		0,
+		NewVpnIp4(0),
 		[]*Ip4AndPort{
 			{Ip: ip2int(net.ParseIP("70.199.182.92")), Port: 1475},
 			{Ip: ip2int(net.ParseIP("172.17.0.182")), Port: 10101},
@@ -116,7 +142,7 @@ func BenchmarkFullRebuild(b *testing.B) {
 	)
 
 	rl.unlockedSetV6(
-		0,
+		NewVpnIp4(0),
 		[]*Ip6AndPort{
 			NewIp6AndPort(net.ParseIP("1::1"), 1),
 			NewIp6AndPort(net.ParseIP("1::1"), 2), // dupe of 0 with a diff port
@@ -164,7 +190,7 @@ func BenchmarkFullRebuild(b *testing.B) {
 func BenchmarkSortRebuild(b *testing.B) {
 	rl := NewRemoteList()
 	rl.unlockedSetV4(
-		0,
+		NewVpnIp4(0),
 		[]*Ip4AndPort{
 			{Ip: ip2int(net.ParseIP("70.199.182.92")), Port: 1475},
 			{Ip: ip2int(net.ParseIP("172.17.0.182")), Port: 10101},
@@ -179,7 +205,7 @@ func BenchmarkSortRebuild(b *testing.B) {
 	)
 
 	rl.unlockedSetV6(
-		0,
+		NewVpnIp4(0),
 		[]*Ip6AndPort{
 			NewIp6AndPort(net.ParseIP("1::1"), 1),
 			NewIp6AndPort(net.ParseIP("1::1"), 2), // dupe of 0 with a diff port
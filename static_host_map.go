@@ -0,0 +1,351 @@
+package nebula
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+// minStaticResolveInterval keeps records with a tiny ttl from turning into a constant stream of lookups
+const minStaticResolveInterval = time.Second * 5
+
+// staticResolveRetry is how soon a failed lookup is tried again, unless static_map.interval is shorter
+const staticResolveRetry = time.Second * 30
+
+// staticHostAddr is one address from the static_host_map. Addresses given as a dns name are looked up again before
+// the records expire so a host that changes its public ip is not lost until we restart
+type staticHostAddr struct {
+	host string
+	port uint16
+	name bool
+	// tcp is set for tcp:// entries, the host is only reached over tcp
+	tcp bool
+
+	ips       []net.IP
+	refreshAt time.Time
+}
+
+// staticHostMap holds the static_host_map as it was configured, the lighthouse addrMap holds the resolved addresses
+type staticHostMap struct {
+	hosts         map[VpnIp][]*staticHostAddr
+	network       string
+	interval      time.Duration
+	lookupTimeout time.Duration
+}
+
+type staticResolver interface {
+	// lookup returns the addresses for host. If wantTTL is set it also tries to find out how long they may be cached,
+	// ttlFound is false if that is not known
+	lookup(ctx context.Context, network, host string, wantTTL bool) (ips []net.IP, ttl time.Duration, ttlFound bool, err error)
+}
+
+// LoadStaticHostMap reads the static_host_map and static_map config, looks up any dns names and adds the results as
+// static remotes
+func (lh *LightHouse) LoadStaticHostMap(c *Config) error {
+	shm := &staticHostMap{
+		hosts:         map[VpnIp][]*staticHostAddr{},
+		network:       c.GetString("static_map.network", "ip"),
+		interval:      c.GetDuration("static_map.interval", time.Minute*5),
+		lookupTimeout: c.GetDuration("static_map.lookup_timeout", time.Second*5),
+	}
+
+	if lh.resolver == nil {
+		lh.resolver = newSystemResolver()
+	}
+
+	switch shm.network {
+	case "ip", "ip4", "ip6":
+	default:
+		return NewContextualError("static_map.network must be one of ip, ip4, or ip6", m{"network": shm.network}, nil)
+	}
+
+	if shm.interval < minStaticResolveInterval {
+		return NewContextualError("static_map.interval is too short", m{"interval": shm.interval, "minimum": minStaticResolveInterval}, nil)
+	}
+
+	for k, v := range c.GetMap("static_host_map", map[interface{}]interface{}{}) {
+		ip := net.ParseIP(fmt.Sprintf("%v", k))
+		vpnIp := NewVpnIp(ip)
+		if !vpnNetContains(lh.myVpnNets, vpnIp) {
+			return NewContextualError("static_host_map key is not in our subnet, invalid", m{"vpnIp": ip, "network": ipNetsString(lh.myVpnNets)}, nil)
+		}
+
+		vals, ok := v.([]interface{})
+		if !ok {
+			vals = []interface{}{v}
+		}
+
+		for _, v := range vals {
+			addr, err := newStaticHostAddr(fmt.Sprintf("%v", v))
+			if err != nil {
+				return NewContextualError("Static host address could not be parsed", m{"vpnIp": ip}, err)
+			}
+			shm.hosts[vpnIp] = append(shm.hosts[vpnIp], addr)
+		}
+	}
+
+	lh.staticHostMap = shm
+	now := time.Now()
+	for vpnIp, addrs := range shm.hosts {
+		// Mark it as static
+		lh.staticList[vpnIp] = struct{}{}
+
+		for _, addr := range addrs {
+			if addr.name {
+				lh.resolveStaticHostAddr(vpnIp, addr, now)
+			}
+		}
+
+		lh.setStaticRemotes(vpnIp, addrs)
+	}
+
+	return nil
+}
+
+func newStaticHostAddr(s string) (*staticHostAddr, error) {
+	tcp := strings.HasPrefix(s, "tcp://")
+	if tcp {
+		s = strings.TrimPrefix(s, "tcp://")
+	}
+
+	host, sPort, err := net.SplitHostPort(s)
+	if err != nil {
+		return nil, err
+	}
+
+	port, err := strconv.ParseUint(sPort, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port in %s: %s", s, err)
+	}
+
+	addr := &staticHostAddr{host: host, port: uint16(port), tcp: tcp}
+	if ip := net.ParseIP(host); ip != nil {
+		addr.ips = []net.IP{ip}
+	} else {
+		addr.name = true
+	}
+
+	return addr, nil
+}
+
+// LhResolveWorker looks up the dns names in the static_host_map again as their records expire
+func (lh *LightHouse) LhResolveWorker() {
+	for {
+		next := lh.refreshStaticHosts(time.Now())
+		if next.IsZero() {
+			// Nothing was configured with a dns name
+			return
+		}
+
+		time.Sleep(time.Until(next))
+	}
+}
+
+// refreshStaticHosts looks up every name that is due and updates the static remotes that changed. It returns when the
+// next name is due, or the zero time if there are no names
+func (lh *LightHouse) refreshStaticHosts(now time.Time) time.Time {
+	if lh.staticHostMap == nil {
+		return time.Time{}
+	}
+
+	var next time.Time
+	for vpnIp, addrs := range lh.staticHostMap.hosts {
+		changed := false
+		for _, addr := range addrs {
+			if !addr.name {
+				continue
+			}
+
+			if !addr.refreshAt.After(now) {
+				changed = lh.resolveStaticHostAddr(vpnIp, addr, now) || changed
+			}
+
+			if next.IsZero() || addr.refreshAt.Before(next) {
+				next = addr.refreshAt
+			}
+		}
+
+		if changed {
+			lh.setStaticRemotes(vpnIp, addrs)
+		}
+	}
+
+	return next
+}
+
+// resolveStaticHostAddr looks up the name for addr and schedules the next lookup, it returns true if the addresses
+// changed. The old addresses are kept if the lookup fails
+func (lh *LightHouse) resolveStaticHostAddr(vpnIp VpnIp, addr *staticHostAddr, now time.Time) bool {
+	shm := lh.staticHostMap
+	ctx, cancel := context.WithTimeout(context.Background(), shm.lookupTimeout)
+	defer cancel()
+
+	// Finding the ttl costs more queries, it can't change anything when the interval is already the minimum
+	ips, ttl, ttlFound, err := lh.resolver.lookup(ctx, shm.network, addr.host, shm.interval > minStaticResolveInterval)
+	if err != nil {
+		retry := staticResolveRetry
+		if shm.interval < retry {
+			retry = shm.interval
+		}
+		addr.refreshAt = now.Add(retry)
+
+		lh.l.WithError(err).WithField("vpnIp", vpnIp).WithField("host", addr.host).
+			WithField("retryIn", retry).Error("Static host address could not be resolved")
+		return false
+	}
+
+	if !ttlFound || ttl > shm.interval {
+		ttl = shm.interval
+	} else if ttl < minStaticResolveInterval {
+		ttl = minStaticResolveInterval
+	}
+	addr.refreshAt = now.Add(ttl)
+
+	// Round robin dns hands out the same records in a different order, that is not a change
+	sort.Slice(ips, func(i, j int) bool {
+		return bytes.Compare(ips[i].To16(), ips[j].To16()) < 0
+	})
+
+	if ipsEqual(addr.ips, ips) {
+		return false
+	}
+
+	if addr.ips != nil {
+		lh.l.WithField("vpnIp", vpnIp).WithField("host", addr.host).WithField("old", addr.ips).WithField("new", ips).
+			Info("Static host address changed")
+	} else if lh.l.Level >= logrus.DebugLevel {
+		lh.l.WithField("vpnIp", vpnIp).WithField("host", addr.host).WithField("ips", ips).Debug("Static host address resolved")
+	}
+
+	addr.ips = ips
+	return true
+}
+
+// setStaticRemotes replaces the static remotes for the host with the current addresses in the static_host_map. The
+// RemoteList is updated in place so any tunnel using it picks up the change on its next handshake
+func (lh *LightHouse) setStaticRemotes(vpnIp VpnIp, addrs []*staticHostAddr) {
+	var v4 []*Ip4AndPort
+	var v6 []*Ip6AndPort
+	var tcp []*udpAddr
+	for _, addr := range addrs {
+		for _, ip := range addr.ips {
+			if addr.tcp {
+				tcp = append(tcp, NewUDPAddr(ip, addr.port))
+			}
+
+			if ipv4 := ip.To4(); ipv4 != nil {
+				v4 = append(v4, NewIp4AndPort(ipv4, uint32(addr.port)))
+			} else {
+				v6 = append(v6, NewIp6AndPort(ip.To16(), uint32(addr.port)))
+			}
+		}
+	}
+
+	lh.Lock()
+	am := lh.unlockedGetRemoteList(vpnIp)
+	am.Lock()
+	defer am.Unlock()
+	lh.Unlock()
+
+	am.unlockedSetV4(lh.myVpnIp, v4, lh.unlockedShouldAddV4)
+	am.unlockedSetV6(lh.myVpnIp, v6, lh.unlockedShouldAddV6)
+	am.unlockedSetTCP(tcp)
+}
+
+func ipsEqual(a, b []net.IP) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if !a[i].Equal(b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// systemResolver looks names up the same way the rest of the system does. The go resolver does not tell us the ttl so
+// when there is a resolv.conf the name servers in it are asked for the records again directly to get it
+type systemResolver struct {
+	conf   *dns.ClientConfig
+	client *dns.Client
+}
+
+func newSystemResolver() *systemResolver {
+	r := &systemResolver{client: &dns.Client{}}
+	conf, err := dns.ClientConfigFromFile("/etc/resolv.conf")
+	if err == nil && len(conf.Servers) > 0 {
+		r.conf = conf
+	}
+	return r
+}
+
+func (r *systemResolver) lookup(ctx context.Context, network, host string, wantTTL bool) ([]net.IP, time.Duration, bool, error) {
+	ips, err := net.DefaultResolver.LookupIP(ctx, network, host)
+	if err != nil {
+		return nil, 0, false, err
+	}
+
+	if !wantTTL {
+		return ips, 0, false, nil
+	}
+
+	ttl, found := r.ttl(ctx, network, host)
+	return ips, ttl, found, nil
+}
+
+// ttl returns the lowest ttl of the records for host, found is false if there were no records to take it from
+func (r *systemResolver) ttl(ctx context.Context, network, host string) (time.Duration, bool) {
+	if r.conf == nil {
+		return 0, false
+	}
+
+	var qtypes []uint16
+	switch network {
+	case "ip4":
+		qtypes = []uint16{dns.TypeA}
+	case "ip6":
+		qtypes = []uint16{dns.TypeAAAA}
+	default:
+		qtypes = []uint16{dns.TypeA, dns.TypeAAAA}
+	}
+
+	found := false
+	var ttl uint32
+	for _, name := range r.conf.NameList(host) {
+		for _, qtype := range qtypes {
+			q := new(dns.Msg)
+			q.SetQuestion(name, qtype)
+
+			for _, server := range r.conf.Servers {
+				resp, _, err := r.client.ExchangeContext(ctx, q, net.JoinHostPort(server, r.conf.Port))
+				if err != nil || resp.Rcode != dns.RcodeSuccess {
+					continue
+				}
+
+				for _, rr := range resp.Answer {
+					if !found || rr.Header().Ttl < ttl {
+						ttl = rr.Header().Ttl
+						found = true
+					}
+				}
+				break
+			}
+		}
+
+		if found {
+			break
+		}
+	}
+
+	return time.Duration(ttl) * time.Second, found
+}
@@ -0,0 +1,167 @@
+package nebula
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testResolver struct {
+	ips      map[string][]net.IP
+	ttl      time.Duration
+	ttlFound bool
+	err      error
+	lookups  int
+	wantTTL  bool
+}
+
+func (r *testResolver) lookup(_ context.Context, _, host string, wantTTL bool) ([]net.IP, time.Duration, bool, error) {
+	r.lookups++
+	r.wantTTL = wantTTL
+	if r.err != nil {
+		return nil, 0, false, r.err
+	}
+
+	ips, ok := r.ips[host]
+	if !ok {
+		return nil, 0, false, errors.New("no such host")
+	}
+
+	// Hand out a copy like a real lookup would
+	return append([]net.IP{}, ips...), r.ttl, r.ttlFound && wantTTL, nil
+}
+
+func TestLightHouse_LoadStaticHostMap(t *testing.T) {
+	l := NewTestLogger()
+	lhVpnIp := NewVpnIp(net.ParseIP("10.128.0.2"))
+	myVpnNets := []*net.IPNet{{IP: net.IP{10, 128, 0, 1}, Mask: net.IPMask{255, 255, 255, 0}}}
+	udpServer, _ := NewListener(l, "0.0.0.0", 0, true)
+
+	newLH := func() (*LightHouse, *testResolver) {
+		lh := NewLightHouse(l, false, myVpnNets, []VpnIp{lhVpnIp}, 10, 10003, udpServer, false, 1, false)
+		r := &testResolver{ips: map[string][]net.IP{
+			"lh.example.com": {net.ParseIP("1.1.1.1"), net.ParseIP("2001::1")},
+		}}
+		lh.resolver = r
+		return lh, r
+	}
+
+	c := NewConfig(l)
+	c.Settings["static_host_map"] = map[interface{}]interface{}{
+		"10.128.0.2": []interface{}{"lh.example.com:4242", "3.3.3.3:4243"},
+	}
+
+	lh, r := newLH()
+	assert.NoError(t, lh.LoadStaticHostMap(c))
+	assert.NoError(t, lh.ValidateLHStaticEntries())
+	assert.Equal(t, 1, r.lookups)
+	assertUdpAddrInArray(
+		t,
+		lh.addrMap[lhVpnIp].CopyAddrs([]*net.IPNet{}),
+		NewUDPAddr(net.ParseIP("2001::1"), 4242),
+		NewUDPAddr(net.ParseIP("1.1.1.1"), 4242),
+		NewUDPAddr(net.ParseIP("3.3.3.3"), 4243),
+	)
+
+	// Nothing happens until the name is due
+	now := time.Now()
+	next := lh.refreshStaticHosts(now)
+	assert.Equal(t, 1, r.lookups)
+	assert.True(t, next.After(now.Add(time.Minute*4)))
+
+	// The host moved, the same remote list sees the new address and keeps the literal one
+	rl := lh.addrMap[lhVpnIp]
+	r.ips["lh.example.com"] = []net.IP{net.ParseIP("4.4.4.4")}
+	r.ttl = time.Minute
+	r.ttlFound = true
+	now = next
+	next = lh.refreshStaticHosts(now)
+	assert.Equal(t, 2, r.lookups)
+	assert.Equal(t, now.Add(time.Minute), next)
+	assertUdpAddrInArray(
+		t,
+		rl.CopyAddrs([]*net.IPNet{}),
+		NewUDPAddr(net.ParseIP("3.3.3.3"), 4243),
+		NewUDPAddr(net.ParseIP("4.4.4.4"), 4242),
+	)
+
+	// Tiny ttls are held to the minimum
+	r.ttl = time.Second
+	now = next
+	next = lh.refreshStaticHosts(now)
+	assert.Equal(t, now.Add(minStaticResolveInterval), next)
+
+	// So is a ttl of 0, it is not the same as an unknown ttl
+	r.ttl = 0
+	now = next
+	next = lh.refreshStaticHosts(now)
+	assert.Equal(t, now.Add(minStaticResolveInterval), next)
+	assert.True(t, r.wantTTL)
+
+	// A failed lookup keeps what we had and tries again soon
+	r.err = errors.New("dns is down")
+	now = next
+	next = lh.refreshStaticHosts(now)
+	assert.Equal(t, now.Add(staticResolveRetry), next)
+	assert.Len(t, rl.CopyAddrs([]*net.IPNet{}), 2)
+
+	// A name that can't be resolved at startup does not stop us from starting
+	c.Settings["static_host_map"] = map[interface{}]interface{}{"10.128.0.2": "missing.example.com:4242"}
+	lh, _ = newLH()
+	assert.NoError(t, lh.LoadStaticHostMap(c))
+	assert.NoError(t, lh.ValidateLHStaticEntries())
+	assert.Empty(t, lh.addrMap[lhVpnIp].CopyAddrs([]*net.IPNet{}))
+
+	// Only literal addresses means there is nothing to refresh
+	c.Settings["static_host_map"] = map[interface{}]interface{}{"10.128.0.2": "3.3.3.3:4242"}
+	lh, r = newLH()
+	assert.NoError(t, lh.LoadStaticHostMap(c))
+	assert.True(t, lh.refreshStaticHosts(time.Now()).IsZero())
+	assert.Equal(t, 0, r.lookups)
+
+	// tcp:// entries are remotes like any other but are only reached over tcp
+	c.Settings["static_host_map"] = map[interface{}]interface{}{"10.128.0.2": []interface{}{"3.3.3.3:4242", "tcp://lh.example.com:443"}}
+	lh, _ = newLH()
+	assert.NoError(t, lh.LoadStaticHostMap(c))
+	rl = lh.addrMap[lhVpnIp]
+	assertUdpAddrInArray(
+		t,
+		rl.CopyAddrs([]*net.IPNet{}),
+		NewUDPAddr(net.ParseIP("2001::1"), 443),
+		NewUDPAddr(net.ParseIP("1.1.1.1"), 443),
+		NewUDPAddr(net.ParseIP("3.3.3.3"), 4242),
+	)
+	assert.True(t, rl.IsTCP(NewUDPAddr(net.ParseIP("1.1.1.1"), 443)))
+	assert.True(t, rl.IsTCP(NewUDPAddr(net.ParseIP("2001::1"), 443)))
+	assert.False(t, rl.IsTCP(NewUDPAddr(net.ParseIP("3.3.3.3"), 4242)))
+
+	// Config errors
+	c.Settings["static_host_map"] = map[interface{}]interface{}{"10.128.0.2": "3.3.3.3"}
+	lh, _ = newLH()
+	assert.EqualError(t, lh.LoadStaticHostMap(c), "address 3.3.3.3: missing port in address")
+
+	c.Settings["static_host_map"] = map[interface{}]interface{}{"10.128.0.2": "3.3.3.3:65536"}
+	assert.EqualError(t, lh.LoadStaticHostMap(c), "invalid port in 3.3.3.3:65536: strconv.ParseUint: parsing \"65536\": value out of range")
+
+	c.Settings["static_host_map"] = map[interface{}]interface{}{"10.1.0.2": "3.3.3.3:4242"}
+	assert.EqualError(t, lh.LoadStaticHostMap(c), "static_host_map key is not in our subnet, invalid")
+
+	c.Settings["static_map"] = map[interface{}]interface{}{"network": "tcp"}
+	assert.EqualError(t, lh.LoadStaticHostMap(c), "static_map.network must be one of ip, ip4, or ip6")
+
+	c.Settings["static_map"] = map[interface{}]interface{}{"interval": "1s"}
+	assert.EqualError(t, lh.LoadStaticHostMap(c), "static_map.interval is too short")
+
+	// The ttl is not worth asking for when the interval is already the minimum
+	c.Settings["static_host_map"] = map[interface{}]interface{}{"10.128.0.2": "lh.example.com:4242"}
+	c.Settings["static_map"] = map[interface{}]interface{}{"interval": "5s"}
+	lh, r = newLH()
+	r.ttl, r.ttlFound = time.Minute, true
+	assert.NoError(t, lh.LoadStaticHostMap(c))
+	assert.Equal(t, 1, r.lookups)
+	assert.False(t, r.wantTTL)
+}
@@ -20,7 +20,7 @@ import (
 // startStats initializes stats from config. On success, if any futher work
 // is needed to serve stats, it returns a func to handle that work. If no
 // work is needed, it'll return nil. On failure, it returns nil, error.
-func startStats(l *logrus.Logger, c *Config, buildVersion string, configTest bool) (func(), error) {
+func startStats(l *logrus.Logger, c *Config, hostMap *HostMap, buildVersion string, configTest bool) (func(), error) {
 	mType := c.GetString("stats.type", "")
 	if mType == "" || mType == "none" {
 		return nil, nil
@@ -40,7 +40,7 @@ func startStats(l *logrus.Logger, c *Config, buildVersion string, configTest boo
 		}
 	case "prometheus":
 		var err error
-		startFn, err = startPrometheusStats(l, interval, c, buildVersion, configTest)
+		startFn, err = startPrometheusStats(l, interval, c, hostMap, buildVersion, configTest)
 		if err != nil {
 			return nil, err
 		}
@@ -57,6 +57,26 @@ func startStats(l *logrus.Logger, c *Config, buildVersion string, configTest boo
 	return startFn, nil
 }
 
+// newTunnelMetricsFromConfig returns the per tunnel metrics for the main hostmap or nil if they are not enabled. They
+// need to exist before any tunnels do so this happens well before startStats
+func newTunnelMetricsFromConfig(l *logrus.Logger, c *Config, hostMap *HostMap) (*tunnelMetrics, error) {
+	if !c.GetBool("stats.tunnel_metrics.enabled", false) {
+		return nil, nil
+	}
+
+	if c.GetString("stats.type", "") != "prometheus" {
+		l.Warn("stats.tunnel_metrics is only supported by prometheus, per tunnel metrics will not be collected")
+		return nil, nil
+	}
+
+	maxTunnels := c.GetInt("stats.tunnel_metrics.max_tunnels", 100)
+	if maxTunnels <= 0 {
+		return nil, fmt.Errorf("stats.tunnel_metrics.max_tunnels must be greater than 0")
+	}
+
+	return newTunnelMetrics(hostMap, maxTunnels, c.GetString("stats.namespace", ""), c.GetString("stats.subsystem", "")), nil
+}
+
 func startGraphiteStats(l *logrus.Logger, i time.Duration, c *Config, configTest bool) error {
 	proto := c.GetString("stats.protocol", "tcp")
 	host := c.GetString("stats.host", "")
@@ -77,7 +97,7 @@ func startGraphiteStats(l *logrus.Logger, i time.Duration, c *Config, configTest
 	return nil
 }
 
-func startPrometheusStats(l *logrus.Logger, i time.Duration, c *Config, buildVersion string, configTest bool) (func(), error) {
+func startPrometheusStats(l *logrus.Logger, i time.Duration, c *Config, hostMap *HostMap, buildVersion string, configTest bool) (func(), error) {
 	namespace := c.GetString("stats.namespace", "")
 	subsystem := c.GetString("stats.subsystem", "")
 
@@ -109,6 +129,10 @@ func startPrometheusStats(l *logrus.Logger, i time.Duration, c *Config, buildVer
 	pr.MustRegister(g)
 	g.Set(1)
 
+	if hostMap.tunnelMetrics != nil {
+		pr.MustRegister(hostMap.tunnelMetrics)
+	}
+
 	var startFn func()
 	if !configTest {
 		startFn = func() {
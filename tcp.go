@@ -0,0 +1,532 @@
+package nebula
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/sirupsen/logrus"
+)
+
+// tcpFrameHeaderLen is the size of the length prefix in front of every nebula packet sent over tcp
+const tcpFrameHeaderLen = 2
+
+// tcpMaxFrame is the biggest packet a frame can carry
+const tcpMaxFrame = 1<<16 - 1
+
+// tcpWriteTimeout closes a connection when the other end stops reading from it
+const tcpWriteTimeout = time.Second * 5
+
+// tcpWriteQueue is how many frames can wait to be written to a connection, more are dropped like a full udp socket
+// buffer would
+const tcpWriteQueue = 128
+
+// tcpHandshakeTimeout is how long an accepted connection has to send its first frame, which must be a handshake
+const tcpHandshakeTimeout = time.Second * 5
+
+var errTcpFrameTooBig = errors.New("packet is too big for a tcp frame")
+var errTcpNotHandshake = errors.New("first packet was not a handshake")
+
+// tcpFramePool holds frame buffers while they wait in a write queue, most packets fit in the capacity they start with
+var tcpFramePool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, 0, tcpFrameHeaderLen+mtu)
+		return &b
+	},
+}
+
+// tcpReader handles a packet that came in over tcp from addr. Each connection gets its own since the buffers behind it
+// are not safe to share
+type tcpReader func(addr *udpAddr, packet []byte)
+
+// tcpKey is a udpAddr that can be used as a map key without allocating
+type tcpKey struct {
+	ip   [16]byte
+	port uint16
+}
+
+func newTcpKey(addr *udpAddr) tcpKey {
+	k := tcpKey{port: addr.Port}
+	copy(k.ip[:], addr.IP.To16())
+	return k
+}
+
+// tcpConn is one tcp connection carrying nebula packets for the address it is keyed by
+type tcpConn struct {
+	net.Conn
+	addr *udpAddr
+	// accepted is true when the other end dialed us
+	accepted bool
+	t        *tcpTransport
+
+	// out feeds the writer goroutine so a slow connection never blocks the routine sending to it
+	out       chan *[]byte
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// write queues b to be sent as a single frame, it is dropped if the queue is full
+func (tc *tcpConn) write(b []byte) error {
+	if len(b) > tcpMaxFrame {
+		return errTcpFrameTooBig
+	}
+
+	frame := tcpFramePool.Get().(*[]byte)
+	*frame = append((*frame)[:0], 0, 0)
+	binary.BigEndian.PutUint16(*frame, uint16(len(b)))
+	*frame = append(*frame, b...)
+
+	select {
+	case tc.out <- frame:
+	default:
+		tcpFramePool.Put(frame)
+		tc.t.dropped.Inc(1)
+	}
+	return nil
+}
+
+// writeLoop writes out queued frames until the connection is closed or a write fails
+func (tc *tcpConn) writeLoop() {
+	for {
+		select {
+		case <-tc.done:
+			return
+		case frame := <-tc.out:
+			err := tc.SetWriteDeadline(time.Now().Add(tcpWriteTimeout))
+			if err == nil {
+				_, err = tc.Write(*frame)
+			}
+			tcpFramePool.Put(frame)
+
+			if err != nil {
+				tc.t.remove(tc, err)
+				return
+			}
+		}
+	}
+}
+
+// Close stops the writer and closes the connection, only the first call returns a nil error
+func (tc *tcpConn) Close() error {
+	tc.closeOnce.Do(func() {
+		close(tc.done)
+		if tc.accepted {
+			atomic.AddInt32(&tc.t.accepted, -1)
+		}
+	})
+	return tc.Conn.Close()
+}
+
+// tcpTransport carries nebula packets over tcp for networks that drop udp. Packets to an address go over tcp whenever
+// there is a connection for it and over udp otherwise, so the rest of nebula keeps dealing in udpAddrs
+type tcpTransport struct {
+	l *logrus.Logger
+
+	// listenAddr is empty unless we accept connections
+	listenAddr    string
+	fallbackAfter int
+	dialTimeout   time.Duration
+	idleTimeout   time.Duration
+	clientTLS     *tls.Config
+	serverTLS     *tls.Config
+
+	newReader func() tcpReader
+	listener  net.Listener
+
+	sync.RWMutex
+	conns   map[tcpKey]*tcpConn
+	dialing map[tcpKey]struct{}
+	// atomicConns lets udp only setups skip the lock on every packet
+	atomicConns int32
+
+	// accepted counts the connections we accepted, new ones are refused past maxConns
+	accepted int32
+	maxConns int32
+	dropped  metrics.Counter
+}
+
+func newTcpTransport(l *logrus.Logger, c *Config, udpPort int) (*tcpTransport, error) {
+	t := &tcpTransport{
+		l:             l,
+		fallbackAfter: c.GetInt("tcp.fallback_after", 0),
+		dialTimeout:   c.GetDuration("tcp.dial_timeout", time.Second*5),
+		idleTimeout:   c.GetDuration("tcp.idle_timeout", time.Minute*5),
+		maxConns:      int32(c.GetInt("tcp.max_connections", 1024)),
+		conns:         map[tcpKey]*tcpConn{},
+		dialing:       map[tcpKey]struct{}{},
+		dropped:       metrics.GetOrRegisterCounter("tcp.write.dropped", nil),
+	}
+
+	if t.fallbackAfter < 0 {
+		return nil, fmt.Errorf("tcp.fallback_after can not be negative")
+	}
+	if t.dialTimeout <= 0 {
+		return nil, fmt.Errorf("tcp.dial_timeout must be greater than 0")
+	}
+	if t.idleTimeout <= 0 {
+		return nil, fmt.Errorf("tcp.idle_timeout must be greater than 0")
+	}
+	if t.maxConns <= 0 {
+		return nil, fmt.Errorf("tcp.max_connections must be greater than 0")
+	}
+
+	listen := c.GetBool("tcp.listen", false)
+	if listen {
+		port := c.GetInt("tcp.port", 0)
+		if port == 0 {
+			port = udpPort
+		}
+		t.listenAddr = net.JoinHostPort(c.GetString("listen.host", "0.0.0.0"), strconv.Itoa(port))
+	}
+
+	if c.GetBool("tcp.tls", false) {
+		serverName := c.GetString("tcp.server_name", "")
+		// Nebula authenticates the other host itself, tls is only here so the connection looks like https to the
+		// network in between. There is nothing to verify the server certificate against
+		t.clientTLS = &tls.Config{ServerName: serverName, InsecureSkipVerify: true}
+
+		if listen {
+			cert, err := newTcpTLSCert(serverName)
+			if err != nil {
+				return nil, fmt.Errorf("failed to create a tls certificate: %s", err)
+			}
+			t.serverTLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+		}
+	}
+
+	return t, nil
+}
+
+// newTcpTLSCert makes a throwaway self signed certificate for the tls listener
+func newTcpTLSCert(name string) (tls.Certificate, error) {
+	if name == "" {
+		name = "nebula"
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(time.Hour * 24 * 365),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+// Listen opens the tcp listener if tcp.listen is set, it does not accept connections until Start
+func (t *tcpTransport) Listen() error {
+	if t == nil || t.listenAddr == "" {
+		return nil
+	}
+
+	ln, err := net.Listen("tcp", t.listenAddr)
+	if err != nil {
+		return err
+	}
+
+	t.listener = ln
+	return nil
+}
+
+// Start accepts connections, newReader is called once for every connection to handle the packets arriving on it
+func (t *tcpTransport) Start(newReader func() tcpReader) {
+	if t == nil {
+		return
+	}
+
+	t.newReader = newReader
+	if t.listener != nil {
+		t.l.WithField("tcpAddr", t.listener.Addr()).Info("Accepting tunnels over tcp")
+		go t.accept()
+	}
+}
+
+// Close stops accepting connections and closes the ones we have
+func (t *tcpTransport) Close() {
+	if t == nil {
+		return
+	}
+
+	if t.listener != nil {
+		t.listener.Close()
+	}
+
+	t.Lock()
+	defer t.Unlock()
+	for k, tc := range t.conns {
+		tc.Close()
+		delete(t.conns, k)
+	}
+	atomic.StoreInt32(&t.atomicConns, 0)
+}
+
+func (t *tcpTransport) accept() {
+	for {
+		c, err := t.listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+
+			t.l.WithError(err).Error("Failed to accept a tcp connection")
+			time.Sleep(time.Second)
+			continue
+		}
+
+		ta, ok := c.RemoteAddr().(*net.TCPAddr)
+		if !ok {
+			c.Close()
+			continue
+		}
+
+		if atomic.LoadInt32(&t.accepted) >= t.maxConns {
+			if t.l.Level >= logrus.DebugLevel {
+				t.l.WithField("tcpAddr", ta).Debug("Refused a tcp connection, tcp.max_connections reached")
+			}
+			c.Close()
+			continue
+		}
+
+		if t.serverTLS != nil {
+			c = tls.Server(c, t.serverTLS)
+		}
+
+		// Replies have to go back over this connection, so it is known by the address it came from
+		tc := t.add(NewUDPAddr(ta.IP, uint16(ta.Port)), c, true)
+		if t.l.Level >= logrus.DebugLevel {
+			t.l.WithField("tcpAddr", tc.addr).Debug("Accepted a tcp connection")
+		}
+		go t.read(tc)
+	}
+}
+
+// writeTo sends b to addr if we have a tcp connection for it, it returns false when the packet should go over udp
+func (t *tcpTransport) writeTo(b []byte, addr *udpAddr) (bool, error) {
+	if t == nil || atomic.LoadInt32(&t.atomicConns) == 0 {
+		return false, nil
+	}
+
+	t.RLock()
+	tc := t.conns[newTcpKey(addr)]
+	t.RUnlock()
+
+	if tc == nil {
+		return false, nil
+	}
+
+	return true, tc.write(b)
+}
+
+// fallback reports if udp has gone unanswered long enough that a handshake should be tried over tcp as well
+func (t *tcpTransport) fallback(handshakeCounter int) bool {
+	return t != nil && t.fallbackAfter > 0 && handshakeCounter >= t.fallbackAfter
+}
+
+// connect dials addr in the background unless there is already a connection for it, first is sent once connected
+func (t *tcpTransport) connect(addr *udpAddr, first []byte) {
+	k := newTcpKey(addr)
+
+	t.Lock()
+	if _, ok := t.conns[k]; ok {
+		t.Unlock()
+		return
+	}
+	if _, ok := t.dialing[k]; ok {
+		t.Unlock()
+		return
+	}
+	t.dialing[k] = struct{}{}
+	t.Unlock()
+
+	addr = addr.Copy()
+	first = append([]byte(nil), first...)
+
+	go func() {
+		c, err := t.dial(addr)
+
+		t.Lock()
+		delete(t.dialing, k)
+		t.Unlock()
+
+		if err != nil {
+			t.l.WithError(err).WithField("tcpAddr", addr).Info("Failed to connect over tcp")
+			return
+		}
+
+		tc := t.add(addr, c, false)
+		t.l.WithField("tcpAddr", addr).Info("Connected over tcp")
+		go t.read(tc)
+
+		if len(first) > 0 {
+			tc.write(first)
+		}
+	}()
+}
+
+func (t *tcpTransport) dial(addr *udpAddr) (net.Conn, error) {
+	d := &net.Dialer{Timeout: t.dialTimeout}
+	target := net.JoinHostPort(addr.IP.String(), strconv.Itoa(int(addr.Port)))
+
+	if t.clientTLS != nil {
+		return tls.DialWithDialer(d, "tcp", target, t.clientTLS)
+	}
+	return d.Dial("tcp", target)
+}
+
+// add makes c the connection for addr, replacing any we had, and starts writing to it
+func (t *tcpTransport) add(addr *udpAddr, c net.Conn, accepted bool) *tcpConn {
+	tc := &tcpConn{
+		Conn:     c,
+		addr:     addr,
+		accepted: accepted,
+		t:        t,
+		out:      make(chan *[]byte, tcpWriteQueue),
+		done:     make(chan struct{}),
+	}
+	if accepted {
+		atomic.AddInt32(&t.accepted, 1)
+	}
+	k := newTcpKey(addr)
+
+	t.Lock()
+	old := t.conns[k]
+	t.conns[k] = tc
+	if old == nil {
+		atomic.AddInt32(&t.atomicConns, 1)
+	}
+	t.Unlock()
+
+	if old != nil {
+		old.Close()
+	}
+
+	go tc.writeLoop()
+	return tc
+}
+
+// remove closes tc and forgets it, unless it was already replaced
+func (t *tcpTransport) remove(tc *tcpConn, err error) {
+	k := newTcpKey(tc.addr)
+
+	t.Lock()
+	if t.conns[k] == tc {
+		delete(t.conns, k)
+		atomic.AddInt32(&t.atomicConns, -1)
+	}
+	t.Unlock()
+
+	if tc.Close() == nil && err != nil && err != io.EOF {
+		t.l.WithError(err).WithField("tcpAddr", tc.addr).Info("Closed tcp connection")
+	}
+}
+
+// read hands every frame on tc to a reader of its own until the connection fails or goes idle
+func (t *tcpTransport) read(tc *tcpConn) {
+	var reader tcpReader
+	br := bufio.NewReader(tc)
+	header := make([]byte, tcpFrameHeaderLen)
+	packet := make([]byte, tcpMaxFrame)
+	h := &Header{}
+
+	var err error
+	defer func() {
+		// Accepted connections that never sent a handshake are port scanners and the like, keep them out of the logs
+		if tc.accepted && reader == nil {
+			if t.l.Level >= logrus.DebugLevel {
+				t.l.WithError(err).WithField("tcpAddr", tc.addr).Debug("Closed tcp connection before a handshake")
+			}
+			err = nil
+		}
+		t.remove(tc, err)
+	}()
+
+	for {
+		// Until an accepted connection has shown it is a nebula host it only gets a few seconds to do so
+		timeout := t.idleTimeout
+		if tc.accepted && reader == nil {
+			timeout = tcpHandshakeTimeout
+		}
+
+		err = tc.SetReadDeadline(time.Now().Add(timeout))
+		if err != nil {
+			return
+		}
+
+		_, err = io.ReadFull(br, header)
+		if err != nil {
+			return
+		}
+
+		n := binary.BigEndian.Uint16(header)
+		_, err = io.ReadFull(br, packet[:n])
+		if err != nil {
+			return
+		}
+
+		if reader == nil {
+			if tc.accepted && (h.Parse(packet[:n]) != nil || h.Type != handshake) {
+				err = errTcpNotHandshake
+				return
+			}
+			reader = t.newReader()
+		}
+
+		reader(tc.addr, packet[:n])
+	}
+}
+
+// newTcpReader feeds packets from a tcp connection in as if they came from udp. Connections come and go so they skip
+// the conntrack cache, which needs a ticker for every reader
+func (f *Interface) newTcpReader() tcpReader {
+	plaintext := make([]byte, mtu)
+	header := &Header{}
+	fwPacket := &FirewallPacket{}
+	nb := make([]byte, 12, 12)
+	lhh := f.lightHouse.NewRequestHandler()
+
+	return func(addr *udpAddr, packet []byte) {
+		f.readOutsidePackets(addr, nil, plaintext[:0], packet, header, fwPacket, lhh, nb, 0, nil)
+	}
+}
+
+// writeTo sends an outside packet to addr over tcp if there is a connection for it, otherwise over w
+func (f *Interface) writeTo(w *udpConn, b []byte, addr *udpAddr) error {
+	if ok, err := f.tcp.writeTo(b, addr); ok {
+		return err
+	}
+	return w.WriteTo(b, addr)
+}
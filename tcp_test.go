@@ -0,0 +1,219 @@
+package nebula
+
+import (
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewTcpTransport(t *testing.T) {
+	l := NewTestLogger()
+	c := NewConfig(l)
+
+	tt, err := newTcpTransport(l, c, 4242)
+	assert.NoError(t, err)
+	assert.Equal(t, "", tt.listenAddr)
+	assert.Nil(t, tt.clientTLS)
+	assert.False(t, tt.fallback(100))
+
+	// The listener follows the udp listener unless told otherwise
+	c.Settings["listen"] = map[interface{}]interface{}{"host": "127.0.0.1"}
+	c.Settings["tcp"] = map[interface{}]interface{}{"listen": true, "fallback_after": 3}
+	tt, err = newTcpTransport(l, c, 4242)
+	assert.NoError(t, err)
+	assert.Equal(t, "127.0.0.1:4242", tt.listenAddr)
+	assert.False(t, tt.fallback(2))
+	assert.True(t, tt.fallback(3))
+
+	c.Settings["tcp"] = map[interface{}]interface{}{"listen": true, "port": 443, "tls": true, "server_name": "example.com"}
+	tt, err = newTcpTransport(l, c, 4242)
+	assert.NoError(t, err)
+	assert.Equal(t, "127.0.0.1:443", tt.listenAddr)
+	assert.Equal(t, "example.com", tt.clientTLS.ServerName)
+	assert.Len(t, tt.serverTLS.Certificates, 1)
+
+	c.Settings["tcp"] = map[interface{}]interface{}{"fallback_after": -1}
+	_, err = newTcpTransport(l, c, 4242)
+	assert.EqualError(t, err, "tcp.fallback_after can not be negative")
+
+	c.Settings["tcp"] = map[interface{}]interface{}{"dial_timeout": "0s"}
+	_, err = newTcpTransport(l, c, 4242)
+	assert.EqualError(t, err, "tcp.dial_timeout must be greater than 0")
+
+	c.Settings["tcp"] = map[interface{}]interface{}{"idle_timeout": "0s"}
+	_, err = newTcpTransport(l, c, 4242)
+	assert.EqualError(t, err, "tcp.idle_timeout must be greater than 0")
+
+	c.Settings["tcp"] = map[interface{}]interface{}{"max_connections": 0}
+	_, err = newTcpTransport(l, c, 4242)
+	assert.EqualError(t, err, "tcp.max_connections must be greater than 0")
+
+	// A nil transport sends everything over udp
+	var nilTransport *tcpTransport
+	ok, err := nilTransport.writeTo([]byte("hi"), NewUDPAddr(net.ParseIP("1.1.1.1"), 4242))
+	assert.False(t, ok)
+	assert.NoError(t, err)
+}
+
+type tcpTestPacket struct {
+	addr   *udpAddr
+	packet string
+}
+
+// testTcpHandshake is a frame an accepted connection will take as its first
+func testTcpHandshake(payload string) []byte {
+	return append(HeaderEncode(make([]byte, HeaderLen), Version, uint8(handshake), handshakeIXPSK0, 0, 1), payload...)
+}
+
+// newTestTcpPair starts a listening transport and a dialing one, packets they receive are sent down their channels
+func newTestTcpPair(t *testing.T, tls bool, settings ...interface{}) (server, client *tcpTransport, serverAddr *udpAddr, fromServer, fromClient chan tcpTestPacket) {
+	l := NewTestLogger()
+	c := NewConfig(l)
+	c.Settings["listen"] = map[interface{}]interface{}{"host": "127.0.0.1"}
+	serverTcp := map[interface{}]interface{}{"listen": true, "tls": tls}
+	for i := 0; i+1 < len(settings); i += 2 {
+		serverTcp[settings[i]] = settings[i+1]
+	}
+	c.Settings["tcp"] = serverTcp
+
+	server, err := newTcpTransport(l, c, 0)
+	assert.NoError(t, err)
+	assert.NoError(t, server.Listen())
+
+	delete(c.Settings, "listen")
+	c.Settings["tcp"] = map[interface{}]interface{}{"tls": tls}
+	client, err = newTcpTransport(l, c, 0)
+	assert.NoError(t, err)
+
+	fromClient = make(chan tcpTestPacket, 10)
+	fromServer = make(chan tcpTestPacket, 10)
+	reader := func(ch chan tcpTestPacket) func() tcpReader {
+		return func() tcpReader {
+			return func(addr *udpAddr, packet []byte) {
+				ch <- tcpTestPacket{addr: addr.Copy(), packet: string(packet)}
+			}
+		}
+	}
+	server.Start(reader(fromClient))
+	client.Start(reader(fromServer))
+
+	ta := server.listener.Addr().(*net.TCPAddr)
+	return server, client, NewUDPAddr(ta.IP, uint16(ta.Port)), fromServer, fromClient
+}
+
+func testTcpTransport(t *testing.T, tls bool) {
+	server, client, serverAddr, fromServer, fromClient := newTestTcpPair(t, tls)
+	defer server.Close()
+	defer client.Close()
+
+	// Nothing goes over tcp until we connect
+	ok, _ := client.writeTo([]byte("too early"), serverAddr)
+	assert.False(t, ok)
+
+	// The packet we connect with is the first thing sent
+	client.connect(serverAddr, testTcpHandshake("hello"))
+	var p tcpTestPacket
+	select {
+	case p = <-fromClient:
+	case <-time.After(time.Second * 5):
+		t.Fatal("the server never got the first packet")
+	}
+	assert.Equal(t, string(testTcpHandshake("hello")), p.packet)
+
+	// Replies go back to the address the connection came from
+	ok, err := server.writeTo([]byte("hello back"), p.addr)
+	assert.True(t, ok)
+	assert.NoError(t, err)
+	p = <-fromServer
+	assert.Equal(t, "hello back", p.packet)
+	assert.True(t, p.addr.Equals(serverAddr))
+
+	// Once connected everything for the address goes over tcp, connecting again does nothing
+	client.connect(serverAddr, []byte("ignored"))
+	ok, err = client.writeTo([]byte("again"), serverAddr)
+	assert.True(t, ok)
+	assert.NoError(t, err)
+	assert.Equal(t, "again", (<-fromClient).packet)
+
+	ok, err = client.writeTo(make([]byte, tcpMaxFrame+1), serverAddr)
+	assert.True(t, ok)
+	assert.Equal(t, errTcpFrameTooBig, err)
+	ok, err = client.writeTo([]byte("still here"), serverAddr)
+	assert.True(t, ok)
+	assert.NoError(t, err)
+	assert.Equal(t, "still here", (<-fromClient).packet)
+
+	// The client falls back to udp once the server goes away
+	server.Close()
+	assert.Eventually(t, func() bool {
+		ok, _ := client.writeTo([]byte("gone"), serverAddr)
+		return !ok
+	}, time.Second*5, time.Millisecond*10)
+}
+
+func TestTcpTransport(t *testing.T) {
+	testTcpTransport(t, false)
+}
+
+func TestTcpTransport_tls(t *testing.T) {
+	testTcpTransport(t, true)
+}
+
+func TestTcpTransport_accept(t *testing.T) {
+	server, client, serverAddr, _, fromClient := newTestTcpPair(t, false, "max_connections", 1)
+	defer server.Close()
+	defer client.Close()
+
+	accepted := func() int32 { return atomic.LoadInt32(&server.accepted) }
+
+	// A connection that doesn't start with a handshake is closed
+	client.connect(serverAddr, []byte("not a handshake"))
+	assert.Eventually(t, func() bool {
+		ok, _ := client.writeTo([]byte("gone"), serverAddr)
+		return !ok && accepted() == 0
+	}, time.Second*5, time.Millisecond*10)
+	assert.Empty(t, fromClient)
+
+	// Past max_connections new connections are closed right away, even if the connections we have are idle
+	idle, err := net.Dial("tcp", serverAddr.String())
+	assert.NoError(t, err)
+	defer idle.Close()
+	assert.Eventually(t, func() bool { return accepted() == 1 }, time.Second*5, time.Millisecond*10)
+
+	refused, err := net.Dial("tcp", serverAddr.String())
+	assert.NoError(t, err)
+	defer refused.Close()
+	refused.SetReadDeadline(time.Now().Add(time.Second * 5))
+	_, err = refused.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+
+	// The idle connection is closed once it has gone too long without a handshake
+	idle.SetReadDeadline(time.Now().Add(tcpHandshakeTimeout * 2))
+	_, err = idle.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+	assert.Eventually(t, func() bool { return accepted() == 0 }, time.Second*5, time.Millisecond*10)
+}
+
+func TestTcpConn_writeQueue(t *testing.T) {
+	l := NewTestLogger()
+	tt, err := newTcpTransport(l, NewConfig(l), 0)
+	assert.NoError(t, err)
+
+	// Nothing reads the other end so the writer stalls and the queue fills up behind it
+	near, far := net.Pipe()
+	defer far.Close()
+	tc := tt.add(NewUDPAddr(net.ParseIP("1.1.1.1"), 4242), near, false)
+	defer tc.Close()
+
+	dropped := tt.dropped.Count()
+	start := time.Now()
+	for i := 0; i < tcpWriteQueue+10; i++ {
+		assert.NoError(t, tc.write([]byte("packet")))
+	}
+	assert.Less(t, int64(time.Since(start)), int64(time.Second))
+	assert.True(t, tt.dropped.Count() >= dropped+9)
+}
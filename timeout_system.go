@@ -43,7 +43,7 @@ type SystemTimeoutList struct {
 
 // Represents an item within a tick
 type SystemTimeoutItem struct {
-	Item uint32
+	Item VpnIp
 	Next *SystemTimeoutItem
 }
 
@@ -74,7 +74,7 @@ func NewSystemTimerWheel(min, max time.Duration) *SystemTimerWheel {
 	return &tw
 }
 
-func (tw *SystemTimerWheel) Add(v uint32, timeout time.Duration) *SystemTimeoutItem {
+func (tw *SystemTimerWheel) Add(v VpnIp, timeout time.Duration) *SystemTimeoutItem {
 	tw.lock.Lock()
 	defer tw.lock.Unlock()
 
@@ -123,7 +123,7 @@ func (tw *SystemTimerWheel) Purge() interface{} {
 	p := ti.Item
 
 	// Clear out the items references
-	ti.Item = 0
+	ti.Item = VpnIp{}
 	ti.Next = nil
 
 	// Maybe cache it for later
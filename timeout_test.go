@@ -85,10 +85,10 @@ func TestTimerWheel_Purge(t *testing.T) {
 	assert.Equal(t, 0, tw.current)
 
 	fps := []FirewallPacket{
-		{LocalIP: 1},
-		{LocalIP: 2},
-		{LocalIP: 3},
-		{LocalIP: 4},
+		{LocalIP: NewVpnIp4(1)},
+		{LocalIP: NewVpnIp4(2)},
+		{LocalIP: NewVpnIp4(3)},
+		{LocalIP: NewVpnIp4(4)},
 	}
 
 	tw.Add(fps[0], time.Second*1)
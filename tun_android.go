@@ -16,7 +16,7 @@ type Tun struct {
 	io.ReadWriteCloser
 	fd           int
 	Device       string
-	Cidr         *net.IPNet
+	Cidrs        []*net.IPNet
 	MaxMTU       int
 	DefaultMTU   int
 	TXQueueLen   int
@@ -25,14 +25,14 @@ type Tun struct {
 	l            *logrus.Logger
 }
 
-func newTunFromFd(l *logrus.Logger, deviceFd int, cidr *net.IPNet, defaultMTU int, routes []route, unsafeRoutes []route, txQueueLen int) (ifce *Tun, err error) {
+func newTunFromFd(l *logrus.Logger, deviceFd int, cidrs []*net.IPNet, defaultMTU int, routes []route, unsafeRoutes []route, txQueueLen int) (ifce *Tun, err error) {
 	file := os.NewFile(uintptr(deviceFd), "/dev/net/tun")
 
 	ifce = &Tun{
 		ReadWriteCloser: file,
 		fd:              int(file.Fd()),
 		Device:          "android",
-		Cidr:            cidr,
+		Cidrs:           cidrs,
 		DefaultMTU:      defaultMTU,
 		TXQueueLen:      txQueueLen,
 		Routes:          routes,
@@ -42,7 +42,7 @@ func newTunFromFd(l *logrus.Logger, deviceFd int, cidr *net.IPNet, defaultMTU in
 	return
 }
 
-func newTun(l *logrus.Logger, deviceName string, cidr *net.IPNet, defaultMTU int, routes []route, unsafeRoutes []route, txQueueLen int, multiqueue bool) (ifce *Tun, err error) {
+func newTun(l *logrus.Logger, deviceName string, cidrs []*net.IPNet, defaultMTU int, routes []route, unsafeRoutes []route, txQueueLen int, multiqueue bool) (ifce *Tun, err error) {
 	return nil, fmt.Errorf("newTun not supported in Android")
 }
 
@@ -73,7 +73,7 @@ func (c Tun) Activate() error {
 }
 
 func (c *Tun) CidrNet() *net.IPNet {
-	return c.Cidr
+	return c.Cidrs[0]
 }
 
 func (c *Tun) DeviceName() string {
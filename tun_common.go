@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"net"
 	"strconv"
+	"strings"
 )
 
 const DEFAULT_MTU = 1300
@@ -14,7 +15,7 @@ type route struct {
 	via   *net.IP
 }
 
-func parseRoutes(config *Config, network *net.IPNet) ([]route, error) {
+func parseRoutes(config *Config, networks []*net.IPNet) ([]route, error) {
 	var err error
 
 	r := config.Get("tun.routes")
@@ -69,12 +70,12 @@ func parseRoutes(config *Config, network *net.IPNet) ([]route, error) {
 			return nil, fmt.Errorf("entry %v.route in tun.routes failed to parse: %v", i+1, err)
 		}
 
-		if !ipWithin(network, r.route) {
+		if ipWithinAny(networks, r.route) == nil {
 			return nil, fmt.Errorf(
 				"entry %v.route in tun.routes is not contained within the network attached to the certificate; route: %v, network: %v",
 				i+1,
 				r.route.String(),
-				network.String(),
+				ipNetsString(networks),
 			)
 		}
 
@@ -84,7 +85,7 @@ func parseRoutes(config *Config, network *net.IPNet) ([]route, error) {
 	return routes, nil
 }
 
-func parseUnsafeRoutes(config *Config, network *net.IPNet) ([]route, error) {
+func parseUnsafeRoutes(config *Config, networks []*net.IPNet) ([]route, error) {
 	var err error
 
 	r := config.Get("tun.unsafe_routes")
@@ -155,7 +156,7 @@ func parseUnsafeRoutes(config *Config, network *net.IPNet) ([]route, error) {
 			return nil, fmt.Errorf("entry %v.route in tun.unsafe_routes failed to parse: %v", i+1, err)
 		}
 
-		if ipWithin(network, r.route) {
+		if network := ipWithinAny(networks, r.route); network != nil {
 			return nil, fmt.Errorf(
 				"entry %v.route in tun.unsafe_routes is contained within the network attached to the certificate; route: %v, network: %v",
 				i+1,
@@ -177,14 +178,18 @@ func ipWithin(o *net.IPNet, i *net.IPNet) bool {
 	}
 
 	// Find the max ip in i
-	ip4 := i.IP.To4()
-	if ip4 == nil {
+	ip := i.IP.To4()
+	if ip == nil {
+		ip = i.IP.To16()
+	}
+
+	if ip == nil || len(ip) != len(i.Mask) {
 		return false
 	}
 
-	last := make(net.IP, len(ip4))
-	copy(last, ip4)
-	for x := range ip4 {
+	last := make(net.IP, len(ip))
+	copy(last, ip)
+	for x := range ip {
 		last[x] |= ^i.Mask[x]
 	}
 
@@ -195,3 +200,21 @@ func ipWithin(o *net.IPNet, i *net.IPNet) bool {
 
 	return true
 }
+
+// ipWithinAny returns the first network in o that entirely contains i, or nil if there is none
+func ipWithinAny(o []*net.IPNet, i *net.IPNet) *net.IPNet {
+	for _, n := range o {
+		if ipWithin(n, i) {
+			return n
+		}
+	}
+	return nil
+}
+
+func ipNetsString(n []*net.IPNet) string {
+	s := make([]string, len(n))
+	for i, v := range n {
+		s[i] = v.String()
+	}
+	return strings.Join(s, ", ")
+}
@@ -16,28 +16,28 @@ import (
 
 type Tun struct {
 	Device       string
-	Cidr         *net.IPNet
+	Cidrs        []*net.IPNet
 	MTU          int
 	UnsafeRoutes []route
 	l            *logrus.Logger
 	*water.Interface
 }
 
-func newTun(l *logrus.Logger, deviceName string, cidr *net.IPNet, defaultMTU int, routes []route, unsafeRoutes []route, txQueueLen int, multiqueue bool) (ifce *Tun, err error) {
+func newTun(l *logrus.Logger, deviceName string, cidrs []*net.IPNet, defaultMTU int, routes []route, unsafeRoutes []route, txQueueLen int, multiqueue bool) (ifce *Tun, err error) {
 	if len(routes) > 0 {
 		return nil, fmt.Errorf("route MTU not supported in Darwin")
 	}
 
 	// NOTE: You cannot set the deviceName under Darwin, so you must check tun.Device after calling .Activate()
 	return &Tun{
-		Cidr:         cidr,
+		Cidrs:        cidrs,
 		MTU:          defaultMTU,
 		UnsafeRoutes: unsafeRoutes,
 		l:            l,
 	}, nil
 }
 
-func newTunFromFd(l *logrus.Logger, deviceFd int, cidr *net.IPNet, defaultMTU int, routes []route, unsafeRoutes []route, txQueueLen int) (ifce *Tun, err error) {
+func newTunFromFd(l *logrus.Logger, deviceFd int, cidrs []*net.IPNet, defaultMTU int, routes []route, unsafeRoutes []route, txQueueLen int) (ifce *Tun, err error) {
 	return nil, fmt.Errorf("newTunFromFd not supported in Darwin")
 }
 
@@ -53,11 +53,27 @@ func (c *Tun) Activate() error {
 	c.Device = c.Interface.Name()
 
 	// TODO use syscalls instead of exec.Command
-	if err = exec.Command("/sbin/ifconfig", c.Device, c.Cidr.String(), c.Cidr.IP.String()).Run(); err != nil {
-		return fmt.Errorf("failed to run 'ifconfig': %s", err)
-	}
-	if err = exec.Command("/sbin/route", "-n", "add", "-net", c.Cidr.String(), "-interface", c.Device).Run(); err != nil {
-		return fmt.Errorf("failed to run 'route add': %s", err)
+	for i, cidr := range c.Cidrs {
+		family := "inet"
+		if cidr.IP.To4() == nil {
+			family = "inet6"
+		}
+
+		ifArgs := []string{c.Device, family, cidr.String()}
+		if family == "inet" {
+			// point to point interfaces want a destination address
+			ifArgs = append(ifArgs, cidr.IP.String())
+		}
+		if i > 0 {
+			ifArgs = append(ifArgs, "alias")
+		}
+
+		if err = exec.Command("/sbin/ifconfig", ifArgs...).Run(); err != nil {
+			return fmt.Errorf("failed to run 'ifconfig': %s", err)
+		}
+		if err = exec.Command("/sbin/route", "-n", "add", "-"+family, "-net", cidr.String(), "-interface", c.Device).Run(); err != nil {
+			return fmt.Errorf("failed to run 'route add': %s", err)
+		}
 	}
 	if err = exec.Command("/sbin/ifconfig", c.Device, "mtu", strconv.Itoa(c.MTU)).Run(); err != nil {
 		return fmt.Errorf("failed to run 'ifconfig': %s", err)
@@ -73,7 +89,7 @@ func (c *Tun) Activate() error {
 }
 
 func (c *Tun) CidrNet() *net.IPNet {
-	return c.Cidr
+	return c.Cidrs[0]
 }
 
 func (c *Tun) DeviceName() string {
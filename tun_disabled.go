@@ -12,8 +12,8 @@ import (
 )
 
 type disabledTun struct {
-	read chan []byte
-	cidr *net.IPNet
+	read  chan []byte
+	cidrs []*net.IPNet
 
 	// Track these metrics since we don't have the tun device to do it for us
 	tx metrics.Counter
@@ -21,11 +21,11 @@ type disabledTun struct {
 	l  *logrus.Logger
 }
 
-func newDisabledTun(cidr *net.IPNet, queueLen int, metricsEnabled bool, l *logrus.Logger) *disabledTun {
+func newDisabledTun(cidrs []*net.IPNet, queueLen int, metricsEnabled bool, l *logrus.Logger) *disabledTun {
 	tun := &disabledTun{
-		cidr: cidr,
-		read: make(chan []byte, queueLen),
-		l:    l,
+		cidrs: cidrs,
+		read:  make(chan []byte, queueLen),
+		l:     l,
 	}
 
 	if metricsEnabled {
@@ -44,7 +44,7 @@ func (*disabledTun) Activate() error {
 }
 
 func (t *disabledTun) CidrNet() *net.IPNet {
-	return t.cidr
+	return t.cidrs[0]
 }
 
 func (*disabledTun) DeviceName() string {
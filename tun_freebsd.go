@@ -19,7 +19,7 @@ var deviceNameRE = regexp.MustCompile(`^tun[0-9]+$`)
 
 type Tun struct {
 	Device       string
-	Cidr         *net.IPNet
+	Cidrs        []*net.IPNet
 	MTU          int
 	UnsafeRoutes []route
 	l            *logrus.Logger
@@ -27,11 +27,11 @@ type Tun struct {
 	io.ReadWriteCloser
 }
 
-func newTunFromFd(l *logrus.Logger, deviceFd int, cidr *net.IPNet, defaultMTU int, routes []route, unsafeRoutes []route, txQueueLen int) (ifce *Tun, err error) {
+func newTunFromFd(l *logrus.Logger, deviceFd int, cidrs []*net.IPNet, defaultMTU int, routes []route, unsafeRoutes []route, txQueueLen int) (ifce *Tun, err error) {
 	return nil, fmt.Errorf("newTunFromFd not supported in FreeBSD")
 }
 
-func newTun(l *logrus.Logger, deviceName string, cidr *net.IPNet, defaultMTU int, routes []route, unsafeRoutes []route, txQueueLen int, multiqueue bool) (ifce *Tun, err error) {
+func newTun(l *logrus.Logger, deviceName string, cidrs []*net.IPNet, defaultMTU int, routes []route, unsafeRoutes []route, txQueueLen int, multiqueue bool) (ifce *Tun, err error) {
 	if len(routes) > 0 {
 		return nil, fmt.Errorf("Route MTU not supported in FreeBSD")
 	}
@@ -43,7 +43,7 @@ func newTun(l *logrus.Logger, deviceName string, cidr *net.IPNet, defaultMTU int
 	}
 	return &Tun{
 		Device:       deviceName,
-		Cidr:         cidr,
+		Cidrs:        cidrs,
 		MTU:          defaultMTU,
 		UnsafeRoutes: unsafeRoutes,
 		l:            l,
@@ -58,13 +58,28 @@ func (c *Tun) Activate() error {
 	}
 
 	// TODO use syscalls instead of exec.Command
-	c.l.Debug("command: ifconfig", c.Device, c.Cidr.String(), c.Cidr.IP.String())
-	if err = exec.Command("/sbin/ifconfig", c.Device, c.Cidr.String(), c.Cidr.IP.String()).Run(); err != nil {
-		return fmt.Errorf("failed to run 'ifconfig': %s", err)
-	}
-	c.l.Debug("command: route", "-n", "add", "-net", c.Cidr.String(), "-interface", c.Device)
-	if err = exec.Command("/sbin/route", "-n", "add", "-net", c.Cidr.String(), "-interface", c.Device).Run(); err != nil {
-		return fmt.Errorf("failed to run 'route add': %s", err)
+	for i, cidr := range c.Cidrs {
+		family := "inet"
+		if cidr.IP.To4() == nil {
+			family = "inet6"
+		}
+
+		ifArgs := []string{c.Device, family, cidr.String()}
+		if family == "inet" {
+			ifArgs = append(ifArgs, cidr.IP.String())
+		}
+		if i > 0 {
+			ifArgs = append(ifArgs, "alias")
+		}
+
+		c.l.Debug("command: ifconfig", ifArgs)
+		if err = exec.Command("/sbin/ifconfig", ifArgs...).Run(); err != nil {
+			return fmt.Errorf("failed to run 'ifconfig': %s", err)
+		}
+		c.l.Debug("command: route", "-n", "add", "-"+family, "-net", cidr.String(), "-interface", c.Device)
+		if err = exec.Command("/sbin/route", "-n", "add", "-"+family, "-net", cidr.String(), "-interface", c.Device).Run(); err != nil {
+			return fmt.Errorf("failed to run 'route add': %s", err)
+		}
 	}
 	c.l.Debug("command: ifconfig", c.Device, "mtu", strconv.Itoa(c.MTU))
 	if err = exec.Command("/sbin/ifconfig", c.Device, "mtu", strconv.Itoa(c.MTU)).Run(); err != nil {
@@ -82,7 +97,7 @@ func (c *Tun) Activate() error {
 }
 
 func (c *Tun) CidrNet() *net.IPNet {
-	return c.Cidr
+	return c.Cidrs[0]
 }
 
 func (c *Tun) DeviceName() string {
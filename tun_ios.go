@@ -18,21 +18,21 @@ import (
 type Tun struct {
 	io.ReadWriteCloser
 	Device string
-	Cidr   *net.IPNet
+	Cidrs  []*net.IPNet
 }
 
-func newTun(l *logrus.Logger, deviceName string, cidr *net.IPNet, defaultMTU int, routes []route, unsafeRoutes []route, txQueueLen int, multiqueue bool) (ifce *Tun, err error) {
+func newTun(l *logrus.Logger, deviceName string, cidrs []*net.IPNet, defaultMTU int, routes []route, unsafeRoutes []route, txQueueLen int, multiqueue bool) (ifce *Tun, err error) {
 	return nil, fmt.Errorf("newTun not supported in iOS")
 }
 
-func newTunFromFd(l *logrus.Logger, deviceFd int, cidr *net.IPNet, defaultMTU int, routes []route, unsafeRoutes []route, txQueueLen int) (ifce *Tun, err error) {
+func newTunFromFd(l *logrus.Logger, deviceFd int, cidrs []*net.IPNet, defaultMTU int, routes []route, unsafeRoutes []route, txQueueLen int) (ifce *Tun, err error) {
 	if len(routes) > 0 {
 		return nil, fmt.Errorf("route MTU not supported in Darwin")
 	}
 
 	file := os.NewFile(uintptr(deviceFd), "/dev/tun")
 	ifce = &Tun{
-		Cidr:            cidr,
+		Cidrs:           cidrs,
 		Device:          "iOS",
 		ReadWriteCloser: &tunReadCloser{f: file},
 	}
@@ -108,7 +108,7 @@ func (t *tunReadCloser) Close() error {
 }
 
 func (c *Tun) CidrNet() *net.IPNet {
-	return c.Cidr
+	return c.Cidrs[0]
 }
 
 func (c *Tun) DeviceName() string {
@@ -20,7 +20,7 @@ type Tun struct {
 	io.ReadWriteCloser
 	fd           int
 	Device       string
-	Cidr         *net.IPNet
+	Cidrs        []*net.IPNet
 	MaxMTU       int
 	DefaultMTU   int
 	TXQueueLen   int
@@ -81,7 +81,7 @@ type ifreqQLEN struct {
 	pad   [8]byte
 }
 
-func newTunFromFd(l *logrus.Logger, deviceFd int, cidr *net.IPNet, defaultMTU int, routes []route, unsafeRoutes []route, txQueueLen int) (ifce *Tun, err error) {
+func newTunFromFd(l *logrus.Logger, deviceFd int, cidrs []*net.IPNet, defaultMTU int, routes []route, unsafeRoutes []route, txQueueLen int) (ifce *Tun, err error) {
 
 	file := os.NewFile(uintptr(deviceFd), "/dev/net/tun")
 
@@ -89,7 +89,7 @@ func newTunFromFd(l *logrus.Logger, deviceFd int, cidr *net.IPNet, defaultMTU in
 		ReadWriteCloser: file,
 		fd:              int(file.Fd()),
 		Device:          "tun0",
-		Cidr:            cidr,
+		Cidrs:           cidrs,
 		DefaultMTU:      defaultMTU,
 		TXQueueLen:      txQueueLen,
 		Routes:          routes,
@@ -99,7 +99,7 @@ func newTunFromFd(l *logrus.Logger, deviceFd int, cidr *net.IPNet, defaultMTU in
 	return
 }
 
-func newTun(l *logrus.Logger, deviceName string, cidr *net.IPNet, defaultMTU int, routes []route, unsafeRoutes []route, txQueueLen int, multiqueue bool) (ifce *Tun, err error) {
+func newTun(l *logrus.Logger, deviceName string, cidrs []*net.IPNet, defaultMTU int, routes []route, unsafeRoutes []route, txQueueLen int, multiqueue bool) (ifce *Tun, err error) {
 	fd, err := unix.Open("/dev/net/tun", os.O_RDWR, 0)
 	if err != nil {
 		return nil, err
@@ -129,7 +129,7 @@ func newTun(l *logrus.Logger, deviceName string, cidr *net.IPNet, defaultMTU int
 		ReadWriteCloser: file,
 		fd:              int(file.Fd()),
 		Device:          name,
-		Cidr:            cidr,
+		Cidrs:           cidrs,
 		MaxMTU:          maxMTU,
 		DefaultMTU:      defaultMTU,
 		TXQueueLen:      txQueueLen,
@@ -194,11 +194,6 @@ func (c Tun) deviceBytes() (o [16]byte) {
 func (c Tun) Activate() error {
 	devName := c.deviceBytes()
 
-	var addr, mask [4]byte
-
-	copy(addr[:], c.Cidr.IP.To4())
-	copy(mask[:], c.Cidr.Mask)
-
 	s, err := unix.Socket(
 		unix.AF_INET,
 		unix.SOCK_DGRAM,
@@ -209,23 +204,39 @@ func (c Tun) Activate() error {
 	}
 	fd := uintptr(s)
 
-	ifra := ifreqAddr{
-		Name: devName,
-		Addr: unix.RawSockaddrInet4{
-			Family: unix.AF_INET,
-			Addr:   addr,
-		},
-	}
+	// The first ipv4 network is assigned with ioctls, anything else is added with netlink once the device is up
+	var extraCidrs []*net.IPNet
+	var haveV4 bool
+	for _, cidr := range c.Cidrs {
+		ip4 := cidr.IP.To4()
+		if ip4 == nil || haveV4 {
+			extraCidrs = append(extraCidrs, cidr)
+			continue
+		}
+		haveV4 = true
+
+		var addr, mask [4]byte
+		copy(addr[:], ip4)
+		copy(mask[:], cidr.Mask[len(cidr.Mask)-4:])
+
+		ifra := ifreqAddr{
+			Name: devName,
+			Addr: unix.RawSockaddrInet4{
+				Family: unix.AF_INET,
+				Addr:   addr,
+			},
+		}
 
-	// Set the device ip address
-	if err = ioctl(fd, unix.SIOCSIFADDR, uintptr(unsafe.Pointer(&ifra))); err != nil {
-		return fmt.Errorf("failed to set tun address: %s", err)
-	}
+		// Set the device ip address
+		if err = ioctl(fd, unix.SIOCSIFADDR, uintptr(unsafe.Pointer(&ifra))); err != nil {
+			return fmt.Errorf("failed to set tun address: %s", err)
+		}
 
-	// Set the device network
-	ifra.Addr.Addr = mask
-	if err = ioctl(fd, unix.SIOCSIFNETMASK, uintptr(unsafe.Pointer(&ifra))); err != nil {
-		return fmt.Errorf("failed to set tun netmask: %s", err)
+		// Set the device network
+		ifra.Addr.Addr = mask
+		if err = ioctl(fd, unix.SIOCSIFNETMASK, uintptr(unsafe.Pointer(&ifra))); err != nil {
+			return fmt.Errorf("failed to set tun netmask: %s", err)
+		}
 	}
 
 	// Set the device name
@@ -260,22 +271,32 @@ func (c Tun) Activate() error {
 		return fmt.Errorf("failed to get tun device link: %s", err)
 	}
 
-	// Default route
-	dr := &net.IPNet{IP: c.Cidr.IP.Mask(c.Cidr.Mask), Mask: c.Cidr.Mask}
-	nr := netlink.Route{
-		LinkIndex: link.Attrs().Index,
-		Dst:       dr,
-		MTU:       c.DefaultMTU,
-		AdvMSS:    c.advMSS(route{}),
-		Scope:     unix.RT_SCOPE_LINK,
-		Src:       c.Cidr.IP,
-		Protocol:  unix.RTPROT_KERNEL,
-		Table:     unix.RT_TABLE_MAIN,
-		Type:      unix.RTN_UNICAST,
+	// Assign the remaining addresses, duplicate address detection is pointless on a tun device
+	for _, cidr := range extraCidrs {
+		err = netlink.AddrReplace(link, &netlink.Addr{IPNet: cidr, Flags: unix.IFA_F_NODAD})
+		if err != nil {
+			return fmt.Errorf("failed to set tun address %v; %v", cidr, err)
+		}
 	}
-	err = netlink.RouteReplace(&nr)
-	if err != nil {
-		return fmt.Errorf("failed to set mtu %v on the default route %v; %v", c.DefaultMTU, dr, err)
+
+	// Default routes
+	for _, cidr := range c.Cidrs {
+		dr := &net.IPNet{IP: cidr.IP.Mask(cidr.Mask), Mask: cidr.Mask}
+		nr := netlink.Route{
+			LinkIndex: link.Attrs().Index,
+			Dst:       dr,
+			MTU:       c.DefaultMTU,
+			AdvMSS:    c.advMSS(route{}),
+			Scope:     unix.RT_SCOPE_LINK,
+			Src:       cidr.IP,
+			Protocol:  unix.RTPROT_KERNEL,
+			Table:     unix.RT_TABLE_MAIN,
+			Type:      unix.RTN_UNICAST,
+		}
+		err = netlink.RouteReplace(&nr)
+		if err != nil {
+			return fmt.Errorf("failed to set mtu %v on the default route %v; %v", c.DefaultMTU, dr, err)
+		}
 	}
 
 	// Path routes
@@ -320,7 +341,7 @@ func (c Tun) Activate() error {
 }
 
 func (c *Tun) CidrNet() *net.IPNet {
-	return c.Cidr
+	return c.Cidrs[0]
 }
 
 func (c *Tun) DeviceName() string {
@@ -12,7 +12,7 @@ import (
 
 type Tun struct {
 	Device       string
-	Cidr         *net.IPNet
+	Cidrs        []*net.IPNet
 	MTU          int
 	UnsafeRoutes []route
 	l            *logrus.Logger
@@ -21,10 +21,10 @@ type Tun struct {
 	txPackets chan []byte // Packets transmitted outside by nebula
 }
 
-func newTun(l *logrus.Logger, deviceName string, cidr *net.IPNet, defaultMTU int, _ []route, unsafeRoutes []route, _ int, _ bool) (ifce *Tun, err error) {
+func newTun(l *logrus.Logger, deviceName string, cidrs []*net.IPNet, defaultMTU int, _ []route, unsafeRoutes []route, _ int, _ bool) (ifce *Tun, err error) {
 	return &Tun{
 		Device:       deviceName,
-		Cidr:         cidr,
+		Cidrs:        cidrs,
 		MTU:          defaultMTU,
 		UnsafeRoutes: unsafeRoutes,
 		l:            l,
@@ -33,7 +33,7 @@ func newTun(l *logrus.Logger, deviceName string, cidr *net.IPNet, defaultMTU int
 	}, nil
 }
 
-func newTunFromFd(_ *logrus.Logger, _ int, _ *net.IPNet, _ int, _ []route, _ []route, _ int) (ifce *Tun, err error) {
+func newTunFromFd(_ *logrus.Logger, _ int, _ []*net.IPNet, _ int, _ []route, _ []route, _ int) (ifce *Tun, err error) {
 	return nil, fmt.Errorf("newTunFromFd not supported")
 }
 
@@ -70,7 +70,7 @@ func (c *Tun) Activate() error {
 }
 
 func (c *Tun) CidrNet() *net.IPNet {
-	return c.Cidr
+	return c.Cidrs[0]
 }
 
 func (c *Tun) DeviceName() string {
@@ -15,7 +15,7 @@ import (
 
 type Tun struct {
 	Device       string
-	Cidr         *net.IPNet
+	Cidrs        []*net.IPNet
 	MTU          int
 	UnsafeRoutes []route
 	l            *logrus.Logger
@@ -23,18 +23,22 @@ type Tun struct {
 	*water.Interface
 }
 
-func newTunFromFd(l *logrus.Logger, deviceFd int, cidr *net.IPNet, defaultMTU int, routes []route, unsafeRoutes []route, txQueueLen int) (ifce *Tun, err error) {
+func newTunFromFd(l *logrus.Logger, deviceFd int, cidrs []*net.IPNet, defaultMTU int, routes []route, unsafeRoutes []route, txQueueLen int) (ifce *Tun, err error) {
 	return nil, fmt.Errorf("newTunFromFd not supported in Windows")
 }
 
-func newTun(l *logrus.Logger, deviceName string, cidr *net.IPNet, defaultMTU int, routes []route, unsafeRoutes []route, txQueueLen int, multiqueue bool) (ifce *Tun, err error) {
+func newTun(l *logrus.Logger, deviceName string, cidrs []*net.IPNet, defaultMTU int, routes []route, unsafeRoutes []route, txQueueLen int, multiqueue bool) (ifce *Tun, err error) {
 	if len(routes) > 0 {
 		return nil, fmt.Errorf("route MTU not supported in Windows")
 	}
 
+	if len(cidrs) > 1 || cidrs[0].IP.To4() == nil {
+		return nil, fmt.Errorf("only a single ipv4 vpn network is supported in Windows")
+	}
+
 	// NOTE: You cannot set the deviceName under Windows, so you must check tun.Device after calling .Activate()
 	return &Tun{
-		Cidr:         cidr,
+		Cidrs:        cidrs,
 		MTU:          defaultMTU,
 		UnsafeRoutes: unsafeRoutes,
 		l:            l,
@@ -47,7 +51,7 @@ func (c *Tun) Activate() error {
 		DeviceType: water.TUN,
 		PlatformSpecificParams: water.PlatformSpecificParams{
 			ComponentID: "tap0901",
-			Network:     c.Cidr.String(),
+			Network:     c.Cidrs[0].String(),
 		},
 	})
 	if err != nil {
@@ -61,8 +65,8 @@ func (c *Tun) Activate() error {
 		`C:\Windows\System32\netsh.exe`, "interface", "ipv4", "set", "address",
 		fmt.Sprintf("name=%s", c.Device),
 		"source=static",
-		fmt.Sprintf("addr=%s", c.Cidr.IP),
-		fmt.Sprintf("mask=%s", net.IP(c.Cidr.Mask)),
+		fmt.Sprintf("addr=%s", c.Cidrs[0].IP),
+		fmt.Sprintf("mask=%s", net.IP(c.Cidrs[0].Mask)),
 		"gateway=none",
 	).Run()
 	if err != nil {
@@ -95,7 +99,7 @@ func (c *Tun) Activate() error {
 }
 
 func (c *Tun) CidrNet() *net.IPNet {
-	return c.Cidr
+	return c.Cidrs[0]
 }
 
 func (c *Tun) DeviceName() string {
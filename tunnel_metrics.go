@@ -0,0 +1,213 @@
+package nebula
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// tunnelStats holds the counters for a single tunnel. They are keyed by vpn ip so they survive a re-handshake.
+// All methods are safe to call on a nil tunnelStats, which is what a tunnel gets when it is not being tracked
+type tunnelStats struct {
+	atomicRxBytes    uint64
+	atomicTxBytes    uint64
+	atomicRxPackets  uint64
+	atomicTxPackets  uint64
+	atomicHandshakes uint64
+	atomicLastSeen   int64 // Unix nanoseconds of the last authenticated packet
+	atomicTCPRTT     int64 // Nanoseconds, the last round trip time measured by the firewall
+}
+
+func (ts *tunnelStats) rx(n int) {
+	if ts == nil {
+		return
+	}
+
+	atomic.AddUint64(&ts.atomicRxBytes, uint64(n))
+	atomic.AddUint64(&ts.atomicRxPackets, 1)
+	atomic.StoreInt64(&ts.atomicLastSeen, time.Now().UnixNano())
+}
+
+func (ts *tunnelStats) tx(n int) {
+	if ts == nil {
+		return
+	}
+
+	atomic.AddUint64(&ts.atomicTxBytes, uint64(n))
+	atomic.AddUint64(&ts.atomicTxPackets, 1)
+}
+
+func (ts *tunnelStats) setTCPRTT(d time.Duration) {
+	if ts == nil {
+		return
+	}
+
+	atomic.StoreInt64(&ts.atomicTCPRTT, int64(d))
+}
+
+// tunnelMetrics exports per tunnel metrics to prometheus, go-metrics has no way to label a metric with the peer.
+// Only maxTunnels are tracked at once to keep the number of series in check
+type tunnelMetrics struct {
+	sync.RWMutex
+	hostMap    *HostMap
+	maxTunnels int
+	tunnels    map[VpnIp]*tunnelStats
+
+	rxBytes    *prometheus.Desc
+	txBytes    *prometheus.Desc
+	rxPackets  *prometheus.Desc
+	txPackets  *prometheus.Desc
+	handshakes *prometheus.Desc
+	lastSeen   *prometheus.Desc
+	tcpRTT     *prometheus.Desc
+	remote     *prometheus.Desc
+	untracked  *prometheus.Desc
+}
+
+func newTunnelMetrics(hostMap *HostMap, maxTunnels int, namespace, subsystem string) *tunnelMetrics {
+	labels := []string{"vpn_ip", "cert_name"}
+	desc := func(name, help string, labels []string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName(namespace, subsystem, name), help, labels, nil)
+	}
+
+	return &tunnelMetrics{
+		hostMap:    hostMap,
+		maxTunnels: maxTunnels,
+		tunnels:    map[VpnIp]*tunnelStats{},
+
+		rxBytes:    desc("tunnel_rx_bytes_total", "Bytes received on the tunnel, including nebula overhead", labels),
+		txBytes:    desc("tunnel_tx_bytes_total", "Bytes sent on the tunnel, including nebula overhead", labels),
+		rxPackets:  desc("tunnel_rx_packets_total", "Packets received on the tunnel", labels),
+		txPackets:  desc("tunnel_tx_packets_total", "Packets sent on the tunnel", labels),
+		handshakes: desc("tunnel_handshakes_total", "Handshakes completed with the peer", labels),
+		lastSeen:   desc("tunnel_last_seen_timestamp_seconds", "When the last packet was received from the peer", labels),
+		tcpRTT:     desc("tunnel_tcp_rtt_seconds", "The last tcp round trip time measured by the firewall", labels),
+		remote:     desc("tunnel_remote_info", "The kind of address the tunnel is using to reach the peer", append(labels, "type")),
+		untracked:  desc("tunnels_untracked", "Tunnels without metrics because the max_tunnels limit was reached", nil),
+	}
+}
+
+// handshake records a completed handshake and returns the stats for the tunnel, or nil if we are already tracking the
+// max number of tunnels
+func (tm *tunnelMetrics) handshake(vpnIp VpnIp) *tunnelStats {
+	if tm == nil {
+		return nil
+	}
+
+	tm.Lock()
+	defer tm.Unlock()
+
+	ts, ok := tm.tunnels[vpnIp]
+	if !ok {
+		if len(tm.tunnels) >= tm.maxTunnels {
+			return nil
+		}
+
+		ts = &tunnelStats{}
+		tm.tunnels[vpnIp] = ts
+	}
+
+	atomic.AddUint64(&ts.atomicHandshakes, 1)
+	return ts
+}
+
+// remove stops tracking the tunnel, freeing a slot for another
+func (tm *tunnelMetrics) remove(vpnIp VpnIp) {
+	if tm == nil {
+		return
+	}
+
+	tm.Lock()
+	delete(tm.tunnels, vpnIp)
+	tm.Unlock()
+}
+
+func (tm *tunnelMetrics) Describe(ch chan<- *prometheus.Desc) {
+	ch <- tm.rxBytes
+	ch <- tm.txBytes
+	ch <- tm.rxPackets
+	ch <- tm.txPackets
+	ch <- tm.handshakes
+	ch <- tm.lastSeen
+	ch <- tm.tcpRTT
+	ch <- tm.remote
+	ch <- tm.untracked
+}
+
+func (tm *tunnelMetrics) Collect(ch chan<- prometheus.Metric) {
+	// Copy the tunnels out so we never hold our lock while taking the hostmap lock, addHostInfo does the opposite
+	tm.RLock()
+	tunnels := make(map[VpnIp]*tunnelStats, len(tm.tunnels))
+	for vpnIp, ts := range tm.tunnels {
+		tunnels[vpnIp] = ts
+	}
+	tm.RUnlock()
+
+	tm.hostMap.RLock()
+	untracked := 0
+	hosts := make(map[VpnIp]*HostInfo, len(tunnels))
+	for vpnIp, h := range tm.hostMap.Hosts {
+		if _, ok := tunnels[vpnIp]; ok {
+			hosts[vpnIp] = h
+		} else {
+			untracked++
+		}
+	}
+	tm.hostMap.RUnlock()
+
+	ch <- prometheus.MustNewConstMetric(tm.untracked, prometheus.GaugeValue, float64(untracked))
+
+	for vpnIp, ts := range tunnels {
+		h, ok := hosts[vpnIp]
+		if !ok {
+			// The tunnel went away since we copied
+			continue
+		}
+
+		certName := ""
+		if c := h.GetCert(); c != nil {
+			certName = c.Details.Name
+		}
+
+		labels := []string{vpnIp.String(), certName}
+		counter := func(d *prometheus.Desc, v *uint64) {
+			ch <- prometheus.MustNewConstMetric(d, prometheus.CounterValue, float64(atomic.LoadUint64(v)), labels...)
+		}
+
+		counter(tm.rxBytes, &ts.atomicRxBytes)
+		counter(tm.txBytes, &ts.atomicTxBytes)
+		counter(tm.rxPackets, &ts.atomicRxPackets)
+		counter(tm.txPackets, &ts.atomicTxPackets)
+		counter(tm.handshakes, &ts.atomicHandshakes)
+
+		if lastSeen := atomic.LoadInt64(&ts.atomicLastSeen); lastSeen > 0 {
+			ch <- prometheus.MustNewConstMetric(tm.lastSeen, prometheus.GaugeValue, float64(lastSeen)/float64(time.Second), labels...)
+		}
+
+		if rtt := atomic.LoadInt64(&ts.atomicTCPRTT); rtt > 0 {
+			ch <- prometheus.MustNewConstMetric(tm.tcpRTT, prometheus.GaugeValue, time.Duration(rtt).Seconds(), labels...)
+		}
+
+		ch <- prometheus.MustNewConstMetric(tm.remote, prometheus.GaugeValue, 1, append(labels, remoteType(h))...)
+	}
+}
+
+// remoteType describes how we are currently reaching the host
+func remoteType(h *HostInfo) string {
+	h.RLock()
+	remote := h.remote
+	h.RUnlock()
+
+	switch {
+	case remote != nil && remote.IP.To4() != nil:
+		return "ipv4"
+	case remote != nil:
+		return "ipv6"
+	case len(h.relayState.CopyRelayIps()) > 0:
+		return "relay"
+	default:
+		return "none"
+	}
+}
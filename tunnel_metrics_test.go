@@ -0,0 +1,101 @@
+package nebula
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/slackhq/nebula/cert"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTunnelMetrics(t *testing.T) {
+	l := NewTestLogger()
+	hm := NewHostMap(l, "test", []*net.IPNet{}, []*net.IPNet{})
+	hm.tunnelMetrics = newTunnelMetrics(hm, 1, "nebula", "")
+	f := &Interface{}
+
+	newHost := func(ip net.IP, idx uint32) *HostInfo {
+		return &HostInfo{
+			hostId:       NewVpnIp(ip),
+			localIndexId: idx,
+			remote:       NewUDPAddr(net.IPv4(192, 168, 0, 1), 4242),
+			ConnectionState: &ConnectionState{
+				peerCert: &cert.NebulaCertificate{Details: cert.NebulaCertificateDetails{Name: "host-a"}},
+			},
+		}
+	}
+	a := newHost(net.IPv4(10, 0, 0, 1), 1)
+	b := newHost(net.IPv4(10, 0, 0, 2), 2)
+
+	hm.Lock()
+	hm.addHostInfo(a, f)
+	hm.addHostInfo(b, f)
+	hm.Unlock()
+
+	// Only one tunnel fits, the other is left untracked and its stats are safe to use
+	assert.NotNil(t, a.stats)
+	assert.Nil(t, b.stats)
+	b.stats.rx(100)
+	b.stats.tx(100)
+	b.stats.setTCPRTT(time.Second)
+
+	a.stats.rx(100)
+	a.stats.rx(50)
+	a.stats.tx(10)
+	a.stats.setTCPRTT(time.Millisecond * 250)
+
+	// A re-handshake keeps the counters
+	a2 := newHost(net.IPv4(10, 0, 0, 1), 3)
+	hm.Lock()
+	hm.addHostInfo(a2, f)
+	hm.Unlock()
+	assert.Equal(t, a.stats, a2.stats)
+
+	expected := `
+# HELP nebula_tunnel_handshakes_total Handshakes completed with the peer
+# TYPE nebula_tunnel_handshakes_total counter
+nebula_tunnel_handshakes_total{cert_name="host-a",vpn_ip="10.0.0.1"} 2
+# HELP nebula_tunnel_remote_info The kind of address the tunnel is using to reach the peer
+# TYPE nebula_tunnel_remote_info gauge
+nebula_tunnel_remote_info{cert_name="host-a",type="ipv4",vpn_ip="10.0.0.1"} 1
+# HELP nebula_tunnel_rx_bytes_total Bytes received on the tunnel, including nebula overhead
+# TYPE nebula_tunnel_rx_bytes_total counter
+nebula_tunnel_rx_bytes_total{cert_name="host-a",vpn_ip="10.0.0.1"} 150
+# HELP nebula_tunnel_rx_packets_total Packets received on the tunnel
+# TYPE nebula_tunnel_rx_packets_total counter
+nebula_tunnel_rx_packets_total{cert_name="host-a",vpn_ip="10.0.0.1"} 2
+# HELP nebula_tunnel_tcp_rtt_seconds The last tcp round trip time measured by the firewall
+# TYPE nebula_tunnel_tcp_rtt_seconds gauge
+nebula_tunnel_tcp_rtt_seconds{cert_name="host-a",vpn_ip="10.0.0.1"} 0.25
+# HELP nebula_tunnel_tx_bytes_total Bytes sent on the tunnel, including nebula overhead
+# TYPE nebula_tunnel_tx_bytes_total counter
+nebula_tunnel_tx_bytes_total{cert_name="host-a",vpn_ip="10.0.0.1"} 10
+# HELP nebula_tunnel_tx_packets_total Packets sent on the tunnel
+# TYPE nebula_tunnel_tx_packets_total counter
+nebula_tunnel_tx_packets_total{cert_name="host-a",vpn_ip="10.0.0.1"} 1
+# HELP nebula_tunnels_untracked Tunnels without metrics because the max_tunnels limit was reached
+# TYPE nebula_tunnels_untracked gauge
+nebula_tunnels_untracked 1
+`
+	assert.NoError(t, testutil.CollectAndCompare(hm.tunnelMetrics, strings.NewReader(expected),
+		"nebula_tunnel_handshakes_total",
+		"nebula_tunnel_remote_info",
+		"nebula_tunnel_rx_bytes_total",
+		"nebula_tunnel_rx_packets_total",
+		"nebula_tunnel_tcp_rtt_seconds",
+		"nebula_tunnel_tx_bytes_total",
+		"nebula_tunnel_tx_packets_total",
+		"nebula_tunnels_untracked",
+	))
+
+	// Closing the tunnel frees its slot
+	hm.DeleteHostInfo(a2)
+	hm.Lock()
+	hm.addHostInfo(b, f)
+	hm.Unlock()
+	assert.NotNil(t, b.stats)
+	assert.NotEqual(t, a.stats, b.stats)
+}
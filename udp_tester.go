@@ -116,7 +116,7 @@ func (u *udpConn) ListenOut(f *Interface, q int) {
 		p := <-u.rxPackets
 		ua.Port = p.FromPort
 		copy(ua.IP, p.FromIp.To16())
-		f.readOutsidePackets(ua, plaintext[:0], p.Data, header, fwPacket, lhh, nb, q, conntrackCache.Get(u.l))
+		f.readOutsidePackets(ua, nil, plaintext[:0], p.Data, header, fwPacket, lhh, nb, q, conntrackCache.Get(u.l))
 	}
 }
 
@@ -0,0 +1,112 @@
+package nebula
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+)
+
+// VpnIp is an overlay address of either family. ipv4 addresses are held in their ipv4-mapped ipv6 form
+// (::ffff:a.b.c.d) which keeps the type comparable and usable as a map key.
+type VpnIp struct {
+	Hi uint64
+	Lo uint64
+}
+
+const v4MappedPrefix = uint64(0xffff) << 32
+
+// NewVpnIp converts a net.IP into a VpnIp, a nil or malformed ip results in the zero value
+func NewVpnIp(ip net.IP) VpnIp {
+	if ip4 := ip.To4(); ip4 != nil {
+		return NewVpnIp4(binary.BigEndian.Uint32(ip4))
+	}
+
+	if len(ip) != net.IPv6len {
+		return VpnIp{}
+	}
+
+	return VpnIp{
+		Hi: binary.BigEndian.Uint64(ip[:8]),
+		Lo: binary.BigEndian.Uint64(ip[8:]),
+	}
+}
+
+// NewVpnIp4 converts a big endian ipv4 address into a VpnIp
+func NewVpnIp4(ip uint32) VpnIp {
+	return VpnIp{Lo: v4MappedPrefix | uint64(ip)}
+}
+
+// Is4 returns true if this is an ipv4 address
+func (ip VpnIp) Is4() bool {
+	return ip.Hi == 0 && ip.Lo&^0xffffffff == v4MappedPrefix
+}
+
+// To4 returns the ipv4 address as a big endian integer, the result is only meaningful if Is4() is true
+func (ip VpnIp) To4() uint32 {
+	return uint32(ip.Lo)
+}
+
+// ToIP returns a 4 byte net.IP for ipv4 addresses and a 16 byte net.IP otherwise
+func (ip VpnIp) ToIP() net.IP {
+	if ip.Is4() {
+		return int2ip(ip.To4())
+	}
+
+	b := make(net.IP, net.IPv6len)
+	binary.BigEndian.PutUint64(b[:8], ip.Hi)
+	binary.BigEndian.PutUint64(b[8:], ip.Lo)
+	return b
+}
+
+// Less provides a total ordering over overlay addresses
+func (ip VpnIp) Less(o VpnIp) bool {
+	if ip.Hi != o.Hi {
+		return ip.Hi < o.Hi
+	}
+	return ip.Lo < o.Lo
+}
+
+// IsUnspecified returns true for 0.0.0.0 and ::, the zero value counts as :: since that is what it holds
+func (ip VpnIp) IsUnspecified() bool {
+	return ip == VpnIp{} || ip == NewVpnIp4(0)
+}
+
+// IsMulticast returns true if the address is ipv4 multicast (224.0.0.0/4) or ipv6 multicast (ff00::/8)
+func (ip VpnIp) IsMulticast() bool {
+	if ip.Is4() {
+		return ip.To4()&0xf0000000 == 0xe0000000
+	}
+	return ip.Hi>>56 == 0xff
+}
+
+func (ip VpnIp) String() string {
+	return ip.ToIP().String()
+}
+
+func (ip VpnIp) MarshalJSON() ([]byte, error) {
+	return []byte(fmt.Sprintf("\"%s\"", ip.String())), nil
+}
+
+// vpnNetContains reports if the ip is within any of the provided networks
+func vpnNetContains(nets []*net.IPNet, ip VpnIp) bool {
+	nip := ip.ToIP()
+	for _, n := range nets {
+		if n.Contains(nip) {
+			return true
+		}
+	}
+	return false
+}
+
+// NewVpnAddr converts a VpnIp into its protobuf form
+func NewVpnAddr(ip VpnIp) *VpnAddr {
+	return &VpnAddr{Hi: ip.Hi, Lo: ip.Lo}
+}
+
+// vpnIp converts the protobuf form back into a VpnIp, a nil address results in the zero value
+func (a *VpnAddr) vpnIp() VpnIp {
+	if a == nil {
+		return VpnIp{}
+	}
+	return VpnIp{Hi: a.Hi, Lo: a.Lo}
+}
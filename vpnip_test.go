@@ -0,0 +1,67 @@
+package nebula
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewVpnIp(t *testing.T) {
+	ip := NewVpnIp(net.ParseIP("10.1.2.3"))
+	assert.True(t, ip.Is4())
+	assert.Equal(t, ip2int(net.ParseIP("10.1.2.3")), ip.To4())
+	assert.Equal(t, NewVpnIp4(ip2int(net.ParseIP("10.1.2.3"))), ip)
+	assert.Equal(t, NewVpnIp(net.IP{10, 1, 2, 3}), ip)
+	assert.Equal(t, net.IP{10, 1, 2, 3}, ip.ToIP())
+	assert.Equal(t, "10.1.2.3", ip.String())
+
+	ip = NewVpnIp(net.ParseIP("fd00::1:2"))
+	assert.False(t, ip.Is4())
+	assert.Equal(t, VpnIp{Hi: 0xfd00000000000000, Lo: 0x10002}, ip)
+	assert.Equal(t, net.ParseIP("fd00::1:2"), ip.ToIP())
+	assert.Equal(t, "fd00::1:2", ip.String())
+
+	// An ipv6 address that happens to share the low bits of an ipv4 address must not collide
+	assert.NotEqual(t, NewVpnIp(net.ParseIP("::a01:203")), NewVpnIp(net.ParseIP("10.1.2.3")))
+	assert.False(t, NewVpnIp(net.ParseIP("::a01:203")).Is4())
+
+	assert.Equal(t, VpnIp{}, NewVpnIp(nil))
+	assert.Equal(t, VpnIp{}, NewVpnIp(net.IP{1, 2, 3}))
+}
+
+func TestVpnIp_Less(t *testing.T) {
+	a := NewVpnIp(net.ParseIP("10.0.0.1"))
+	b := NewVpnIp(net.ParseIP("10.0.0.2"))
+	c := NewVpnIp(net.ParseIP("fd00::1"))
+
+	assert.True(t, a.Less(b))
+	assert.False(t, b.Less(a))
+	assert.False(t, a.Less(a))
+	assert.True(t, b.Less(c))
+	assert.False(t, c.Less(a))
+}
+
+func TestVpnIp_IsMulticast(t *testing.T) {
+	assert.True(t, NewVpnIp(net.ParseIP("224.0.0.1")).IsMulticast())
+	assert.True(t, NewVpnIp(net.ParseIP("239.255.255.255")).IsMulticast())
+	assert.False(t, NewVpnIp(net.ParseIP("10.0.0.1")).IsMulticast())
+	assert.True(t, NewVpnIp(net.ParseIP("ff02::1")).IsMulticast())
+	assert.False(t, NewVpnIp(net.ParseIP("fd00::1")).IsMulticast())
+}
+
+func TestVpnIp_IsUnspecified(t *testing.T) {
+	assert.True(t, NewVpnIp(net.ParseIP("0.0.0.0")).IsUnspecified())
+	assert.True(t, NewVpnIp(net.ParseIP("::")).IsUnspecified())
+	assert.True(t, VpnIp{}.IsUnspecified())
+	assert.False(t, NewVpnIp(net.ParseIP("10.0.0.1")).IsUnspecified())
+	assert.False(t, NewVpnIp(net.ParseIP("::1")).IsUnspecified())
+	assert.False(t, NewVpnIp(net.ParseIP("::ffff:0:1")).IsUnspecified())
+}
+
+func TestVpnIp_MarshalJSON(t *testing.T) {
+	b, err := json.Marshal(m{"a": NewVpnIp(net.ParseIP("10.0.0.1")), "b": NewVpnIp(net.ParseIP("fd00::1"))})
+	assert.Nil(t, err)
+	assert.Equal(t, `{"a":"10.0.0.1","b":"fd00::1"}`, string(b))
+}